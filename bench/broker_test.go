@@ -0,0 +1,141 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"kv/broker"
+	"kv/kvstore"
+	"kv/transport"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// brokerStores is the number of stores behind the broker in the routing benchmarks.
+const brokerStores = 3
+
+// countingTransport counts the requests made through it to one route, and
+// delays them as the network would.
+type countingTransport struct {
+	transport.Transport
+	route   string
+	latency time.Duration
+	n       atomic.Int64
+}
+
+func (t *countingTransport) Do(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, t.route) {
+		t.n.Add(1)
+		time.Sleep(t.latency)
+	}
+	return t.Transport.Do(req)
+}
+
+// memoryCluster returns a broker routing to stores over an in-memory
+// transport, so the benchmarks measure routing rather than the network.
+// If counter is not nil, the broker's requests go through it.
+func memoryCluster(b *testing.B, counter *countingTransport) *broker.Broker {
+	mem := transport.NewMemory()
+	br := broker.NewBroker()
+	b.Cleanup(br.Close)
+	br.SetTransport(mem)
+	if counter != nil {
+		counter.Transport = mem
+		br.SetTransport(counter)
+	}
+	for i := 0; i < brokerStores; i++ {
+		s := kvstore.NewKVStore(fmt.Sprintf("bench%d", i), fmt.Sprint(9000+i))
+		s.SetTransport(mem)
+		mem.Register(s.IPAddress, kvstore.NewKVStoreHandler(s))
+		if err := br.CreateStore(s.Name, s.IPAddress); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return br
+}
+
+// BenchmarkBrokerSet measures routing a Set to the least loaded store.
+func BenchmarkBrokerSet(b *testing.B) {
+	br := memoryCluster(b, nil)
+	keys := benchKeys(keySpace)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := br.SetKey(ctx, keys[i%len(keys)], "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func filledBroker(b *testing.B, counter *countingTransport) (*broker.Broker, []string) {
+	br := memoryCluster(b, counter)
+	keys := benchKeys(1000)
+	pairs := make(map[string]string, len(keys))
+	for _, key := range keys {
+		pairs[key] = "value"
+	}
+	if err := br.SetKeys(context.Background(), pairs); err != nil {
+		b.Fatal(err)
+	}
+	return br, keys
+}
+
+// BenchmarkBrokerGet measures locating and reading a key through the broker.
+func BenchmarkBrokerGet(b *testing.B) {
+	br, keys := filledBroker(b, nil)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := br.GetKey(ctx, keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBrokerGetParallel measures concurrent reads through the broker.
+func BenchmarkBrokerGetParallel(b *testing.B) {
+	br, keys := filledBroker(b, nil)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			br.GetKey(ctx, keys[rand.IntN(len(keys))])
+		}
+	})
+}
+
+// hotKeyReaders is the number of concurrent reads of one key in BenchmarkBrokerGetHotKey.
+const hotKeyReaders = 1000
+
+// BenchmarkBrokerGetHotKey measures a burst of concurrent reads of the same key
+// through the broker, and reports how many store reads each burst cost.
+func BenchmarkBrokerGetHotKey(b *testing.B) {
+	counter := &countingTransport{route: "/get", latency: time.Millisecond}
+	br, keys := filledBroker(b, counter)
+	ctx := context.Background()
+	counter.n.Store(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i%len(keys)]
+		var wg sync.WaitGroup
+		for range hotKeyReaders {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := br.GetKey(ctx, key); err != nil {
+					b.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(counter.n.Load())/float64(b.N), "store-gets/burst")
+}
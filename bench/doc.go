@@ -0,0 +1,4 @@
+// Package bench holds benchmarks for the store and the broker, run with
+// "go test -run '^$' -bench . ./bench" so performance changes can be
+// compared.
+package bench
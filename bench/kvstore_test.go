@@ -0,0 +1,154 @@
+package bench
+
+import (
+	"fmt"
+	"kv/kvstore"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// keySpace is the number of distinct keys the store benchmarks touch.
+const keySpace = 10000
+
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func filledStore(name string, keys []string) *kvstore.KVStore {
+	s := kvstore.NewKVStore(name, "0")
+	pairs := make(map[string]string, len(keys))
+	for _, key := range keys {
+		pairs[key] = "value-" + key
+	}
+	s.SetMany(pairs)
+	return s
+}
+
+// BenchmarkKVStoreSetParallel measures Set with every benchmark goroutine writing.
+func BenchmarkKVStoreSetParallel(b *testing.B) {
+	keys := benchKeys(keySpace)
+	s := kvstore.NewKVStore("bench", "0")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.Set(keys[rand.IntN(len(keys))], "value")
+		}
+	})
+}
+
+// BenchmarkKVStoreGetParallel measures Get with every benchmark goroutine reading.
+func BenchmarkKVStoreGetParallel(b *testing.B) {
+	keys := benchKeys(keySpace)
+	s := filledStore("bench", keys)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.Get(keys[rand.IntN(len(keys))])
+		}
+	})
+}
+
+// BenchmarkKVStoreMixedParallel measures a read-mostly mix: 90% Get, 10% Set.
+func BenchmarkKVStoreMixedParallel(b *testing.B) {
+	keys := benchKeys(keySpace)
+	s := filledStore("bench", keys)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := keys[rand.IntN(len(keys))]
+			if rand.IntN(10) == 0 {
+				s.Set(key, "value")
+			} else {
+				s.Get(key)
+			}
+		}
+	})
+}
+
+// snapshotStore returns a store of 100k keys whose snapshots go to a
+// temporary directory, and that directory.
+func snapshotStore(b *testing.B) (*kvstore.KVStore, string) {
+	dir, err := os.MkdirTemp("", "kv-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.RemoveAll(dir) })
+	// Snapshots are named after the store, so a path in the name moves them
+	return filledStore(filepath.Join(dir, "bench"), benchKeys(100000)), dir
+}
+
+// BenchmarkSnapshotSave100k measures writing a snapshot of 100,000 keys.
+func BenchmarkSnapshotSave100k(b *testing.B) {
+	s, _ := snapshotStore(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.SaveToDisk(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSnapshotWhileWriting measures Set while snapshots of 100,000 keys are
+// written back to back. It reports the slowest Set, which would take as long
+// as copying the keys if snapshots held writers back, and the snapshots
+// written meanwhile.
+func BenchmarkSnapshotWhileWriting(b *testing.B) {
+	s, _ := snapshotStore(b)
+	keys := benchKeys(keySpace)
+	stop, saves := make(chan struct{}), make(chan int)
+	go func() {
+		n := 0
+		for {
+			select {
+			case <-stop:
+				saves <- n
+				return
+			default:
+			}
+			if err := s.SaveToDisk(); err != nil {
+				b.Error(err)
+			}
+			n++
+		}
+	}()
+	var slowest time.Duration
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		s.Set(keys[i%len(keys)], "value")
+		slowest = max(slowest, time.Since(start))
+	}
+	b.StopTimer()
+	close(stop)
+	b.ReportMetric(float64(<-saves), "snapshots")
+	b.ReportMetric(float64(slowest.Microseconds()), "max-us/set")
+}
+
+// BenchmarkSnapshotLoad100k measures loading a snapshot of 100,000 keys.
+func BenchmarkSnapshotLoad100k(b *testing.B) {
+	s, dir := snapshotStore(b)
+	if err := s.SaveToDisk(); err != nil {
+		b.Fatal(err)
+	}
+	filename := filepath.Join(dir, "bench.snapshot.json")
+	target := kvstore.NewKVStore("load", "0")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := target.LoadFromDisk(filename); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
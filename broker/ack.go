@@ -0,0 +1,176 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+	"sync"
+)
+
+// Write acknowledgment levels, chosen per Set with ?ack=. Each waits longer
+// than the one before it for a write to be safe.
+const (
+	// AckLocal acknowledges a write once the store holding the key has it in
+	// memory; it is lost if the store crashes before its next snapshot.
+	AckLocal = "local"
+	// AckDurable waits for the store to append the write to its journal
+	// and fsync it.
+	AckDurable = "durable"
+	// AckReplicated waits for the store backing up the one holding the key
+	// to copy its data, the write included, to disk.
+	AckReplicated = "replicated"
+)
+
+// ErrNoBackupHolder is returned for a write made with AckReplicated when
+// the store holding the key is the only one, so nothing backs it up.
+var ErrNoBackupHolder = errors.New("no other store backs up the store holding the key")
+
+// ValidAck reports whether level is an acknowledgment level; empty means
+// AckLocal.
+func ValidAck(level string) bool {
+	switch level {
+	case "", AckLocal, AckDurable, AckReplicated:
+		return true
+	}
+	return false
+}
+
+// AwaitAck returns once the write of key just made to the named store is
+// safe at the given level. It is the store that took the write that
+// journals it or is backed up, not whichever copy of the key a lookup would
+// find. Replicated writes to a store share its backups; see peerBackups.
+func (b *Broker) AwaitAck(ctx context.Context, owner, key, level string) error {
+	if level == "" || level == AckLocal {
+		return nil
+	}
+	store, err := b.GetStore(owner)
+	if err != nil {
+		return err
+	}
+
+	switch level {
+	case AckDurable:
+		return b.journalKeys(ctx, store.Address(), key)
+	case AckReplicated:
+		holderAddr, holder, err := b.GetStorePeerIP(owner)
+		if err != nil {
+			return err
+		}
+		if holder == owner {
+			return ErrNoBackupHolder
+		}
+		return b.replicatedAcks.await(ctx, holderAddr, store.Address(), b.backUpPeer)
+	default:
+		return fmt.Errorf("unknown ack level %q", level)
+	}
+}
+
+// journalKeys has the store at addr append the keys, as it holds them, to
+// its journal and fsync it.
+func (b *Broker) journalKeys(ctx context.Context, addr string, keys ...string) error {
+	resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/journal", kvstore.JournalRequest{Keys: keys})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("journal returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backUpPeer has the store at holder back up the store at peer now.
+func (b *Broker) backUpPeer(ctx context.Context, holder, peer string) error {
+	resp, err := b.storeRequest(ctx, http.MethodPost, holder, "/backup-peers", kvstore.BackUpPeersRequest{Peer: peer})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backup-peers returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// peerBackups coalesces the backups replicated writes wait for. Each backup
+// copies the peer's whole dataset, so rather than one per write, a write
+// waits for the next backup of its store to start, which covers it and
+// every other write made while the one before ran. Its zero value is ready
+// to use.
+type peerBackups struct {
+	mu     sync.Mutex
+	queues map[peerBackupKey]*peerBackupQueue
+}
+
+// peerBackupKey names the store backed up and the store holding its backup.
+type peerBackupKey struct {
+	holder, peer string
+}
+
+// peerBackupQueue is the backup of a store running, if any, and the next
+// one, which the writes made meanwhile wait for.
+type peerBackupQueue struct {
+	running bool
+	next    *peerBackupRound
+}
+
+// peerBackupRound is a backup that writes wait for, done once it ran.
+type peerBackupRound struct {
+	done chan struct{}
+	err  error
+}
+
+// await returns once a backup of the store at peer by the store at holder,
+// run with backUp, has started after the call and finished.
+func (p *peerBackups) await(ctx context.Context, holder, peer string, backUp func(ctx context.Context, holder, peer string) error) error {
+	key := peerBackupKey{holder, peer}
+	p.mu.Lock()
+	if p.queues == nil {
+		p.queues = make(map[peerBackupKey]*peerBackupQueue)
+	}
+	q := p.queues[key]
+	if q == nil {
+		q = &peerBackupQueue{}
+		p.queues[key] = q
+	}
+	if q.next == nil {
+		q.next = &peerBackupRound{done: make(chan struct{})}
+	}
+	round := q.next
+	if !q.running {
+		q.running = true
+		// The backups outlive the write that started them, which others wait on
+		go p.run(context.WithoutCancel(ctx), key, q, backUp)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-round.done:
+		return round.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run runs the backups queued in q until no write waits for another.
+func (p *peerBackups) run(ctx context.Context, key peerBackupKey, q *peerBackupQueue, backUp func(ctx context.Context, holder, peer string) error) {
+	for {
+		p.mu.Lock()
+		round := q.next
+		q.next = nil
+		if round == nil {
+			q.running = false
+			delete(p.queues, key)
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+
+		roundCtx, cancel := context.WithTimeout(ctx, DefaultStoreTimeout)
+		round.err = backUp(roundCtx, key.holder, key.peer)
+		cancel()
+		close(round.done)
+	}
+}
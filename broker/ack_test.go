@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"context"
+	"kv/kvstore"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplicatedAcksShareBackups(t *testing.T) {
+	b, mem, stores := memoryBroker(t, 2)
+	ctx := context.Background()
+	holderAddr, holder, err := b.GetStorePeerIP("store0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The holder counts the backups it is asked for and holds the first
+	// until released
+	var backups atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := kvstore.NewKVStoreHandler(stores[holder])
+	mem.Register(holderAddr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/backup-peers") && backups.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+		handler.ServeHTTP(w, r)
+	}))
+
+	first := make(chan error, 1)
+	go func() { first <- b.AwaitAck(ctx, "store0", "k0", AckReplicated) }()
+	<-started
+
+	const writes = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writes)
+	for i := 0; i < writes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- b.AwaitAck(ctx, "store0", "k", AckReplicated)
+		}()
+	}
+	// The writes made while the first backup runs wait for the next
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatalf("first AwaitAck: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("AwaitAck: %v", err)
+		}
+	}
+	if n := backups.Load(); n != 2 {
+		t.Errorf("%d backups for %d replicated writes, want 2", n, writes+1)
+	}
+
+	if err := b.AwaitAck(ctx, "store0", "k", AckReplicated); err != nil {
+		t.Fatalf("AwaitAck after the backups: %v", err)
+	}
+	if n := backups.Load(); n != 3 {
+		t.Errorf("%d backups after another replicated write, want 3", n)
+	}
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Alert events fired by the broker.
+const (
+	AlertStoreDown      = "store_down"
+	AlertStoreRecovered = "store_recovered"
+	AlertFailover       = "failover"
+	// AlertFailoverIncomplete is fired when a failover recovered fewer keys
+	// than the store was known to hold.
+	AlertFailoverIncomplete = "failover_incomplete"
+	// AlertUncleanShutdown is fired when a store registers after its last
+	// run ended without a clean shutdown.
+	AlertUncleanShutdown = "unclean_shutdown"
+	// AlertStoreCorrupt is fired when a store reports that it started from
+	// a corrupt snapshot.
+	AlertStoreCorrupt = "store_corrupt"
+)
+
+// Alert describes a cluster event that operators should hear about.
+// Text makes the payload directly usable as a Slack incoming webhook message.
+type Alert struct {
+	Text    string    `json:"text"`
+	Event   string    `json:"event"`
+	Store   string    `json:"store"`
+	Peer    string    `json:"peer,omitempty"`
+	Details string    `json:"details,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Alerter posts alerts to a webhook. A nil *Alerter discards alerts.
+type Alerter struct {
+	webhookURL string
+	client     *http.Client
+	logger     *slog.Logger
+}
+
+// NewAlerter returns an Alerter posting to webhookURL, or nil if the URL is empty.
+func NewAlerter(webhookURL string) *Alerter {
+	if webhookURL == "" {
+		return nil
+	}
+	return &Alerter{
+		webhookURL: webhookURL,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		logger:     slog.Default().With("component", "alerter"),
+	}
+}
+
+// Fire sends the alert in the background so callers never block on the webhook.
+func (a *Alerter) Fire(alert Alert) {
+	if a == nil {
+		return
+	}
+	if alert.Time.IsZero() {
+		alert.Time = time.Now()
+	}
+	if alert.Text == "" {
+		alert.Text = fmt.Sprintf("[kv] %s: store %s", alert.Event, alert.Store)
+		if alert.Peer != "" {
+			alert.Text += ", peer " + alert.Peer
+		}
+		if alert.Details != "" {
+			alert.Text += " (" + alert.Details + ")"
+		}
+	}
+	go a.send(alert)
+}
+
+func (a *Alerter) send(alert Alert) {
+	jsonData, err := json.Marshal(alert)
+	if err != nil {
+		a.logger.Error("error marshalling alert", "err", err)
+		return
+	}
+	resp, err := a.client.Post(a.webhookURL, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		a.logger.Error("error sending alert", "event", alert.Event, "store", alert.Store, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		a.logger.Warn("alert webhook rejected alert", "event", alert.Event, "status", resp.StatusCode)
+	}
+}
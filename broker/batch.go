@@ -0,0 +1,397 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"kv/logging"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Scan page sizes.
+const (
+	DefaultScanLimit = 100
+	MaxScanLimit     = 1000
+)
+
+// ScanItem is a key-value pair found by Scan together with the store holding it.
+type ScanItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Store string `json:"store"`
+}
+
+// ScanPage is one page of a cluster-wide scan.
+type ScanPage struct {
+	Items []ScanItem `json:"items"`
+	// Next is the cursor for the following page; empty when the scan is complete.
+	Next string `json:"next,omitempty"`
+}
+
+// SetKeys stores many pairs, each on the store holding its key as SetKey
+// does, and new keys spread over the stores by load, sending each store its
+// share in a single request. With a write queue configured, the pairs wait
+// while no store can take them.
+func (b *Broker) SetKeys(ctx context.Context, pairs map[string]string) error {
+	return b.queueWrite(ctx, func() error { return b.setKeys(ctx, pairs, "/mset") })
+}
+
+// setKeys is SetKeys, sending each store its share to path: /mset, or
+// /mset?moved=1 for keys moved from another store. Copies of a key left on
+// other stores than the one written are deleted, unless written since.
+func (b *Broker) setKeys(ctx context.Context, pairs map[string]string, path string) error {
+	logger := logging.FromContext(ctx, b.logger)
+	located, err := b.locateKeys(ctx, slices.Collect(maps.Keys(pairs)), "mset")
+	if err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	addrs := make(map[string]string, len(b.stores))
+	writable := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		addrs[name] = store.Address()
+		if b.takesWrites(name) {
+			writable[name] = store.Address()
+		}
+	}
+	candidates := placementCandidates(writable, nil)
+	loads := b.placementLoads(candidates)
+	b.mu.RUnlock()
+
+	// Write each key to the store holding it, as placeKey does, and assign
+	// the others to the least loaded store, counting earlier assignments
+	batches := make(map[string]map[string]string)
+	stale := make(map[string]map[string]string)
+	for key, value := range pairs {
+		held := located[key]
+		target := ""
+		if len(held) > 0 && addrs[held[0].store] != "" {
+			target = held[0].store
+			held = held[1:]
+		} else {
+			if target = leastLoaded(loads, candidates); target == "" {
+				return fmt.Errorf("no available KVStore: %w", ErrNoStores)
+			}
+			loads[target]++
+		}
+		if batches[target] == nil {
+			batches[target] = make(map[string]string)
+		}
+		batches[target][key] = value
+		for _, other := range held {
+			if other.store == target {
+				continue
+			}
+			if stale[other.store] == nil {
+				stale[other.store] = make(map[string]string)
+			}
+			stale[other.store][key] = other.value
+		}
+	}
+
+	for name, batch := range batches {
+		body := map[string]interface{}{"pairs": batch}
+		resp, err := b.storeRequest(ctx, http.MethodPost, addrs[name], path, body)
+		if err != nil {
+			// The store may have taken the keys all the same
+			b.forgetFilter(name)
+			return fmt.Errorf("error contacting KVStore at %s: %w", addrs[name], err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("KVStore %s returned status: %d", name, resp.StatusCode)
+		}
+		b.noteWrites(name, slices.Collect(maps.Keys(batch))...)
+		b.addLoad(name, len(batch))
+		logger.Debug("keys set", "store", name, "count", len(batch))
+	}
+
+	for name, copies := range stale {
+		resp, err := b.storeRequest(ctx, http.MethodPost, addrs[name], "/mdelete", map[string]interface{}{"pairs": copies})
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("mdelete returned status: %d", resp.StatusCode)
+			}
+		}
+		if err != nil {
+			logger.Warn("failed to delete older copies of keys written", "store", name, "count", len(copies), "err", err)
+		}
+	}
+	return nil
+}
+
+// locateKeys returns the stores holding each of keys that some store holds,
+// asking every store in a single request for those of the keys its Bloom
+// filter does not rule out. As GetKey does, it fails over a store that
+// cannot be reached and asks again, since its keys are then on another
+// store. A key held by several stores, as a drift or an interrupted move
+// leaves it, has its copies listed newest first, going by the revisions in
+// their entity tags; the first is the one reads and writes go to. If a
+// store that was reached but did not answer may hold a key no other store
+// holds, an error is returned.
+func (b *Broker) locateKeys(ctx context.Context, keys []string, op string) (map[string][]storedKey, error) {
+	logger := logging.FromContext(ctx, b.logger)
+	var located map[string][]storedKey
+	var unanswered error
+	for pass := 0; pass < 2; pass++ {
+		located, unanswered = make(map[string][]storedKey, len(keys)), nil
+		failedOver := false
+		contacted := 0
+		for _, store := range b.readableStores() {
+			var asked []string
+			for _, key := range keys {
+				if b.mayHold(store.Name(), key) {
+					asked = append(asked, key)
+				}
+			}
+			if len(asked) == 0 {
+				b.bloomSkips.Inc(op)
+				continue
+			}
+			contacted++
+			found, err := b.storeMGetTagged(ctx, store.Address(), asked)
+			if err != nil {
+				logger.Error("error contacting store", "store", store.Name(), "address", store.Address(), "err", err)
+				if errors.Is(err, ErrStoreBusy) || errors.Is(err, errStoreStatus) {
+					// Reached but overloaded or failing the read: not failed over
+					unanswered = err
+					continue
+				}
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				b.failover(ctx, store, err)
+				failedOver = true
+				continue
+			}
+			for key, held := range found {
+				held.store = store.Name()
+				located[key] = append(located[key], held)
+			}
+		}
+		b.readFanout.Observe(float64(contacted), op)
+		if !failedOver {
+			break
+		}
+		// The failed store's keys are now on a store this pass may have
+		// asked before they got there
+	}
+
+	for _, held := range located {
+		sort.Slice(held, func(i, j int) bool {
+			// Entity tags are fixed-width hexadecimal revisions
+			if held[i].etag != held[j].etag {
+				return held[i].etag > held[j].etag
+			}
+			return held[i].store < held[j].store
+		})
+	}
+	if unanswered != nil {
+		for _, key := range keys {
+			if len(located[key]) == 0 {
+				// A store that did not answer may hold it: not found is not known
+				return nil, fmt.Errorf("key '%s' not found in the stores that answered: %w", key, unanswered)
+			}
+		}
+	}
+	return located, nil
+}
+
+// storeMGetTagged reads those of keys the store at addr holds, with their
+// entity tags. Its errors are classified as those of StoreClient.Get.
+func (b *Broker) storeMGetTagged(ctx context.Context, addr string, keys []string) (map[string]storedKey, error) {
+	resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/mget", map[string]interface{}{"keys": keys})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(addr, resp.StatusCode)
+	}
+	var result struct {
+		Values map[string]string `json:"values"`
+		ETags  map[string]string `json:"etags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("%w: error decoding mget: %w", errStoreStatus, err)
+	}
+	found := make(map[string]storedKey, len(result.Values))
+	for key, value := range result.Values {
+		found[key] = storedKey{value: value, etag: result.ETags[key]}
+	}
+	return found, nil
+}
+
+// PrefixDeletion is what DeletePrefix did, or would do in a dry run: the
+// keys deleted in all and on each store.
+type PrefixDeletion struct {
+	Prefix  string         `json:"prefix"`
+	DryRun  bool           `json:"dry_run"`
+	Deleted int            `json:"deleted"`
+	Stores  map[string]int `json:"stores"`
+}
+
+// DeletePrefix deletes every key starting with prefix from every store, or
+// with dryRun only counts them. A store that fails does not stop the others;
+// the error names it, and the result counts the keys deleted elsewhere.
+func (b *Broker) DeletePrefix(ctx context.Context, prefix string, dryRun bool) (PrefixDeletion, error) {
+	result := PrefixDeletion{Prefix: prefix, DryRun: dryRun, Stores: make(map[string]int)}
+	b.mu.RLock()
+	// Warming and draining stores are included, so they do not keep keys
+	// that the others no longer have
+	targets := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		targets[name] = store.Address()
+	}
+	b.mu.RUnlock()
+	if len(targets) == 0 {
+		return result, ErrNoStores
+	}
+
+	path := "/delete-prefix"
+	if dryRun {
+		path += "?dry_run=true"
+	} else {
+		b.forgetHotCopiesWithPrefix(prefix)
+	}
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(targets)) {
+		resp, err := b.storeRequest(ctx, http.MethodPost, targets[name], path, map[string]string{"prefix": prefix})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error contacting KVStore %s: %w", name, err))
+			continue
+		}
+		var deleted struct {
+			Count int `json:"count"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("KVStore %s returned status: %d", name, resp.StatusCode)
+		} else if err = json.NewDecoder(resp.Body).Decode(&deleted); err != nil {
+			err = fmt.Errorf("error decoding delete-prefix from %s: %w", name, err)
+		}
+		resp.Body.Close()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result.Stores[name] = deleted.Count
+		result.Deleted += deleted.Count
+	}
+	if !dryRun {
+		b.logger.Info("keys deleted by prefix", "prefix_hash", logging.KeyHash(prefix), "keys", result.Deleted)
+	}
+	return result, errors.Join(errs...)
+}
+
+// GetKeys returns the values of those keys that exist, asking every store
+// for all of them in a single request each, less those its Bloom filter
+// rules out. A key held by several stores is read from its newest copy. A
+// store that cannot be reached is failed over as for GetKey; one that fails
+// the request fails GetKeys only if it may hold a key no other store has.
+func (b *Broker) GetKeys(ctx context.Context, keys []string) (map[string]string, error) {
+	located, err := b.locateKeys(ctx, keys, "mget")
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(located))
+	for key, held := range located {
+		values[key] = held[0].value
+	}
+	return values, nil
+}
+
+// Scan returns, in key order, up to limit pairs whose keys start with prefix
+// and sort after cursor. Pass the returned Next as cursor to continue. Every
+// store must answer; a partial page would silently skip keys.
+func (b *Broker) Scan(ctx context.Context, prefix, cursor string, limit int) (ScanPage, error) {
+	if limit <= 0 {
+		limit = DefaultScanLimit
+	}
+	if limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+
+	b.mu.RLock()
+	targets := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		if !b.warming[name] {
+			targets[name] = store.Address()
+		}
+	}
+	b.mu.RUnlock()
+	b.readFanout.Observe(float64(len(targets)), "scan")
+
+	var items []ScanItem
+	more := false
+	for name, addr := range targets {
+		result, err := b.fetchStoreScan(ctx, addr, prefix, cursor, limit)
+		if err != nil {
+			return ScanPage{}, fmt.Errorf("scan of store %s failed: %w", name, err)
+		}
+		more = more || result.More
+		for _, kv := range result.Items {
+			items = append(items, ScanItem{Key: kv.Key, Value: kv.Value, Store: name})
+		}
+	}
+	return mergePage(items, more, limit), nil
+}
+
+// mergePage sorts the items the stores returned into a page of up to limit
+// keys. more is set if a store had further items.
+func mergePage(items []ScanItem, more bool, limit int) ScanPage {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Key != items[j].Key {
+			return items[i].Key < items[j].Key
+		}
+		return items[i].Store < items[j].Store
+	})
+
+	if len(items) > limit {
+		// Keep copies of the last key held by several stores on the same page,
+		// since the next page starts strictly after it.
+		end := limit
+		for end < len(items) && items[end].Key == items[limit-1].Key {
+			end++
+		}
+		more = more || end < len(items)
+		items = items[:end]
+	}
+
+	page := ScanPage{Items: items}
+	if page.Items == nil {
+		page.Items = []ScanItem{}
+	}
+	if more && len(items) > 0 {
+		page.Next = items[len(items)-1].Key
+	}
+	return page
+}
+
+func (b *Broker) fetchStoreScan(ctx context.Context, addr, prefix, after string, limit int) (kvstore.ScanResult, error) {
+	var result kvstore.ScanResult
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	query.Set("after", after)
+	query.Set("limit", strconv.Itoa(limit))
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/scan?"+query.Encode(), nil)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("scan returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("error decoding scan: %w", err)
+	}
+	return result, nil
+}
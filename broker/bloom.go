@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+	"strconv"
+)
+
+// storeFilter is the broker's copy of a store's Bloom filter. Lookups skip
+// the store for keys the filter rules out.
+type storeFilter struct {
+	// filter is nil until fetched, and after keys reached the store in a
+	// way the broker could not follow; the store is then always asked.
+	filter *kvstore.BloomFilter
+	// writes counts changes made to the copy, so a fetch that raced one is
+	// discarded rather than losing it.
+	writes uint64
+}
+
+// bloomEnabled reports whether lookups use the stores' filters. b.mu must be held.
+func (b *Broker) bloomEnabled() bool {
+	return b.config.BloomFilters
+}
+
+// mayHold reports false if the named store definitely does not hold key.
+func (b *Broker) mayHold(name, key string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if !b.bloomEnabled() {
+		return true
+	}
+	f := b.filters[name]
+	return f == nil || f.filter == nil || f.filter.MayContain(key)
+}
+
+// skipStores returns the stores that may hold key, counting the others as skipped.
+func (b *Broker) skipStores(stores []StoreClient, key, op string) []StoreClient {
+	var kept []StoreClient
+	for _, store := range stores {
+		if b.mayHold(store.Name(), key) {
+			kept = append(kept, store)
+		} else {
+			b.bloomSkips.Inc(op)
+		}
+	}
+	return kept
+}
+
+// noteWrites adds keys the broker wrote to the named store to its filter,
+// and keeps later lookups of them from sharing one that predates the write
+// or reading a copy of them, and the store from being sent deletions of
+// them it missed.
+func (b *Broker) noteWrites(name string, keys ...string) {
+	b.reads.Forget(keys...)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dropHotCopies(keys...)
+	b.dropPendingDeletes(name, keys...)
+	f := b.filters[name]
+	if f == nil {
+		return
+	}
+	f.writes++
+	if f.filter != nil {
+		for _, key := range keys {
+			f.filter.Add(key)
+		}
+	}
+}
+
+// forgetFilter drops the copy of the named store's filter after keys reached
+// the store other than through the broker's writes, such as on failover. The
+// store is asked for every key until the filter is fetched again.
+func (b *Broker) forgetFilter(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dropFilter(name)
+}
+
+// dropFilter is forgetFilter for callers holding b.mu.
+func (b *Broker) dropFilter(name string) {
+	if _, exists := b.stores[name]; !exists {
+		return
+	}
+	f := b.filters[name]
+	if f == nil {
+		f = &storeFilter{}
+		b.filters[name] = f
+	}
+	f.filter = nil
+	f.writes++
+}
+
+// refreshFilters fetches the filters of the stores that changed since they
+// were last fetched.
+func (b *Broker) refreshFilters(ctx context.Context) {
+	type target struct {
+		addr    string
+		version uint64
+		writes  uint64
+	}
+	b.mu.Lock()
+	if !b.bloomEnabled() {
+		clear(b.filters)
+		b.mu.Unlock()
+		return
+	}
+	targets := make(map[string]target, len(b.stores))
+	for name, store := range b.stores {
+		f := b.filters[name]
+		if f == nil {
+			f = &storeFilter{}
+			b.filters[name] = f
+		}
+		t := target{addr: store.Address(), writes: f.writes}
+		if f.filter != nil {
+			t.version = f.filter.Version
+		}
+		targets[name] = t
+	}
+	b.mu.Unlock()
+
+	for name, t := range targets {
+		filter, err := b.fetchFilter(ctx, t.addr, t.version)
+		if err != nil {
+			b.logger.Debug("error fetching bloom filter", "store", name, "err", err)
+			continue
+		}
+		if filter == nil {
+			continue // unchanged
+		}
+		b.mu.Lock()
+		if f := b.filters[name]; f != nil && f.writes == t.writes {
+			f.filter = filter
+		}
+		b.mu.Unlock()
+	}
+}
+
+// fetchFilter fetches the store's filter, or nil if its version is still version.
+func (b *Broker) fetchFilter(ctx context.Context, addr string, version uint64) (*kvstore.BloomFilter, error) {
+	path := "/bloom"
+	if version != 0 {
+		path += "?version=" + strconv.FormatUint(version, 10)
+	}
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("bloom returned status: %d", resp.StatusCode)
+	}
+	var filter kvstore.BloomFilter
+	if err := json.NewDecoder(resp.Body).Decode(&filter); err != nil {
+		return nil, fmt.Errorf("error decoding bloom filter: %w", err)
+	}
+	return &filter, nil
+}
@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// enableBloom has b's lookups use the stores' filters, fetched now.
+func enableBloom(t *testing.T, b *Broker) {
+	t.Helper()
+	b.mu.Lock()
+	b.config.BloomFilters = true
+	b.mu.Unlock()
+	b.refreshFilters(context.Background())
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for name := range b.stores {
+		if f := b.filters[name]; f == nil || f.filter == nil {
+			t.Fatalf("filter of %s not fetched", name)
+		}
+	}
+}
+
+func TestBloomFindsEveryKeyWritten(t *testing.T) {
+	b, _, stores := memoryBroker(t, 3)
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		b.SetKey(ctx, fmt.Sprintf("before%d", i), "v")
+	}
+	enableBloom(t, b)
+
+	// Keys written through the broker are added to its copies of the filters
+	for i := 0; i < 100; i++ {
+		if err := b.SetKey(ctx, fmt.Sprintf("after%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, prefix := range []string{"before", "after"} {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("%s%d", prefix, i)
+			if _, err := b.GetKey(ctx, key); err != nil {
+				t.Errorf("GetKey(%q) with Bloom filters: %v (held by %v)", key, err, holders(stores, key))
+			}
+		}
+	}
+}
+
+func TestBloomRefetchesChangedFilters(t *testing.T) {
+	b, _, stores := memoryBroker(t, 2)
+	ctx := context.Background()
+	enableBloom(t, b)
+
+	// A key that reached the store behind the broker's back is found once
+	// the store's filter is fetched again
+	stores["store0"].Set("direct", "v")
+	b.refreshFilters(ctx)
+	if value, err := b.GetKey(ctx, "direct"); err != nil || value != "v" {
+		t.Errorf("GetKey(direct) after refetching the filters = %q, %v; want v", value, err)
+	}
+	if !b.mayHold("store0", "direct") {
+		t.Error("refetched filter of store0 rules out a key it holds")
+	}
+}
+
+func TestBloomKeepsWriteRacingFetch(t *testing.T) {
+	b, mem, stores := memoryBroker(t, 1)
+	ctx := context.Background()
+	enableBloom(t, b)
+	stores["store0"].Set("other", "v") // so the next refresh fetches the filter
+
+	// store0 answers the fetch with its filter as it was before the write,
+	// once the write is made
+	fetched, release := make(chan struct{}), make(chan struct{})
+	handler := kvstore.NewKVStoreHandler(stores["store0"])
+	mem.Register(stores["store0"].IPAddress, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/bloom") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		close(fetched)
+		<-release
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		b.refreshFilters(ctx)
+	}()
+	<-fetched
+	stores["store0"].Set("raced", "v")
+	b.noteWrites("store0", "raced")
+	close(release)
+	<-refreshed
+
+	if !b.mayHold("store0", "raced") {
+		t.Error("a fetch that raced the write dropped the key from the broker's copy of the filter")
+	}
+	if _, err := b.GetKey(ctx, "raced"); err != nil {
+		t.Errorf("GetKey(raced): %v", err)
+	}
+}
+
+func TestBloomFindsKeysAfterMerge(t *testing.T) {
+	b, _, stores := memoryBroker(t, 3)
+	ctx := context.Background()
+	enableBloom(t, b)
+	var keys []string
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if err := b.SetKey(ctx, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	if _, _, err := b.MergeStores(ctx, "store1", "store0"); err != nil {
+		t.Fatal(err)
+	}
+	delete(stores, "store1")
+	for _, key := range keys {
+		if _, err := b.GetKey(ctx, key); err != nil {
+			t.Errorf("GetKey(%q) after the merge: %v (held by %v)", key, err, holders(stores, key))
+		}
+	}
+}
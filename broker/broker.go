@@ -1,222 +1,270 @@
 package broker
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"kv/kvstore"
-	"log"
+	"kv/lifecycle"
+	"kv/logging"
+	"kv/metrics"
+	"kv/qos"
+	"kv/singleflight"
+	"kv/transport"
+	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func (b *Broker) StartPeering() error {
-	NotifyPeersOfEachOther(b.peerlist)
-	return nil
-}
-
-func (b *Broker) GetStorePeerIP(storeName string) (string, string, error) {
-
-	store, exists := b.stores[storeName]
-	if !exists {
-		return "", "", errors.New("store not found")
-	}
-
-	current := b.peerlist.Head
-	if current == nil {
-		return "", "", errors.New("peer list is empty")
-	}
-
-	for {
-		if current.Name == store.Name {
-			return current.Prev.IpAddress, current.Prev.Name, nil
-		}
-		current = current.Next
-		if current == b.peerlist.Head {
-			break // full circle
-		}
-	}
-
-	return "", "", errors.New("peer not found")
-}
-
 // Broker manages multiple KVStore instances and handles load balancing.
 type Broker struct {
-	mu       sync.RWMutex
-	stores   map[string]*kvstore.KVStore
-	loads    map[string]int // Simple load metric: number of operations handled
-	peerlist *LinkedList
+	mu        sync.RWMutex
+	stores    map[string]StoreClient
+	newStore  StoreFactory
+	loads     map[string]int // Simple load metric: number of operations handled
+	health    map[string]StoreHealth
+	draining  map[string]bool      // stores being emptied before removal; they receive no new keys, only writes to those they hold
+	warming   map[string]bool      // stores loading their data from a peer; they are not read from or given new keys
+	removed   map[string]bool      // stores removed on request; their heartbeats are refused
+	busy      map[string]time.Time // stores that turned writes away as busy; they are given no new keys until then
+	replicas  map[string]*replica
+	snapshots map[string]*snapshotState
+	peerlist  *LinkedList
+	logger    *slog.Logger
+	transport transport.Transport
+	alerter   *Alerter
+
+	// adminToken authenticates the broker's calls to stores, e.g. /shutdown
+	adminToken string
+	// tasks runs the health checks, membership changes and shadow workers
+	tasks *lifecycle.Group
+	// config is the configuration last applied by ApplyConfig
+	config       Config
+	configured   bool
+	configSource func() (Config, error)
+	// membership carries membership changes to the management goroutine
+	membership chan func()
+	// tenants are the applications sharing the cluster, if any
+	tenants []*tenant
+	// validation are the rules writes are checked against
+	validation []*validationRule
+	// conditional serializes conditional writes and increments to the same key
+	conditional conditionalLocks
+	// replicatedAcks coalesces the backups writes made with AckReplicated
+	// wait for
+	replicatedAcks peerBackups
+	// readTurn rotates reads between stores and their replicas, and hot
+	// keys' copies
+	readTurn atomic.Uint64
+	// hotCopies are the hot keys copied to other stores to spread their reads
+	hotCopies map[string]*hotCopy
+	// shadow mirrors writes to a migration target, if one is configured
+	shadow *shadower
+	// failovers are the most recent failover reports, oldest first
+	failovers []*FailoverReport
+	// defaultTTLs are the default TTLs set for stores through the API
+	defaultTTLs map[string]time.Duration
+	// filters are the broker's copies of the stores' Bloom filters
+	filters map[string]*storeFilter
+	// background paces the keys the broker moves between stores
+	background *qos.Limiter
+	// migrations are the latest drain, handoff, split or merge of each store
+	migrations map[string]*storeMigration
+	// resizing is set while a store is being split or merged
+	resizing bool
+	// splitBlocked are the stores over the split size that no other store
+	// has room for, logged once
+	splitBlocked map[string]bool
+	// reads collapses concurrent lookups of the same key into one
+	reads singleflight.Group[storedKey]
+	// jobs are the recurring jobs, and jobHistory their most recent runs,
+	// oldest first
+	jobs       []*scheduledJob
+	jobHistory []JobRun
+	// events are the recent cluster events, reported at /events
+	events *eventLog
+	// pendingDeletes are the deletions stores missed while they could not
+	// be reached, by store name, sent once they are back
+	pendingDeletes map[string]*pendingDeletes
+	// queuedWrites counts the writes waiting for a store to take them
+	queuedWrites atomic.Int64
+	// pool is the transport to stores unless SetTransport replaced it, and
+	// clients counts the connections to the broker's server
+	pool    *connPool
+	clients *clientConns
+
+	metrics      *metrics.Registry
+	storeUp      *metrics.GaugeVec
+	storeLoad    *metrics.GaugeVec
+	storeLatency *metrics.HistogramVec
+	readFanout   *metrics.HistogramVec
+	replicaReads *metrics.CounterVec
+	hotCopyReads *metrics.CounterVec
+	boundedReads *metrics.CounterVec
+	bloomSkips   *metrics.CounterVec
+	shadowOps    *metrics.CounterVec
+	sharedReads  *metrics.CounterVec
+	splits       *metrics.CounterVec
+	merges       *metrics.CounterVec
+	jobRuns      *metrics.CounterVec
+
+	writeQueueOutcomes *metrics.CounterVec
+
+	tenantRequests   *metrics.CounterVec
+	tenantRejections *metrics.CounterVec
+	tenantKeys       *metrics.GaugeVec
+	tenantBytes      *metrics.GaugeVec
+
+	validationRejections *metrics.CounterVec
 }
 
 // NewBroker initializes and returns a new Broker instance.
 func NewBroker() *Broker {
-	return &Broker{
-		stores:   make(map[string]*kvstore.KVStore),
-		loads:    make(map[string]int),
-		peerlist: &LinkedList{},
-	}
-}
-
-// Node represents a kvstore, this kvstore has the Next's replication
-type StoreNode struct {
-	Name      string
-	IpAddress string
-	Next      *StoreNode
-	Prev      *StoreNode
+	b := &Broker{
+		stores:    make(map[string]StoreClient),
+		loads:     make(map[string]int),
+		health:    make(map[string]StoreHealth),
+		draining:  make(map[string]bool),
+		warming:   make(map[string]bool),
+		removed:   make(map[string]bool),
+		busy:      make(map[string]time.Time),
+		replicas:  make(map[string]*replica),
+		snapshots: make(map[string]*snapshotState),
+		filters:   make(map[string]*storeFilter),
+		hotCopies: make(map[string]*hotCopy),
+		peerlist:  &LinkedList{},
+		logger:    slog.Default().With("component", "broker"),
+		metrics:   metrics.NewRegistry(),
+
+		defaultTTLs:    make(map[string]time.Duration),
+		migrations:     make(map[string]*storeMigration),
+		splitBlocked:   make(map[string]bool),
+		pendingDeletes: make(map[string]*pendingDeletes),
+		membership:     make(chan func()),
+		tasks:          lifecycle.New(),
+		events:         &eventLog{},
+	}
+	b.pool = newConnPool(b.metrics)
+	b.transport = &http.Client{Transport: b.pool}
+	b.clients = newClientConns(b.metrics)
+	b.metrics.NewGaugeFunc("broker_stores", "Number of registered stores.", func() float64 {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		return float64(len(b.stores))
+	})
+	b.storeUp = b.metrics.NewGaugeVec("broker_store_up", "Whether the broker considers a store reachable (1) or dead (0).", "store")
+	b.storeLoad = b.metrics.NewGaugeVec("broker_store_load", "Operations routed to a store since its load was last reset.", "store")
+	b.storeLatency = b.metrics.NewHistogramVec("broker_store_request_duration_seconds", "Latency of broker-to-store calls by target store address, route and status code (error if the call failed).", nil, "address", "route", "code")
+	b.readFanout = b.metrics.NewHistogramVec("broker_lookup_fanout_stores", "Number of stores contacted to locate a key.", []float64{1, 2, 3, 5, 8, 13, 21}, "op")
+	b.replicaReads = b.metrics.NewCounterVec("broker_replica_reads_total", "Key lookups answered by a read replica.", "replica")
+	b.hotCopyReads = b.metrics.NewCounterVec("broker_hot_copy_reads_total", "Key lookups answered by a copy of a hot key, by the store holding the copy.", "store")
+	b.metrics.NewGaugeFunc("broker_hot_keys_copied", "Hot keys whose reads are spread over copies on other stores.", func() float64 {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		return float64(len(b.hotCopies))
+	})
+	b.boundedReads = b.metrics.NewCounterVec("broker_bounded_staleness_reads_total", "Store reads made for lookups with a staleness bound, by whether a replica or the store itself (primary) was read.", "source")
+	b.bloomSkips = b.metrics.NewCounterVec("broker_bloom_skipped_stores_total", "Stores not asked for a key because their Bloom filter rules it out.", "op")
+	b.sharedReads = b.metrics.NewCounterVec("broker_shared_reads_total", "Key lookups answered with the result of an identical lookup already in flight.")
+	b.splits = b.metrics.NewCounterVec("broker_store_splits_total", "Stores split because they grew past the configured size, or on request.")
+	b.merges = b.metrics.NewCounterVec("broker_store_merges_total", "Stores merged into another and removed.")
+	b.jobRuns = b.metrics.NewCounterVec("broker_job_runs_total", "Runs of recurring jobs by job and result (ok, failed or skipped).", "job", "result")
+	b.shadowOps = b.metrics.NewCounterVec("broker_shadow_ops_total", "Operations for the shadow target by op and result (mirrored, failed, dropped, compared, mismatch).", "op", "result")
+	b.metrics.NewGaugeFunc("broker_write_queue_depth", "Writes waiting for a store to take them.", func() float64 {
+		return float64(b.queuedWrites.Load())
+	})
+	b.metrics.NewGaugeFunc("broker_pending_deletes", "Key deletions and tombstones waiting for a store that could not be reached to come back.", func() float64 {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		n := 0
+		for _, p := range b.pendingDeletes {
+			n += p.len()
+		}
+		return float64(n)
+	})
+	b.writeQueueOutcomes = b.metrics.NewCounterVec("broker_queued_writes_total", "Writes that waited for a store, by outcome (written, expired, canceled, failed, or rejected because the queue was full).", "outcome")
+	b.tenantRequests = b.metrics.NewCounterVec("broker_tenant_requests_total", "Requests made with a tenant's token.", "tenant")
+	b.tenantRejections = b.metrics.NewCounterVec("broker_tenant_quota_rejections_total", "Writes refused because they would exceed the tenant's quota.", "tenant")
+	b.validationRejections = b.metrics.NewCounterVec("broker_validation_rejections_total", "Writes refused by a validation rule, by rule.", "rule")
+	b.tenantKeys = b.metrics.NewGaugeVec("broker_tenant_keys", "Keys a tenant held when last measured.", "tenant")
+	b.tenantBytes = b.metrics.NewGaugeVec("broker_tenant_bytes", "Bytes of keys and values a tenant held when last measured.", "tenant")
+	b.background = qos.NewLimiter(qos.Limit{}, b.metrics, "broker")
+	b.newStore = func(name, addr string) StoreClient {
+		return &remoteStore{broker: b, name: name, addr: addr}
+	}
+	b.metrics.NewGaugeFunc("broker_background_goroutines", "Background loops and workers running: health checks, membership changes and shadow workers.", func() float64 {
+		return float64(b.tasks.Len())
+	})
+	b.tasks.Go(b.manageMembership)
+	return b
 }
 
-// LinkedList represents the peer architecture
-type LinkedList struct {
-	Head *StoreNode
+// Close stops the broker's background goroutines and waits for them to
+// return. Membership changes fail with ErrClosed afterwards.
+func (b *Broker) Close() {
+	b.tasks.Close()
 }
 
-// AddNode appends a new node to the circular list
-func (ll *LinkedList) AddNode(name, ipAddress string) {
-	newNode := &StoreNode{Name: name, IpAddress: ipAddress}
-
-	if ll.Head == nil { // If the list is empty
-		ll.Head = newNode
-		newNode.Next = newNode // Points to itself
-		newNode.Prev = newNode
-	} else { // Append to the end
-		tail := ll.Head.Prev // Get the tail node
-		tail.Next = newNode
-		newNode.Prev = tail
-		newNode.Next = ll.Head
-		ll.Head.Prev = newNode
-	}
-}
-
-// RemoveNode removes a node by name
-func (ll *LinkedList) RemoveNode(name string) error {
-	if ll.Head == nil {
-		return fmt.Errorf("list is empty")
-	}
-
-	current := ll.Head
-	for {
-		if current.Name == name {
-			// Update pointers
-			if current.Next == current { // Only one node in the list
-				ll.Head = nil
-			} else {
-				current.Prev.Next = current.Next
-				current.Next.Prev = current.Prev
-				if current == ll.Head { // Removing the head
-					ll.Head = current.Next
-				}
-			}
-			return nil // Node removed
-		}
-
-		current = current.Next
-		if current == ll.Head {
-			break // Completed a full circle
-		}
-	}
-	return fmt.Errorf("node with name %s not found", name)
+// SetTransport replaces the transport used to reach stores, e.g. with an
+// in-memory one in tests. Call it before the broker is used.
+func (b *Broker) SetTransport(t transport.Transport) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.transport = t
 }
 
-func (b *Broker) CreateStore(name string, ip_address string) error {
-	fmt.Printf("Attempting to create store:\nName: %s\nIP Address: %s\n", name, ip_address)
-
+// SetAdminToken sets the token the broker presents to stores as
+// "Authorization: Bearer <token>", which they require before shutting down.
+func (b *Broker) SetAdminToken(token string) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-
-	if _, exists := b.stores[name]; exists {
-		fmt.Printf("Store with name '%s' already exists. Skipping creation.\n", name)
-		return errors.New("store with this name already exists")
-	}
-
-	if ip_address == "" {
-		fmt.Printf("Error: Empty IP address for store '%s'.\n", name)
-		return errors.New("invalid IP address")
-	}
-
-	// Add to stores and peerlist
-	fmt.Printf("Registering new store:\nName: %s\nIP Address: %s\n", name, ip_address)
-	store := &kvstore.KVStore{
-		Name:      name,
-		IPAddress: ip_address,
-	}
-	b.stores[name] = store
-	b.loads[name] = 0
-
-	fmt.Printf("Adding to peer list: Name: %s, IP Address: %s\n", name, ip_address)
-	b.peerlist.AddNode(name, ip_address)
-
-	// Debug: Print current list of stores
-	fmt.Println("Current list of stores:")
-	for storeName, store := range b.stores {
-		fmt.Printf("  Store Name: %s, IP Address: %s\n", storeName, store.IPAddress)
-	}
-
-	// Notify existing stores about the new store
-	fmt.Printf("Notifying peers about the new store: %s\n", name)
-	b.StartPeering()
-
-	return nil
+	b.adminToken = token
 }
 
-func (b *Broker) RemoveStore(name string) error {
+// SetAlerter configures where store failure and failover alerts are sent.
+func (b *Broker) SetAlerter(a *Alerter) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	b.alerter = a
+}
 
-	store, exists := b.stores[name]
-	if !exists {
-		return errors.New("store not found")
-	}
-
-	delete(b.stores, name)
-	delete(b.loads, name)
-	b.peerlist.RemoveNode(name)
-
-	// Notify remaining stores about the removal
-	b.StartPeering()
-
-	// Optionally, send a delete request to the KVStore to gracefully shut it down
-	url := fmt.Sprintf("http://%s/shutdown", store.IPAddress)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		log.Printf("Error creating shutdown request for store %s: %v", name, err)
-		return nil // Continue even if shutdown request fails
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error sending shutdown request to store %s: %v", name, err)
-		return nil
-	}
-	resp.Body.Close()
-
-	return nil
+// Metrics returns the registry holding the broker's metrics.
+func (b *Broker) Metrics() *metrics.Registry {
+	return b.metrics
 }
 
 // GetLeastLoadedStore returns the name of the store with the least load.
-func (b *Broker) GetLeastLoadedStore() (*kvstore.KVStore, error) {
+// Only stores that take writes are chosen: not draining, warming, DOWN or
+// busy.
+func (b *Broker) GetLeastLoadedStore() (StoreClient, error) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	if len(b.stores) == 0 {
-		return nil, errors.New("no stores available")
-	}
-	var leastLoadedStore *kvstore.KVStore
-	minLoad := int(^uint(0) >> 1) // Initialize with maximum int
-	for name, store := range b.stores {
-		if b.loads[name] < minLoad {
-			minLoad = b.loads[name]
-			leastLoadedStore = store
+	candidates := make([]string, 0, len(b.stores))
+	for name := range b.stores {
+		if b.takesWrites(name) {
+			candidates = append(candidates, name)
 		}
 	}
-	return leastLoadedStore, nil
+	name := leastLoaded(b.placementLoads(candidates), candidates)
+	if name == "" {
+		return nil, ErrNoStores
+	}
+	return b.stores[name], nil
 }
 
 // IncrementLoad increments the load metric for a given store.
 func (b *Broker) IncrementLoad(storeName string) {
+	b.addLoad(storeName, 1)
+}
+
+func (b *Broker) addLoad(storeName string, n int) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	if _, exists := b.loads[storeName]; exists {
-		b.loads[storeName]++
+		b.loads[storeName] += n
+		b.storeLoad.Set(float64(b.loads[storeName]), storeName)
 	}
 }
 
@@ -226,6 +274,7 @@ func (b *Broker) ResetLoad(storeName string) {
 	defer b.mu.Unlock()
 	if _, exists := b.loads[storeName]; exists {
 		b.loads[storeName] = 0
+		b.storeLoad.Set(0, storeName)
 	}
 }
 
@@ -240,17 +289,76 @@ func (b *Broker) ListStores() []string {
 	return names
 }
 
+// storeList returns the registered stores, for calls made without b.mu held.
+func (b *Broker) storeList() []StoreClient {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	stores := make([]StoreClient, 0, len(b.stores))
+	for _, store := range b.stores {
+		stores = append(stores, store)
+	}
+	return stores
+}
+
+// readableStores returns the stores that may be read from: those not
+// warming up. It is for calls made without b.mu held.
+func (b *Broker) readableStores() []StoreClient {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	stores := make([]StoreClient, 0, len(b.stores))
+	for name, store := range b.stores {
+		if !b.warming[name] {
+			stores = append(stores, store)
+		}
+	}
+	return stores
+}
+
+// SetWarming records whether the named store is still loading its data
+// from its peer. A warming store is neither read from nor given new keys.
+func (b *Broker) SetWarming(name string, warming bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.stores[name]; exists {
+		b.setWarming(name, warming)
+	}
+}
+
+// setWarming is SetWarming for callers holding b.mu.
+func (b *Broker) setWarming(name string, warming bool) {
+	if b.warming[name] == warming {
+		return
+	}
+	if warming {
+		b.warming[name] = true
+		b.logger.Info("store is warming up", "store", name)
+	} else {
+		delete(b.warming, name)
+		// Its keys were loaded from a peer
+		b.dropFilter(name)
+		b.logger.Info("store is warm", "store", name)
+	}
+}
+
 // GetStore retrieves a store by name.
-func (b *Broker) GetStore(name string) (*kvstore.KVStore, error) {
+func (b *Broker) GetStore(name string) (StoreClient, error) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	store, exists := b.stores[name]
 	if !exists {
-		return nil, errors.New("store not found")
+		return nil, ErrStoreNotFound
 	}
 	return store, nil
 }
 
+// WasRemoved reports whether the named store was removed on request and has
+// not registered again since.
+func (b *Broker) WasRemoved(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.removed[name]
+}
+
 // StoreExists checks if a store with the given name exists.
 func (b *Broker) StoreExists(name string) bool {
 	b.mu.RLock()
@@ -259,293 +367,277 @@ func (b *Broker) StoreExists(name string) bool {
 	return exists
 }
 
-// StoreExists checks if a store with the given name exists.
-func (b *Broker) ManualSnapshotStore() error {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	for name, store := range b.stores {
-		url := fmt.Sprintf("http://%s/save", store.IPAddress)
-		resp, err := http.Post(url, "application/json", nil)
+// ManualSnapshotStore asks every store to save a snapshot to disk.
+func (b *Broker) ManualSnapshotStore(ctx context.Context) error {
+	stores := b.storeList()
+	saved := 0
+	for _, store := range stores {
+		name := store.Name()
+		resp, err := b.storeRequest(ctx, http.MethodPost, store.Address(), "/save", nil)
 		if err != nil {
-			log.Printf("Failed to send manual snapshot request to store %s: %v", name, err)
+			b.logger.Error("failed to send manual snapshot request", "store", name, "err", err)
 			continue
 		}
 		resp.Body.Close()
 		if resp.StatusCode != http.StatusOK {
-			log.Printf("Store %s responded with status: %d", name, resp.StatusCode)
+			b.logger.Warn("manual snapshot rejected", "store", name, "status", resp.StatusCode)
 		} else {
-			log.Printf("Manual snapshot triggered for store %s successfully.", name)
+			b.logger.Info("manual snapshot triggered", "store", name)
+			saved++
 		}
 	}
+	b.recordEvent(ClusterEvent{Type: EventSnapshot, Details: fmt.Sprintf("manual snapshot saved by %d of %d stores", saved, len(stores))})
 	return nil
 }
 
-func (b *Broker) GetKey(key string) (string, error) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+func (b *Broker) GetKey(ctx context.Context, key string) (string, error) {
+	value, _, err := b.ReadKey(ctx, key)
+	return value, err
+}
 
-	// Iterate over all KVStores to find the key
-	for _, store := range b.stores {
-		url := fmt.Sprintf("http://%s/get?key=%s", store.IPAddress, key)
-		resp, err := http.Get(url)
-		if err != nil {
-			fmt.Printf("Error contacting KVStore at %s: %v\n", store.IPAddress, err)
-			//Ediz, I could not find the ip of its peer. Le it be ip_peer;
-			ip_peer, name_peer, err := b.GetStorePeerIP(store.Name)
-			if err != nil {
-				fmt.Printf("Error getting peer ip of %s: %v\n", store.Name, err)
-			}
-			fmt.Printf("Now %s will continue where he left\n", name_peer)
-			url := fmt.Sprintf("http://%s/peer-dead", ip_peer)
-			http.Post(url, "application/json", nil)
-			delete(b.stores, store.Name)
-			delete(b.loads, store.Name)
-			b.peerlist.RemoveNode(store.Name)
-			b.StartPeering()
-			continue
+// sharedReadTimeout bounds a key lookup shared by concurrent callers, or
+// made with a staleness bound, which no longer ends when the caller that
+// started it gives up.
+const sharedReadTimeout = 10 * time.Second
+
+// storedKey is a key's value as a store holds it: the name of the store and
+// the entity tag it gives the value.
+type storedKey struct {
+	value, store, etag string
+}
+
+// LookupKey returns the value of key and the name of the store holding it.
+// Concurrent lookups of the same key share one round of store requests; a
+// write to the key makes later lookups start a round of their own. A lookup
+// with a staleness bound set by WithMaxStaleness is not shared, since the
+// others may allow staler replicas. Either way the stores are asked apart
+// from the caller's context, so a caller giving up is not taken for a store
+// failing.
+func (b *Broker) LookupKey(ctx context.Context, key string) (string, string, error) {
+	found, err := b.lookupStoredKey(ctx, key)
+	return found.value, found.store, err
+}
+
+// lookupStoredKey is LookupKey returning the value's entity tag too.
+func (b *Broker) lookupStoredKey(ctx context.Context, key string) (storedKey, error) {
+	if _, bounded := maxStaleness(ctx); bounded {
+		type outcome struct {
+			storedKey
+			err error
+		}
+		done := make(chan outcome, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedReadTimeout)
+			defer cancel()
+			found, err := b.lookupKey(ctx, key)
+			done <- outcome{found, err}
+		}()
+		select {
+		case result := <-done:
+			return result.storedKey, result.err
+		case <-ctx.Done():
+			return storedKey{}, ctx.Err()
 		}
-		defer resp.Body.Close()
+	}
+	fetched := false
+	result, err, _ := b.reads.Do(key, func() (storedKey, error) {
+		fetched = true
+		// The lookup is shared, so one caller giving up must not fail the others
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedReadTimeout)
+		defer cancel()
+		return b.lookupKey(ctx, key)
+	})
+	if !fetched {
+		b.sharedReads.Inc()
+	}
+	return result, err
+}
 
-		if resp.StatusCode == http.StatusOK {
-			var result map[string]string
-			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-				fmt.Printf("Error decoding response from KVStore at %s: %v\n", store.IPAddress, err)
+// lookupKey is lookupStoredKey without sharing.
+func (b *Broker) lookupKey(ctx context.Context, key string) (storedKey, error) {
+	logger := logging.FromContext(ctx, b.logger)
+	contacted := 0
+	defer func() { b.readFanout.Observe(float64(contacted), "get") }()
+
+	// Iterate over the KVStores that may hold the key to find it
+	var unanswered error
+	for pass := 0; pass < 2; pass++ {
+		failedOver := false
+		for _, store := range b.skipStores(b.readableStores(), key, "get") {
+			contacted++
+			value, etag, found, err := b.readKey(ctx, store, key)
+			if err != nil {
+				logger.Error("error contacting store", "store", store.Name(), "address", store.Address(), "err", err)
+				if errors.Is(err, ErrStoreBusy) || errors.Is(err, errStoreStatus) {
+					// Reached but overloaded or failing the read: not failed over
+					unanswered = err
+					continue
+				}
+				if ctx.Err() != nil {
+					// Given up on, not failed: no store is failed over for it
+					return storedKey{}, ctx.Err()
+				}
+				b.failover(ctx, store, err)
+				failedOver = true
 				continue
 			}
 
 			// Found the key, return the value
-			if value, ok := result["value"]; ok {
-				fmt.Printf("Key '%s' found in KVStore: %s\n", key, store.IPAddress)
-				return value, nil
+			if found {
+				logger.Debug("key found", "key_hash", logging.KeyHash(key), "store", store.Name())
+				return storedKey{value, store.Name(), etag}, nil
 			}
 		}
+		if !failedOver {
+			break
+		}
+		// The failed store's keys are now on a store this pass may have
+		// asked before they got there
 	}
 
-	return "", fmt.Errorf("key '%s' not found in any KVStore", key)
+	if unanswered != nil {
+		// A store that did not answer may hold it: not found is not known
+		return storedKey{}, fmt.Errorf("key '%s' not found in the stores that answered: %w", key, unanswered)
+	}
+	// No store holds it; a store in cache mode may read it from its origin
+	return b.readThrough(ctx, key)
 }
 
-func (b *Broker) SetKey(key string, value string) error {
-	store, err := b.GetLeastLoadedStore()
-	if err != nil {
-		return fmt.Errorf("no available KVStore: %w", err)
-	}
+// SetKey writes key to the store holding it or, for a new key, to the least
+// loaded store. With a write queue configured, a write no store can take
+// waits for one.
+func (b *Broker) SetKey(ctx context.Context, key string, value string) error {
+	_, err := b.setKeyQueued(ctx, key, value)
+	return err
+}
 
-	url := fmt.Sprintf("http://%s/set", store.IPAddress)
-	data := map[string]string{
-		"key":   key,
-		"value": value,
-	}
-	jsonData, err := json.Marshal(data)
-	if err != nil {
+// setKeyQueued is SetKey returning the value as the store written to holds
+// it.
+func (b *Broker) setKeyQueued(ctx context.Context, key string, value string) (storedKey, error) {
+	var written storedKey
+	err := b.queueWrite(ctx, func() (err error) {
+		written, err = b.setKey(ctx, key, value)
 		return err
-	}
+	})
+	return written, err
+}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+func (b *Broker) setKey(ctx context.Context, key string, value string) (storedKey, error) {
+	logger := logging.FromContext(ctx, b.logger)
+	store, err := b.placeKey(ctx, key)
 	if err != nil {
-		return fmt.Errorf("error contacting KVStore at %s: %w", store.IPAddress, err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("KVStore returned status: %d", resp.StatusCode)
+		return storedKey{}, err
 	}
 
-	b.IncrementLoad(store.Name)
-	fmt.Printf("Key '%s' set in KVStore: %s\n", key, store.IPAddress)
-	return nil
-}
-
-// DeleteKey deletes a key from the specific KVStore where it is located.
-func (b *Broker) DeleteKey(key string) (bool, error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	var storeIP string
-	exists := false
-	// Iterate over all KVStores to find the key
-	for _, store := range b.stores {
-		url := fmt.Sprintf("http://%s/get?key=%s", store.IPAddress, key)
-		resp, err := http.Get(url)
-		if err != nil {
-			fmt.Printf("Error contacting KVStore at %s: %v\n", store.IPAddress, err)
-			continue
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusOK {
-			storeIP = store.IPAddress
-			exists = true
+	etag, err := store.Set(ctx, key, value)
+	if err != nil {
+		if errors.Is(err, ErrStoreBusy) {
+			// Turned away unread; the next write goes elsewhere
+			b.backOff(store.Name())
+			return storedKey{}, err
 		}
+		// The store may have taken the key all the same
+		b.forgetFilter(store.Name())
+		return storedKey{}, err
 	}
 
-	if !exists {
-		log.Printf("Key '%s' not found in keyLocation map.\n", key)
-		return false, fmt.Errorf("key '%s' not found in keyLocation map", key)
-	}
+	b.noteWrites(store.Name(), key)
+	b.IncrementLoad(store.Name())
+	logger.Debug("key set", "key_hash", logging.KeyHash(key), "store", store.Name())
+	return storedKey{value, store.Name(), etag}, nil
+}
 
-	url := fmt.Sprintf("http://%s/delete", storeIP)
-	data := map[string]string{
-		"key": key,
+// placeKey returns the store a write to key goes to: the store holding it,
+// so the write leaves no older copy behind, or the least loaded store for a
+// new key. A store being drained still takes writes to the keys it holds,
+// which the drain moves in a further pass. The key is looked up on the
+// primaries, as a replica may not have it yet.
+func (b *Broker) placeKey(ctx context.Context, key string) (StoreClient, error) {
+	_, owner, err := b.LookupKey(WithMaxStaleness(ctx, 0), key)
+	switch {
+	case err == nil:
+		return b.GetStore(owner)
+	case !errors.Is(err, ErrKeyNotFound):
+		return nil, err
 	}
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("Error marshalling delete request: %v\n", err)
-		return false, fmt.Errorf("error marshalling delete request: %v", err)
-	}
-
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	store, err := b.GetLeastLoadedStore()
 	if err != nil {
-		log.Printf("Error contacting KVStore at %s: %v\n", storeIP, err)
-		return false, fmt.Errorf("error contacting KVStore at %s: %v", storeIP, err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		// Successfully deleted the key, remove it from the keyLocation map
-		log.Printf("key '%s' successfully deleted from KVStore at %s", key, storeIP)
-		return true, nil
+		return nil, fmt.Errorf("no available KVStore: %w", err)
 	}
+	return store, nil
+}
 
-	// Log response if deletion failed
-	log.Printf("Failed to delete key '%s' from KVStore at %s, status code: %d\n", key, storeIP, resp.StatusCode)
-	return false, fmt.Errorf("failed to delete key '%s' from KVStore at %s, status code: %d", key, storeIP, resp.StatusCode)
+// DeleteKey deletes key from every store holding it, at ConsistencyOne.
+func (b *Broker) DeleteKey(ctx context.Context, key string) (bool, error) {
+	_, err := b.DeleteKeyAt(ctx, key, ConsistencyOne)
+	return err == nil, err
 }
 
 func (b *Broker) LoadStoreFromSnapshot(storename string, filename string) {
 	store, err := b.GetStore(storename)
 	if err != nil {
-		fmt.Println("Error retrieving store:", err)
+		b.logger.Error("error retrieving store", "store", storename, "err", err)
 		return
 	}
 
-	url := fmt.Sprintf("http://%s/load", store.IPAddress)
 	data := map[string]string{
 		"filename": filename,
 	}
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		fmt.Printf("Error marshalling load snapshot request for store %s: %v\n", storename, err)
-		return
-	}
-
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	b.forgetFilter(storename)
+	resp, err := b.storeRequest(context.Background(), http.MethodPost, store.Address(), "/load", data)
 	if err != nil {
-		fmt.Printf("Error sending load snapshot request to store %s: %v\n", storename, err)
+		b.logger.Error("error sending load snapshot request", "store", storename, "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Store %s responded with status: %d\n", storename, resp.StatusCode)
+		b.logger.Warn("load snapshot rejected", "store", storename, "status", resp.StatusCode)
 	} else {
-		fmt.Println("Data loaded successfully from", filename)
+		b.logger.Info("data loaded from snapshot", "store", storename, "file", filename)
 	}
 }
 
-func (b *Broker) GetAllData() []string {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+func (b *Broker) GetAllData(ctx context.Context) []string {
+	return b.getAllData(ctx, nil)
+}
 
+// getAllData is GetAllData for the keys of tenant t, or every key if t is nil.
+func (b *Broker) getAllData(ctx context.Context, t *tenant) []string {
 	var allData []string
-	for name, store := range b.stores {
-		url := fmt.Sprintf("http://%s/getall", store.IPAddress)
-		resp, err := http.Get(url)
+	for _, store := range b.storeList() {
+		name := store.Name()
+		resp, err := b.storeRequest(ctx, http.MethodGet, store.Address(), "/getall", nil)
 		if err != nil {
-			log.Printf("Error contacting KVStore at %s: %v", store.IPAddress, err)
+			b.logger.Error("error contacting store", "store", name, "address", store.Address(), "err", err)
 			continue
 		}
 
 		if resp.StatusCode != http.StatusOK {
-			log.Printf("KVStore %s responded with status: %d", name, resp.StatusCode)
+			b.logger.Warn("getall rejected", "store", name, "status", resp.StatusCode)
 			resp.Body.Close()
 			continue
 		}
 
 		var data map[string]string
 		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-			log.Printf("Error decoding getall response from store %s: %v", name, err)
+			b.logger.Error("error decoding getall response", "store", name, "err", err)
 			resp.Body.Close()
 			continue
 		}
 		resp.Body.Close()
 
 		for k, v := range data {
+			k, ok := t.unkey(k)
+			if !ok {
+				continue
+			}
 			allData = append(allData, fmt.Sprintf("Store: %s, Key: %s, Value: %s", name, k, v))
 		}
 	}
 	return allData
 }
 
-func (b *Broker) ListAllData() error {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	for name, store := range b.stores {
-		fmt.Printf("Store: %s\n", name)
-		url := fmt.Sprintf("http://%s/getall", store.IPAddress)
-		resp, err := http.Get(url)
-		if err != nil {
-			fmt.Printf("Error contacting KVStore at %s: %v\n", store.IPAddress, err)
-			continue
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			fmt.Printf("KVStore %s responded with status: %d\n", name, resp.StatusCode)
-			resp.Body.Close()
-			continue
-		}
-
-		var data map[string]string
-		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-			fmt.Printf("Error decoding getall response from store %s: %v\n", name, err)
-			resp.Body.Close()
-			continue
-		}
-		resp.Body.Close()
-
-		for k, v := range data {
-			fmt.Printf("  Key: %s, Value: %s\n", k, v)
-		}
-	}
-	return nil
-}
-
-// DisplayForward displays the list from head to tail (circularly)
-func (ll *LinkedList) DisplayForward() {
-	if ll.Head == nil {
-		fmt.Println("List is empty")
-		return
-	}
-
-	current := ll.Head
-	for {
-		fmt.Printf("Name: %s, IP: %s\n", current.Name, current.IpAddress)
-		current = current.Next
-		if current == ll.Head {
-			break // Completed a full circle
-		}
-	}
-}
-
 func (b *Broker) GetList() *LinkedList {
 	return b.peerlist
 }
-
-// EnablePeriodicSnapshots configures periodic snapshots for a given store.
-func (b *Broker) EnablePeriodicSnapshots(storename string, intervalSeconds int) error {
-	store, err := b.GetStore(storename)
-	if err != nil {
-		return err
-	}
-
-	url := fmt.Sprintf("http://%s/start-snapshots?interval=%d", store.IPAddress, intervalSeconds)
-	resp, err := http.Post(url, "application/json", nil)
-	if err != nil {
-		return fmt.Errorf("error sending start snapshots request to store %s: %w", storename, err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("store %s responded with status: %d", storename, resp.StatusCode)
-	}
-
-	return nil
-}
@@ -2,180 +2,555 @@ package broker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"kv/httpapi"
+	"kv/kvstore"
+	"kv/metrics"
+	"kv/transport"
+	"kv/version"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 
 	//"os"
 	"sync"
 )
 
-func NotifyPeersOfEachOther(ll *LinkedList) {
+// NotifyPeersOfEachOther tells every store in the ring, over t, which store
+// follows it.
+func NotifyPeersOfEachOther(ll *LinkedList, t transport.Transport) {
+	notifyPeers(PeerAssignments(ll), t)
+}
+
+// notifyPeers sends every store in assignments the addresses of the stores
+// it backs up. It makes network calls, so the caller must not hold b.mu.
+func notifyPeers(assignments []PeerAssignment, t transport.Transport) {
+	logger := slog.Default().With("component", "broker")
+
 	// Check if the list is empty
-	if ll.Head == nil {
-		fmt.Println("Peer list is empty. No notifications sent.")
+	if len(assignments) == 0 {
+		logger.Debug("no peer assignments, no notifications sent")
 		return
 	}
 
-	// Create a snapshot of the linked list
-	var peers []*StoreNode
-	current := ll.Head
-	for {
-		peers = append(peers, current)
-		current = current.Next
-		if current == ll.Head {
-			break // Completed a full circle
+	// Group the assignments by store, keeping ring order
+	var order []string
+	peers := make(map[string][]kvstore.PeerRef)
+	for _, assignment := range assignments {
+		if _, seen := peers[assignment.Address]; !seen {
+			order = append(order, assignment.Address)
 		}
+		peers[assignment.Address] = append(peers[assignment.Address], kvstore.PeerRef{Name: assignment.PeerName, Address: assignment.PeerAddress})
 	}
 
-	// Notify each peer about the next peer
-	for _, peer := range peers {
-		ipAddr := peer.IpAddress
-		nextPeerIP := peer.Next.IpAddress
+	// Notify each store about the stores it backs up
+	for _, ipAddr := range order {
+		nextPeerIP := peers[ipAddr][0].Address
 
-		// Skip notification if IP addresses are invalid or identical
-		if ipAddr == "" || nextPeerIP == "" {
-			fmt.Printf("Skipping notification for invalid IPs: current=%s, next=%s\n", ipAddr, nextPeerIP)
-			continue
+		// Prepare the notification payload; stores of older versions only
+		// understand peer_ip
+		url := fmt.Sprintf("http://%s%s/notify", ipAddr, httpapi.Version)
+		data := map[string]interface{}{"peer_ip": nextPeerIP}
+		if len(peers[ipAddr]) > 1 {
+			data["peers"] = peers[ipAddr]
 		}
-		if ipAddr == nextPeerIP {
-			fmt.Printf("Skipping notification: current IP (%s) is the same as next IP (%s)\n", ipAddr, nextPeerIP)
-			continue
-		}
-
-		// Prepare the notification payload
-		url := fmt.Sprintf("http://%s/notify", ipAddr)
-		data := map[string]string{"peer_ip": nextPeerIP}
 		jsonData, err := json.Marshal(data)
 		if err != nil {
-			fmt.Printf("Error marshalling data for %s: %v\n", ipAddr, err)
+			logger.Error("error marshalling peer notification", "address", ipAddr, "err", err)
 			continue
 		}
 
-		// Create and send the HTTP request
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+		// Create and send the HTTP request, with a timeout to prevent hanging requests
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 		if err != nil {
-			fmt.Printf("Error creating request to %s: %v\n", ipAddr, err)
+			cancel()
+			logger.Error("error creating peer notification", "address", ipAddr, "err", err)
 			continue
 		}
 		req.Header.Set("Content-Type", "application/json")
 
-		client := &http.Client{Timeout: 10 * time.Second} // Set timeout to prevent hanging requests
-		resp, err := client.Do(req)
+		resp, err := t.Do(req)
 		if err != nil {
-			fmt.Printf("Error sending request to %s: %v\n", ipAddr, err)
+			cancel()
+			logger.Error("error sending peer notification", "address", ipAddr, "err", err)
 			continue
 		}
 		resp.Body.Close()
+		cancel()
 
 		// Handle response status
 		if resp.StatusCode != http.StatusOK {
-			fmt.Printf("Failed to notify peer at %s, status code: %d\n", ipAddr, resp.StatusCode)
+			logger.Warn("failed to notify peer", "address", ipAddr, "status", resp.StatusCode)
 		} else {
-			fmt.Printf("Successfully notified peer at %s about %s\n", ipAddr, nextPeerIP)
+			logger.Info("notified peer", "address", ipAddr, "peer", nextPeerIP, "backups", len(peers[ipAddr]))
 		}
 	}
 }
 
-func StartPeriodicSnapshot(kvstore_ip string, interval string) error {
-	// Ensure the interval parameter is provided
-	if interval == "" {
-		return fmt.Errorf("interval parameter cannot be empty")
-	}
-
-	// Create the URL with the interval parameter
-	url := fmt.Sprintf("http://%s/start-snapshots?interval=%s", kvstore_ip, interval)
-
-	// Create and send the HTTP request
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("error sending periodic snapshots request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Check for a successful response
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("error response from store starting snapshots: %s", resp.Status)
-	}
-
-	return nil
-}
-
 // Wraps a broker to expose it via HTTP.
 type BrokerHandler struct {
-	broker *Broker
-	mu     sync.RWMutex
+	broker      *Broker
+	httpMetrics *metrics.HTTPMetrics
+	idempotency *idempotencyCache
+
+	mux    *http.ServeMux
+	router *httpapi.Router
+	hooks  []func(*httpapi.Router) // added by AddRoutes
+	routes sync.Once
 }
 
 // GetBroker returns the broker instance.
 func (h *BrokerHandler) GetBroker() *Broker {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
 	return h.broker
 }
 
 // Creates a new BrokerHandler instance.
 func NewBrokerHandler(b *Broker) *BrokerHandler {
-	return &BrokerHandler{broker: b}
+	h := &BrokerHandler{
+		broker:      b,
+		httpMetrics: metrics.NewHTTPMetrics(b.Metrics(), "broker"),
+		idempotency: newIdempotencyCache(DefaultIdempotencyTTL),
+		mux:         http.NewServeMux(),
+	}
+	h.router = httpapi.NewRouter(h.mux, httpapi.Logging(b.logger), httpapi.Tracing(), httpapi.Metrics(h.httpMetrics))
+	return h
+}
+
+// writeError replies with the error envelope for a failed broker operation.
+// Known errors get their own status and code; others get status.
+func writeError(w http.ResponseWriter, message string, err error, status int) {
+	message += ": " + err.Error()
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeKeyNotFound, message, nil)
+	case errors.Is(err, ErrStoreNotFound):
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeStoreNotFound, message, nil)
+	case errors.Is(err, ErrStoreExists):
+		httpapi.WriteError(w, http.StatusConflict, httpapi.CodeStoreExists, message, nil)
+	case errors.Is(err, ErrLastStore), errors.Is(err, ErrNoSplitTarget), errors.Is(err, ErrResizeRunning),
+		errors.Is(err, ErrMergeTooLarge):
+		httpapi.Error(w, message, http.StatusConflict)
+	case errors.Is(err, ErrQuotaExceeded):
+		httpapi.WriteError(w, http.StatusInsufficientStorage, httpapi.CodeQuotaExceeded, message, nil)
+	case errors.Is(err, ErrPreconditionFailed):
+		httpapi.WriteError(w, http.StatusPreconditionFailed, httpapi.CodePreconditionFailed, message, nil)
+	case errors.Is(err, ErrValidationFailed):
+		var details interface{}
+		var v *ValidationError
+		if errors.As(err, &v) {
+			details = v
+		}
+		httpapi.WriteError(w, http.StatusUnprocessableEntity, httpapi.CodeValidationFailed, message, details)
+	case errors.Is(err, ErrNotCounter):
+		httpapi.Error(w, message, http.StatusConflict)
+	case errors.Is(err, ErrIndexNotFound):
+		httpapi.Error(w, message, http.StatusNotFound)
+	case errors.Is(err, ErrNotInTrash):
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeKeyNotFound, message, nil)
+	case errors.Is(err, ErrKeyExists):
+		httpapi.Error(w, message, http.StatusConflict)
+	case errors.Is(err, ErrNoShadow):
+		httpapi.Error(w, message, http.StatusNotFound)
+	case errors.Is(err, ErrNoMigration):
+		httpapi.Error(w, message, http.StatusNotFound)
+	case errors.Is(err, ErrProfileNotFound), errors.Is(err, ErrJobNotFound):
+		httpapi.Error(w, message, http.StatusNotFound)
+	case errors.Is(err, ErrJobRunning), errors.Is(err, ErrNoBackupHolder), errors.Is(err, ErrNoRecoverySource),
+		errors.Is(err, ErrRecovering):
+		httpapi.Error(w, message, http.StatusConflict)
+	case errors.Is(err, kvstore.ErrMigrationFinished), errors.Is(err, kvstore.ErrMigrationAborted):
+		httpapi.Error(w, message, http.StatusConflict)
+	case errors.Is(err, ErrWriteQueueFull), errors.Is(err, ErrStoreBusy):
+		w.Header().Set("Retry-After", "1")
+		httpapi.WriteError(w, http.StatusServiceUnavailable, httpapi.CodeStoreUnavailable, message, nil)
+	case errors.Is(err, ErrNoStores):
+		httpapi.WriteError(w, http.StatusServiceUnavailable, httpapi.CodeNoStores, message, nil)
+	case status == http.StatusBadGateway:
+		httpapi.WriteError(w, status, httpapi.CodeStoreFailed, message, nil)
+	default:
+		httpapi.Error(w, message, status)
+	}
 }
 
 type RegisterRequest struct {
 	Name      string `json:"name"`
 	IPAddress string `json:"ip_address"`
+	// Heartbeat marks a periodic re-registration by a running store. It is
+	// refused with 410 Gone if the store was removed from the cluster.
+	Heartbeat bool `json:"heartbeat,omitempty"`
+	// ReplicaOf registers the store as a read replica of the store at this
+	// address instead of as a store holding keys of its own.
+	ReplicaOf string `json:"replica_of,omitempty"`
+	// Warming marks a store still loading its data from its peer. It is
+	// neither read from nor given new keys until it registers without it.
+	Warming bool `json:"warming,omitempty"`
+	// UncleanShutdown marks a store whose last run ended without a clean
+	// shutdown, e.g. because it crashed or was killed.
+	UncleanShutdown bool `json:"unclean_shutdown,omitempty"`
+	// Corrupt marks a store that started from a corrupt snapshot. It is
+	// routed nothing and asked to recover its data from its peer.
+	Corrupt bool `json:"corrupt,omitempty"`
+}
+
+// Use adds middleware, e.g. httpapi.RateLimit or httpapi.Gzip, around every
+// route, inside access logging, tracing and metrics. Call it before the
+// handler serves its first request.
+func (h *BrokerHandler) Use(mws ...httpapi.Middleware) {
+	h.router.Use(mws...)
+}
+
+// AddRoutes registers a hook that adds routes of its own, through the same
+// middleware, when the handler sets up its routes. Call it before the
+// handler serves its first request.
+func (h *BrokerHandler) AddRoutes(hook func(*httpapi.Router)) {
+	h.hooks = append(h.hooks, hook)
+}
+
+// ServeHTTP serves the broker's API from the handler's own ServeMux, so
+// several servers can run in one process. Routes are registered on the
+// first request.
+func (h *BrokerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.routes.Do(h.registerRoutes)
+	h.mux.ServeHTTP(w, r)
+}
+
+// registerRoutes sets up the broker's HTTP routes on its mux.
+func (h *BrokerHandler) registerRoutes() {
+	h.router.Use(h.broker.tenantAccess, h.broker.adminAccess)
+	h.router.Handle("/set", h.idempotent(h.SetHandler))
+	h.router.Handle("/get", h.GetHandler)
+	h.router.Handle("/getall", h.GetAllHandler, httpapi.LongRunning())
+	h.router.Handle("/mset", h.idempotent(h.MSetHandler))
+	h.router.Handle("/mget", h.MGetHandler)
+	h.router.Handle("/scan", h.ScanHandler)
+	h.router.Handle("/query", h.QueryHandler)
+	h.router.Handle("/counter/{name}/incr", h.idempotent(h.IncrHandler))
+	h.router.Handle("/stores/list", h.ListStoresHandler)
+	h.router.Handle("/stores/distribution", h.DistributionHandler)
+	h.router.Handle("/hotkeys", h.HotKeysHandler)
+	h.router.Handle("/stores/remove", h.RemoveStoreHandler, httpapi.LongRunning())
+	h.router.Handle("/stores/split", h.SplitStoreHandler, httpapi.LongRunning())
+	h.router.Handle("/stores/merge", h.MergeStoresHandler, httpapi.LongRunning())
+	h.router.Handle("/stores/replicas", h.ReplicasHandler)
+	h.router.Handle("/stores/recover", h.RecoverStoreHandler)
+	h.router.Handle("/stores/default-ttl", h.DefaultTTLHandler)
+	h.router.Handle("/failovers", h.FailoversHandler)
+	h.router.Handle("/events", h.EventsHandler)
+	h.router.Handle("/migration/status", h.MigrationStatusHandler)
+	h.router.Handle("/migration/{action}", h.MigrationControlHandler)
+	h.router.Handle("/topology", h.TopologyHandler)
+	h.router.Handle("/delete", h.idempotent(h.DeleteHandler))
+	h.router.Handle("/delete-prefix", h.DeletePrefixHandler, httpapi.LongRunning())
+	h.router.Handle("/trash", h.TrashHandler)
+	h.router.Handle("/undelete", h.UndeleteHandler, httpapi.LongRunning())
+	h.router.Handle("/expire", h.ExpireHandler)
+	h.router.Handle("/ttl", h.TTLHandler)
+	h.router.Handle("/persist", h.PersistHandler)
+	h.router.Handle("/kvstore/snapshot/manual", h.ManualSnapshotHandler, httpapi.LongRunning())
+	h.router.Handle("/kvstore/snapshot/enable", h.SnapshotKVStoreHandler)
+	h.router.Handle("/kvstore/snapshot/disable", h.DisableSnapshotHandler)
+	h.router.Handle("/kvstore/snapshot/status", h.SnapshotStatusHandler)
+	h.router.Handle("/kvstore/snapshot/attach", h.AttachSnapshotProfileHandler)
+	h.router.Handle("/kvstore/snapshot/profiles", h.SnapshotProfilesHandler)
+	h.router.Handle("/snapshot/status", h.SnapshotStatusHandler)
+	h.router.Handle("/register", h.RegisterHandler)
+	h.router.Handle("/healthz", h.HealthHandler)
+	h.router.Handle("/version", version.Handler)
+	h.router.Handle("/cluster/status", h.ClusterStatusHandler)
+	h.router.Handle("/connections", h.ConnectionsHandler)
+	h.router.Handle("/changes", h.ChangesHandler)
+	h.router.Handle("/config", h.ConfigHandler)
+	h.router.Handle("/config/reload", h.ConfigReloadHandler)
+	h.router.Handle("/tenants", h.TenantsHandler)
+	h.router.Handle("/tenant", h.TenantHandler)
+	h.router.Handle("/shadow", h.ShadowHandler)
+	h.router.Handle("/shadow/verify", h.ShadowVerifyHandler, httpapi.LongRunning())
+	h.router.Handle("/validation", h.ValidationHandler)
+	h.router.Handle("/jobs", h.JobsHandler)
+	h.router.Handle("/jobs/run", h.RunJobHandler, httpapi.LongRunning())
+	h.mux.Handle("/metrics", h.broker.Metrics())
+	h.mux.Handle("/ui/", uiHandler())
+	h.mux.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+
+	//routes added by extensions
+	for _, hook := range h.hooks {
+		hook(h.router)
+	}
+
+	// Unversioned paths from before /v1, for existing clients
+	h.mux.Handle("/", httpapi.Legacy(h.mux))
+}
+
+// adminRoutes are the routes that administer the cluster, or act on every
+// key, which require the admin token while one is set, tenants or not. A
+// tenant may still call those scoped to its own keys with its token.
+var adminRoutes = map[string]bool{
+	"/delete-prefix":             true,
+	"/stores/remove":             true,
+	"/stores/split":              true,
+	"/stores/merge":              true,
+	"/stores/replicas":           true,
+	"/stores/recover":            true,
+	"/stores/default-ttl":        true,
+	"/migration/{action}":        true,
+	"/undelete":                  true,
+	"/kvstore/snapshot/manual":   true,
+	"/kvstore/snapshot/enable":   true,
+	"/kvstore/snapshot/disable":  true,
+	"/kvstore/snapshot/status":   true,
+	"/kvstore/snapshot/attach":   true,
+	"/kvstore/snapshot/profiles": true,
+	"/snapshot/status":           true,
+	"/register":                  true,
+	"/config/reload":             true,
+	"/tenants":                   true,
+	"/shadow":                    true,
+	"/shadow/verify":             true,
+	"/validation":                true,
+	"/jobs":                      true,
+	"/jobs/run":                  true,
+}
+
+// adminAccess requires the admin token on the admin routes while one is set,
+// but for requests tenantAccess scoped to a tenant's keys.
+func (b *Broker) adminAccess(route string, next http.HandlerFunc) http.HandlerFunc {
+	if !adminRoutes[route] {
+		return next
+	}
+	authorized := httpapi.BearerAuth(b.currentAdminToken)(route, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tenantFrom(r.Context()) != nil {
+			next(w, r)
+			return
+		}
+		authorized(w, r)
+	}
+}
+
+// TenantsHandler: GET /tenants
+// Measures and reports every tenant's usage and quota. When an admin token is
+// configured the request must carry it.
+func (h *BrokerHandler) TenantsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.broker.TenantUsage(r.Context()))
+}
+
+// TenantHandler: GET /tenant
+// Measures and reports the calling tenant's usage and quota.
+func (h *BrokerHandler) TenantHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t := tenantFrom(r.Context())
+	if t == nil {
+		httpapi.Error(w, "The request was not made with a tenant token", http.StatusNotFound)
+		return
+	}
+	h.broker.measureTenant(r.Context(), t)
+	jsonResponse(w, t.status())
+}
+
+// ValidationHandler: GET /validation, POST /validation { "rules": [ { "name": "...", "prefix": "...", ... } ] }
+// Reports the rules writes are checked against and how many writes each
+// refused, or replaces them; 400 if a rule is invalid.
+func (h *BrokerHandler) ValidationHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Rules []ValidationRule `json:"rules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := h.broker.SetValidationRules(req.Rules); err != nil {
+			httpapi.Error(w, "Invalid validation rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.broker.logger.Info("validation rules replaced", "rules", len(req.Rules))
+	default:
+		httpapi.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.broker.ValidationRules())
+}
+
+// JobsHandler: GET /jobs
+// Reports the recurring jobs, when each runs next, and their most recent runs.
+func (h *BrokerHandler) JobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.broker.Jobs())
+}
+
+// RunJobHandler: POST /jobs/run { "name": "nightly-backup" }
+// Runs a job now and reports the run; 409 if it is already running.
+func (h *BrokerHandler) RunJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	run, err := h.broker.RunJob(r.Context(), req.Name)
+	if err != nil {
+		writeError(w, "Failed to run job", err, http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, run)
+}
+
+// ShadowHandler: GET /shadow
+// Reports the writes mirrored to the shadow target and the reads that differed.
+func (h *BrokerHandler) ShadowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := h.broker.ShadowReport()
+	if err != nil {
+		writeError(w, "No shadow report", err, http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, report)
+}
+
+// ShadowVerifyHandler: POST /shadow/verify { "repair": <bool> }
+// Compares every key with the shadow target; with repair, copies the keys that differ.
+func (h *BrokerHandler) ShadowVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Repair bool `json:"repair"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	result, err := h.broker.VerifyShadow(r.Context(), req.Repair)
+	if errors.Is(err, ErrNoShadow) {
+		writeError(w, "Failed to verify", err, http.StatusInternalServerError)
+		return
+	}
+	// A failed verification still reports what it compared
+	jsonResponse(w, result)
+}
+
+// ConfigHandler: GET /config
+// Returns the configuration in effect, with secrets redacted.
+func (h *BrokerHandler) ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.broker.Config())
 }
 
-// SetupRoutes sets up HTTP routes for the broker.
-func (h *BrokerHandler) SetupRoutes() {
-	http.HandleFunc("/set", h.SetHandler)
-	http.HandleFunc("/get", h.GetHandler)
-	http.HandleFunc("/getall", h.GetAllHandler)
-	http.HandleFunc("/stores/list", h.ListStoresHandler)
-	http.HandleFunc("/delete", h.DeleteHandler)
-	http.HandleFunc("/kvstore/snapshot/manual", h.ManualSnapshotHandler)
-	http.HandleFunc("/register", h.RegisterHandler)
+// ConfigReloadHandler: POST /config/reload
+// Rereads the config file, as SIGHUP does. When an admin token is configured
+// the request must carry it as "Authorization: Bearer <token>".
+func (h *BrokerHandler) ConfigReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	changed, err := h.broker.ReloadConfig(r.Context())
+	if err != nil {
+		httpapi.Error(w, "Failed to reload config: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.broker.logger.Info("config reloaded", "changed", changed)
+	jsonResponse(w, map[string]interface{}{"changed": changed})
+}
 
+// TopologyHandler: GET /topology
+func (h *BrokerHandler) TopologyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.broker.Topology())
 }
 
 // Get the value of the given key
 func (h *BrokerHandler) GetHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	key := r.URL.Query().Get("key")
+	key := tenantFrom(r.Context()).key(r.URL.Query().Get("key"))
+	ctx := r.Context()
+	if bound := r.Header.Get(kvstore.MaxStalenessHeader); bound != "" {
+		d, err := time.ParseDuration(bound)
+		if err != nil || d < 0 {
+			httpapi.Error(w, "Invalid "+kvstore.MaxStalenessHeader+" header: want a duration such as 5s", http.StatusBadRequest)
+			return
+		}
+		ctx = WithMaxStaleness(ctx, d)
+	}
 
-	h.mu.RLock()
-	defer h.mu.RUnlock()
 	// Perform the Get operation
 
-	val, err := h.broker.GetKey(key)
+	found, err := h.broker.readStoredKey(ctx, key)
+	if err == nil || errors.Is(err, ErrKeyNotFound) {
+		h.broker.shadowRead(key, found.value, err == nil)
+	}
 	if err != nil {
-		http.Error(w, "Failed to get the value: "+key+err.Error(), http.StatusInternalServerError)
+		writeError(w, "Failed to get the value", err, http.StatusBadGateway)
 		return
 	}
 
+	if found.etag != "" {
+		w.Header().Set("ETag", found.etag)
+		if match := r.Header.Get("If-None-Match"); match != "" && kvstore.MatchesETag(match, found.etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
 	// Respond with success
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	response := map[string]string{
 		"message": "Get operation successful",
-		"value":   val,
+		"value":   found.value,
+		"store":   found.store,
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
 func (h *BrokerHandler) GetAllHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	h.mu.RLock()
-	defer h.mu.RUnlock()
 	// Perform the Get operation
-	data := h.broker.GetAllData()
+	data := h.broker.getAllData(r.Context(), tenantFrom(r.Context()))
 
 	// Respond with success
 	w.WriteHeader(http.StatusOK)
@@ -185,10 +560,17 @@ func (h *BrokerHandler) GetAllHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// Assign the given key-value pair to the least loaded store
+// Write the given key-value pair to the store holding the key, or to the least
+// loaded store for a new key. ?ack=durable or
+// ?ack=replicated waits for the write to reach disk or the store's backup.
 func (h *BrokerHandler) SetHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ack := r.URL.Query().Get("ack")
+	if !ValidAck(ack) {
+		httpapi.Error(w, fmt.Sprintf("ack must be %q, %q or %q", AckLocal, AckDurable, AckReplicated), http.StatusBadRequest)
 		return
 	}
 
@@ -198,21 +580,40 @@ func (h *BrokerHandler) SetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Key == "" {
+		httpapi.Error(w, "Key cannot be empty", http.StatusBadRequest)
 		return
 	}
 
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
-	if err := h.broker.SetKey(req.Key, req.Value); err != nil {
-		http.Error(w, "Failed to set key-value pair: "+err.Error(), http.StatusInternalServerError)
+	t := tenantFrom(r.Context())
+	if err := h.broker.validateWrites(map[string]string{req.Key: req.Value}); err != nil {
+		writeError(w, "Failed to set key-value pair", err, http.StatusBadRequest)
+		return
+	}
+	if err := h.broker.reserve(r.Context(), t, map[string]string{req.Key: req.Value}); err != nil {
+		writeError(w, "Failed to set key-value pair", err, http.StatusBadGateway)
+		return
+	}
+	written, err := h.broker.SetKeyIf(r.Context(), t.key(req.Key), req.Value, kvstore.PreconditionFrom(r.Header))
+	if err != nil {
+		writeError(w, "Failed to set key-value pair", err, http.StatusBadGateway)
+		return
+	}
+	h.broker.shadowSet(map[string]string{t.key(req.Key): req.Value})
+	if err := h.broker.AwaitAck(r.Context(), written.store, t.key(req.Key), ack); err != nil {
+		writeError(w, "Key was set but not acknowledged as "+ack, err, http.StatusBadGateway)
 		return
 	}
 
 	// Respond with success
-	w.WriteHeader(http.StatusOK)
+	if written.etag != "" {
+		w.Header().Set("ETag", written.etag)
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	response := map[string]string{
 		"message": "Set operation successful",
 	}
@@ -220,204 +621,1083 @@ func (h *BrokerHandler) SetHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// ListStoresHandler lists all the stores in the broker.
-func (h *BrokerHandler) ListStoresHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+// MGetHandler: POST /mget { "keys": ["<key>", ...] }
+// Responds with {"values": {...}} holding the keys that exist.
+func (h *BrokerHandler) MGetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
 
-	stores := h.broker.ListStores()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stores)
+	t := tenantFrom(r.Context())
+	values, err := h.broker.GetKeys(r.Context(), t.keys(req.Keys))
+	if err != nil {
+		writeError(w, "Failed to get values", err, http.StatusBadGateway)
+		return
+	}
+	if t != nil {
+		own := make(map[string]string, len(values))
+		for k, v := range values {
+			if k, ok := t.unkey(k); ok {
+				own[k] = v
+			}
+		}
+		values = own
+	}
+	jsonResponse(w, map[string]interface{}{"values": values})
 }
 
-// type KVStoreConfig struct {
-// 	Name      string `json:"Name"`
-// 	IPAddress string `json:"IPAddress"`
-// }
-
-// func LoadKVStoresConfig(filepath string) ([]KVStoreConfig, error) {
-//     fmt.Printf("Loading KVStore configurations from file: %s\n", filepath)
-
-//     file, err := os.Open(filepath)
-//     if err != nil {
-//         return nil, fmt.Errorf("failed to open config file: %w", err)
-//     }
-//     defer file.Close()
-
-//     var configs []KVStoreConfig
-//     decoder := json.NewDecoder(file)
-//     if err := decoder.Decode(&configs); err != nil {
-//         return nil, fmt.Errorf("failed to decode config file: %w", err)
-//     }
-
-//     fmt.Println("Loaded KVStore configurations:")
-//     for _, config := range configs {
-//         fmt.Printf("  Name: %s, IP Address: %s\n", config.Name, config.IPAddress)
-//     }
-
-//     return configs, nil
-// }
-
-// DeleteHandler: POST /delete { "key": "..." }
-// DeleteHandler: POST /delete { "key": "..." }
-func (h *BrokerHandler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+// MSetHandler: POST /mset { "pairs": { "<key>": "<value>", ... } }
+func (h *BrokerHandler) MSetHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	var req struct {
-		Key string `json:"key"`
+		Pairs map[string]string `json:"pairs"`
 	}
-
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, ok := req.Pairs[""]; ok {
+		httpapi.Error(w, "Keys cannot be empty", http.StatusBadRequest)
 		return
 	}
 
-	// Acquire lock for broker operations
-	h.mu.Lock()
-	deleted, error := h.broker.DeleteKey(req.Key)
-	h.mu.Unlock()
-
-	if deleted {
-		// Key was successfully deleted
-		response := map[string]string{
-			"message": fmt.Sprintf("Key '%s' successfully deleted.", req.Key),
+	t := tenantFrom(r.Context())
+	if err := h.broker.validateWrites(req.Pairs); err != nil {
+		writeError(w, "Failed to set key-value pairs", err, http.StatusBadRequest)
+		return
+	}
+	if err := h.broker.reserve(r.Context(), t, req.Pairs); err != nil {
+		writeError(w, "Failed to set key-value pairs", err, http.StatusBadGateway)
+		return
+	}
+	pairs := req.Pairs
+	if t != nil {
+		pairs = make(map[string]string, len(req.Pairs))
+		for k, v := range req.Pairs {
+			pairs[t.key(k)] = v
 		}
-		jsonResponse(w, response)
-	} else {
-		// Key was not found
-		http.Error(w, fmt.Sprintf("Error: %s", error), http.StatusNotFound)
 	}
+	if err := h.broker.SetKeys(r.Context(), pairs); err != nil {
+		writeError(w, "Failed to set key-value pairs", err, http.StatusBadGateway)
+		return
+	}
+	h.broker.shadowSet(pairs)
+	jsonResponse(w, map[string]interface{}{
+		"message": "MSet operation successful",
+		"count":   len(req.Pairs),
+	})
 }
 
-// SnapshotKVStoreHandler: POST /snapshot/enable { "storename": "...", "interval": <seconds> }
-func (h *BrokerHandler) SnapshotKVStoreHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+// ScanHandler: GET /scan?prefix=<p>&cursor=<c>&limit=<n>
+// Pages through every key-value pair in key order; pass the returned "next" back as cursor.
+func (h *BrokerHandler) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req struct {
-		Storename string `json:"storename"`
-		Interval  int    `json:"interval"`
+	query := r.URL.Query()
+	limit := 0
+	if limitStr := query.Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed < 0 {
+			httpapi.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	t := tenantFrom(r.Context())
+	cursor := query.Get("cursor")
+	if cursor != "" {
+		cursor = t.key(cursor)
+	}
+	page, err := h.broker.Scan(r.Context(), t.key(query.Get("prefix")), cursor, limit)
+	if err != nil {
+		writeError(w, "Failed to scan", err, http.StatusBadGateway)
 		return
 	}
-	h.mu.Lock()
-	err := h.broker.EnablePeriodicSnapshots(req.Storename, req.Interval)
-	h.mu.Unlock()
+	if t != nil {
+		for i := range page.Items {
+			page.Items[i].Key, _ = t.unkey(page.Items[i].Key)
+		}
+		page.Next, _ = t.unkey(page.Next)
+	}
+	jsonResponse(w, page)
+}
 
-	if err != nil {
-		http.Error(w, "Failed to enable periodic snapshots: "+err.Error(), http.StatusNotFound)
+// QueryHandler: GET /query?index=email&value=<v>&cursor=<c>&limit=<n>
+// Returns the pairs whose value the secondary index holds under v, from every store, in key order; pass
+// the returned "next" back as cursor for the following page.
+func (h *BrokerHandler) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	response := map[string]string{
-		"message": fmt.Sprintf("Periodic snapshots enabled for store %s with interval %d seconds.", req.Storename, req.Interval),
+	query := r.URL.Query()
+	if query.Get("index") == "" {
+		httpapi.Error(w, "Missing index parameter", http.StatusBadRequest)
+		return
 	}
-	jsonResponse(w, response)
+	limit := 0
+	if limitStr := query.Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed < 0 {
+			httpapi.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	page, err := h.broker.Query(r.Context(), query.Get("index"), query.Get("value"), query.Get("cursor"), limit)
+	if err != nil {
+		writeError(w, "Failed to query", err, http.StatusBadGateway)
+		return
+	}
+	jsonResponse(w, page)
 }
 
-// NewKVHandler: POST /store/new { "name": "...", "ip_address": "..." }
-func (h *BrokerHandler) NewKVHandler(w http.ResponseWriter, r *http.Request) {
+// IncrHandler: POST /counter/{name}/incr {"delta": 1}
+// Adds delta (1 if the body is empty, never negative) to the named counter and responds with its new value, after the
+// stores backing up its store recorded it.
+func (h *BrokerHandler) IncrHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req struct {
-		Name      string `json:"Name"`
-		IPAddress string `json:"IPAddress"`
+	req := struct {
+		Delta int64 `json:"delta"`
+	}{Delta: 1}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
 	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if req.Delta < 0 {
+		httpapi.Error(w, "Counters only go up; delta cannot be negative", http.StatusBadRequest)
 		return
 	}
 
-	h.mu.Lock()
-	err := h.broker.CreateStore(req.Name, req.IPAddress)
-	h.mu.Unlock()
-
+	name := r.PathValue("name")
+	value, err := h.broker.Incr(r.Context(), name, req.Delta)
+	if errors.Is(err, ErrCounterNotBackedUp) {
+		// Incremented all the same; say to what
+		httpapi.WriteError(w, http.StatusBadGateway, httpapi.CodeStoreFailed, "Failed to back up counter: "+err.Error(), kvstore.IncrResponse{Key: name, Value: value})
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to create new store: "+err.Error(), http.StatusBadRequest)
+		writeError(w, "Failed to increment counter", err, http.StatusBadGateway)
 		return
 	}
+	jsonResponse(w, kvstore.IncrResponse{Key: name, Value: value})
+}
 
-	response := map[string]string{
-		"message": "New store created: " + req.Name,
+// ListStoresHandler lists all the stores in the broker.
+func (h *BrokerHandler) ListStoresHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	jsonResponse(w, response)
+
+	stores := h.broker.ListStores()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stores)
 }
 
-// ManualSnapshotHandler: POST /snapshot/manual
-func (h *BrokerHandler) ManualSnapshotHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+// DistributionHandler: GET /stores/distribution
+// Reports how many keys and bytes each store holds and the skew versus an even split.
+func (h *BrokerHandler) DistributionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	h.mu.Lock()
-	err := h.broker.ManualSnapshotStore()
-	h.mu.Unlock()
+	jsonResponse(w, h.broker.KeyDistribution(r.Context()))
+}
 
-	if err != nil {
-		http.Error(w, "Failed to perform manual snapshot: "+err.Error(), http.StatusInternalServerError)
+// HotKeysHandler: GET /hotkeys?limit=<n>
+// Reports the keys accessed most often across the stores, with approximate counts, and each store's part of
+// the accesses; limit defaults to 10 and is at most 100.
+func (h *BrokerHandler) HotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	response := map[string]string{
-		"message": "Manual snapshot successful",
+	limit, err := kvstore.HotKeysLimit(r)
+	if err != nil {
+		httpapi.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	jsonResponse(w, response)
+	jsonResponse(w, h.broker.HotKeys(r.Context(), limit))
 }
 
-// SnapshotBrokerHandler: POST /snapshot/broker
-
-func jsonResponse(w http.ResponseWriter, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+// ConnectionsHandler: GET /connections
+// Reports the client connections to the broker and its connection pool to each store: open, in use and
+// idle connections, how often they are reused and how much of the pool is in use.
+func (h *BrokerHandler) ConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.broker.ConnectionStats())
 }
 
-// RegisterHandler handles registration of KVStore instances
-func (h *BrokerHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+// DeleteHandler: POST /delete?consistency=<one|quorum|all> { "key": "...", "if_value": "..." }
+// Deletes a key from every store holding it and reports which copies confirmed it; ?consistency=quorum or all waits
+// for a majority or every copy, backup holders and read replicas included. With if_value, or an If-Match or
+// If-None-Match header, it deletes only while the value of the store holding it satisfies it.
+func (h *BrokerHandler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	consistency := r.URL.Query().Get("consistency")
+	if !ValidConsistency(consistency) {
+		httpapi.Error(w, fmt.Sprintf("consistency must be %q, %q or %q", ConsistencyOne, ConsistencyQuorum, ConsistencyAll), http.StatusBadRequest)
 		return
 	}
 
-	var req RegisterRequest
+	var req struct {
+		Key string `json:"key"`
+		// IfValue, if set, has the key deleted only while it holds that value
+		IfValue *string `json:"if_value"`
+	}
+
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	p := kvstore.PreconditionFrom(r.Header)
+	p.IfValue = req.IfValue
+
+	key := tenantFrom(r.Context()).key(req.Key)
+	deletion, err := h.broker.DeleteKeyIf(r.Context(), key, consistency, p)
+	deletion.Key = req.Key
+	switch {
+	case errors.Is(err, ErrDeleteUnconfirmed):
+		// Deleted all the same: mirror it, and say which copies confirmed it
+		h.broker.shadowWrite(key, "/delete", map[string]string{"key": key})
+		httpapi.WriteError(w, http.StatusBadGateway, httpapi.CodeStoreFailed, "Key deletion was not confirmed at "+deletion.Consistency+": "+err.Error(), deletion)
+	case err != nil:
+		writeError(w, "Failed to delete key", err, http.StatusBadGateway)
+	default:
+		h.broker.shadowWrite(key, "/delete", map[string]string{"key": key})
+		jsonResponse(w, struct {
+			Message string `json:"message"`
+			KeyDeletion
+		}{fmt.Sprintf("Key '%s' successfully deleted.", req.Key), deletion})
+	}
+}
 
-	// Create the store in the Broker
-	err := h.broker.CreateStore(req.Name, req.IPAddress)
-	if err != nil {
-		http.Error(w, "Failed to create store: "+err.Error(), http.StatusBadRequest)
+// DeletePrefixHandler: POST /delete-prefix?dry_run=<bool> { "prefix": "..." }
+// Deletes every key starting with prefix from every store and reports how many each deleted; a dry run
+// only counts them. If a store fails, the keys on the others are deleted all the same.
+func (h *BrokerHandler) DeletePrefixHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Start Periodic Snapshots
-	//StartPeriodicSnapshot(req.IPAddress, "15")
+	var req struct {
+		Prefix string `json:"prefix"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Prefix == "" {
+		httpapi.Error(w, "prefix is required", http.StatusBadRequest)
+		return
+	}
+	dryRun, err := httpapi.DryRun(r)
+	if err != nil {
+		httpapi.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prefix := tenantFrom(r.Context()).key(req.Prefix)
+	result, err := h.broker.DeletePrefix(r.Context(), prefix, dryRun)
+	if !dryRun && result.Deleted > 0 {
+		h.broker.shadowWrite(prefix, "/delete-prefix", map[string]string{"prefix": prefix})
+	}
+	if err != nil {
+		writeError(w, fmt.Sprintf("Failed to delete keys by prefix (%d deleted)", result.Deleted), err, http.StatusBadGateway)
+		return
+	}
+	result.Prefix = req.Prefix
+	jsonResponse(w, result)
+}
 
-	// Optionally, notify existing peers about the new store
-	NotifyPeersOfEachOther(h.broker.peerlist)
+// TrashHandler: GET /trash?prefix=<p>
+// Lists the deleted keys held in the stores' trash, with the store holding
+// each and when it is purged.
+func (h *BrokerHandler) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := h.broker.Trash(r.Context(), r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(w, "Failed to list the trash", err, http.StatusBadGateway)
+		return
+	}
+	jsonResponse(w, report)
+}
+
+// UndeleteHandler: POST /undelete { "key": "..." } or { "prefix": "..." }
+// Restores a deleted key, or every deleted key starting with prefix, from the
+// stores' trash. 404 if the key is not in the trash, 409 if it was written
+// again since it was deleted.
+func (h *BrokerHandler) UndeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Key    string `json:"key"`
+		Prefix string `json:"prefix"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if (req.Key == "") == (req.Prefix == "") {
+		httpapi.Error(w, "Exactly one of key and prefix is required", http.StatusBadRequest)
+		return
+	}
+
+	prefix, exact := req.Prefix, false
+	if req.Key != "" {
+		prefix, exact = req.Key, true
+	}
+	result, err := h.broker.Undelete(r.Context(), prefix, exact)
+	if err != nil {
+		writeError(w, fmt.Sprintf("Failed to undelete (%d restored)", result.Restored), err, http.StatusBadGateway)
+		return
+	}
+	jsonResponse(w, result)
+}
+
+// ttlError writes the response for a failed TTL operation.
+func ttlError(w http.ResponseWriter, key string, err error) {
+	if errors.Is(err, ErrKeyNotFound) {
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeKeyNotFound, fmt.Sprintf("Key '%s' not found", key), nil)
+		return
+	}
+	writeError(w, "Failed to update TTL", err, http.StatusBadGateway)
+}
+
+// ExpireHandler: POST /expire { "key": "...", "seconds": <n> }
+func (h *BrokerHandler) ExpireHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Key     string `json:"key"`
+		Seconds int    `json:"seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Seconds <= 0 {
+		httpapi.Error(w, "seconds must be positive", http.StatusBadRequest)
+		return
+	}
+
+	key := tenantFrom(r.Context()).key(req.Key)
+	if err := h.broker.Expire(r.Context(), key, req.Seconds); err != nil {
+		ttlError(w, req.Key, err)
+		return
+	}
+	h.broker.shadowWrite(key, "/expire", map[string]interface{}{"key": key, "seconds": req.Seconds})
+	jsonResponse(w, map[string]interface{}{"key": req.Key, "ttl": req.Seconds})
+}
+
+// TTLHandler: GET /ttl?key=<key>
+// Reports the seconds left before the key expires, or -1 if it has no TTL.
+func (h *BrokerHandler) TTLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		httpapi.Error(w, "Key cannot be empty", http.StatusBadRequest)
+		return
+	}
+	ttl, err := h.broker.TTL(r.Context(), tenantFrom(r.Context()).key(key))
+	if err != nil {
+		ttlError(w, key, err)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{"key": key, "ttl": ttl})
+}
+
+// PersistHandler: POST /persist { "key": "..." }
+// Removes the key's TTL; "persisted" reports whether it had one.
+func (h *BrokerHandler) PersistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	key := tenantFrom(r.Context()).key(req.Key)
+	had, err := h.broker.Persist(r.Context(), key)
+	if err != nil {
+		ttlError(w, req.Key, err)
+		return
+	}
+	h.broker.shadowWrite(key, "/persist", map[string]string{"key": key})
+	jsonResponse(w, map[string]interface{}{"key": req.Key, "persisted": had})
+}
+
+// SnapshotKVStoreHandler: POST /kvstore/snapshot/enable { "storename": "...", "interval": <seconds> }
+func (h *BrokerHandler) SnapshotKVStoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Storename string `json:"storename"`
+		Interval  int    `json:"interval"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Interval <= 0 {
+		httpapi.Error(w, "interval must be a positive number of seconds", http.StatusBadRequest)
+		return
+	}
+	err := h.broker.EnablePeriodicSnapshots(r.Context(), req.Storename, req.Interval)
+
+	if err != nil {
+		writeError(w, "Failed to enable periodic snapshots", err, http.StatusBadGateway)
+		return
+	}
 
-	// Respond with success
 	response := map[string]string{
-		"message": "Store registered successfully",
+		"message": fmt.Sprintf("Periodic snapshots enabled for store %s with interval %d seconds.", req.Storename, req.Interval),
+	}
+	jsonResponse(w, response)
+}
+
+// DisableSnapshotHandler: POST /kvstore/snapshot/disable { "storename": "..." }
+func (h *BrokerHandler) DisableSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Storename string `json:"storename"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	err := h.broker.DisablePeriodicSnapshots(r.Context(), req.Storename)
+
+	if err != nil {
+		writeError(w, "Failed to disable periodic snapshots", err, http.StatusBadGateway)
+		return
+	}
+
+	response := map[string]string{
+		"message": fmt.Sprintf("Periodic snapshots disabled for store %s.", req.Storename),
+	}
+	jsonResponse(w, response)
+}
+
+// AttachSnapshotProfileHandler: POST /kvstore/snapshot/attach { "storename": "...", "profile": "..." }
+func (h *BrokerHandler) AttachSnapshotProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Storename string `json:"storename"`
+		Profile   string `json:"profile"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	err := h.broker.AttachSnapshotProfile(r.Context(), req.Storename, req.Profile)
+
+	if err != nil {
+		writeError(w, "Failed to attach snapshot profile", err, http.StatusBadGateway)
+		return
+	}
+
+	response := map[string]string{
+		"message": fmt.Sprintf("Snapshot profile %s attached to store %s.", req.Profile, req.Storename),
+	}
+	jsonResponse(w, response)
+}
+
+// SnapshotProfilesHandler: GET /kvstore/snapshot/profiles
+// Lists the configured snapshot profiles.
+func (h *BrokerHandler) SnapshotProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.broker.SnapshotProfiles())
+}
+
+// SnapshotStatusHandler: GET /snapshot/status?storename=<name> (also /kvstore/snapshot/status)
+// Reports each store's periodic snapshot schedule, the schedule the broker keeps applied and the last
+// successful and failed snapshots, for one store or all.
+func (h *BrokerHandler) SnapshotStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses, err := h.broker.SnapshotStatus(r.Context(), r.URL.Query().Get("storename"))
+	if err != nil {
+		writeError(w, "Failed to get snapshot status", err, http.StatusBadGateway)
+		return
+	}
+	jsonResponse(w, statuses)
+}
+
+// DefaultTTLHandler: GET /stores/default-ttl?storename=<name>, POST /stores/default-ttl { "storename": "...", "seconds": <n> }
+// Reports the default TTL of every store, or of the named one, or sets a store's; 0 seconds removes it.
+func (h *BrokerHandler) DefaultTTLHandler(w http.ResponseWriter, r *http.Request) {
+	storename := r.URL.Query().Get("storename")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Storename string `json:"storename"`
+			Seconds   int    `json:"seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Storename == "" {
+			httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Seconds < 0 {
+			httpapi.Error(w, "seconds must not be negative", http.StatusBadRequest)
+			return
+		}
+		if err := h.broker.SetDefaultTTL(r.Context(), req.Storename, time.Duration(req.Seconds)*time.Second); err != nil {
+			writeError(w, "Failed to set default TTL", err, http.StatusBadGateway)
+			return
+		}
+		storename = req.Storename
+	default:
+		httpapi.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ttls, err := h.broker.DefaultTTLs(r.Context(), storename)
+	if err != nil {
+		writeError(w, "Failed to get default TTL", err, http.StatusBadGateway)
+		return
+	}
+	jsonResponse(w, ttls)
+}
+
+// NewKVHandler: POST /store/new { "name": "...", "ip_address": "..." }
+func (h *BrokerHandler) NewKVHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name      string `json:"Name"`
+		IPAddress string `json:"IPAddress"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.broker.CreateStore(req.Name, req.IPAddress)
+
+	if err != nil {
+		writeError(w, "Failed to create new store", err, http.StatusBadRequest)
+		return
+	}
+
+	response := map[string]string{
+		"message": "New store created: " + req.Name,
 	}
 	jsonResponse(w, response)
 }
+
+// ManualSnapshotHandler: POST /snapshot/manual
+func (h *BrokerHandler) ManualSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := h.broker.ManualSnapshotStore(r.Context())
+
+	if err != nil {
+		writeError(w, "Failed to perform manual snapshot", err, http.StatusBadGateway)
+		return
+	}
+
+	response := map[string]string{
+		"message": "Manual snapshot successful",
+	}
+	jsonResponse(w, response)
+}
+
+// HealthHandler: GET /healthz
+// Reports the fraction of registered stores the health checker considers UP.
+// Responds 503 only when stores are registered but none of them is healthy.
+func (h *BrokerHandler) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	healthy, total := h.broker.HealthyStores()
+	status := "ok"
+	fraction := 1.0
+	if total > 0 {
+		fraction = float64(healthy) / float64(total)
+		if healthy == 0 {
+			status = "unavailable"
+		} else if healthy < total {
+			status = "degraded"
+		}
+	}
+
+	response := map[string]interface{}{
+		"status":           status,
+		"healthy_stores":   healthy,
+		"total_stores":     total,
+		"healthy_fraction": fraction,
+		"stores":           h.broker.StoreHealth(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status == "unavailable" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// RemoveStoreHandler: POST /stores/remove?dry_run=<bool> { "name": "...", "drain": true, "handoff": false }
+// Removes a store from the cluster. With drain, its keys are first moved to the remaining stores; with
+// handoff, the store pushes them to its ring successor itself and confirms they arrived. Without either,
+// they are no longer reachable through the broker. A dry run reports the keys affected, the stores that
+// would be contacted and the steps taken, without removing the store. When an admin token is configured
+// the request must carry it, since the broker shuts the store down with its own.
+func (h *BrokerHandler) RemoveStoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name    string `json:"name"`
+		Drain   bool   `json:"drain"`
+		Handoff bool   `json:"handoff"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Drain && req.Handoff {
+		httpapi.Error(w, "drain and handoff cannot both be set", http.StatusBadRequest)
+		return
+	}
+	isReplica := h.broker.ReplicaExists(req.Name)
+	if !isReplica && !h.broker.StoreExists(req.Name) {
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeStoreNotFound, "Store not found: "+req.Name, nil)
+		return
+	}
+	dryRun, err := httpapi.DryRun(r)
+	if err != nil {
+		httpapi.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		mode := RemovePlain
+		if req.Drain {
+			mode = RemoveDrain
+		} else if req.Handoff {
+			mode = RemoveHandoff
+		}
+		plan, err := h.broker.PlanRemoval(r.Context(), req.Name, mode)
+		if err != nil {
+			writeError(w, "Cannot remove store", err, http.StatusBadGateway)
+			return
+		}
+		jsonResponse(w, plan)
+		return
+	}
+
+	moved := 0
+	target := ""
+	// A replica holds no keys of its own, so there is nothing to drain
+	if req.Drain && !isReplica {
+		moved, err = h.broker.DrainStore(r.Context(), req.Name)
+	} else if req.Handoff && !isReplica {
+		moved, target, err = h.broker.HandOffStore(r.Context(), req.Name)
+	} else {
+		err = h.broker.RemoveStore(req.Name)
+	}
+	if err != nil {
+		writeError(w, "Failed to remove store", err, http.StatusBadGateway)
+		return
+	}
+
+	response := map[string]interface{}{
+		"message":    "Store removed: " + req.Name,
+		"keys_moved": moved,
+	}
+	if target != "" {
+		response["handed_off_to"] = target
+	}
+	jsonResponse(w, response)
+}
+
+// SplitStoreHandler: POST /stores/split { "name": "...", "target": "..." }
+// Moves the keys in the upper half of the store's hash range to target, or to the least loaded other store.
+func (h *BrokerHandler) SplitStoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name   string `json:"name"`
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	moved, target, err := h.broker.SplitStore(r.Context(), req.Name, req.Target)
+	if err != nil {
+		writeError(w, "Failed to split store "+req.Name, err, http.StatusBadGateway)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"message":    "Store split: " + req.Name,
+		"target":     target,
+		"keys_moved": moved,
+	})
+}
+
+// RecoverStoreHandler: GET /stores/recover?name=<store>, POST /stores/recover { "name": "..." }
+// Has the store replace its data with the backup its peer holds, streamed from the peer, and routes nothing to it
+// until loaded. It answers once the store has started, with the progress; GET reports the progress.
+func (h *BrokerHandler) RecoverStoreHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			httpapi.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		recovery, err := h.broker.RecoveryStatus(r.Context(), name)
+		if err != nil {
+			writeError(w, "Failed to get recovery status of store "+name, err, http.StatusBadGateway)
+			return
+		}
+		jsonResponse(w, recovery)
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		recovery, err := h.broker.RecoverStore(r.Context(), req.Name)
+		if err != nil {
+			writeError(w, "Failed to recover store "+req.Name, err, http.StatusBadGateway)
+			return
+		}
+		jsonResponse(w, recovery)
+	default:
+		httpapi.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// MergeStoresHandler: POST /stores/merge { "name": "...", "into": "..." }
+// Moves every key of the store into another, the least loaded if into is omitted, and removes the store.
+func (h *BrokerHandler) MergeStoresHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+		Into string `json:"into"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	moved, into, err := h.broker.MergeStores(r.Context(), req.Name, req.Into)
+	if err != nil {
+		writeError(w, "Failed to merge store "+req.Name, err, http.StatusBadGateway)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"message":    "Store merged: " + req.Name,
+		"into":       into,
+		"keys_moved": moved,
+	})
+}
+
+// MigrationStatusHandler: GET /migration/status
+// Reports the latest drain, handoff, split or merge of each store: keys and bytes moved, rate, ETA and state.
+func (h *BrokerHandler) MigrationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.broker.Migrations(r.Context()))
+}
+
+// MigrationControlHandler: POST /migration/{pause,resume,abort} { "store": "..." }
+// Pauses, resumes or aborts the drain, handoff, split or merge of a store between batches.
+func (h *BrokerHandler) MigrationControlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	action := r.PathValue("action")
+	if action != "pause" && action != "resume" && action != "abort" {
+		httpapi.Error(w, "Unknown migration action: "+action, http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Store string `json:"store"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Store == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	status, err := h.broker.ControlMigration(r.Context(), req.Store, action)
+	if err != nil {
+		writeError(w, "Failed to "+action+" migration of "+req.Store, err, http.StatusBadGateway)
+		return
+	}
+	jsonResponse(w, status)
+}
+
+// ReplicasHandler: GET /stores/replicas
+// Lists the read replicas with their primary, staleness and whether they serve reads.
+func (h *BrokerHandler) ReplicasHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.broker.Replicas())
+}
+
+// FailoversHandler: GET /failovers
+// Reports the most recent failovers: keys expected and recovered, keys moved off the survivor and the stores
+// that backed their peers up again.
+func (h *BrokerHandler) FailoversHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.broker.Failovers())
+}
+
+// EventsHandler: GET /events?since=<seq|RFC 3339 time>&limit=<n>
+// Reports the cluster events after a sequence number or a time, oldest first. Pass the returned next back as since.
+func (h *BrokerHandler) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			httpapi.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		jsonResponse(w, h.broker.Events(0, limit))
+		return
+	}
+	if seq, err := strconv.ParseUint(since, 10, 64); err == nil {
+		jsonResponse(w, h.broker.Events(seq, limit))
+		return
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		httpapi.Error(w, "Invalid since parameter: neither a sequence number nor an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	jsonResponse(w, h.broker.EventsSince(t, limit))
+}
+
+// ClusterStatusHandler: GET /cluster/status
+// Reports every store's address, health, load, peers and running version.
+func (h *BrokerHandler) ClusterStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, h.broker.ClusterStatus(r.Context()))
+}
+
+// ChangesHandler: GET /changes?cursor=<store:seq,...>&limit=<n>
+// Aggregates the change feeds of all stores. Pass the returned cursor back to continue.
+func (h *BrokerHandler) ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cursor, err := ParseChangeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		httpapi.Error(w, "Invalid cursor: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			httpapi.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes := h.broker.Changes(r.Context(), cursor, limit)
+	if t := tenantFrom(r.Context()); t != nil {
+		for name, feed := range changes.Stores {
+			own := feed.Changes[:0]
+			for _, change := range feed.Changes {
+				// Resets have no key and concern every tenant
+				if key, ok := t.unkey(change.Key); ok || change.Key == "" {
+					change.Key = key
+					own = append(own, change)
+				}
+			}
+			feed.Changes = own
+			changes.Stores[name] = feed
+		}
+	}
+	jsonResponse(w, changes)
+}
+
+// SnapshotBrokerHandler: POST /snapshot/broker
+
+func jsonResponse(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// RegisterHandler handles registration of KVStore instances
+func (h *BrokerHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Heartbeat {
+		// A known store needs nothing; one the broker lost (e.g. after a
+		// restart) is registered again below
+		if h.broker.WasRemoved(req.Name) {
+			httpapi.Error(w, "Store was removed from the cluster", http.StatusGone)
+			return
+		}
+		if h.broker.StoreExists(req.Name) {
+			h.broker.SetWarming(req.Name, req.Warming)
+			jsonResponse(w, h.registered(req.Name, "Store already registered"))
+			return
+		}
+	}
+
+	if req.ReplicaOf != "" {
+		if err := h.broker.AddReplica(req.Name, req.IPAddress, req.ReplicaOf); err != nil {
+			writeError(w, "Failed to register replica", err, http.StatusBadRequest)
+			return
+		}
+		jsonResponse(w, map[string]string{"message": "Replica registered successfully"})
+		return
+	}
+
+	// Create the store in the Broker
+	err := h.broker.createStore(req.Name, req.IPAddress, req.Warming)
+	if err != nil {
+		writeError(w, "Failed to create store", err, http.StatusBadRequest)
+		return
+	}
+
+	// Apply the configured snapshot schedule and indexes, if any
+	h.broker.applySnapshotSchedule(r.Context(), req.Name)
+	h.broker.applyIndexes(r.Context(), req.Name, nil)
+	h.broker.applyBackgroundLimit(r.Context(), req.Name)
+	h.broker.applyDefaultTTL(r.Context(), req.Name)
+	if req.UncleanShutdown {
+		h.broker.uncleanShutdown(req.Name)
+	}
+	if req.Corrupt {
+		h.broker.storeCorrupt(req.Name)
+	}
+
+	// Respond with success
+	jsonResponse(w, h.registered(req.Name, "Store registered successfully"))
+}
+
+// registered is the response to a store's registration. "backup" is the
+// address of the store holding the backup of its data, which a warming
+// store loads from.
+func (h *BrokerHandler) registered(name, message string) map[string]string {
+	response := map[string]string{"message": message}
+	if addr, _, err := h.broker.GetStorePeerIP(name); err == nil {
+		response["backup"] = addr
+	}
+	return response
+}
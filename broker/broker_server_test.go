@@ -0,0 +1,167 @@
+package broker
+
+import (
+	"context"
+	"kv/httpapi"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// serve sends a request to the broker's API with token as a bearer token,
+// if set, and returns the response status.
+func serve(t *testing.T, h http.Handler, method, path, body, token string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, "/v1"+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestRemoveStoreRequiresAdminToken(t *testing.T) {
+	b, _, _ := memoryBroker(t, 2)
+	b.SetAdminToken("secret")
+	h := NewBrokerHandler(b)
+
+	for _, token := range []string{"", "wrong"} {
+		if code := serve(t, h, http.MethodPost, "/stores/remove", `{"name": "store1"}`, token); code != http.StatusUnauthorized {
+			t.Errorf("remove with token %q: status %d, want 401", token, code)
+		}
+	}
+	if !slices.Contains(b.ListStores(), "store1") {
+		t.Fatal("store1 removed without the admin token")
+	}
+	if code := serve(t, h, http.MethodPost, "/stores/remove", `{"name": "store1"}`, "secret"); code != http.StatusOK {
+		t.Errorf("remove with the admin token: status %d, want 200", code)
+	}
+	if slices.Contains(b.ListStores(), "store1") {
+		t.Error("store1 still registered after removal with the admin token")
+	}
+}
+
+func TestAdminRoutesRequireAdminToken(t *testing.T) {
+	b, _, _ := memoryBroker(t, 2)
+	b.SetAdminToken("secret")
+	h := NewBrokerHandler(b)
+
+	for route := range adminRoutes {
+		path := strings.Replace(route, "{action}", "pause", 1)
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			if code := serve(t, h, method, path, `{}`, ""); code != http.StatusUnauthorized {
+				t.Errorf("%s %s without the admin token: status %d, want 401", method, path, code)
+			}
+			if code := serve(t, h, method, path, `{}`, "wrong"); code != http.StatusUnauthorized {
+				t.Errorf("%s %s with a wrong token: status %d, want 401", method, path, code)
+			}
+		}
+	}
+	if code := serve(t, h, http.MethodGet, "/kvstore/snapshot/profiles", "", "secret"); code != http.StatusOK {
+		t.Errorf("GET /kvstore/snapshot/profiles with the admin token: status %d, want 200", code)
+	}
+	if code := serve(t, h, http.MethodGet, "/stores/list", "", ""); code != http.StatusOK {
+		t.Errorf("GET /stores/list without a token: status %d, want 200", code)
+	}
+}
+
+func TestDeletePrefixRequiresAdminOrTenantToken(t *testing.T) {
+	b, _, _ := memoryBroker(t, 2)
+	b.SetAdminToken("secret")
+	h := NewBrokerHandler(b)
+	ctx := context.Background()
+	for _, key := range []string{"user:1", "acme/user:1"} {
+		if err := b.SetKey(ctx, key, "v"); err != nil {
+			t.Fatalf("SetKey(%q): %v", key, err)
+		}
+	}
+
+	if code := serve(t, h, http.MethodPost, "/delete-prefix", `{"prefix": "user:"}`, ""); code != http.StatusUnauthorized {
+		t.Errorf("delete-prefix without a token: status %d, want 401", code)
+	}
+	if _, err := b.GetKey(ctx, "user:1"); err != nil {
+		t.Fatalf("user:1 deleted without a token: %v", err)
+	}
+
+	b.SetTenants([]TenantConfig{{Name: "acme", Token: "acme-token"}})
+	if code := serve(t, h, http.MethodPost, "/delete-prefix", `{"prefix": "user:"}`, "acme-token"); code != http.StatusOK {
+		t.Errorf("delete-prefix with a tenant token: status %d, want 200", code)
+	}
+	if _, err := b.GetKey(ctx, "acme/user:1"); err == nil {
+		t.Error("acme/user:1 survived the tenant's delete-prefix")
+	}
+	if _, err := b.GetKey(ctx, "user:1"); err != nil {
+		t.Errorf("the tenant's delete-prefix reached user:1: %v", err)
+	}
+
+	if code := serve(t, h, http.MethodPost, "/delete-prefix", `{"prefix": "user:"}`, "secret"); code != http.StatusOK {
+		t.Errorf("delete-prefix with the admin token: status %d, want 200", code)
+	}
+	if _, err := b.GetKey(ctx, "user:1"); err == nil {
+		t.Error("user:1 survived the admin's delete-prefix")
+	}
+}
+
+func TestEmptyKeysRefused(t *testing.T) {
+	b, _, stores := memoryBroker(t, 2)
+	h := NewBrokerHandler(b)
+
+	tests := []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/set", `{"key": "", "value": "v"}`},
+		{http.MethodPost, "/set", `{"value": "v"}`},
+		{http.MethodPost, "/mset", `{"pairs": {"": "v"}}`},
+		{http.MethodGet, "/ttl?key=", ""},
+		{http.MethodGet, "/ttl", ""},
+	}
+	for _, tt := range tests {
+		if code := serve(t, h, tt.method, tt.path, tt.body, ""); code != http.StatusBadRequest {
+			t.Errorf("%s %s %s: status %d, want 400", tt.method, tt.path, tt.body, code)
+		}
+	}
+	if got := holders(stores, ""); len(got) != 0 {
+		t.Errorf("empty key written to %v", got)
+	}
+}
+
+func TestErrorsNegotiateProblems(t *testing.T) {
+	b, _, _ := memoryBroker(t, 1)
+	h := NewBrokerHandler(b)
+
+	tests := []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"", "application/json", `{"error":{"code":"key_not_found",`},
+		{"application/json", "application/json", `{"error":{"code":"key_not_found",`},
+		{"application/json, application/problem+json", httpapi.ProblemContentType, `{"type":"urn:kv:problem:key-not-found","title":"Key not found","status":404,`},
+		{"application/problem+json;q=0.9", httpapi.ProblemContentType, `{"type":"urn:kv:problem:key-not-found",`},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/v1/get?key=missing", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Accept %q: status %d, want 404", tt.accept, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("Accept %q: Content-Type %q, want %q", tt.accept, got, tt.contentType)
+		}
+		if !strings.HasPrefix(rec.Body.String(), tt.body) {
+			t.Errorf("Accept %q: body %s, want it to start with %s", tt.accept, rec.Body.String(), tt.body)
+		}
+		problem, ok := httpapi.DecodeProblem(rec.Body.Bytes())
+		if !ok || problem.Code != httpapi.CodeKeyNotFound {
+			t.Errorf("Accept %q: decoded %+v, %v, want code %s", tt.accept, problem, ok, httpapi.CodeKeyNotFound)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv/logging"
+	"net/http"
+	"net/url"
+)
+
+// Cache mode: stores in cache mode read keys they do not hold through from
+// their origin. The broker asks every store for a key without reading
+// through, and only when none holds it has one cache store, the least
+// loaded, read it through. Health checks tell the broker which stores are
+// in cache mode.
+
+// cacheStores returns the names and addresses of the readable stores in
+// cache mode.
+func (b *Broker) cacheStores() map[string]string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	stores := make(map[string]string)
+	for name, store := range b.stores {
+		if b.health[name].Cache && !b.warming[name] && !b.draining[name] {
+			stores[name] = store.Address()
+		}
+	}
+	return stores
+}
+
+// pickCacheStore returns the least loaded store in cache mode, or "" if
+// there is none.
+func (b *Broker) pickCacheStore() (name, addr string) {
+	stores := b.cacheStores()
+	candidates := placementCandidates(stores, nil)
+	b.mu.RLock()
+	name = leastLoaded(b.placementLoads(candidates), candidates)
+	b.mu.RUnlock()
+	return name, stores[name]
+}
+
+// readThrough has a store in cache mode read key through from its origin,
+// and returns the value as the store now holding it holds it. It returns
+// ErrKeyNotFound if no store is in cache mode or the origin lacks the key.
+func (b *Broker) readThrough(ctx context.Context, key string) (storedKey, error) {
+	name, addr := b.pickCacheStore()
+	if name == "" {
+		return storedKey{}, fmt.Errorf("key '%s' not found in any KVStore: %w", key, ErrKeyNotFound)
+	}
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/get?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		return storedKey{}, fmt.Errorf("error contacting KVStore at %s: %w", addr, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return storedKey{}, fmt.Errorf("key '%s' not found in any KVStore or origin: %w", key, ErrKeyNotFound)
+	default:
+		return storedKey{}, fmt.Errorf("KVStore %s returned status: %d", name, resp.StatusCode)
+	}
+
+	var result map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return storedKey{}, fmt.Errorf("error decoding store response: %w", err)
+	}
+	b.noteWrites(name, key)
+	b.IncrementLoad(name)
+	logging.FromContext(ctx, b.logger).Debug("key read through", "key_hash", logging.KeyHash(key), "store", name)
+	return storedKey{result["value"], name, resp.Header.Get("ETag")}, nil
+}
+
+// deleteThrough deletes key at the origin through a store in cache mode,
+// for a key no store holds. It reports false if no store is in cache mode.
+func (b *Broker) deleteThrough(ctx context.Context, key string) (bool, error) {
+	name, addr := b.pickCacheStore()
+	if name == "" {
+		return false, nil
+	}
+	resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/delete", map[string]string{"key": key})
+	if err != nil {
+		return false, fmt.Errorf("error contacting KVStore at %s: %w", addr, err)
+	}
+	resp.Body.Close()
+	b.reads.Forget(key)
+	b.forgetHotCopies(key)
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("KVStore %s returned status: %d", name, resp.StatusCode)
+	}
+	return true, nil
+}
@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ChangeCursor records, per store, the last change sequence a consumer has seen.
+// It is encoded as "store1:12,store2:7".
+type ChangeCursor map[string]uint64
+
+// ParseChangeCursor decodes a cursor string. An empty string is an empty cursor.
+func ParseChangeCursor(s string) (ChangeCursor, error) {
+	cursor := make(ChangeCursor)
+	if s == "" {
+		return cursor, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		name, seqStr, ok := strings.Cut(part, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid cursor entry %q", part)
+		}
+		seq, err := strconv.ParseUint(seqStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor entry %q: %w", part, err)
+		}
+		cursor[name] = seq
+	}
+	return cursor, nil
+}
+
+// String encodes the cursor with store names in sorted order.
+func (c ChangeCursor) String() string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s:%d", name, c[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+// StoreChanges is one store's page of an aggregated change feed.
+type StoreChanges struct {
+	kvstore.ChangeFeed
+	Error string `json:"error,omitempty"`
+}
+
+// AggregatedChanges is the broker-wide change feed.
+type AggregatedChanges struct {
+	Stores map[string]StoreChanges `json:"stores"`
+	// Cursor is the value to pass on the next call to continue where this one ended.
+	Cursor string `json:"cursor"`
+}
+
+// Changes collects the change feed of every store starting after the positions
+// recorded in cursor. Stores missing from the cursor are read from the start of
+// their retained log. Unreachable stores keep their cursor position.
+func (b *Broker) Changes(ctx context.Context, cursor ChangeCursor, limit int) AggregatedChanges {
+	b.mu.RLock()
+	targets := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		targets[name] = store.Address()
+	}
+	b.mu.RUnlock()
+
+	result := AggregatedChanges{Stores: make(map[string]StoreChanges, len(targets))}
+	next := make(ChangeCursor, len(targets))
+	for name, addr := range targets {
+		since := cursor[name]
+		next[name] = since
+		feed, err := b.fetchStoreChanges(ctx, addr, since, limit)
+		if err != nil {
+			result.Stores[name] = StoreChanges{Error: err.Error()}
+			continue
+		}
+		result.Stores[name] = StoreChanges{ChangeFeed: feed}
+		next[name] = feed.Next
+	}
+	result.Cursor = next.String()
+	return result
+}
+
+func (b *Broker) fetchStoreChanges(ctx context.Context, addr string, since uint64, limit int) (kvstore.ChangeFeed, error) {
+	var feed kvstore.ChangeFeed
+	path := fmt.Sprintf("/changes?since=%d&limit=%d", since, limit)
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, path, nil)
+	if err != nil {
+		return feed, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return feed, fmt.Errorf("changes returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return feed, fmt.Errorf("error decoding changes: %w", err)
+	}
+	return feed, nil
+}
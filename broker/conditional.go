@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"kv/kvstore"
+	"kv/logging"
+	"net/http"
+	"sync"
+)
+
+// ErrPreconditionFailed is returned when a conditional write's If-Match or
+// If-None-Match header, or its if_value, does not hold for the key as it is.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// conditionalStripes is the number of locks conditional writes are spread over by key.
+const conditionalStripes = 64
+
+// conditionalLocks serializes conditional writes and increments to the same
+// key made through this broker, between looking the key up and writing it.
+type conditionalLocks [conditionalStripes]sync.Mutex
+
+func (l *conditionalLocks) lock(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &l[h.Sum32()%conditionalStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// SetKeyIf sets key to value if the key as it is satisfies p. A key that
+// exists is written on the store holding it, which checks that it still
+// holds the revision p was checked against; a new key is placed as by
+// SetKey and written only if that store does not hold it meanwhile.
+// Conditional writes to a key through the same broker are serialized. It
+// returns the key as written: the store and the value's new entity tag.
+func (b *Broker) SetKeyIf(ctx context.Context, key, value string, p kvstore.Precondition) (storedKey, error) {
+	if p.IsZero() {
+		return b.setKeyQueued(ctx, key, value)
+	}
+	defer b.conditional.lock(key)()
+	logger := logging.FromContext(ctx, b.logger)
+
+	// The revision is checked on the primary, which a replica may lag
+	current, err := b.lookupStoredKey(WithMaxStaleness(ctx, 0), key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return storedKey{}, err
+	}
+	if !p.Allows(current.value, current.etag, exists) {
+		return storedKey{}, fmt.Errorf("%w for key '%s'", ErrPreconditionFailed, key)
+	}
+
+	var store StoreClient
+	check := kvstore.Precondition{IfNoneMatch: "*"}
+	if exists {
+		if store, err = b.GetStore(current.store); err != nil {
+			return storedKey{}, err
+		}
+		check = kvstore.Precondition{IfMatch: current.etag}
+	} else if store, err = b.GetLeastLoadedStore(); err != nil {
+		return storedKey{}, fmt.Errorf("no available KVStore: %w", err)
+	}
+
+	header := make(http.Header)
+	check.Header(header)
+	resp, err := b.storeRequestHeader(ctx, http.MethodPost, store.Address(), "/set", map[string]string{"key": key, "value": value}, header)
+	if err != nil {
+		// The store may have taken the key all the same
+		b.forgetFilter(store.Name())
+		return storedKey{}, fmt.Errorf("error contacting KVStore at %s: %w", store.Address(), err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		// Written by someone else since the lookup
+		return storedKey{}, fmt.Errorf("%w for key '%s'", ErrPreconditionFailed, key)
+	default:
+		return storedKey{}, fmt.Errorf("KVStore returned status: %d", resp.StatusCode)
+	}
+
+	b.noteWrites(store.Name(), key)
+	b.IncrementLoad(store.Name())
+	logger.Debug("key set conditionally", "key_hash", logging.KeyHash(key), "store", store.Name())
+	return storedKey{value, store.Name(), resp.Header.Get("ETag")}, nil
+}
+
+// DeleteKeyIf deletes key if the key as it is satisfies p. The store
+// holding it checks that it still holds the revision p was checked against,
+// so a value written since the lookup is not deleted; once it is deleted
+// there, every other copy is deleted as by DeleteKeyAt. Conditional deletes
+// and writes to a key through the same broker are serialized.
+func (b *Broker) DeleteKeyIf(ctx context.Context, key, consistency string, p kvstore.Precondition) (KeyDeletion, error) {
+	if p.IsZero() {
+		return b.DeleteKeyAt(ctx, key, consistency)
+	}
+	defer b.conditional.lock(key)()
+	logger := logging.FromContext(ctx, b.logger)
+	deletion := KeyDeletion{Key: key, Consistency: consistency, Stores: []string{}}
+
+	current, err := b.lookupStoredKey(WithMaxStaleness(ctx, 0), key)
+	if err != nil {
+		return deletion, err
+	}
+	if !p.Allows(current.value, current.etag, true) {
+		return deletion, fmt.Errorf("%w for key '%s'", ErrPreconditionFailed, key)
+	}
+	store, err := b.GetStore(current.store)
+	if err != nil {
+		return deletion, err
+	}
+
+	header := make(http.Header)
+	kvstore.Precondition{IfMatch: current.etag}.Header(header)
+	resp, err := b.storeRequestHeader(ctx, http.MethodPost, store.Address(), "/delete", map[string]string{"key": key}, header)
+	b.reads.Forget(key)
+	b.forgetHotCopies(key)
+	if err != nil {
+		return deletion, fmt.Errorf("error contacting KVStore at %s: %w", store.Address(), err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		// Written by someone else since the lookup
+		return deletion, fmt.Errorf("%w for key '%s'", ErrPreconditionFailed, key)
+	case http.StatusNotFound:
+		// Deleted by someone else since the lookup
+		return deletion, fmt.Errorf("key '%s' not found in any KVStore: %w", key, ErrKeyNotFound)
+	default:
+		return deletion, fmt.Errorf("KVStore returned status: %d", resp.StatusCode)
+	}
+	logger.Debug("key deleted conditionally", "key_hash", logging.KeyHash(key), "store", store.Name())
+
+	// The copies left on other stores, and the tombstones, as for any delete
+	return b.deleteKeyAt(ctx, key, consistency, store)
+}
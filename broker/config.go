@@ -0,0 +1,491 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"kv/qos"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config is the broker's configuration, read from a JSON file by
+// LoadConfig. Listen, ShutdownTimeout, ServerTimeouts and ReplicationFactor
+// are read at startup only; everything else takes effect on ReloadConfig.
+type Config struct {
+	// Listen is the address the broker listens on, e.g. ":8080".
+	Listen string `json:"listen"`
+	// ShutdownTimeout bounds how long in-flight requests may run on shutdown.
+	ShutdownTimeout kvstore.Duration `json:"shutdown_timeout,omitempty"`
+	// ServerTimeouts bound how long clients may take over their requests.
+	ServerTimeouts kvstore.ServerTimeouts `json:"server_timeouts,omitempty"`
+	// StoreTimeouts bound each call the broker makes to a store, by route
+	// such as "/getall"; "default" applies to the routes not listed. Routes
+	// given in the config file are added to the defaults.
+	StoreTimeouts map[string]kvstore.Duration `json:"store_timeouts,omitempty"`
+	// HealthInterval is how often registered stores are probed.
+	HealthInterval kvstore.Duration `json:"health_interval,omitempty"`
+	// ReplicationFactor is the number of copies of each key: the store
+	// holding it and the backups of the ReplicationFactor-1 stores before
+	// it in the ring.
+	ReplicationFactor int `json:"replication_factor,omitempty"`
+	// SnapshotInterval, if set, is the periodic snapshot interval the broker
+	// applies to every store, overriding the stores' own setting.
+	SnapshotInterval kvstore.Duration `json:"snapshot_interval,omitempty"`
+	// SnapshotProfiles are named snapshot settings, attached to stores with
+	// /kvstore/snapshot/attach in place of a schedule of their own.
+	SnapshotProfiles map[string]SnapshotProfile `json:"snapshot_profiles,omitempty"`
+	// AdminToken is presented to stores for admin calls and required by the
+	// broker's /config/reload endpoint.
+	AdminToken string `json:"admin_token,omitempty"`
+	// ReplicaMaxStaleness is how far behind its primary a read replica may
+	// be and still serve reads (default 5s).
+	ReplicaMaxStaleness kvstore.Duration `json:"replica_max_staleness,omitempty"`
+	// BloomFilters has lookups skip the stores whose Bloom filter rules the
+	// key out. The filters are fetched with every health check; keys written
+	// to a store other than through the broker may be missed until then.
+	BloomFilters bool `json:"bloom_filters,omitempty"`
+	// Indexes are the secondary indexes every store keeps, for /query.
+	Indexes []kvstore.IndexSpec `json:"indexes,omitempty"`
+	// BackgroundLimit paces background work so it leaves room for client
+	// traffic: the keys the broker moves when draining a store and, pushed
+	// to every store, snapshots, peer backups and handoffs. If never set the
+	// stores keep their own background_limit.
+	BackgroundLimit *qos.Limit `json:"background_limit,omitempty"`
+	// AlertWebhook is the URL store failure alerts are posted to.
+	AlertWebhook string `json:"alert_webhook,omitempty"`
+	// Stores are registered at startup, and on reload if new, without
+	// waiting for them to register themselves.
+	Stores []kvstore.KVStoreConfig `json:"stores,omitempty"`
+	// Tenants, if any, share the cluster with their keys kept apart. Data
+	// requests must then carry a tenant's token, or the admin token for the
+	// whole keyspace.
+	Tenants []TenantConfig `json:"tenants,omitempty"`
+	// Validation are rules writes must pass before they reach a store, such
+	// as a key pattern or a JSON Schema for values under a prefix. They can
+	// also be replaced at runtime with POST /validation, until the config
+	// is reloaded with different rules.
+	Validation []ValidationRule `json:"validation,omitempty"`
+	// Split, if set, has the broker split a store that grows past a size:
+	// half its keys are moved to the least loaded store with room for them.
+	Split *SplitConfig `json:"split,omitempty"`
+	// HotCopies, if set, has the broker copy keys taking a large part of
+	// the accesses on a busy store to other stores and spread their reads,
+	// until they cool down.
+	HotCopies *HotCopyConfig `json:"hot_copies,omitempty"`
+	// WriteQueue, if set, has writes that no store can take at the moment,
+	// because every store is down, busy, warming or draining, wait briefly
+	// for one instead of failing at once.
+	WriteQueue *WriteQueueConfig `json:"write_queue,omitempty"`
+	// Shadow, if set, mirrors every write to another broker or store and
+	// compares reads with it, to verify a migration before switching over.
+	Shadow *ShadowConfig `json:"shadow,omitempty"`
+	// Jobs are recurring jobs run on a cron-style schedule, such as nightly
+	// backups; their runs are reported at /jobs.
+	Jobs []JobConfig `json:"jobs,omitempty"`
+	// EventLog, if set, is the file the cluster events reported at /events
+	// are appended to, so they are kept across restarts.
+	EventLog string `json:"event_log,omitempty"`
+	// ConnectionPool limits the connections the broker keeps to each
+	// store; their use is reported at /connections.
+	ConnectionPool PoolConfig `json:"connection_pool,omitempty"`
+}
+
+// DefaultConfig returns the configuration used for settings that are
+// neither in the config file nor given as flags.
+func DefaultConfig() Config {
+	return Config{
+		Listen:            ":8080",
+		ShutdownTimeout:   kvstore.Duration(10 * time.Second),
+		ServerTimeouts:    kvstore.DefaultServerTimeouts(),
+		StoreTimeouts:     DefaultStoreTimeouts(),
+		HealthInterval:    kvstore.Duration(5 * time.Second),
+		ReplicationFactor: 2,
+	}
+}
+
+// LoadConfig reads a JSON config file over the defaults. Unknown fields are
+// rejected so typos do not go unnoticed.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	file, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate reports every problem with the configuration at once.
+func (c Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen %q is not a host:port address", c.Listen))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	if err := c.ServerTimeouts.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("server_timeouts: %w", err))
+	}
+	for route, d := range c.StoreTimeouts {
+		if route != "default" && !strings.HasPrefix(route, "/") {
+			errs = append(errs, fmt.Errorf("store_timeouts: %q is neither \"default\" nor a route such as \"/getall\"", route))
+		}
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("store_timeouts: %s must be positive", route))
+		}
+	}
+	if c.HealthInterval <= 0 {
+		errs = append(errs, errors.New("health_interval must be positive"))
+	}
+	if c.ReplicationFactor < 2 {
+		errs = append(errs, fmt.Errorf("replication_factor %d is not supported (at least 2)", c.ReplicationFactor))
+	}
+	if c.SnapshotInterval < 0 {
+		errs = append(errs, errors.New("snapshot_interval must not be negative"))
+	} else if c.SnapshotInterval > 0 && time.Duration(c.SnapshotInterval) < time.Second {
+		errs = append(errs, errors.New("snapshot_interval must be at least 1s"))
+	}
+	if c.ReplicaMaxStaleness < 0 {
+		errs = append(errs, errors.New("replica_max_staleness must not be negative"))
+	}
+	if c.AlertWebhook != "" {
+		if u, err := url.Parse(c.AlertWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("alert_webhook %q is not an http(s) URL", c.AlertWebhook))
+		}
+	}
+	indexes := make(map[string]bool)
+	for i, idx := range c.Indexes {
+		if idx.Name == "" {
+			errs = append(errs, fmt.Errorf("indexes[%d]: name is required", i))
+		} else if indexes[idx.Name] {
+			errs = append(errs, fmt.Errorf("indexes[%d]: duplicate name %q", i, idx.Name))
+		}
+		indexes[idx.Name] = true
+	}
+	if c.BackgroundLimit != nil {
+		if err := c.BackgroundLimit.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("background_limit: %w", err))
+		}
+	}
+	seen := make(map[string]bool)
+	for i, s := range c.Stores {
+		if s.Name == "" {
+			errs = append(errs, fmt.Errorf("stores[%d]: name is required", i))
+		} else if seen[s.Name] {
+			errs = append(errs, fmt.Errorf("stores[%d]: duplicate name %q", i, s.Name))
+		}
+		seen[s.Name] = true
+		if host, _, err := net.SplitHostPort(s.IPAddress); err != nil || host == "" {
+			errs = append(errs, fmt.Errorf("stores[%d]: ip_address %q is not a host:port address", i, s.IPAddress))
+		}
+	}
+	if len(c.Tenants) > 0 && c.AdminToken == "" {
+		// Stores register, and operators administer the cluster, with it
+		errs = append(errs, errors.New("admin_token is required when tenants are configured"))
+	}
+	names, tokens := make(map[string]bool), make(map[string]bool)
+	for i, t := range c.Tenants {
+		if !validTenantName(t.Name) {
+			errs = append(errs, fmt.Errorf("tenants[%d]: name %q must be letters, digits, '-' or '_'", i, t.Name))
+		} else if names[t.Name] {
+			errs = append(errs, fmt.Errorf("tenants[%d]: duplicate name %q", i, t.Name))
+		}
+		names[t.Name] = true
+		switch {
+		case t.Token == "":
+			errs = append(errs, fmt.Errorf("tenants[%d]: token is required", i))
+		case t.Token == c.AdminToken:
+			errs = append(errs, fmt.Errorf("tenants[%d]: token must differ from admin_token", i))
+		case tokens[t.Token]:
+			errs = append(errs, fmt.Errorf("tenants[%d]: token is used by another tenant", i))
+		}
+		tokens[t.Token] = true
+		if t.MaxKeys < 0 || t.MaxBytes < 0 {
+			errs = append(errs, fmt.Errorf("tenants[%d]: max_keys and max_bytes must not be negative", i))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.SnapshotProfiles)) {
+		if err := c.SnapshotProfiles[name].Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("snapshot_profiles[%s]: %w", name, err))
+		}
+	}
+	if err := validateRules(c.Validation); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Split != nil && (c.Split.MaxKeys < 0 || c.Split.MaxBytes < 0) {
+		errs = append(errs, errors.New("split: max_keys and max_bytes must not be negative"))
+	}
+	if c.HotCopies != nil {
+		if err := c.HotCopies.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("hot_copies: %w", err))
+		}
+	}
+	if c.WriteQueue != nil {
+		if err := c.WriteQueue.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("write_queue: %w", err))
+		}
+	}
+	jobs := make(map[string]bool)
+	for i, j := range c.Jobs {
+		if err := j.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("jobs[%d]: %w", i, err))
+		}
+		if j.Name != "" && jobs[j.Name] {
+			errs = append(errs, fmt.Errorf("jobs[%d]: duplicate name %q", i, j.Name))
+		}
+		jobs[j.Name] = true
+	}
+	if err := c.ConnectionPool.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("connection_pool: %w", err))
+	}
+	if c.Shadow != nil {
+		if u, err := url.Parse(c.Shadow.Target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("shadow: target %q is not an http(s) URL", c.Shadow.Target))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// redacted returns c with secrets hidden, for display.
+func (c Config) redacted() Config {
+	if c.AdminToken != "" {
+		c.AdminToken = "REDACTED"
+	}
+	if len(c.Tenants) > 0 {
+		c.Tenants = append([]TenantConfig(nil), c.Tenants...)
+		for i := range c.Tenants {
+			c.Tenants[i].Token = "REDACTED"
+		}
+	}
+	if c.Shadow != nil && c.Shadow.Token != "" {
+		shadow := *c.Shadow
+		shadow.Token = "REDACTED"
+		c.Shadow = &shadow
+	}
+	return c
+}
+
+// SetConfigSource sets how ReloadConfig obtains the configuration, usually by
+// reading the config file and applying command line overrides.
+func (b *Broker) SetConfigSource(load func() (Config, error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.configSource = load
+}
+
+// Config returns the configuration last applied, with secrets redacted.
+func (b *Broker) Config() Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.config.redacted()
+}
+
+// ReloadConfig loads the configuration from the config source and applies
+// the settings that can change at runtime. Changes to startup-only settings
+// are reported in the returned list and ignored until a restart.
+func (b *Broker) ReloadConfig(ctx context.Context) ([]string, error) {
+	b.mu.RLock()
+	load := b.configSource
+	b.mu.RUnlock()
+	if load == nil {
+		return nil, errors.New("no config source set")
+	}
+
+	cfg, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return b.ApplyConfig(ctx, cfg), nil
+}
+
+// ApplyConfig applies cfg, which must be valid, and returns the settings it
+// changed. The first call applies everything; later calls leave the
+// startup-only settings as they were and report their changes as needing a
+// restart.
+func (b *Broker) ApplyConfig(ctx context.Context, cfg Config) []string {
+	var changed []string
+	b.mu.Lock()
+	old, first := b.config, !b.configured
+	if !first {
+		if old.Listen != cfg.Listen {
+			changed = append(changed, "listen (restart required)")
+		}
+		if old.ShutdownTimeout != cfg.ShutdownTimeout {
+			changed = append(changed, "shutdown_timeout (restart required)")
+		}
+		if old.ServerTimeouts != cfg.ServerTimeouts {
+			changed = append(changed, "server_timeouts (restart required)")
+		}
+		if old.ReplicationFactor != cfg.ReplicationFactor {
+			changed = append(changed, "replication_factor (restart required)")
+		}
+		cfg.Listen, cfg.ShutdownTimeout, cfg.ReplicationFactor = old.Listen, old.ShutdownTimeout, old.ReplicationFactor
+		cfg.ServerTimeouts = old.ServerTimeouts
+	}
+	b.config, b.configured = cfg, true
+	b.mu.Unlock()
+
+	if !first && !maps.Equal(old.StoreTimeouts, cfg.StoreTimeouts) {
+		changed = append(changed, "store_timeouts")
+	}
+	if first || old.AdminToken != cfg.AdminToken {
+		b.SetAdminToken(cfg.AdminToken)
+		changed = append(changed, "admin_token")
+	}
+	if first || !slices.Equal(old.Tenants, cfg.Tenants) {
+		b.SetTenants(cfg.Tenants)
+		changed = append(changed, "tenants")
+	}
+	if first || !validationEqual(old.Validation, cfg.Validation) {
+		if err := b.SetValidationRules(cfg.Validation); err != nil {
+			b.logger.Error("invalid validation rules, keeping the current ones", "err", err)
+		}
+		if !first || len(cfg.Validation) > 0 {
+			changed = append(changed, "validation")
+		}
+	}
+	if first || !shadowEqual(old.Shadow, cfg.Shadow) {
+		b.SetShadow(cfg.Shadow)
+		changed = append(changed, "shadow")
+	}
+	if first || old.AlertWebhook != cfg.AlertWebhook {
+		b.SetAlerter(NewAlerter(cfg.AlertWebhook))
+		changed = append(changed, "alert_webhook")
+	}
+	if !first && !splitEqual(old.Split, cfg.Split) {
+		changed = append(changed, "split")
+	}
+	if !first && !hotCopyEqual(old.HotCopies, cfg.HotCopies) {
+		changed = append(changed, "hot_copies")
+	}
+	if !first && !writeQueueEqual(old.WriteQueue, cfg.WriteQueue) {
+		changed = append(changed, "write_queue")
+	}
+	if !first && old.BloomFilters != cfg.BloomFilters {
+		changed = append(changed, "bloom_filters")
+	}
+	if first || old.EventLog != cfg.EventLog {
+		if err := b.SetEventLog(cfg.EventLog); err != nil {
+			b.logger.Error("failed to open event log, events are kept in memory only", "file", cfg.EventLog, "err", err)
+		}
+		if !first || cfg.EventLog != "" {
+			changed = append(changed, "event_log")
+		}
+	}
+	if first || !slices.Equal(old.Jobs, cfg.Jobs) {
+		b.SetJobs(cfg.Jobs)
+		if !first || len(cfg.Jobs) > 0 {
+			changed = append(changed, "jobs")
+		}
+	}
+	if first || old.ConnectionPool != cfg.ConnectionPool {
+		b.SetConnectionPool(cfg.ConnectionPool)
+		if !first || cfg.ConnectionPool != (PoolConfig{}) {
+			changed = append(changed, "connection_pool")
+		}
+	}
+	if first || old.HealthInterval != cfg.HealthInterval {
+		b.StartHealthChecks(time.Duration(cfg.HealthInterval))
+		changed = append(changed, "health_interval")
+	}
+
+	added := false
+	for _, s := range cfg.Stores {
+		if b.StoreExists(s.Name) {
+			continue
+		}
+		if err := b.CreateStore(s.Name, s.IPAddress); err != nil {
+			b.logger.Error("failed to add configured store", "store", s.Name, "err", err)
+			continue
+		}
+		added = true
+		changed = append(changed, "stores: added "+s.Name)
+	}
+	if added {
+		b.StartPeering()
+	}
+
+	if cfg.SnapshotInterval > 0 && (first || added || old.SnapshotInterval != cfg.SnapshotInterval) {
+		for _, name := range b.ListStores() {
+			b.applySnapshotSchedule(ctx, name)
+		}
+		changed = append(changed, "snapshot_interval")
+	}
+	if !first && !maps.Equal(old.SnapshotProfiles, cfg.SnapshotProfiles) {
+		for _, name := range b.ListStores() {
+			if b.snapshotProfile(name) != "" {
+				b.applySnapshotSchedule(ctx, name)
+			}
+		}
+		changed = append(changed, "snapshot_profiles")
+	}
+	if first || added || !slices.Equal(old.Indexes, cfg.Indexes) {
+		var dropped []string
+		// An index on another field is dropped and created again
+		for _, idx := range old.Indexes {
+			if !slices.Contains(cfg.Indexes, idx) {
+				dropped = append(dropped, idx.Name)
+			}
+		}
+		if len(cfg.Indexes) > 0 || len(dropped) > 0 {
+			for _, name := range b.ListStores() {
+				b.applyIndexes(ctx, name, dropped)
+			}
+			changed = append(changed, "indexes")
+		}
+	}
+	if first || added || !limitEqual(old.BackgroundLimit, cfg.BackgroundLimit) {
+		var limit qos.Limit
+		if cfg.BackgroundLimit != nil {
+			limit = *cfg.BackgroundLimit
+		}
+		b.background.SetLimit(limit)
+		if cfg.BackgroundLimit != nil || old.BackgroundLimit != nil {
+			// Unsetting it lifts the limit the stores were given
+			for _, name := range b.ListStores() {
+				b.setStoreBackgroundLimit(ctx, name, limit)
+			}
+			changed = append(changed, "background_limit")
+		}
+	}
+	return changed
+}
+
+func limitEqual(a, b *qos.Limit) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func shadowEqual(a, b *ShadowConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// currentAdminToken returns the admin token, which /config/reload requires.
+func (b *Broker) currentAdminToken() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.adminToken
+}
@@ -0,0 +1,375 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"kv/kvstore"
+	"kv/metrics"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PoolConfig limits the connections the broker keeps to each store.
+type PoolConfig struct {
+	// MaxIdlePerStore is how many idle connections to each store are kept
+	// for reuse (default 2). Requests beyond it that finish together close
+	// their connections instead.
+	MaxIdlePerStore int `json:"max_idle_per_store,omitempty"`
+	// MaxPerStore bounds the connections to each store, idle or in use;
+	// requests beyond it wait for one. 0 means no limit.
+	MaxPerStore int `json:"max_per_store,omitempty"`
+	// IdleTimeout is how long an idle connection is kept (default 90s).
+	IdleTimeout kvstore.Duration `json:"idle_timeout,omitempty"`
+}
+
+// Validate reports every problem with the pool limits at once.
+func (c PoolConfig) Validate() error {
+	var errs []error
+	if c.MaxIdlePerStore < 0 || c.MaxPerStore < 0 {
+		errs = append(errs, errors.New("max_idle_per_store and max_per_store must not be negative"))
+	}
+	if c.MaxPerStore > 0 && c.MaxIdlePerStore > c.MaxPerStore {
+		errs = append(errs, errors.New("max_idle_per_store must not exceed max_per_store"))
+	}
+	if c.IdleTimeout < 0 {
+		errs = append(errs, errors.New("idle_timeout must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// connPool is the broker's transport to stores: an http.Transport that counts
+// the connections it opens to each address and how often they are reused.
+type connPool struct {
+	mu     sync.Mutex
+	rt     *http.Transport
+	limits PoolConfig
+	hosts  map[string]*hostConns // by address
+
+	conns    *metrics.GaugeVec
+	requests *metrics.CounterVec
+}
+
+// hostConns counts the connections to one address. They are guarded by the
+// pool's mu.
+type hostConns struct {
+	open   int
+	inUse  int
+	fresh  uint64 // requests sent on a new connection
+	reused uint64 // requests sent on an idle one
+}
+
+func newConnPool(r *metrics.Registry) *connPool {
+	p := &connPool{
+		hosts:    make(map[string]*hostConns),
+		conns:    r.NewGaugeVec("broker_store_connections", "Connections from the broker to a store by address and state (open, in_use).", "address", "state"),
+		requests: r.NewCounterVec("broker_store_connection_requests_total", "Requests from the broker to a store by address and whether they got a new or a reused connection.", "address", "conn"),
+	}
+	p.setLimits(PoolConfig{})
+	return p
+}
+
+// setLimits replaces the transport with one enforcing limits. Requests in
+// flight finish on the old one, whose idle connections are closed.
+func (p *connPool) setLimits(limits PoolConfig) {
+	rt := http.DefaultTransport.(*http.Transport).Clone()
+	rt.DialContext = p.dial
+	if limits.MaxIdlePerStore > 0 {
+		rt.MaxIdleConnsPerHost = limits.MaxIdlePerStore
+	}
+	rt.MaxConnsPerHost = limits.MaxPerStore
+	if limits.IdleTimeout > 0 {
+		rt.IdleConnTimeout = time.Duration(limits.IdleTimeout)
+	}
+	// The stores' idle connections are bounded per store only
+	rt.MaxIdleConns = 0
+
+	p.mu.Lock()
+	old := p.rt
+	p.rt, p.limits = rt, limits
+	p.mu.Unlock()
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// host returns the counts for addr. p.mu must be held.
+func (p *connPool) host(addr string) *hostConns {
+	h, ok := p.hosts[addr]
+	if !ok {
+		h = &hostConns{}
+		p.hosts[addr] = h
+	}
+	return h
+}
+
+func (p *connPool) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.host(addr).open++
+	p.mu.Unlock()
+	p.conns.Add(1, addr, "open")
+	return &countedConn{Conn: conn, pool: p, addr: addr}, nil
+}
+
+// countedConn is a connection that leaves the open count when closed.
+type countedConn struct {
+	net.Conn
+	pool *connPool
+	addr string
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		c.pool.mu.Lock()
+		c.pool.host(c.addr).open--
+		c.pool.mu.Unlock()
+		c.pool.conns.Add(-1, c.addr, "open")
+	})
+	return c.Conn.Close()
+}
+
+// RoundTrip sends req, counting its connection in use until the response body
+// is closed.
+func (p *connPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr := req.URL.Host
+	var got sync.Once
+	gotConn := false
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			kind := "new"
+			if info.Reused {
+				kind = "reused"
+			}
+			p.requests.Inc(addr, kind)
+			p.mu.Lock()
+			h := p.host(addr)
+			if info.Reused {
+				h.reused++
+			} else {
+				h.fresh++
+			}
+			// A request retried on another connection is in use once
+			got.Do(func() {
+				gotConn = true
+				h.inUse++
+				p.conns.Add(1, addr, "in_use")
+			})
+			p.mu.Unlock()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	p.mu.Lock()
+	rt := p.rt
+	p.mu.Unlock()
+	resp, err := rt.RoundTrip(req)
+
+	release := func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if gotConn {
+			p.host(addr).inUse--
+			p.conns.Add(-1, addr, "in_use")
+		}
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releaseOnClose calls release once the body is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// StoreConnStats are the broker's connections to one store.
+type StoreConnStats struct {
+	Address string `json:"address"`
+	Open    int    `json:"open"`
+	InUse   int    `json:"in_use"`
+	Idle    int    `json:"idle"`
+	// Requests is the number sent since the broker started, and ReuseRate
+	// the share of them sent on a reused connection.
+	Requests  uint64  `json:"requests"`
+	ReuseRate float64 `json:"reuse_rate"`
+	// Utilization is the share of the pool in use: of max_per_store if
+	// set, otherwise of the open connections.
+	Utilization float64 `json:"utilization"`
+}
+
+// ClientConnStats are the connections clients have open to the broker.
+type ClientConnStats struct {
+	Open     int    `json:"open"`
+	Active   int    `json:"active"`
+	Idle     int    `json:"idle"`
+	Accepted uint64 `json:"accepted"`
+	// Requests is the number received since the broker started, and
+	// ReuseRate the share of them sent on a kept-alive connection.
+	Requests  uint64  `json:"requests"`
+	ReuseRate float64 `json:"reuse_rate"`
+}
+
+// ConnectionStats is the response of GET /connections.
+type ConnectionStats struct {
+	Clients ClientConnStats `json:"clients"`
+	// Stores are keyed by store name; addresses the broker calls that are
+	// no registered store's, such as a removed store, by address.
+	Stores map[string]StoreConnStats `json:"stores"`
+	Limits PoolConfig                `json:"limits"`
+}
+
+// clientConns tracks the connections to the broker's server, fed by
+// TrackConn. It has a mutex of its own since it is called for every request.
+type clientConns struct {
+	mu       sync.Mutex
+	states   map[net.Conn]http.ConnState
+	accepted uint64
+	requests uint64
+	reused   uint64
+
+	gauge   *metrics.GaugeVec
+	counter *metrics.CounterVec
+}
+
+func newClientConns(r *metrics.Registry) *clientConns {
+	return &clientConns{
+		states:  make(map[net.Conn]http.ConnState),
+		gauge:   r.NewGaugeVec("broker_client_connections", "Client connections to the broker by state (active, idle).", "state"),
+		counter: r.NewCounterVec("broker_client_requests_total", "Requests to the broker by whether they came on a new or a kept-alive connection.", "conn"),
+	}
+}
+
+// TrackConn counts client connections to the broker; set it as the broker
+// server's http.Server.ConnState.
+func (b *Broker) TrackConn(conn net.Conn, state http.ConnState) {
+	c := b.clients
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, known := c.states[conn]
+	if known && prev != http.StateNew {
+		c.gauge.Add(-1, gaugeState(prev))
+	}
+	switch state {
+	case http.StateNew:
+		c.accepted++
+	case http.StateActive:
+		c.requests++
+		kind := "new"
+		if prev == http.StateIdle {
+			c.reused++
+			kind = "reused"
+		}
+		c.counter.Inc(kind)
+	}
+	if state == http.StateClosed || state == http.StateHijacked {
+		delete(c.states, conn)
+		return
+	}
+	c.states[conn] = state
+	if state != http.StateNew {
+		c.gauge.Add(1, gaugeState(state))
+	}
+}
+
+func gaugeState(state http.ConnState) string {
+	if state == http.StateActive {
+		return "active"
+	}
+	return "idle"
+}
+
+// ConnectionStats reports the client connections to the broker and the
+// broker's connections to each store. The store side is empty when stores
+// are reached over a transport set with SetTransport.
+func (b *Broker) ConnectionStats() ConnectionStats {
+	stats := ConnectionStats{Stores: make(map[string]StoreConnStats)}
+
+	c := b.clients
+	c.mu.Lock()
+	for _, state := range c.states {
+		stats.Clients.Open++
+		switch state {
+		case http.StateActive:
+			stats.Clients.Active++
+		case http.StateIdle:
+			stats.Clients.Idle++
+		}
+	}
+	stats.Clients.Accepted, stats.Clients.Requests = c.accepted, c.requests
+	stats.Clients.ReuseRate = rate(c.reused, c.requests)
+	c.mu.Unlock()
+
+	b.mu.RLock()
+	names := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		names[store.Address()] = name
+	}
+	b.mu.RUnlock()
+
+	p := b.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats.Limits = p.limits
+	addrs := make([]string, 0, len(p.hosts))
+	for addr := range p.hosts {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		h := p.hosts[addr]
+		requests := h.fresh + h.reused
+		s := StoreConnStats{
+			Address:   addr,
+			Open:      h.open,
+			InUse:     h.inUse,
+			Idle:      max(h.open-h.inUse, 0),
+			Requests:  requests,
+			ReuseRate: rate(h.reused, requests),
+		}
+		if p.limits.MaxPerStore > 0 {
+			s.Utilization = float64(h.inUse) / float64(p.limits.MaxPerStore)
+		} else if h.open > 0 {
+			s.Utilization = min(float64(h.inUse)/float64(h.open), 1)
+		}
+		key := addr
+		if name, ok := names[addr]; ok {
+			key = name
+		}
+		stats.Stores[key] = s
+	}
+	return stats
+}
+
+// rate returns n as a share of total, or 0 if total is.
+func rate(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// SetConnectionPool applies limits to the broker's connections to stores.
+func (b *Broker) SetConnectionPool(limits PoolConfig) {
+	b.pool.setLimits(limits)
+}
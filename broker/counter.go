@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"kv/logging"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+var (
+	// ErrNotCounter is returned when incrementing a key whose value is not an integer.
+	ErrNotCounter = errors.New("value is not an integer counter")
+	// ErrCounterNotBackedUp is returned when a counter was incremented but
+	// a store backing up its store could not record the result.
+	ErrCounterNotBackedUp = errors.New("counter not backed up")
+)
+
+// Incr adds delta to the counter held by key on the store holding it, or
+// starts it at delta on the least loaded store, and returns the result.
+// Before returning, the result is recorded on every store backing up the
+// counter's store, so a failover never takes the counter back below a value
+// a client saw. If one of them could not be reached the increment has still
+// happened; the result is returned with ErrCounterNotBackedUp.
+func (b *Broker) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	defer b.conditional.lock(key)()
+	logger := logging.FromContext(ctx, b.logger)
+
+	// Looked up on the primary: a lagging replica would start a second copy
+	store, err := b.placeKey(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if err := b.validateIncr(ctx, key, delta); err != nil {
+		return 0, err
+	}
+
+	resp, err := b.storeRequest(ctx, http.MethodPost, store.Address(), "/incr", kvstore.IncrRequest{Key: key, Delta: &delta})
+	if err != nil {
+		// The store may have taken the key all the same
+		b.forgetFilter(store.Name())
+		return 0, fmt.Errorf("error contacting KVStore at %s: %w", store.Address(), err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return 0, fmt.Errorf("%w: %s", ErrNotCounter, key)
+	default:
+		return 0, fmt.Errorf("KVStore returned status: %d", resp.StatusCode)
+	}
+	var result kvstore.IncrResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("error decoding increment: %w", err)
+	}
+	b.noteWrites(store.Name(), key)
+	b.IncrementLoad(store.Name())
+
+	if err := b.raiseCounterFloors(ctx, store.Name(), key, result.Value); err != nil {
+		return result.Value, err
+	}
+	logger.Debug("counter incremented", "key_hash", logging.KeyHash(key), "store", store.Name(), "value", result.Value)
+	return result.Value, nil
+}
+
+// validateIncr checks the value the counter key reaches after adding delta
+// against the validation rules, before any store takes it.
+func (b *Broker) validateIncr(ctx context.Context, key string, delta int64) error {
+	b.mu.RLock()
+	rules := len(b.validation)
+	b.mu.RUnlock()
+	if rules == 0 {
+		return nil
+	}
+	var current int64
+	value, _, err := b.LookupKey(WithMaxStaleness(ctx, 0), key)
+	switch {
+	case err == nil:
+		if current, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("%w: %s", ErrNotCounter, key)
+		}
+	case !errors.Is(err, ErrKeyNotFound):
+		return err
+	}
+	if delta > 0 && current > math.MaxInt64-delta {
+		return fmt.Errorf("%w: %s would overflow", ErrNotCounter, key)
+	}
+	return b.validateWrites(map[string]string{key: strconv.FormatInt(current+delta, 10)})
+}
+
+// raiseCounterFloors records that the counter key on the named store reached
+// value on every store holding a backup of it.
+func (b *Broker) raiseCounterFloors(ctx context.Context, name, key string, value int64) error {
+	b.mu.RLock()
+	holders := b.peerlist.Holders(name, b.backups())
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, holder := range holders {
+		if holder.IpAddress == "" {
+			continue
+		}
+		resp, err := b.storeRequest(ctx, http.MethodPost, holder.IpAddress, "/counter-floor", kvstore.CounterFloorRequest{Peer: name, Key: key, Value: value})
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("counter-floor returned status: %d", resp.StatusCode)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", holder.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrCounterNotBackedUp, errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package broker
+
+import (
+	"context"
+	"kv/httpapi"
+	"kv/transport"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// laggingReplica registers a read replica of the named store that has not
+// seen any of its writes yet, and is in rotation for reads.
+func laggingReplica(t *testing.T, b *Broker, mem *transport.Memory, primary string) {
+	t.Helper()
+	const addr = "localhost:9200"
+	mem.Register(addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/get") {
+			httpapi.Error(w, "not a replica route", http.StatusNotFound)
+			return
+		}
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeKeyNotFound, "key not found", nil)
+	}))
+	store, err := b.GetStore(primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddReplica("replica0", addr, store.Address()); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	b.replicas["replica0"].staleness = 0 // as probed
+	b.mu.Unlock()
+}
+
+func TestIncrContinuesCountDespiteLaggingReplica(t *testing.T) {
+	b, mem, stores := memoryBroker(t, 2)
+	ctx := context.Background()
+
+	if got, err := b.Incr(ctx, "hits", 1); err != nil || got != 1 {
+		t.Fatalf("first Incr = %d, %v; want 1", got, err)
+	}
+	owner := holders(stores, "hits")[0]
+	laggingReplica(t, b, mem, owner)
+
+	for want := int64(2); want <= 6; want++ {
+		got, err := b.Incr(ctx, "hits", 1)
+		if err != nil {
+			t.Fatalf("Incr: %v", err)
+		}
+		if got != want {
+			t.Fatalf("Incr = %d, want %d", got, want)
+		}
+	}
+	if got := holders(stores, "hits"); !slices.Equal(got, []string{owner}) {
+		t.Errorf("counter held by %v, want %s only", got, owner)
+	}
+}
@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+	"time"
+)
+
+// Default TTLs: the broker remembers the default TTL set for each store
+// through the API and applies it again whenever the store registers, e.g.
+// after a restart. Stores without one keep their own default_ttl.
+
+// StoreDefaultTTL is the TTL a store gives the keys written to it.
+type StoreDefaultTTL struct {
+	Seconds int `json:"seconds"`
+	// Managed is set when the broker keeps the default TTL applied.
+	Managed bool   `json:"managed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SetDefaultTTL gives every key written to the named store from now on a
+// TTL of ttl, or none if ttl is zero, and keeps that default applied across
+// the store's restarts. Keys can still be given another TTL, or none, one
+// by one.
+func (b *Broker) SetDefaultTTL(ctx context.Context, storename string, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("default TTL must not be negative")
+	}
+	store, err := b.GetStore(storename)
+	if err != nil {
+		return err
+	}
+	if _, err := b.defaultTTLRequest(ctx, store.Address(), &kvstore.DefaultTTLRequest{Seconds: int(ttl / time.Second)}); err != nil {
+		return fmt.Errorf("error setting default TTL of store %s: %w", storename, err)
+	}
+	b.mu.Lock()
+	b.defaultTTLs[storename] = ttl
+	b.mu.Unlock()
+	return nil
+}
+
+// DefaultTTLs reports the default TTL of the named store, or of every store
+// when storename is empty.
+func (b *Broker) DefaultTTLs(ctx context.Context, storename string) (map[string]StoreDefaultTTL, error) {
+	b.mu.RLock()
+	targets := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		if storename == "" || name == storename {
+			targets[name] = store.Address()
+		}
+	}
+	b.mu.RUnlock()
+	if storename != "" && len(targets) == 0 {
+		return nil, ErrStoreNotFound
+	}
+
+	results := make(map[string]StoreDefaultTTL, len(targets))
+	for name, addr := range targets {
+		b.mu.RLock()
+		_, managed := b.defaultTTLs[name]
+		b.mu.RUnlock()
+		result := StoreDefaultTTL{Managed: managed}
+		if ttl, err := b.defaultTTLRequest(ctx, addr, nil); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Seconds = int(ttl / time.Second)
+		}
+		results[name] = result
+	}
+	return results, nil
+}
+
+// applyDefaultTTL gives the named store the default TTL set for it through
+// the API, if any.
+func (b *Broker) applyDefaultTTL(ctx context.Context, name string) {
+	b.mu.RLock()
+	ttl, managed := b.defaultTTLs[name]
+	addr := ""
+	if store, ok := b.stores[name]; ok {
+		addr = store.Address()
+	}
+	b.mu.RUnlock()
+	if !managed || addr == "" {
+		return
+	}
+	if _, err := b.defaultTTLRequest(ctx, addr, &kvstore.DefaultTTLRequest{Seconds: int(ttl / time.Second)}); err != nil {
+		b.logger.Warn("failed to apply default TTL", "store", name, "err", err)
+	}
+}
+
+// defaultTTLRequest sets the default TTL of the store at addr to set, or
+// only reads it if set is nil, and returns it.
+func (b *Broker) defaultTTLRequest(ctx context.Context, addr string, set *kvstore.DefaultTTLRequest) (time.Duration, error) {
+	method := http.MethodGet
+	var body interface{}
+	if set != nil {
+		method, body = http.MethodPost, set
+	}
+	resp, err := b.storeRequest(ctx, method, addr, "/default-ttl", body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("default-ttl returned status: %d", resp.StatusCode)
+	}
+	var result kvstore.DefaultTTLRequest
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("error decoding default TTL: %w", err)
+	}
+	return time.Duration(result.Seconds) * time.Second, nil
+}
@@ -0,0 +1,369 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"kv/logging"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Delete consistency levels, chosen per delete with ?consistency=. A key's
+// copies are the stores holding it, which it is deleted from, and the stores
+// backing those up, which record its tombstone so a failover does not bring
+// it back. Whatever the level, a copy that cannot be reached is sent the
+// deletion once it is back UP.
+const (
+	// ConsistencyOne answers once the key is deleted from the stores that
+	// were found holding it.
+	ConsistencyOne = "one"
+	// ConsistencyQuorum also waits for a majority of the key's copies to
+	// confirm the deletion, counting the stores that could not be asked
+	// as copies that did not.
+	ConsistencyQuorum = "quorum"
+	// ConsistencyAll waits for every copy: every store that may hold the
+	// key answered, every backup holder recorded the tombstone and every
+	// read replica of the stores holding it no longer serves the key.
+	ConsistencyAll = "all"
+)
+
+// ErrDeleteUnconfirmed is returned for a delete that took effect but was not
+// confirmed by as many copies of the key as its consistency level asks for.
+var ErrDeleteUnconfirmed = errors.New("deletion not confirmed by enough copies")
+
+// replicaDeleteTimeout bounds how long a delete at ConsistencyAll waits for
+// the read replicas to apply it, and replicaDeletePoll how often it asks.
+const (
+	replicaDeleteTimeout = 5 * time.Second
+	replicaDeletePoll    = 100 * time.Millisecond
+)
+
+// maxPendingDeletes bounds the deletions kept for a store that cannot be
+// reached. Those beyond it are dropped with a warning, and the store brings
+// back the keys it held when it returns.
+const maxPendingDeletes = 10000
+
+// ValidConsistency reports whether level is a delete consistency level;
+// empty means ConsistencyOne.
+func ValidConsistency(level string) bool {
+	switch level {
+	case "", ConsistencyOne, ConsistencyQuorum, ConsistencyAll:
+		return true
+	}
+	return false
+}
+
+// KeyDeletion reports which copies of a key confirmed its deletion.
+type KeyDeletion struct {
+	Key         string `json:"key"`
+	Consistency string `json:"consistency"`
+	// Stores are the stores the key was deleted from.
+	Stores []string `json:"stores"`
+	// Holders are the stores that recorded the key's tombstone in their
+	// backup of one of Stores or Pending, once for each backup.
+	Holders []string `json:"holders,omitempty"`
+	// Replicas are the read replicas of Stores seen no longer serving the
+	// key; they are only waited for at ConsistencyAll.
+	Replicas []string `json:"replicas,omitempty"`
+	// Pending are the stores that could not be reached, once for each copy
+	// they hold, which are sent the deletion or the tombstone once they are
+	// back UP.
+	Pending []string `json:"pending,omitempty"`
+}
+
+// DeleteKeyAt deletes key from every store found holding it and records its
+// tombstone on the stores backing those up, then checks that enough of them
+// confirmed it for the consistency level. Stores that could not be reached
+// are sent the deletion once they are back. A deletion that took effect but
+// was not confirmed well enough fails with ErrDeleteUnconfirmed, and its
+// report says which copies confirmed it.
+func (b *Broker) DeleteKeyAt(ctx context.Context, key, consistency string) (KeyDeletion, error) {
+	return b.deleteKeyAt(ctx, key, consistency, nil)
+}
+
+// deleteKeyAt is DeleteKeyAt for a key already deleted from done, if it is
+// not nil, which is counted as a copy that confirmed it and not asked again.
+func (b *Broker) deleteKeyAt(ctx context.Context, key, consistency string, done StoreClient) (KeyDeletion, error) {
+	if consistency == "" {
+		consistency = ConsistencyOne
+	}
+	deletion := KeyDeletion{Key: key, Consistency: consistency, Stores: []string{}}
+	if !ValidConsistency(consistency) {
+		return deletion, fmt.Errorf("unknown consistency level %q", consistency)
+	}
+	logger := logging.FromContext(ctx, b.logger)
+	at := time.Now()
+	if done != nil {
+		deletion.Stores = append(deletion.Stores, done.Name())
+	}
+
+	// Ask every store that may hold the key, as a copy may be on several
+	var owners []StoreClient
+	var unreached []string
+	stores := b.skipStores(b.storeList(), key, "delete")
+	stores = slices.DeleteFunc(stores, func(store StoreClient) bool { return done != nil && store.Name() == done.Name() })
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Name() < stores[j].Name() })
+	b.readFanout.Observe(float64(len(stores)), "delete")
+	for _, store := range stores {
+		_, _, found, err := store.Get(ctx, key)
+		if err != nil {
+			logger.Error("error contacting store", "store", store.Name(), "address", store.Address(), "err", err)
+			unreached = append(unreached, store.Name())
+			continue
+		}
+		if found {
+			owners = append(owners, store)
+		}
+	}
+
+	if len(owners) == 0 && done == nil {
+		// The origin behind a store in cache mode may still hold it
+		if deleted, err := b.deleteThrough(ctx, key); deleted || err != nil {
+			return deletion, err
+		}
+		if len(unreached) == 0 {
+			logger.Debug("key not found for delete", "key_hash", logging.KeyHash(key))
+			return deletion, fmt.Errorf("key '%s' not found in any KVStore: %w", key, ErrKeyNotFound)
+		}
+	}
+
+	for _, owner := range owners {
+		deleted, err := owner.Delete(ctx, key)
+		switch {
+		case err != nil:
+			logger.Error("error deleting key", "key_hash", logging.KeyHash(key), "address", owner.Address(), "err", err)
+			unreached = append(unreached, owner.Name())
+		case !deleted:
+			// Deleted by someone else since the lookup
+			logger.Warn("failed to delete key", "key_hash", logging.KeyHash(key), "address", owner.Address())
+		default:
+			deletion.Stores = append(deletion.Stores, owner.Name())
+		}
+	}
+	b.reads.Forget(key)
+	b.forgetHotCopies(key)
+	if len(deletion.Stores) == 0 && len(unreached) == 0 {
+		return deletion, fmt.Errorf("failed to delete key '%s': %w", key, ErrKeyNotFound)
+	}
+
+	// The key is gone: the stores that may still hold a copy get the deletion
+	// once they are back, and their holders its tombstone now, so a failover
+	// of them does not bring it back either
+	for _, name := range unreached {
+		b.pendDelete(name, key, at)
+	}
+	deletion.Pending = append(deletion.Pending, unreached...)
+	for _, name := range slices.Concat(deletion.Stores, unreached) {
+		recorded, missed := b.recordTombstones(ctx, name, key)
+		deletion.Holders = append(deletion.Holders, recorded...)
+		deletion.Pending = append(deletion.Pending, missed...)
+	}
+	logger.Debug("key deleted", "key_hash", logging.KeyHash(key), "stores", deletion.Stores, "pending", deletion.Pending)
+
+	confirmed := len(deletion.Stores) + len(deletion.Holders)
+	copies := confirmed + len(deletion.Pending)
+	if len(deletion.Stores) == 0 {
+		// No store that may hold the key answered: whether it held it is
+		// not known until they are back and take the deletion
+		return deletion, fmt.Errorf("%w: the key was not found on the stores that answered, and %v could not be reached", ErrDeleteUnconfirmed, unreached)
+	}
+	switch consistency {
+	case ConsistencyQuorum:
+		if confirmed <= copies/2 {
+			return deletion, fmt.Errorf("%w: %d of %d copies confirmed it, not a quorum", ErrDeleteUnconfirmed, confirmed, copies)
+		}
+	case ConsistencyAll:
+		if len(deletion.Pending) > 0 {
+			return deletion, fmt.Errorf("%w: %d of %d copies confirmed it, %v could not be reached", ErrDeleteUnconfirmed, confirmed, copies, deletion.Pending)
+		}
+		replicas, stale := b.awaitReplicaDeletes(ctx, deletion.Stores, key)
+		deletion.Replicas = replicas
+		if len(stale) > 0 {
+			return deletion, fmt.Errorf("%w: read replicas %v still serve the key", ErrDeleteUnconfirmed, stale)
+		}
+	}
+	return deletion, nil
+}
+
+// awaitReplicaDeletes waits, for up to replicaDeleteTimeout, for the read
+// replicas of the named stores to stop serving key. It returns those that
+// did and those that still serve it or cannot be asked.
+func (b *Broker) awaitReplicaDeletes(ctx context.Context, stores []string, key string) (confirmed, stale []string) {
+	primaries := make(map[string]bool, len(stores))
+	for _, name := range stores {
+		primaries[name] = true
+	}
+	b.mu.RLock()
+	targets := make(map[string]string)
+	for _, r := range b.replicas {
+		if primaries[r.primary] {
+			targets[r.name] = r.addr
+		}
+	}
+	b.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, replicaDeleteTimeout)
+	defer cancel()
+	for name, addr := range targets {
+		if b.awaitReplicaDelete(ctx, addr, key) {
+			confirmed = append(confirmed, name)
+		} else {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(confirmed)
+	sort.Strings(stale)
+	return confirmed, stale
+}
+
+// awaitReplicaDelete reports whether the replica at addr stopped serving key
+// before ctx is done.
+func (b *Broker) awaitReplicaDelete(ctx context.Context, addr, key string) bool {
+	ticker := time.NewTicker(replicaDeletePoll)
+	defer ticker.Stop()
+	for {
+		if _, _, found, err := b.replicaGet(ctx, addr, key, replicaDeleteTimeout); err == nil && !found {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// pendingDeletes are the deletions a store missed because it could not be
+// reached, each with when it was made.
+type pendingDeletes struct {
+	// keys are the keys to delete from the store
+	keys map[string]time.Time
+	// tombstones are the keys deleted from the stores it backs up, by store
+	tombstones map[string]map[string]time.Time
+	// full is set once deletions were dropped for going past maxPendingDeletes
+	full bool
+}
+
+func (p *pendingDeletes) len() int {
+	n := len(p.keys)
+	for _, keys := range p.tombstones {
+		n += len(keys)
+	}
+	return n
+}
+
+// pending returns the deletions kept for the named store, or nil if it
+// already has as many as it may. b.mu must be held.
+func (b *Broker) pending(name string) *pendingDeletes {
+	p := b.pendingDeletes[name]
+	if p == nil {
+		p = &pendingDeletes{keys: make(map[string]time.Time), tombstones: make(map[string]map[string]time.Time)}
+		b.pendingDeletes[name] = p
+	}
+	if p.len() >= maxPendingDeletes {
+		if !p.full {
+			b.logger.Warn("too many deletions pending for store; dropping the rest", "store", name, "max", maxPendingDeletes)
+			p.full = true
+		}
+		return nil
+	}
+	return p
+}
+
+// pendDelete keeps key to be deleted from the named store once it is back.
+func (b *Broker) pendDelete(name, key string, at time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p := b.pending(name); p != nil {
+		p.keys[key] = at
+	}
+}
+
+// pendTombstones keeps the tombstones of keys deleted from peer to be sent
+// to holder, which backs it up, once holder is back.
+func (b *Broker) pendTombstones(holder, peer string, at time.Time, keys ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.pending(holder)
+	if p == nil {
+		return
+	}
+	if p.tombstones[peer] == nil {
+		p.tombstones[peer] = make(map[string]time.Time)
+	}
+	for _, key := range keys {
+		p.tombstones[peer][key] = at
+	}
+}
+
+// dropPendingDeletes forgets the deletions pending for keys just written to
+// the named store, so the new values are not deleted when it is sent them.
+// b.mu must be held.
+func (b *Broker) dropPendingDeletes(name string, keys ...string) {
+	if p := b.pendingDeletes[name]; p != nil {
+		for _, key := range keys {
+			delete(p.keys, key)
+		}
+	}
+}
+
+// sendPendingDeletes sends every store that is back UP, and not warming, the
+// deletions it missed. Those it still fails to take are kept for the next
+// round.
+func (b *Broker) sendPendingDeletes(ctx context.Context) {
+	b.mu.Lock()
+	targets := make(map[StoreClient]*pendingDeletes)
+	for name, p := range b.pendingDeletes {
+		store, exists := b.stores[name]
+		if !exists || b.health[name].Status != StatusUp || b.warming[name] {
+			continue
+		}
+		delete(b.pendingDeletes, name)
+		if p.len() > 0 {
+			targets[store] = p
+		}
+	}
+	b.mu.Unlock()
+
+	for store, p := range targets {
+		var deleted []string
+		for key, at := range p.keys {
+			if _, err := store.Delete(ctx, key); err != nil {
+				b.logger.Warn("failed to send store a pending deletion", "store", store.Name(), "err", err)
+				b.pendDelete(store.Name(), key, at)
+				continue
+			}
+			deleted = append(deleted, key)
+		}
+		if len(deleted) > 0 {
+			b.reads.Forget(deleted...)
+			b.recordTombstones(ctx, store.Name(), deleted...)
+		}
+
+		tombstones := 0
+		for peer, keys := range p.tombstones {
+			resp, err := b.storeRequest(ctx, http.MethodPost, store.Address(), "/tombstones", kvstore.TombstonesRequest{Peer: peer, Deleted: keys})
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("tombstones returned status: %d", resp.StatusCode)
+				}
+			}
+			if err != nil {
+				b.logger.Warn("failed to send store pending tombstones", "store", store.Name(), "peer", peer, "keys", len(keys), "err", err)
+				for key, at := range keys {
+					b.pendTombstones(store.Name(), peer, at, key)
+				}
+				continue
+			}
+			tombstones += len(keys)
+		}
+		if len(deleted) > 0 || tombstones > 0 {
+			b.logger.Info("sent store the deletions it missed", "store", store.Name(), "keys", len(deleted), "tombstones", tombstones)
+		}
+	}
+}
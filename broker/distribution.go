@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+	"net/url"
+)
+
+// StoreDistribution is one store's share of the cluster's data.
+type StoreDistribution struct {
+	Keys  int    `json:"keys"`
+	Bytes int    `json:"bytes"`
+	Error string `json:"error,omitempty"`
+	// KeySkew is the store's key count relative to an even split (1.0 is ideal).
+	KeySkew float64 `json:"key_skew"`
+}
+
+// DistributionReport describes how keys are spread over the stores.
+type DistributionReport struct {
+	Stores     map[string]StoreDistribution `json:"stores"`
+	TotalKeys  int                          `json:"total_keys"`
+	TotalBytes int                          `json:"total_bytes"`
+	IdealKeys  float64                      `json:"ideal_keys_per_store"`
+	// MaxKeySkew is the largest KeySkew of any store; values well above 1 suggest rebalancing.
+	MaxKeySkew float64 `json:"max_key_skew"`
+}
+
+// KeyDistribution asks every store for its key count and size and reports the skew versus an even split.
+// Stores that cannot be reached are reported with an error and left out of the totals.
+func (b *Broker) KeyDistribution(ctx context.Context) DistributionReport {
+	b.mu.RLock()
+	targets := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		targets[name] = store.Address()
+	}
+	b.mu.RUnlock()
+
+	report := DistributionReport{Stores: make(map[string]StoreDistribution, len(targets))}
+	reachable := 0
+	for name, addr := range targets {
+		stats, err := b.fetchStoreStats(ctx, addr, "")
+		if err != nil {
+			report.Stores[name] = StoreDistribution{Error: err.Error()}
+			continue
+		}
+		reachable++
+		report.Stores[name] = StoreDistribution{Keys: stats.Keys, Bytes: stats.Bytes}
+		report.TotalKeys += stats.Keys
+		report.TotalBytes += stats.Bytes
+	}
+
+	if reachable > 0 {
+		report.IdealKeys = float64(report.TotalKeys) / float64(reachable)
+	}
+	for name, dist := range report.Stores {
+		if dist.Error != "" || report.IdealKeys == 0 {
+			continue
+		}
+		dist.KeySkew = float64(dist.Keys) / report.IdealKeys
+		if dist.KeySkew > report.MaxKeySkew {
+			report.MaxKeySkew = dist.KeySkew
+		}
+		report.Stores[name] = dist
+	}
+	return report
+}
+
+// fetchStoreStats asks a store for the size of its data, or of the keys
+// starting with prefix if it is not empty.
+func (b *Broker) fetchStoreStats(ctx context.Context, addr, prefix string) (kvstore.Stats, error) {
+	var stats kvstore.Stats
+	path := "/stats"
+	if prefix != "" {
+		path += "?prefix=" + url.QueryEscape(prefix)
+	}
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, path, nil)
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("stats returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return stats, fmt.Errorf("error decoding stats: %w", err)
+	}
+	return stats, nil
+}
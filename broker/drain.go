@@ -0,0 +1,224 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kv/httpapi"
+	"kv/kvstore"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// ErrLastStore is returned when draining the only store that can still hold keys.
+var ErrLastStore = errors.New("cannot drain the last store: no other store can take its keys")
+
+// DrainStore moves every key held by the named store onto the other stores
+// and then removes it from the cluster. It returns the number of keys moved.
+//
+// While draining the store receives no new keys and reports itself not
+// ready, but writes to the keys it holds still go to it, so no older copy
+// is read elsewhere. They are moved in a further pass. Each key goes to the
+// least loaded store as a new key would, and is deleted from the store once
+// copied, unless written since. If moving fails or is aborted the store is
+// left registered and takes new keys again, with the keys already moved on
+// the other stores, and the drain can be retried.
+//
+// Its progress is reported by Migrations, through which it can be paused,
+// resumed or aborted.
+func (b *Broker) DrainStore(ctx context.Context, name string) (moved int, err error) {
+	b.mu.Lock()
+	store, exists := b.stores[name]
+	if !exists {
+		b.mu.Unlock()
+		return 0, ErrStoreNotFound
+	}
+	if len(b.stores)-len(b.draining) <= 1 && !b.draining[name] {
+		b.mu.Unlock()
+		return 0, ErrLastStore
+	}
+	b.draining[name] = true
+	addr := store.Address()
+	b.mu.Unlock()
+	m := b.startLocalMigration("drain", name, "")
+	defer func() {
+		m.Finish(err)
+		if err != nil {
+			b.stopDraining(ctx, name, addr)
+		}
+	}()
+
+	b.logger.Info("draining store", "store", name, "address", addr)
+	if resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/drain", nil); err == nil {
+		resp.Body.Close()
+	}
+
+	for pass := 0; ; pass++ {
+		data, err := b.fetchStoreData(ctx, addr)
+		if err != nil {
+			return moved, fmt.Errorf("error reading data from store %s: %w", name, err)
+		}
+		if len(data) == 0 {
+			break
+		}
+		if pass == movePasses {
+			return moved, fmt.Errorf("store %s still holds %d keys after %d passes", name, len(data), movePasses)
+		}
+		m.AddKeys(len(data))
+		keys := slices.Sorted(maps.Keys(data))
+		for start := 0; start < len(keys); start += moveBatchSize {
+			if err := m.Wait(ctx); err != nil {
+				return moved, err
+			}
+			target, err := b.GetLeastLoadedStore()
+			if err != nil {
+				return moved, fmt.Errorf("error moving keys off store %s: %w", name, err)
+			}
+			batch, err := b.moveBatch(ctx, "drain", name, addr, target.Name(), target.Address(), keys[start:min(start+moveBatchSize, len(keys))])
+			moved += len(batch)
+			if err != nil {
+				return moved, fmt.Errorf("error moving keys off store %s: %w", name, err)
+			}
+			m.Moved(batch)
+		}
+	}
+	b.logger.Info("store drained", "store", name, "keys_moved", moved)
+	b.recordEvent(ClusterEvent{Type: EventStoreDrained, Store: name, Details: fmt.Sprintf("%d keys moved", moved)})
+
+	if err := b.RemoveStore(name); err != nil {
+		return moved, err
+	}
+	return moved, nil
+}
+
+// stopDraining lets the named store at addr take new keys again after its
+// drain, handoff or merge failed or was aborted, and has it report itself
+// ready. A store removed or re-registered meanwhile is left as it is.
+func (b *Broker) stopDraining(ctx context.Context, name, addr string) {
+	b.mu.Lock()
+	current, exists := b.stores[name]
+	if !exists || current.Address() != addr {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.draining, name)
+	b.mu.Unlock()
+	b.logger.Info("store no longer draining", "store", name)
+
+	// The move may have ended because the caller gave up
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), membershipCallTimeout)
+	defer cancel()
+	resp, err := b.storeRequest(ctx, http.MethodDelete, addr, "/drain", nil)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("drain returned status: %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		b.logger.Warn("failed to tell the store it is no longer draining", "store", name, "err", err)
+	}
+}
+
+func (b *Broker) fetchStoreData(ctx context.Context, addr string) (map[string]string, error) {
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/getall", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getall returned status: %d", resp.StatusCode)
+	}
+	var data map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("error decoding getall: %w", err)
+	}
+	return data, nil
+}
+
+// HandOffStore has the named store push its keys to its ring successor and
+// removes it once the store confirms every key arrived. Unlike DrainStore the
+// keys travel between the stores directly. It returns the number of keys
+// handed off and the store that took them.
+//
+// The store is marked as draining meanwhile: it receives no new keys, but
+// writes to the keys it holds still go to it and are handed off in its
+// catch-up passes. The keys are sent with their entity tags, so a key
+// written on the successor since is not overwritten. If the handoff fails
+// or is aborted the store stays registered and takes new keys again, so the
+// handoff can be retried. Its progress is reported by Migrations, through
+// which it can be paused, resumed or aborted.
+func (b *Broker) HandOffStore(ctx context.Context, name string) (handedOff int, target string, err error) {
+	b.mu.Lock()
+	store, exists := b.stores[name]
+	if !exists {
+		b.mu.Unlock()
+		return 0, "", ErrStoreNotFound
+	}
+	if len(b.stores)-len(b.draining) <= 1 && !b.draining[name] {
+		b.mu.Unlock()
+		return 0, "", ErrLastStore
+	}
+	target, targetAddr := b.successor(name)
+	if target == "" {
+		b.mu.Unlock()
+		return 0, "", ErrLastStore
+	}
+	b.draining[name] = true
+	addr := store.Address()
+	b.mu.Unlock()
+	b.startHandoffMigration(name, addr)
+	defer func() {
+		if err != nil {
+			b.stopDraining(ctx, name, addr)
+		}
+	}()
+
+	b.logger.Info("handing off store", "store", name, "address", addr, "target", target)
+	if resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/drain", nil); err == nil {
+		resp.Body.Close()
+	}
+
+	b.forgetFilter(target)
+	resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/handoff", map[string]string{"target": targetAddr})
+	if err != nil {
+		return 0, target, fmt.Errorf("error handing off store %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	b.finishHandoffMigration(ctx, name, addr)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		failed, _ := httpapi.DecodeProblem(body)
+		return 0, target, fmt.Errorf("handoff of store %s to %s failed with status %d: %s", name, target, resp.StatusCode, failed.Detail)
+	}
+	var result kvstore.HandoffResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, target, fmt.Errorf("error decoding handoff result: %w", err)
+	}
+	if result.Verified != result.Keys {
+		return 0, target, fmt.Errorf("store %s confirmed %d of %d keys on %s", name, result.Verified, result.Keys, target)
+	}
+	b.addLoad(target, result.Keys)
+	b.logger.Info("store handed off", "store", name, "target", target, "keys", result.Keys, "passes", result.Passes)
+	b.recordEvent(ClusterEvent{Type: EventStoreHandedOff, Store: name, Peer: target, Details: fmt.Sprintf("%d keys moved", result.Keys)})
+
+	if err := b.RemoveStore(name); err != nil {
+		return result.Keys, target, err
+	}
+	return result.Keys, target, nil
+}
+
+// successor returns the first store after name on the ring that can take
+// keys, or "" if there is none. b.mu must be held.
+func (b *Broker) successor(name string) (string, string) {
+	_, next := b.peerlist.Neighbors(name)
+	for node := next; node != nil && node.Name != name; node = node.Next {
+		if !b.draining[node.Name] && !b.warming[node.Name] {
+			return node.Name, b.stores[node.Name].Address()
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Ways of removing a store, as planned by PlanRemoval.
+const (
+	RemovePlain   = "remove"
+	RemoveDrain   = "drain"
+	RemoveHandoff = "handoff"
+)
+
+// RemovalPlan is what removing a store would do, as reported by a dry run.
+type RemovalPlan struct {
+	DryRun  bool   `json:"dry_run"`
+	Store   string `json:"store"`
+	Mode    string `json:"mode"`
+	Replica bool   `json:"replica,omitempty"`
+	// KeysAffected is the number of keys the store holds: moved by a drain
+	// or handoff, no longer served after a plain removal. It is -1 if the
+	// store did not report it.
+	KeysAffected int `json:"keys_affected"`
+	// Target is the store a handoff would push the keys to.
+	Target string `json:"target,omitempty"`
+	// StoresContacted are the stores the removal would send requests to,
+	// sorted, and Steps what it would ask of them, in order.
+	StoresContacted []string `json:"stores_contacted"`
+	Steps           []string `json:"steps"`
+}
+
+// PlanRemoval reports what removing the named store in the given mode would
+// do, without doing it. It fails as the removal would, e.g. with
+// ErrLastStore when no other store could take the keys.
+func (b *Broker) PlanRemoval(ctx context.Context, name, mode string) (RemovalPlan, error) {
+	plan := RemovalPlan{DryRun: true, Store: name, Mode: mode, StoresContacted: []string{name}}
+
+	b.mu.RLock()
+	if _, ok := b.replicas[name]; ok {
+		b.mu.RUnlock()
+		// A replica holds no keys of its own, so there is nothing to move
+		plan.Replica = true
+		plan.Steps = []string{"remove read replica " + name, "shut down " + name}
+		return plan, nil
+	}
+	store, exists := b.stores[name]
+	if !exists {
+		b.mu.RUnlock()
+		return plan, ErrStoreNotFound
+	}
+	if mode != RemovePlain && len(b.stores)-len(b.draining) <= 1 && !b.draining[name] {
+		b.mu.RUnlock()
+		return plan, ErrLastStore
+	}
+	addr := store.Address()
+	var others, receivers []string
+	for other := range b.stores {
+		if other != name {
+			others = append(others, other)
+			if !b.draining[other] {
+				receivers = append(receivers, other)
+			}
+		}
+	}
+	slices.Sort(others)
+	slices.Sort(receivers)
+	if mode == RemoveHandoff {
+		plan.Target, _ = b.successor(name)
+		if plan.Target == "" {
+			b.mu.RUnlock()
+			return plan, ErrLastStore
+		}
+	}
+	b.mu.RUnlock()
+
+	plan.KeysAffected = -1
+	if report := b.fetchLoadReport(ctx, addr); report != nil {
+		plan.KeysAffected = report.Keys
+	}
+	keys := "its keys"
+	if plan.KeysAffected >= 0 {
+		keys = fmt.Sprintf("its %d keys", plan.KeysAffected)
+	}
+	switch mode {
+	case RemoveDrain:
+		plan.Steps = append(plan.Steps,
+			"stop placing keys on "+name+" and ask it to drain",
+			fmt.Sprintf("read %s and write them to %s", keys, strings.Join(receivers, ", ")))
+	case RemoveHandoff:
+		plan.Steps = append(plan.Steps,
+			"stop placing keys on "+name+" and ask it to drain",
+			fmt.Sprintf("have it push %s to %s and confirm them", keys, plan.Target))
+	default:
+		plan.Steps = append(plan.Steps, "stop serving "+keys)
+	}
+	if len(others) > 0 {
+		plan.Steps = append(plan.Steps, "take "+name+" off the ring and send the new backup assignments to "+strings.Join(others, ", "))
+	}
+	plan.Steps = append(plan.Steps, "shut down "+name)
+	plan.StoresContacted = append(plan.StoresContacted, others...)
+	slices.Sort(plan.StoresContacted)
+	return plan, nil
+}
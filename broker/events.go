@@ -0,0 +1,240 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Cluster events recorded in the broker's event history.
+const (
+	EventStoreRegistered   = "store_registered"
+	EventReplicaRegistered = "replica_registered"
+	EventStoreRemoved      = "store_removed"
+	EventStoreDown         = "store_down"
+	EventStoreRecovered    = "store_recovered"
+	EventUncleanShutdown   = "unclean_shutdown"
+	EventStoreCorrupt      = "store_corrupt"
+	EventStoreRecovering   = "store_recovering"
+	// EventStoreDataRecovered is a corrupt store having recovered its data
+	// from its peer's backup; EventStoreRecovered is a store back UP.
+	EventStoreDataRecovered = "store_data_recovered"
+	EventFailover           = "failover"
+	EventFailoverCompleted  = "failover_completed"
+	EventFailoverFailed     = "failover_incomplete"
+	EventStoreDrained       = "store_drained"
+	EventStoreHandedOff     = "store_handed_off"
+	EventStoreSplit         = "store_split"
+	EventStoreMerged        = "store_merged"
+	EventSnapshot           = "snapshot"
+	EventJob                = "job"
+	EventHotKeyCopied       = "hot_key_copied"
+	EventHotKeyReverted     = "hot_key_reverted"
+)
+
+// eventHistory is the number of events the broker keeps, in memory and in
+// the event log file.
+const eventHistory = 1000
+
+// ClusterEvent is something that happened to the cluster, such as a store
+// registering, going down or being split.
+type ClusterEvent struct {
+	// Seq numbers the events in the order they happened, from 1.
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Store string    `json:"store,omitempty"`
+	// Peer is the other store involved, e.g. the survivor of a failover or
+	// the target of a split.
+	Peer    string `json:"peer,omitempty"`
+	Details string `json:"details,omitempty"`
+}
+
+// eventLog is the broker's recent cluster events, oldest first, optionally
+// appended to a file as JSON lines so they outlive a restart. It has a
+// mutex of its own so events can be recorded with b.mu held.
+type eventLog struct {
+	mu     sync.Mutex
+	events []ClusterEvent
+	next   uint64
+	path   string
+	file   *os.File
+	// lines is the number of lines in the file; it is rewritten with the
+	// events kept once it holds twice as many.
+	lines int
+}
+
+// recordEvent adds an event to the history, dropping the oldest beyond
+// eventHistory. Failures to write the event log are only logged.
+func (b *Broker) recordEvent(event ClusterEvent) {
+	l := b.events
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next++
+	event.Seq = l.next
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	l.events = append(l.events, event)
+	if len(l.events) > eventHistory {
+		l.events = l.events[len(l.events)-eventHistory:]
+	}
+	if l.file == nil {
+		return
+	}
+	if err := l.append(event); err != nil {
+		b.logger.Error("failed to write event log", "file", l.path, "err", err)
+	}
+}
+
+// append writes an event to the file, rewriting it first if it has grown to
+// twice the events kept. l.mu must be held.
+func (l *eventLog) append(event ClusterEvent) error {
+	if l.lines >= 2*eventHistory {
+		// The event was added to l.events already
+		return l.rewrite()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.lines++
+	return nil
+}
+
+// rewrite replaces the file with the events kept and reopens it for
+// appending. l.mu must be held.
+func (l *eventLog) rewrite() error {
+	tmp := l.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, event := range l.events {
+		if err := enc.Encode(event); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	l.lines = len(l.events)
+	return err
+}
+
+// SetEventLog has the cluster events appended to the file at path; an empty
+// path keeps them in memory only. At startup, while no event has been
+// recorded, the events in the file are loaded first.
+func (b *Broker) SetEventLog(path string) error {
+	l := b.events
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	l.path = path
+	if path == "" {
+		return nil
+	}
+	if len(l.events) == 0 {
+		events, err := readEventLog(path)
+		if err != nil {
+			return err
+		}
+		l.events = events[max(len(events)-eventHistory, 0):]
+		if len(l.events) > 0 {
+			l.next = l.events[len(l.events)-1].Seq
+		}
+	}
+	return l.rewrite()
+}
+
+// readEventLog reads the events in the file at path, if it exists.
+func readEventLog(path string) ([]ClusterEvent, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var events []ClusterEvent
+	dec := json.NewDecoder(file)
+	for dec.More() {
+		var event ClusterEvent
+		if err := dec.Decode(&event); err != nil {
+			// A line cut short by a crash ends the log
+			if len(events) > 0 {
+				break
+			}
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// EventsResponse is the response of GET /events.
+type EventsResponse struct {
+	Events []ClusterEvent `json:"events"`
+	// Next is the sequence number to pass as since on the following call.
+	Next uint64 `json:"next"`
+}
+
+// Events returns up to limit of the events after sequence number since, or
+// all of them if limit is 0, oldest first.
+func (b *Broker) Events(since uint64, limit int) EventsResponse {
+	l := b.events
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	resp := EventsResponse{Events: []ClusterEvent{}, Next: since}
+	for _, event := range l.events {
+		if event.Seq <= since {
+			continue
+		}
+		if limit > 0 && len(resp.Events) == limit {
+			break
+		}
+		resp.Events = append(resp.Events, event)
+		resp.Next = event.Seq
+	}
+	return resp
+}
+
+// EventsSince returns up to limit of the events that happened after t, or
+// all of them if limit is 0, oldest first.
+func (b *Broker) EventsSince(t time.Time, limit int) EventsResponse {
+	l := b.events
+	l.mu.Lock()
+	var since uint64
+	for _, event := range l.events {
+		if event.Time.After(t) {
+			break
+		}
+		since = event.Seq
+	}
+	l.mu.Unlock()
+	return b.Events(since, limit)
+}
@@ -0,0 +1,313 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv/codec"
+	"kv/kvstore"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+)
+
+// failoverHistory is the number of failover reports the broker keeps.
+const failoverHistory = 20
+
+// FailoverReport records a failover and the follow-up that completes it:
+// checking the recovered keys, moving them off the survivor and backing the
+// moved keys up again.
+type FailoverReport struct {
+	Store    string    `json:"store"`
+	Address  string    `json:"address"`
+	Survivor string    `json:"survivor,omitempty"` // store that took over the keys
+	Time     time.Time `json:"time"`
+	// ExpectedKeys is how many keys the store held at its last successful
+	// health probe; -1 if unknown.
+	ExpectedKeys  int        `json:"expected_keys"`
+	RecoveredKeys int        `json:"recovered_keys"`
+	BackupTaken   *time.Time `json:"backup_taken,omitempty"`
+	// Verified is set when at least the expected number of keys was
+	// recovered. Keys written after the last backup are lost otherwise.
+	Verified bool `json:"verified"`
+	// Moved is the number of recovered keys placed on other stores.
+	Moved int `json:"moved"`
+	// Rereplicated lists the stores told to back up their peers at once.
+	Rereplicated []string `json:"rereplicated,omitempty"`
+	Errors       []string `json:"errors,omitempty"`
+	Done         bool     `json:"done"`
+}
+
+// Failovers returns the most recent failover reports, oldest first.
+func (b *Broker) Failovers() []FailoverReport {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	reports := make([]FailoverReport, len(b.failovers))
+	for i, report := range b.failovers {
+		reports[i] = *report
+		reports[i].Rereplicated = append([]string(nil), report.Rereplicated...)
+		reports[i].Errors = append([]string(nil), report.Errors...)
+	}
+	return reports
+}
+
+// recordFailover adds a report, dropping the oldest beyond failoverHistory.
+func (b *Broker) recordFailover(report *FailoverReport) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failovers = append(b.failovers, report)
+	if len(b.failovers) > failoverHistory {
+		b.failovers = b.failovers[len(b.failovers)-failoverHistory:]
+	}
+}
+
+// failoverError records a step of the follow-up that failed.
+func (b *Broker) failoverError(report *FailoverReport, err error) {
+	b.logger.Error("failover follow-up failed", "store", report.Store, "survivor", report.Survivor, "err", err)
+	b.mu.Lock()
+	report.Errors = append(report.Errors, err.Error())
+	b.mu.Unlock()
+}
+
+// failedTakeOver records that the survivor recovered nothing, which ends the failover.
+func (b *Broker) failedTakeOver(report *FailoverReport, err error) {
+	b.failoverError(report, err)
+	b.mu.Lock()
+	report.Done = true
+	alerter := b.alerter
+	b.mu.Unlock()
+	alerter.Fire(Alert{Event: AlertFailoverIncomplete, Store: report.Store, Peer: report.Survivor, Details: "no keys recovered: " + err.Error()})
+	b.recordEvent(ClusterEvent{Type: EventFailoverFailed, Store: report.Store, Peer: report.Survivor, Details: "no keys recovered: " + err.Error()})
+}
+
+// verifyFailover compares the keys the survivor recovered with the number the
+// store was known to hold, and alerts if some are missing.
+func (b *Broker) verifyFailover(report *FailoverReport, backup kvstore.PeerBackupMeta) {
+	b.mu.Lock()
+	report.RecoveredKeys, report.BackupTaken = backup.Keys, &backup.Taken
+	report.Verified = report.ExpectedKeys >= 0 && backup.Keys >= report.ExpectedKeys
+	alerter := b.alerter
+	b.mu.Unlock()
+
+	if report.ExpectedKeys < 0 {
+		b.logger.Warn("failover recovered keys could not be verified: key count unknown", "store", report.Store, "recovered", backup.Keys)
+		return
+	}
+	if !report.Verified {
+		details := fmt.Sprintf("recovered %d of %d keys from the backup taken at %s", backup.Keys, report.ExpectedKeys, backup.Taken.Format(time.RFC3339))
+		b.logger.Warn("failover lost keys", "store", report.Store, "survivor", report.Survivor, "expected", report.ExpectedKeys, "recovered", backup.Keys)
+		alerter.Fire(Alert{Event: AlertFailoverIncomplete, Store: report.Store, Peer: report.Survivor, Details: details})
+		b.recordEvent(ClusterEvent{Type: EventFailoverFailed, Store: report.Store, Peer: report.Survivor, Details: details})
+	}
+}
+
+// finishFailover spreads the keys the survivor recovered over the stores by
+// load, as if they had been written anew, and has the stores that got keys
+// backed up again at once rather than on their holders' next snapshot. It
+// runs on the management goroutine.
+func (b *Broker) finishFailover(report *FailoverReport, deadAddr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*membershipCallTimeout)
+	defer cancel()
+	defer func() {
+		b.mu.Lock()
+		report.Done = true
+		b.mu.Unlock()
+	}()
+
+	b.mu.RLock()
+	survivor, exists := b.stores[report.Survivor]
+	b.mu.RUnlock()
+	if !exists {
+		b.failoverError(report, fmt.Errorf("survivor %s left the cluster: %w", report.Survivor, ErrStoreNotFound))
+		return
+	}
+
+	moved, err := b.moveRecovered(ctx, report.Survivor, survivor.Address(), deadAddr)
+	b.mu.Lock()
+	report.Moved = moved.count
+	b.mu.Unlock()
+	if err != nil {
+		b.failoverError(report, err)
+	}
+
+	// The survivor gained keys, and so did any store they were moved to
+	changed := map[string]bool{report.Survivor: true}
+	for _, name := range moved.targets {
+		changed[name] = true
+	}
+	b.mu.RLock()
+	holders := b.holdersOf(slices.Collect(maps.Keys(changed))...)
+	b.mu.RUnlock()
+
+	names := make([]string, 0, len(holders))
+	for name := range holders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := b.backUpNow(ctx, holders[name]); err != nil {
+			b.failoverError(report, fmt.Errorf("re-replicating through %s: %w", name, err))
+			continue
+		}
+		b.mu.Lock()
+		report.Rereplicated = append(report.Rereplicated, name)
+		b.mu.Unlock()
+	}
+	b.logger.Info("failover completed", "store", report.Store, "survivor", report.Survivor, "moved", moved.count, "rereplicated", names)
+	b.recordEvent(ClusterEvent{Type: EventFailoverCompleted, Store: report.Store, Peer: report.Survivor,
+		Details: fmt.Sprintf("%d keys recovered, %d moved", report.RecoveredKeys, moved.count)})
+}
+
+// holdersOf returns the address of every store holding a backup of one of
+// the named stores, by name. b.mu must be held.
+func (b *Broker) holdersOf(names ...string) map[string]string {
+	holders := make(map[string]string)
+	for _, name := range names {
+		for _, holder := range b.peerlist.Holders(name, b.backups()) {
+			holders[holder.Name] = holder.IpAddress
+		}
+	}
+	return holders
+}
+
+// backUpNow asks the store at addr to back up the stores it holds backups
+// of at once, rather than at its next snapshot.
+func (b *Broker) backUpNow(ctx context.Context, addr string) error {
+	resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/backup-peers", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backup-peers returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// movedKeys counts the recovered keys moved and lists the stores they went to.
+type movedKeys struct {
+	count   int
+	targets []string
+}
+
+// moveRecovered places the keys the survivor recovered from the backup of the
+// store at deadAddr by load. Those placed elsewhere are copied there and
+// deleted from the survivor unless they changed in the meantime.
+func (b *Broker) moveRecovered(ctx context.Context, survivorName, survivorAddr, deadAddr string) (movedKeys, error) {
+	var moved movedKeys
+	backup, err := b.fetchBackup(ctx, survivorAddr, deadAddr)
+	if err != nil {
+		return moved, fmt.Errorf("reading the recovered keys from %s: %w", survivorName, err)
+	}
+	if len(backup) == 0 {
+		return moved, nil
+	}
+	keys := make([]string, 0, len(backup))
+	for key := range backup {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Move the values the survivor holds now, which may be newer
+	resp, err := b.storeRequest(ctx, http.MethodPost, survivorAddr, "/mget", map[string]interface{}{"keys": keys})
+	if err != nil {
+		return moved, err
+	}
+	var current struct {
+		Values map[string]string `json:"values"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&current)
+	resp.Body.Close()
+	if err != nil {
+		return moved, fmt.Errorf("error decoding mget from %s: %w", survivorName, err)
+	}
+
+	b.mu.RLock()
+	addrs := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		if b.draining[name] || b.warming[name] {
+			continue
+		}
+		addrs[name] = store.Address()
+	}
+	candidates := placementCandidates(addrs, nil)
+	loads := b.placementLoads(candidates)
+	b.mu.RUnlock()
+	if _, ok := addrs[survivorName]; !ok {
+		return moved, nil // a draining survivor moves all its keys itself
+	}
+
+	batches := make(map[string]map[string]string)
+	kept := 0
+	for _, key := range keys {
+		value, ok := current.Values[key]
+		if !ok {
+			continue // deleted since
+		}
+		target := leastLoaded(loads, candidates)
+		loads[target]++
+		if target == survivorName {
+			kept++
+			continue
+		}
+		if batches[target] == nil {
+			batches[target] = make(map[string]string)
+		}
+		batches[target][key] = value
+	}
+	b.addLoad(survivorName, kept)
+
+	targets := make([]string, 0, len(batches))
+	for name := range batches {
+		targets = append(targets, name)
+	}
+	sort.Strings(targets)
+	for _, name := range targets {
+		batch := batches[name]
+		resp, err := b.storeRequest(ctx, http.MethodPost, addrs[name], "/mset?moved=1", map[string]interface{}{"pairs": batch})
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("KVStore %s returned status: %d", name, resp.StatusCode)
+			}
+		}
+		if err != nil {
+			// The keys stay on the survivor
+			b.forgetFilter(name)
+			b.addLoad(survivorName, len(batch))
+			return moved, fmt.Errorf("moving recovered keys to %s: %w", name, err)
+		}
+		b.noteWrites(name, slices.Collect(maps.Keys(batch))...)
+		b.addLoad(name, len(batch))
+		moved.count += len(batch)
+		moved.targets = append(moved.targets, name)
+
+		resp, err = b.storeRequest(ctx, http.MethodPost, survivorAddr, "/mdelete", map[string]interface{}{"pairs": batch})
+		if err != nil {
+			return moved, fmt.Errorf("deleting moved keys from %s: %w", survivorName, err)
+		}
+		resp.Body.Close()
+	}
+	return moved, nil
+}
+
+// fetchBackup reads the backup the store at addr holds of the store at of.
+func (b *Broker) fetchBackup(ctx context.Context, addr, of string) (map[string]string, error) {
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/backup?of="+url.QueryEscape(of), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("backup returned status: %d", resp.StatusCode)
+	}
+	// The backup comes in the codec the holder wrote it in
+	data, _, err := codec.ForContentType(resp.Header.Get("Content-Type")).Decode(resp.Body, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding backup: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,310 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+	"time"
+)
+
+// healthFailureThreshold is the number of consecutive failed probes after
+// which a store is marked DOWN.
+const healthFailureThreshold = 3
+
+// healthProbeTimeout bounds a single /healthz probe.
+const healthProbeTimeout = 2 * time.Second
+
+// Health states reported for a store.
+const (
+	StatusUp   = "UP"
+	StatusDown = "DOWN"
+)
+
+// StoreHealth is the broker's view of a single store's health.
+type StoreHealth struct {
+	Status              string    `json:"status"`
+	LastChecked         time.Time `json:"last_checked"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	// Keys is how many keys the store held at its last successful probe;
+	// nil if it did not say. Failover checks the recovered keys against it.
+	Keys *int `json:"keys,omitempty"`
+	// Cache is set when the store is in cache mode, so keys missing from
+	// every store are read through from its origin.
+	Cache bool `json:"cache,omitempty"`
+	// UncleanShutdown is set when the store's last run ended without a
+	// clean shutdown, so it may have lost the writes since its last snapshot.
+	UncleanShutdown bool `json:"unclean_shutdown,omitempty"`
+	// Integrity is the outcome of the store's startup self-check when it
+	// found problems, e.g. "corrupt" for a store that started from a
+	// corrupt snapshot and is not routed to until it has recovered.
+	Integrity string `json:"integrity,omitempty"`
+	// Report is the store's load report from its last successful probe;
+	// nil if the probe failed or the store gave none.
+	Report *kvstore.LoadReport `json:"load_report,omitempty"`
+	// reportLoad is the store's routed load when Report was received.
+	reportLoad int
+}
+
+// StartHealthChecks probes every registered store's /healthz endpoint at the given interval.
+// A loop that is already running is replaced, so calling it again changes the interval.
+func (b *Broker) StartHealthChecks(interval time.Duration) {
+	b.tasks.Start("health-checks", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			b.CheckStores(ctx)
+		}
+	})
+}
+
+// CheckStores probes every registered store once and updates their health,
+// then asks the read replicas how far behind they are, starts splitting a
+// store grown past the split size, spreads the reads of hot keys and sends
+// the stores back UP the deletions they missed.
+func (b *Broker) CheckStores(ctx context.Context) {
+	defer b.sendPendingDeletes(ctx)
+	defer b.spreadHotKeys(ctx)
+	defer b.splitOversized()
+	defer b.checkReplicas(ctx)
+	defer b.refreshFilters(ctx)
+
+	b.mu.RLock()
+	targets := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		targets[name] = store.Address()
+	}
+	b.mu.RUnlock()
+
+	type result struct {
+		probe  storeProbe
+		report *kvstore.LoadReport
+		err    error
+	}
+	results := make(map[string]result, len(targets))
+	for name, addr := range targets {
+		probe, err := b.probeStore(ctx, addr)
+		var report *kvstore.LoadReport
+		if err == nil {
+			report = b.fetchLoadReport(ctx, addr)
+		}
+		results[name] = result{probe, report, err}
+	}
+	if ctx.Err() != nil {
+		return // stopped, not failed: the stores were not all asked
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, probe := range results {
+		if _, exists := b.stores[name]; !exists {
+			continue // removed while we were probing
+		}
+		b.recordProbe(name, probe.err)
+		health := b.health[name]
+		if probe.err == nil {
+			if probe.probe.Keys != nil {
+				health.Keys = probe.probe.Keys
+			}
+			health.Cache = probe.probe.Cache
+			health.UncleanShutdown = probe.probe.UncleanShutdown
+		}
+		health.Report, health.reportLoad = probe.report, b.loads[name]
+		b.health[name] = health
+		if probe.err == nil {
+			b.noteIntegrity(name, probe.probe.Integrity)
+		}
+	}
+}
+
+// fetchLoadReport asks the store at addr for its load report, and returns
+// nil if it gives none, e.g. because it predates load reports.
+func (b *Broker) fetchLoadReport(ctx context.Context, addr string) *kvstore.LoadReport {
+	ctx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+	defer cancel()
+
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/load-report", nil)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	var report kvstore.LoadReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil
+	}
+	return &report
+}
+
+// storeProbe is what a store's /healthz reports.
+type storeProbe struct {
+	Keys            *int   `json:"keys"`
+	Cache           bool   `json:"cache"`
+	UncleanShutdown bool   `json:"unclean_shutdown"`
+	Integrity       string `json:"integrity"`
+}
+
+// probeStore checks the store's /healthz and returns what it reports.
+func (b *Broker) probeStore(ctx context.Context, addr string) (storeProbe, error) {
+	ctx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+	defer cancel()
+
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/healthz", nil)
+	if err != nil {
+		return storeProbe{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return storeProbe{}, fmt.Errorf("healthz returned status: %d", resp.StatusCode)
+	}
+	var body storeProbe
+	json.NewDecoder(resp.Body).Decode(&body)
+	return body, nil
+}
+
+// recordProbe updates a store's health with the outcome of a probe. b.mu must be held.
+func (b *Broker) recordProbe(name string, probeErr error) {
+	health := b.health[name]
+	health.LastChecked = time.Now()
+
+	if probeErr == nil {
+		if health.Status == StatusDown {
+			b.logger.Info("store is back UP", "store", name)
+			b.alerter.Fire(Alert{Event: AlertStoreRecovered, Store: name})
+			b.recordEvent(ClusterEvent{Type: EventStoreRecovered, Store: name})
+		}
+		health.Status = StatusUp
+		health.LastError = ""
+		health.ConsecutiveFailures = 0
+		b.storeUp.Set(1, name)
+	} else {
+		health.LastError = probeErr.Error()
+		health.ConsecutiveFailures++
+		if health.ConsecutiveFailures >= healthFailureThreshold && health.Status != StatusDown {
+			b.logger.Warn("store marked DOWN", "store", name, "failures", health.ConsecutiveFailures, "err", probeErr)
+			health.Status = StatusDown
+			b.storeUp.Set(0, name)
+			b.alerter.Fire(Alert{Event: AlertStoreDown, Store: name, Details: probeErr.Error()})
+			b.recordEvent(ClusterEvent{Type: EventStoreDown, Store: name, Details: probeErr.Error()})
+		}
+	}
+	b.health[name] = health
+}
+
+// uncleanShutdown records that the store registered after its last run ended
+// without a clean shutdown. The backups it holds of its peers stopped being
+// refreshed while it was down, so it is told to take them again at once
+// instead of at its next snapshot.
+func (b *Broker) uncleanShutdown(name string) {
+	b.mu.Lock()
+	store, exists := b.stores[name]
+	if !exists {
+		b.mu.Unlock()
+		return
+	}
+	health := b.health[name]
+	health.UncleanShutdown = true
+	b.health[name] = health
+	alerter := b.alerter
+	b.mu.Unlock()
+
+	details := "last run ended without a clean shutdown; writes since its last snapshot may be lost"
+	b.logger.Warn("store restarted after an unclean shutdown", "store", name)
+	alerter.Fire(Alert{Event: AlertUncleanShutdown, Store: name, Details: details})
+	b.recordEvent(ClusterEvent{Type: EventUncleanShutdown, Store: name, Details: details})
+	b.tasks.Go(func(ctx context.Context) {
+		if err := b.backUpNow(ctx, store.Address()); err != nil {
+			b.logger.Error("failed to refresh peer backups after unclean shutdown", "store", name, "err", err)
+		}
+	})
+}
+
+// storeCorrupt handles a store registering after it started from a corrupt
+// snapshot.
+func (b *Broker) storeCorrupt(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.stores[name]; exists {
+		b.noteIntegrity(name, kvstore.IntegrityCorrupt)
+	}
+}
+
+// noteIntegrity records the integrity a store reports. A store newly found
+// corrupt is routed nothing, as if warming, and an alert is fired; it stays
+// so until it has recovered its data and says it is warm. While it is
+// corrupt and not already recovering, it is asked to recover from the backup
+// its peer holds. b.mu must be held.
+func (b *Broker) noteIntegrity(name, integrity string) {
+	health := b.health[name]
+	was := health.Integrity
+	health.Integrity = integrity
+	b.health[name] = health
+
+	corrupt := func(status string) bool {
+		return status == kvstore.IntegrityCorrupt || status == kvstore.IntegrityRecovering
+	}
+	switch {
+	case integrity == kvstore.IntegrityCorrupt:
+		if !corrupt(was) {
+			details := "started from a corrupt snapshot; recovering its data from its peer's backup"
+			b.logger.Error("store reports corrupt data", "store", name)
+			b.alerter.Fire(Alert{Event: AlertStoreCorrupt, Store: name, Details: details})
+			b.recordEvent(ClusterEvent{Type: EventStoreCorrupt, Store: name, Details: details})
+			b.setWarming(name, true)
+		}
+		b.recoverStore(name)
+	case integrity == kvstore.IntegrityRecovered && corrupt(was):
+		b.logger.Info("store recovered its data from its peer", "store", name)
+		b.recordEvent(ClusterEvent{Type: EventStoreDataRecovered, Store: name})
+	}
+}
+
+// recoverStore has the named store, which started from a corrupt snapshot,
+// load the backup of its data from the store holding it. The store answers
+// at once and recovers in the background.
+func (b *Broker) recoverStore(name string) {
+	b.tasks.Go(func(ctx context.Context) {
+		holder, _, err := b.requestRecovery(ctx, name, false)
+		switch {
+		case errors.Is(err, ErrRecovering), errors.Is(err, ErrStoreNotFound):
+			// Already recovering or recovered, or removed meanwhile
+		case err != nil:
+			b.logger.Error("failed to ask store to recover", "store", name, "err", err)
+		default:
+			b.logger.Info("store recovering from its peer's backup", "store", name, "holder", holder)
+		}
+	})
+}
+
+// StoreHealth returns a copy of the current health of every registered store.
+func (b *Broker) StoreHealth() map[string]StoreHealth {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	result := make(map[string]StoreHealth, len(b.health))
+	for name, health := range b.health {
+		result[name] = health
+	}
+	return result
+}
+
+// HealthyStores returns how many registered stores are currently UP, and the total.
+func (b *Broker) HealthyStores() (healthy, total int) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for name := range b.stores {
+		if b.health[name].Status == StatusUp {
+			healthy++
+		}
+	}
+	return healthy, len(b.stores)
+}
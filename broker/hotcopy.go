@@ -0,0 +1,456 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"kv/logging"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Hot copies: with every health check the broker looks for keys taking a
+// large part of the cluster's accesses on a store busier than the others,
+// copies them to the least busy stores and reads them in turn from the store
+// holding them and the copies. A write to a copied key stops its copies
+// being read at once; they expire on their stores, and the key is copied
+// again at the next check if it is still hot. Copies are dropped once the
+// key's part of the accesses falls below half the threshold.
+
+// errNoCopyTargets is returned when no store other than the one holding a
+// hot key can take a copy of it.
+var errNoCopyTargets = errors.New("no other store can take a copy")
+
+// HotCopyConfig sets when the broker copies hot keys to other stores.
+type HotCopyConfig struct {
+	// Share is the part of the cluster's accesses, from 0 to 1, a key must
+	// take to be copied, e.g. 0.05. Its copies are dropped below half of it.
+	Share float64 `json:"share"`
+	// Copies is how many stores besides the one holding a key get a copy
+	// of it (default 1).
+	Copies int `json:"copies,omitempty"`
+	// MaxKeys is how many keys may be copied at once (default 10).
+	MaxKeys int `json:"max_keys,omitempty"`
+	// LoadFactor is how many times the average operations rate of the
+	// stores the store holding a key must handle for it to be copied
+	// (default 1.5). Without load reports from two stores, it is not
+	// checked.
+	LoadFactor float64 `json:"load_factor,omitempty"`
+}
+
+// Validate reports every problem with the settings at once.
+func (c HotCopyConfig) Validate() error {
+	var errs []error
+	if c.Share <= 0 || c.Share > 1 {
+		errs = append(errs, errors.New("share must be above 0 and at most 1"))
+	}
+	if c.Copies < 0 || c.MaxKeys < 0 {
+		errs = append(errs, errors.New("copies and max_keys must not be negative"))
+	}
+	if c.LoadFactor != 0 && c.LoadFactor < 1 {
+		errs = append(errs, errors.New("load_factor must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
+func (c HotCopyConfig) copies() int {
+	if c.Copies > 0 {
+		return c.Copies
+	}
+	return 1
+}
+
+func (c HotCopyConfig) maxKeys() int {
+	if c.MaxKeys > 0 {
+		return c.MaxKeys
+	}
+	return 10
+}
+
+func (c HotCopyConfig) loadFactor() float64 {
+	if c.LoadFactor > 0 {
+		return c.LoadFactor
+	}
+	return 1.5
+}
+
+func hotCopyEqual(a, b *HotCopyConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// hotCopy is a hot key copied, or being copied, to other stores.
+type hotCopy struct {
+	key    string
+	holder string   // the store holding the key when last copied
+	etag   string   // the holder's entity tag for the value copied
+	stores []string // the stores holding a copy; replaced, never changed in place
+	// ready is set once the copies are in place; until then, and once the
+	// key is written, its reads go to the store holding it only
+	ready   bool
+	since   time.Time
+	renewed time.Time
+}
+
+// HotCopy is a hot key whose reads are spread over copies on other stores.
+type HotCopy struct {
+	Key    string   `json:"key"`
+	Holder string   `json:"holder"`
+	Stores []string `json:"stores"`
+	// Serving is whether the copies are read; not while they are first
+	// made.
+	Serving bool      `json:"serving"`
+	Since   time.Time `json:"since"`
+	Renewed time.Time `json:"renewed"`
+}
+
+// HotCopies describes the hot keys copied to other stores, by key.
+func (b *Broker) HotCopies() []HotCopy {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	copies := make([]HotCopy, 0, len(b.hotCopies))
+	for _, key := range slices.Sorted(maps.Keys(b.hotCopies)) {
+		c := b.hotCopies[key]
+		copies = append(copies, HotCopy{Key: key, Holder: c.holder, Stores: c.stores, Serving: c.ready, Since: c.since, Renewed: c.renewed})
+	}
+	return copies
+}
+
+// ReadKey returns the value of key and the name of the store holding it, as
+// LookupKey does, except that the reads of a hot key copied to other stores
+// take turns between the store holding it and the copies. A read with a
+// staleness bound of zero is not answered by a copy. Reads before a write,
+// which need the store holding the key, use LookupKey.
+func (b *Broker) ReadKey(ctx context.Context, key string) (string, string, error) {
+	found, err := b.readStoredKey(ctx, key)
+	return found.value, found.store, err
+}
+
+// readStoredKey is ReadKey returning the value's entity tag too; a copy
+// gives the tag of the value it was copied from.
+func (b *Broker) readStoredKey(ctx context.Context, key string) (storedKey, error) {
+	if bound, bounded := maxStaleness(ctx); !bounded || bound > 0 {
+		if found, ok := b.readHotCopy(ctx, key); ok {
+			return found, nil
+		}
+	}
+	return b.lookupStoredKey(ctx, key)
+}
+
+// readHotCopy reads key from one of its copies if it has some and it is
+// their turn. A copy that cannot be read is not read again until renewed.
+func (b *Broker) readHotCopy(ctx context.Context, key string) (storedKey, bool) {
+	b.mu.RLock()
+	c := b.hotCopies[key]
+	if c == nil || !c.ready || len(c.stores) == 0 {
+		b.mu.RUnlock()
+		return storedKey{}, false
+	}
+	// Slot 0 is the store holding the key
+	turn := int(b.readTurn.Add(1) % uint64(len(c.stores)+1))
+	if turn == 0 {
+		b.mu.RUnlock()
+		return storedKey{}, false
+	}
+	name, holder, etag := c.stores[turn-1], c.holder, c.etag
+	store, exists := b.stores[name]
+	b.mu.RUnlock()
+	if !exists {
+		return storedKey{}, false
+	}
+
+	value, err := b.fetchHotCopy(ctx, store.Address(), key)
+	if err != nil {
+		logging.FromContext(ctx, b.logger).Warn("failed to read hot key copy", "store", name, "key_hash", logging.KeyHash(key), "err", err)
+		b.mu.Lock()
+		if b.hotCopies[key] == c {
+			c.stores = slices.DeleteFunc(slices.Clone(c.stores), func(s string) bool { return s == name })
+		}
+		b.mu.Unlock()
+		return storedKey{}, false
+	}
+	b.hotCopyReads.Inc(name)
+	return storedKey{value, holder, etag}, true
+}
+
+// fetchHotCopy reads the copy of key held by the store at addr.
+func (b *Broker) fetchHotCopy(ctx context.Context, addr, key string) (string, error) {
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/hot-copies?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("hot-copies returned status: %d", resp.StatusCode)
+	}
+	var result map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("error decoding hot copy: %w", err)
+	}
+	value, ok := result["value"]
+	if !ok {
+		return "", errors.New("hot copy has no value")
+	}
+	return value, nil
+}
+
+// dropHotCopies stops the copies of keys being read, as they were just
+// written. b.mu must be held.
+func (b *Broker) dropHotCopies(keys ...string) {
+	for _, key := range keys {
+		delete(b.hotCopies, key)
+	}
+}
+
+// forgetHotCopies is dropHotCopies for callers not holding b.mu.
+func (b *Broker) forgetHotCopies(keys ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dropHotCopies(keys...)
+}
+
+// forgetHotCopiesWithPrefix stops the copies of the keys starting with
+// prefix being read.
+func (b *Broker) forgetHotCopiesWithPrefix(prefix string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key := range b.hotCopies {
+		if strings.HasPrefix(key, prefix) {
+			delete(b.hotCopies, key)
+		}
+	}
+}
+
+// spreadHotKeys copies the keys that have become hot on a busy store,
+// renews the copies of those still hot and drops the others. It runs after
+// every health check, whose load reports it weighs.
+func (b *Broker) spreadHotKeys(ctx context.Context) {
+	b.mu.RLock()
+	cfg, copied := b.config.HotCopies, len(b.hotCopies)
+	ttl := 3 * time.Duration(b.config.HealthInterval)
+	b.mu.RUnlock()
+	if cfg == nil {
+		if copied > 0 {
+			b.revertHotCopies(ctx, nil)
+		}
+		return
+	}
+
+	report := b.HotKeys(ctx, kvstore.MaxHotKeys)
+	// A copied key is counted on every store it is read from
+	shares := make(map[string]float64)
+	for _, k := range report.Keys {
+		shares[k.Key] += k.ClusterShare
+	}
+	busy, weighed := b.busyStores(cfg.loadFactor())
+
+	var cooled []string
+	b.mu.Lock()
+	for key := range b.hotCopies {
+		if shares[key] < cfg.Share/2 {
+			cooled = append(cooled, key)
+		}
+	}
+	var renew []*hotCopy
+	for _, key := range slices.Sorted(maps.Keys(b.hotCopies)) {
+		if !slices.Contains(cooled, key) {
+			renew = append(renew, b.hotCopies[key])
+		}
+	}
+	for _, k := range report.Keys {
+		if len(renew) >= cfg.maxKeys() {
+			break
+		}
+		if _, exists := b.hotCopies[k.Key]; exists || shares[k.Key] < cfg.Share || weighed && !busy[k.Store] {
+			continue
+		}
+		c := &hotCopy{key: k.Key, holder: k.Store, since: time.Now()}
+		b.hotCopies[k.Key] = c
+		renew = append(renew, c)
+	}
+	b.mu.Unlock()
+
+	if len(cooled) > 0 {
+		b.revertHotCopies(ctx, cooled)
+	}
+	for _, c := range renew {
+		first := !c.ready
+		holder, stores, err := b.copyHotKey(ctx, c, cfg.copies(), ttl)
+		if err != nil {
+			b.logger.Warn("failed to copy hot key", "key_hash", logging.KeyHash(c.key), "err", err)
+			b.mu.Lock()
+			if b.hotCopies[c.key] == c && !c.ready {
+				delete(b.hotCopies, c.key)
+			}
+			b.mu.Unlock()
+			continue
+		}
+		if first {
+			b.logger.Info("hot key copied", "key_hash", logging.KeyHash(c.key), "holder", holder, "copies", stores)
+			b.recordEvent(ClusterEvent{Type: EventHotKeyCopied, Store: holder, Details: fmt.Sprintf("key %s copied to %s", logging.KeyHash(c.key), strings.Join(stores, ", "))})
+		}
+	}
+}
+
+// copyHotKey reads c's key from the store holding it and copies it, for ttl,
+// to the stores it already has copies on and the least busy others up to
+// copies. It returns the store holding the key and those given a copy. If
+// the key is written meanwhile, the copies are not read.
+func (b *Broker) copyHotKey(ctx context.Context, c *hotCopy, copies int, ttl time.Duration) (string, []string, error) {
+	found, err := b.lookupStoredKey(ctx, c.key)
+	if err != nil {
+		return "", nil, err
+	}
+	holder := found.store
+	b.mu.RLock()
+	previous := c.stores
+	targets := b.copyTargets(holder, previous, copies)
+	b.mu.RUnlock()
+	if len(targets) == 0 {
+		return "", nil, errNoCopyTargets
+	}
+
+	var stores []string
+	for name, addr := range targets {
+		err := b.putHotCopies(ctx, addr, kvstore.HotCopiesRequest{Copies: map[string]string{c.key: found.value}, TTL: kvstore.Duration(ttl)})
+		if err != nil {
+			b.logger.Warn("failed to copy hot key", "store", name, "key_hash", logging.KeyHash(c.key), "err", err)
+			continue
+		}
+		stores = append(stores, name)
+	}
+	if len(stores) == 0 {
+		return "", nil, errNoCopyTargets
+	}
+	sort.Strings(stores)
+	b.dropCopiesFrom(ctx, c.key, previous, stores)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.hotCopies[c.key] == c {
+		c.holder, c.etag, c.stores, c.ready, c.renewed = holder, found.etag, stores, true, time.Now()
+	}
+	return holder, stores, nil
+}
+
+// copyTargets picks up to n stores, by address, for copies of a key held by
+// holder: those of keep still readable, then the others handling the fewest
+// operations. b.mu must be held.
+func (b *Broker) copyTargets(holder string, keep []string, n int) map[string]string {
+	var candidates []string
+	for name := range b.stores {
+		if name != holder && !b.draining[name] && !b.warming[name] && b.health[name].Status != StatusDown {
+			candidates = append(candidates, name)
+		}
+	}
+	ops := func(name string) float64 {
+		if report := b.health[name].Report; report != nil {
+			return report.OpsPerSecond
+		}
+		return 0
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, c := candidates[i], candidates[j]
+		if ka, kc := slices.Contains(keep, a), slices.Contains(keep, c); ka != kc {
+			return ka
+		}
+		return ops(a) < ops(c) || ops(a) == ops(c) && a < c
+	})
+	targets := make(map[string]string, n)
+	for _, name := range candidates[:min(n, len(candidates))] {
+		targets[name] = b.stores[name].Address()
+	}
+	return targets
+}
+
+// busyStores returns the stores handling more than factor times the average
+// operations rate, and whether two or more stores gave a load report to
+// tell.
+func (b *Broker) busyStores(factor float64) (map[string]bool, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	rates := make(map[string]float64)
+	var total float64
+	for name := range b.stores {
+		if report := b.health[name].Report; report != nil {
+			rates[name] = report.OpsPerSecond
+			total += report.OpsPerSecond
+		}
+	}
+	if len(rates) < 2 {
+		return nil, false
+	}
+	busy := make(map[string]bool)
+	average := total / float64(len(rates))
+	for name, rate := range rates {
+		if rate > 0 && rate > factor*average {
+			busy[name] = true
+		}
+	}
+	return busy, true
+}
+
+// revertHotCopies stops reading the copies of keys, or of every copied key
+// if keys is nil, and drops them from their stores.
+func (b *Broker) revertHotCopies(ctx context.Context, keys []string) {
+	b.mu.Lock()
+	if keys == nil {
+		keys = slices.Collect(maps.Keys(b.hotCopies))
+	}
+	dropped := make(map[string]*hotCopy, len(keys))
+	for _, key := range keys {
+		if c := b.hotCopies[key]; c != nil {
+			dropped[key] = c
+			delete(b.hotCopies, key)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, key := range slices.Sorted(maps.Keys(dropped)) {
+		c := dropped[key]
+		b.dropCopiesFrom(ctx, key, c.stores, nil)
+		if c.ready {
+			b.logger.Info("hot key copies dropped", "key_hash", logging.KeyHash(key), "holder", c.holder)
+			b.recordEvent(ClusterEvent{Type: EventHotKeyReverted, Store: c.holder, Details: fmt.Sprintf("copies of key %s dropped from %s", logging.KeyHash(key), strings.Join(c.stores, ", "))})
+		}
+	}
+}
+
+// dropCopiesFrom drops the copies of key from the stores of from not in
+// keep. The copies expire anyway, so failures are only logged.
+func (b *Broker) dropCopiesFrom(ctx context.Context, key string, from, keep []string) {
+	for _, name := range from {
+		if slices.Contains(keep, name) {
+			continue
+		}
+		store, err := b.GetStore(name)
+		if err != nil {
+			continue
+		}
+		if err := b.putHotCopies(ctx, store.Address(), kvstore.HotCopiesRequest{Drop: []string{key}}); err != nil {
+			b.logger.Warn("failed to drop hot key copy", "store", name, "key_hash", logging.KeyHash(key), "err", err)
+		}
+	}
+}
+
+// putHotCopies sends the store at addr copies to keep and drop.
+func (b *Broker) putHotCopies(ctx context.Context, addr string, req kvstore.HotCopiesRequest) error {
+	resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/hot-copies", req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hot-copies returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
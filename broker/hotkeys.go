@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// ClusterHotKey is one of the keys accessed most often on the store holding
+// it. Share is its part of that store's accesses, ClusterShare of every
+// store's.
+type ClusterHotKey struct {
+	kvstore.HotKey
+	Store        string  `json:"store"`
+	ClusterShare float64 `json:"cluster_share"`
+}
+
+// StoreAccesses is how often a store was accessed recently, as counted with
+// its hot keys.
+type StoreAccesses struct {
+	Total uint64 `json:"total"`
+	// Share is the store's part of every store's accesses.
+	Share float64 `json:"share"`
+	Error string  `json:"error,omitempty"`
+}
+
+// HotKeysReport is the response of GET /hotkeys.
+type HotKeysReport struct {
+	// HalfLife is how often the stores halve their counts.
+	HalfLife kvstore.Duration         `json:"half_life"`
+	Keys     []ClusterHotKey          `json:"keys"`
+	Stores   map[string]StoreAccesses `json:"stores"`
+	// Copies are the hot keys whose reads are spread over copies.
+	Copies []HotCopy `json:"copies"`
+}
+
+// HotKeys asks every store for its most accessed keys and reports the limit
+// most accessed across the cluster, with each store's part of the accesses,
+// so a store loaded by a few hot keys stands out. Counts are approximate
+// and may only be too high. Stores that cannot be reached are reported with
+// an error.
+func (b *Broker) HotKeys(ctx context.Context, limit int) HotKeysReport {
+	b.mu.RLock()
+	targets := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		targets[name] = store.Address()
+	}
+	b.mu.RUnlock()
+
+	report := HotKeysReport{Keys: make([]ClusterHotKey, 0), Stores: make(map[string]StoreAccesses, len(targets)), Copies: b.HotCopies()}
+	var total uint64
+	for name, addr := range targets {
+		hot, err := b.fetchHotKeys(ctx, addr, limit)
+		if err != nil {
+			report.Stores[name] = StoreAccesses{Error: err.Error()}
+			continue
+		}
+		report.HalfLife = hot.HalfLife
+		report.Stores[name] = StoreAccesses{Total: hot.Total}
+		total += hot.Total
+		for _, key := range hot.Keys {
+			report.Keys = append(report.Keys, ClusterHotKey{HotKey: key, Store: name})
+		}
+	}
+
+	sort.Slice(report.Keys, func(i, j int) bool {
+		a, b := report.Keys[i], report.Keys[j]
+		return a.Count > b.Count || a.Count == b.Count && a.Key < b.Key
+	})
+	if len(report.Keys) > limit {
+		report.Keys = report.Keys[:limit]
+	}
+	if total > 0 {
+		for i := range report.Keys {
+			report.Keys[i].ClusterShare = min(float64(report.Keys[i].Count)/float64(total), 1)
+		}
+		for name, s := range report.Stores {
+			if s.Error == "" {
+				s.Share = float64(s.Total) / float64(total)
+				report.Stores[name] = s
+			}
+		}
+	}
+	return report
+}
+
+// fetchHotKeys asks a store for its limit most accessed keys.
+func (b *Broker) fetchHotKeys(ctx context.Context, addr string, limit int) (kvstore.HotKeysReport, error) {
+	var hot kvstore.HotKeysReport
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/hotkeys?limit="+strconv.Itoa(limit), nil)
+	if err != nil {
+		return hot, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return hot, fmt.Errorf("hotkeys returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&hot); err != nil {
+		return hot, fmt.Errorf("error decoding hotkeys: %w", err)
+	}
+	return hot, nil
+}
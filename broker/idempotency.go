@@ -0,0 +1,148 @@
+package broker
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader carries a client-chosen key identifying a write. A
+// retried write with the same key gets the recorded response instead of
+// being applied again.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultIdempotencyTTL is how long responses to keyed writes are remembered.
+const DefaultIdempotencyTTL = 10 * time.Minute
+
+// recordedResponse is the outcome of a keyed write. done is closed once the
+// first request has finished; duplicates arriving earlier wait for it.
+type recordedResponse struct {
+	done        chan struct{}
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyCache remembers the responses to writes carrying an idempotency key.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*recordedResponse
+	lastPrune time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:       ttl,
+		entries:   make(map[string]*recordedResponse),
+		lastPrune: time.Now(),
+	}
+}
+
+// begin returns the entry for key and whether the caller is the first to use
+// it and must run the request.
+func (c *idempotencyCache) begin(key string) (*recordedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPrune) > c.ttl {
+		for k, e := range c.entries {
+			if !e.expires.IsZero() && now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if e, ok := c.entries[key]; ok && (e.expires.IsZero() || now.Before(e.expires)) {
+		return e, false
+	}
+	e := &recordedResponse{done: make(chan struct{})}
+	c.entries[key] = e
+	return e, true
+}
+
+// finish records the outcome of key's request. Server errors are forgotten so
+// a retry runs the write again.
+func (c *idempotencyCache) finish(key string, e *recordedResponse, rec *responseRecorder) {
+	c.mu.Lock()
+	if rec.status >= http.StatusInternalServerError {
+		delete(c.entries, key)
+	} else {
+		e.status = rec.status
+		e.contentType = rec.Header().Get("Content-Type")
+		e.body = rec.body.Bytes()
+		e.expires = time.Now().Add(c.ttl)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// responseRecorder passes a response through while keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent wraps a write handler so requests carrying an Idempotency-Key
+// header are applied at most once per key; repeats get the first response.
+func (h *BrokerHandler) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		key = r.URL.Path + " " + key
+		if t := tenantFrom(r.Context()); t != nil {
+			// Tenants may pick the same keys
+			key = t.Name + " " + key
+		}
+
+		for {
+			e, first := h.idempotency.begin(key)
+			if first {
+				rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+				defer func() { h.idempotency.finish(key, e, rec) }()
+				next(rec, r)
+				return
+			}
+
+			select {
+			case <-e.done:
+			case <-r.Context().Done():
+				return
+			}
+			if e.status == 0 {
+				// The first attempt failed and was forgotten; run this one
+				continue
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			if e.contentType != "" {
+				w.Header().Set("Content-Type", e.contentType)
+			}
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"kv/schedule"
+	"net/http"
+	"time"
+)
+
+// Kinds of recurring jobs the broker runs on a schedule.
+const (
+	// JobBackup has every store save a snapshot and back up the stores it
+	// holds backups of.
+	JobBackup = "backup"
+	// JobRebalance measures how evenly the keys are spread and starts
+	// splitting a store grown past the split size.
+	JobRebalance = "rebalance"
+	// JobSnapshotCleanup has every store remove the backups it still holds
+	// of stores it no longer backs up, once they are older than MaxAge.
+	JobSnapshotCleanup = "snapshot-cleanup"
+)
+
+// What started a job run, and how it ended.
+const (
+	JobTriggerSchedule = "schedule"
+	JobTriggerManual   = "manual"
+
+	JobOK      = "ok"
+	JobFailed  = "failed"
+	JobSkipped = "skipped" // the previous run had not finished
+)
+
+// jobHistory is the number of job runs the broker keeps.
+const jobHistory = 100
+
+// DefaultStaleBackupAge is how old a backup of a store no longer backed up
+// must be for a snapshot-cleanup job to remove it, unless the job says.
+const DefaultStaleBackupAge = 24 * time.Hour
+
+var (
+	// ErrJobNotFound is returned when running a job that is not configured.
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobRunning is returned when running a job whose previous run has
+	// not finished.
+	ErrJobRunning = errors.New("job is already running")
+)
+
+// JobConfig is a recurring job.
+type JobConfig struct {
+	Name string `json:"name"`
+	// Kind is JobBackup, JobRebalance or JobSnapshotCleanup.
+	Kind string `json:"kind"`
+	// Schedule is when the job runs, e.g. "0 2 * * *", "@hourly" or
+	// "@every 15m"; see schedule.Parse.
+	Schedule string `json:"schedule"`
+	// MaxAge is, for JobSnapshotCleanup, how old a stale backup must be to
+	// be removed (default DefaultStaleBackupAge).
+	MaxAge kvstore.Duration `json:"max_age,omitempty"`
+}
+
+// Validate reports every problem with the job at once.
+func (j JobConfig) Validate() error {
+	var errs []error
+	if j.Name == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	switch j.Kind {
+	case JobBackup, JobRebalance, JobSnapshotCleanup:
+	default:
+		errs = append(errs, fmt.Errorf("kind %q is not one of %q, %q or %q", j.Kind, JobBackup, JobRebalance, JobSnapshotCleanup))
+	}
+	if _, err := schedule.Parse(j.Schedule); err != nil {
+		errs = append(errs, fmt.Errorf("schedule: %w", err))
+	}
+	if j.MaxAge < 0 {
+		errs = append(errs, errors.New("max_age must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// JobRun is one run of a job.
+type JobRun struct {
+	Job      string    `json:"job"`
+	Kind     string    `json:"kind"`
+	Trigger  string    `json:"trigger"` // schedule or manual
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Result   string    `json:"result"` // ok, failed or skipped
+	// Detail summarizes what the run did, e.g. the stores it backed up.
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// JobStatus is a configured job, when it runs next and how its last run went.
+type JobStatus struct {
+	JobConfig
+	Next    time.Time `json:"next"`
+	Running bool      `json:"running"`
+	LastRun *JobRun   `json:"last_run,omitempty"`
+}
+
+// JobsReport is the response of GET /jobs.
+type JobsReport struct {
+	Jobs []JobStatus `json:"jobs"`
+	// History holds the most recent runs of every job, oldest first.
+	History []JobRun `json:"history"`
+}
+
+// scheduledJob is a configured job and its schedule.
+type scheduledJob struct {
+	cfg      JobConfig
+	schedule schedule.Schedule
+	next     time.Time
+	running  bool
+	last     *JobRun
+}
+
+// SetJobs replaces the recurring jobs, which must be valid, and starts the
+// loop running them; with no jobs the loop is stopped. A job keeps its last
+// run across the change.
+func (b *Broker) SetJobs(jobs []JobConfig) {
+	now := time.Now()
+	b.mu.Lock()
+	previous := make(map[string]*scheduledJob, len(b.jobs))
+	for _, job := range b.jobs {
+		previous[job.cfg.Name] = job
+	}
+	b.jobs = nil
+	for _, cfg := range jobs {
+		sched, err := schedule.Parse(cfg.Schedule)
+		if err != nil {
+			b.logger.Error("invalid job schedule", "job", cfg.Name, "schedule", cfg.Schedule, "err", err)
+			continue
+		}
+		job := &scheduledJob{cfg: cfg, schedule: sched, next: sched.Next(now)}
+		if prev := previous[cfg.Name]; prev != nil {
+			job.last = prev.last
+		}
+		b.jobs = append(b.jobs, job)
+	}
+	empty := len(b.jobs) == 0
+	b.mu.Unlock()
+
+	if empty {
+		b.tasks.Stop("jobs")
+		return
+	}
+	b.tasks.Start("jobs", b.runJobs)
+}
+
+// runJobs starts every job when it is due, until ctx is cancelled. A job
+// still running when it is due again is skipped, and the skip recorded.
+func (b *Broker) runJobs(ctx context.Context) {
+	for {
+		b.mu.RLock()
+		var due time.Time
+		for _, job := range b.jobs {
+			if !job.next.IsZero() && (due.IsZero() || job.next.Before(due)) {
+				due = job.next
+			}
+		}
+		b.mu.RUnlock()
+		if due.IsZero() {
+			return
+		}
+
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		var ready []*scheduledJob
+		b.mu.Lock()
+		for _, job := range b.jobs {
+			if !job.next.IsZero() && !job.next.After(now) {
+				job.next = job.schedule.Next(now)
+				ready = append(ready, job)
+			}
+		}
+		b.mu.Unlock()
+		for _, job := range ready {
+			b.tasks.Go(func(ctx context.Context) {
+				if _, err := b.runJob(ctx, job, JobTriggerSchedule); errors.Is(err, ErrJobRunning) {
+					b.logger.Warn("job skipped, its previous run has not finished", "job", job.cfg.Name)
+					b.recordJobRun(job, JobRun{Job: job.cfg.Name, Kind: job.cfg.Kind, Trigger: JobTriggerSchedule,
+						Started: now, Finished: now, Result: JobSkipped, Detail: "the previous run had not finished"})
+				}
+			})
+		}
+	}
+}
+
+// RunJob runs the named job now, whatever its schedule, and returns the run.
+func (b *Broker) RunJob(ctx context.Context, name string) (JobRun, error) {
+	b.mu.RLock()
+	var job *scheduledJob
+	for _, j := range b.jobs {
+		if j.cfg.Name == name {
+			job = j
+		}
+	}
+	b.mu.RUnlock()
+	if job == nil {
+		return JobRun{}, ErrJobNotFound
+	}
+	return b.runJob(ctx, job, JobTriggerManual)
+}
+
+// runJob runs job and records the run, unless the job is already running.
+func (b *Broker) runJob(ctx context.Context, job *scheduledJob, trigger string) (JobRun, error) {
+	b.mu.Lock()
+	if job.running {
+		b.mu.Unlock()
+		return JobRun{}, ErrJobRunning
+	}
+	job.running = true
+	b.mu.Unlock()
+
+	run := JobRun{Job: job.cfg.Name, Kind: job.cfg.Kind, Trigger: trigger, Started: time.Now()}
+	b.logger.Info("job started", "job", run.Job, "kind", run.Kind, "trigger", trigger)
+	detail, err := b.doJob(ctx, job.cfg)
+	run.Finished, run.Detail, run.Result = time.Now(), detail, JobOK
+	if err != nil {
+		run.Result, run.Error = JobFailed, err.Error()
+		b.logger.Error("job failed", "job", run.Job, "kind", run.Kind, "duration", run.Finished.Sub(run.Started), "err", err)
+	} else {
+		b.logger.Info("job finished", "job", run.Job, "kind", run.Kind, "duration", run.Finished.Sub(run.Started), "detail", detail)
+	}
+
+	b.mu.Lock()
+	job.running = false
+	b.mu.Unlock()
+	b.recordJobRun(job, run)
+	return run, nil
+}
+
+// recordJobRun adds a run to the history, dropping the oldest beyond
+// jobHistory.
+func (b *Broker) recordJobRun(job *scheduledJob, run JobRun) {
+	b.jobRuns.Inc(run.Job, run.Result)
+	details := run.Kind + " " + run.Result
+	if run.Error != "" {
+		details += ": " + run.Error
+	} else if run.Detail != "" {
+		details += ": " + run.Detail
+	}
+	b.recordEvent(ClusterEvent{Type: EventJob, Store: run.Job, Details: details})
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	job.last = &run
+	b.jobHistory = append(b.jobHistory, run)
+	if len(b.jobHistory) > jobHistory {
+		b.jobHistory = b.jobHistory[len(b.jobHistory)-jobHistory:]
+	}
+}
+
+// doJob does the work of a job and describes what it did.
+func (b *Broker) doJob(ctx context.Context, cfg JobConfig) (string, error) {
+	switch cfg.Kind {
+	case JobBackup:
+		return b.backupJob(ctx)
+	case JobRebalance:
+		return b.rebalanceJob(ctx)
+	case JobSnapshotCleanup:
+		maxAge := time.Duration(cfg.MaxAge)
+		if maxAge == 0 {
+			maxAge = DefaultStaleBackupAge
+		}
+		return b.snapshotCleanupJob(ctx, maxAge)
+	}
+	return "", fmt.Errorf("unknown job kind %q", cfg.Kind)
+}
+
+// backupJob has every store save a snapshot and then back up its peers.
+func (b *Broker) backupJob(ctx context.Context) (string, error) {
+	var errs []error
+	stores := b.storeList()
+	done := 0
+	for _, store := range stores {
+		err := b.saveStore(ctx, store.Address())
+		if err == nil {
+			err = b.backUpNow(ctx, store.Address())
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", store.Name(), err))
+			continue
+		}
+		done++
+	}
+	return fmt.Sprintf("%d of %d stores saved and backed up", done, len(stores)), errors.Join(errs...)
+}
+
+// saveStore asks the store at addr to save a snapshot now.
+func (b *Broker) saveStore(ctx context.Context, addr string) error {
+	resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/save", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("save returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// rebalanceJob reports the key skew and starts splitting a store over the
+// split size, as the health checks also do.
+func (b *Broker) rebalanceJob(ctx context.Context) (string, error) {
+	report := b.KeyDistribution(ctx)
+	var errs []error
+	for name, dist := range report.Stores {
+		if dist.Error != "" {
+			errs = append(errs, fmt.Errorf("%s: %s", name, dist.Error))
+		}
+	}
+	b.splitOversized()
+	b.mu.RLock()
+	resizing := b.resizing
+	b.mu.RUnlock()
+	detail := fmt.Sprintf("max key skew %.2f over %d stores", report.MaxKeySkew, len(report.Stores))
+	if resizing {
+		detail += "; a split or merge is running"
+	}
+	return detail, errors.Join(errs...)
+}
+
+// snapshotCleanupJob has every store remove the stale backups it holds.
+func (b *Broker) snapshotCleanupJob(ctx context.Context, maxAge time.Duration) (string, error) {
+	var errs []error
+	pruned := 0
+	for _, store := range b.storeList() {
+		n, err := b.prunePeerBackups(ctx, store.Address(), maxAge)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", store.Name(), err))
+		}
+		pruned += n
+	}
+	return fmt.Sprintf("%d stale backups removed", pruned), errors.Join(errs...)
+}
+
+// prunePeerBackups asks the store at addr to remove the backups older than
+// maxAge of stores it no longer backs up, and returns how many it removed.
+func (b *Broker) prunePeerBackups(ctx context.Context, addr string, maxAge time.Duration) (int, error) {
+	resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/prune-peer-backups", kvstore.PrunePeerBackupsRequest{MaxAge: kvstore.Duration(maxAge)})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("prune-peer-backups returned status: %d", resp.StatusCode)
+	}
+	var result struct {
+		Pruned []string `json:"pruned"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return len(result.Pruned), nil
+}
+
+// Jobs reports the configured jobs and their most recent runs.
+func (b *Broker) Jobs() JobsReport {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	report := JobsReport{Jobs: make([]JobStatus, 0, len(b.jobs)), History: append([]JobRun{}, b.jobHistory...)}
+	for _, job := range b.jobs {
+		status := JobStatus{JobConfig: job.cfg, Next: job.next, Running: job.running}
+		if job.last != nil {
+			last := *job.last
+			status.LastRun = &last
+		}
+		report.Jobs = append(report.Jobs, status)
+	}
+	return report
+}
@@ -0,0 +1,355 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"kv/logging"
+	"net/http"
+	"time"
+)
+
+// membershipCallTimeout bounds each call a membership change makes to a
+// store, so one that hangs cannot hold up the changes queued behind it.
+const membershipCallTimeout = 10 * time.Second
+
+// ErrClosed is returned for a membership change asked of a closed broker.
+var ErrClosed = errors.New("broker is closed")
+
+// Locking: b.mu guards the broker's routing state (stores, loads, health,
+// draining, removed and the peer ring) and is only ever held while reading or
+// updating it, never across a call to a store. Request paths copy what they
+// need under the lock and talk to stores without it.
+//
+// Membership changes (a store joining, being removed or failed over) are
+// applied one at a time by a single management goroutine, so their peer
+// notifications reach the stores in the order the changes were made.
+
+// manageMembership runs the membership changes sent to b.membership, in order.
+func (b *Broker) manageMembership(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-b.membership:
+			change()
+		}
+	}
+}
+
+// changeMembership runs change on the management goroutine and waits for it
+// to finish. change must not call changeMembership itself. It returns
+// ErrClosed once the broker is closed.
+func (b *Broker) changeMembership(change func() error) error {
+	done := make(chan error, 1)
+	select {
+	case b.membership <- func() { done <- change() }:
+	case <-b.tasks.Done():
+		return ErrClosed
+	}
+	return <-done
+}
+
+// StartPeering tells every store which store it backs up.
+func (b *Broker) StartPeering() error {
+	return b.changeMembership(func() error {
+		b.notifyPeers()
+		return nil
+	})
+}
+
+// notifyPeers sends the current peer ring to the stores. It runs on the
+// management goroutine.
+func (b *Broker) notifyPeers() {
+	b.mu.RLock()
+	assignments := BackupAssignments(b.peerlist, b.backups())
+	t := b.transport
+	b.mu.RUnlock()
+	notifyPeers(assignments, t)
+}
+
+// backups is the number of stores every store backs up. b.mu must be held.
+func (b *Broker) backups() int {
+	return max(b.config.ReplicationFactor-1, 1)
+}
+
+// GetStorePeerIP returns the address and name of the store that backs up the
+// named store, its ring predecessor.
+func (b *Broker) GetStorePeerIP(storeName string) (string, string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.peerOf(storeName)
+}
+
+// peerOf is GetStorePeerIP for callers holding b.mu.
+func (b *Broker) peerOf(storeName string) (string, string, error) {
+	if _, exists := b.stores[storeName]; !exists {
+		return "", "", ErrStoreNotFound
+	}
+	if b.peerlist.Head == nil {
+		return "", "", errors.New("peer list is empty")
+	}
+	prev, _ := b.peerlist.Neighbors(storeName)
+	if prev == nil {
+		return "", "", errors.New("peer not found")
+	}
+	return prev.IpAddress, prev.Name, nil
+}
+
+func (b *Broker) CreateStore(name string, ip_address string) error {
+	return b.createStore(name, ip_address, false)
+}
+
+// createStore is CreateStore for a store that may still be warming up, in
+// which case it is neither read from nor given new keys until it is warm.
+func (b *Broker) createStore(name string, ip_address string, warming bool) error {
+	b.logger.Info("attempting to create store", "store", name, "address", ip_address)
+	return b.changeMembership(func() error {
+		b.mu.Lock()
+		if store, exists := b.stores[name]; exists {
+			if old := store.Address(); old != ip_address {
+				down := b.health[name].Status == StatusDown
+				b.mu.Unlock()
+				if !down {
+					// A store restarted on another port, e.g. one listening
+					// on port 0, before a health check noticed it was gone
+					_, err := b.probeStore(context.Background(), old)
+					down = err != nil
+				}
+				if !down {
+					b.logger.Warn("store already exists, skipping creation", "store", name)
+					return ErrStoreExists
+				}
+				b.mu.Lock()
+				b.logger.Info("store moved", "store", name, "from", old, "to", ip_address)
+				b.stores[name] = b.newStore(name, ip_address)
+				b.peerlist.SetAddress(name, ip_address)
+				b.recordProbe(name, nil)
+			}
+			b.setWarming(name, warming)
+			b.dropFilter(name)
+			b.mu.Unlock()
+			// A configured store registering itself, or a restarted one
+			// that needs to be told its peer again
+			b.logger.Info("store re-registered", "store", name, "address", ip_address)
+			b.recordEvent(ClusterEvent{Type: EventStoreRegistered, Store: name, Details: "registered again at " + ip_address})
+			b.notifyPeers()
+			return nil
+		}
+
+		if _, exists := b.replicas[name]; exists {
+			b.mu.Unlock()
+			b.logger.Warn("name is taken by a read replica, skipping creation", "store", name)
+			return ErrStoreExists
+		}
+
+		if ip_address == "" {
+			b.mu.Unlock()
+			b.logger.Error("empty IP address for store", "store", name)
+			return errors.New("invalid IP address")
+		}
+
+		// Add to stores and peerlist
+		b.logger.Info("registering new store", "store", name, "address", ip_address)
+		delete(b.removed, name)
+		b.stores[name] = b.newStore(name, ip_address)
+		b.setWarming(name, warming)
+		b.loads[name] = 0
+		b.health[name] = StoreHealth{Status: StatusUp, LastChecked: time.Now()}
+		b.storeUp.Set(1, name)
+		b.storeLoad.Set(0, name)
+
+		b.logger.Debug("adding to peer list", "store", name, "address", ip_address)
+		b.peerlist.AddNode(name, ip_address)
+
+		// Debug: Print current list of stores
+		for storeName, store := range b.stores {
+			b.logger.Debug("current store", "store", storeName, "address", store.Address())
+		}
+		b.mu.Unlock()
+
+		b.recordEvent(ClusterEvent{Type: EventStoreRegistered, Store: name, Details: "at " + ip_address})
+
+		// Notify existing stores about the new store
+		b.logger.Info("notifying peers about the new store", "store", name)
+		b.notifyPeers()
+		return nil
+	})
+}
+
+func (b *Broker) RemoveStore(name string) error {
+	if addr, ok := b.removeReplica(name); ok {
+		b.logger.Info("read replica removed", "replica", name)
+		b.recordEvent(ClusterEvent{Type: EventStoreRemoved, Store: name, Details: "read replica"})
+		b.shutdownStore(name, addr)
+		return nil
+	}
+
+	var addr string
+	err := b.changeMembership(func() error {
+		b.mu.Lock()
+		store, exists := b.stores[name]
+		if !exists {
+			b.mu.Unlock()
+			return ErrStoreNotFound
+		}
+		addr = store.Address()
+
+		delete(b.stores, name)
+		delete(b.loads, name)
+		delete(b.health, name)
+		delete(b.draining, name)
+		delete(b.warming, name)
+		delete(b.filters, name)
+		delete(b.pendingDeletes, name)
+		// b.snapshots is kept, so the schedule is applied again if the
+		// store comes back, e.g. after a restart
+		b.removed[name] = true
+		b.peerlist.RemoveNode(name)
+		b.storeUp.Delete(name)
+		b.storeLoad.Delete(name)
+		b.mu.Unlock()
+		b.recordEvent(ClusterEvent{Type: EventStoreRemoved, Store: name})
+
+		// Notify remaining stores about the removal
+		b.notifyPeers()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.shutdownStore(name, addr)
+	return nil
+}
+
+// shutdownStore asks a removed store to save a final snapshot and stop.
+func (b *Broker) shutdownStore(name, addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), membershipCallTimeout)
+	defer cancel()
+	resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/shutdown", nil)
+	if err != nil {
+		b.logger.Error("error sending shutdown request", "store", name, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b.logger.Warn("shutdown request rejected", "store", name, "status", resp.StatusCode)
+	}
+}
+
+// failover takes a store that could not be reached out of the cluster and
+// has its peer serve the backup of its data. Requests that find the same
+// store unreachable at the same time fail it over once.
+func (b *Broker) failover(ctx context.Context, store StoreClient, cause error) {
+	logger := logging.FromContext(ctx, b.logger)
+	b.changeMembership(func() error {
+		b.mu.Lock()
+		if current, exists := b.stores[store.Name()]; !exists || current.Address() != store.Address() {
+			b.mu.Unlock()
+			return nil // already failed over, or removed
+		}
+		//Ediz, I could not find the ip of its peer. Le it be ip_peer;
+		ip_peer, name_peer, peerErr := b.peerOf(store.Name())
+		holders := b.peerlist.Holders(store.Name(), b.backups())
+		report := &FailoverReport{Store: store.Name(), Address: store.Address(), Time: time.Now(), ExpectedKeys: -1}
+		if keys := b.health[store.Name()].Keys; keys != nil {
+			report.ExpectedKeys = *keys
+		}
+		delete(b.stores, store.Name())
+		delete(b.loads, store.Name())
+		delete(b.health, store.Name())
+		delete(b.warming, store.Name())
+		delete(b.filters, store.Name())
+		delete(b.pendingDeletes, store.Name())
+		b.peerlist.RemoveNode(store.Name())
+		b.storeUp.Set(0, store.Name())
+		b.storeLoad.Delete(store.Name())
+		alerter := b.alerter
+		b.mu.Unlock()
+
+		callCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), membershipCallTimeout)
+		defer cancel()
+		if peerErr != nil {
+			logger.Error("error getting peer ip", "store", store.Name(), "err", peerErr)
+		} else if len(holders) > 1 {
+			// The predecessor may have failed too, or hold an older backup
+			ip_peer, name_peer = b.newestHolder(callCtx, holders, store.Address(), ip_peer, name_peer)
+		}
+		logger.Warn("failing over to peer", "store", store.Name(), "peer", name_peer)
+		alerter.Fire(Alert{Event: AlertFailover, Store: store.Name(), Peer: name_peer, Details: cause.Error()})
+		b.recordEvent(ClusterEvent{Type: EventFailover, Store: store.Name(), Peer: name_peer, Details: cause.Error()})
+		if peerErr == nil {
+			// The peer loads the backup before the ring is re-formed around it
+			report.Survivor = name_peer
+			b.recordFailover(report)
+			b.forgetFilter(name_peer)
+			backup, err := b.takeOver(callCtx, ip_peer, store)
+			if err != nil {
+				b.failedTakeOver(report, err)
+			} else {
+				b.verifyFailover(report, backup)
+				// Rebalancing and re-replication run after the ring is
+				// re-formed, without holding up the request that failed
+				defer b.tasks.Go(func(context.Context) {
+					b.changeMembership(func() error {
+						b.finishFailover(report, store.Address())
+						return nil
+					})
+				})
+			}
+		}
+		b.notifyPeers()
+		return nil
+	})
+}
+
+// newestHolder asks the stores holding a backup of the store at addr which
+// of them has the newest, and returns its address and name. If none answers
+// with one, it returns fallbackAddr and fallbackName.
+func (b *Broker) newestHolder(ctx context.Context, holders []*StoreNode, addr, fallbackAddr, fallbackName string) (string, string) {
+	var newest time.Time
+	for _, holder := range holders {
+		resp, err := b.storeRequest(ctx, http.MethodGet, holder.IpAddress, "/peer-backups", nil)
+		if err != nil {
+			b.logger.Warn("backup holder unreachable", "holder", holder.Name, "err", err)
+			continue
+		}
+		var backups []kvstore.PeerBackupMeta
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&backups)
+		}
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		for _, backup := range backups {
+			if backup.Address == addr && backup.Taken.After(newest) {
+				newest, fallbackAddr, fallbackName = backup.Taken, holder.IpAddress, holder.Name
+			}
+		}
+	}
+	return fallbackAddr, fallbackName
+}
+
+// takeOver tells the store at addr to merge the backup it holds of dead and
+// returns what it merged.
+func (b *Broker) takeOver(ctx context.Context, addr string, dead StoreClient) (kvstore.PeerBackupMeta, error) {
+	var result struct {
+		Backup kvstore.PeerBackupMeta `json:"backup"`
+	}
+	req := kvstore.PeerDeadRequest{Name: dead.Name(), Address: dead.Address()}
+	resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/peer-dead", req)
+	if err != nil {
+		return result.Backup, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return result.Backup, fmt.Errorf("peer-dead returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result.Backup, fmt.Errorf("error decoding peer-dead response: %w", err)
+	}
+	return result.Backup, nil
+}
@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// ErrMergeTooLarge is returned when merging two stores would leave one over
+// the split size, to be split again at the next health check.
+var ErrMergeTooLarge = errors.New("the merged store would be over the split size")
+
+// MergeStores moves every key of the named store onto into, or onto the
+// least loaded other store if into is empty, and then removes the store
+// from the cluster, shutting it down. It returns the number of keys moved
+// and the store they went to. It is meant for scaling in when two stores
+// hold few keys; with a split size configured, stores whose keys together
+// exceed it are not merged.
+//
+// While merging the store receives no new keys and reports itself not
+// ready. Keys written to it meanwhile are moved in a further pass. If
+// moving fails or is aborted the store is left registered and takes new
+// keys again, and the merge can be retried. Its progress is reported by Migrations, through
+// which it can be paused, resumed or aborted.
+func (b *Broker) MergeStores(ctx context.Context, name, into string) (moved int, to string, err error) {
+	b.mu.Lock()
+	store, exists := b.stores[name]
+	if !exists {
+		b.mu.Unlock()
+		return 0, "", ErrStoreNotFound
+	}
+	limits, report := b.config.Split, b.health[name].Report
+	if report == nil {
+		limits = nil // its size is not known
+	}
+	var keys int
+	var bytes int64
+	if report != nil {
+		keys, bytes = report.Keys, report.DataBytes
+	}
+	if into == "" {
+		if into = b.resizeTarget(name, limits, keys, bytes); into == "" {
+			b.mu.Unlock()
+			if b.resizeTarget(name, nil, 0, 0) != "" {
+				return 0, "", ErrMergeTooLarge
+			}
+			return 0, "", ErrLastStore
+		}
+	}
+	switch {
+	case b.stores[into] == nil:
+		b.mu.Unlock()
+		return 0, "", fmt.Errorf("target %s: %w", into, ErrStoreNotFound)
+	case into == name || b.draining[into] || b.warming[into]:
+		b.mu.Unlock()
+		return 0, "", fmt.Errorf("target %s cannot take keys: %w", into, ErrNoSplitTarget)
+	case !b.roomFor(into, limits, keys, bytes):
+		b.mu.Unlock()
+		return 0, "", fmt.Errorf("merging %s into %s: %w", name, into, ErrMergeTooLarge)
+	case b.resizing:
+		b.mu.Unlock()
+		return 0, "", ErrResizeRunning
+	}
+	b.resizing = true
+	b.draining[name] = true
+	addr, intoAddr := store.Address(), b.stores[into].Address()
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.resizing = false
+		b.mu.Unlock()
+	}()
+	m := b.startLocalMigration("merge", name, into)
+	defer func() {
+		m.Finish(err)
+		if err != nil {
+			b.stopDraining(ctx, name, addr)
+		}
+	}()
+
+	b.logger.Info("merging store", "store", name, "into", into)
+	if resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/drain", nil); err == nil {
+		resp.Body.Close()
+	}
+
+	for pass := 0; ; pass++ {
+		data, err := b.fetchStoreData(ctx, addr)
+		if err != nil {
+			return moved, into, fmt.Errorf("error reading data from store %s: %w", name, err)
+		}
+		if len(data) == 0 {
+			break
+		}
+		if pass == movePasses {
+			return moved, into, fmt.Errorf("store %s still holds %d keys after %d passes", name, len(data), movePasses)
+		}
+		m.AddKeys(len(data))
+		keys := slices.Sorted(maps.Keys(data))
+		for start := 0; start < len(keys); start += moveBatchSize {
+			if err := m.Wait(ctx); err != nil {
+				return moved, into, err
+			}
+			batch, err := b.moveBatch(ctx, "merge", name, addr, into, intoAddr, keys[start:min(start+moveBatchSize, len(keys))])
+			moved += len(batch)
+			if err != nil {
+				return moved, into, err
+			}
+			m.Moved(batch)
+		}
+	}
+
+	if err := b.RemoveStore(name); err != nil {
+		return moved, into, err
+	}
+	b.mu.RLock()
+	holders := b.holdersOf(into)
+	b.mu.RUnlock()
+	for holder, holderAddr := range holders {
+		if err := b.backUpNow(ctx, holderAddr); err != nil {
+			b.logger.Warn("failed to re-replicate after merge", "store", into, "holder", holder, "err", err)
+		}
+	}
+	b.merges.Inc()
+	b.logger.Info("store merged", "store", name, "into", into, "keys_moved", moved)
+	b.recordEvent(ClusterEvent{Type: EventStoreMerged, Store: name, Peer: into, Details: fmt.Sprintf("%d keys moved", moved)})
+	return moved, into, nil
+}
@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kv/httpapi"
+	"kv/kvstore"
+	"net/http"
+	"sort"
+)
+
+// Migrations: drains, handoffs, splits and merges report their progress and
+// can be paused, resumed and aborted between batches. The broker tracks
+// drains, splits and merges itself; a handoff is run by the store handing
+// off, so the broker asks it.
+
+// ErrNoMigration is returned for a store with no drain, handoff, split or merge to report.
+var ErrNoMigration = errors.New("no drain, handoff, split or merge has run for the store")
+
+// storeMigration is the latest drain, handoff, split or merge of a store.
+type storeMigration struct {
+	local *kvstore.Migration // set for a drain, split or merge, which the broker runs
+	addr  string             // the store handing off, while it runs
+	// final is the outcome of a handoff, kept once it is over
+	final *kvstore.MigrationStatus
+}
+
+// startLocalMigration starts tracking a drain, split or merge of the named store.
+func (b *Broker) startLocalMigration(kind, name, target string) *kvstore.Migration {
+	m := kvstore.NewMigration(kind, name, target)
+	b.mu.Lock()
+	b.migrations[name] = &storeMigration{local: m}
+	b.mu.Unlock()
+	return m
+}
+
+// startHandoffMigration records that the named store at addr is handing off.
+func (b *Broker) startHandoffMigration(name, addr string) {
+	b.mu.Lock()
+	b.migrations[name] = &storeMigration{addr: addr}
+	b.mu.Unlock()
+}
+
+// finishHandoffMigration keeps the outcome of the named store's handoff,
+// read from the store before it is removed.
+func (b *Broker) finishHandoffMigration(ctx context.Context, name, addr string) {
+	status, err := b.storeMigrationStatus(ctx, addr)
+	if err != nil {
+		b.logger.Warn("failed to read handoff progress", "store", name, "err", err)
+		return
+	}
+	b.mu.Lock()
+	if m, ok := b.migrations[name]; ok && m.addr == addr {
+		m.addr, m.final = "", &status
+	}
+	b.mu.Unlock()
+}
+
+// Migrations reports the latest drain, handoff, split or merge of each store, oldest first.
+func (b *Broker) Migrations(ctx context.Context) []kvstore.MigrationStatus {
+	b.mu.RLock()
+	migrations := make(map[string]storeMigration, len(b.migrations))
+	for name, m := range b.migrations {
+		migrations[name] = *m
+	}
+	b.mu.RUnlock()
+
+	result := make([]kvstore.MigrationStatus, 0, len(migrations))
+	for name, m := range migrations {
+		switch {
+		case m.local != nil:
+			result = append(result, m.local.Status())
+		case m.final != nil:
+			result = append(result, *m.final)
+		default:
+			status, err := b.storeMigrationStatus(ctx, m.addr)
+			if err != nil {
+				status = kvstore.MigrationStatus{Kind: "handoff", Store: name, Error: err.Error(), ETASeconds: -1}
+			}
+			result = append(result, status)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].StartedAt.Before(result[j].StartedAt) })
+	return result
+}
+
+// ControlMigration pauses, resumes or aborts the drain, handoff, split or
+// merge of the named store; action is "pause", "resume" or "abort". An
+// aborted drain, handoff or merge leaves the store registered and taking
+// new keys again, as a failed one does, with the keys already moved on the
+// other stores; an aborted split leaves the keys already moved on the
+// target.
+func (b *Broker) ControlMigration(ctx context.Context, name, action string) (kvstore.MigrationStatus, error) {
+	b.mu.RLock()
+	m, ok := b.migrations[name]
+	var current storeMigration
+	if ok {
+		current = *m
+	}
+	b.mu.RUnlock()
+	switch {
+	case !ok:
+		return kvstore.MigrationStatus{}, ErrNoMigration
+	case current.local != nil:
+		err := current.local.Control(action)
+		return current.local.Status(), err
+	case current.final != nil:
+		return *current.final, kvstore.ErrMigrationFinished
+	}
+
+	resp, err := b.storeRequest(ctx, http.MethodPost, current.addr, "/migration/"+action, nil)
+	if err != nil {
+		return kvstore.MigrationStatus{}, fmt.Errorf("error contacting store %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusConflict {
+			return kvstore.MigrationStatus{}, kvstore.ErrMigrationFinished
+		}
+		body, _ := io.ReadAll(resp.Body)
+		failed, _ := httpapi.DecodeProblem(body)
+		return kvstore.MigrationStatus{}, fmt.Errorf("store %s returned status %d: %s", name, resp.StatusCode, failed.Detail)
+	}
+	var status kvstore.MigrationStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, fmt.Errorf("error decoding migration status: %w", err)
+	}
+	return status, nil
+}
+
+// storeMigrationStatus reads the progress of the handoff of the store at addr.
+func (b *Broker) storeMigrationStatus(ctx context.Context, addr string) (kvstore.MigrationStatus, error) {
+	var status kvstore.MigrationStatus
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/migration", nil)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("migration returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, fmt.Errorf("error decoding migration status: %w", err)
+	}
+	return status, nil
+}
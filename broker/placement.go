@@ -0,0 +1,53 @@
+package broker
+
+import "sort"
+
+// leastLoaded returns the candidate with the lowest load, breaking ties by
+// name so placement does not depend on map order. It returns "" when there
+// are no candidates.
+func leastLoaded(loads map[string]int, candidates []string) string {
+	best := ""
+	for _, name := range candidates {
+		if best == "" || loads[name] < loads[best] || loads[name] == loads[best] && name < best {
+			best = name
+		}
+	}
+	return best
+}
+
+// placementLoads returns the loads placement weighs the named stores by.
+// If every one of them has a load report, a store's load is the keys it
+// reported plus the operations routed to it since, so keys placed between
+// two health checks do not all go to the same store. Otherwise it is the
+// operations routed to it. b.mu must be held.
+func (b *Broker) placementLoads(names []string) map[string]int {
+	loads := make(map[string]int, len(names))
+	reported := true
+	for _, name := range names {
+		health := b.health[name]
+		if health.Report == nil {
+			reported = false
+			break
+		}
+		loads[name] = health.Report.Keys + max(b.loads[name]-health.reportLoad, 0)
+	}
+	if !reported {
+		for _, name := range names {
+			loads[name] = b.loads[name]
+		}
+	}
+	return loads
+}
+
+// placementCandidates returns the names of stores that may receive new keys:
+// every store that is not draining, sorted.
+func placementCandidates(stores map[string]string, draining map[string]bool) []string {
+	names := make([]string, 0, len(stores))
+	for name := range stores {
+		if !draining[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
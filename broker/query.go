@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// ErrIndexNotFound is returned when a store lacks the index being queried.
+var ErrIndexNotFound = errors.New("index not found")
+
+// Query returns, in key order, up to limit pairs whose value the named
+// secondary index holds under value, from every store, after cursor. Every
+// store must answer and have the index; a partial answer would silently
+// leave out matches.
+func (b *Broker) Query(ctx context.Context, index, value, cursor string, limit int) (ScanPage, error) {
+	if limit <= 0 {
+		limit = DefaultScanLimit
+	}
+	if limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+
+	b.mu.RLock()
+	targets := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		if !b.warming[name] {
+			targets[name] = store.Address()
+		}
+	}
+	b.mu.RUnlock()
+	b.readFanout.Observe(float64(len(targets)), "query")
+
+	var items []ScanItem
+	more := false
+	for name, addr := range targets {
+		result, err := b.fetchStoreQuery(ctx, addr, index, value, cursor, limit)
+		if err != nil {
+			return ScanPage{}, fmt.Errorf("query of store %s failed: %w", name, err)
+		}
+		more = more || result.More
+		for _, kv := range result.Items {
+			items = append(items, ScanItem{Key: kv.Key, Value: kv.Value, Store: name})
+		}
+	}
+	return mergePage(items, more, limit), nil
+}
+
+func (b *Broker) fetchStoreQuery(ctx context.Context, addr, index, value, after string, limit int) (kvstore.ScanResult, error) {
+	var result kvstore.ScanResult
+	query := url.Values{}
+	query.Set("index", index)
+	query.Set("value", value)
+	query.Set("after", after)
+	query.Set("limit", strconv.Itoa(limit))
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/query?"+query.Encode(), nil)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return result, fmt.Errorf("%w: %s", ErrIndexNotFound, index)
+	default:
+		return result, fmt.Errorf("query returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("error decoding query: %w", err)
+	}
+	return result, nil
+}
+
+// applyIndexes drops the secondary indexes in dropped from the named store
+// and creates the configured ones.
+func (b *Broker) applyIndexes(ctx context.Context, name string, dropped []string) {
+	b.mu.RLock()
+	store, exists := b.stores[name]
+	specs := slices.Clone(b.config.Indexes)
+	b.mu.RUnlock()
+	if !exists {
+		return
+	}
+	for _, index := range dropped {
+		resp, err := b.storeRequest(ctx, http.MethodDelete, store.Address(), "/indexes?name="+url.QueryEscape(index), nil)
+		if err != nil {
+			b.logger.Warn("failed to drop index", "store", name, "index", index, "err", err)
+			continue
+		}
+		resp.Body.Close()
+	}
+	for _, spec := range specs {
+		resp, err := b.storeRequest(ctx, http.MethodPost, store.Address(), "/indexes", spec)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("indexes returned status: %d", resp.StatusCode)
+			}
+		}
+		if err != nil {
+			b.logger.Warn("failed to create index", "store", name, "index", spec.Name, "err", err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+)
+
+var (
+	// ErrNoRecoverySource is returned when recovering a store no other
+	// store backs up.
+	ErrNoRecoverySource = errors.New("no other store holds a backup of the store")
+	// ErrRecovering is returned when recovering a store that already is.
+	ErrRecovering = errors.New("store is already recovering")
+)
+
+// StoreRecovery is the progress of a store recovering its data from the
+// backup its peer holds.
+type StoreRecovery struct {
+	Store string `json:"store"`
+	// Holder is the address of the store holding the backup.
+	Holder string `json:"holder,omitempty"`
+	kvstore.RecoveryStatus
+}
+
+// RecoverStore has the named store replace its data with a full copy of the
+// backup its peer holds, streamed from the peer's /backup endpoint, whether
+// or not the store found its data corrupt: for a store that lost its disk or
+// was restored from an old snapshot. The store answers at once and is routed
+// nothing until the backup is loaded; RecoveryStatus reports its progress.
+// Writes made to the store since the backup was taken are lost.
+func (b *Broker) RecoverStore(ctx context.Context, name string) (StoreRecovery, error) {
+	holder, holderName, err := b.requestRecovery(ctx, name, true)
+	if err != nil {
+		return StoreRecovery{Store: name}, err
+	}
+	b.mu.Lock()
+	if _, exists := b.stores[name]; exists {
+		health := b.health[name]
+		health.Integrity = kvstore.IntegrityRecovering
+		b.health[name] = health
+		b.setWarming(name, true)
+	}
+	b.mu.Unlock()
+	b.logger.Info("store recovering from its peer's backup", "store", name, "holder", holder)
+	b.recordEvent(ClusterEvent{Type: EventStoreRecovering, Store: name, Peer: holderName})
+	return b.RecoveryStatus(ctx, name)
+}
+
+// RecoveryStatus reports the named store's integrity and the progress of
+// the backup it is loading or last loaded.
+func (b *Broker) RecoveryStatus(ctx context.Context, name string) (StoreRecovery, error) {
+	recovery := StoreRecovery{Store: name}
+	store, err := b.GetStore(name)
+	if err != nil {
+		return recovery, err
+	}
+	recovery.Holder, _, _ = b.GetStorePeerIP(name)
+	resp, err := b.storeRequest(ctx, http.MethodGet, store.Address(), "/recover", nil)
+	if err != nil {
+		return recovery, fmt.Errorf("error contacting KVStore %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return recovery, fmt.Errorf("KVStore %s returned status: %d", name, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&recovery.RecoveryStatus); err != nil {
+		return recovery, fmt.Errorf("error decoding recovery status from %s: %w", name, err)
+	}
+	return recovery, nil
+}
+
+// requestRecovery asks the named store to recover from the backup its peer
+// holds, and returns the address and name of that peer. Unless force is set
+// the store only recovers if it found its data corrupt, and with no peer it
+// keeps the empty data it started with.
+func (b *Broker) requestRecovery(ctx context.Context, name string, force bool) (string, string, error) {
+	store, err := b.GetStore(name)
+	if err != nil {
+		return "", "", err
+	}
+	holder, holderName, err := b.GetStorePeerIP(name)
+	if err != nil || holderName == name {
+		if force {
+			return "", "", fmt.Errorf("%w: %s", ErrNoRecoverySource, name)
+		}
+		holder, holderName = "", ""
+	}
+	resp, err := b.storeRequest(ctx, http.MethodPost, store.Address(), "/recover", kvstore.RecoverRequest{Holder: holder, Force: force})
+	if err != nil {
+		return "", "", fmt.Errorf("error contacting KVStore %s: %w", name, err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		return holder, holderName, nil
+	case http.StatusConflict:
+		return "", "", fmt.Errorf("%w: %s", ErrRecovering, name)
+	default:
+		return "", "", fmt.Errorf("KVStore %s returned status: %d", name, resp.StatusCode)
+	}
+}
@@ -0,0 +1,291 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// DefaultReplicaMaxStaleness is how far behind its primary a read replica
+// may be and still serve reads.
+const DefaultReplicaMaxStaleness = 5 * time.Second
+
+// errReplicaStale is returned for a read from a replica that is further
+// behind its primary than the staleness bound allows.
+var errReplicaStale = errors.New("replica is too far behind its primary")
+
+// replica is a store registered as a read replica of a primary. It holds a
+// copy of the primary's data, follows the primary's change feed and serves
+// reads only. Replicas are not in the peer ring and never get new keys.
+type replica struct {
+	name    string
+	addr    string
+	primary string // name of the primary store
+
+	// staleness is the replica's lag as reported by its last probe, or -1
+	// if it is unknown or the replica failed a read since
+	staleness time.Duration
+	probed    time.Time
+	lastError string
+}
+
+// ReplicaInfo describes a read replica.
+type ReplicaInfo struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Primary string `json:"primary"`
+	// StalenessSeconds is how far the replica was behind its primary when
+	// last probed; -1 if unknown.
+	StalenessSeconds float64   `json:"staleness_seconds"`
+	Probed           time.Time `json:"probed"`
+	// Serving is whether the broker currently sends it reads.
+	Serving   bool   `json:"serving"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// AddReplica registers the store name at addr as a read replica of the
+// store at primaryAddr, which must be registered. Registering again, e.g. on
+// a heartbeat, updates the replica.
+func (b *Broker) AddReplica(name, addr, primaryAddr string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.stores[name]; exists {
+		return ErrStoreExists
+	}
+	primary := ""
+	for storeName, store := range b.stores {
+		if store.Address() == primaryAddr {
+			primary = storeName
+		}
+	}
+	if primary == "" {
+		return fmt.Errorf("primary %s is not registered: %w", primaryAddr, ErrStoreNotFound)
+	}
+
+	if r, exists := b.replicas[name]; exists && r.addr == addr && r.primary == primary {
+		return nil
+	}
+	b.logger.Info("registering read replica", "replica", name, "address", addr, "primary", primary)
+	delete(b.removed, name)
+	b.replicas[name] = &replica{name: name, addr: addr, primary: primary, staleness: -1}
+	b.recordEvent(ClusterEvent{Type: EventReplicaRegistered, Store: name, Peer: primary, Details: "at " + addr})
+	return nil
+}
+
+// ReplicaExists reports whether a read replica is registered under name.
+func (b *Broker) ReplicaExists(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, exists := b.replicas[name]
+	return exists
+}
+
+// removeReplica unregisters the named read replica and returns its address,
+// or false if there is no such replica.
+func (b *Broker) removeReplica(name string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, exists := b.replicas[name]
+	if !exists {
+		return "", false
+	}
+	delete(b.replicas, name)
+	b.removed[name] = true
+	b.replicaReads.Delete(name)
+	return r.addr, true
+}
+
+// Replicas describes every registered read replica.
+func (b *Broker) Replicas() []ReplicaInfo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	maxStaleness := b.replicaMaxStaleness()
+	infos := make([]ReplicaInfo, 0, len(b.replicas))
+	for _, r := range b.replicas {
+		info := ReplicaInfo{
+			Name:             r.name,
+			Address:          r.addr,
+			Primary:          r.primary,
+			StalenessSeconds: -1,
+			Probed:           r.probed,
+			Serving:          b.serving(r, maxStaleness),
+			LastError:        r.lastError,
+		}
+		if r.staleness >= 0 {
+			info.StalenessSeconds = r.staleness.Seconds()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// replicaMaxStaleness returns the configured staleness bound. b.mu must be held.
+func (b *Broker) replicaMaxStaleness() time.Duration {
+	if b.config.ReplicaMaxStaleness > 0 {
+		return time.Duration(b.config.ReplicaMaxStaleness)
+	}
+	return DefaultReplicaMaxStaleness
+}
+
+// serving reports whether r is sent reads: its primary is registered and it
+// was within maxStaleness of it when last probed. The replica checks the
+// bound again on every read. b.mu must be held.
+func (b *Broker) serving(r *replica, maxStaleness time.Duration) bool {
+	_, exists := b.stores[r.primary]
+	return exists && r.staleness >= 0 && r.staleness <= maxStaleness
+}
+
+type maxStalenessKey struct{}
+
+// WithMaxStaleness returns a context whose key lookups may be answered by a
+// read replica no more than d behind its primary, in preference to the
+// primary, which answers when no replica is fresh enough. Zero reads from
+// the primary only. Without it, reads rotate between a store and its
+// replicas within the configured replica_max_staleness.
+func WithMaxStaleness(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, maxStalenessKey{}, d)
+}
+
+// maxStaleness returns the bound set with WithMaxStaleness, if any.
+func maxStaleness(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(maxStalenessKey{}).(time.Duration)
+	return d, ok
+}
+
+// readKey reads key from store or, in turn with it, one of its replicas. A
+// replica that cannot answer within the staleness bound is skipped for the
+// store itself. With a bound set by WithMaxStaleness, the replicas within
+// it take turns and the store answers only if there is none. Errors are
+// those of the store.
+func (b *Broker) readKey(ctx context.Context, store StoreClient, key string) (string, string, bool, error) {
+	bound, bounded := maxStaleness(ctx)
+	if bounded && bound <= 0 {
+		b.boundedReads.Inc("primary")
+		return store.Get(ctx, key)
+	}
+	b.mu.RLock()
+	maxStaleness := b.replicaMaxStaleness()
+	if bounded {
+		maxStaleness = bound
+	}
+	var candidates []*replica
+	for _, r := range b.replicas {
+		if r.primary == store.Name() && b.serving(r, maxStaleness) {
+			candidates = append(candidates, r)
+		}
+	}
+	b.mu.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].name < candidates[j].name })
+
+	var r *replica
+	switch {
+	case len(candidates) == 0:
+	case bounded:
+		r = candidates[int(b.readTurn.Add(1)%uint64(len(candidates)))]
+	default:
+		// Slot 0 is the store itself
+		if turn := int(b.readTurn.Add(1) % uint64(len(candidates)+1)); turn > 0 {
+			r = candidates[turn-1]
+		}
+	}
+	if r == nil {
+		if bounded {
+			b.boundedReads.Inc("primary")
+		}
+		return store.Get(ctx, key)
+	}
+
+	value, etag, found, err := b.replicaGet(ctx, r.addr, key, maxStaleness)
+	if err == nil {
+		b.replicaReads.Inc(r.name)
+		if bounded {
+			b.boundedReads.Inc("replica")
+		}
+		return value, etag, found, nil
+	}
+	if !errors.Is(err, errReplicaStale) || !bounded {
+		// Out of rotation until the next probe
+		b.mu.Lock()
+		r.staleness, r.lastError = -1, err.Error()
+		b.mu.Unlock()
+	}
+	if bounded {
+		b.boundedReads.Inc("primary")
+	}
+	return store.Get(ctx, key)
+}
+
+// replicaGet reads key from the replica at addr, which must be no more than
+// maxStaleness behind its primary. The entity tag is the primary's, as
+// replicas take the revisions of the writes they apply.
+func (b *Broker) replicaGet(ctx context.Context, addr, key string, maxStaleness time.Duration) (string, string, bool, error) {
+	header := http.Header{kvstore.MaxStalenessHeader: {maxStaleness.String()}}
+	resp, err := b.storeRequestHeader(ctx, http.MethodGet, addr, "/get?key="+url.QueryEscape(key), nil, header)
+	if err != nil {
+		return "", "", false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", "", false, nil
+	case http.StatusServiceUnavailable:
+		return "", "", false, errReplicaStale
+	default:
+		return "", "", false, fmt.Errorf("replica returned status: %d", resp.StatusCode)
+	}
+
+	var result map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", "", false, fmt.Errorf("error decoding replica response: %w", err)
+	}
+	value, ok := result["value"]
+	return value, resp.Header.Get("ETag"), ok, nil
+}
+
+// checkReplicas asks every replica how far behind its primary it is.
+func (b *Broker) checkReplicas(ctx context.Context) {
+	b.mu.RLock()
+	targets := make(map[*replica]string, len(b.replicas))
+	for _, r := range b.replicas {
+		targets[r] = r.addr
+	}
+	b.mu.RUnlock()
+
+	for r, addr := range targets {
+		status, err := b.probeReplica(ctx, addr)
+		b.mu.Lock()
+		r.probed, r.staleness, r.lastError = time.Now(), -1, status.LastError
+		if err != nil {
+			r.lastError = err.Error()
+		} else if status.StalenessSeconds >= 0 {
+			r.staleness = time.Duration(status.StalenessSeconds * float64(time.Second))
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *Broker) probeReplica(ctx context.Context, addr string) (kvstore.ReplicaStatus, error) {
+	var status kvstore.ReplicaStatus
+	ctx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+	defer cancel()
+
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/replica", nil)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("replica status returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, fmt.Errorf("error decoding replica status: %w", err)
+	}
+	return status, nil
+}
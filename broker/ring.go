@@ -0,0 +1,227 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Node represents a kvstore, this kvstore has the Next's replication
+type StoreNode struct {
+	Name      string
+	IpAddress string
+	Next      *StoreNode
+	Prev      *StoreNode
+}
+
+// LinkedList represents the peer architecture
+type LinkedList struct {
+	Head *StoreNode
+}
+
+// AddNode appends a new node to the circular list
+func (ll *LinkedList) AddNode(name, ipAddress string) {
+	newNode := &StoreNode{Name: name, IpAddress: ipAddress}
+
+	if ll.Head == nil { // If the list is empty
+		ll.Head = newNode
+		newNode.Next = newNode // Points to itself
+		newNode.Prev = newNode
+	} else { // Append to the end
+		tail := ll.Head.Prev // Get the tail node
+		tail.Next = newNode
+		newNode.Prev = tail
+		newNode.Next = ll.Head
+		ll.Head.Prev = newNode
+	}
+}
+
+// RemoveNode removes a node by name
+func (ll *LinkedList) RemoveNode(name string) error {
+	if ll.Head == nil {
+		return fmt.Errorf("list is empty")
+	}
+
+	current := ll.Head
+	for {
+		if current.Name == name {
+			// Update pointers
+			if current.Next == current { // Only one node in the list
+				ll.Head = nil
+			} else {
+				current.Prev.Next = current.Next
+				current.Next.Prev = current.Prev
+				if current == ll.Head { // Removing the head
+					ll.Head = current.Next
+				}
+			}
+			return nil // Node removed
+		}
+
+		current = current.Next
+		if current == ll.Head {
+			break // Completed a full circle
+		}
+	}
+	return fmt.Errorf("node with name %s not found", name)
+}
+
+// Neighbors returns the nodes before and after the named node, or nils if it is not in the list.
+func (ll *LinkedList) Neighbors(name string) (prev, next *StoreNode) {
+	if ll.Head == nil {
+		return nil, nil
+	}
+
+	current := ll.Head
+	for {
+		if current.Name == name {
+			return current.Prev, current.Next
+		}
+		current = current.Next
+		if current == ll.Head {
+			return nil, nil // Completed a full circle
+		}
+	}
+}
+
+// SetAddress changes the address of the named node, keeping its place in the
+// ring, and reports whether it was found.
+func (ll *LinkedList) SetAddress(name, ipAddress string) bool {
+	prev, _ := ll.Neighbors(name)
+	if prev == nil {
+		return false
+	}
+	prev.Next.IpAddress = ipAddress
+	return true
+}
+
+// Len returns the number of nodes in the ring.
+func (ll *LinkedList) Len() int {
+	return len(ll.Names())
+}
+
+// Names returns the node names in ring order, starting at the head.
+func (ll *LinkedList) Names() []string {
+	var names []string
+	if ll.Head == nil {
+		return names
+	}
+	current := ll.Head
+	for {
+		names = append(names, current.Name)
+		current = current.Next
+		if current == ll.Head {
+			return names
+		}
+	}
+}
+
+// Contains reports whether a node with the given name is in the ring.
+func (ll *LinkedList) Contains(name string) bool {
+	prev, _ := ll.Neighbors(name)
+	return prev != nil
+}
+
+// Validate checks the ring's invariants: following Next from the head
+// returns to it, every node's Next points back to it through Prev, and no
+// name appears twice. It returns the first violation found.
+func (ll *LinkedList) Validate() error {
+	if ll.Head == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	seenNodes := make(map[*StoreNode]bool)
+	current := ll.Head
+	for {
+		if current.Next == nil || current.Prev == nil {
+			return fmt.Errorf("node %q has a nil link", current.Name)
+		}
+		if current.Next.Prev != current {
+			return fmt.Errorf("node %q: next %q does not link back", current.Name, current.Next.Name)
+		}
+		if seen[current.Name] {
+			return fmt.Errorf("name %q appears more than once", current.Name)
+		}
+		seen[current.Name] = true
+		seenNodes[current] = true
+
+		current = current.Next
+		if current == ll.Head {
+			break
+		}
+		if seenNodes[current] {
+			return errors.New("ring loops back without passing the head")
+		}
+	}
+
+	// Walking backwards must visit the same number of nodes
+	count := 0
+	current = ll.Head
+	for {
+		count++
+		current = current.Prev
+		if current == ll.Head {
+			break
+		}
+		if count > len(seen) {
+			return errors.New("backward walk does not return to the head")
+		}
+	}
+	if count != len(seen) {
+		return fmt.Errorf("forward walk visits %d nodes, backward walk %d", len(seen), count)
+	}
+	return nil
+}
+
+// PeerAssignment tells the store at Address to back up the store at PeerAddress.
+type PeerAssignment struct {
+	Name        string
+	Address     string
+	PeerName    string
+	PeerAddress string
+}
+
+// PeerAssignments returns, for every node in ring order, the successor it
+// backs up. A node alone in the ring, or with an empty address, gets none.
+func PeerAssignments(ll *LinkedList) []PeerAssignment {
+	return BackupAssignments(ll, 1)
+}
+
+// BackupAssignments returns, for every node in ring order, the next backups
+// nodes it backs up, nearest first, so every node is backed up by the
+// backups nodes before it. Fewer are assigned if the ring is smaller.
+func BackupAssignments(ll *LinkedList, backups int) []PeerAssignment {
+	var assignments []PeerAssignment
+	if ll.Head == nil {
+		return assignments
+	}
+	current := ll.Head
+	for {
+		next := current.Next
+		for peer, i := next, 0; i < backups && peer != current; peer, i = peer.Next, i+1 {
+			if current.IpAddress != "" && peer.IpAddress != "" && current.IpAddress != peer.IpAddress {
+				assignments = append(assignments, PeerAssignment{
+					Name:        current.Name,
+					Address:     current.IpAddress,
+					PeerName:    peer.Name,
+					PeerAddress: peer.IpAddress,
+				})
+			}
+		}
+		current = next
+		if current == ll.Head {
+			return assignments
+		}
+	}
+}
+
+// Holders returns the nodes holding a backup of the named node when every
+// node backs up the next backups nodes: the backups nodes before it, nearest
+// first.
+func (ll *LinkedList) Holders(name string, backups int) []*StoreNode {
+	prev, _ := ll.Neighbors(name)
+	var holders []*StoreNode
+	for i := 0; prev != nil && i < backups && prev.Name != name; prev, i = prev.Prev, i+1 {
+		holders = append(holders, prev)
+	}
+	return holders
+}
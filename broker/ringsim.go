@@ -0,0 +1,183 @@
+package broker
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+)
+
+// RingSimulation counts the events applied by SimulateRing.
+type RingSimulation struct {
+	Steps      int `json:"steps"`
+	Adds       int `json:"adds"`
+	Duplicates int `json:"duplicates"`
+	Removes    int `json:"removes"`
+	Failures   int `json:"failures"`
+	Unknown    int `json:"unknown_removes"`
+	Placements int `json:"placements"`
+	MaxSize    int `json:"max_size"`
+}
+
+// SimulateRing applies steps random membership events (adds, duplicate adds,
+// graceful removals, failures and removals of unknown stores) to a peer ring,
+// checking after each one that the ring is circular in both directions, has
+// unique names, matches a simple reference model in order, and that every
+// store backs up its successor. After a failure the failed store's
+// predecessor must back up its successor. Each step also checks that
+// placement picks the least loaded store that is not draining. The same
+// seed always produces the same events. The first violated invariant is
+// returned as an error.
+func SimulateRing(seed uint64, steps int) (RingSimulation, error) {
+	rng := rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15))
+	ring := &LinkedList{}
+	var model []string // names in ring order, starting at the head
+	addrs := make(map[string]string)
+	stats := RingSimulation{}
+	nextID := 0
+
+	for step := 1; step <= steps; step++ {
+		stats.Steps = step
+		var failed, failedPrev, failedNext string
+
+		switch op := rng.IntN(10); {
+		case op < 4 || len(model) == 0:
+			nextID++
+			name := fmt.Sprintf("store%d", nextID)
+			addrs[name] = fmt.Sprintf("localhost:%d", 8000+nextID)
+			ring.AddNode(name, addrs[name])
+			model = append(model, name)
+			stats.Adds++
+		case op < 5:
+			// Registering a name twice must be refused before it reaches the ring
+			name := model[rng.IntN(len(model))]
+			if !ring.Contains(name) {
+				return stats, fmt.Errorf("step %d: %q missing from ring", step, name)
+			}
+			stats.Duplicates++
+		case op < 7:
+			i := rng.IntN(len(model))
+			if err := ring.RemoveNode(model[i]); err != nil {
+				return stats, fmt.Errorf("step %d: removing %q: %w", step, model[i], err)
+			}
+			model = slices.Delete(model, i, i+1)
+			stats.Removes++
+		case op < 9:
+			i := rng.IntN(len(model))
+			failed = model[i]
+			prev, next := ring.Neighbors(failed)
+			failedPrev, failedNext = prev.Name, next.Name
+			if err := ring.RemoveNode(failed); err != nil {
+				return stats, fmt.Errorf("step %d: failing %q: %w", step, failed, err)
+			}
+			model = slices.Delete(model, i, i+1)
+			stats.Failures++
+		default:
+			if err := ring.RemoveNode("unknown"); err == nil {
+				return stats, fmt.Errorf("step %d: removing an unknown store succeeded", step)
+			}
+			stats.Unknown++
+		}
+		stats.MaxSize = max(stats.MaxSize, len(model))
+
+		if err := checkRing(ring, model); err != nil {
+			return stats, fmt.Errorf("step %d: %w", step, err)
+		}
+		if failed != "" && failed != failedPrev && failedPrev != failedNext {
+			prev, _ := ring.Neighbors(failedNext)
+			if prev == nil || prev.Name != failedPrev {
+				return stats, fmt.Errorf("step %d: after %q failed, %q should back up %q", step, failed, failedPrev, failedNext)
+			}
+		}
+
+		if err := checkPlacement(rng, model, addrs); err != nil {
+			return stats, fmt.Errorf("step %d: %w", step, err)
+		}
+		stats.Placements++
+	}
+	return stats, nil
+}
+
+// checkRing compares the ring against the reference model.
+func checkRing(ring *LinkedList, model []string) error {
+	if err := ring.Validate(); err != nil {
+		return err
+	}
+	if names := ring.Names(); !slices.Equal(names, model) {
+		return fmt.Errorf("ring order %v, want %v", names, model)
+	}
+	for i, name := range model {
+		prev, next := ring.Neighbors(name)
+		wantPrev := model[(i+len(model)-1)%len(model)]
+		wantNext := model[(i+1)%len(model)]
+		if prev == nil || prev.Name != wantPrev || next.Name != wantNext {
+			return fmt.Errorf("neighbors of %q wrong, want %q and %q", name, wantPrev, wantNext)
+		}
+	}
+
+	assignments := PeerAssignments(ring)
+	if len(model) < 2 {
+		if len(assignments) != 0 {
+			return fmt.Errorf("%d peer assignments for %d stores", len(assignments), len(model))
+		}
+		return nil
+	}
+	if len(assignments) != len(model) {
+		return fmt.Errorf("%d peer assignments for %d stores", len(assignments), len(model))
+	}
+	for i, a := range assignments {
+		if a.Name != model[i] || a.PeerName != model[(i+1)%len(model)] {
+			return fmt.Errorf("%q backs up %q, want %q", a.Name, a.PeerName, model[(i+1)%len(model)])
+		}
+	}
+
+	// With two backups each, every store is backed up by the holders the
+	// broker fails it over to
+	backedUpBy := make(map[string][]string)
+	for _, a := range BackupAssignments(ring, 2) {
+		backedUpBy[a.PeerName] = append(backedUpBy[a.PeerName], a.Name)
+	}
+	for _, name := range model {
+		var holders []string
+		for _, node := range ring.Holders(name, 2) {
+			holders = append(holders, node.Name)
+		}
+		slices.Sort(holders)
+		slices.Sort(backedUpBy[name])
+		if want := min(2, len(model)-1); len(holders) != want || !slices.Equal(holders, backedUpBy[name]) {
+			return fmt.Errorf("%q is backed up by %v, holders are %v", name, backedUpBy[name], holders)
+		}
+	}
+	return nil
+}
+
+// checkPlacement gives the stores random loads and draining flags and checks
+// that the chosen store is not draining and has the smallest load.
+func checkPlacement(rng *rand.Rand, model []string, addrs map[string]string) error {
+	stores := make(map[string]string, len(model))
+	loads := make(map[string]int, len(model))
+	draining := make(map[string]bool)
+	for _, name := range model {
+		stores[name] = addrs[name]
+		loads[name] = rng.IntN(5)
+		draining[name] = rng.IntN(4) == 0
+	}
+
+	chosen := leastLoaded(loads, placementCandidates(stores, draining))
+	if chosen == "" {
+		for _, name := range model {
+			if !draining[name] {
+				return fmt.Errorf("no store placed although %q is available", name)
+			}
+		}
+		return nil
+	}
+	if draining[chosen] {
+		return fmt.Errorf("placed on draining store %q", chosen)
+	}
+	for _, name := range model {
+		if !draining[name] && loads[name] < loads[chosen] {
+			return fmt.Errorf("placed on %q with load %d, but %q has %d", chosen, loads[chosen], name, loads[name])
+		}
+	}
+	return nil
+}
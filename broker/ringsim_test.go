@@ -0,0 +1,100 @@
+package broker
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestSimulateRing(t *testing.T) {
+	var total RingSimulation
+	for seed := uint64(1); seed <= 10; seed++ {
+		stats, err := SimulateRing(seed, 2000)
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if stats.Placements != stats.Steps {
+			t.Errorf("seed %d: %d placements checked in %d steps", seed, stats.Placements, stats.Steps)
+		}
+		total.Adds += stats.Adds
+		total.Duplicates += stats.Duplicates
+		total.Removes += stats.Removes
+		total.Failures += stats.Failures
+		total.Unknown += stats.Unknown
+		total.MaxSize = max(total.MaxSize, stats.MaxSize)
+	}
+	if total.Adds == 0 || total.Duplicates == 0 || total.Removes == 0 || total.Failures == 0 || total.Unknown == 0 {
+		t.Errorf("some events never ran: %+v", total)
+	}
+	if total.MaxSize < 3 {
+		t.Errorf("the ring never grew past %d stores", total.MaxSize)
+	}
+}
+
+func TestSimulateRingIsDeterministic(t *testing.T) {
+	a, errA := SimulateRing(42, 2000)
+	b, errB := SimulateRing(42, 2000)
+	if a != b || errA != nil || errB != nil {
+		t.Errorf("same seed gave %+v (%v) and %+v (%v)", a, errA, b, errB)
+	}
+}
+
+// backedUpBy maps every store to the store backing it up.
+func backedUpBy(ring *LinkedList) map[string]string {
+	by := make(map[string]string)
+	for _, a := range PeerAssignments(ring) {
+		by[a.PeerName] = a.Name
+	}
+	return by
+}
+
+func TestRingRemovalMovesOneBackup(t *testing.T) {
+	const n = 10
+	for removed := 1; removed <= n; removed++ {
+		ring := &LinkedList{}
+		for i := 1; i <= n; i++ {
+			ring.AddNode(fmt.Sprintf("store%d", i), fmt.Sprintf("localhost:%d", 8000+i))
+		}
+		name := fmt.Sprintf("store%d", removed)
+		prev, next := ring.Neighbors(name)
+		before := backedUpBy(ring)
+		if err := ring.RemoveNode(name); err != nil {
+			t.Fatal(err)
+		}
+		after := backedUpBy(ring)
+
+		// Only the removed store's successor changes holder, to its predecessor
+		for peer, holder := range after {
+			want := before[peer]
+			if peer == next.Name {
+				want = prev.Name
+			}
+			if holder != want {
+				t.Errorf("removing %s: %s backed up by %s, want %s", name, peer, holder, want)
+			}
+		}
+		if len(after) != n-1 {
+			t.Errorf("removing %s: %d stores backed up, want %d", name, len(after), n-1)
+		}
+	}
+}
+
+func TestPlacementStaysBalanced(t *testing.T) {
+	stores := map[string]string{"a": "localhost:1", "b": "localhost:2", "c": "localhost:3", "d": "localhost:4"}
+	draining := map[string]bool{"d": true}
+	loads := map[string]int{"a": 7, "b": 0, "c": 3, "d": 0}
+	for i := 0; i < 1000; i++ {
+		name := leastLoaded(loads, placementCandidates(stores, draining))
+		if name == "" || draining[name] {
+			t.Fatalf("key %d placed on %q", i, name)
+		}
+		loads[name]++
+	}
+	if loads["d"] != 0 {
+		t.Errorf("draining store got %d keys", loads["d"])
+	}
+	spread := []int{loads["a"], loads["b"], loads["c"]}
+	if slices.Max(spread)-slices.Min(spread) > 1 {
+		t.Errorf("loads %v after 1000 placements, want them within one", spread)
+	}
+}
@@ -0,0 +1,468 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"kv/transport"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// memoryBroker returns a broker routing to n stores over an in-memory
+// transport, and the stores by name.
+func memoryBroker(t *testing.T, n int) (*Broker, *transport.Memory, map[string]*kvstore.KVStore) {
+	t.Helper()
+	mem := transport.NewMemory()
+	b := NewBroker()
+	t.Cleanup(b.Close)
+	b.SetTransport(mem)
+	dir := t.TempDir()
+	stores := make(map[string]*kvstore.KVStore, n)
+	for i := 0; i < n; i++ {
+		s := kvstore.NewKVStore(fmt.Sprintf("store%d", i), fmt.Sprint(9100+i))
+		s.SetDataDir(dir)
+		s.SetTransport(mem)
+		mem.Register(s.IPAddress, kvstore.NewKVStoreHandler(s))
+		if err := b.CreateStore(s.Name, s.IPAddress); err != nil {
+			t.Fatal(err)
+		}
+		stores[s.Name] = s
+	}
+	return b, mem, stores
+}
+
+// holders returns the names of the stores holding key.
+func holders(stores map[string]*kvstore.KVStore, key string) []string {
+	var names []string
+	for name, s := range stores {
+		if _, err := s.Get(key); err == nil {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestSetKeySpreadsNewKeys(t *testing.T) {
+	b, _, stores := memoryBroker(t, 3)
+	ctx := context.Background()
+	for i := 0; i < 30; i++ {
+		if err := b.SetKey(ctx, fmt.Sprintf("k%d", i), fmt.Sprint(i)); err != nil {
+			t.Fatalf("SetKey k%d: %v", i, err)
+		}
+	}
+	for name, s := range stores {
+		if s.Len() == 0 {
+			t.Errorf("%s got none of 30 new keys", name)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if got := holders(stores, key); len(got) != 1 {
+			t.Errorf("%s held by %v, want one store", key, got)
+		}
+		if value, err := b.GetKey(ctx, key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("GetKey %s = %q, %v; want %q", key, value, err, fmt.Sprint(i))
+		}
+	}
+}
+
+func TestSetKeyOverwritesOnStoreHoldingKey(t *testing.T) {
+	b, _, stores := memoryBroker(t, 3)
+	ctx := context.Background()
+	if err := b.SetKey(ctx, "greeting", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	first := holders(stores, "greeting")
+	// Other keys make another store the least loaded
+	for i := 0; i < 10; i++ {
+		if err := b.SetKey(ctx, fmt.Sprintf("k%d", i), "x"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetKey(ctx, "greeting", fmt.Sprintf("v%d", i+2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := holders(stores, "greeting"); !slices.Equal(got, first) {
+		t.Errorf("greeting held by %v after overwrites, want %v only", got, first)
+	}
+	if value, err := b.GetKey(ctx, "greeting"); err != nil || value != "v11" {
+		t.Errorf("GetKey greeting = %q, %v; want v11", value, err)
+	}
+}
+
+func TestSetKeysOverwritesOnStoresHoldingKeys(t *testing.T) {
+	b, _, stores := memoryBroker(t, 3)
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if err := b.SetKey(ctx, fmt.Sprintf("k%d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := make(map[string][]string)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		first[key] = holders(stores, key)
+	}
+
+	pairs := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		pairs[fmt.Sprintf("k%d", i)] = fmt.Sprintf("new%d", i)
+	}
+	if err := b.SetKeys(ctx, pairs); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range first {
+		if got := holders(stores, key); !slices.Equal(got, want) {
+			t.Errorf("%s held by %v after SetKeys, want %v only", key, got, want)
+		}
+	}
+	keys := make([]string, 0, len(pairs))
+	for key, value := range pairs {
+		keys = append(keys, key)
+		if got := holders(stores, key); len(got) != 1 {
+			t.Errorf("%s held by %v, want one store", key, got)
+		}
+		for n := 0; n < 5; n++ {
+			if got, err := b.GetKey(ctx, key); err != nil || got != value {
+				t.Errorf("GetKey %s = %q, %v; want %q", key, got, err, value)
+			}
+		}
+	}
+	values, err := b.GetKeys(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range pairs {
+		if values[key] != value {
+			t.Errorf("GetKeys %s = %q, want %q", key, values[key], value)
+		}
+	}
+}
+
+func TestSetKeysDeletesOlderCopies(t *testing.T) {
+	b, _, stores := memoryBroker(t, 2)
+	ctx := context.Background()
+	// A copy drifted onto both stores
+	for _, s := range stores {
+		if err := s.Set("k", "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.SetKeys(ctx, map[string]string{"k": "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := holders(stores, "k"); len(got) != 1 {
+		t.Errorf("k held by %v after SetKeys, want one store", got)
+	}
+	if values, err := b.GetKeys(ctx, []string{"k"}); err != nil || values["k"] != "new" {
+		t.Errorf("GetKeys k = %v, %v; want new", values, err)
+	}
+}
+
+func TestGetKeysReadsNewestCopy(t *testing.T) {
+	b, _, stores := memoryBroker(t, 3)
+	for _, name := range []string{"store0", "store1", "store2"} {
+		if err := stores[name].Set("k", "from "+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for n := 0; n < 10; n++ {
+		values, err := b.GetKeys(context.Background(), []string{"k"})
+		if err != nil || values["k"] != "from store2" {
+			t.Fatalf("GetKeys k = %v, %v; want the copy written last", values, err)
+		}
+	}
+}
+
+func TestGetKeysFailsOverUnreachableStore(t *testing.T) {
+	b, mem, stores := memoryBroker(t, 3)
+	ctx := context.Background()
+	pairs := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		pairs[fmt.Sprintf("k%d", i)] = fmt.Sprint(i)
+	}
+	if err := b.SetKeys(ctx, pairs); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range stores {
+		if err := s.BackUpPeers(); err != nil {
+			t.Fatalf("backing up the peers of %s: %v", name, err)
+		}
+	}
+
+	mem.Unregister(stores["store1"].IPAddress)
+	values, err := b.GetKeys(ctx, slices.Collect(maps.Keys(pairs)))
+	if err != nil {
+		t.Fatalf("GetKeys after store1 failed: %v", err)
+	}
+	for key, value := range pairs {
+		if values[key] != value {
+			t.Errorf("GetKeys %s after store1 failed = %q, want %q", key, values[key], value)
+		}
+	}
+	if slices.Contains(b.ListStores(), "store1") {
+		t.Error("store1 still registered after failing over")
+	}
+}
+
+func TestGetKeysKeepsBusyStore(t *testing.T) {
+	b, mem, stores := memoryBroker(t, 2)
+	ctx := context.Background()
+	if err := b.SetKey(ctx, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	holder := holders(stores, "k")[0]
+	mem.Register(stores[holder].IPAddress, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+
+	if _, err := b.GetKeys(ctx, []string{"k"}); err == nil {
+		t.Error("GetKeys with the holder busy succeeded, want a failure")
+	}
+	if !slices.Contains(b.ListStores(), holder) {
+		t.Errorf("busy store %s was failed over", holder)
+	}
+}
+
+func TestGetKeyNotFound(t *testing.T) {
+	b, _, _ := memoryBroker(t, 2)
+	if _, err := b.GetKey(context.Background(), "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetKey missing: err = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestLookupFailsOverUnreachableStore(t *testing.T) {
+	b, mem, stores := memoryBroker(t, 3)
+	ctx := context.Background()
+	for i := 0; i < 30; i++ {
+		if err := b.SetKey(ctx, fmt.Sprintf("k%d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, s := range stores {
+		if err := s.BackUpPeers(); err != nil {
+			t.Fatalf("backing up the peers of %s: %v", name, err)
+		}
+	}
+
+	mem.Unregister(stores["store1"].IPAddress)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if value, err := b.GetKey(ctx, key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("GetKey %s after store1 failed = %q, %v; want %q", key, value, err, fmt.Sprint(i))
+		}
+	}
+	if slices.Contains(b.ListStores(), "store1") {
+		t.Error("store1 still registered after failing over")
+	}
+	if failovers := b.Failovers(); len(failovers) != 1 || failovers[0].Store != "store1" {
+		t.Errorf("failovers = %+v, want one of store1", failovers)
+	}
+}
+
+func TestLookupKeepsBusyStore(t *testing.T) {
+	b, mem, stores := memoryBroker(t, 2)
+	ctx := context.Background()
+	if err := b.SetKey(ctx, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	holder := holders(stores, "k")[0]
+	mem.Register(stores[holder].IPAddress, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+
+	if _, err := b.GetKey(ctx, "k"); err == nil || errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetKey on a busy store: err = %v, want a failure other than not found", err)
+	}
+	if !slices.Contains(b.ListStores(), holder) {
+		t.Errorf("busy store %s was failed over", holder)
+	}
+}
+
+func TestLookupGivenUpOnKeepsStores(t *testing.T) {
+	b, mem, stores := memoryBroker(t, 2)
+	if err := b.SetKey(context.Background(), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		handler := kvstore.NewKVStoreHandler(s)
+		mem.Register(s.IPAddress, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+			handler.ServeHTTP(w, r)
+		}))
+	}
+
+	ctx, cancel := context.WithTimeout(WithMaxStaleness(context.Background(), 5*time.Second), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.GetKey(ctx, "k"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetKey past the caller's deadline: err = %v, want DeadlineExceeded", err)
+	}
+	// The lookup goes on without the caller; no store fails over for it
+	time.Sleep(300 * time.Millisecond)
+	if got := b.ListStores(); len(got) != 2 {
+		t.Errorf("stores after a lookup given up on = %v, want both", got)
+	}
+}
+
+func TestSetKeyWritesToDrainingHolder(t *testing.T) {
+	b, _, stores := memoryBroker(t, 3)
+	ctx := context.Background()
+	if err := b.SetKey(ctx, "k", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	holder := holders(stores, "k")[0]
+	b.mu.Lock()
+	b.draining[holder] = true
+	b.mu.Unlock()
+
+	if err := b.SetKey(ctx, "k", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetKeys(ctx, map[string]string{"k": "v3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := holders(stores, "k"); !slices.Equal(got, []string{holder}) {
+		t.Errorf("k held by %v while %s drains, want %s only", got, holder, holder)
+	}
+	if value, err := b.GetKey(ctx, "k"); err != nil || value != "v3" {
+		t.Errorf("GetKey k = %q, %v; want v3", value, err)
+	}
+}
+
+func TestMoveBatchKeepsNewerWriteOnTarget(t *testing.T) {
+	b, _, stores := memoryBroker(t, 2)
+	source, target := stores["store0"], stores["store1"]
+	if err := source.Set("k", "old"); err != nil {
+		t.Fatal(err)
+	}
+	// Written on the target after the source's copy, e.g. deleted and set again
+	if err := target.Set("k", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.moveBatch(context.Background(), "drain", source.Name, source.IPAddress, target.Name, target.IPAddress, []string{"k"}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := target.Get("k"); err != nil || value != "new" {
+		t.Errorf("target k = %q, %v; want new", value, err)
+	}
+	if got := holders(stores, "k"); !slices.Equal(got, []string{"store1"}) {
+		t.Errorf("k held by %v after the move, want store1 only", got)
+	}
+}
+
+func TestDrainStoreMovesEveryKey(t *testing.T) {
+	b, _, stores := memoryBroker(t, 3)
+	ctx := context.Background()
+	for i := 0; i < 30; i++ {
+		if err := b.SetKey(ctx, fmt.Sprintf("k%d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	held := stores["store1"].Len()
+	moved, err := b.DrainStore(ctx, "store1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != held {
+		t.Errorf("DrainStore moved %d keys, want the %d store1 held", moved, held)
+	}
+	if slices.Contains(b.ListStores(), "store1") {
+		t.Error("store1 still registered after draining")
+	}
+	delete(stores, "store1")
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if got := holders(stores, key); len(got) != 1 {
+			t.Errorf("%s held by %v after the drain, want one store", key, got)
+		}
+		if value, err := b.GetKey(ctx, key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("GetKey %s = %q, %v; want %q", key, value, err, fmt.Sprint(i))
+		}
+	}
+}
+
+func TestFailedDrainTakesNewKeysAgain(t *testing.T) {
+	b, mem, stores := memoryBroker(t, 2)
+	if err := stores["store0"].Set("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	mem.Unregister(stores["store1"].IPAddress)
+
+	if _, err := b.DrainStore(context.Background(), "store0"); err == nil {
+		t.Fatal("DrainStore with no store to take the keys succeeded")
+	}
+	b.mu.RLock()
+	draining := b.draining["store0"]
+	b.mu.RUnlock()
+	if draining || !slices.Contains(b.ListStores(), "store0") {
+		t.Errorf("after a failed drain store0 registered = %v, draining = %v; want registered and not draining", slices.Contains(b.ListStores(), "store0"), draining)
+	}
+
+	resp, err := mem.Do(httptest.NewRequest(http.MethodGet, "http://"+stores["store0"].IPAddress+"/readyz", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var ready struct {
+		Checks map[string]bool `json:"checks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ready); err != nil {
+		t.Fatal(err)
+	}
+	if !ready.Checks["not_draining"] {
+		t.Error("store0 still reports itself draining after its drain failed")
+	}
+}
+
+func TestHandOffKeepsNewerWriteOnSuccessor(t *testing.T) {
+	b, _, stores := memoryBroker(t, 2)
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "k"} {
+		if err := stores["store0"].Set(key, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Written on the successor after the handing-off store's copy
+	if err := stores["store1"].Set("k", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	handedOff, target, err := b.HandOffStore(ctx, "store0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "store1" || handedOff != 2 {
+		t.Errorf("HandOffStore = %d keys to %s, want 2 to store1", handedOff, target)
+	}
+	for key, want := range map[string]string{"a": "old", "b": "old", "k": "new"} {
+		if value, err := stores["store1"].Get(key); err != nil || value != want {
+			t.Errorf("store1 %s = %q, %v; want %q", key, value, err, want)
+		}
+	}
+}
+
+func TestFailedHandOffTakesNewKeysAgain(t *testing.T) {
+	b, mem, stores := memoryBroker(t, 2)
+	if err := stores["store0"].Set("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	mem.Unregister(stores["store1"].IPAddress)
+
+	if _, _, err := b.HandOffStore(context.Background(), "store0"); err == nil {
+		t.Fatal("HandOffStore to an unreachable successor succeeded")
+	}
+	b.mu.RLock()
+	draining := b.draining["store0"]
+	b.mu.RUnlock()
+	if draining || !slices.Contains(b.ListStores(), "store0") {
+		t.Errorf("after a failed handoff store0 registered = %v, draining = %v; want registered and not draining", slices.Contains(b.ListStores(), "store0"), draining)
+	}
+}
@@ -0,0 +1,500 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"kv/httpapi"
+	"kv/logging"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shadow writes: every write the broker accepts is repeated on a migration
+// target, another broker or a single store, and reads are compared with the
+// target's answers. Operations on a key reach the target in the order the
+// broker applied them.
+const (
+	// shadowWorkers is the number of concurrent streams to the target.
+	// Keys are spread over them by hash.
+	shadowWorkers = 8
+	// shadowQueueSize is how many operations each stream may have pending.
+	// Operations beyond it are dropped and counted.
+	shadowQueueSize = 4096
+	// shadowSamples is how many mismatches a report keeps.
+	shadowSamples = 20
+)
+
+// ShadowConfig configures shadow writes to a migration target.
+type ShadowConfig struct {
+	// Target is the base URL of the broker or store to mirror writes to,
+	// e.g. "http://10.0.0.9:8080".
+	Target string `json:"target"`
+	// Token, if set, is presented to the target as a bearer token. A
+	// target broker with tenants needs its admin token.
+	Token string `json:"token,omitempty"`
+	// CompareReads compares every GET with the target's answer.
+	CompareReads bool `json:"compare_reads,omitempty"`
+}
+
+// ShadowMismatch is a key the cluster and the target disagree on. A nil
+// value means the key is missing on that side.
+type ShadowMismatch struct {
+	Key     string    `json:"key"`
+	Cluster *string   `json:"cluster"`
+	Target  *string   `json:"target"`
+	At      time.Time `json:"at"`
+}
+
+// ShadowReport describes shadow writes since they were configured.
+type ShadowReport struct {
+	Target       string    `json:"target"`
+	Since        time.Time `json:"since"`
+	CompareReads bool      `json:"compare_reads"`
+	// Mirrored writes were accepted by the target; Failed ones were refused
+	// or could not be sent, and Dropped ones were never sent because the
+	// queue to the target was full.
+	Mirrored int64 `json:"writes_mirrored"`
+	Failed   int64 `json:"writes_failed"`
+	Dropped  int64 `json:"dropped"`
+	Pending  int   `json:"pending"`
+	// Compared reads got an answer from the target; Mismatches differed.
+	Compared   int64            `json:"reads_compared"`
+	Mismatches int64            `json:"mismatches"`
+	Recent     []ShadowMismatch `json:"recent_mismatches"`
+	LastError  string           `json:"last_error,omitempty"`
+	// LastVerification is the result of the last full comparison.
+	LastVerification *ShadowVerification `json:"last_verification,omitempty"`
+}
+
+// ShadowVerification is the result of comparing every key in the cluster
+// with the target. Keys held only by the target are not found.
+type ShadowVerification struct {
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	Checked  int       `json:"checked"`
+	Missing  int       `json:"missing"`
+	Differ   int       `json:"differ"`
+	// Repaired is the number of keys queued to be copied to the target.
+	Repaired int              `json:"repaired"`
+	Samples  []ShadowMismatch `json:"samples"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// ErrNoShadow is returned by shadow operations when no target is configured.
+var ErrNoShadow = errors.New("shadow writes are not configured")
+
+// shadowOp is one operation for the target: a write sent to path, a read to
+// compare, or a key to copy from the cluster.
+type shadowOp struct {
+	path string
+	body interface{}
+
+	// compare is set for a read of key that returned value, if found
+	compare bool
+	// sync is set for a key to read from the cluster and copy
+	sync  bool
+	key   string
+	value string
+	found bool
+}
+
+// name is the op label of the operation's metrics.
+func (op shadowOp) name() string {
+	switch {
+	case op.compare:
+		return "read"
+	case op.sync:
+		return "sync"
+	}
+	return strings.TrimPrefix(op.path, "/")
+}
+
+// shadower sends operations to a shadow target.
+type shadower struct {
+	cfg    ShadowConfig
+	broker *Broker
+	queues []chan shadowOp
+	stop   chan struct{}
+
+	mu     sync.Mutex
+	report ShadowReport
+}
+
+// SetShadow starts mirroring writes to cfg.Target, replacing any earlier
+// target, or stops if cfg is nil. Operations still queued for an earlier
+// target are discarded.
+func (b *Broker) SetShadow(cfg *ShadowConfig) {
+	var s *shadower
+	if cfg != nil {
+		s = &shadower{
+			cfg:    *cfg,
+			broker: b,
+			stop:   make(chan struct{}),
+			report: ShadowReport{Target: cfg.Target, Since: time.Now(), CompareReads: cfg.CompareReads},
+		}
+		for range shadowWorkers {
+			queue := make(chan shadowOp, shadowQueueSize)
+			s.queues = append(s.queues, queue)
+			b.tasks.Go(func(ctx context.Context) { s.run(ctx, queue) })
+		}
+		b.logger.Info("shadowing writes", "target", cfg.Target, "compare_reads", cfg.CompareReads)
+	}
+
+	b.mu.Lock()
+	old := b.shadow
+	b.shadow = s
+	b.mu.Unlock()
+	if old != nil {
+		close(old.stop)
+		if s == nil {
+			b.logger.Info("stopped shadowing writes", "target", old.cfg.Target)
+		}
+	}
+}
+
+func (b *Broker) currentShadow() *shadower {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.shadow
+}
+
+// ShadowReport describes the shadow writes to the current target.
+func (b *Broker) ShadowReport() (ShadowReport, error) {
+	s := b.currentShadow()
+	if s == nil {
+		return ShadowReport{}, ErrNoShadow
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := s.report
+	report.Recent = append([]ShadowMismatch{}, s.report.Recent...)
+	for _, queue := range s.queues {
+		report.Pending += len(queue)
+	}
+	return report, nil
+}
+
+// shadowWrite mirrors a write of key, sent to the target's path with body.
+func (b *Broker) shadowWrite(key, path string, body interface{}) {
+	if s := b.currentShadow(); s != nil {
+		s.enqueue(shadowStream(key), shadowOp{path: path, body: body})
+	}
+}
+
+// shadowSet mirrors a write of several pairs, split by stream.
+func (b *Broker) shadowSet(pairs map[string]string) {
+	s := b.currentShadow()
+	if s == nil {
+		return
+	}
+	if len(pairs) == 1 {
+		for k, v := range pairs {
+			s.enqueue(shadowStream(k), shadowOp{path: "/set", body: map[string]string{"key": k, "value": v}})
+		}
+		return
+	}
+	shares := make(map[int]map[string]string)
+	for k, v := range pairs {
+		n := shadowStream(k)
+		if shares[n] == nil {
+			shares[n] = make(map[string]string)
+		}
+		shares[n][k] = v
+	}
+	for n, share := range shares {
+		s.enqueue(n, shadowOp{path: "/mset", body: map[string]interface{}{"pairs": share}})
+	}
+}
+
+// shadowRead compares a read of key, which returned value if found, with the
+// target once the writes before it have been mirrored.
+func (b *Broker) shadowRead(key, value string, found bool) {
+	if s := b.currentShadow(); s != nil && s.cfg.CompareReads {
+		s.enqueue(shadowStream(key), shadowOp{compare: true, key: key, value: value, found: found})
+	}
+}
+
+// shadowStream returns the stream carrying the operations on key.
+func shadowStream(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % shadowWorkers)
+}
+
+// enqueue queues op on a stream, or drops it if the stream is full so the
+// target never slows the cluster down.
+func (s *shadower) enqueue(stream int, op shadowOp) {
+	select {
+	case s.queues[stream] <- op:
+	default:
+		s.mu.Lock()
+		s.report.Dropped++
+		s.mu.Unlock()
+		s.broker.shadowOps.Inc(op.name(), "dropped")
+	}
+}
+
+// enqueueWait queues op, waiting for room in the stream.
+func (s *shadower) enqueueWait(ctx context.Context, key string, op shadowOp) error {
+	select {
+	case s.queues[shadowStream(key)] <- op:
+		return nil
+	case <-s.stop:
+		return errors.New("shadow target was replaced")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *shadower) run(ctx context.Context, queue chan shadowOp) {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ctx.Done():
+			return
+		case op := <-queue:
+			s.apply(op)
+		}
+	}
+}
+
+func (s *shadower) apply(op shadowOp) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch {
+	case op.compare:
+		value, found, err := s.get(ctx, op.key)
+		if err != nil {
+			s.fail("read", err)
+			return
+		}
+		s.broker.shadowOps.Inc("read", "compared")
+		s.mu.Lock()
+		s.report.Compared++
+		s.mu.Unlock()
+		if found != op.found || value != op.value {
+			s.mismatch(op.key, op.value, op.found, value, found)
+		}
+	case op.sync:
+		// Read the cluster now, so writes made since the key was queued
+		// are not undone
+		value, _, err := s.broker.LookupKey(ctx, op.key)
+		switch {
+		case errors.Is(err, ErrKeyNotFound):
+			s.write(ctx, "/delete", map[string]string{"key": op.key})
+		case err != nil:
+			s.fail("sync", err)
+		default:
+			s.write(ctx, "/set", map[string]string{"key": op.key, "value": value})
+		}
+	default:
+		s.write(ctx, op.path, op.body)
+	}
+}
+
+// write sends a mirrored write. A key the target does not have counts as
+// mirrored for deletes and TTL changes, since the result is the same.
+func (s *shadower) write(ctx context.Context, path string, body interface{}) {
+	op := strings.TrimPrefix(path, "/")
+	resp, err := s.request(ctx, http.MethodPost, path, body)
+	if err != nil {
+		s.fail(op, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		s.fail(op, fmt.Errorf("target returned status %d for %s", resp.StatusCode, path))
+		return
+	}
+	s.broker.shadowOps.Inc(op, "mirrored")
+	s.mu.Lock()
+	s.report.Mirrored++
+	s.mu.Unlock()
+}
+
+func (s *shadower) fail(op string, err error) {
+	s.broker.shadowOps.Inc(op, "failed")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if op != "read" {
+		s.report.Failed++
+	}
+	if s.report.LastError == "" {
+		s.broker.logger.Warn("shadow target failed", "target", s.cfg.Target, "op", op, "err", err)
+	}
+	s.report.LastError = err.Error()
+}
+
+// mismatch records a key the target answered differently.
+func (s *shadower) mismatch(key, value string, found bool, targetValue string, targetFound bool) {
+	s.broker.shadowOps.Inc("read", "mismatch")
+	s.broker.logger.Debug("shadow read mismatch", "key_hash", logging.KeyHash(key))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report.Mismatches++
+	s.report.Recent = appendSample(s.report.Recent, newMismatch(key, value, found, targetValue, targetFound))
+}
+
+func newMismatch(key, value string, found bool, targetValue string, targetFound bool) ShadowMismatch {
+	m := ShadowMismatch{Key: key, At: time.Now()}
+	if found {
+		m.Cluster = &value
+	}
+	if targetFound {
+		m.Target = &targetValue
+	}
+	return m
+}
+
+// appendSample keeps the latest shadowSamples mismatches.
+func appendSample(samples []ShadowMismatch, m ShadowMismatch) []ShadowMismatch {
+	samples = append(samples, m)
+	if len(samples) > shadowSamples {
+		samples = samples[len(samples)-shadowSamples:]
+	}
+	return samples
+}
+
+// get reads key from the target.
+func (s *shadower) get(ctx context.Context, key string) (string, bool, error) {
+	resp, err := s.request(ctx, http.MethodGet, "/get?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("target returned status %d for /get", resp.StatusCode)
+	}
+	var result map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", false, fmt.Errorf("error decoding target response: %w", err)
+	}
+	value, ok := result["value"]
+	return value, ok, nil
+}
+
+// getMany reads keys from the target in one request.
+func (s *shadower) getMany(ctx context.Context, keys []string) (map[string]string, error) {
+	resp, err := s.request(ctx, http.MethodPost, "/mget", map[string][]string{"keys": keys})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("target returned status %d for /mget", resp.StatusCode)
+	}
+	var result struct {
+		Values map[string]string `json:"values"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding target response: %w", err)
+	}
+	return result.Values, nil
+}
+
+// request sends a request to the target. A non-nil body is sent as JSON.
+func (s *shadower) request(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewBuffer(jsonData)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(s.cfg.Target, "/")+httpapi.Version+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+	b := s.broker
+	b.mu.RLock()
+	t := b.transport
+	b.mu.RUnlock()
+	return t.Do(req)
+}
+
+// VerifyShadow compares every key in the cluster with the target, a page at
+// a time. With repair, keys that are missing or differ are queued to be
+// copied to the target, which is also how a target is first filled.
+func (b *Broker) VerifyShadow(ctx context.Context, repair bool) (ShadowVerification, error) {
+	s := b.currentShadow()
+	if s == nil {
+		return ShadowVerification{}, ErrNoShadow
+	}
+	v := ShadowVerification{Started: time.Now(), Samples: []ShadowMismatch{}}
+	err := s.verify(ctx, &v, repair)
+	if err != nil {
+		v.Error = err.Error()
+	}
+	v.Duration = time.Since(v.Started).Round(time.Millisecond).String()
+	b.logger.Info("shadow verification finished", "target", s.cfg.Target, "checked", v.Checked, "missing", v.Missing, "differ", v.Differ, "repaired", v.Repaired)
+
+	s.mu.Lock()
+	s.report.LastVerification = &v
+	s.mu.Unlock()
+	return v, err
+}
+
+func (s *shadower) verify(ctx context.Context, v *ShadowVerification, repair bool) error {
+	cursor := ""
+	for {
+		page, err := s.broker.Scan(ctx, "", cursor, MaxScanLimit)
+		if err != nil {
+			return err
+		}
+		if len(page.Items) > 0 {
+			keys := make([]string, len(page.Items))
+			for i, item := range page.Items {
+				keys[i] = item.Key
+			}
+			theirs, err := s.getMany(ctx, keys)
+			if err != nil {
+				return err
+			}
+			for _, item := range page.Items {
+				v.Checked++
+				value, ok := theirs[item.Key]
+				if ok && value == item.Value {
+					continue
+				}
+				if ok {
+					v.Differ++
+				} else {
+					v.Missing++
+				}
+				if len(v.Samples) < shadowSamples {
+					v.Samples = append(v.Samples, newMismatch(item.Key, item.Value, true, value, ok))
+				}
+				if repair {
+					if err := s.enqueueWait(ctx, item.Key, shadowOp{sync: true, key: item.Key}); err != nil {
+						return err
+					}
+					v.Repaired++
+				}
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		cursor = page.Next
+	}
+}
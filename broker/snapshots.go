@@ -0,0 +1,345 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"maps"
+	"net/http"
+	"time"
+)
+
+// Snapshot schedules: the broker remembers the periodic snapshot interval
+// set for each store through the API and applies it again whenever the store
+// registers, e.g. after a restart. Stores without one get the configured
+// snapshot_interval, if any, or keep their own. A store may instead have a
+// configured snapshot profile attached, whose interval and archive settings
+// are applied the same way, and again when the profile changes on reload.
+
+// ErrProfileNotFound is returned when attaching a snapshot profile that is
+// not configured.
+var ErrProfileNotFound = errors.New("snapshot profile not found")
+
+// SnapshotProfile is a named set of snapshot settings, configured once and
+// attached to any number of stores.
+type SnapshotProfile struct {
+	// Interval is how often the store saves a snapshot.
+	Interval kvstore.Duration `json:"interval"`
+	// If its destination is set, every snapshot is also archived as set
+	// out by the format, compression, destination and retain fields.
+	kvstore.SnapshotArchive
+}
+
+// Validate reports every problem with the profile at once.
+func (p SnapshotProfile) Validate() error {
+	var errs []error
+	if time.Duration(p.Interval) < time.Second {
+		errs = append(errs, errors.New("interval must be at least 1s"))
+	}
+	if p.Destination != "" {
+		errs = append(errs, p.SnapshotArchive.Validate())
+	} else if p.SnapshotArchive != (kvstore.SnapshotArchive{}) {
+		errs = append(errs, errors.New("format, compression and retain need a destination"))
+	}
+	return errors.Join(errs...)
+}
+
+// archive returns the archive settings to push to a store, nil if the
+// profile does not archive.
+func (p SnapshotProfile) archive() *kvstore.SnapshotArchive {
+	if p.Destination == "" {
+		return nil
+	}
+	a := p.SnapshotArchive
+	return &a
+}
+
+// snapshotState is what the broker knows of a store's periodic snapshots.
+type snapshotState struct {
+	// managed is set once the schedule was set through the API; interval
+	// is then the interval kept applied, or 0 if snapshots were disabled.
+	managed  bool
+	interval time.Duration
+	// profile is the snapshot profile attached, if any, applied in place
+	// of interval
+	profile string
+
+	// last is the status the store last reported, at reported
+	last     kvstore.SnapshotStatus
+	reported time.Time
+}
+
+// StoreSnapshotStatus is a store's periodic snapshot status. If the store
+// cannot be reached, Error is set and the rest is what it reported last.
+type StoreSnapshotStatus struct {
+	kvstore.SnapshotStatus
+	// Managed is set when the broker keeps the store's schedule applied,
+	// either one set through the API or the configured snapshot_interval.
+	// ManagedIntervalSeconds is 0 if the API disabled snapshots.
+	Managed                bool    `json:"managed"`
+	ManagedIntervalSeconds float64 `json:"managed_interval_seconds,omitempty"`
+	// Profile is the snapshot profile attached to the store, if any.
+	Profile  string     `json:"profile,omitempty"`
+	Reported *time.Time `json:"reported,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// EnablePeriodicSnapshots starts periodic snapshots on a store, or changes
+// their interval, and keeps that schedule applied across the store's restarts.
+// It detaches the store's snapshot profile, if any.
+func (b *Broker) EnablePeriodicSnapshots(ctx context.Context, storename string, intervalSeconds int) error {
+	if intervalSeconds <= 0 {
+		return fmt.Errorf("invalid snapshot interval %d: must be positive", intervalSeconds)
+	}
+	if err := b.startSnapshots(ctx, storename, time.Duration(intervalSeconds)*time.Second); err != nil {
+		return err
+	}
+	if err := b.detachSnapshotProfile(ctx, storename); err != nil {
+		return err
+	}
+	b.setSnapshotSchedule(storename, time.Duration(intervalSeconds)*time.Second)
+	return nil
+}
+
+// DisablePeriodicSnapshots stops periodic snapshots on a given store, and
+// keeps them stopped across the store's restarts. It detaches the store's
+// snapshot profile, if any.
+func (b *Broker) DisablePeriodicSnapshots(ctx context.Context, storename string) error {
+	if err := b.stopSnapshots(ctx, storename); err != nil {
+		return err
+	}
+	if err := b.detachSnapshotProfile(ctx, storename); err != nil {
+		return err
+	}
+	b.setSnapshotSchedule(storename, 0)
+	return nil
+}
+
+// AttachSnapshotProfile applies the named snapshot profile to a store and
+// keeps it applied across the store's restarts and config reloads, in place
+// of any schedule set before.
+func (b *Broker) AttachSnapshotProfile(ctx context.Context, storename, profile string) error {
+	b.mu.RLock()
+	p, ok := b.config.SnapshotProfiles[profile]
+	b.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%s: %w", profile, ErrProfileNotFound)
+	}
+	if err := b.applySnapshotProfile(ctx, storename, p); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.snapshotState(storename)
+	state.managed, state.interval, state.profile = true, time.Duration(p.Interval), profile
+	return nil
+}
+
+// SnapshotProfiles returns the configured snapshot profiles.
+func (b *Broker) SnapshotProfiles() map[string]SnapshotProfile {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return maps.Clone(b.config.SnapshotProfiles)
+}
+
+// applySnapshotProfile starts the store's periodic snapshots at the
+// profile's interval and sets its archive settings.
+func (b *Broker) applySnapshotProfile(ctx context.Context, storename string, p SnapshotProfile) error {
+	if err := b.startSnapshots(ctx, storename, time.Duration(p.Interval)); err != nil {
+		return err
+	}
+	return b.setSnapshotArchive(ctx, storename, p.archive())
+}
+
+// detachSnapshotProfile stops the store archiving snapshots if it had a
+// snapshot profile attached. The caller records the schedule replacing it.
+func (b *Broker) detachSnapshotProfile(ctx context.Context, storename string) error {
+	if b.snapshotProfile(storename) == "" {
+		return nil
+	}
+	return b.setSnapshotArchive(ctx, storename, nil)
+}
+
+// snapshotProfile returns the snapshot profile attached to the named store,
+// or "".
+func (b *Broker) snapshotProfile(name string) string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if state, ok := b.snapshots[name]; ok && state.managed {
+		return state.profile
+	}
+	return ""
+}
+
+func (b *Broker) setSnapshotArchive(ctx context.Context, storename string, archive *kvstore.SnapshotArchive) error {
+	store, err := b.GetStore(storename)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.storeRequest(ctx, http.MethodPost, store.Address(), "/snapshot-archive", archive)
+	if err != nil {
+		return fmt.Errorf("error sending snapshot archive settings to store %s: %w", storename, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("store %s responded with status: %d", storename, resp.StatusCode)
+	}
+	return nil
+}
+
+func (b *Broker) startSnapshots(ctx context.Context, storename string, interval time.Duration) error {
+	store, err := b.GetStore(storename)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.storeRequest(ctx, http.MethodPost, store.Address(), fmt.Sprintf("/start-snapshots?interval=%d", int(interval/time.Second)), nil)
+	if err != nil {
+		return fmt.Errorf("error sending start snapshots request to store %s: %w", storename, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("store %s responded with status: %d", storename, resp.StatusCode)
+	}
+	return nil
+}
+
+func (b *Broker) stopSnapshots(ctx context.Context, storename string) error {
+	store, err := b.GetStore(storename)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.storeRequest(ctx, http.MethodPost, store.Address(), "/stop-snapshots", nil)
+	if err != nil {
+		return fmt.Errorf("error sending stop snapshots request to store %s: %w", storename, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("store %s responded with status: %d", storename, resp.StatusCode)
+	}
+	return nil
+}
+
+// setSnapshotSchedule records the schedule set for a store through the API.
+func (b *Broker) setSnapshotSchedule(name string, interval time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.snapshotState(name)
+	state.managed, state.interval, state.profile = true, interval, ""
+}
+
+// snapshotState returns the snapshot state of the named store, creating it
+// if needed. b.mu must be held.
+func (b *Broker) snapshotState(name string) *snapshotState {
+	state, ok := b.snapshots[name]
+	if !ok {
+		state = &snapshotState{}
+		b.snapshots[name] = state
+	}
+	return state
+}
+
+// applySnapshotSchedule applies the store's schedule: its snapshot profile
+// or the one set through the API, or else the configured snapshot_interval.
+// It does nothing if none is set, leaving snapshots to the store.
+func (b *Broker) applySnapshotSchedule(ctx context.Context, name string) {
+	b.mu.RLock()
+	interval := time.Duration(b.config.SnapshotInterval)
+	state, managed := b.snapshots[name]
+	managed = managed && state.managed
+	var profile string
+	if managed {
+		interval, profile = state.interval, state.profile
+	}
+	p, configured := b.config.SnapshotProfiles[profile]
+	b.mu.RUnlock()
+
+	var err error
+	switch {
+	case profile != "" && !configured:
+		// Left as last applied until the profile is configured again
+		b.logger.Warn("attached snapshot profile is not configured", "store", name, "profile", profile)
+		return
+	case profile != "":
+		err = b.applySnapshotProfile(ctx, name, p)
+	case managed && interval == 0:
+		err = b.stopSnapshots(ctx, name)
+	case interval > 0:
+		err = b.startSnapshots(ctx, name, interval)
+	default:
+		return
+	}
+	if err != nil {
+		b.logger.Warn("failed to apply snapshot schedule", "store", name, "err", err)
+	}
+}
+
+// SnapshotStatus reports the periodic snapshot status of the named store, or
+// of every store when storename is empty.
+func (b *Broker) SnapshotStatus(ctx context.Context, storename string) (map[string]StoreSnapshotStatus, error) {
+	b.mu.RLock()
+	targets := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		if storename == "" || name == storename {
+			targets[name] = store.Address()
+		}
+	}
+	b.mu.RUnlock()
+	if storename != "" && len(targets) == 0 {
+		return nil, ErrStoreNotFound
+	}
+
+	statuses := make(map[string]StoreSnapshotStatus, len(targets))
+	for name, addr := range targets {
+		status, err := b.fetchSnapshotStatus(ctx, addr)
+
+		b.mu.Lock()
+		state := b.snapshotState(name)
+		if err == nil {
+			state.last, state.reported = status, time.Now()
+		}
+		result := StoreSnapshotStatus{SnapshotStatus: state.last}
+		if state.managed {
+			result.Managed, result.ManagedIntervalSeconds, result.Profile = true, state.interval.Seconds(), state.profile
+			if p, ok := b.config.SnapshotProfiles[state.profile]; ok {
+				result.ManagedIntervalSeconds = time.Duration(p.Interval).Seconds()
+			}
+		} else if b.config.SnapshotInterval > 0 {
+			result.Managed, result.ManagedIntervalSeconds = true, time.Duration(b.config.SnapshotInterval).Seconds()
+		}
+		if !state.reported.IsZero() {
+			reported := state.reported
+			result.Reported = &reported
+		}
+		b.mu.Unlock()
+
+		if err != nil {
+			result.Error = err.Error()
+		}
+		statuses[name] = result
+	}
+	return statuses, nil
+}
+
+func (b *Broker) fetchSnapshotStatus(ctx context.Context, addr string) (kvstore.SnapshotStatus, error) {
+	var status kvstore.SnapshotStatus
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/snapshot-status", nil)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("snapshot-status returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, fmt.Errorf("error decoding snapshot status: %w", err)
+	}
+	return status, nil
+}
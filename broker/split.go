@@ -0,0 +1,299 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+)
+
+// Splits: a store that grows past the configured size has half its keyspace
+// moved to another store. The store's keys are ordered by hash and those in
+// the upper half of its hash range move, so the split does not depend on
+// which keys happen to be written most. Placement goes by load rather than
+// by hash, so nothing routes by the range afterwards; the ring of stores
+// backing each other up is unchanged, and the stores backing up the two
+// stores are asked to back them up again at once.
+
+// ErrNoSplitTarget is returned when no other store can take half the keys
+// of the store being split.
+var ErrNoSplitTarget = errors.New("no other store can take half of the store's keys")
+
+// ErrResizeRunning is returned when a split or merge is asked for while
+// another runs.
+var ErrResizeRunning = errors.New("another split or merge is running")
+
+// SplitConfig sets the size at which the broker splits a store. A limit of
+// zero is not enforced.
+type SplitConfig struct {
+	// MaxKeys is the number of keys a store may hold before it is split.
+	MaxKeys int `json:"max_keys,omitempty"`
+	// MaxBytes is the size of the keys and values a store may hold before
+	// it is split.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+func splitEqual(a, b *SplitConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// keyHash is the position of a key in a store's hash range.
+func keyHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// upperHalfKeys returns the keys of data that hash into the upper half of
+// the range its keys span, sorted.
+func upperHalfKeys(data map[string]string) []string {
+	keys := slices.Collect(maps.Keys(data))
+	sort.Slice(keys, func(i, j int) bool {
+		hi, hj := keyHash(keys[i]), keyHash(keys[j])
+		return hi < hj || hi == hj && keys[i] < keys[j]
+	})
+	upper := keys[len(keys)/2:]
+	sort.Strings(upper)
+	return upper
+}
+
+// SplitStore moves the keys in the upper half of the named store's hash
+// range to target, or to the least loaded other store if target is empty.
+// It returns the number of keys moved and the store they went to.
+//
+// Keys written while they move stay on the store they were written to. Its
+// progress is reported by Migrations, through which it can be paused,
+// resumed or aborted; the keys already moved stay on the target.
+func (b *Broker) SplitStore(ctx context.Context, name, target string) (moved int, to string, err error) {
+	b.mu.Lock()
+	store, exists := b.stores[name]
+	if !exists {
+		b.mu.Unlock()
+		return 0, "", ErrStoreNotFound
+	}
+	if target == "" {
+		target = b.resizeTarget(name, nil, 0, 0)
+	}
+	switch {
+	case target == "":
+		b.mu.Unlock()
+		return 0, "", ErrNoSplitTarget
+	case b.stores[target] == nil:
+		b.mu.Unlock()
+		return 0, "", fmt.Errorf("target %s: %w", target, ErrStoreNotFound)
+	case target == name || b.draining[target] || b.warming[target]:
+		b.mu.Unlock()
+		return 0, "", fmt.Errorf("target %s cannot take keys: %w", target, ErrNoSplitTarget)
+	case b.resizing:
+		b.mu.Unlock()
+		return 0, "", ErrResizeRunning
+	}
+	b.resizing = true
+	addr, targetAddr := store.Address(), b.stores[target].Address()
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.resizing = false
+		b.mu.Unlock()
+	}()
+	m := b.startLocalMigration("split", name, target)
+	defer func() { m.Finish(err) }()
+
+	b.logger.Info("splitting store", "store", name, "target", target)
+	data, err := b.fetchStoreData(ctx, addr)
+	if err != nil {
+		return 0, target, fmt.Errorf("error reading data from store %s: %w", name, err)
+	}
+	upper := upperHalfKeys(data)
+	m.AddKeys(len(upper))
+	for start := 0; start < len(upper); start += moveBatchSize {
+		keys := upper[start:min(start+moveBatchSize, len(upper))]
+		if err := m.Wait(ctx); err != nil {
+			return moved, target, err
+		}
+		batch, err := b.moveBatch(ctx, "split", name, addr, target, targetAddr, keys)
+		moved += len(batch)
+		if err != nil {
+			return moved, target, err
+		}
+		m.Moved(batch)
+	}
+
+	b.mu.RLock()
+	holders := b.holdersOf(name, target)
+	b.mu.RUnlock()
+	for holder, holderAddr := range holders {
+		if err := b.backUpNow(ctx, holderAddr); err != nil {
+			b.logger.Warn("failed to re-replicate after split", "store", name, "holder", holder, "err", err)
+		}
+	}
+	b.splits.Inc()
+	b.logger.Info("store split", "store", name, "target", target, "keys_moved", moved)
+	b.recordEvent(ClusterEvent{Type: EventStoreSplit, Store: name, Peer: target, Details: fmt.Sprintf("%d keys moved", moved)})
+	return moved, target, nil
+}
+
+// moveBatch copies the keys from the store at addr to the one at
+// targetAddr and deletes them from the former, returning the pairs moved.
+// The values are read just before, so keys deleted since the move began
+// are not brought back, and sent with their entity tags, so a key written
+// on the target since it was read is not overwritten. A key written on the
+// source meanwhile is kept there and deleted from the target again. op
+// names the move for the background limit.
+func (b *Broker) moveBatch(ctx context.Context, op, name, addr, target, targetAddr string, keys []string) (map[string]string, error) {
+	found, err := b.storeMGetTagged(ctx, addr, keys)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keys from %s: %w", name, err)
+	}
+	batch := make(map[string]string, len(found))
+	etags := make(map[string]string, len(found))
+	for key, held := range found {
+		batch[key] = held.value
+		if held.etag != "" {
+			etags[key] = held.etag
+		}
+	}
+	if len(batch) == 0 {
+		return batch, nil
+	}
+	if err := b.background.WaitPairs(ctx, op, batch); err != nil {
+		return nil, err
+	}
+	resp, err := b.storeRequest(ctx, http.MethodPost, targetAddr, "/mset?moved=1", map[string]interface{}{"pairs": batch, "etags": etags})
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("KVStore %s returned status: %d", target, resp.StatusCode)
+		}
+	}
+	if err != nil {
+		b.forgetFilter(target) // it may have taken the keys all the same
+		return nil, fmt.Errorf("error moving keys to %s: %w", target, err)
+	}
+	b.noteWrites(target, slices.Collect(maps.Keys(batch))...)
+	b.addLoad(target, len(batch))
+
+	resp, err = b.storeRequest(ctx, http.MethodPost, addr, "/mdelete", map[string]interface{}{"pairs": batch})
+	if err != nil {
+		return nil, fmt.Errorf("error deleting moved keys from %s: %w", name, err)
+	}
+	var deleted struct {
+		Count int `json:"count"`
+	}
+	json.NewDecoder(resp.Body).Decode(&deleted)
+	resp.Body.Close()
+	if deleted.Count == len(batch) {
+		return batch, nil
+	}
+
+	// Some keys were written on the source since they were read
+	kept, err := b.storeMGet(ctx, addr, slices.Collect(maps.Keys(batch)))
+	if err != nil {
+		return nil, fmt.Errorf("error reading the keys kept on %s: %w", name, err)
+	}
+	stale := make(map[string]string, len(kept))
+	for key := range kept {
+		stale[key] = batch[key]
+		delete(batch, key)
+	}
+	resp, err = b.storeRequest(ctx, http.MethodPost, targetAddr, "/mdelete", map[string]interface{}{"pairs": stale})
+	if err != nil {
+		return nil, fmt.Errorf("error deleting stale copies from %s: %w", target, err)
+	}
+	resp.Body.Close()
+	return batch, nil
+}
+
+// storeMGet reads those of keys the store at addr holds.
+func (b *Broker) storeMGet(ctx context.Context, addr string, keys []string) (map[string]string, error) {
+	resp, err := b.storeRequest(ctx, http.MethodPost, addr, "/mget", map[string]interface{}{"keys": keys})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mget returned status: %d", resp.StatusCode)
+	}
+	var result struct {
+		Values map[string]string `json:"values"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding mget: %w", err)
+	}
+	return result.Values, nil
+}
+
+// resizeTarget returns the least loaded store other than name that can take
+// keys and has room under limits for keys and bytes more, or "" if there is
+// none. b.mu must be held.
+func (b *Broker) resizeTarget(name string, limits *SplitConfig, keys int, bytes int64) string {
+	var candidates []string
+	for other := range b.stores {
+		if other != name && !b.draining[other] && !b.warming[other] && b.roomFor(other, limits, keys, bytes) {
+			candidates = append(candidates, other)
+		}
+	}
+	sort.Strings(candidates)
+	return leastLoaded(b.placementLoads(candidates), candidates)
+}
+
+// roomFor reports whether the named store's last load report leaves room
+// under limits for keys and bytes more. Without limits every store has
+// room; without a report none has. b.mu must be held.
+func (b *Broker) roomFor(name string, limits *SplitConfig, keys int, bytes int64) bool {
+	if limits == nil {
+		return true
+	}
+	report := b.health[name].Report
+	if report == nil {
+		return false
+	}
+	return (limits.MaxKeys == 0 || report.Keys+keys <= limits.MaxKeys) &&
+		(limits.MaxBytes == 0 || report.DataBytes+bytes <= limits.MaxBytes)
+}
+
+// splitOversized starts splitting the first store, by name, whose last load
+// report is over the configured size, unless a split or merge is running. A
+// store with no other store to take half its keys is logged once.
+func (b *Broker) splitOversized() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	limits := b.config.Split
+	if limits == nil || b.resizing {
+		return
+	}
+	names := slices.Sorted(maps.Keys(b.stores))
+	for _, name := range names {
+		health := b.health[name]
+		report := health.Report
+		over := report != nil && health.Status == StatusUp && !b.draining[name] && !b.warming[name] &&
+			(limits.MaxKeys > 0 && report.Keys > limits.MaxKeys || limits.MaxBytes > 0 && report.DataBytes > limits.MaxBytes)
+		if !over {
+			delete(b.splitBlocked, name)
+			continue
+		}
+		target := b.resizeTarget(name, limits, report.Keys/2, report.DataBytes/2)
+		if target == "" {
+			if !b.splitBlocked[name] {
+				b.logger.Warn("store is over the split size but no other store has room for half its keys", "store", name, "keys", report.Keys, "data_bytes", report.DataBytes)
+				b.splitBlocked[name] = true
+			}
+			continue
+		}
+		delete(b.splitBlocked, name)
+		b.tasks.Go(func(ctx context.Context) {
+			if _, _, err := b.SplitStore(ctx, name, target); err != nil && !errors.Is(err, ErrResizeRunning) {
+				b.logger.Error("failed to split store", "store", name, "target", target, "err", err)
+			}
+		})
+		return
+	}
+}
@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv/version"
+	"net/http"
+	"sort"
+)
+
+// StoreStatus is the broker's view of a single store.
+type StoreStatus struct {
+	Name    string      `json:"name"`
+	Address string      `json:"address"`
+	Health  StoreHealth `json:"health"`
+	Load    int         `json:"load"`
+	// Keys is the number of keys the store holds; zero if it could not be asked.
+	Keys int `json:"keys"`
+	// BacksUp is the ring successor whose data this store keeps a copy of.
+	BacksUp string `json:"backs_up,omitempty"`
+	// BackedUpBy is the ring predecessor that keeps a copy of this store's data.
+	BackedUpBy   string        `json:"backed_up_by,omitempty"`
+	Version      *version.Info `json:"version,omitempty"`
+	VersionError string        `json:"version_error,omitempty"`
+}
+
+// ClusterStatus summarizes the broker and every registered store.
+type ClusterStatus struct {
+	Broker        version.Info  `json:"broker"`
+	Stores        []StoreStatus `json:"stores"`
+	MixedVersions bool          `json:"mixed_versions"`
+}
+
+// ClusterStatus collects membership, health, load and peering from the broker's
+// state and asks every store which version it is running and how many keys it holds.
+func (b *Broker) ClusterStatus(ctx context.Context) ClusterStatus {
+	b.mu.RLock()
+	stores := make([]StoreStatus, 0, len(b.stores))
+	for name, store := range b.stores {
+		status := StoreStatus{
+			Name:    name,
+			Address: store.Address(),
+			Health:  b.health[name],
+			Load:    b.loads[name],
+		}
+		if prev, next := b.peerlist.Neighbors(name); prev != nil {
+			if next.Name != name {
+				status.BacksUp = next.Name
+			}
+			if prev.Name != name {
+				status.BackedUpBy = prev.Name
+			}
+		}
+		stores = append(stores, status)
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Name < stores[j].Name })
+
+	versions := make(map[string]bool)
+	for i := range stores {
+		info, err := b.fetchStoreVersion(ctx, stores[i].Address)
+		if err != nil {
+			stores[i].VersionError = err.Error()
+			continue
+		}
+		stores[i].Version = &info
+		versions[info.Version+"/"+info.Commit] = true
+		if stats, err := b.fetchStoreStats(ctx, stores[i].Address, ""); err == nil {
+			stores[i].Keys = stats.Keys
+		}
+	}
+
+	return ClusterStatus{
+		Broker:        version.Get(),
+		Stores:        stores,
+		MixedVersions: len(versions) > 1,
+	}
+}
+
+func (b *Broker) fetchStoreVersion(ctx context.Context, addr string) (version.Info, error) {
+	var info version.Info
+	resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/version", nil)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("version returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return info, fmt.Errorf("error decoding version: %w", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"kv/logging"
+	"net/http"
+	"net/url"
+)
+
+// StoreClient is the broker's handle on a registered store. The broker holds
+// no store data itself: key operations go through this interface and other
+// calls are made to the store's address, so tests can register mock stores
+// with SetStoreFactory.
+type StoreClient interface {
+	Name() string
+	Address() string
+	// Get returns the value of key, with its entity tag, and whether the
+	// store holds it. An error means the store could not be reached, or
+	// answered without saying: ErrStoreBusy if it turned the read away, an
+	// error wrapping errStoreStatus if it failed it.
+	Get(ctx context.Context, key string) (value, etag string, found bool, err error)
+	// Set writes key and returns the entity tag of the value written.
+	Set(ctx context.Context, key, value string) (etag string, err error)
+	// Delete removes key and reports whether the store held it.
+	Delete(ctx context.Context, key string) (found bool, err error)
+}
+
+// StoreFactory creates the handle for a store registering under name at addr.
+type StoreFactory func(name, addr string) StoreClient
+
+// SetStoreFactory replaces how handles on newly registered stores are
+// created. Call it before any store registers.
+func (b *Broker) SetStoreFactory(f StoreFactory) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.newStore = f
+}
+
+// remoteStore is a StoreClient that calls a store over the broker's transport.
+type remoteStore struct {
+	broker *Broker
+	name   string
+	addr   string
+}
+
+func (s *remoteStore) Name() string    { return s.name }
+func (s *remoteStore) Address() string { return s.addr }
+
+func (s *remoteStore) Get(ctx context.Context, key string) (string, string, bool, error) {
+	// Only the store the broker picks reads a missing key through
+	header := http.Header{kvstore.NoReadThroughHeader: {"1"}}
+	resp, err := s.broker.storeRequestHeader(ctx, http.MethodGet, s.addr, "/get?key="+url.QueryEscape(key), nil, header)
+	if err != nil {
+		return "", "", false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", "", false, nil
+	default:
+		return "", "", false, statusError(s.addr, resp.StatusCode)
+	}
+
+	var result map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		logging.FromContext(ctx, s.broker.logger).Error("error decoding store response", "store", s.name, "err", err)
+		return "", "", false, fmt.Errorf("%w: error decoding KVStore response: %w", errStoreStatus, err)
+	}
+	value, ok := result["value"]
+	return value, resp.Header.Get("ETag"), ok, nil
+}
+
+func (s *remoteStore) Set(ctx context.Context, key, value string) (string, error) {
+	data := map[string]string{"key": key, "value": value}
+	resp, err := s.broker.storeRequest(ctx, http.MethodPost, s.addr, "/set", data)
+	if err != nil {
+		return "", fmt.Errorf("error contacting KVStore at %s: %w", s.addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(s.addr, resp.StatusCode)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *remoteStore) Delete(ctx context.Context, key string) (bool, error) {
+	data := map[string]string{"key": key}
+	resp, err := s.broker.storeRequest(ctx, http.MethodPost, s.addr, "/delete", data)
+	if err != nil {
+		return false, fmt.Errorf("error contacting KVStore at %s: %w", s.addr, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, statusError(s.addr, resp.StatusCode)
+	}
+}
+
+// errStoreStatus is wrapped by the errors of key operations a store answered
+// with a failure: it was reached, so it is not failed over.
+var errStoreStatus = errors.New("store failed the request")
+
+// statusError is the error for a key operation the store at addr answered
+// with status: ErrStoreBusy if it turned the request away, errStoreStatus
+// otherwise.
+func statusError(addr string, status int) error {
+	if status == http.StatusServiceUnavailable || status == http.StatusTooManyRequests {
+		return fmt.Errorf("%w: KVStore at %s returned status: %d", ErrStoreBusy, addr, status)
+	}
+	return fmt.Errorf("%w: KVStore at %s returned status: %d", errStoreStatus, addr, status)
+}
@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"kv/httpapi"
+	"kv/kvstore"
+	"kv/logging"
+	"kv/tracing"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultStoreTimeout bounds a call to a store on a route with no timeout
+// of its own in the config's store_timeouts.
+const DefaultStoreTimeout = 10 * time.Second
+
+// DefaultStoreTimeouts returns the timeouts of calls to stores by route.
+// The routes that save, load, hand off or back up a store's whole data set
+// get longer than the default.
+func DefaultStoreTimeouts() map[string]kvstore.Duration {
+	return map[string]kvstore.Duration{
+		"default":       kvstore.Duration(DefaultStoreTimeout),
+		"/getall":       kvstore.Duration(2 * time.Minute),
+		"/save":         kvstore.Duration(2 * time.Minute),
+		"/load":         kvstore.Duration(2 * time.Minute),
+		"/backup-peers": kvstore.Duration(2 * time.Minute),
+		"/peer-backups": kvstore.Duration(2 * time.Minute),
+		"/handoff":      kvstore.Duration(10 * time.Minute),
+	}
+}
+
+// storeTimeout returns the timeout of a call to route on a store. b.mu
+// must be held.
+func (b *Broker) storeTimeout(route string) time.Duration {
+	timeouts := b.config.StoreTimeouts
+	if timeouts == nil {
+		timeouts = DefaultStoreTimeouts()
+	}
+	d, ok := timeouts[route]
+	if !ok {
+		d = timeouts["default"]
+	}
+	if d <= 0 {
+		return DefaultStoreTimeout
+	}
+	return time.Duration(d)
+}
+
+// storeRequest sends a request to the KVStore at addr. A non-nil body is sent
+// as JSON. The call is traced as a child of the span carried by ctx and the
+// trace context and request ID are propagated to the store. The call, body
+// included, must finish within the route's store timeout.
+func (b *Broker) storeRequest(ctx context.Context, method, addr, path string, body interface{}) (*http.Response, error) {
+	return b.storeRequestHeader(ctx, method, addr, path, body, nil)
+}
+
+// storeRequestHeader is storeRequest with extra request headers.
+func (b *Broker) storeRequestHeader(ctx context.Context, method, addr, path string, body interface{}, header http.Header) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewBuffer(jsonData)
+	}
+
+	route, _, _ := strings.Cut(path, "?")
+	ctx, span := tracing.Start(ctx, "store "+method+" "+route, "address", addr)
+	defer span.End()
+	b.mu.RLock()
+	token, t, timeout := b.adminToken, b.transport, b.storeTimeout(route)
+	b.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	start := time.Now()
+	code := "error"
+	defer func() { b.storeLatency.ObserveSince(start, addr, route, code) }()
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+addr+httpapi.Version+path, reader)
+	if err != nil {
+		cancel()
+		span.RecordError(err)
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	tracing.Inject(ctx, req.Header)
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+
+	resp, err := t.Do(req)
+	if err != nil {
+		cancel()
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes("status", resp.StatusCode)
+	code = strconv.Itoa(resp.StatusCode)
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a request's context once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
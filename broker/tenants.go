@@ -0,0 +1,283 @@
+package broker
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"kv/httpapi"
+	"kv/kvstore"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned for a write that would take a tenant over its
+// key or byte quota.
+var ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+// TenantConfig is an application sharing the cluster. Requests carrying the
+// tenant's token as "Authorization: Bearer <token>" see only the tenant's
+// keys, which the stores hold under the prefix "<name>/".
+type TenantConfig struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// MaxKeys and MaxBytes cap the tenant's data; zero means no limit.
+	// Bytes are the sum of key and value lengths, as in /stores/distribution.
+	MaxKeys  int `json:"max_keys,omitempty"`
+	MaxBytes int `json:"max_bytes,omitempty"`
+}
+
+// validTenantName reports whether name may be used as a tenant, and so as
+// a key prefix.
+func validTenantName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// TenantUsage is a tenant's quota and the data it holds.
+type TenantUsage struct {
+	Name     string `json:"name"`
+	MaxKeys  int    `json:"max_keys,omitempty"`
+	MaxBytes int    `json:"max_bytes,omitempty"`
+	Keys     int    `json:"keys"`
+	Bytes    int    `json:"bytes"`
+	// Measured is when the usage was last counted on the stores; writes
+	// accepted since are added to it.
+	Measured time.Time `json:"measured"`
+}
+
+// tenant is a configured tenant and its usage. Usage is counted on the
+// stores when a write would exceed the quota, so the quota is exact at the
+// limit, and estimated from the writes accepted in between.
+type tenant struct {
+	TenantConfig
+
+	mu       sync.Mutex
+	usage    kvstore.Stats
+	measured time.Time
+}
+
+// prefix is the prefix the tenant's keys are stored under.
+func (t *tenant) prefix() string {
+	return t.Name + "/"
+}
+
+// key returns the key the stores hold key under. A nil tenant, for requests
+// made without tenancy or with the admin token, leaves keys unchanged.
+func (t *tenant) key(key string) string {
+	if t == nil {
+		return key
+	}
+	return t.prefix() + key
+}
+
+// keys applies key to every key in keys.
+func (t *tenant) keys(keys []string) []string {
+	if t == nil {
+		return keys
+	}
+	scoped := make([]string, len(keys))
+	for i, k := range keys {
+		scoped[i] = t.key(k)
+	}
+	return scoped
+}
+
+// unkey returns the tenant's name for a stored key, and false if the key
+// belongs to someone else.
+func (t *tenant) unkey(key string) (string, bool) {
+	if t == nil {
+		return key, true
+	}
+	return strings.CutPrefix(key, t.prefix())
+}
+
+// over reports whether adding keys and bytes would exceed the quota. t.mu
+// must be held.
+func (t *tenant) over(keys, bytes int) bool {
+	return t.MaxKeys > 0 && t.usage.Keys+keys > t.MaxKeys ||
+		t.MaxBytes > 0 && t.usage.Bytes+bytes > t.MaxBytes
+}
+
+func (t *tenant) status() TenantUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return TenantUsage{
+		Name:     t.Name,
+		MaxKeys:  t.MaxKeys,
+		MaxBytes: t.MaxBytes,
+		Keys:     t.usage.Keys,
+		Bytes:    t.usage.Bytes,
+		Measured: t.measured,
+	}
+}
+
+type tenantContextKey struct{}
+
+// tenantFrom returns the tenant a request is scoped to, or nil.
+func tenantFrom(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantContextKey{}).(*tenant)
+	return t
+}
+
+// SetTenants replaces the configured tenants. Tenants that remain keep their
+// measured usage. With no tenants every request sees the whole keyspace.
+func (b *Broker) SetTenants(configs []TenantConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old := make(map[string]*tenant, len(b.tenants))
+	for _, t := range b.tenants {
+		old[t.Name] = t
+	}
+	b.tenants = make([]*tenant, 0, len(configs))
+	for _, cfg := range configs {
+		t := &tenant{TenantConfig: cfg}
+		if prev, ok := old[cfg.Name]; ok {
+			prev.mu.Lock()
+			t.usage, t.measured = prev.usage, prev.measured
+			prev.mu.Unlock()
+		}
+		b.tenants = append(b.tenants, t)
+	}
+}
+
+// tenantFor returns the tenant token belongs to, whether tenancy is enabled
+// and whether token is the admin token.
+func (b *Broker) tenantFor(token string) (t *tenant, enabled, admin bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.tenants) == 0 {
+		return nil, false, false
+	}
+	if b.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(b.adminToken)) == 1 {
+		return nil, true, true
+	}
+	for _, candidate := range b.tenants {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate.Token)) == 1 {
+			t = candidate
+		}
+	}
+	return t, true, false
+}
+
+// tenantRoutes are the routes tenants may call. The scoped ones (true)
+// require a tenant token and see only the tenant's keys; the others are open
+// to everyone.
+var tenantRoutes = map[string]bool{
+	"/set":           true,
+	"/get":           true,
+	"/getall":        true,
+	"/delete":        true,
+	"/delete-prefix": true,
+	"/mset":          true,
+	"/mget":          true,
+	"/scan":          true,
+	"/expire":        true,
+	"/ttl":           true,
+	"/persist":       true,
+	"/changes":       true,
+	"/tenant":        true,
+	"/healthz":       false,
+	"/version":       false,
+}
+
+// tenantAccess scopes requests to the tenant their token belongs to. While
+// no tenants are configured, and for requests with the admin token, it does
+// nothing. Otherwise every route but the open ones requires a token: the
+// scoped routes a tenant's, the others, which span every tenant's keys or
+// administer the cluster, the admin token. Stores present it to register.
+func (b *Broker) tenantAccess(route string, next http.HandlerFunc) http.HandlerFunc {
+	scoped, tenantRoute := tenantRoutes[route]
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		t, enabled, admin := b.tenantFor(token)
+		switch {
+		case !enabled || admin, tenantRoute && !scoped:
+			next(w, r)
+		case t == nil && scoped:
+			httpapi.Error(w, "A tenant token is required", http.StatusUnauthorized)
+		case t == nil:
+			httpapi.Error(w, "The admin token is required", http.StatusUnauthorized)
+		case scoped:
+			b.tenantRequests.Inc(t.Name)
+			next(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, t)))
+		default:
+			httpapi.Error(w, "Tenants cannot use this endpoint", http.StatusForbidden)
+		}
+	}
+}
+
+// reserve checks that writing pairs keeps t within its quota and counts them
+// towards its usage. Overwrites are counted as new keys until the usage is
+// next measured, which happens before a write is refused.
+func (b *Broker) reserve(ctx context.Context, t *tenant, pairs map[string]string) error {
+	if t == nil || t.MaxKeys == 0 && t.MaxBytes == 0 {
+		return nil
+	}
+	keys, bytes := len(pairs), 0
+	for k, v := range pairs {
+		bytes += len(k) + len(v)
+	}
+
+	for measured := false; ; measured = true {
+		t.mu.Lock()
+		if !t.over(keys, bytes) {
+			t.usage.Keys += keys
+			t.usage.Bytes += bytes
+			t.mu.Unlock()
+			return nil
+		}
+		t.mu.Unlock()
+		if measured {
+			break
+		}
+		b.measureTenant(ctx, t)
+	}
+	b.tenantRejections.Inc(t.Name)
+	return fmt.Errorf("%w: %s may hold %d keys and %d bytes", ErrQuotaExceeded, t.Name, t.MaxKeys, t.MaxBytes)
+}
+
+// measureTenant counts the tenant's keys and bytes on every store. Stores
+// that cannot be reached are left out.
+func (b *Broker) measureTenant(ctx context.Context, t *tenant) {
+	var usage kvstore.Stats
+	for _, store := range b.storeList() {
+		stats, err := b.fetchStoreStats(ctx, store.Address(), t.prefix())
+		if err != nil {
+			b.logger.Warn("failed to measure tenant usage", "tenant", t.Name, "store", store.Name(), "err", err)
+			continue
+		}
+		usage.Keys += stats.Keys
+		// Quotas count the keys as the tenant names them
+		usage.Bytes += stats.Bytes - stats.Keys*len(t.prefix())
+	}
+
+	t.mu.Lock()
+	t.usage, t.measured = usage, time.Now()
+	t.mu.Unlock()
+	b.tenantKeys.Set(float64(usage.Keys), t.Name)
+	b.tenantBytes.Set(float64(usage.Bytes), t.Name)
+}
+
+// TenantUsage measures and returns the usage of every tenant.
+func (b *Broker) TenantUsage(ctx context.Context) []TenantUsage {
+	b.mu.RLock()
+	tenants := append([]*tenant(nil), b.tenants...)
+	b.mu.RUnlock()
+
+	usage := make([]TenantUsage, 0, len(tenants))
+	for _, t := range tenants {
+		b.measureTenant(ctx, t)
+		usage = append(usage, t.status())
+	}
+	return usage
+}
@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"kv/qos"
+	"net/http"
+)
+
+// moveBatchSize is the number of pairs the broker writes per request when
+// moving keys between stores.
+const moveBatchSize = 1000
+
+// movePasses is how many times a drain or merge moves the keys the store
+// still holds, written to it while the previous pass ran, before giving up.
+const movePasses = 3
+
+// applyBackgroundLimit gives the named store the configured background
+// limit, if one is set.
+func (b *Broker) applyBackgroundLimit(ctx context.Context, name string) {
+	b.mu.RLock()
+	limit := b.config.BackgroundLimit
+	b.mu.RUnlock()
+	if limit != nil {
+		b.setStoreBackgroundLimit(ctx, name, *limit)
+	}
+}
+
+// setStoreBackgroundLimit paces the named store's background work to limit.
+func (b *Broker) setStoreBackgroundLimit(ctx context.Context, name string, limit qos.Limit) {
+	store, err := b.GetStore(name)
+	if err != nil {
+		return
+	}
+	resp, err := b.storeRequest(ctx, http.MethodPost, store.Address(), "/background-limit", limit)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("background-limit returned status: %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		b.logger.Warn("failed to set background limit", "store", name, "err", err)
+	}
+}
@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"kv/kvstore"
+	"net/http"
+	"time"
+)
+
+// recordTombstones tells every store holding a backup of the named store
+// that keys were deleted from it, so taking over that backup does not bring
+// them back. It returns the holders that recorded them and those that could
+// not be reached; the keys are deleted all the same, and those holders are
+// sent the tombstones once they are back.
+func (b *Broker) recordTombstones(ctx context.Context, name string, keys ...string) (recorded, missed []string) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	at := time.Now()
+	b.mu.RLock()
+	holders := b.peerlist.Holders(name, b.backups())
+	b.mu.RUnlock()
+
+	for _, holder := range holders {
+		if holder.IpAddress == "" {
+			continue
+		}
+		resp, err := b.storeRequest(ctx, http.MethodPost, holder.IpAddress, "/tombstones", kvstore.TombstonesRequest{Peer: name, Keys: keys})
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("tombstones returned status: %d", resp.StatusCode)
+			}
+		}
+		if err != nil {
+			b.logger.Warn("failed to record tombstones on backup holder", "store", name, "holder", holder.Name, "keys", len(keys), "err", err)
+			b.pendTombstones(holder.Name, name, at, keys...)
+			missed = append(missed, holder.Name)
+			continue
+		}
+		recorded = append(recorded, holder.Name)
+	}
+	return recorded, missed
+}
@@ -0,0 +1,41 @@
+package broker
+
+import "sort"
+
+// TopologyStore is a store as seen by clients that read from stores directly.
+type TopologyStore struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	// Up is false once the health checker has marked the store DOWN.
+	Up bool `json:"up"`
+	// Draining stores are being emptied and should not be read from.
+	Draining bool `json:"draining,omitempty"`
+	// Warming stores are still loading their data and should not be read from.
+	Warming bool `json:"warming,omitempty"`
+}
+
+// Topology lists the registered stores and their addresses. Keys are placed by
+// load rather than by hash, so clients learn which store holds a key from the
+// "store" field of GET /get and use the topology to reach it.
+type Topology struct {
+	Stores []TopologyStore `json:"stores"`
+}
+
+// Topology returns the current store membership.
+func (b *Broker) Topology() Topology {
+	b.mu.RLock()
+	stores := make([]TopologyStore, 0, len(b.stores))
+	for name, store := range b.stores {
+		stores = append(stores, TopologyStore{
+			Name:     name,
+			Address:  store.Address(),
+			Up:       b.health[name].Status != StatusDown,
+			Draining: b.draining[name],
+			Warming:  b.warming[name],
+		})
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Name < stores[j].Name })
+	return Topology{Stores: stores}
+}
@@ -0,0 +1,204 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"kv/logging"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+)
+
+var (
+	// ErrNotInTrash is returned when undeleting a key no store holds in its
+	// trash, because soft delete is off, the key was purged or it was
+	// never deleted.
+	ErrNotInTrash = errors.New("key not in trash")
+	// ErrKeyExists is returned when undeleting a key written again since
+	// it was deleted; the newer value is kept.
+	ErrKeyExists = errors.New("key was written again since it was deleted")
+)
+
+// TrashedKey is a deleted key held in the trash of the named store.
+type TrashedKey struct {
+	kvstore.TrashedKey
+	Store string `json:"store"`
+}
+
+// TrashReport is the response of GET /trash.
+type TrashReport struct {
+	Keys []TrashedKey `json:"keys"`
+}
+
+// UndeleteResult is what Undelete restored, in all and on each store.
+type UndeleteResult struct {
+	Restored int            `json:"restored"`
+	Stores   map[string]int `json:"stores"`
+	// Skipped are the keys left in the trash because they were written
+	// again since they were deleted.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// Trash lists the deleted keys starting with prefix held in the stores'
+// trash, in key order. A store that fails does not stop the others; the
+// error names it.
+func (b *Broker) Trash(ctx context.Context, prefix string) (TrashReport, error) {
+	report := TrashReport{Keys: make([]TrashedKey, 0)}
+	b.mu.RLock()
+	targets := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		targets[name] = store.Address()
+	}
+	b.mu.RUnlock()
+	if len(targets) == 0 {
+		return report, ErrNoStores
+	}
+
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(targets)) {
+		resp, err := b.storeRequest(ctx, http.MethodGet, targets[name], "/trash?prefix="+url.QueryEscape(prefix), nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error contacting KVStore %s: %w", name, err))
+			continue
+		}
+		var trash kvstore.TrashResponse
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("KVStore %s returned status: %d", name, resp.StatusCode)
+		} else if err = json.NewDecoder(resp.Body).Decode(&trash); err != nil {
+			err = fmt.Errorf("error decoding trash from %s: %w", name, err)
+		}
+		resp.Body.Close()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, key := range trash.Keys {
+			report.Keys = append(report.Keys, TrashedKey{TrashedKey: key, Store: name})
+		}
+	}
+	sort.SliceStable(report.Keys, func(i, j int) bool { return report.Keys[i].Key < report.Keys[j].Key })
+	return report, errors.Join(errs...)
+}
+
+// Undelete restores the deleted keys starting with prefix, or with exact the
+// key prefix alone, from the stores' trash to the stores they were deleted
+// from. Keys written again since they were deleted are skipped, so a newer
+// value is never replaced. A key in the trash of several stores, deleted
+// again after being written to another, is restored as last deleted.
+func (b *Broker) Undelete(ctx context.Context, prefix string, exact bool) (UndeleteResult, error) {
+	result := UndeleteResult{Stores: make(map[string]int)}
+	trash, err := b.Trash(ctx, prefix)
+	if err != nil {
+		return result, err
+	}
+	latest := make(map[string]TrashedKey)
+	for _, key := range trash.Keys {
+		if exact && key.Key != prefix {
+			continue
+		}
+		if prev, ok := latest[key.Key]; !ok || key.Deleted.After(prev.Deleted) {
+			latest[key.Key] = key
+		}
+	}
+	if len(latest) == 0 {
+		if exact {
+			return result, fmt.Errorf("%w: %s", ErrNotInTrash, prefix)
+		}
+		return result, nil
+	}
+
+	keys := slices.Sorted(maps.Keys(latest))
+	existing, err := b.GetKeys(ctx, keys)
+	if err != nil {
+		return result, fmt.Errorf("failed to check for keys written since: %w", err)
+	}
+	batches := make(map[string][]string)
+	for _, key := range keys {
+		if _, ok := existing[key]; ok {
+			result.Skipped = append(result.Skipped, key)
+			continue
+		}
+		store := latest[key].Store
+		batches[store] = append(batches[store], key)
+	}
+
+	if err := b.validateUndelete(ctx, batches); err != nil {
+		return result, err
+	}
+
+	restored := make(map[string]string)
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(batches)) {
+		undeleted, err := b.undeleteOn(ctx, name, kvstore.UndeleteRequest{Keys: batches[name]})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(undeleted.Restored) > 0 {
+			b.noteWrites(name, slices.Collect(maps.Keys(undeleted.Restored))...)
+			b.addLoad(name, len(undeleted.Restored))
+			maps.Copy(restored, undeleted.Restored)
+		}
+		result.Stores[name] = len(undeleted.Restored)
+		result.Restored += len(undeleted.Restored)
+		result.Skipped = append(result.Skipped, undeleted.Skipped...)
+	}
+	sort.Strings(result.Skipped)
+	b.shadowSet(restored)
+	if result.Restored > 0 {
+		b.logger.Info("keys restored from trash", "prefix_hash", logging.KeyHash(prefix), "keys", result.Restored)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return result, err
+	}
+	if exact && result.Restored == 0 {
+		return result, fmt.Errorf("%w: %s", ErrKeyExists, prefix)
+	}
+	return result, nil
+}
+
+// validateUndelete checks the pairs each store would restore from its batch
+// of keys against the validation rules, before any store restores them.
+func (b *Broker) validateUndelete(ctx context.Context, batches map[string][]string) error {
+	b.mu.RLock()
+	rules := len(b.validation)
+	b.mu.RUnlock()
+	if rules == 0 {
+		return nil
+	}
+	pairs := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(batches)) {
+		restorable, err := b.undeleteOn(ctx, name, kvstore.UndeleteRequest{Keys: batches[name], DryRun: true})
+		if err != nil {
+			return err
+		}
+		maps.Copy(pairs, restorable.Restored)
+	}
+	return b.validateWrites(pairs)
+}
+
+// undeleteOn sends req to the named store's /undelete.
+func (b *Broker) undeleteOn(ctx context.Context, name string, req kvstore.UndeleteRequest) (kvstore.UndeleteResponse, error) {
+	var undeleted kvstore.UndeleteResponse
+	store, err := b.GetStore(name)
+	if err != nil {
+		return undeleted, err
+	}
+	resp, err := b.storeRequest(ctx, http.MethodPost, store.Address(), "/undelete", req)
+	if err != nil {
+		return undeleted, fmt.Errorf("error contacting KVStore %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return undeleted, fmt.Errorf("KVStore %s returned status: %d", name, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&undeleted); err != nil {
+		return undeleted, fmt.Errorf("error decoding undelete from %s: %w", name, err)
+	}
+	return undeleted, nil
+}
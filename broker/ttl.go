@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/logging"
+	"net/http"
+	"net/url"
+)
+
+// Errors returned by broker operations, so handlers can pick a status code.
+var (
+	// ErrKeyNotFound is returned when no store holds the requested key.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrStoreNotFound is returned for a store name that is not registered.
+	ErrStoreNotFound = errors.New("store not found")
+	// ErrStoreExists is returned when registering a name already in use at another address that still answers.
+	ErrStoreExists = errors.New("store with this name already exists")
+	// ErrNoStores is returned when no store can take a write.
+	ErrNoStores = errors.New("no stores available")
+)
+
+// locateKey returns the name and address of a store holding key.
+func (b *Broker) locateKey(ctx context.Context, key string) (string, string, error) {
+	b.mu.RLock()
+	targets := make(map[string]string, len(b.stores))
+	for name, store := range b.stores {
+		targets[name] = store.Address()
+	}
+	b.mu.RUnlock()
+
+	contacted := 0
+	defer func() { b.readFanout.Observe(float64(contacted), "locate") }()
+	for name, addr := range targets {
+		contacted++
+		resp, err := b.storeRequest(ctx, http.MethodGet, addr, "/get?key="+url.QueryEscape(key), nil)
+		if err != nil {
+			logging.FromContext(ctx, b.logger).Error("error contacting store", "store", name, "address", addr, "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return name, addr, nil
+		}
+	}
+	return "", "", ErrKeyNotFound
+}
+
+// ttlRequest sends a TTL operation for key to the store holding it and decodes the reply into out.
+func (b *Broker) ttlRequest(ctx context.Context, method, key, path string, body, out interface{}) error {
+	name, addr, err := b.locateKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	resp, err := b.storeRequest(ctx, method, addr, path, body)
+	if err != nil {
+		return fmt.Errorf("error contacting KVStore at %s: %w", addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrKeyNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("KVStore %s returned status: %d", name, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Expire sets key to be deleted after the given number of seconds.
+func (b *Broker) Expire(ctx context.Context, key string, seconds int) error {
+	var result map[string]interface{}
+	body := map[string]interface{}{"key": key, "seconds": seconds}
+	// Copies would outlive the key
+	b.forgetHotCopies(key)
+	return b.ttlRequest(ctx, http.MethodPost, key, "/expire", body, &result)
+}
+
+// TTL returns the seconds left before key expires, or -1 if it has no TTL.
+func (b *Broker) TTL(ctx context.Context, key string) (int, error) {
+	var result struct {
+		TTL int `json:"ttl"`
+	}
+	if err := b.ttlRequest(ctx, http.MethodGet, key, "/ttl?key="+url.QueryEscape(key), nil, &result); err != nil {
+		return 0, err
+	}
+	return result.TTL, nil
+}
+
+// Persist removes key's TTL and reports whether it had one.
+func (b *Broker) Persist(ctx context.Context, key string) (bool, error) {
+	var result struct {
+		Persisted bool `json:"persisted"`
+	}
+	body := map[string]string{"key": key}
+	if err := b.ttlRequest(ctx, http.MethodPost, key, "/persist", body, &result); err != nil {
+		return false, err
+	}
+	return result.Persisted, nil
+}
@@ -0,0 +1,23 @@
+package broker
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// ui is the admin dashboard: a single page that calls the broker's JSON API
+// for the cluster status, distribution, events, change feed, failovers and
+// jobs.
+//
+//go:embed ui
+var ui embed.FS
+
+// uiHandler serves the dashboard under /ui/.
+func uiHandler() http.Handler {
+	files, err := fs.Sub(ui, "ui")
+	if err != nil {
+		panic(err) // the directory is embedded above
+	}
+	return http.StripPrefix("/ui/", http.FileServerFS(files))
+}
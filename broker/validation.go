@@ -0,0 +1,212 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/schema"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrValidationFailed is returned for a write a validation rule refuses.
+var ErrValidationFailed = errors.New("write refused by a validation rule")
+
+// ValidationRule constrains the writes to the keys starting with Prefix, or
+// to every key if it is empty. Writes are checked against every rule whose
+// prefix they match before they reach a store. Keys are checked as the
+// client names them, without a tenant's prefix.
+type ValidationRule struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix,omitempty"`
+	// KeyPattern is a regular expression the keys must match; anchor it
+	// with ^ and $ to match whole keys.
+	KeyPattern string `json:"key_pattern,omitempty"`
+	// MaxValueBytes caps the length of the values; zero means no limit.
+	MaxValueBytes int `json:"max_value_bytes,omitempty"`
+	// Schema is a JSON Schema the values must be JSON documents satisfying;
+	// see package schema for the keywords supported.
+	Schema json.RawMessage `json:"schema,omitempty"`
+}
+
+// Validate reports every problem with the rule at once.
+func (r ValidationRule) Validate() error {
+	_, err := r.compile()
+	return err
+}
+
+func (r ValidationRule) equal(o ValidationRule) bool {
+	return r.Name == o.Name && r.Prefix == o.Prefix && r.KeyPattern == o.KeyPattern &&
+		r.MaxValueBytes == o.MaxValueBytes && bytes.Equal(r.Schema, o.Schema)
+}
+
+// ValidationError is the ErrValidationFailed error for one key, reported
+// as the details of the error response.
+type ValidationError struct {
+	Rule   string `json:"rule"`
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("key %q refused by rule %q: %s", e.Key, e.Rule, e.Reason)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidationFailed
+}
+
+// validationRule is a rule with its pattern and schema compiled.
+type validationRule struct {
+	ValidationRule
+	key      *regexp.Regexp
+	schema   *schema.Schema
+	rejected atomic.Uint64
+}
+
+func (r ValidationRule) compile() (*validationRule, error) {
+	var errs []error
+	rule := &validationRule{ValidationRule: r}
+	if r.Name == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if r.KeyPattern != "" {
+		re, err := regexp.Compile(r.KeyPattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("key_pattern: %w", err))
+		}
+		rule.key = re
+	}
+	if r.MaxValueBytes < 0 {
+		errs = append(errs, errors.New("max_value_bytes must not be negative"))
+	}
+	if len(r.Schema) > 0 {
+		s, err := schema.Parse(r.Schema)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("schema: %w", err))
+		}
+		rule.schema = s
+	}
+	if r.KeyPattern == "" && r.MaxValueBytes == 0 && len(r.Schema) == 0 {
+		errs = append(errs, errors.New("one of key_pattern, max_value_bytes or schema is required"))
+	}
+	return rule, errors.Join(errs...)
+}
+
+// check returns why the rule refuses value for key, or "" if it accepts it.
+func (r *validationRule) check(key, value string) string {
+	if r.key != nil && !r.key.MatchString(key) {
+		return fmt.Sprintf("key does not match %q", r.KeyPattern)
+	}
+	if r.MaxValueBytes > 0 && len(value) > r.MaxValueBytes {
+		return fmt.Sprintf("value is %d bytes, over the limit of %d", len(value), r.MaxValueBytes)
+	}
+	if r.schema != nil {
+		if err := r.schema.Validate([]byte(value)); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// validateRules reports every problem with rules at once, naming each by its
+// index.
+func validateRules(rules []ValidationRule) error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, r := range rules {
+		if err := r.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("validation[%d]: %w", i, err))
+		}
+		if r.Name != "" && names[r.Name] {
+			errs = append(errs, fmt.Errorf("validation[%d]: duplicate name %q", i, r.Name))
+		}
+		names[r.Name] = true
+	}
+	return errors.Join(errs...)
+}
+
+// SetValidationRules replaces the rules writes are checked against. Rules
+// keep their rejection counts across replacements by name. Invalid rules
+// are refused and the current ones kept.
+func (b *Broker) SetValidationRules(rules []ValidationRule) error {
+	if err := validateRules(rules); err != nil {
+		return err
+	}
+	compiled := make([]*validationRule, 0, len(rules))
+	for _, r := range rules {
+		rule, _ := r.compile()
+		compiled = append(compiled, rule)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, rule := range compiled {
+		for _, prev := range b.validation {
+			if prev.Name == rule.Name {
+				rule.rejected.Store(prev.rejected.Load())
+			}
+		}
+	}
+	b.validation = compiled
+	return nil
+}
+
+// ValidationRuleStatus is a validation rule and the writes it refused.
+type ValidationRuleStatus struct {
+	ValidationRule
+	Rejected uint64 `json:"rejected"`
+}
+
+// ValidationReport is the response of GET /validation.
+type ValidationReport struct {
+	Rules []ValidationRuleStatus `json:"rules"`
+}
+
+// ValidationRules reports the rules writes are checked against.
+func (b *Broker) ValidationRules() ValidationReport {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	report := ValidationReport{Rules: make([]ValidationRuleStatus, 0, len(b.validation))}
+	for _, rule := range b.validation {
+		report.Rules = append(report.Rules, ValidationRuleStatus{ValidationRule: rule.ValidationRule, Rejected: rule.rejected.Load()})
+	}
+	return report
+}
+
+// validateWrites checks pairs, keyed as the client named them, against the
+// validation rules. The first key refused, in key order, is reported as a
+// *ValidationError and none of the pairs should be written.
+func (b *Broker) validateWrites(pairs map[string]string) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.validation) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, rule := range b.validation {
+			if !strings.HasPrefix(k, rule.Prefix) {
+				continue
+			}
+			if reason := rule.check(k, pairs[k]); reason != "" {
+				rule.rejected.Add(1)
+				b.validationRejections.Inc(rule.Name)
+				return &ValidationError{Rule: rule.Name, Key: k, Reason: reason}
+			}
+		}
+	}
+	return nil
+}
+
+func validationEqual(a, b []ValidationRule) bool {
+	return slices.EqualFunc(a, b, ValidationRule.equal)
+}
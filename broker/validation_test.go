@@ -0,0 +1,176 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidationRules(t *testing.T) {
+	rules := []ValidationRule{
+		{Name: "user-keys", Prefix: "user:", KeyPattern: `^user:[0-9]+$`},
+		{Name: "small-sessions", Prefix: "session/", MaxValueBytes: 8},
+		{Name: "orders", Prefix: "order/", Schema: json.RawMessage(`{
+			"type": "object",
+			"required": ["id", "total"],
+			"properties": {"id": {"type": "string"}, "total": {"type": "number", "minimum": 0}},
+			"additionalProperties": false
+		}`)},
+		{Name: "no-spaces", KeyPattern: `^\S+$`},
+		{Name: "small-counts", Prefix: "count-", MaxValueBytes: 1},
+	}
+	// Each write goes through a route: /set; /counter/{key}/incr by value
+	// from zero; or /undelete of the pair deleted from a store.
+	tests := []struct {
+		name  string
+		route string
+		key   string
+		value string
+		rule  string // the rule refusing the write, if any
+	}{
+		{"key pattern matched", "set", "user:42", "alice", ""},
+		{"key pattern not matched", "set", "user:alice", "alice", "user-keys"},
+		{"value within the limit", "set", "session/a", "12345678", ""},
+		{"value over the limit", "set", "session/a", "123456789", "small-sessions"},
+		{"schema satisfied", "set", "order/1", `{"id": "1", "total": 9.5}`, ""},
+		{"schema missing a property", "set", "order/1", `{"id": "1"}`, "orders"},
+		{"schema with a wrong type", "set", "order/1", `{"id": 1, "total": 9.5}`, "orders"},
+		{"schema under the minimum", "set", "order/1", `{"id": "1", "total": -1}`, "orders"},
+		{"schema with an extra property", "set", "order/1", `{"id": "1", "total": 1, "note": "x"}`, "orders"},
+		{"schema given no JSON", "set", "order/1", `not json`, "orders"},
+		{"other prefixes unconstrained", "set", "misc", strings.Repeat("x", 100), ""},
+		{"rule without a prefix", "set", "has space", "v", "no-spaces"},
+		{"every matching rule applies", "set", "user:4 2", "v", "user-keys"},
+		{"counter within the limit", "incr", "count-a", "9", ""},
+		{"counter over the limit", "incr", "count-b", "10", "small-counts"},
+		{"counter key pattern not matched", "incr", "user:hits", "1", "user-keys"},
+		{"undelete within the limit", "undelete", "session/b", "12345678", ""},
+		{"undelete over the limit", "undelete", "session/c", "123456789", "small-sessions"},
+		{"undelete key pattern not matched", "undelete", "user:bob", "bob", "user-keys"},
+	}
+
+	b, _, stores := memoryBroker(t, 2)
+	if err := b.SetValidationRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		s.SetTrashRetention(time.Hour)
+	}
+	h := NewBrokerHandler(b)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			var body []byte
+			switch tt.route {
+			case "set":
+				path = "/set"
+				body, _ = json.Marshal(map[string]string{"key": tt.key, "value": tt.value})
+			case "incr":
+				path = "/counter/" + tt.key + "/incr"
+				body = []byte(`{"delta": ` + tt.value + `}`)
+			case "undelete":
+				if err := stores["store0"].Set(tt.key, tt.value); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := b.DeleteKey(context.Background(), tt.key); err != nil {
+					t.Fatal(err)
+				}
+				path = "/undelete"
+				body, _ = json.Marshal(map[string]string{"key": tt.key})
+			}
+			code, problem := serveProblem(t, h, path, string(body))
+			switch {
+			case tt.rule == "" && code != http.StatusOK:
+				t.Errorf("%s %q = %q: status %d (%s), want 200", tt.route, tt.key, tt.value, code, problem.Detail)
+			case tt.rule != "" && code != http.StatusUnprocessableEntity:
+				t.Errorf("%s %q = %q: status %d, want 422", tt.route, tt.key, tt.value, code)
+			case tt.rule != "" && problem.Details.Rule != tt.rule:
+				t.Errorf("%s %q = %q refused by %+v, want rule %s", tt.route, tt.key, tt.value, problem.Details, tt.rule)
+			}
+			value, err := b.GetKey(context.Background(), tt.key)
+			if written := err == nil && value == tt.value; written != (tt.rule == "") {
+				t.Errorf("write of %q = %q reached a store: %v, want %v", tt.key, tt.value, written, tt.rule == "")
+			}
+		})
+	}
+}
+
+func TestValidationRefusesWholeMSet(t *testing.T) {
+	b, _, _ := memoryBroker(t, 2)
+	if err := b.SetValidationRules([]ValidationRule{{Name: "small", MaxValueBytes: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	h := NewBrokerHandler(b)
+
+	code, problem := serveProblem(t, h, "/mset", `{"pairs": {"a": "ok", "b": "too long", "c": "ok"}}`)
+	if code != http.StatusUnprocessableEntity || problem.Details.Key != "b" || problem.Details.Rule != "small" {
+		t.Errorf("mset: status %d, details %+v; want 422 for b by small", code, problem.Details)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := b.GetKey(context.Background(), key); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("%s written by an mset a rule refused: %v", key, err)
+		}
+	}
+	if code, _ := serveProblem(t, h, "/mset", `{"pairs": {"a": "ok", "c": "ok"}}`); code != http.StatusOK {
+		t.Errorf("valid mset: status %d, want 200", code)
+	}
+	if rejected := b.ValidationRules().Rules[0].Rejected; rejected != 1 {
+		t.Errorf("rule counted %d rejections, want 1", rejected)
+	}
+}
+
+func TestValidationRulesRefusedWhenInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []ValidationRule
+	}{
+		{"no name", []ValidationRule{{KeyPattern: ".*"}}},
+		{"no constraint", []ValidationRule{{Name: "empty", Prefix: "a"}}},
+		{"bad key pattern", []ValidationRule{{Name: "re", KeyPattern: "("}}},
+		{"negative size", []ValidationRule{{Name: "size", MaxValueBytes: -1}}},
+		{"bad schema", []ValidationRule{{Name: "schema", Schema: json.RawMessage(`{"oneOf": []}`)}}},
+		{"duplicate names", []ValidationRule{{Name: "a", MaxValueBytes: 1}, {Name: "a", MaxValueBytes: 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _, _ := memoryBroker(t, 1)
+			kept := []ValidationRule{{Name: "kept", MaxValueBytes: 10}}
+			if err := b.SetValidationRules(kept); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.SetValidationRules(tt.rules); err == nil {
+				t.Fatal("invalid rules accepted")
+			}
+			if rules := b.ValidationRules().Rules; len(rules) != 1 || rules[0].Name != "kept" {
+				t.Errorf("rules after refusing invalid ones = %+v, want kept", rules)
+			}
+		})
+	}
+}
+
+// validationProblem is the problem a write a rule refused is answered with.
+type validationProblem struct {
+	Detail  string          `json:"detail"`
+	Details ValidationError `json:"details"`
+}
+
+// serveProblem posts body to path, asking for problems, and returns the
+// response status and problem, if any.
+func serveProblem(t *testing.T, h http.Handler, path, body string) (int, validationProblem) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1"+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/problem+json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var problem validationProblem
+	if rec.Code != http.StatusOK {
+		json.Unmarshal(rec.Body.Bytes(), &problem)
+	}
+	return rec.Code, problem
+}
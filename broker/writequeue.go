@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kv/kvstore"
+	"time"
+)
+
+// Write queueing: with a write queue configured, a write that no store can
+// take at the moment, because every store is down, warming, draining or has
+// just turned writes away as busy, waits for one to free up instead of
+// failing at once. The queue is bounded in depth and in how long a write may
+// wait, so short blips are smoothed over while a lasting outage still fails
+// the writes. Only writes no store has seen are queued: a write that failed
+// after reaching a store may have been taken, and is not sent again.
+
+var (
+	// ErrStoreBusy is returned when a store turns a write away because it is
+	// serving as many requests as it will take.
+	ErrStoreBusy = errors.New("store is busy")
+	// ErrWriteQueueFull is returned for a write no store could take while
+	// as many writes as the queue holds were already waiting.
+	ErrWriteQueueFull = errors.New("write queue is full")
+)
+
+// busyBackoff is how long a store that turned a write away as busy is given
+// no new keys, matching the Retry-After it answers with.
+const busyBackoff = time.Second
+
+// writeRetryInterval is how often a queued write looks for a store to take it.
+const writeRetryInterval = 50 * time.Millisecond
+
+// WriteQueueConfig sets how writes wait when no store can take them.
+type WriteQueueConfig struct {
+	// MaxWait is how long a write may wait for a store before it fails,
+	// e.g. "2s".
+	MaxWait kvstore.Duration `json:"max_wait"`
+	// MaxDepth is how many writes may wait at once (default 1000). Writes
+	// beyond it fail at once.
+	MaxDepth int `json:"max_depth,omitempty"`
+}
+
+// Validate reports every problem with the settings at once.
+func (c WriteQueueConfig) Validate() error {
+	var errs []error
+	if c.MaxWait <= 0 {
+		errs = append(errs, errors.New("max_wait must be positive"))
+	}
+	if c.MaxDepth < 0 {
+		errs = append(errs, errors.New("max_depth must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (c WriteQueueConfig) maxDepth() int64 {
+	if c.MaxDepth > 0 {
+		return int64(c.MaxDepth)
+	}
+	return 1000
+}
+
+func writeQueueEqual(a, b *WriteQueueConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// queueWrite runs write and, if no store could take it and a write queue is
+// configured, runs it again every writeRetryInterval until a store takes
+// it, it fails otherwise, or the queue's max_wait has passed.
+func (b *Broker) queueWrite(ctx context.Context, write func() error) error {
+	err := write()
+	if err == nil || !queueable(err) {
+		return err
+	}
+	b.mu.RLock()
+	cfg := b.config.WriteQueue
+	b.mu.RUnlock()
+	if cfg == nil {
+		return err
+	}
+	if b.queuedWrites.Add(1) > cfg.maxDepth() {
+		b.queuedWrites.Add(-1)
+		b.writeQueueOutcomes.Inc("rejected")
+		return fmt.Errorf("%w: %w", ErrWriteQueueFull, err)
+	}
+	defer b.queuedWrites.Add(-1)
+
+	maxWait := time.Duration(cfg.MaxWait)
+	deadline := time.NewTimer(maxWait)
+	defer deadline.Stop()
+	ticker := time.NewTicker(writeRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			b.writeQueueOutcomes.Inc("canceled")
+			return fmt.Errorf("%w while waiting for a store: %w", ctx.Err(), err)
+		case <-deadline.C:
+			b.writeQueueOutcomes.Inc("expired")
+			return fmt.Errorf("no store took the write within %s: %w", maxWait, err)
+		case <-ticker.C:
+		}
+		switch err = write(); {
+		case err == nil:
+			b.writeQueueOutcomes.Inc("written")
+			return nil
+		case !queueable(err):
+			b.writeQueueOutcomes.Inc("failed")
+			return err
+		}
+	}
+}
+
+// queueable reports whether err means no store took the write, so it may
+// wait for one.
+func queueable(err error) bool {
+	return errors.Is(err, ErrNoStores) || errors.Is(err, ErrStoreBusy)
+}
+
+// backOff gives the named store, which turned a write away as busy, no new
+// keys for busyBackoff.
+func (b *Broker) backOff(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.stores[name]; exists {
+		b.busy[name] = time.Now().Add(busyBackoff)
+	}
+}
+
+// takesWrites reports whether the named store may be given new keys: it is
+// not draining, warming, DOWN or backing off after turning writes away.
+// b.mu must be held.
+func (b *Broker) takesWrites(name string) bool {
+	return !b.draining[name] && !b.warming[name] && b.health[name].Status != StatusDown &&
+		!time.Now().Before(b.busy[name])
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Batcher coalesces Sets and Gets issued within a short window into one MSet
+// and one MGet call, cutting the per-request overhead of chatty callers.
+// Each Set and Get still blocks until its batch has been sent. Sets in a
+// batch are applied before its Gets, so a Get sees an earlier Set. The
+// broker writes each key of an MSet to the store holding it, as it does for
+// a Set. A call whose context carries options a batch cannot honour, such as
+// WithAck, WithIdempotencyKey or WithMaxStaleness, is not batched and goes
+// straight to the client.
+type Batcher struct {
+	client   *Client
+	window   time.Duration
+	maxBatch int
+
+	flushMu sync.Mutex // keeps batches in order
+
+	mu         sync.Mutex
+	sets       map[string]string
+	setWaiters []chan error
+	gets       map[string][]chan getResult
+	timer      *time.Timer
+	closed     bool
+}
+
+type getResult struct {
+	value string
+	err   error
+}
+
+// NewBatcher returns a Batcher sending a batch window after its first
+// operation, or as soon as it holds maxBatch keys.
+func (c *Client) NewBatcher(window time.Duration, maxBatch int) *Batcher {
+	return &Batcher{
+		client:   c,
+		window:   window,
+		maxBatch: maxBatch,
+		sets:     make(map[string]string),
+		gets:     make(map[string][]chan getResult),
+	}
+}
+
+// Set stores value under key as part of the next batch. If key is set
+// several times in one batch the last value wins.
+func (b *Batcher) Set(ctx context.Context, key, value string) error {
+	done := make(chan error, 1)
+	b.mu.Lock()
+	if b.closed || !batchableSet(ctx) {
+		b.mu.Unlock()
+		return b.client.Set(ctx, key, value)
+	}
+	b.sets[key] = value
+	b.setWaiters = append(b.setWaiters, done)
+	b.scheduleLocked()
+	b.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Get returns the value of key, read as part of the next batch, or ErrNotFound.
+func (b *Batcher) Get(ctx context.Context, key string) (string, error) {
+	done := make(chan getResult, 1)
+	b.mu.Lock()
+	if b.closed || !batchableGet(ctx) {
+		b.mu.Unlock()
+		return b.client.Get(ctx, key)
+	}
+	b.gets[key] = append(b.gets[key], done)
+	b.scheduleLocked()
+	b.mu.Unlock()
+
+	select {
+	case result := <-done:
+		return result.value, result.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// batchableSet reports whether a Set made with ctx may join a batch: the
+// batch is sent as one MSet with none of the per-call settings.
+func batchableSet(ctx context.Context) bool {
+	level, _ := ctx.Value(ackContextKey{}).(string)
+	idemKey, _ := ctx.Value(idempotencyKeyContextKey{}).(string)
+	return (level == "" || level == AckLocal) && idemKey == ""
+}
+
+// batchableGet reports whether a Get made with ctx may join a batch, whose
+// MGet reads from the stores themselves.
+func batchableGet(ctx context.Context) bool {
+	_, bounded := ctx.Value(maxStalenessContextKey{}).(time.Duration)
+	return !bounded
+}
+
+// scheduleLocked starts the window timer for a new batch, or sends a full
+// batch right away.
+func (b *Batcher) scheduleLocked() {
+	if b.maxBatch > 0 && len(b.sets)+len(b.gets) >= b.maxBatch {
+		if b.timer != nil {
+			b.timer.Stop()
+			b.timer = nil
+		}
+		go b.Flush()
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, b.Flush)
+	}
+}
+
+// Flush sends the pending batch now.
+func (b *Batcher) Flush() {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	sets, setWaiters, gets := b.sets, b.setWaiters, b.gets
+	b.sets = make(map[string]string)
+	b.setWaiters = nil
+	b.gets = make(map[string][]chan getResult)
+	b.mu.Unlock()
+
+	// Waiters may have given up, so the batch runs on its own context; the
+	// client's HTTP timeout still bounds it
+	ctx := context.Background()
+	if len(sets) > 0 {
+		err := b.client.MSet(ctx, sets)
+		for _, done := range setWaiters {
+			done <- err
+		}
+	}
+	if len(gets) > 0 {
+		keys := make([]string, 0, len(gets))
+		for key := range gets {
+			keys = append(keys, key)
+		}
+		values, err := b.client.MGet(ctx, keys)
+		for key, waiters := range gets {
+			result := getResult{err: err}
+			if err == nil {
+				value, ok := values[key]
+				result = getResult{value: value}
+				if !ok {
+					result.err = ErrNotFound
+				}
+			}
+			for _, done := range waiters {
+				done <- result
+			}
+		}
+	}
+}
+
+// Close sends the pending batch. Later Sets and Gets go straight to the client.
+func (b *Batcher) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.Flush()
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// changesPageLimit is the number of changes per store requested on each
+// page while following the change feed.
+const changesPageLimit = 1000
+
+const (
+	// DefaultCacheTTL is the cache's TTL when CacheOptions sets none.
+	DefaultCacheTTL = time.Minute
+	// DefaultCachePollInterval is how often the cache reads the change feed
+	// when CacheOptions sets no interval.
+	DefaultCachePollInterval = time.Second
+)
+
+// CacheOptions configures the client's read cache.
+type CacheOptions struct {
+	// TTL bounds how long a value is served from the cache, even if no change
+	// to it is seen; zero means DefaultCacheTTL.
+	TTL time.Duration
+	// MaxEntries bounds the cache size; zero means unbounded.
+	MaxEntries int
+	// PollInterval is how often the change feed is read for invalidations;
+	// zero means DefaultCachePollInterval.
+	PollInterval time.Duration
+}
+
+// withDefaults returns opts with the defaults for the fields it leaves
+// zero, or an error if a field is negative.
+func (opts CacheOptions) withDefaults() (CacheOptions, error) {
+	switch {
+	case opts.TTL < 0:
+		return opts, fmt.Errorf("cache TTL cannot be negative: %s", opts.TTL)
+	case opts.MaxEntries < 0:
+		return opts, fmt.Errorf("cache MaxEntries cannot be negative: %d", opts.MaxEntries)
+	case opts.PollInterval < 0:
+		return opts, fmt.Errorf("cache PollInterval cannot be negative: %s", opts.PollInterval)
+	}
+	if opts.TTL == 0 {
+		opts.TTL = DefaultCacheTTL
+	}
+	if opts.PollInterval == 0 {
+		opts.PollInterval = DefaultCachePollInterval
+	}
+	return opts, nil
+}
+
+type cacheEntry struct {
+	value   string
+	expires time.Time
+}
+
+// readCache holds values returned by Get. epoch counts invalidations, so a
+// read that raced with one does not cache the value it fetched.
+type readCache struct {
+	mu      sync.Mutex
+	opts    CacheOptions
+	entries map[string]cacheEntry
+	epoch   uint64
+}
+
+// EnableCache keeps the values returned by Get in memory for up to opts.TTL.
+// Entries are invalidated by writes through this client and by following
+// the broker's change feed, which is polled every opts.PollInterval until ctx
+// is cancelled. A store that cannot be read, or whose feed has been
+// truncated or reset, empties the whole cache. It suits read-mostly data such
+// as configuration. Call it before the client is shared between goroutines.
+// A negative option is an error.
+func (c *Client) EnableCache(ctx context.Context, opts CacheOptions) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	// Start following the feed from its current end
+	cursor, err := c.followChanges(ctx, "", nil)
+	if err != nil {
+		return err
+	}
+	rc := &readCache{opts: opts, entries: make(map[string]cacheEntry)}
+	c.cache = rc
+
+	go func() {
+		ticker := time.NewTicker(opts.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			next, err := c.followChanges(ctx, cursor, rc)
+			if err != nil {
+				// Changes may have been missed while the broker was unreachable
+				rc.clear()
+				continue
+			}
+			cursor = next
+		}
+	}()
+	return nil
+}
+
+// followChanges reads the change feed from cursor to its end, invalidating
+// changed keys in rc if it is not nil, and returns the new cursor.
+func (c *Client) followChanges(ctx context.Context, cursor string, rc *readCache) (string, error) {
+	for {
+		page, err := c.Changes(ctx, cursor, changesPageLimit)
+		if err != nil {
+			return cursor, err
+		}
+		more := false
+		for _, store := range page.Stores {
+			if rc != nil && (store.Error != "" || store.Truncated) {
+				rc.clear()
+			}
+			for _, change := range store.Changes {
+				if rc == nil {
+					continue
+				}
+				if change.Op == OpReset {
+					rc.clear()
+				} else {
+					rc.invalidate(change.Key)
+				}
+			}
+			more = more || len(store.Changes) >= changesPageLimit
+		}
+		cursor = page.Cursor
+		if !more {
+			return cursor, nil
+		}
+	}
+}
+
+// get returns a cached value and whether it was found, and the epoch to pass
+// to put when it was not.
+func (rc *readCache) get(key string) (string, bool, uint64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	entry, ok := rc.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(rc.entries, key)
+		ok = false
+	}
+	return entry.value, ok, rc.epoch
+}
+
+// put caches value unless an invalidation happened since epoch was read.
+func (rc *readCache) put(key, value string, epoch uint64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if epoch != rc.epoch {
+		return
+	}
+	if _, ok := rc.entries[key]; !ok && rc.opts.MaxEntries > 0 && len(rc.entries) >= rc.opts.MaxEntries {
+		for k := range rc.entries {
+			delete(rc.entries, k)
+			break
+		}
+	}
+	rc.entries[key] = cacheEntry{value: value, expires: time.Now().Add(rc.opts.TTL)}
+}
+
+func (rc *readCache) invalidate(keys ...string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.epoch++
+	for _, key := range keys {
+		delete(rc.entries, key)
+	}
+}
+
+func (rc *readCache) invalidatePrefix(prefix string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.epoch++
+	for key := range rc.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(rc.entries, key)
+		}
+	}
+}
+
+func (rc *readCache) clear() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.epoch++
+	rc.entries = make(map[string]cacheEntry)
+}
@@ -0,0 +1,71 @@
+package client_test
+
+import (
+	"context"
+	"kv/client"
+	"kv/testutil"
+	"testing"
+	"time"
+)
+
+func TestCacheServesUntilChangeFeedInvalidates(t *testing.T) {
+	c := testutil.New(t, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cached, writer := c.Client(), c.Client()
+
+	if err := writer.Set(ctx, "config", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	// Zero options take the defaults rather than disabling the cache
+	if err := cached.EnableCache(ctx, client.CacheOptions{}); err != nil {
+		t.Fatalf("EnableCache with zero options: %v", err)
+	}
+	if got, err := cached.Get(ctx, "config"); err != nil || got != "v1" {
+		t.Fatalf("Get = %q, %v; want v1", got, err)
+	}
+	if err := writer.Set(ctx, "config", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cached.Get(ctx, "config"); err != nil || got != "v1" {
+		t.Errorf("Get right after another client's write = %q, %v; want the cached v1", got, err)
+	}
+
+	deadline := time.Now().Add(5 * client.DefaultCachePollInterval)
+	for {
+		got, err := cached.Get(ctx, "config")
+		if err == nil && got == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Get = %q, %v; still not invalidated by the change feed", got, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := cached.Set(ctx, "config", "v3"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cached.Get(ctx, "config"); err != nil || got != "v3" {
+		t.Errorf("Get after a write through the same client = %q, %v; want v3", got, err)
+	}
+}
+
+func TestEnableCacheRefusesNegativeOptions(t *testing.T) {
+	c := testutil.New(t, 1)
+	tests := []struct {
+		name string
+		opts client.CacheOptions
+	}{
+		{"negative TTL", client.CacheOptions{TTL: -time.Second}},
+		{"negative size", client.CacheOptions{MaxEntries: -1}},
+		{"negative poll interval", client.CacheOptions{PollInterval: -time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.Client().EnableCache(context.Background(), tt.opts); err == nil {
+				t.Errorf("EnableCache(%+v) = nil, want an error", tt.opts)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Change operations reported by Changes.
+const (
+	OpSet    = "set"
+	OpDelete = "delete"
+	// OpReset means a store's whole dataset was replaced.
+	OpReset = "reset"
+)
+
+// Change is a single mutation on a store.
+type Change struct {
+	Seq   uint64    `json:"seq"`
+	Op    string    `json:"op"`
+	Key   string    `json:"key,omitempty"`
+	Value string    `json:"value,omitempty"`
+	Time  time.Time `json:"time"`
+	// Expires is when the key set expires; nil if it has no TTL.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// StoreChanges is one store's part of a Changes page.
+type StoreChanges struct {
+	Changes []Change `json:"changes"`
+	// Truncated is set when the store no longer retains every change since the
+	// cursor, so some were missed.
+	Truncated bool `json:"truncated"`
+	// Error is set when the broker could not reach the store.
+	Error string `json:"error,omitempty"`
+}
+
+// ChangesPage is a page of the cluster-wide change feed.
+type ChangesPage struct {
+	Stores map[string]StoreChanges `json:"stores"`
+	// Cursor is passed to the next Changes call to continue after this page.
+	Cursor string `json:"cursor"`
+}
+
+// Changes returns up to limit changes per store (0 for the stores' default)
+// made after cursor. Start with an empty cursor to read every retained change.
+func (c *Client) Changes(ctx context.Context, cursor string, limit int) (*ChangesPage, error) {
+	query := url.Values{}
+	query.Set("cursor", cursor)
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var page ChangesPage
+	if err := c.do(ctx, http.MethodGet, "/changes?"+query.Encode(), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
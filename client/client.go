@@ -0,0 +1,957 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kv/httpapi"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Client talks to a broker over HTTP.
+type Client struct {
+	brokers []string
+	current atomic.Int32 // index into brokers of the broker in use
+	http    *http.Client
+	retry   RetryPolicy
+	direct  *directReads
+	cache   *readCache
+	token   string
+}
+
+// New returns a client for the broker at brokerURL (e.g. "http://localhost:8080").
+func New(brokerURL string) *Client {
+	return NewMulti([]string{brokerURL})
+}
+
+// NewMulti returns a client that talks to the first of brokerURLs and fails
+// over to the next one when a broker cannot be reached or answers 503, as a
+// standby broker does.
+func NewMulti(brokerURLs []string) *Client {
+	brokers := make([]string, len(brokerURLs))
+	for i, u := range brokerURLs {
+		brokers[i] = strings.TrimRight(u, "/")
+	}
+	return &Client{
+		brokers: brokers,
+		http:    &http.Client{Timeout: DefaultTimeout},
+		retry:   DefaultRetryPolicy,
+	}
+}
+
+// DefaultTimeout bounds each request of clients returned from New, response
+// body included.
+const DefaultTimeout = 30 * time.Second
+
+// SetTimeout bounds each request the client makes, retries counted
+// separately; zero means no limit. Call it before the client is shared
+// between goroutines.
+func (c *Client) SetTimeout(d time.Duration) {
+	c.http.Timeout = d
+}
+
+// SetToken makes the client present token as "Authorization: Bearer <token>"
+// on every request, e.g. a tenant's token on a broker serving several
+// applications. Call it before the client is shared between goroutines.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// BaseURL returns the URL of the broker the client currently talks to.
+func (c *Client) BaseURL() string {
+	return c.brokers[c.current.Load()]
+}
+
+// Brokers returns every broker URL the client may fail over between.
+func (c *Client) Brokers() []string {
+	return append([]string(nil), c.brokers...)
+}
+
+// Set stores value under key. It is sent with an idempotency key, so it is
+// safe to retry. It returns once the write is acknowledged at the level set
+// by WithAck.
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	body := map[string]string{"key": key, "value": value}
+	defer c.forget(key)
+	path := "/set"
+	if level, ok := ctx.Value(ackContextKey{}).(string); ok && level != "" {
+		path += "?ack=" + url.QueryEscape(level)
+	}
+	return c.doIdempotent(ctx, http.MethodPost, path, body, nil)
+}
+
+// Write acknowledgment levels for WithAck.
+const (
+	AckLocal      = "local"      // the store holding the key has it in memory (the default)
+	AckDurable    = "durable"    // the store has appended it to its fsynced journal
+	AckReplicated = "replicated" // the store backing that one up has copied it to disk
+)
+
+type ackContextKey struct{}
+
+// WithAck returns a context that makes Set wait until the write is
+// acknowledged at level, trading latency for durability. Durable and
+// replicated writes save or copy the store's whole data, so keep them for
+// writes that must not be lost.
+func WithAck(ctx context.Context, level string) context.Context {
+	return context.WithValue(ctx, ackContextKey{}, level)
+}
+
+// MaxStalenessHeader carries the staleness bound of a read.
+const MaxStalenessHeader = "X-Max-Staleness"
+
+type maxStalenessContextKey struct{}
+
+// WithMaxStaleness returns a context that lets Get be answered by a read
+// replica no more than d behind its primary, which the broker then prefers
+// to the primary; the primary answers when no replica is fresh enough. Zero
+// reads from the primary only. Such a Get skips the cache.
+func WithMaxStaleness(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, maxStalenessContextKey{}, d)
+}
+
+// Get returns the value stored under key, or ErrNotFound. With the cache
+// enabled a cached value is returned first; with direct reads enabled the
+// store holding key is asked before the broker.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	if _, bounded := ctx.Value(maxStalenessContextKey{}).(time.Duration); c.cache == nil || bounded {
+		return c.get(ctx, key)
+	}
+	value, ok, epoch := c.cache.get(key)
+	if ok {
+		return value, nil
+	}
+	value, err := c.get(ctx, key)
+	if err == nil {
+		c.cache.put(key, value, epoch)
+	}
+	return value, err
+}
+
+func (c *Client) get(ctx context.Context, key string) (string, error) {
+	if c.direct != nil {
+		if value, ok := c.getDirect(ctx, key); ok {
+			return value, nil
+		}
+	}
+
+	var result struct {
+		Value string `json:"value"`
+		Store string `json:"store"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/get?key="+url.QueryEscape(key), nil, &result); err != nil {
+		return "", err
+	}
+	if c.direct != nil {
+		c.direct.learn(key, result.Store)
+	}
+	return result.Value, nil
+}
+
+// forget drops what the client remembers about keys it has just written.
+func (c *Client) forget(keys ...string) {
+	if c.direct != nil {
+		c.direct.forget(keys...)
+	}
+	if c.cache != nil {
+		c.cache.invalidate(keys...)
+	}
+}
+
+// Delete removes key from every store holding it, or returns ErrNotFound.
+// It is sent with an idempotency key, so a retry after a lost response does
+// not report ErrNotFound. It returns once as many copies of the key as the
+// level set by WithConsistency confirmed the deletion.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	body := map[string]string{"key": key}
+	defer c.forget(key)
+	path := "/delete"
+	if level, ok := ctx.Value(consistencyContextKey{}).(string); ok && level != "" {
+		path += "?consistency=" + url.QueryEscape(level)
+	}
+	return c.doIdempotent(ctx, http.MethodPost, path, body, nil)
+}
+
+// Delete consistency levels for WithConsistency.
+const (
+	ConsistencyOne    = "one"    // the stores holding the key deleted it (the default)
+	ConsistencyQuorum = "quorum" // so did a majority of its copies, backups included
+	ConsistencyAll    = "all"    // so did every copy, backups and read replicas included
+)
+
+type consistencyContextKey struct{}
+
+// WithConsistency returns a context that makes Delete wait until level is
+// met. A deletion that took effect but was not confirmed well enough fails
+// with an *Error whose Details say which copies confirmed it; the copies
+// that missed it are sent it once they are back.
+func WithConsistency(ctx context.Context, level string) context.Context {
+	return context.WithValue(ctx, consistencyContextKey{}, level)
+}
+
+// PrefixDeletion is the result of DeletePrefix: the keys deleted, or that
+// would be in a dry run, in all and on each store.
+type PrefixDeletion struct {
+	Prefix  string         `json:"prefix"`
+	DryRun  bool           `json:"dry_run"`
+	Deleted int            `json:"deleted"`
+	Stores  map[string]int `json:"stores"`
+}
+
+// DeletePrefix deletes every key starting with prefix, which must not be
+// empty, from every store. With dryRun it only counts them.
+func (c *Client) DeletePrefix(ctx context.Context, prefix string, dryRun bool) (PrefixDeletion, error) {
+	path := "/delete-prefix"
+	if dryRun {
+		path += "?dry_run=true"
+	} else if c.cache != nil {
+		defer c.cache.invalidatePrefix(prefix)
+	}
+	var result PrefixDeletion
+	err := c.do(ctx, http.MethodPost, path, map[string]string{"prefix": prefix}, &result)
+	return result, err
+}
+
+// HotKey is one of the keys accessed most often on the store holding it,
+// with its approximate recent access count and its part of the store's and
+// the cluster's accesses.
+type HotKey struct {
+	Key          string  `json:"key"`
+	Store        string  `json:"store"`
+	Count        uint64  `json:"count"`
+	Share        float64 `json:"share"`
+	ClusterShare float64 `json:"cluster_share"`
+}
+
+// StoreAccesses is how often a store was accessed recently.
+type StoreAccesses struct {
+	Total uint64  `json:"total"`
+	Share float64 `json:"share"`
+	Error string  `json:"error,omitempty"`
+}
+
+// HotCopy is a hot key whose reads the broker spreads over copies of it on
+// other stores.
+type HotCopy struct {
+	Key     string    `json:"key"`
+	Holder  string    `json:"holder"`
+	Stores  []string  `json:"stores"`
+	Serving bool      `json:"serving"`
+	Since   time.Time `json:"since"`
+	Renewed time.Time `json:"renewed"`
+}
+
+// HotKeysReport lists the keys accessed most often across the stores, and
+// those copied to spread their reads.
+type HotKeysReport struct {
+	HalfLife string                   `json:"half_life"`
+	Keys     []HotKey                 `json:"keys"`
+	Stores   map[string]StoreAccesses `json:"stores"`
+	Copies   []HotCopy                `json:"copies"`
+}
+
+// HotKeys returns the limit keys accessed most often recently, at most 100,
+// and each store's part of the accesses.
+func (c *Client) HotKeys(ctx context.Context, limit int) (HotKeysReport, error) {
+	var result HotKeysReport
+	err := c.do(ctx, http.MethodGet, "/hotkeys?limit="+strconv.Itoa(limit), nil, &result)
+	return result, err
+}
+
+// TrashedKey is a deleted key held in a store's trash until it is purged.
+type TrashedKey struct {
+	Key     string    `json:"key"`
+	Store   string    `json:"store"`
+	Bytes   int       `json:"bytes"`
+	Deleted time.Time `json:"deleted"`
+	Expires time.Time `json:"expires"`
+}
+
+// Trash returns the deleted keys starting with prefix that can still be
+// restored, in key order. It is empty unless the stores keep deleted keys
+// with a trash retention.
+func (c *Client) Trash(ctx context.Context, prefix string) ([]TrashedKey, error) {
+	var result struct {
+		Keys []TrashedKey `json:"keys"`
+	}
+	err := c.do(ctx, http.MethodGet, "/trash?prefix="+url.QueryEscape(prefix), nil, &result)
+	return result.Keys, err
+}
+
+// Undeletion is the result of Undelete and UndeletePrefix: the keys
+// restored in all and on each store, and those skipped because they were
+// written again since they were deleted.
+type Undeletion struct {
+	Restored int            `json:"restored"`
+	Stores   map[string]int `json:"stores"`
+	Skipped  []string       `json:"skipped,omitempty"`
+}
+
+// Undelete restores a deleted key from the trash. It returns ErrNotFound if
+// the key is not in the trash, and an error with status 409 if it was
+// written again since it was deleted.
+func (c *Client) Undelete(ctx context.Context, key string) error {
+	defer c.forget(key)
+	return c.do(ctx, http.MethodPost, "/undelete", map[string]string{"key": key}, nil)
+}
+
+// UndeletePrefix restores every deleted key starting with prefix from the
+// trash, skipping those written again since.
+func (c *Client) UndeletePrefix(ctx context.Context, prefix string) (Undeletion, error) {
+	if c.cache != nil {
+		defer c.cache.invalidatePrefix(prefix)
+	}
+	var result Undeletion
+	err := c.do(ctx, http.MethodPost, "/undelete", map[string]string{"prefix": prefix}, &result)
+	return result, err
+}
+
+// DeleteIf removes key only if it still holds value, so a cleanup cannot
+// remove a value written since it was read. It returns
+// ErrPreconditionFailed if the key holds another value, and ErrNotFound if
+// it does not exist.
+func (c *Client) DeleteIf(ctx context.Context, key, value string) error {
+	body := map[string]string{"key": key, "if_value": value}
+	defer c.forget(key)
+	return c.doIdempotent(ctx, http.MethodPost, "/delete", body, nil)
+}
+
+// Expire sets key to be deleted after ttl (rounded down to whole seconds, at least one).
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	seconds := int(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	body := map[string]interface{}{"key": key, "seconds": seconds}
+	return c.do(ctx, http.MethodPost, "/expire", body, nil)
+}
+
+// TTL returns the time left before key expires. ok is false if the key has no TTL.
+func (c *Client) TTL(ctx context.Context, key string) (ttl time.Duration, ok bool, err error) {
+	var result struct {
+		TTL int `json:"ttl"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/ttl?key="+url.QueryEscape(key), nil, &result); err != nil {
+		return 0, false, err
+	}
+	if result.TTL < 0 {
+		return 0, false, nil
+	}
+	return time.Duration(result.TTL) * time.Second, true, nil
+}
+
+// Persist removes key's TTL and reports whether it had one.
+func (c *Client) Persist(ctx context.Context, key string) (bool, error) {
+	var result struct {
+		Persisted bool `json:"persisted"`
+	}
+	body := map[string]string{"key": key}
+	err := c.do(ctx, http.MethodPost, "/persist", body, &result)
+	return result.Persisted, err
+}
+
+// Incr adds delta to the named counter and returns its new value. It is
+// sent with an idempotency key, so a retry after a lost response does not
+// count twice.
+func (c *Client) Incr(ctx context.Context, name string, delta int64) (int64, error) {
+	var result struct {
+		Value int64 `json:"value"`
+	}
+	body := map[string]int64{"delta": delta}
+	defer c.forget(name)
+	err := c.doIdempotent(ctx, http.MethodPost, "/counter/"+url.PathEscape(name)+"/incr", body, &result)
+	return result.Value, err
+}
+
+// GetAll returns a description of every key-value pair in the cluster.
+func (c *Client) GetAll(ctx context.Context) ([]string, error) {
+	var result []string
+	err := c.do(ctx, http.MethodGet, "/getall", nil, &result)
+	return result, err
+}
+
+// MSet stores many key-value pairs in one request. It is sent with an
+// idempotency key, so it is safe to retry.
+func (c *Client) MSet(ctx context.Context, pairs map[string]string) error {
+	body := map[string]interface{}{"pairs": pairs}
+	if c.direct != nil || c.cache != nil {
+		keys := make([]string, 0, len(pairs))
+		for key := range pairs {
+			keys = append(keys, key)
+		}
+		defer c.forget(keys...)
+	}
+	return c.doIdempotent(ctx, http.MethodPost, "/mset", body, nil)
+}
+
+// MGet returns the values of those keys that exist in one request; missing
+// keys are left out of the result.
+func (c *Client) MGet(ctx context.Context, keys []string) (map[string]string, error) {
+	var result struct {
+		Values map[string]string `json:"values"`
+	}
+	body := map[string]interface{}{"keys": keys}
+	if err := c.doRead(ctx, "/mget", body, &result); err != nil {
+		return nil, err
+	}
+	return result.Values, nil
+}
+
+// ScanItem is a key-value pair returned by Scan with the store holding it.
+type ScanItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Store string `json:"store"`
+}
+
+// ScanPage is one page of a scan.
+type ScanPage struct {
+	Items []ScanItem `json:"items"`
+	// Next is the cursor for the following page; empty when the scan is complete.
+	Next string `json:"next"`
+}
+
+// Scan returns up to limit pairs (0 for the broker's default) whose keys start
+// with prefix and sort after cursor, in key order. Start with an empty cursor
+// and pass each page's Next until it is empty.
+func (c *Client) Scan(ctx context.Context, prefix, cursor string, limit int) (*ScanPage, error) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	query.Set("cursor", cursor)
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var page ScanPage
+	if err := c.do(ctx, http.MethodGet, "/scan?"+query.Encode(), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Query returns up to limit pairs (0 for the broker's default) whose value
+// the named secondary index holds under value, after cursor. Pass the
+// returned Next as cursor to continue.
+func (c *Client) Query(ctx context.Context, index, value, cursor string, limit int) (*ScanPage, error) {
+	query := url.Values{}
+	query.Set("index", index)
+	query.Set("value", value)
+	query.Set("cursor", cursor)
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var page ScanPage
+	if err := c.do(ctx, http.MethodGet, "/query?"+query.Encode(), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// ListStores returns the names of all registered stores.
+func (c *Client) ListStores(ctx context.Context) ([]string, error) {
+	var result []string
+	err := c.do(ctx, http.MethodGet, "/stores/list", nil, &result)
+	return result, err
+}
+
+// RemoveStore removes the named store from the cluster. With drain, its keys
+// are first moved to the remaining stores; the number moved is returned.
+func (c *Client) RemoveStore(ctx context.Context, name string, drain bool) (int, error) {
+	body := map[string]interface{}{"name": name, "drain": drain}
+	var result struct {
+		KeysMoved int `json:"keys_moved"`
+	}
+	err := c.do(ctx, http.MethodPost, "/stores/remove", body, &result)
+	return result.KeysMoved, err
+}
+
+// HandOffStore removes the named store after it pushed its keys to its ring
+// successor. It returns the number of keys handed off and the store that took them.
+func (c *Client) HandOffStore(ctx context.Context, name string) (int, string, error) {
+	body := map[string]interface{}{"name": name, "handoff": true}
+	var result struct {
+		KeysMoved   int    `json:"keys_moved"`
+		HandedOffTo string `json:"handed_off_to"`
+	}
+	err := c.do(ctx, http.MethodPost, "/stores/remove", body, &result)
+	return result.KeysMoved, result.HandedOffTo, err
+}
+
+// RemovalPlan is what removing a store would do, as reported by a dry run.
+// KeysAffected is -1 if the store did not report its keys.
+type RemovalPlan struct {
+	Store           string   `json:"store"`
+	Mode            string   `json:"mode"`
+	Replica         bool     `json:"replica,omitempty"`
+	KeysAffected    int      `json:"keys_affected"`
+	Target          string   `json:"target,omitempty"`
+	StoresContacted []string `json:"stores_contacted"`
+	Steps           []string `json:"steps"`
+}
+
+// PlanRemoval reports what removing the named store would do without
+// removing it. mode is "remove", "drain" or "handoff", as for RemoveStore
+// and HandOffStore.
+func (c *Client) PlanRemoval(ctx context.Context, name, mode string) (RemovalPlan, error) {
+	body := map[string]interface{}{"name": name, "drain": mode == "drain", "handoff": mode == "handoff"}
+	var plan RemovalPlan
+	err := c.do(ctx, http.MethodPost, "/stores/remove?dry_run=true", body, &plan)
+	return plan, err
+}
+
+// SplitStore moves the keys in the upper half of the named store's hash
+// range to target, or to the least loaded other store if target is empty.
+// It returns the number of keys moved and the store they went to.
+func (c *Client) SplitStore(ctx context.Context, name, target string) (int, string, error) {
+	body := map[string]string{"name": name, "target": target}
+	var result struct {
+		KeysMoved int    `json:"keys_moved"`
+		Target    string `json:"target"`
+	}
+	err := c.do(ctx, http.MethodPost, "/stores/split", body, &result)
+	return result.KeysMoved, result.Target, err
+}
+
+// MergeStores moves every key of the named store into another, the least
+// loaded if into is empty, and removes the store. It returns the number of
+// keys moved and the store they went to.
+func (c *Client) MergeStores(ctx context.Context, name, into string) (int, string, error) {
+	body := map[string]string{"name": name, "into": into}
+	var result struct {
+		KeysMoved int    `json:"keys_moved"`
+		Into      string `json:"into"`
+	}
+	err := c.do(ctx, http.MethodPost, "/stores/merge", body, &result)
+	return result.KeysMoved, result.Into, err
+}
+
+// StoreRecovery is the progress of a store recovering its data from the
+// backup its peer holds.
+type StoreRecovery struct {
+	Store  string `json:"store"`
+	Holder string `json:"holder,omitempty"`
+	// Integrity is the store's integrity: Status is "recovering" until the
+	// backup is loaded, then "recovered"; Problems lists what went wrong.
+	Integrity struct {
+		Status    string     `json:"status"`
+		Problems  []string   `json:"problems,omitempty"`
+		Recovered *time.Time `json:"recovered,omitempty"`
+	} `json:"integrity"`
+	// Load is the progress of loading the backup.
+	Load struct {
+		Phase      string  `json:"phase"`
+		BytesRead  int64   `json:"bytes_read"`
+		TotalBytes int64   `json:"total_bytes"`
+		Keys       int64   `json:"keys"`
+		Progress   float64 `json:"progress"`
+		Error      string  `json:"error,omitempty"`
+	} `json:"load"`
+}
+
+// RecoverStore has the named store replace its data with the backup its
+// peer holds, streamed from the peer. It returns at once; poll
+// RecoveryStatus for the progress.
+func (c *Client) RecoverStore(ctx context.Context, name string) (StoreRecovery, error) {
+	var result StoreRecovery
+	err := c.do(ctx, http.MethodPost, "/stores/recover", map[string]string{"name": name}, &result)
+	return result, err
+}
+
+// RecoveryStatus reports the progress of the named store's recovery.
+func (c *Client) RecoveryStatus(ctx context.Context, name string) (StoreRecovery, error) {
+	var result StoreRecovery
+	err := c.do(ctx, http.MethodGet, "/stores/recover?name="+url.QueryEscape(name), nil, &result)
+	return result, err
+}
+
+// Snapshot asks every store to save a snapshot to disk.
+func (c *Client) Snapshot(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/kvstore/snapshot/manual", nil, nil)
+}
+
+// EnableSnapshots starts periodic snapshots on a store every intervalSeconds.
+func (c *Client) EnableSnapshots(ctx context.Context, store string, intervalSeconds int) error {
+	body := map[string]interface{}{"storename": store, "interval": intervalSeconds}
+	return c.do(ctx, http.MethodPost, "/kvstore/snapshot/enable", body, nil)
+}
+
+// DisableSnapshots stops periodic snapshots on a store.
+func (c *Client) DisableSnapshots(ctx context.Context, store string) error {
+	body := map[string]string{"storename": store}
+	return c.do(ctx, http.MethodPost, "/kvstore/snapshot/disable", body, nil)
+}
+
+// SnapshotStatus is a store's periodic snapshot configuration.
+type SnapshotStatus struct {
+	Enabled         bool       `json:"enabled"`
+	IntervalSeconds float64    `json:"interval_seconds"`
+	Codec           string     `json:"codec,omitempty"`
+	LastSnapshot    *time.Time `json:"last_snapshot,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	LastSuccess     *time.Time `json:"last_success,omitempty"`
+	LastFailure     *time.Time `json:"last_failure,omitempty"`
+	// Archive is where periodic snapshots are also archived, if anywhere;
+	// LastArchive is the file last written there.
+	Archive          *SnapshotArchive `json:"archive,omitempty"`
+	LastArchive      string           `json:"last_archive,omitempty"`
+	LastArchiveError string           `json:"last_archive_error,omitempty"`
+	// Managed is set when the broker keeps the schedule applied across
+	// restarts of the store; ManagedIntervalSeconds is 0 if disabled.
+	// Profile is the snapshot profile attached, if any.
+	Managed                bool    `json:"managed"`
+	ManagedIntervalSeconds float64 `json:"managed_interval_seconds,omitempty"`
+	Profile                string  `json:"profile,omitempty"`
+	// Error is set when the broker could not reach the store; the rest is
+	// then what the store reported last.
+	Error string `json:"error,omitempty"`
+}
+
+// SnapshotStatus returns the periodic snapshot status of a store, or of every
+// store when store is empty, keyed by store name.
+func (c *Client) SnapshotStatus(ctx context.Context, store string) (map[string]SnapshotStatus, error) {
+	var result map[string]SnapshotStatus
+	err := c.do(ctx, http.MethodGet, "/snapshot/status?storename="+url.QueryEscape(store), nil, &result)
+	return result, err
+}
+
+// SnapshotArchive is where a store archives its periodic snapshots.
+type SnapshotArchive struct {
+	Format      string `json:"format,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	Destination string `json:"destination"`
+	// Retain is how many archived snapshots are kept; 0 keeps them all.
+	Retain int `json:"retain,omitempty"`
+}
+
+// SnapshotProfile is a named set of snapshot settings configured on the
+// broker. Interval is a duration such as "1m0s"; the archive settings are
+// empty if the profile does not archive.
+type SnapshotProfile struct {
+	Interval string `json:"interval"`
+	SnapshotArchive
+}
+
+// AttachSnapshotProfile applies a configured snapshot profile to a store,
+// replacing its schedule.
+func (c *Client) AttachSnapshotProfile(ctx context.Context, store, profile string) error {
+	body := map[string]string{"storename": store, "profile": profile}
+	return c.do(ctx, http.MethodPost, "/kvstore/snapshot/attach", body, nil)
+}
+
+// SnapshotProfiles returns the snapshot profiles configured on the broker,
+// keyed by name.
+func (c *Client) SnapshotProfiles(ctx context.Context) (map[string]SnapshotProfile, error) {
+	var result map[string]SnapshotProfile
+	err := c.do(ctx, http.MethodGet, "/kvstore/snapshot/profiles", nil, &result)
+	return result, err
+}
+
+// DefaultTTL is the TTL a store gives the keys written to it; Seconds is 0
+// if it gives none.
+type DefaultTTL struct {
+	Seconds int `json:"seconds"`
+	// Managed is set when the broker keeps the default applied across
+	// restarts of the store.
+	Managed bool `json:"managed"`
+	// Error is set when the broker could not reach the store.
+	Error string `json:"error,omitempty"`
+}
+
+// SetDefaultTTL gives every key written to a store from now on a TTL of ttl,
+// unless Expire or Persist set another; zero removes the default.
+func (c *Client) SetDefaultTTL(ctx context.Context, store string, ttl time.Duration) error {
+	body := map[string]interface{}{"storename": store, "seconds": int(ttl / time.Second)}
+	return c.do(ctx, http.MethodPost, "/stores/default-ttl", body, nil)
+}
+
+// DefaultTTLs returns the default TTL of a store, or of every store when
+// store is empty, keyed by store name.
+func (c *Client) DefaultTTLs(ctx context.Context, store string) (map[string]DefaultTTL, error) {
+	var result map[string]DefaultTTL
+	err := c.do(ctx, http.MethodGet, "/stores/default-ttl?storename="+url.QueryEscape(store), nil, &result)
+	return result, err
+}
+
+// MigrationStatus reports the progress of a drain, handoff, split or merge
+// moving the keys of a store elsewhere.
+type MigrationStatus struct {
+	Kind       string     `json:"kind"` // drain, handoff, split or merge
+	Store      string     `json:"store"`
+	Target     string     `json:"target,omitempty"`
+	State      string     `json:"state"` // running, paused, aborted, done or failed
+	KeysTotal  int        `json:"keys_total"`
+	KeysMoved  int        `json:"keys_moved"`
+	BytesMoved int64      `json:"bytes_moved"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// KeysPerSecond and BytesPerSecond leave out the time spent paused.
+	KeysPerSecond  float64 `json:"keys_per_second"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// ETASeconds is -1 while the time left cannot be estimated.
+	ETASeconds int    `json:"eta_seconds"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Migrations returns the latest drain, handoff, split or merge of each store, oldest first.
+func (c *Client) Migrations(ctx context.Context) ([]MigrationStatus, error) {
+	var result []MigrationStatus
+	err := c.do(ctx, http.MethodGet, "/migration/status", nil, &result)
+	return result, err
+}
+
+// ControlMigration pauses, resumes or aborts the drain, handoff, split or
+// merge of a store; action is "pause", "resume" or "abort".
+func (c *Client) ControlMigration(ctx context.Context, store, action string) (MigrationStatus, error) {
+	var result MigrationStatus
+	err := c.do(ctx, http.MethodPost, "/migration/"+url.PathEscape(action), map[string]string{"store": store}, &result)
+	return result, err
+}
+
+// JobConfig is a recurring job the broker runs on a schedule.
+type JobConfig struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"` // backup, rebalance or snapshot-cleanup
+	Schedule string `json:"schedule"`
+	MaxAge   string `json:"max_age,omitempty"`
+}
+
+// JobRun is one run of a job.
+type JobRun struct {
+	Job      string    `json:"job"`
+	Kind     string    `json:"kind"`
+	Trigger  string    `json:"trigger"` // schedule or manual
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Result   string    `json:"result"` // ok, failed or skipped
+	Detail   string    `json:"detail,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// JobStatus is a configured job, when it runs next and how its last run went.
+type JobStatus struct {
+	JobConfig
+	Next    time.Time `json:"next"`
+	Running bool      `json:"running"`
+	LastRun *JobRun   `json:"last_run,omitempty"`
+}
+
+// JobsReport lists the broker's recurring jobs and their most recent runs.
+type JobsReport struct {
+	Jobs    []JobStatus `json:"jobs"`
+	History []JobRun    `json:"history"`
+}
+
+// Jobs returns the broker's recurring jobs and their most recent runs. It
+// needs the admin token when one is configured.
+func (c *Client) Jobs(ctx context.Context) (JobsReport, error) {
+	var result JobsReport
+	err := c.do(ctx, http.MethodGet, "/jobs", nil, &result)
+	return result, err
+}
+
+// RunJob runs the named job now and returns the run.
+func (c *Client) RunJob(ctx context.Context, name string) (JobRun, error) {
+	var result JobRun
+	err := c.do(ctx, http.MethodPost, "/jobs/run", map[string]string{"name": name}, &result)
+	return result, err
+}
+
+// ValidationRule constrains the writes to the keys starting with Prefix, or
+// to every key if it is empty.
+type ValidationRule struct {
+	Name          string          `json:"name"`
+	Prefix        string          `json:"prefix,omitempty"`
+	KeyPattern    string          `json:"key_pattern,omitempty"`
+	MaxValueBytes int             `json:"max_value_bytes,omitempty"`
+	Schema        json.RawMessage `json:"schema,omitempty"`
+	// Rejected is the number of writes the rule refused, as reported by
+	// ValidationRules.
+	Rejected uint64 `json:"rejected,omitempty"`
+}
+
+// ValidationRules returns the rules the broker checks writes against. It
+// needs the admin token when one is configured.
+func (c *Client) ValidationRules(ctx context.Context) ([]ValidationRule, error) {
+	var result struct {
+		Rules []ValidationRule `json:"rules"`
+	}
+	err := c.do(ctx, http.MethodGet, "/validation", nil, &result)
+	return result.Rules, err
+}
+
+// SetValidationRules replaces the rules the broker checks writes against
+// until its config is reloaded with different ones.
+func (c *Client) SetValidationRules(ctx context.Context, rules []ValidationRule) ([]ValidationRule, error) {
+	var result struct {
+		Rules []ValidationRule `json:"rules"`
+	}
+	err := c.do(ctx, http.MethodPost, "/validation", map[string]interface{}{"rules": rules}, &result)
+	return result.Rules, err
+}
+
+// ClusterEvent is something that happened to the cluster, such as a store
+// registering, going down or being split.
+type ClusterEvent struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Store   string    `json:"store,omitempty"`
+	Peer    string    `json:"peer,omitempty"`
+	Details string    `json:"details,omitempty"`
+}
+
+// Events returns the cluster events after sequence number since, oldest
+// first, and the sequence number to pass on the following call.
+func (c *Client) Events(ctx context.Context, since uint64) ([]ClusterEvent, uint64, error) {
+	var result struct {
+		Events []ClusterEvent `json:"events"`
+		Next   uint64         `json:"next"`
+	}
+	err := c.do(ctx, http.MethodGet, "/events?since="+strconv.FormatUint(since, 10), nil, &result)
+	return result.Events, result.Next, err
+}
+
+// StoreConnStats are the broker's connections to one store.
+type StoreConnStats struct {
+	Address     string  `json:"address"`
+	Open        int     `json:"open"`
+	InUse       int     `json:"in_use"`
+	Idle        int     `json:"idle"`
+	Requests    uint64  `json:"requests"`
+	ReuseRate   float64 `json:"reuse_rate"`
+	Utilization float64 `json:"utilization"`
+}
+
+// ConnectionStats are the client connections to the broker and the broker's
+// connections to each store, keyed by store name.
+type ConnectionStats struct {
+	Clients struct {
+		Open      int     `json:"open"`
+		Active    int     `json:"active"`
+		Idle      int     `json:"idle"`
+		Accepted  uint64  `json:"accepted"`
+		Requests  uint64  `json:"requests"`
+		ReuseRate float64 `json:"reuse_rate"`
+	} `json:"clients"`
+	Stores map[string]StoreConnStats `json:"stores"`
+	Limits struct {
+		MaxIdlePerStore int    `json:"max_idle_per_store,omitempty"`
+		MaxPerStore     int    `json:"max_per_store,omitempty"`
+		IdleTimeout     string `json:"idle_timeout,omitempty"`
+	} `json:"limits"`
+}
+
+// Connections returns the broker's connection stats.
+func (c *Client) Connections(ctx context.Context) (ConnectionStats, error) {
+	var result ConnectionStats
+	err := c.do(ctx, http.MethodGet, "/connections", nil, &result)
+	return result, err
+}
+
+// do sends a request to the broker. A non-nil body is sent as JSON and a
+// non-nil out receives the decoded JSON response. GET requests are retried
+// on transient failures.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	return c.send(ctx, method, path, "", method == http.MethodGet, body, out)
+}
+
+// doRead is do for reads sent as POST, which are retried like a GET.
+func (c *Client) doRead(ctx context.Context, path string, body, out interface{}) error {
+	return c.send(ctx, http.MethodPost, path, "", true, body, out)
+}
+
+// doIdempotent is do for writes: the request carries an idempotency key and
+// is retried like a read.
+func (c *Client) doIdempotent(ctx context.Context, method, path string, body, out interface{}) error {
+	return c.send(ctx, method, path, idempotencyKey(ctx), true, body, out)
+}
+
+func (c *Client) send(ctx context.Context, method, path, idemKey string, retryable bool, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = jsonData
+	}
+
+	failovers := 0
+	for attempt := 1; ; {
+		baseURL := c.BaseURL()
+		err := c.attempt(ctx, baseURL, method, path, idemKey, payload, out)
+		if err == nil {
+			return nil
+		}
+
+		// Try the other brokers before backing off; a request that never
+		// reached a broker can move even if it is not retryable
+		if failovers < len(c.brokers)-1 && (unreachable(err) || retryable && brokerUnavailable(err)) && ctx.Err() == nil {
+			c.failover(baseURL)
+			failovers++
+			continue
+		}
+
+		if !retryable || attempt >= c.retry.MaxAttempts || !transient(ctx, err) {
+			return err
+		}
+		timer := time.NewTimer(c.retry.backoff(attempt))
+		attempt++
+		failovers = 0
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt makes a single request to the broker at baseURL.
+func (c *Client) attempt(ctx context.Context, baseURL, method, path, idemKey string, payload []byte, out interface{}) error {
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, baseURL+httpapi.Version+path, reader)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json, "+httpapi.ProblemContentType)
+	if idemKey != "" {
+		req.Header.Set(IdempotencyKeyHeader, idemKey)
+	}
+	if d, ok := ctx.Value(maxStalenessContextKey{}).(time.Duration); ok && method == http.MethodGet {
+		req.Header.Set(MaxStalenessHeader, d.String())
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("error contacting broker at %s: %w", baseURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return problemError(resp.StatusCode, body)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("error decoding broker response: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/httpapi"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLocations bounds the number of key locations a client remembers for
+// direct reads; the cache is emptied when it fills up.
+const maxLocations = 100000
+
+// TopologyStore is a store as reported by the broker's /topology endpoint.
+type TopologyStore struct {
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Up       bool   `json:"up"`
+	Draining bool   `json:"draining,omitempty"`
+	Warming  bool   `json:"warming,omitempty"`
+}
+
+// Topology is the broker's current store membership.
+type Topology struct {
+	Stores []TopologyStore `json:"stores"`
+}
+
+// Topology returns the stores registered with the broker and their addresses.
+func (c *Client) Topology(ctx context.Context) (*Topology, error) {
+	var topology Topology
+	if err := c.do(ctx, http.MethodGet, "/topology", nil, &topology); err != nil {
+		return nil, err
+	}
+	return &topology, nil
+}
+
+// directReads is the state behind EnableDirectReads: the address of every
+// readable store and the store each recently read key was found on.
+type directReads struct {
+	mu        sync.Mutex
+	refresh   time.Duration
+	fetched   time.Time
+	stores    map[string]string
+	locations map[string]string
+}
+
+// EnableDirectReads makes Get read keys straight from the store holding them
+// instead of through the broker. The broker places keys by load, so a key's
+// store is learned from the first broker read and remembered; later reads
+// go to that store and fall back to the broker if it fails or no longer has
+// the key. The topology is fetched now and again every refresh interval.
+//
+// Writes made through this client forget the key's location, but writes by
+// other clients that move a key can be missed until the next broker read, so
+// use direct reads for data where slightly stale reads are acceptable. They
+// are not available to tenants, whose keys the stores hold under a prefix.
+// Call it before the client is shared between goroutines.
+func (c *Client) EnableDirectReads(ctx context.Context, refresh time.Duration) error {
+	d := &directReads{refresh: refresh, locations: make(map[string]string)}
+	if err := c.refreshTopology(ctx, d); err != nil {
+		return err
+	}
+	c.direct = d
+	return nil
+}
+
+// refreshTopology reloads the readable stores from the broker.
+func (c *Client) refreshTopology(ctx context.Context, d *directReads) error {
+	topology, err := c.Topology(ctx)
+	if err != nil {
+		return err
+	}
+	stores := make(map[string]string, len(topology.Stores))
+	for _, store := range topology.Stores {
+		if store.Up && !store.Draining && !store.Warming {
+			stores[store.Name] = store.Address
+		}
+	}
+
+	d.mu.Lock()
+	d.stores = stores
+	d.fetched = time.Now()
+	d.mu.Unlock()
+	return nil
+}
+
+// storeFor returns the address of the store key was last found on, if it is
+// still readable, refreshing a stale topology first.
+func (c *Client) storeFor(ctx context.Context, key string) (string, bool) {
+	d := c.direct
+	d.mu.Lock()
+	stale := time.Since(d.fetched) > d.refresh
+	if stale {
+		// Claim the refresh so concurrent reads, and reads while the broker
+		// is down, do not all ask for the topology
+		d.fetched = time.Now()
+	}
+	d.mu.Unlock()
+	if stale {
+		// Keep using the old topology if the broker cannot be reached
+		c.refreshTopology(ctx, d)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name, ok := d.locations[key]
+	if !ok {
+		return "", false
+	}
+	addr, ok := d.stores[name]
+	if !ok {
+		delete(d.locations, key)
+	}
+	return addr, ok
+}
+
+// learn records that key was found on the named store.
+func (d *directReads) learn(key, store string) {
+	if store == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.locations) >= maxLocations {
+		d.locations = make(map[string]string)
+	}
+	d.locations[key] = store
+}
+
+// forget drops the remembered locations of keys.
+func (d *directReads) forget(keys ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		delete(d.locations, key)
+	}
+}
+
+// getDirect reads key from the store it was last found on. ok is false if the
+// location is unknown or the read failed, and the caller should ask the broker.
+func (c *Client) getDirect(ctx context.Context, key string) (value string, ok bool) {
+	addr, ok := c.storeFor(ctx, key)
+	if !ok {
+		return "", false
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	value, err := c.fetchFromStore(ctx, addr, key)
+	if err != nil {
+		c.direct.forget(key)
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			// The store may be gone; reload the topology on the next read
+			c.direct.mu.Lock()
+			c.direct.fetched = time.Time{}
+			c.direct.mu.Unlock()
+		}
+		return "", false
+	}
+	return value, true
+}
+
+// fetchFromStore makes a single GET /get request to a store.
+func (c *Client) fetchFromStore(ctx context.Context, baseURL, key string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+httpapi.Version+"/get?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error contacting %s: %w", baseURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("store %s returned status %d", baseURL, resp.StatusCode)
+	}
+
+	var result struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("error decoding store response: %w", err)
+	}
+	return result.Value, nil
+}
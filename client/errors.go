@@ -0,0 +1,102 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/httpapi"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when the requested key does not exist.
+	ErrNotFound = errors.New("key not found")
+	// ErrPreconditionFailed is returned when a conditional delete finds the
+	// key holding another value.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrStoreNotFound is returned when no store is registered under the
+	// name given.
+	ErrStoreNotFound = errors.New("store not found")
+	// ErrStoreUnavailable is returned when no store could take the request,
+	// e.g. because the broker has none or they are all busy or down. It is
+	// worth retrying later.
+	ErrStoreUnavailable = errors.New("store unavailable")
+	// ErrQuotaExceeded is returned for a write that would take the tenant
+	// over its key or byte quota.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrValidationFailed is returned for a write the broker's validation
+	// rules refuse; the Error's Details name the rule and the reason.
+	ErrValidationFailed = errors.New("validation failed")
+)
+
+// problemErrors are the errors matched by the problems of each code.
+var problemErrors = map[string]error{
+	httpapi.CodeKeyNotFound:        ErrNotFound,
+	httpapi.CodePreconditionFailed: ErrPreconditionFailed,
+	httpapi.CodeStoreNotFound:      ErrStoreNotFound,
+	httpapi.CodeNoStores:           ErrStoreUnavailable,
+	httpapi.CodeStoreUnavailable:   ErrStoreUnavailable,
+	httpapi.CodeQuotaExceeded:      ErrQuotaExceeded,
+	httpapi.CodeValidationFailed:   ErrValidationFailed,
+}
+
+// Error is a failed request, as the problem the broker reported it as.
+// errors.Is matches it against the errors of this package by its code, e.g.
+// a key-not-found problem is ErrNotFound.
+type Error struct {
+	// Status is the response's HTTP status.
+	Status int
+	// Type is the problem type URI, e.g. "urn:kv:problem:key-not-found",
+	// or "about:blank" for a failure that is no more than its status.
+	Type  string
+	Title string
+	// Detail describes this failure, for people.
+	Detail string
+	// Code is the broker's name for the problem, e.g. "key_not_found".
+	Code string
+	// Details holds more about some problems, such as the rule a validation
+	// failure broke, as JSON.
+	Details json.RawMessage
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("broker returned status %d (%s): %s", e.Status, e.Code, e.Detail)
+	}
+	return fmt.Sprintf("broker returned status %d: %s", e.Status, e.Detail)
+}
+
+// Is reports whether the problem is target, one of the errors of this
+// package.
+func (e *Error) Is(target error) bool {
+	return target != nil && problemErrors[e.Code] == target
+}
+
+// problemError returns the Error for a failed response with the given
+// status and body. A body that is not a problem, e.g. from a proxy, is taken
+// as the detail, and a bare 404 or 412 as a missing key or a failed
+// precondition, as brokers that predate problems sent them.
+func problemError(status int, body []byte) *Error {
+	problem, ok := httpapi.DecodeProblem(body)
+	if !ok {
+		problem.Detail = strings.TrimSpace(string(body))
+		switch status {
+		case http.StatusNotFound:
+			problem.Code = httpapi.CodeKeyNotFound
+		case http.StatusPreconditionFailed:
+			problem.Code = httpapi.CodePreconditionFailed
+		}
+	}
+	if problem.Type == "" {
+		problem.Type = httpapi.ProblemType(problem.Code)
+	}
+	e := &Error{Status: status, Type: problem.Type, Title: problem.Title, Detail: problem.Detail, Code: problem.Code}
+	if e.Title == "" {
+		e.Title = http.StatusText(status)
+	}
+	if problem.Details != nil {
+		e.Details, _ = json.Marshal(problem.Details)
+	}
+	return e
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// IdempotencyKeyHeader carries the idempotency key of a write. The broker
+// replays its recorded response for a key it has already seen, so a retried
+// write is applied once.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RetryPolicy controls how transient failures are retried: network errors
+// and 429, 502, 503 and 504 responses. Reads are always retried; writes only
+// when they carry an idempotency key.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first. One or less disables retries.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry; it doubles on each further retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the policy used by clients returned from New.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+}
+
+// SetRetryPolicy replaces the client's retry policy.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
+}
+
+// backoff returns the wait before retry n (starting at 1), with jitter so
+// clients that failed together do not retry together.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < n && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+type idempotencyKeyContextKey struct{}
+
+// WithIdempotencyKey returns a context that makes Set, Delete and MSet use key
+// as their idempotency key instead of generating one. Use it to keep a write
+// idempotent across process restarts, not just across the client's own retries.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+// idempotencyKey returns the key set with WithIdempotencyKey, or a new random one.
+func idempotencyKey(ctx context.Context) string {
+	if key, ok := ctx.Value(idempotencyKeyContextKey{}).(string); ok && key != "" {
+		return key
+	}
+	var b [16]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// transient reports whether a failed attempt is worth retrying.
+func transient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var pe *Error
+	if errors.As(err, &pe) {
+		switch pe.Status {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	// The request never got a response
+	var ue *url.Error
+	return errors.As(err, &ue) && ue.Op != "parse"
+}
+
+// unreachable reports whether err means the broker could not be connected
+// to, so the request was never seen by it.
+func unreachable(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
+
+// brokerUnavailable reports whether err is a broker saying it cannot serve
+// requests, e.g. because it is a standby.
+func brokerUnavailable(err error) bool {
+	var pe *Error
+	return errors.As(err, &pe) && pe.Status == http.StatusServiceUnavailable
+}
+
+// failover moves the client off the broker at failed, unless another request
+// has already done so.
+func (c *Client) failover(failed string) {
+	for i, u := range c.brokers {
+		if u == failed {
+			c.current.CompareAndSwap(int32(i), int32((i+1)%len(c.brokers)))
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"kv/httpapi"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VersionInfo describes the build of a broker or store.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// StoreHealth is the broker's view of a store's health.
+type StoreHealth struct {
+	Status              string    `json:"status"`
+	LastChecked         time.Time `json:"last_checked"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	// Integrity is set when the store's startup self-check found problems,
+	// e.g. "corrupt" until it has recovered its data from its peer.
+	Integrity string `json:"integrity,omitempty"`
+	// LoadReport is what the store reported at its last health check.
+	LoadReport *LoadReport `json:"load_report,omitempty"`
+}
+
+// LoadReport is how busy a store said it was.
+type LoadReport struct {
+	Keys         int     `json:"keys"`
+	DataBytes    int64   `json:"data_bytes"`
+	MemoryBytes  uint64  `json:"memory_bytes"`
+	OpsPerSecond float64 `json:"ops_per_second"`
+	// SnapshotAgeSeconds is -1 if the store has no snapshot.
+	SnapshotAgeSeconds float64 `json:"snapshot_age_seconds"`
+}
+
+// StoreStatus is one store as reported by ClusterStatus.
+type StoreStatus struct {
+	Name         string       `json:"name"`
+	Address      string       `json:"address"`
+	Health       StoreHealth  `json:"health"`
+	Load         int          `json:"load"`
+	Keys         int          `json:"keys"`
+	BacksUp      string       `json:"backs_up,omitempty"`
+	BackedUpBy   string       `json:"backed_up_by,omitempty"`
+	Version      *VersionInfo `json:"version,omitempty"`
+	VersionError string       `json:"version_error,omitempty"`
+}
+
+// ClusterStatus summarizes the broker and its stores.
+type ClusterStatus struct {
+	Broker        VersionInfo   `json:"broker"`
+	Stores        []StoreStatus `json:"stores"`
+	MixedVersions bool          `json:"mixed_versions"`
+}
+
+// ClusterStatus returns membership, health, load, key counts, peering and
+// versions of every store.
+func (c *Client) ClusterStatus(ctx context.Context) (*ClusterStatus, error) {
+	var status ClusterStatus
+	if err := c.do(ctx, http.MethodGet, "/cluster/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Ping measures a round trip to the broker's /healthz endpoint.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	return c.ping(ctx, c.BaseURL())
+}
+
+// PingStore measures a round trip to the /healthz endpoint of the store at
+// addr (host:port, as reported by ClusterStatus).
+func (c *Client) PingStore(ctx context.Context, addr string) (time.Duration, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return c.ping(ctx, addr)
+}
+
+// ping treats any HTTP response as a successful round trip; an unhealthy
+// target still answers.
+func (c *Client) ping(ctx context.Context, baseURL string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+httpapi.Version+"/healthz", nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error contacting %s: %w", baseURL, err)
+	}
+	resp.Body.Close()
+	return time.Since(start), nil
+}
+
+// TenantUsage is a tenant's quota and the data it holds. Zero limits mean no
+// limit.
+type TenantUsage struct {
+	Name     string    `json:"name"`
+	MaxKeys  int       `json:"max_keys,omitempty"`
+	MaxBytes int       `json:"max_bytes,omitempty"`
+	Keys     int       `json:"keys"`
+	Bytes    int       `json:"bytes"`
+	Measured time.Time `json:"measured"`
+}
+
+// Tenant returns the usage and quota of the tenant whose token the client
+// presents (see SetToken).
+func (c *Client) Tenant(ctx context.Context) (*TenantUsage, error) {
+	var usage TenantUsage
+	if err := c.do(ctx, http.MethodGet, "/tenant", nil, &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"kv/broker"
+	"kv/kvstore"
+	"kv/logging"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func runBroker(args []string) {
+	logCfg := logging.ConfigFromEnv()
+	defaults := broker.DefaultConfig()
+	fs := newFlagSet("broker", "[flags]", &logCfg)
+	configPath := fs.String("config", os.Getenv("KV_BROKER_CONFIG"), "JSON config file, reread on SIGHUP; flags override its values (env KV_BROKER_CONFIG)")
+	addr := fs.String("addr", defaults.Listen, "Address to listen on")
+	healthInterval := fs.Duration("health-interval", time.Duration(defaults.HealthInterval), "How often registered stores are probed")
+	snapshotInterval := fs.Duration("snapshot-interval", 0, "Periodic snapshot interval applied to every store (default: each store's own)")
+	shutdownTimeout := fs.Duration("shutdown-timeout", time.Duration(defaults.ShutdownTimeout), "How long to wait for in-flight requests when stopping")
+	storeTimeout := fs.Duration("store-timeout", broker.DefaultStoreTimeout, "Bound on each call to a store, except on the routes with their own in the config's store_timeouts")
+	adminToken := fs.String("admin-token", "", adminTokenUsage)
+	alertWebhook := fs.String("alert-webhook", "", "URL that store failure alerts are posted to (env ALERT_WEBHOOK_URL)")
+	fs.Parse(args)
+
+	// Settings come from the defaults, then the config file, then the
+	// environment, then flags, each overriding the one before. The same
+	// steps are repeated on every reload.
+	loadConfig := func() (broker.Config, error) {
+		cfg := defaults
+		if *configPath != "" {
+			var err error
+			if cfg, err = broker.LoadConfig(*configPath); err != nil {
+				return cfg, err
+			}
+		}
+		cfg.AdminToken = envOr("KV_ADMIN_TOKEN", cfg.AdminToken)
+		cfg.AlertWebhook = envOr("ALERT_WEBHOOK_URL", cfg.AlertWebhook)
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "addr":
+				cfg.Listen = *addr
+			case "health-interval":
+				cfg.HealthInterval = kvstore.Duration(*healthInterval)
+			case "snapshot-interval":
+				cfg.SnapshotInterval = kvstore.Duration(*snapshotInterval)
+			case "shutdown-timeout":
+				cfg.ShutdownTimeout = kvstore.Duration(*shutdownTimeout)
+			case "store-timeout":
+				cfg.StoreTimeouts = maps.Clone(cfg.StoreTimeouts)
+				if cfg.StoreTimeouts == nil {
+					cfg.StoreTimeouts = make(map[string]kvstore.Duration)
+				}
+				cfg.StoreTimeouts["default"] = kvstore.Duration(*storeTimeout)
+			case "admin-token":
+				cfg.AdminToken = *adminToken
+			case "alert-webhook":
+				cfg.AlertWebhook = *alertWebhook
+			}
+		})
+		return cfg, cfg.Validate()
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid broker configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+
+	logger := setupLogging("broker_server", logCfg)
+
+	// Initialize the broker
+	b := broker.NewBroker()
+
+	// Start peering
+	if err := b.StartPeering(); err != nil {
+		logger.Error("failed to start peering", "err", err)
+		os.Exit(1)
+	}
+
+	// Apply the configuration: admin token, alert webhook, health checks,
+	// snapshot schedule and configured stores
+	b.SetConfigSource(loadConfig)
+	b.ApplyConfig(context.Background(), cfg)
+
+	// Reread the configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			changed, err := b.ReloadConfig(context.Background())
+			if err != nil {
+				logger.Error("failed to reload config", "err", err)
+				continue
+			}
+			logger.Info("config reloaded", "changed", changed)
+		}
+	}()
+
+	// Start the HTTP server
+	logger.Info("starting broker web server", "address", cfg.Listen)
+	server := &http.Server{Addr: cfg.Listen, Handler: broker.NewBrokerHandler(b), ConnState: b.TrackConn}
+	cfg.ServerTimeouts.Apply(server)
+	errs := make(chan error, 1)
+	if err := serve(server, errs); err != nil {
+		logger.Error("error starting server", "err", err)
+		os.Exit(1)
+	}
+
+	// Serve until SIGINT or SIGTERM, then let in-flight requests finish
+	if err := waitForSignal(logger, errs, nil); err != nil {
+		logger.Error("server stopped", "err", err)
+		os.Exit(1)
+	}
+	shutdown(logger, server, time.Duration(cfg.ShutdownTimeout))
+	b.Close()
+	logger.Info("broker stopped")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kv/client"
+	"os"
+	"strings"
+)
+
+func runCLI(args []string) {
+	fs := newFlagSet("cli", "[flags] [command [args...]]", nil)
+	brokerURL := fs.String("broker", envOr("KV_BROKER", "http://localhost:8080"), "URL of the broker to talk to, or a comma-separated list to fail over between (env KV_BROKER)")
+	output := fs.String("output", "", "Output format: json, table or plain (default: each command's usual format)")
+	token := fs.String("token", os.Getenv("KV_TOKEN"), "Token to present to the broker, e.g. a tenant's (env KV_TOKEN)")
+	timeout := fs.Duration("timeout", client.DefaultTimeout, "Bound on each request to the broker (0 for none)")
+	historyFile := fs.String("history-file", defaultHistoryFile(), "File the interactive shell keeps its history in (env KV_HISTORY_FILE, empty disables)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: kv cli [--broker=URL] [--token=TOKEN] [--output=json|table|plain] [command [args...]]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Without a command an interactive shell is started.")
+		fs.PrintDefaults()
+		fmt.Fprintln(os.Stderr)
+		printHelp(os.Stderr)
+	}
+	fs.Parse(args)
+	if !validOutput(*output) {
+		fmt.Fprintf(os.Stderr, "Invalid --output %q: want json, table or plain\n", *output)
+		os.Exit(2)
+	}
+
+	cli := &CLI{client: client.NewMulti(strings.Split(*brokerURL, ",")), out: os.Stdout, output: *output}
+	cli.client.SetToken(*token)
+	cli.client.SetTimeout(*timeout)
+	ctx := context.Background()
+
+	// Non-interactive: run the command given on the command line
+	if fs.NArg() > 0 {
+		if err := cli.Execute(ctx, fs.Arg(0), fs.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Interactive shell
+	fmt.Printf("Connected to broker at %s. Type \"help\" for commands.\n", cli.client.BaseURL())
+	editor := newLineEditor(*historyFile)
+	for {
+		line, err := editor.ReadLine("kv> ")
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		editor.AddHistory(line)
+
+		fields, err := tokenize(line)
+		if err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "exit" || fields[0] == "quit" {
+			return
+		}
+		if fields[0] == "history" {
+			for i, entry := range editor.history {
+				fmt.Printf("%5d  %s\n", i+1, entry)
+			}
+			continue
+		}
+		if err := cli.Execute(ctx, fields[0], fields[1:]); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+}
+
+// cliFlags are the flags of "kv cli" that take a value.
+var cliFlags = map[string]bool{"broker": true, "output": true, "token": true, "timeout": true, "history-file": true}
+
+// cliShortcut returns a subcommand running the cli command name, so that
+// "kv status" is "kv cli status". The cli's flags may come anywhere among
+// the command's arguments.
+func cliShortcut(name string) func(args []string) {
+	return func(args []string) {
+		var flags, rest []string
+		for i := 0; i < len(args); i++ {
+			flagName, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+			if !strings.HasPrefix(args[i], "-") || !cliFlags[flagName] {
+				rest = append(rest, args[i])
+				continue
+			}
+			flags = append(flags, args[i])
+			if !hasValue && i+1 < len(args) {
+				i++
+				flags = append(flags, args[i])
+			}
+		}
+		runCLI(append(append(flags, name), rest...))
+	}
+}
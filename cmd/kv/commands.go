@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kv/client"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// command is a single CLI command.
+type command struct {
+	usage   string
+	help    string
+	minArgs int
+	maxArgs int // -1 means unlimited
+	run     func(ctx context.Context, cli *CLI, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"set": {
+			usage: "set <key> <value> [--ack=local|durable|replicated]", help: "Store a key-value pair; --ack waits for it to reach disk or the store's backup",
+			minArgs: 2, maxArgs: 3,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				if len(args) == 3 {
+					level, ok := strings.CutPrefix(args[2], "--ack=")
+					if !ok || level == "" {
+						return errors.New("usage: set <key> <value> [--ack=local|durable|replicated]")
+					}
+					ctx = client.WithAck(ctx, level)
+				}
+				if err := cli.client.Set(ctx, args[0], args[1]); err != nil {
+					return err
+				}
+				return cli.ok()
+			},
+		},
+		"get": {
+			usage: "get <key> [--max-staleness=5s]", help: "Retrieve the value of a key; --max-staleness lets a read replica that far behind answer",
+			minArgs: 1, maxArgs: 2,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				if len(args) == 2 {
+					bound, ok := strings.CutPrefix(args[1], "--max-staleness=")
+					d, err := time.ParseDuration(bound)
+					if !ok || err != nil || d < 0 {
+						return errors.New("usage: get <key> [--max-staleness=5s]")
+					}
+					ctx = client.WithMaxStaleness(ctx, d)
+				}
+				value, err := cli.client.Get(ctx, args[0])
+				if err != nil {
+					return err
+				}
+				return cli.render(map[string]string{"key": args[0], "value": value},
+					func(w io.Writer) { fmt.Fprintln(w, value) }, nil)
+			},
+		},
+		"delete": {
+			usage: "delete <key> [--if-value=<v>|--consistency=one|quorum|all]", help: "Remove a key-value pair; --if-value only while it holds that value, --consistency waits for its copies",
+			minArgs: 1, maxArgs: 2,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				if len(args) == 2 {
+					level, isLevel := strings.CutPrefix(args[1], "--consistency=")
+					value, isValue := strings.CutPrefix(args[1], "--if-value=")
+					switch {
+					case isLevel && level != "":
+						ctx = client.WithConsistency(ctx, level)
+					case isValue:
+						if err := cli.client.DeleteIf(ctx, args[0], value); errors.Is(err, client.ErrPreconditionFailed) {
+							return fmt.Errorf("key %q no longer holds %q: not deleted", args[0], value)
+						} else if err != nil {
+							return err
+						}
+						return cli.ok()
+					default:
+						return errors.New("usage: delete <key> [--if-value=<v>|--consistency=one|quorum|all]")
+					}
+				}
+				if err := cli.client.Delete(ctx, args[0]); err != nil {
+					return err
+				}
+				return cli.ok()
+			},
+		},
+		"delete-prefix": {
+			usage: "delete-prefix <prefix> [--dry-run]", help: "Delete every key starting with prefix; --dry-run only counts them",
+			minArgs: 1, maxArgs: 2,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				const usage = "usage: delete-prefix <prefix> [--dry-run]"
+				prefix, dryRun := "", false
+				for _, arg := range args {
+					switch {
+					case arg == "--dry-run":
+						dryRun = true
+					case strings.HasPrefix(arg, "--"):
+						return fmt.Errorf("unknown flag %q", arg)
+					case prefix == "":
+						prefix = arg
+					default:
+						return errors.New(usage)
+					}
+				}
+				if prefix == "" {
+					return errors.New(usage)
+				}
+				result, err := cli.client.DeletePrefix(ctx, prefix, dryRun)
+				if err != nil {
+					return err
+				}
+				names := make([]string, 0, len(result.Stores))
+				for name := range result.Stores {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				return cli.render(result, func(w io.Writer) {
+					verb := "Deleted"
+					if dryRun {
+						verb = "Would delete"
+					}
+					fmt.Fprintf(w, "%s %d keys\n", verb, result.Deleted)
+					for _, name := range names {
+						fmt.Fprintf(w, "  %s: %d\n", name, result.Stores[name])
+					}
+				}, nil)
+			},
+		},
+		"trash": {
+			usage: "trash [prefix]", help: "List the deleted keys that can still be restored, when the stores keep a trash",
+			maxArgs: 1,
+			run:     trash,
+		},
+		"undelete": {
+			usage: "undelete <key> | undelete --prefix <prefix>", help: "Restore a deleted key, or every deleted key starting with prefix, from the trash",
+			minArgs: 1, maxArgs: 2,
+			run: undelete,
+		},
+		"expire": {
+			usage: "expire <key> <seconds>", help: "Delete a key after the given number of seconds",
+			minArgs: 2, maxArgs: 2,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				seconds, err := strconv.Atoi(args[1])
+				if err != nil || seconds <= 0 {
+					return fmt.Errorf("invalid TTL %q: want a positive number of seconds", args[1])
+				}
+				if err := cli.client.Expire(ctx, args[0], time.Duration(seconds)*time.Second); err != nil {
+					return err
+				}
+				return cli.ok()
+			},
+		},
+		"ttl": {
+			usage: "ttl <key>", help: "Show the seconds left before a key expires (-1 if it never does)",
+			minArgs: 1, maxArgs: 1,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				ttl, ok, err := cli.client.TTL(ctx, args[0])
+				if err != nil {
+					return err
+				}
+				seconds := -1
+				if ok {
+					seconds = int(ttl / time.Second)
+				}
+				return cli.render(map[string]interface{}{"key": args[0], "ttl": seconds},
+					func(w io.Writer) { fmt.Fprintln(w, seconds) }, nil)
+			},
+		},
+		"persist": {
+			usage: "persist <key>", help: "Remove a key's TTL so it never expires",
+			minArgs: 1, maxArgs: 1,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				had, err := cli.client.Persist(ctx, args[0])
+				if err != nil {
+					return err
+				}
+				return cli.render(map[string]interface{}{"key": args[0], "persisted": had}, func(w io.Writer) {
+					if had {
+						fmt.Fprintln(w, "OK")
+					} else {
+						fmt.Fprintln(w, "Key has no TTL")
+					}
+				}, nil)
+			},
+		},
+		"incr": {
+			usage: "incr <name> [delta]", help: "Add delta (default 1, not negative) to a counter and print its new value",
+			minArgs: 1, maxArgs: 2,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				delta := int64(1)
+				if len(args) == 2 {
+					parsed, err := strconv.ParseInt(args[1], 10, 64)
+					if err != nil {
+						return fmt.Errorf("invalid delta %q", args[1])
+					}
+					delta = parsed
+				}
+				value, err := cli.client.Incr(ctx, args[0], delta)
+				if err != nil {
+					return err
+				}
+				return cli.render(map[string]interface{}{"key": args[0], "value": value},
+					func(w io.Writer) { fmt.Fprintln(w, value) }, nil)
+			},
+		},
+		"getall": {
+			usage: "getall", help: "List every key-value pair in the cluster",
+			run: printAll,
+		},
+		"find": {
+			usage: "find [--prefix=<p>] [--value-contains=<s>] [-i]", help: "List keys (and their stores) matching a key prefix and value substring",
+			maxArgs: -1,
+			run:     find,
+		},
+		"query": {
+			usage: "query <index> <value>", help: "List the keys whose value a secondary index holds under value",
+			minArgs: 2, maxArgs: 2,
+			run: query,
+		},
+		"list-kvs": {
+			usage: "list-kvs", help: "List the registered stores",
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				stores, err := cli.client.ListStores(ctx)
+				if err != nil {
+					return err
+				}
+				sort.Strings(stores)
+				return cli.render(stores, func(w io.Writer) {
+					for _, name := range stores {
+						fmt.Fprintln(w, name)
+					}
+				}, nil)
+			},
+		},
+		"enable-snapshot": {
+			usage: "enable-snapshot <store> <seconds>", help: "Save a store's snapshot periodically",
+			minArgs: 2, maxArgs: 2,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				interval, err := strconv.Atoi(args[1])
+				if err != nil || interval <= 0 {
+					return fmt.Errorf("invalid interval %q: want a positive number of seconds", args[1])
+				}
+				if err := cli.client.EnableSnapshots(ctx, args[0], interval); err != nil {
+					return storeError(args[0], err)
+				}
+				return cli.ok()
+			},
+		},
+		"disable-snapshot": {
+			usage: "disable-snapshot <store>", help: "Stop a store's periodic snapshots",
+			minArgs: 1, maxArgs: 1,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				if err := cli.client.DisableSnapshots(ctx, args[0]); err != nil {
+					return storeError(args[0], err)
+				}
+				return cli.ok()
+			},
+		},
+		"snapshot-status": {
+			usage: "snapshot-status [store]", help: "Show periodic snapshot settings and the last snapshot",
+			maxArgs: 1,
+			run:     printSnapshotStatus,
+		},
+		"default-ttl": {
+			usage: "default-ttl [store] [seconds]", help: "Show the TTL stores give keys written to them, or set a store's (0 for none)",
+			maxArgs: 2,
+			run:     defaultTTL,
+		},
+		"split": {
+			usage: "split <store> [target]", help: "Move half a store's keys, by hash, to target or the least loaded other store",
+			minArgs: 1, maxArgs: 2,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				target := ""
+				if len(args) == 2 {
+					target = args[1]
+				}
+				moved, target, err := cli.client.SplitStore(ctx, args[0], target)
+				if err != nil {
+					return storeError(args[0], err)
+				}
+				return cli.render(map[string]interface{}{"store": args[0], "target": target, "keys_moved": moved}, func(w io.Writer) {
+					fmt.Fprintf(w, "Moved %d keys off %s to %s\n", moved, args[0], target)
+				}, nil)
+			},
+		},
+		"merge": {
+			usage: "merge <store> [into]", help: "Move every key of a store into another, the least loaded by default, and remove it",
+			minArgs: 1, maxArgs: 2,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				into := ""
+				if len(args) == 2 {
+					into = args[1]
+				}
+				moved, into, err := cli.client.MergeStores(ctx, args[0], into)
+				if err != nil {
+					return storeError(args[0], err)
+				}
+				return cli.render(map[string]interface{}{"store": args[0], "into": into, "keys_moved": moved, "removed": true}, func(w io.Writer) {
+					fmt.Fprintf(w, "Moved %d keys off %s into %s\n", moved, args[0], into)
+					fmt.Fprintf(w, "Removed store %s\n", args[0])
+				}, nil)
+			},
+		},
+		"recover": {
+			usage: "recover <store>", help: "Replace a store's data with the backup its peer holds, and show the progress until loaded",
+			minArgs: 1, maxArgs: 1,
+			run: recoverStore,
+		},
+		"migration": {
+			usage: "migration [pause|resume|abort <store>]", help: "Show the progress of drains, handoffs, splits and merges, or pause, resume or abort a store's",
+			maxArgs: 2,
+			run:     migration,
+		},
+		"events": {
+			usage: "events [since]", help: "Show the cluster events the broker recorded, after a sequence number if given",
+			maxArgs: 1,
+			run:     events,
+		},
+		"hotkeys": {
+			usage: "hotkeys [limit]", help: "Show the keys read and written most often recently, and each store's part of the accesses",
+			maxArgs: 1,
+			run:     hotkeys,
+		},
+		"connections": {
+			usage: "connections", help: "Show the client connections to the broker and its connection pool to each store",
+			run: connections,
+		},
+		"validation": {
+			usage: "validation [set <file>]", help: "Show the broker's write validation rules and the writes each refused, or replace them with the JSON array in a file",
+			maxArgs: 2,
+			run:     validation,
+		},
+		"jobs": {
+			usage: "jobs [run <name>]", help: "Show the broker's recurring jobs and their latest runs, or run one now",
+			maxArgs: 2,
+			run:     jobs,
+		},
+		"delete-kv": {
+			usage: "delete-kv <name> [--drain|--handoff] [--dry-run]", help: "Remove a store; --drain first moves its keys to the others, --handoff has it push them to its ring successor, --dry-run only shows what would happen",
+			minArgs: 1, maxArgs: 3,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				const usage = "usage: delete-kv <name> [--drain|--handoff] [--dry-run]"
+				name, drain, handoff, dryRun := "", false, false, false
+				for _, arg := range args {
+					switch {
+					case arg == "--drain" && !handoff:
+						drain = true
+					case arg == "--handoff" && !drain:
+						handoff = true
+					case arg == "--dry-run":
+						dryRun = true
+					case strings.HasPrefix(arg, "-"):
+						return fmt.Errorf("unknown flag %q", arg)
+					case name == "":
+						name = arg
+					default:
+						return errors.New(usage)
+					}
+				}
+				if name == "" {
+					return errors.New(usage)
+				}
+				if dryRun {
+					mode := "remove"
+					if drain {
+						mode = "drain"
+					} else if handoff {
+						mode = "handoff"
+					}
+					return planRemoval(ctx, cli, name, mode)
+				}
+				if handoff {
+					moved, target, err := cli.client.HandOffStore(ctx, name)
+					if err != nil {
+						return storeError(name, err)
+					}
+					return cli.render(map[string]interface{}{"store": name, "removed": true, "keys_moved": moved, "handed_off_to": target}, func(w io.Writer) {
+						fmt.Fprintf(w, "Handed %d keys off %s to %s\n", moved, name, target)
+						fmt.Fprintf(w, "Removed store %s\n", name)
+					}, nil)
+				}
+				moved, err := cli.client.RemoveStore(ctx, name, drain)
+				if err != nil {
+					return storeError(name, err)
+				}
+				return cli.render(map[string]interface{}{"store": name, "removed": true, "keys_moved": moved}, func(w io.Writer) {
+					if drain {
+						fmt.Fprintf(w, "Moved %d keys off %s\n", moved, name)
+					}
+					fmt.Fprintf(w, "Removed store %s\n", name)
+				}, nil)
+			},
+		},
+		"snapshot": {
+			usage: "snapshot [attach <store> <profile>|profiles]", help: "Save a snapshot on every store, attach a configured snapshot profile to a store, or list the profiles",
+			maxArgs: 3,
+			run:     snapshot,
+		},
+		"status": {
+			usage: "status", help: "Show every store's health, key count, load and peers",
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				return printStatus(ctx, cli)
+			},
+		},
+		"ping": {
+			usage: "ping", help: "Measure the round trip to the broker and each store",
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				return ping(ctx, cli)
+			},
+		},
+		"quota": {
+			usage: "quota", help: "Show the tenant's key and byte usage against its quota",
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				usage, err := cli.client.Tenant(ctx)
+				if err != nil {
+					return err
+				}
+				limit := func(n int) string {
+					if n == 0 {
+						return "unlimited"
+					}
+					return strconv.Itoa(n)
+				}
+				return cli.render(usage, nil, func(w io.Writer) {
+					fmt.Fprintln(w, "TENANT\tKEYS\tMAX KEYS\tBYTES\tMAX BYTES")
+					fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\n", usage.Name, usage.Keys, limit(usage.MaxKeys), usage.Bytes, limit(usage.MaxBytes))
+				})
+			},
+		},
+		"import": {
+			usage: "import <file> [json|csv]", help: "Load key-value pairs from a JSON or CSV file (- for stdin)",
+			minArgs: 1, maxArgs: 2,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				return importFile(ctx, cli, args[0], args[1:])
+			},
+		},
+		"export": {
+			usage: "export <file> [json|csv]", help: "Write every key-value pair to a JSON or CSV file (- for stdout)",
+			minArgs: 1, maxArgs: 2,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				return exportFile(ctx, cli, args[0], args[1:])
+			},
+		},
+		"run": {
+			usage: "run <script> [--continue-on-error]", help: "Run the commands in a file, one per line (# starts a comment)",
+			minArgs: 1, maxArgs: 2,
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				path, continueOnError := "", false
+				for _, arg := range args {
+					switch {
+					case arg == "--continue-on-error":
+						continueOnError = true
+					case strings.HasPrefix(arg, "-") && arg != "-":
+						return fmt.Errorf("unknown flag %q", arg)
+					case path == "":
+						path = arg
+					default:
+						return errors.New("usage: run <script> [--continue-on-error]")
+					}
+				}
+				if path == "" {
+					return errors.New("usage: run <script> [--continue-on-error]")
+				}
+				return runScript(ctx, cli, path, continueOnError)
+			},
+		},
+		"help": {
+			usage: "help", help: "Show this help",
+			run: func(ctx context.Context, cli *CLI, args []string) error {
+				printHelp(cli.out)
+				return nil
+			},
+		},
+	}
+}
+
+func printHelp(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-24s %s\n", commands[name].usage, commands[name].help)
+	}
+	fmt.Fprintf(w, "  %-24s %s\n", "history", "Show the interactive shell's history")
+	fmt.Fprintf(w, "  %-24s %s\n", "exit", "Leave the interactive shell")
+}
+
+// storeError rewords the client's not-found errors for commands that name a store.
+func storeError(name string, err error) error {
+	if errors.Is(err, client.ErrStoreNotFound) || errors.Is(err, client.ErrNotFound) {
+		return fmt.Errorf("store %q not found", name)
+	}
+	return err
+}
+
+// CLI executes commands against a broker.
+type CLI struct {
+	client *client.Client
+	out    io.Writer
+	output string // json, table, plain or empty for each command's default
+}
+
+// printAll lists every key-value pair in key order, paging through the broker's scan API.
+func printAll(ctx context.Context, cli *CLI, args []string) error {
+	var items []client.ScanItem
+	cursor := ""
+	for {
+		page, err := cli.client.Scan(ctx, "", cursor, 0)
+		if err != nil {
+			return err
+		}
+		items = append(items, page.Items...)
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	if items == nil {
+		items = []client.ScanItem{}
+	}
+
+	return cli.render(items, func(w io.Writer) {
+		for _, item := range items {
+			fmt.Fprintf(w, "Store: %s, Key: %s, Value: %s\n", item.Store, item.Key, item.Value)
+		}
+	}, func(w io.Writer) {
+		fmt.Fprintln(w, "STORE\tKEY\tVALUE")
+		for _, item := range items {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", item.Store, item.Key, item.Value)
+		}
+	})
+}
+
+// Execute runs a single command with its arguments.
+func (cli *CLI) Execute(ctx context.Context, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q (try \"help\")", name)
+	}
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		return fmt.Errorf("usage: %s", cmd.usage)
+	}
+	return cmd.run(ctx, cli, args)
+}
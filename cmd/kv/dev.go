@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"kv/broker"
+	"kv/kvstore"
+	"kv/logging"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// runDev starts a broker and a number of stores in this process, each
+// server on its own mux and port, so the system can be tried from one
+// terminal.
+func runDev(args []string) {
+	logCfg := logging.ConfigFromEnv()
+	fs := newFlagSet("dev", "[flags]", &logCfg)
+	stores := fs.Int("stores", 3, "Number of stores to start")
+	brokerPort := fs.Int("broker-port", 8080, "Port the broker listens on")
+	basePort := fs.Int("base-port", 8081, "Port of the first store; the others use the ports after it")
+	healthInterval := fs.Duration("health-interval", defaultHealthInterval, "How often registered stores are probed")
+	snapshotInterval := fs.Duration("snapshot-interval", defaultSnapshotInterval, "How often each store saves a snapshot and backs up its peer")
+	shutdownTimeout := fs.Duration("shutdown-timeout", defaultShutdownTimeout, "How long to wait for in-flight requests when stopping")
+	adminToken := fs.String("admin-token", os.Getenv("KV_ADMIN_TOKEN"), adminTokenUsage+"; random if unset")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *stores < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	logger := setupLogging("dev", logCfg)
+	errs := make(chan error, *stores+1)
+	if *adminToken == "" {
+		token := make([]byte, 16)
+		rand.Read(token)
+		*adminToken = hex.EncodeToString(token)
+	}
+
+	// Start the broker first so stores have something to register with
+	b := broker.NewBroker()
+	b.SetAdminToken(*adminToken)
+	b.StartHealthChecks(*healthInterval)
+	brokerAddr := fmt.Sprintf("localhost:%d", *brokerPort)
+	brokerServer := &http.Server{Addr: fmt.Sprintf(":%d", *brokerPort), Handler: broker.NewBrokerHandler(b), ConnState: b.TrackConn}
+	kvstore.DefaultServerTimeouts().Apply(brokerServer)
+	if err := serve(brokerServer, errs); err != nil {
+		logger.Error("failed to start broker", "err", err)
+		os.Exit(1)
+	}
+	logger.Info("broker listening", "address", brokerAddr)
+
+	// Each store listens before registering so the broker can notify it of its peer
+	registerURL := fmt.Sprintf("http://%s/v1/register", brokerAddr)
+	var running []*devStore
+	for i := 0; i < *stores; i++ {
+		name := fmt.Sprintf("store%d", i+1)
+		port := *basePort + i
+		s, err := startDevStore(logger, name, port, registerURL, *adminToken, *snapshotInterval, *shutdownTimeout, errs)
+		if err != nil {
+			logger.Error("failed to start store", "store", name, "err", err)
+			os.Exit(1)
+		}
+		running = append(running, s)
+		logger.Info("store listening", "store", name, "address", fmt.Sprintf("localhost:%d", port))
+	}
+
+	fmt.Printf("Broker ready at http://%s with %d stores. Try: kv cli --broker http://%s\n", brokerAddr, *stores, brokerAddr)
+	fmt.Printf("Admin commands need the admin token: kv cli --broker http://%s --token %s\n", brokerAddr, *adminToken)
+
+	failed := waitForSignal(logger, errs, nil)
+	if failed != nil {
+		logger.Error("server stopped", "err", failed)
+	}
+
+	// Stop the broker first so no new requests reach the stores, then let
+	// each store finish its requests and save a final snapshot
+	shutdown(logger, brokerServer, *shutdownTimeout)
+	b.Close()
+	for _, s := range running {
+		s.stop()
+	}
+	if failed != nil {
+		os.Exit(1)
+	}
+}
+
+// devStore is a store started by runDev.
+type devStore struct {
+	store   *kvstore.KVStore
+	server  *http.Server
+	logger  *slog.Logger
+	timeout time.Duration
+	once    sync.Once
+}
+
+// stop lets the store's in-flight requests finish and saves a final
+// snapshot. Only the first call has any effect.
+func (s *devStore) stop() {
+	s.once.Do(func() {
+		shutdown(s.logger, s.server, s.timeout)
+		if err := s.store.Close(); err != nil {
+			s.logger.Error("failed to save final snapshot", "err", err)
+		}
+		s.logger.Info("store stopped")
+	})
+}
+
+// startDevStore loads a store's snapshot, serves it on its own mux and
+// registers it with the broker.
+func startDevStore(logger *slog.Logger, name string, port int, registerURL, adminToken string, snapshotInterval, shutdownTimeout time.Duration, errs chan<- error) (*devStore, error) {
+	store := kvstore.NewKVStore(name, fmt.Sprint(port))
+	handler := kvstore.NewKVStoreHandler(store)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port)}
+	kvstore.DefaultServerTimeouts().Apply(server)
+	s := &devStore{store: store, server: server, logger: logger.With("store", name), timeout: shutdownTimeout}
+	handler.EnableShutdown(adminToken, s.stop)
+	server.Handler = handler
+	server.RegisterOnShutdown(store.Events().Close) // end /watch streams
+
+	if err := store.Lock(); err != nil {
+		return nil, err
+	}
+	if err := store.LoadFromDisk(store.StartupSnapshotPath()); err != nil {
+		return nil, fmt.Errorf("failed to load snapshot: %w", err)
+	}
+	handler.SetSnapshotLoaded(true)
+
+	if err := serve(server, errs); err != nil {
+		return nil, err
+	}
+
+	store.StartPeriodicSnapshots(snapshotInterval)
+	store.StartExpiry(time.Second)
+	store.StartCompaction(kvstore.DefaultCompactionInterval, kvstore.DefaultCompactionThreshold)
+
+	if err := kvstore.RegisterWithBrokerToken(registerURL, name, fmt.Sprintf("localhost:%d", port), adminToken); err != nil {
+		return nil, fmt.Errorf("failed to register with broker: %w", err)
+	}
+	handler.SetRegistered(true)
+	return s, nil
+}
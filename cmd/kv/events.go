@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"kv/client"
+	"strconv"
+	"time"
+)
+
+// events lists the cluster events the broker recorded, after a sequence
+// number if one is given.
+func events(ctx context.Context, cli *CLI, args []string) error {
+	var since uint64
+	if len(args) > 0 {
+		var err error
+		if since, err = strconv.ParseUint(args[0], 10, 64); err != nil {
+			return fmt.Errorf("invalid sequence number %q", args[0])
+		}
+	}
+	list, _, err := cli.client.Events(ctx, since)
+	if err != nil {
+		return err
+	}
+	fields := func(e client.ClusterEvent) []interface{} {
+		return []interface{}{e.Seq, e.Time.Format(time.DateTime), e.Type, dash(e.Store), dash(e.Peer), dash(e.Details)}
+	}
+	return cli.render(list, func(w io.Writer) {
+		for _, e := range list {
+			fmt.Fprintln(w, fields(e)...)
+		}
+	}, func(w io.Writer) {
+		fmt.Fprintln(w, "SEQ\tTIME\tTYPE\tSTORE\tPEER\tDETAILS")
+		for _, e := range list {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", fields(e)...)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"kv/client"
+	"strings"
+)
+
+// find scans the cluster for keys with a prefix whose values contain a
+// substring. The prefix is applied by the stores; the value filter here.
+func find(ctx context.Context, cli *CLI, args []string) error {
+	flags := flag.NewFlagSet("find", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	prefix := flags.String("prefix", "", "only keys starting with this prefix")
+	contains := flags.String("value-contains", "", "only values containing this substring")
+	ignoreCase := flags.Bool("i", false, "match value-contains case-insensitively")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%v (usage: %s)", err, commands["find"].usage)
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q (usage: %s)", flags.Arg(0), commands["find"].usage)
+	}
+
+	needle := *contains
+	if *ignoreCase {
+		needle = strings.ToLower(needle)
+	}
+	matches := []client.ScanItem{}
+	cursor := ""
+	for {
+		page, err := cli.client.Scan(ctx, *prefix, cursor, 0)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			value := item.Value
+			if *ignoreCase {
+				value = strings.ToLower(value)
+			}
+			if strings.Contains(value, needle) {
+				matches = append(matches, item)
+			}
+		}
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+
+	return cli.render(matches, func(w io.Writer) {
+		for _, item := range matches {
+			fmt.Fprintln(w, item.Key, item.Store)
+		}
+	}, func(w io.Writer) {
+		fmt.Fprintln(w, "STORE\tKEY\tVALUE")
+		for _, item := range matches {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", item.Store, item.Key, item.Value)
+		}
+		fmt.Fprintf(w, "%d matches\n", len(matches))
+	})
+}
+
+// query lists the pairs whose value a secondary index holds under a value,
+// reading every page.
+func query(ctx context.Context, cli *CLI, args []string) error {
+	matches := []client.ScanItem{}
+	cursor := ""
+	for {
+		page, err := cli.client.Query(ctx, args[0], args[1], cursor, 0)
+		if err != nil {
+			return err
+		}
+		matches = append(matches, page.Items...)
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+
+	return cli.render(matches, func(w io.Writer) {
+		for _, item := range matches {
+			fmt.Fprintln(w, item.Key, item.Store)
+		}
+	}, func(w io.Writer) {
+		fmt.Fprintln(w, "STORE\tKEY\tVALUE")
+		for _, item := range matches {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", item.Store, item.Key, item.Value)
+		}
+		fmt.Fprintf(w, "%d matches\n", len(matches))
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kv/client"
+	"time"
+)
+
+// jobs lists the broker's recurring jobs and their latest runs, or runs one
+// now.
+func jobs(ctx context.Context, cli *CLI, args []string) error {
+	if len(args) > 0 {
+		if len(args) != 2 || args[0] != "run" {
+			return errors.New("usage: jobs [run <name>]")
+		}
+		run, err := cli.client.RunJob(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		return cli.render(run, func(w io.Writer) {
+			fmt.Fprintln(w, run.Job, run.Result, run.Finished.Sub(run.Started).Round(time.Millisecond), dash(run.Detail), dash(run.Error))
+		}, nil)
+	}
+
+	report, err := cli.client.Jobs(ctx)
+	if err != nil {
+		return err
+	}
+	fields := func(j client.JobStatus) []interface{} {
+		last, result := "-", "-"
+		if j.LastRun != nil {
+			last, result = j.LastRun.Started.Format(time.DateTime), j.LastRun.Result
+		}
+		if j.Running {
+			result = "running"
+		}
+		return []interface{}{j.Name, j.Kind, j.Schedule, j.Next.Format(time.DateTime), last, result}
+	}
+	return cli.render(report, func(w io.Writer) {
+		for _, j := range report.Jobs {
+			fmt.Fprintln(w, fields(j)...)
+		}
+	}, func(w io.Writer) {
+		fmt.Fprintln(w, "NAME\tKIND\tSCHEDULE\tNEXT\tLAST RUN\tRESULT")
+		for _, j := range report.Jobs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", fields(j)...)
+		}
+	})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxHistory is the number of history entries kept in memory and on disk.
+const maxHistory = 1000
+
+// errInterrupted is returned by ReadLine when the user presses Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads command lines from a terminal with basic readline-style
+// editing: cursor movement, history navigation and Ctrl-R reverse search.
+// When stdin is not a terminal it falls back to plain line reading.
+type lineEditor struct {
+	in          *bufio.Reader
+	out         io.Writer
+	fd          int
+	interactive bool
+
+	history     []string
+	historyFile string
+}
+
+// newLineEditor returns an editor on stdin/stdout, loading history from
+// historyFile (if non-empty).
+func newLineEditor(historyFile string) *lineEditor {
+	e := &lineEditor{
+		in:          bufio.NewReader(os.Stdin),
+		out:         os.Stdout,
+		fd:          int(os.Stdin.Fd()),
+		historyFile: historyFile,
+	}
+	e.interactive = isTerminal(e.fd)
+	e.loadHistory()
+	return e
+}
+
+// defaultHistoryFile returns $KV_HISTORY_FILE or ~/.kv_history.
+func defaultHistoryFile() string {
+	if path := os.Getenv("KV_HISTORY_FILE"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".kv_history")
+}
+
+func (e *lineEditor) loadHistory() {
+	if e.historyFile == "" {
+		return
+	}
+	data, err := os.ReadFile(e.historyFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+		os.WriteFile(e.historyFile, []byte(strings.Join(e.history, "\n")+"\n"), 0o600)
+	}
+}
+
+// AddHistory records a line in memory and appends it to the history file.
+func (e *lineEditor) AddHistory(line string) {
+	if strings.TrimSpace(line) == "" || strings.Contains(line, "\n") {
+		return
+	}
+	if len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[1:]
+	}
+	if e.historyFile == "" {
+		return
+	}
+	file, err := os.OpenFile(e.historyFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fmt.Fprintln(file, line)
+}
+
+// ReadLine shows prompt and returns the next line without its newline.
+// It returns io.EOF on end of input (or Ctrl-D on an empty line) and
+// errInterrupted on Ctrl-C.
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	if !e.interactive {
+		fmt.Fprint(e.out, prompt)
+		line, err := e.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		e.interactive = false
+		return e.ReadLine(prompt)
+	}
+	defer restore()
+	return e.edit(prompt)
+}
+
+// editState is the line being edited.
+type editState struct {
+	prompt  string
+	buf     []rune
+	pos     int
+	histPos int    // index into history while navigating; len(history) is the new line
+	pending string // the new line saved while browsing history
+}
+
+func (e *lineEditor) edit(prompt string) (string, error) {
+	st := &editState{prompt: prompt, histPos: len(e.history)}
+	e.refresh(st)
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(st.buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(st.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			st.deleteAt(st.pos)
+		case 1: // Ctrl-A
+			st.pos = 0
+		case 5: // Ctrl-E
+			st.pos = len(st.buf)
+		case 2: // Ctrl-B
+			st.moveLeft()
+		case 6: // Ctrl-F
+			st.moveRight()
+		case 11: // Ctrl-K
+			st.buf = st.buf[:st.pos]
+		case 21: // Ctrl-U
+			st.buf = st.buf[st.pos:]
+			st.pos = 0
+		case 16: // Ctrl-P
+			e.historyPrev(st)
+		case 14: // Ctrl-N
+			e.historyNext(st)
+		case 18: // Ctrl-R
+			line, done, err := e.reverseSearch(st)
+			if err != nil || done {
+				return line, err
+			}
+		case 127, 8: // Backspace
+			if st.pos > 0 {
+				st.pos--
+				st.deleteAt(st.pos)
+			}
+		case 27: // Escape sequence
+			e.handleEscape(st)
+		default:
+			if r >= 32 {
+				st.insert(r)
+			}
+		}
+		e.refresh(st)
+	}
+}
+
+func (e *lineEditor) handleEscape(st *editState) {
+	first, _, err := e.in.ReadRune()
+	if err != nil || (first != '[' && first != 'O') {
+		return
+	}
+	code, _, err := e.in.ReadRune()
+	if err != nil {
+		return
+	}
+	switch code {
+	case 'A':
+		e.historyPrev(st)
+	case 'B':
+		e.historyNext(st)
+	case 'C':
+		st.moveRight()
+	case 'D':
+		st.moveLeft()
+	case 'H':
+		st.pos = 0
+	case 'F':
+		st.pos = len(st.buf)
+	case '1', '3', '4', '7', '8':
+		if next, _, err := e.in.ReadRune(); err != nil || next != '~' {
+			return
+		}
+		switch code {
+		case '1', '7':
+			st.pos = 0
+		case '4', '8':
+			st.pos = len(st.buf)
+		case '3':
+			st.deleteAt(st.pos)
+		}
+	}
+}
+
+// reverseSearch implements Ctrl-R. It returns done=true when the user accepted
+// a match with Enter, in which case line should be executed.
+func (e *lineEditor) reverseSearch(st *editState) (line string, done bool, err error) {
+	var query []rune
+	match := -1
+	find := func(from int) int {
+		for i := from; i >= 0 && len(query) > 0; i-- {
+			if strings.Contains(e.history[i], string(query)) {
+				return i
+			}
+		}
+		return -1
+	}
+	show := func() {
+		found := ""
+		if match >= 0 {
+			found = e.history[match]
+		}
+		fmt.Fprintf(e.out, "\r(reverse-i-search)`%s': %s\x1b[K", string(query), found)
+	}
+	show()
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", true, err
+		}
+		switch {
+		case r == '\r' || r == '\n':
+			if match >= 0 {
+				st.buf = []rune(e.history[match])
+			}
+			fmt.Fprint(e.out, "\r\x1b[K"+st.prompt+string(st.buf)+"\r\n")
+			return string(st.buf), true, nil
+		case r == 18: // Ctrl-R again: older match
+			if older := find(match - 1); match > 0 && older >= 0 {
+				match = older
+			}
+		case r == 3 || r == 7: // Ctrl-C, Ctrl-G: abort search
+			return "", false, nil
+		case r == 127 || r == 8:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				match = find(len(e.history) - 1)
+			}
+		case r < 32: // any other control key leaves search with the match loaded
+			if match >= 0 {
+				st.buf = []rune(e.history[match])
+				st.pos = len(st.buf)
+			}
+			if r == 27 {
+				e.handleEscape(st)
+			}
+			return "", false, nil
+		default:
+			query = append(query, r)
+			start := match
+			if start < 0 {
+				start = len(e.history) - 1
+			}
+			match = find(start)
+		}
+		show()
+	}
+}
+
+func (e *lineEditor) historyPrev(st *editState) {
+	if st.histPos == 0 {
+		return
+	}
+	if st.histPos == len(e.history) {
+		st.pending = string(st.buf)
+	}
+	st.histPos--
+	st.buf = []rune(e.history[st.histPos])
+	st.pos = len(st.buf)
+}
+
+func (e *lineEditor) historyNext(st *editState) {
+	if st.histPos >= len(e.history) {
+		return
+	}
+	st.histPos++
+	if st.histPos == len(e.history) {
+		st.buf = []rune(st.pending)
+	} else {
+		st.buf = []rune(e.history[st.histPos])
+	}
+	st.pos = len(st.buf)
+}
+
+// refresh redraws the prompt and buffer and places the cursor.
+func (e *lineEditor) refresh(st *editState) {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", st.prompt, string(st.buf))
+	if back := len(st.buf) - st.pos; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
+
+func (st *editState) insert(r rune) {
+	st.buf = append(st.buf, 0)
+	copy(st.buf[st.pos+1:], st.buf[st.pos:])
+	st.buf[st.pos] = r
+	st.pos++
+}
+
+func (st *editState) deleteAt(i int) {
+	if i < 0 || i >= len(st.buf) {
+		return
+	}
+	st.buf = append(st.buf[:i], st.buf[i+1:]...)
+}
+
+func (st *editState) moveLeft() {
+	if st.pos > 0 {
+		st.pos--
+	}
+}
+
+func (st *editState) moveRight() {
+	if st.pos < len(st.buf) {
+		st.pos++
+	}
+}
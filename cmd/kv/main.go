@@ -0,0 +1,125 @@
+// Command kv runs every part of the system from one binary:
+//
+//	kv broker   start the broker
+//	kv store    start a key-value store and register it with the broker
+//	kv cli      talk to a running broker (one-off commands or an interactive shell)
+//	kv dev      start a broker and several stores in one process for trying things out
+//	kv expire   delete a key after the given number of seconds
+//	kv find     list keys matching a key prefix and value substring
+//	kv persist  remove a key's TTL
+//	kv ping     measure the round trip to the broker and each store
+//	kv ringsim  check peer ring invariants against random membership changes
+//	kv run      run a file of cli commands, one per line
+//	kv status   show every store's health, key count, load and peers
+//	kv ttl      show the seconds left before a key expires
+//	kv version  print build information
+package main
+
+import (
+	"flag"
+	"fmt"
+	"kv/logging"
+	"kv/version"
+	"log/slog"
+	"os"
+	"sort"
+)
+
+// subcommand is one of the kv subcommands.
+type subcommand struct {
+	summary string
+	run     func(args []string)
+}
+
+var subcommands map[string]subcommand
+
+func init() {
+	subcommands = map[string]subcommand{
+		"broker":  {summary: "Start the broker", run: runBroker},
+		"store":   {summary: "Start a key-value store and register it with the broker", run: runStore},
+		"cli":     {summary: "Talk to a running broker", run: runCLI},
+		"dev":     {summary: "Start a broker and several stores in one process", run: runDev},
+		"ringsim": {summary: "Check peer ring invariants against random membership changes", run: runRingSim},
+		"status":  {summary: "Show every store's health, key count, load and peers (kv cli status)", run: cliShortcut("status")},
+		"ping":    {summary: "Measure the round trip to the broker and each store (kv cli ping)", run: cliShortcut("ping")},
+		"run":     {summary: "Run a file of cli commands, one per line (kv cli run)", run: cliShortcut("run")},
+		"find":    {summary: "List keys matching a key prefix and value substring (kv cli find)", run: cliShortcut("find")},
+		"expire":  {summary: "Delete a key after the given number of seconds (kv cli expire)", run: cliShortcut("expire")},
+		"ttl":     {summary: "Show the seconds left before a key expires (kv cli ttl)", run: cliShortcut("ttl")},
+		"persist": {summary: "Remove a key's TTL so it never expires (kv cli persist)", run: cliShortcut("persist")},
+		"version": {summary: "Print build information", run: runVersion},
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		usage()
+		if len(os.Args) < 2 {
+			os.Exit(2)
+		}
+		return
+	}
+
+	sub, ok := subcommands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "kv: unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	sub.run(os.Args[2:])
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: kv <command> [flags] [args...]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, subcommands[name].summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, `Run "kv <command> --help" for a command's flags.`)
+}
+
+// newFlagSet returns the flag set for a subcommand. Servers pass a logging
+// config so every one of them accepts the same --log-* flags.
+func newFlagSet(name, args string, logCfg *logging.Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("kv "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kv %s %s\n\n", name, args)
+		fs.PrintDefaults()
+	}
+	if logCfg != nil {
+		logCfg.RegisterFlags(fs)
+	}
+	return fs
+}
+
+// envOr returns the environment variable key, or def if it is unset.
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// setupLogging configures the default logger for a server, exiting on a bad config.
+func setupLogging(component string, cfg logging.Config) *slog.Logger {
+	logger, err := logging.SetupWith(component, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to configure logging:", err)
+		os.Exit(1)
+	}
+	return logger
+}
+
+func runVersion(args []string) {
+	fs := newFlagSet("version", "", nil)
+	fs.Parse(args)
+	info := version.Get()
+	fmt.Printf("kv %s (commit %s, built %s, %s)\n", info.Version, info.Commit, info.BuildTime, info.GoVersion)
+}
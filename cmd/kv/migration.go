@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kv/client"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migration shows the progress of the latest drain, handoff, split or merge
+// of each store, or pauses, resumes or aborts one.
+func migration(ctx context.Context, cli *CLI, args []string) error {
+	if len(args) > 0 {
+		if len(args) != 2 {
+			return errors.New("usage: migration [pause|resume|abort <store>]")
+		}
+		status, err := cli.client.ControlMigration(ctx, args[1], args[0])
+		if err != nil {
+			return storeError(args[1], err)
+		}
+		return cli.render(status, func(w io.Writer) {
+			fmt.Fprintln(w, status.Store, status.State)
+		}, nil)
+	}
+
+	migrations, err := cli.client.Migrations(ctx)
+	if err != nil {
+		return err
+	}
+	fields := func(m client.MigrationStatus) []interface{} {
+		eta := "?"
+		if m.ETASeconds >= 0 {
+			eta = (time.Duration(m.ETASeconds) * time.Second).String()
+		}
+		progress := strconv.Itoa(m.KeysMoved) + "/" + strconv.Itoa(m.KeysTotal)
+		rate := fmt.Sprintf("%.0f/s", m.KeysPerSecond)
+		return []interface{}{m.Store, m.Kind, m.State, progress, m.BytesMoved, rate, eta, dash(m.Error)}
+	}
+	return cli.render(migrations, func(w io.Writer) {
+		for _, m := range migrations {
+			fmt.Fprintln(w, fields(m)...)
+		}
+	}, func(w io.Writer) {
+		fmt.Fprintln(w, "STORE\tKIND\tSTATE\tKEYS\tBYTES\tRATE\tETA\tERROR")
+		for _, m := range migrations {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", fields(m)...)
+		}
+	})
+}
+
+// planRemoval shows what removing a store in the given mode would do.
+func planRemoval(ctx context.Context, cli *CLI, name, mode string) error {
+	plan, err := cli.client.PlanRemoval(ctx, name, mode)
+	if err != nil {
+		return storeError(name, err)
+	}
+	return cli.render(plan, func(w io.Writer) {
+		keys := "unknown"
+		if plan.KeysAffected >= 0 {
+			keys = strconv.Itoa(plan.KeysAffected)
+		}
+		fmt.Fprintf(w, "Dry run: %s %s (keys affected: %s)\n", mode, name, keys)
+		fmt.Fprintf(w, "Stores contacted: %s\n", strings.Join(plan.StoresContacted, ", "))
+		for i, step := range plan.Steps {
+			fmt.Fprintf(w, "%d. %s\n", i+1, step)
+		}
+	}, nil)
+}
+
+// recoverPollInterval is how often recover checks the progress.
+const recoverPollInterval = 500 * time.Millisecond
+
+// recoverStore has a store recover its data from its peer's backup and
+// shows the progress until the backup is loaded.
+func recoverStore(ctx context.Context, cli *CLI, args []string) error {
+	name := args[0]
+	recovery, err := cli.client.RecoverStore(ctx, name)
+	if err != nil {
+		return storeError(name, err)
+	}
+	if cli.output != outputJSON {
+		fmt.Fprintf(cli.out, "Recovering %s from %s\n", name, recovery.Holder)
+	}
+	for recovery.Integrity.Status == "recovering" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(recoverPollInterval):
+		}
+		if recovery, err = cli.client.RecoveryStatus(ctx, name); err != nil {
+			return storeError(name, err)
+		}
+		if cli.output != outputJSON && recovery.Load.Phase != "done" {
+			fmt.Fprintf(cli.out, "%s: %d keys, %d/%d bytes\n", recovery.Load.Phase, recovery.Load.Keys, recovery.Load.BytesRead, recovery.Load.TotalBytes)
+		}
+	}
+	if recovery.Integrity.Status != "recovered" {
+		err = fmt.Errorf("store %s is %s after recovering", name, recovery.Integrity.Status)
+		if problems := recovery.Integrity.Problems; len(problems) > 0 {
+			err = fmt.Errorf("%w: %s", err, problems[len(problems)-1])
+		}
+		return err
+	}
+	return cli.render(recovery, func(w io.Writer) {
+		fmt.Fprintf(w, "Recovered %s: %d keys loaded from %s\n", name, recovery.Load.Keys, recovery.Holder)
+	}, nil)
+}
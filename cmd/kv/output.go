@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// Output formats selected with --output.
+const (
+	outputJSON  = "json"
+	outputTable = "table"
+	outputPlain = "plain"
+)
+
+func validOutput(format string) bool {
+	return format == "" || format == outputJSON || format == outputTable || format == outputPlain
+}
+
+// render writes a command's result in the selected output format: data as
+// indented JSON, or the plain or table form. Either human-readable form may
+// be nil, in which case the other one is used; without --output a command
+// prints its table form if it has one.
+func (cli *CLI) render(data interface{}, plain, table func(w io.Writer)) error {
+	format := cli.output
+	if format == "" {
+		format = outputTable
+	}
+	if format == outputTable && table == nil {
+		format = outputPlain
+	}
+	if format == outputPlain && plain == nil {
+		format = outputTable
+	}
+
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(cli.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(data)
+	case outputTable:
+		tw := tabwriter.NewWriter(cli.out, 0, 4, 2, ' ', 0)
+		table(tw)
+		return tw.Flush()
+	default:
+		plain(cli.out)
+		return nil
+	}
+}
+
+// ok reports that a command without a result succeeded.
+func (cli *CLI) ok() error {
+	return cli.render(map[string]string{"status": "ok"}, func(w io.Writer) { fmt.Fprintln(w, "OK") }, nil)
+}
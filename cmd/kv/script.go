@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// runScript executes the commands in path ("-" for stdin), one per line.
+// Blank lines and lines starting with # are skipped and "exit" ends the
+// script early. The first failing command aborts the script unless
+// continueOnError is set, in which case failures are reported and counted.
+func runScript(ctx context.Context, cli *CLI, path string, continueOnError bool) error {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	scanner := bufio.NewScanner(in)
+	ran, failed := 0, 0
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields, err := tokenize(line)
+		if err == nil {
+			if len(fields) == 0 {
+				continue
+			}
+			switch fields[0] {
+			case "exit", "quit":
+				return scriptResult(ran, failed)
+			case "run":
+				err = errors.New("scripts cannot run other scripts")
+			default:
+				err = cli.Execute(ctx, fields[0], fields[1:])
+			}
+		}
+		// A line that does not parse counts as a command that failed
+		ran++
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		if !continueOnError {
+			return err
+		}
+		failed++
+		fmt.Fprintln(os.Stderr, "Error:", err)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return scriptResult(ran, failed)
+}
+
+func scriptResult(ran, failed int) error {
+	if failed > 0 {
+		return fmt.Errorf("%d of %d commands failed", failed, ran)
+	}
+	return nil
+}
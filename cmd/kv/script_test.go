@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunScriptCountsLinesThatDoNotParse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.kv")
+	script := "# neither line reaches the broker\nset k \"v\nrun other.kv\n\nexit\nset never run\n"
+	if err := os.WriteFile(path, []byte(script), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := runScript(context.Background(), nil, path, true)
+	if err == nil || err.Error() != "2 of 2 commands failed" {
+		t.Errorf("runScript: %v, want 2 of 2 commands failed", err)
+	}
+}
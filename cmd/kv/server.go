@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 10 * time.Second
+
+// adminTokenUsage describes the --admin-token flag shared by the servers.
+const adminTokenUsage = "Token the broker presents to stores for admin calls such as /shutdown (env KV_ADMIN_TOKEN)"
+
+// serve listens on srv.Addr and serves in the background, reporting a
+// failed server on errs. A server stopped by shutdown is not a failure.
+func serve(srv *http.Server, errs chan<- error) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	serveListener(srv, ln, errs)
+	return nil
+}
+
+// serveListener is serve on a listener already open, such as one on port 0
+// whose port must be known before the server takes requests.
+func serveListener(srv *http.Server, ln net.Listener, errs chan<- error) {
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			errs <- fmt.Errorf("%s: %w", srv.Addr, err)
+		}
+	}()
+}
+
+// waitForSignal blocks until the process receives SIGINT or SIGTERM or stop
+// is closed, and returns nil, or until a server fails, and returns its error.
+// A nil stop is never closed.
+func waitForSignal(logger *slog.Logger, errs <-chan error, stop <-chan struct{}) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	select {
+	case sig := <-sigs:
+		logger.Info("shutting down", "signal", sig.String())
+		return nil
+	case <-stop:
+		logger.Info("shutting down", "reason", "requested")
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
+
+// shutdown stops srv accepting connections and waits up to timeout for
+// in-flight requests to finish.
+func shutdown(logger *slog.Logger, srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("requests still in flight at shutdown", "address", srv.Addr, "err", err)
+	}
+}
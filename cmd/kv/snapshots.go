@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+func printSnapshotStatus(ctx context.Context, cli *CLI, args []string) error {
+	store := ""
+	if len(args) > 0 {
+		store = args[0]
+	}
+	statuses, err := cli.client.SnapshotStatus(ctx, store)
+	if err != nil {
+		return storeError(store, err)
+	}
+
+	names := make([]string, 0, len(statuses))
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	when := func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return t.Local().Format(time.RFC3339)
+	}
+	fields := func(name string) []interface{} {
+		status := statuses[name]
+		enabled, interval := "off", "-"
+		if status.Enabled {
+			enabled = "on"
+			interval = time.Duration(status.IntervalSeconds * float64(time.Second)).String()
+		}
+		if status.Profile != "" {
+			enabled += " (profile " + status.Profile + ")"
+		} else if status.Managed {
+			enabled += " (managed)"
+		}
+		lastErr := status.LastError
+		if status.Error != "" {
+			// What the store reported before it became unreachable
+			enabled, lastErr = "?", status.Error
+		}
+		return []interface{}{name, enabled, interval, when(status.LastSuccess), when(status.LastFailure), dash(lastErr)}
+	}
+	return cli.render(statuses, func(w io.Writer) {
+		for _, name := range names {
+			fmt.Fprintln(w, fields(name)...)
+		}
+	}, func(w io.Writer) {
+		fmt.Fprintln(w, "STORE\tPERIODIC\tINTERVAL\tLAST SUCCESS\tLAST FAILURE\tLAST ERROR")
+		for _, name := range names {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", fields(name)...)
+		}
+	})
+}
+
+// snapshot saves a snapshot on every store, or attaches a snapshot profile to
+// a store or lists the profiles.
+func snapshot(ctx context.Context, cli *CLI, args []string) error {
+	switch {
+	case len(args) == 0:
+		if err := cli.client.Snapshot(ctx); err != nil {
+			return err
+		}
+		return cli.ok()
+	case args[0] == "attach" && len(args) == 3:
+		if err := cli.client.AttachSnapshotProfile(ctx, args[1], args[2]); err != nil {
+			return storeError(args[1], err)
+		}
+		return cli.ok()
+	case args[0] == "profiles" && len(args) == 1:
+		return printSnapshotProfiles(ctx, cli)
+	}
+	return errors.New("usage: snapshot [attach <store> <profile>|profiles]")
+}
+
+func printSnapshotProfiles(ctx context.Context, cli *CLI) error {
+	profiles, err := cli.client.SnapshotProfiles(ctx)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := func(name string) []interface{} {
+		p := profiles[name]
+		format, compression, retain := "-", "-", "-"
+		if p.Destination != "" {
+			format, compression, retain = "json", "none", "all"
+			if p.Format != "" {
+				format = p.Format
+			}
+			if p.Compression != "" {
+				compression = p.Compression
+			}
+			if p.Retain > 0 {
+				retain = strconv.Itoa(p.Retain)
+			}
+		}
+		return []interface{}{name, p.Interval, dash(p.Destination), format, compression, retain}
+	}
+	return cli.render(profiles, func(w io.Writer) {
+		for _, name := range names {
+			fmt.Fprintln(w, fields(name)...)
+		}
+	}, func(w io.Writer) {
+		fmt.Fprintln(w, "PROFILE\tINTERVAL\tDESTINATION\tFORMAT\tCOMPRESSION\tRETAIN")
+		for _, name := range names {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", fields(name)...)
+		}
+	})
+}
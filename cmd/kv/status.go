@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pingTimeout bounds each round trip made by the ping command.
+const pingTimeout = 5 * time.Second
+
+func printStatus(ctx context.Context, cli *CLI) error {
+	status, err := cli.client.ClusterStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	type row struct{ name, address, health, keys, load, ops, memory, snapshotAge, backsUp, backedUpBy, version string }
+	rows := make([]row, 0, len(status.Stores))
+	up := 0
+	for _, store := range status.Stores {
+		health := store.Health.Status
+		if store.Health.Status == "UP" {
+			up++
+		} else if store.Health.LastError != "" {
+			health += " (" + store.Health.LastError + ")"
+		}
+		if store.Health.Integrity != "" {
+			health += " (" + store.Health.Integrity + ")"
+		}
+		keys, ver := "-", "unreachable"
+		if store.Version != nil {
+			keys = fmt.Sprint(store.Keys)
+			ver = store.Version.Version
+		}
+		ops, memory, snapshotAge := "-", "-", "-"
+		if report := store.Health.LoadReport; report != nil {
+			ops = fmt.Sprintf("%.1f", report.OpsPerSecond)
+			memory = fmt.Sprintf("%.1fMiB", float64(report.MemoryBytes)/(1<<20))
+			if report.SnapshotAgeSeconds >= 0 {
+				snapshotAge = (time.Duration(report.SnapshotAgeSeconds) * time.Second).String()
+			}
+		}
+		rows = append(rows, row{store.Name, store.Address, health, keys, fmt.Sprint(store.Load), ops, memory, snapshotAge,
+			dash(store.BacksUp), dash(store.BackedUpBy), ver})
+	}
+
+	return cli.render(status, func(w io.Writer) {
+		for _, r := range rows {
+			fmt.Fprintln(w, r.name, r.address, r.health, r.keys, r.load, r.ops, r.memory, r.snapshotAge, r.backsUp, r.backedUpBy, r.version)
+		}
+	}, func(w io.Writer) {
+		fmt.Fprintf(w, "Broker %s: version %s (%s)\n", cli.client.BaseURL(), status.Broker.Version, status.Broker.Commit)
+		if len(rows) == 0 {
+			fmt.Fprintln(w, "No stores registered")
+			return
+		}
+		fmt.Fprintln(w, "STORE\tADDRESS\tHEALTH\tKEYS\tLOAD\tOPS/S\tMEMORY\tSNAPSHOT AGE\tBACKS UP\tBACKED UP BY\tVERSION")
+		for _, r := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.name, r.address, r.health, r.keys, r.load, r.ops, r.memory, r.snapshotAge, r.backsUp, r.backedUpBy, r.version)
+		}
+		fmt.Fprintf(w, "%d/%d stores up\n", up, len(rows))
+		if status.MixedVersions {
+			fmt.Fprintln(w, "Warning: stores are running different versions")
+		}
+	})
+}
+
+// connections shows the client connections to the broker and the broker's
+// connection pool to each store.
+func connections(ctx context.Context, cli *CLI, args []string) error {
+	stats, err := cli.client.Connections(ctx)
+	if err != nil {
+		return err
+	}
+	names := slices.Sorted(maps.Keys(stats.Stores))
+	percent := func(f float64) string { return fmt.Sprintf("%.0f%%", 100*f) }
+	return cli.render(stats, func(w io.Writer) {
+		c := stats.Clients
+		fmt.Fprintln(w, "clients", c.Open, c.Active, c.Idle, c.Requests, percent(c.ReuseRate))
+		for _, name := range names {
+			s := stats.Stores[name]
+			fmt.Fprintln(w, name, s.Address, s.Open, s.InUse, s.Idle, s.Requests, percent(s.ReuseRate), percent(s.Utilization))
+		}
+	}, func(w io.Writer) {
+		c := stats.Clients
+		fmt.Fprintf(w, "Clients: %d open (%d active, %d idle), %d requests, %s on kept-alive connections\n",
+			c.Open, c.Active, c.Idle, c.Requests, percent(c.ReuseRate))
+		if len(names) == 0 {
+			fmt.Fprintln(w, "No connections to stores")
+			return
+		}
+		fmt.Fprintln(w, "STORE\tADDRESS\tOPEN\tIN USE\tIDLE\tREQUESTS\tREUSED\tUTILIZATION")
+		for _, name := range names {
+			s := stats.Stores[name]
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\n", name, s.Address, s.Open, s.InUse, s.Idle, s.Requests, percent(s.ReuseRate), percent(s.Utilization))
+		}
+	})
+}
+
+// hotkeys shows the keys accessed most often and each store's part of the
+// accesses.
+func hotkeys(ctx context.Context, cli *CLI, args []string) error {
+	limit := 10
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid limit %q: want a positive number", args[0])
+		}
+		limit = n
+	}
+	report, err := cli.client.HotKeys(ctx, limit)
+	if err != nil {
+		return err
+	}
+	names := slices.Sorted(maps.Keys(report.Stores))
+	percent := func(f float64) string { return fmt.Sprintf("%.1f%%", 100*f) }
+	return cli.render(report, func(w io.Writer) {
+		for _, k := range report.Keys {
+			fmt.Fprintln(w, k.Key, k.Store, k.Count, percent(k.Share), percent(k.ClusterShare))
+		}
+	}, func(w io.Writer) {
+		fmt.Fprintf(w, "Accesses in the last few minutes (counts halve every %s):\n", report.HalfLife)
+		for _, name := range names {
+			if s := report.Stores[name]; s.Error != "" {
+				fmt.Fprintf(w, "  %s: %s\n", name, s.Error)
+			} else {
+				fmt.Fprintf(w, "  %s: %d (%s)\n", name, s.Total, percent(s.Share))
+			}
+		}
+		if len(report.Keys) == 0 {
+			fmt.Fprintln(w, "No keys accessed")
+			return
+		}
+		fmt.Fprintln(w, "KEY\tSTORE\tCOUNT\tOF STORE\tOF CLUSTER")
+		for _, k := range report.Keys {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", k.Key, k.Store, k.Count, percent(k.Share), percent(k.ClusterShare))
+		}
+		if len(report.Copies) > 0 {
+			fmt.Fprintln(w, "Reads spread over copies:")
+			for _, c := range report.Copies {
+				state := "copying"
+				if c.Serving {
+					state = "since " + c.Since.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "  %s: %s and %s (%s)\n", c.Key, c.Holder, strings.Join(c.Stores, ", "), state)
+			}
+		}
+	})
+}
+
+// pingResult is the outcome of one round trip made by the ping command.
+type pingResult struct {
+	Target  string  `json:"target"`
+	Address string  `json:"address"`
+	OK      bool    `json:"ok"`
+	RTTMs   float64 `json:"rtt_ms,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// ping measures a round trip to the broker and to every store it knows of.
+// It reports every target and fails if any of them could not be reached.
+func ping(ctx context.Context, cli *CLI) error {
+	measure := func(target, address string, fn func(context.Context) (time.Duration, error)) pingResult {
+		pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+		defer cancel()
+		rtt, err := fn(pingCtx)
+		if err != nil {
+			return pingResult{Target: target, Address: address, Error: err.Error()}
+		}
+		return pingResult{Target: target, Address: address, OK: true, RTTMs: float64(rtt.Microseconds()) / 1000}
+	}
+
+	results := []pingResult{measure("broker", cli.client.BaseURL(), cli.client.Ping)}
+	var failure error
+	if !results[0].OK {
+		failure = fmt.Errorf("broker unreachable")
+	} else if status, err := cli.client.ClusterStatus(ctx); err != nil {
+		failure = err
+	} else {
+		failed := 0
+		for _, store := range status.Stores {
+			result := measure(store.Name, store.Address, func(ctx context.Context) (time.Duration, error) {
+				return cli.client.PingStore(ctx, store.Address)
+			})
+			if !result.OK {
+				failed++
+			}
+			results = append(results, result)
+		}
+		if failed > 0 {
+			failure = fmt.Errorf("%d of %d stores unreachable", failed, len(status.Stores))
+		}
+	}
+
+	line := func(r pingResult, sep string) string {
+		if !r.OK {
+			return r.Target + sep + r.Address + sep + "FAILED" + sep + r.Error
+		}
+		return r.Target + sep + r.Address + sep + "ok" + sep + fmt.Sprintf("%.3fms", r.RTTMs)
+	}
+	err := cli.render(results, func(w io.Writer) {
+		for _, r := range results {
+			fmt.Fprintln(w, line(r, " "))
+		}
+	}, func(w io.Writer) {
+		for _, r := range results {
+			fmt.Fprintln(w, line(r, "\t"))
+		}
+	})
+	if failure != nil {
+		return failure
+	}
+	return err
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"kv/codec"
+	"kv/kvstore"
+	"kv/logging"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHealthInterval   = 5 * time.Second
+	defaultSnapshotInterval = 15 * time.Second
+)
+
+// warmUp loads the store's data from the backup held at holder, if it is
+// newer than the local snapshot. Failing that, the store serves its local data.
+func warmUp(logger *slog.Logger, store *kvstore.KVStore, holder string, timeout time.Duration) {
+	if holder == "" {
+		logger.Info("no peer holds a backup of this store, serving local data")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := store.WarmUp(ctx, holder); err != nil {
+		logger.Warn("failed to warm up from peer, serving local data", "holder", holder, "err", err)
+	}
+}
+
+func runStore(args []string) {
+	logCfg := logging.ConfigFromEnv()
+	defaults := kvstore.DefaultStoreConfig()
+	fs := newFlagSet("store", "[flags] [<name> <port>]", &logCfg)
+	configPath := fs.String("config", os.Getenv("KV_STORE_CONFIG"), "JSON config file; flags override its values (env KV_STORE_CONFIG)")
+	name := fs.String("name", "", "Store name")
+	listen := fs.String("listen", "", `Address to listen on, e.g. ":8081"; port 0 picks a free port`)
+	advertise := fs.String("advertise", "", "Address the broker and peers reach the store at (default localhost and the listen port)")
+	brokerURL := fs.String("broker", "", `Broker registration URL, e.g. "http://localhost:8080/v1/register", or a comma-separated list (env BROKER_URL)`)
+	registerTimeout := fs.Duration("register-timeout", time.Duration(defaults.RegisterTimeout), "How long to keep retrying registration at startup")
+	heartbeatInterval := fs.Duration("heartbeat-interval", time.Duration(defaults.HeartbeatInterval), "How often the store re-registers with the broker")
+	dataDir := fs.String("data-dir", defaults.DataDir, "Directory for snapshot and peer backup files")
+	snapshotInterval := fs.Duration("snapshot-interval", time.Duration(defaults.SnapshotInterval), "How often the store saves a snapshot and backs up its peer")
+	warmUpTimeout := fs.Duration("warmup-timeout", time.Duration(defaults.WarmUpTimeout), "How long to wait for the peer's backup of the store's data before serving (0 skips warm-up)")
+	engine := fs.String("engine", defaults.Engine, "Storage engine (only \"memory\")")
+	codecName := fs.String("codec", defaults.Codec, "Format of snapshots and peer backups: "+strings.Join(codec.Names(), ", "))
+	adminToken := fs.String("admin-token", "", adminTokenUsage)
+	replicaOf := fs.String("replica-of", "", "Serve as a read replica of the store at this host:port")
+	shutdownTimeout := fs.Duration("shutdown-timeout", defaultShutdownTimeout, "How long to wait for in-flight requests when stopping")
+	peerTimeout := fs.Duration("peer-timeout", time.Duration(defaults.PeerTimeout), "Bound on each call to another store: peer backups, handoffs and replica polls")
+	trashRetention := fs.Duration("trash-retention", 0, "Keep deleted keys restorable with /undelete for this long (0 deletes them at once)")
+	maxConcurrent := fs.Int("max-concurrent-requests", 0, "Serve at most this many requests at once, answering 503 with Retry-After beyond it (0 for no limit)")
+	chaos := fs.Bool("chaos", false, "Enable the /chaos fault injection endpoints (testing only)")
+	fs.Parse(args)
+	if fs.NArg() != 0 && fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// Settings come from the defaults, then the config file, then the
+	// environment, then flags, each overriding the one before
+	cfg := defaults
+	if *configPath != "" {
+		var err error
+		if cfg, err = kvstore.LoadStoreConfig(*configPath); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to load config:", err)
+			os.Exit(1)
+		}
+	}
+	cfg.Broker = envOr("BROKER_URL", cfg.Broker)
+	cfg.AdminToken = envOr("KV_ADMIN_TOKEN", cfg.AdminToken)
+	if fs.NArg() == 2 {
+		// Positional arguments, as in "kv store store1 8081"
+		cfg.Name, cfg.Listen = fs.Arg(0), ":"+fs.Arg(1)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			cfg.Name = *name
+		case "listen":
+			cfg.Listen = *listen
+		case "advertise":
+			cfg.Advertise = *advertise
+		case "broker":
+			cfg.Broker = *brokerURL
+		case "register-timeout":
+			cfg.RegisterTimeout = kvstore.Duration(*registerTimeout)
+		case "heartbeat-interval":
+			cfg.HeartbeatInterval = kvstore.Duration(*heartbeatInterval)
+		case "data-dir":
+			cfg.DataDir = *dataDir
+		case "snapshot-interval":
+			cfg.SnapshotInterval = kvstore.Duration(*snapshotInterval)
+		case "warmup-timeout":
+			cfg.WarmUpTimeout = kvstore.Duration(*warmUpTimeout)
+		case "engine":
+			cfg.Engine = *engine
+		case "codec":
+			cfg.Codec = *codecName
+		case "admin-token":
+			cfg.AdminToken = *adminToken
+		case "replica-of":
+			cfg.ReplicaOf = *replicaOf
+		case "peer-timeout":
+			cfg.PeerTimeout = kvstore.Duration(*peerTimeout)
+		case "trash-retention":
+			cfg.TrashRetention = kvstore.Duration(*trashRetention)
+		case "max-concurrent-requests":
+			cfg.MaxConcurrentRequests = *maxConcurrent
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid store configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	kvname := cfg.Name
+
+	logger := setupLogging("kvstore_server", logCfg).With("store", kvname)
+
+	kvStoreInstance := kvstore.NewKVStore(kvname, "")
+	kvStoreInstance.SetDataDir(cfg.DataDir)
+	storeCodec, _ := codec.Lookup(cfg.Codec) // checked by Validate
+	kvStoreInstance.SetCodec(storeCodec)
+	handler := kvstore.NewKVStoreHandler(kvStoreInstance)
+
+	// Refuse to share the data directory with a running store of the same
+	// name, before looking at its running marker or snapshot
+	if err := kvStoreInstance.Lock(); err != nil {
+		logger.Error("failed to lock data directory", "dir", cfg.DataDir, "err", err)
+		os.Exit(1)
+	}
+
+	// A marker left behind by the previous run means it crashed or was
+	// killed before saving its final snapshot
+	unclean, err := kvStoreInstance.MarkRunning()
+	if err != nil {
+		logger.Error("failed to write running marker", "err", err)
+		os.Exit(1)
+	}
+
+	if cfg.MaxConcurrentRequests > 0 {
+		handler.LimitConcurrency(cfg.MaxConcurrentRequests, time.Duration(cfg.ConcurrencyWait))
+	}
+	if *chaos {
+		handler.EnableFaultInjection(func() {
+			logger.Error("crashing on request to /chaos/crash")
+			os.Exit(1)
+		})
+	}
+
+	// Let the broker stop the store when it removes it
+	stopRequested := make(chan struct{})
+	handler.EnableShutdown(cfg.AdminToken, func() { close(stopRequested) })
+
+	kvStoreInstance.SetPeerTimeout(time.Duration(cfg.PeerTimeout))
+	kvStoreInstance.SetBackgroundLimit(cfg.BackgroundLimit)
+	kvStoreInstance.SetDefaultTTL(time.Duration(cfg.DefaultTTL))
+	kvStoreInstance.SetTombstoneHorizon(time.Duration(cfg.TombstoneHorizon))
+	kvStoreInstance.SetTrashRetention(time.Duration(cfg.TrashRetention))
+	if cfg.Cache != nil {
+		if err := kvStoreInstance.EnableCache(cfg.Cache.Origin, time.Duration(cfg.Cache.Timeout)); err != nil {
+			logger.Error("failed to enable cache mode", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// Create the indexes before loading, so the snapshot is indexed too
+	for _, spec := range cfg.Indexes {
+		if err := kvStoreInstance.CreateIndex(spec); err != nil {
+			logger.Error("failed to create index", "index", spec.Name, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// Listen before restoring the snapshot, so /readyz and /load-status
+	// can be watched during a long restore, and before registering so the
+	// broker can notify the store of its peer
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		logger.Error("error starting server", "address", cfg.Listen, "err", err)
+		os.Exit(1)
+	}
+	// On port 0 the kernel picks the port, and the store registers that one
+	cfg.Listen = ln.Addr().String()
+	kvStoreInstance.IPAddress = cfg.AdvertiseAddress()
+	logger.Info("starting KVStore web server", "address", cfg.Listen, "advertise", kvStoreInstance.IPAddress)
+	server := &http.Server{Addr: cfg.Listen, Handler: handler}
+	cfg.ServerTimeouts.Apply(server)
+	server.RegisterOnShutdown(kvStoreInstance.Events().Close) // end /watch streams
+	errs := make(chan error, 1)
+	handler.SetRestoring(true)
+	serveListener(server, ln, errs)
+
+	// Restore the last local snapshot, checking it and the peer backups
+	// held; data routes answer 503 until it is done
+	integrity, err := kvStoreInstance.LoadChecked(kvStoreInstance.StartupSnapshotPath())
+	if err != nil {
+		logger.Error("failed to load snapshot", "err", err)
+		os.Exit(1)
+	}
+	// A replica's copy from the primary replaces a corrupt snapshot anyway
+	corrupt := integrity.Status == kvstore.IntegrityCorrupt && cfg.ReplicaOf == ""
+	if integrity.Status != kvstore.IntegrityOK {
+		logger.Warn("integrity self-check found problems", "status", integrity.Status, "problems", integrity.Problems)
+	}
+	handler.SetSnapshotLoaded(true)
+	handler.SetRestoring(false)
+	if cfg.ReplicaOf != "" {
+		// The copy taken from the primary replaces the snapshot
+		kvStoreInstance.FollowPrimary(cfg.ReplicaOf, kvstore.DefaultReplicaPollInterval)
+		logger.Info("serving as a read replica", "primary", cfg.ReplicaOf)
+	}
+
+	// Start snapshots before registering, so a schedule the broker applies
+	// on registration replaces the store's own
+	kvStoreInstance.StartPeriodicSnapshots(time.Duration(cfg.SnapshotInterval))
+	kvStoreInstance.StartExpiry(time.Second)
+	if cfg.CompactionInterval > 0 {
+		kvStoreInstance.StartCompaction(time.Duration(cfg.CompactionInterval), cfg.CompactionThreshold)
+	}
+
+	// After an unclean shutdown the peer's backup is likely newer than the
+	// snapshot, so the store warms up from it even if warm-up is off
+	warmUpFor := time.Duration(cfg.WarmUpTimeout)
+	if unclean && warmUpFor == 0 {
+		warmUpFor = kvstore.DefaultWarmUpTimeout
+	}
+
+	// Register with Broker, retrying while it is unavailable, then keep
+	// re-registering in case it restarts. A store that warms up registers
+	// as warming, so the broker routes nothing to it yet. A corrupt store
+	// registers as warming too, until it has recovered its data from its
+	// peer when the broker asks it to.
+	warm := cfg.ReplicaOf == "" && warmUpFor > 0 && !corrupt
+	registration := kvstore.NewRegistration(cfg.BrokerURLs(), kvname, kvStoreInstance.IPAddress)
+	registration.SetReplicaOf(cfg.ReplicaOf)
+	registration.SetToken(cfg.AdminToken)
+	registration.SetUncleanShutdown(unclean)
+	registration.SetCorrupt(corrupt)
+	registration.SetWarming(warm || corrupt)
+	handler.SetWarming(warm || corrupt)
+	handler.OnRecovery(func(recovering bool) {
+		if !recovering {
+			registration.SetCorrupt(false)
+		}
+		if err := registration.SetWarming(recovering); err != nil {
+			// The next heartbeat reports it
+			logger.Warn("failed to report recovery to broker", "err", err)
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.RegisterTimeout))
+	err = registration.Register(ctx)
+	cancel()
+	if err != nil {
+		logger.Error("failed to register with broker", "broker", cfg.Broker, "err", err)
+		os.Exit(1)
+	}
+	logger.Info("registered with broker", "broker", registration.Broker())
+	handler.SetRegistered(true)
+	registration.StartHeartbeats(time.Duration(cfg.HeartbeatInterval))
+
+	if warm {
+		warmUp(logger, kvStoreInstance, registration.Backup(), warmUpFor)
+		handler.SetWarming(false)
+		if err := registration.SetWarming(false); err != nil {
+			// The next heartbeat reports it
+			logger.Warn("failed to report warm-up to broker", "err", err)
+		}
+	}
+
+	// Serve until SIGINT or SIGTERM, or until the broker asks the store to stop
+	failed := waitForSignal(logger, errs, stopRequested)
+	registration.Stop()
+	select {
+	case <-stopRequested:
+		// The broker has already removed the store
+	default:
+		if failed != nil {
+			logger.Error("server stopped", "err", failed)
+			break
+		}
+		// Leave the cluster first so the broker stops sending requests here
+		if err := registration.Deregister(); err != nil {
+			logger.Warn("failed to deregister from broker", "broker", registration.Broker(), "err", err)
+		}
+	}
+
+	// Have the peer holding the backup of the store's data take a last one
+	// while the store still serves it. A store still corrupt has nothing
+	// worth backing up and would replace the backup it has to recover from.
+	if holder := registration.Backup(); holder != "" && failed == nil && cfg.ReplicaOf == "" && !kvStoreInstance.Corrupt() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.PeerTimeout))
+		if err := kvStoreInstance.RequestFinalBackup(ctx, holder); err != nil {
+			logger.Warn("failed to have peer take a final backup", "holder", holder, "err", err)
+		} else {
+			logger.Info("peer took a final backup", "holder", holder)
+		}
+		cancel()
+	}
+
+	// Finish in-flight requests, then save everything they wrote and
+	// remove the running marker
+	shutdown(logger, server, *shutdownTimeout)
+	if err := kvStoreInstance.Close(); err != nil {
+		logger.Error("failed to save final snapshot", "err", err)
+		os.Exit(1)
+	}
+	if failed != nil {
+		os.Exit(1)
+	}
+	logger.Info("store stopped")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// tokenize splits a command line into arguments, shell style:
+//
+//   - whitespace separates arguments
+//   - "double quotes" group words and honor the escapes \" \\ \n and \t
+//   - 'single quotes' group words and are taken literally
+//   - outside quotes a backslash escapes the next character
+//
+// A pair of quotes with nothing between them yields an empty argument.
+func tokenize(line string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inToken bool
+	)
+	flush := func() {
+		if inToken {
+			args = append(args, current.String())
+			current.Reset()
+			inToken = false
+		}
+	}
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t':
+			flush()
+		case r == '\\':
+			if i+1 >= len(runes) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			current.WriteRune(runes[i])
+			inToken = true
+		case r == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			current.WriteString(string(runes[i+1 : end]))
+			inToken = true
+			i = end
+		case r == '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					switch runes[i] {
+					case 'n':
+						current.WriteRune('\n')
+					case 't':
+						current.WriteRune('\t')
+					case '"', '\\':
+						current.WriteRune(runes[i])
+					default:
+						current.WriteRune('\\')
+						current.WriteRune(runes[i])
+					}
+					continue
+				}
+				current.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inToken = true
+		default:
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+	flush()
+	return args, nil
+}
+
+func indexRune(runes []rune, from int, target rune) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == target {
+			return i
+		}
+	}
+	return -1
+}
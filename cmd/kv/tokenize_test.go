@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+		err  string
+	}{
+		{"words", "set k v", []string{"set", "k", "v"}, ""},
+		{"runs of whitespace", " set \t k   v ", []string{"set", "k", "v"}, ""},
+		{"empty line", "", nil, ""},
+		{"double quotes", `set k "hello world"`, []string{"set", "k", "hello world"}, ""},
+		{"single quotes", `set k 'hello world'`, []string{"set", "k", "hello world"}, ""},
+		{"double quote escapes", `"a\"b\\c\nd\te"`, []string{"a\"b\\c\nd\te"}, ""},
+		{"unknown escape kept", `"a\xb"`, []string{`a\xb`}, ""},
+		{"single quotes literal", `'a\"b\n'`, []string{`a\"b\n`}, ""},
+		{"backslash outside quotes", `a\ b c\'d`, []string{"a b", "c'd"}, ""},
+		{"empty double quotes", `set k ""`, []string{"set", "k", ""}, ""},
+		{"empty single quotes", `set k ''`, []string{"set", "k", ""}, ""},
+		{"empty quotes alone", `"" ''`, []string{"", ""}, ""},
+		{"mixed quoting in one argument", `a"b c"'d e'f`, []string{"ab cd ef"}, ""},
+		{"quotes inside the other quotes", `"it's" '"x"'`, []string{"it's", `"x"`}, ""},
+		{"unicode", `set ключ "значение ✓"`, []string{"set", "ключ", "значение ✓"}, ""},
+		{"unterminated double quote", `set k "hello`, nil, "unterminated double quote"},
+		{"unterminated single quote", `set k 'hello`, nil, "unterminated single quote"},
+		{"escaped closing double quote", `"abc\"`, nil, "unterminated double quote"},
+		{"trailing backslash", `set k v\`, nil, "trailing backslash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tokenize(tt.line)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("tokenize(%q) = %q, %v; want error %q", tt.line, got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tokenize(%q): %v", tt.line, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("tokenize(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
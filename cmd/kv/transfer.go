@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// transferBatchSize is the number of pairs sent or fetched per broker request.
+const transferBatchSize = 500
+
+// transferFormat picks json or csv from an explicit format argument or the
+// file extension, defaulting to json.
+func transferFormat(path string, args []string) (string, error) {
+	format := "json"
+	if len(args) > 0 {
+		format = strings.ToLower(args[0])
+	} else if strings.EqualFold(filepath.Ext(path), ".csv") {
+		format = "csv"
+	}
+	if format != "json" && format != "csv" {
+		return "", fmt.Errorf("unknown format %q (want json or csv)", format)
+	}
+	return format, nil
+}
+
+// importFile loads key-value pairs from path ("-" for stdin) into the cluster
+// in batches. JSON files hold a single object of string values; CSV files
+// hold key,value rows with an optional key,value header.
+func importFile(ctx context.Context, cli *CLI, path string, args []string) error {
+	format, err := transferFormat(path, args)
+	if err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	total := 0
+	batch := make(map[string]string, transferBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := cli.client.MSet(ctx, batch); err != nil {
+			return fmt.Errorf("import stopped after %d keys: %w", total, err)
+		}
+		total += len(batch)
+		batch = make(map[string]string, transferBatchSize)
+		return nil
+	}
+	add := func(key, value string) error {
+		if key == "" {
+			return errors.New("empty key in input")
+		}
+		batch[key] = value
+		if len(batch) >= transferBatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	if format == "csv" {
+		err = readCSV(in, add)
+	} else {
+		err = readJSON(in, add)
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+	return cli.render(map[string]int{"imported": total}, func(w io.Writer) {
+		fmt.Fprintf(w, "Imported %d keys\n", total)
+	}, nil)
+}
+
+func readJSON(in io.Reader, add func(key, value string) error) error {
+	dec := json.NewDecoder(bufio.NewReader(in))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return errors.New("JSON input must be an object of key-value pairs")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("invalid JSON input: %w", err)
+		}
+		key := tok.(string)
+		var value string
+		if err := dec.Decode(&value); err != nil {
+			return fmt.Errorf("invalid value for key %q: %w", key, err)
+		}
+		if err := add(key, value); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("invalid JSON input: %w", err)
+	}
+	return nil
+}
+
+func readCSV(in io.Reader, add func(key, value string) error) error {
+	r := csv.NewReader(bufio.NewReader(in))
+	r.FieldsPerRecord = 2
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if line == 1 && record[0] == "key" && record[1] == "value" {
+			continue
+		}
+		if err := add(record[0], record[1]); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+// exportFile writes every key-value pair in the cluster to path ("-" for
+// stdout), paging through the broker's scan API so the dataset never has to
+// fit in one response.
+func exportFile(ctx context.Context, cli *CLI, path string, args []string) (err error) {
+	format, err := transferFormat(path, args)
+	if err != nil {
+		return err
+	}
+
+	out := cli.out
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		out = file
+	}
+	w := bufio.NewWriter(out)
+
+	var (
+		csvWriter *csv.Writer
+		total     int
+	)
+	if format == "csv" {
+		csvWriter = csv.NewWriter(w)
+		csvWriter.Write([]string{"key", "value"})
+	} else {
+		w.WriteString("{")
+	}
+
+	cursor := ""
+	for {
+		page, err := cli.client.Scan(ctx, "", cursor, transferBatchSize)
+		if err != nil {
+			return fmt.Errorf("export stopped after %d keys: %w", total, err)
+		}
+		for _, item := range page.Items {
+			if csvWriter != nil {
+				csvWriter.Write([]string{item.Key, item.Value})
+			} else {
+				key, _ := json.Marshal(item.Key)
+				value, _ := json.Marshal(item.Value)
+				if total > 0 {
+					w.WriteString(",")
+				}
+				fmt.Fprintf(w, "\n  %s: %s", key, value)
+			}
+			total++
+		}
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	} else {
+		w.WriteString("\n}\n")
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if path == "-" {
+		return nil
+	}
+	return cli.render(map[string]interface{}{"exported": total, "file": path}, func(w io.Writer) {
+		fmt.Fprintf(w, "Exported %d keys to %s\n", total, path)
+	}, nil)
+}
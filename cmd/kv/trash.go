@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kv/client"
+	"strings"
+	"time"
+)
+
+// trash lists the deleted keys the stores keep for undelete.
+func trash(ctx context.Context, cli *CLI, args []string) error {
+	prefix := ""
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	keys, err := cli.client.Trash(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	fields := func(k client.TrashedKey) []interface{} {
+		return []interface{}{k.Key, k.Store, k.Bytes, k.Deleted.Format(time.DateTime), k.Expires.Format(time.DateTime)}
+	}
+	return cli.render(keys, func(w io.Writer) {
+		for _, k := range keys {
+			fmt.Fprintln(w, fields(k)...)
+		}
+	}, func(w io.Writer) {
+		if len(keys) == 0 {
+			fmt.Fprintln(w, "The trash is empty")
+			return
+		}
+		fmt.Fprintln(w, "KEY\tSTORE\tBYTES\tDELETED\tPURGED AT")
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", fields(k)...)
+		}
+	})
+}
+
+// undelete restores a deleted key, or every deleted key starting with a
+// prefix, from the trash.
+func undelete(ctx context.Context, cli *CLI, args []string) error {
+	const usage = "usage: undelete <key> | undelete --prefix <prefix>"
+	if args[0] != "--prefix" {
+		if len(args) != 1 || strings.HasPrefix(args[0], "--") {
+			return errors.New(usage)
+		}
+		if err := cli.client.Undelete(ctx, args[0]); errors.Is(err, client.ErrNotFound) {
+			return fmt.Errorf("key %q is not in the trash", args[0])
+		} else if err != nil {
+			return err
+		}
+		return cli.ok()
+	}
+	if len(args) != 2 {
+		return errors.New(usage)
+	}
+	result, err := cli.client.UndeletePrefix(ctx, args[1])
+	if err != nil {
+		return err
+	}
+	return cli.render(result, func(w io.Writer) {
+		fmt.Fprintf(w, "Restored %d keys\n", result.Restored)
+		for _, key := range result.Skipped {
+			fmt.Fprintf(w, "  skipped %s: written again since it was deleted\n", key)
+		}
+	}, nil)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// defaultTTL sets a store's default TTL, or shows the default TTL of one
+// store or all of them.
+func defaultTTL(ctx context.Context, cli *CLI, args []string) error {
+	if len(args) == 2 {
+		seconds, err := strconv.Atoi(args[1])
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("invalid TTL %q: want a number of seconds, 0 for none", args[1])
+		}
+		if err := cli.client.SetDefaultTTL(ctx, args[0], time.Duration(seconds)*time.Second); err != nil {
+			return storeError(args[0], err)
+		}
+		return cli.ok()
+	}
+
+	store := ""
+	if len(args) > 0 {
+		store = args[0]
+	}
+	ttls, err := cli.client.DefaultTTLs(ctx, store)
+	if err != nil {
+		return storeError(store, err)
+	}
+
+	names := make([]string, 0, len(ttls))
+	for name := range ttls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := func(name string) []interface{} {
+		ttl := ttls[name]
+		value := "none"
+		if ttl.Seconds > 0 {
+			value = (time.Duration(ttl.Seconds) * time.Second).String()
+		}
+		if ttl.Managed {
+			value += " (managed)"
+		}
+		if ttl.Error != "" {
+			value = "?"
+		}
+		return []interface{}{name, value, dash(ttl.Error)}
+	}
+	return cli.render(ttls, func(w io.Writer) {
+		for _, name := range names {
+			fmt.Fprintln(w, fields(name)...)
+		}
+	}, func(w io.Writer) {
+		fmt.Fprintln(w, "STORE\tDEFAULT TTL\tERROR")
+		for _, name := range names {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", fields(name)...)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kv/client"
+	"os"
+	"strconv"
+)
+
+// validation lists the broker's write validation rules, or replaces them
+// with the JSON array of rules in a file ("-" for stdin).
+func validation(ctx context.Context, cli *CLI, args []string) error {
+	var (
+		rules []client.ValidationRule
+		err   error
+	)
+	if len(args) > 0 {
+		if len(args) != 2 || args[0] != "set" {
+			return errors.New("usage: validation [set <file>]")
+		}
+		var in io.Reader = os.Stdin
+		if args[1] != "-" {
+			file, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+		var set []client.ValidationRule
+		if err := json.NewDecoder(in).Decode(&set); err != nil {
+			return fmt.Errorf("%s: %w", args[1], err)
+		}
+		rules, err = cli.client.SetValidationRules(ctx, set)
+	} else {
+		rules, err = cli.client.ValidationRules(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	fields := func(r client.ValidationRule) []interface{} {
+		maxBytes := "-"
+		if r.MaxValueBytes > 0 {
+			maxBytes = strconv.Itoa(r.MaxValueBytes)
+		}
+		hasSchema := "no"
+		if len(r.Schema) > 0 {
+			hasSchema = "yes"
+		}
+		return []interface{}{r.Name, dash(r.Prefix), dash(r.KeyPattern), maxBytes, hasSchema, r.Rejected}
+	}
+	return cli.render(rules, func(w io.Writer) {
+		for _, r := range rules {
+			fmt.Fprintln(w, fields(r)...)
+		}
+	}, func(w io.Writer) {
+		if len(rules) == 0 {
+			fmt.Fprintln(w, "No validation rules")
+			return
+		}
+		fmt.Fprintln(w, "NAME\tPREFIX\tKEY PATTERN\tMAX BYTES\tSCHEMA\tREJECTED")
+		for _, r := range rules {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", fields(r)...)
+		}
+	})
+}
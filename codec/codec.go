@@ -0,0 +1,157 @@
+// Package codec encodes a store's key-value pairs for its snapshots, the
+// backups it holds of its peers and the transfers between stores, so the
+// format they are written in is chosen in one place.
+package codec
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Codec writes and reads a set of key-value pairs.
+type Codec interface {
+	// Name is how the codec is chosen in config, e.g. "json".
+	Name() string
+	// Extension ends the names of the files written with it, without the
+	// dot; it is unique among the registered codecs.
+	Extension() string
+	// ContentType is the media type of its encoding over HTTP.
+	ContentType() string
+	// Encode writes every pair in data to w, then the deadline in expiry of
+	// each of them that has a TTL; expiry may be nil. The deadlines follow
+	// the pairs, so readers that know only the pairs still read them.
+	Encode(w io.Writer, data map[string]string, expiry map[string]time.Time) error
+	// Decode reads the pairs and deadlines Encode wrote, counting each pair
+	// in keys if it is not nil; an encoding from before deadlines were kept
+	// has none. It reads no further than the end of the encoding it needs
+	// to see, so a caller hashing r can hash the rest itself.
+	Decode(r io.Reader, keys *atomic.Int64) (map[string]string, map[string]time.Time, error)
+}
+
+// expiring returns the deadlines in expiry of the keys in data, or nil if
+// none of them has one.
+func expiring(data map[string]string, expiry map[string]time.Time) map[string]time.Time {
+	var out map[string]time.Time
+	for key, at := range expiry {
+		if _, ok := data[key]; !ok {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]time.Time)
+		}
+		out[key] = at
+	}
+	return out
+}
+
+// unixDeadlines turns deadlines written as Unix nanoseconds back into times.
+func unixDeadlines(unix map[string]int64) map[string]time.Time {
+	if len(unix) == 0 {
+		return nil
+	}
+	expiry := make(map[string]time.Time, len(unix))
+	for key, ns := range unix {
+		expiry[key] = time.Unix(0, ns)
+	}
+	return expiry
+}
+
+// Default is the codec used when none is chosen, and the one files and
+// responses from before codecs were selectable are written in.
+const Default = "json"
+
+var (
+	mu     sync.RWMutex
+	codecs = map[string]Codec{}
+)
+
+func init() {
+	for _, c := range []Codec{JSON{}, Gob{}, MsgPack{}, Protobuf{}} {
+		Register(c)
+	}
+}
+
+// Register makes c selectable by name, replacing a codec of the same name.
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// Lookup returns the codec named name; empty means Default.
+func Lookup(name string) (Codec, error) {
+	if name == "" {
+		name = Default
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q (known: %s)", name, strings.Join(names(), ", "))
+	}
+	return c, nil
+}
+
+// Names returns the names of the registered codecs, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return names()
+}
+
+func names() []string {
+	list := make([]string, 0, len(codecs))
+	for name := range codecs {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// ForFile returns the codec whose extension ends filename, or the JSON
+// codec if none does.
+func ForFile(filename string) Codec {
+	ext := strings.TrimPrefix(path.Ext(filename), ".")
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, c := range codecs {
+		if c.Extension() == ext {
+			return c
+		}
+	}
+	return JSON{}
+}
+
+// ForContentType returns the codec of the media type contentType, or the
+// JSON codec if no codec has it, as for a response from a store that
+// predates codecs.
+func ForContentType(contentType string) Codec {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, c := range codecs {
+		if c.ContentType() == mediaType {
+			return c
+		}
+	}
+	return JSON{}
+}
+
+// Extensions returns the extensions of the registered codecs.
+func Extensions() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	exts := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		exts = append(exts, c.Extension())
+	}
+	sort.Strings(exts)
+	return exts
+}
@@ -0,0 +1,158 @@
+package codec
+
+import (
+	"bytes"
+	"maps"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// allCodecs are the codecs registered by the package.
+func allCodecs(t *testing.T) []Codec {
+	t.Helper()
+	var all []Codec
+	for _, name := range Names() {
+		c, err := Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, c)
+	}
+	return all
+}
+
+// binaryUnsafe holds values that trip up encodings meant for text.
+var binaryUnsafe = map[string]string{
+	"empty":       "",
+	"nul":         "a\x00b",
+	"newlines":    "line1\nline2\r\n",
+	"quotes":      `"quoted" 'and' \backslashed\`,
+	"json":        `{"not": "an object"}`,
+	"unicode":     "ключ ✓ 日本語 🙂",
+	"control":     "\x01\x02\x1f\x7f",
+	"\x00key nul": "v",
+	"":            "empty key",
+	"long":        strings.Repeat("x", 1<<16),
+}
+
+// invalidUTF8 holds values that are not text at all.
+var invalidUTF8 = map[string]string{
+	"truncated":  "\xff\xfe\xc3",
+	"high bytes": string([]byte{0x80, 0x81, 0xfd, 0xfe, 0xff}),
+	"\xff key":   "v",
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	deadline := time.Unix(1_800_000_000, 123_456_789)
+	tests := []struct {
+		name   string
+		data   map[string]string
+		expiry map[string]time.Time
+	}{
+		{"empty", map[string]string{}, nil},
+		{"empty with deadlines of missing keys", map[string]string{}, map[string]time.Time{"gone": deadline}},
+		{"pairs", map[string]string{"a": "1", "b": "2"}, nil},
+		{"binary-unsafe", binaryUnsafe, nil},
+		{"deadlines", map[string]string{"a": "1", "b": "2"}, map[string]time.Time{"a": deadline}},
+		{"binary-unsafe with deadlines", binaryUnsafe, map[string]time.Time{"nul": deadline, "": deadline}},
+		{"invalid UTF-8", invalidUTF8, map[string]time.Time{"\xff key": deadline}},
+	}
+	for _, c := range allCodecs(t) {
+		for _, tt := range tests {
+			if c.Name() == "json" && tt.name == "invalid UTF-8" {
+				continue // see TestJSONReplacesInvalidUTF8
+			}
+			t.Run(c.Name()+"/"+tt.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := c.Encode(&buf, tt.data, tt.expiry); err != nil {
+					t.Fatalf("Encode: %v", err)
+				}
+				var keys atomic.Int64
+				data, expiry, err := c.Decode(&buf, &keys)
+				if err != nil {
+					t.Fatalf("Decode: %v", err)
+				}
+				if !maps.Equal(data, tt.data) {
+					for key, value := range tt.data {
+						if got, ok := data[key]; !ok || got != value {
+							t.Errorf("key %q decoded as %q, %v; want %q", key, got, ok, value)
+						}
+					}
+					t.Fatalf("decoded %d pairs, want %d", len(data), len(tt.data))
+				}
+				if keys.Load() != int64(len(tt.data)) {
+					t.Errorf("counted %d keys, want %d", keys.Load(), len(tt.data))
+				}
+				want := expiring(tt.data, tt.expiry)
+				if len(expiry) != len(want) {
+					t.Errorf("decoded deadlines %v, want %v", expiry, want)
+				}
+				for key, at := range want {
+					if !expiry[key].Equal(at) {
+						t.Errorf("deadline of %q decoded as %v, want %v", key, expiry[key], at)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestJSONReplacesInvalidUTF8(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (JSON{}).Encode(&buf, map[string]string{"k": "a\xffb"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := JSON{}.Decode(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := data["k"], "a\uFFFDb"; got != want {
+		t.Errorf("decoded %q, want %q", got, want)
+	}
+}
+
+func TestCodecsRejectGarbage(t *testing.T) {
+	for _, c := range allCodecs(t) {
+		if _, _, err := c.Decode(strings.NewReader("\xffnot an encoding at all"), nil); err == nil {
+			t.Errorf("%s decoded garbage", c.Name())
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, name := range []string{"json", "gob", "msgpack", "protobuf"} {
+		c, err := Lookup(name)
+		if err != nil || c.Name() != name {
+			t.Errorf("Lookup(%q) = %v, %v", name, c, err)
+		}
+	}
+	if c, err := Lookup(""); err != nil || c.Name() != Default {
+		t.Errorf("Lookup(\"\") = %v, %v; want %s", c, err, Default)
+	}
+	for _, name := range []string{"yaml", "JSON", " json"} {
+		if c, err := Lookup(name); err == nil {
+			t.Errorf("Lookup(%q) = %v, want an error", name, c)
+		} else if !strings.Contains(err.Error(), "unknown codec") {
+			t.Errorf("Lookup(%q): %v, want an unknown codec error", name, err)
+		}
+	}
+}
+
+func TestForFileAndContentType(t *testing.T) {
+	for _, c := range allCodecs(t) {
+		if got := ForFile("store1.snapshot." + c.Extension()); got.Name() != c.Name() {
+			t.Errorf("ForFile(*.%s) = %s, want %s", c.Extension(), got.Name(), c.Name())
+		}
+		if got := ForContentType(c.ContentType() + "; charset=utf-8"); got.Name() != c.Name() {
+			t.Errorf("ForContentType(%s) = %s, want %s", c.ContentType(), got.Name(), c.Name())
+		}
+	}
+	if got := ForFile("store1.snapshot.yaml"); got.Name() != "json" {
+		t.Errorf("ForFile of an unknown extension = %s, want json", got.Name())
+	}
+	if got := ForContentType("text/plain"); got.Name() != "json" {
+		t.Errorf("ForContentType of an unknown type = %s, want json", got.Name())
+	}
+}
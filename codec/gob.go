@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Gob writes the number of pairs followed by each pair as a gob value, then
+// the deadlines of the keys with a TTL as a map of Unix nanoseconds. It is
+// more compact than JSON and cheaper to decode, but only Go reads it.
+type Gob struct{}
+
+// gobPair is a pair as Gob writes it.
+type gobPair struct {
+	Key, Value string
+}
+
+func (Gob) Name() string        { return "gob" }
+func (Gob) Extension() string   { return "gob" }
+func (Gob) ContentType() string { return "application/x-gob" }
+
+func (Gob) Encode(w io.Writer, data map[string]string, expiry map[string]time.Time) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(len(data)); err != nil {
+		return err
+	}
+	for key, value := range data {
+		if err := enc.Encode(gobPair{key, value}); err != nil {
+			return err
+		}
+	}
+	if deadlines := expiring(data, expiry); deadlines != nil {
+		// As Unix nanoseconds, after the pairs
+		unix := make(map[string]int64, len(deadlines))
+		for key, at := range deadlines {
+			unix[key] = at.UnixNano()
+		}
+		return enc.Encode(unix)
+	}
+	return nil
+}
+
+// Decode reads the count first, so a file cut short between two pairs is
+// caught rather than read as fewer keys.
+func (Gob) Decode(r io.Reader, keys *atomic.Int64) (map[string]string, map[string]time.Time, error) {
+	dec := gob.NewDecoder(r)
+	var n int
+	if err := dec.Decode(&n); err != nil {
+		return nil, nil, fmt.Errorf("failed to read pair count: %w", err)
+	}
+	if n < 0 {
+		return nil, nil, fmt.Errorf("invalid pair count %d", n)
+	}
+	data := make(map[string]string)
+	for range n {
+		var pair gobPair
+		if err := dec.Decode(&pair); err != nil {
+			return nil, nil, err
+		}
+		data[pair.Key] = pair.Value
+		if keys != nil {
+			keys.Add(1)
+		}
+	}
+	var unix map[string]int64
+	if err := dec.Decode(&unix); err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("failed to read deadlines: %w", err)
+	}
+	return data, unixDeadlines(unix), nil
+}
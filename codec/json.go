@@ -0,0 +1,63 @@
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// JSON writes the pairs as one JSON object, as the stores always have,
+// followed, if any key has a TTL, by a second object of their deadlines.
+// JSON strings hold text, so bytes of keys and values that are not valid
+// UTF-8 are read back as U+FFFD; the other codecs keep every byte.
+type JSON struct{}
+
+func (JSON) Name() string        { return "json" }
+func (JSON) Extension() string   { return "json" }
+func (JSON) ContentType() string { return "application/json" }
+
+func (JSON) Encode(w io.Writer, data map[string]string, expiry map[string]time.Time) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(data); err != nil {
+		return err
+	}
+	if deadlines := expiring(data, expiry); deadlines != nil {
+		return enc.Encode(deadlines)
+	}
+	return nil
+}
+
+// Decode reads the object one pair at a time, so a large snapshot is not
+// held twice while it is read.
+func (JSON) Decode(r io.Reader, keys *atomic.Int64) (map[string]string, map[string]time.Time, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil, errors.New("expected a JSON object")
+	}
+	data := make(map[string]string)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, _ := tok.(string)
+		var value string
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		data[key] = value
+		if keys != nil {
+			keys.Add(1)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, nil, err
+	}
+	var expiry map[string]time.Time
+	if err := dec.Decode(&expiry); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	return data, expiry, nil
+}
@@ -0,0 +1,207 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// MsgPack writes the pairs as a MessagePack map of strings, readable by
+// MessagePack libraries in other languages, followed, if any key has a TTL,
+// by a map of their deadlines in Unix nanoseconds.
+type MsgPack struct{}
+
+func (MsgPack) Name() string        { return "msgpack" }
+func (MsgPack) Extension() string   { return "msgpack" }
+func (MsgPack) ContentType() string { return "application/msgpack" }
+
+func (MsgPack) Encode(w io.Writer, data map[string]string, expiry map[string]time.Time) error {
+	bw := bufio.NewWriter(w)
+	writeMsgPackMapHeader(bw, len(data))
+	for key, value := range data {
+		writeMsgPackString(bw, key)
+		writeMsgPackString(bw, value)
+	}
+	if deadlines := expiring(data, expiry); deadlines != nil {
+		// A second map, of Unix nanoseconds, after the pairs
+		writeMsgPackMapHeader(bw, len(deadlines))
+		for key, at := range deadlines {
+			writeMsgPackString(bw, key)
+			bw.WriteByte(0xd3)
+			binary.Write(bw, binary.BigEndian, at.UnixNano())
+		}
+	}
+	return bw.Flush()
+}
+
+// writeMsgPackMapHeader starts a map of n entries. Errors surface when bw is
+// flushed.
+func writeMsgPackMapHeader(bw *bufio.Writer, n int) {
+	switch {
+	case n < 16:
+		bw.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		bw.WriteByte(0xde)
+		binary.Write(bw, binary.BigEndian, uint16(n))
+	default:
+		bw.WriteByte(0xdf)
+		binary.Write(bw, binary.BigEndian, uint32(n))
+	}
+}
+
+// writeMsgPackString writes s in the shortest str format that holds it.
+// Errors surface when bw is flushed.
+func writeMsgPackString(bw *bufio.Writer, s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		bw.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		bw.WriteByte(0xd9)
+		bw.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		bw.WriteByte(0xda)
+		binary.Write(bw, binary.BigEndian, uint16(n))
+	default:
+		bw.WriteByte(0xdb)
+		binary.Write(bw, binary.BigEndian, uint32(n))
+	}
+	bw.WriteString(s)
+}
+
+func (MsgPack) Decode(r io.Reader, keys *atomic.Int64) (map[string]string, map[string]time.Time, error) {
+	br := bufio.NewReader(r)
+	tag, err := br.ReadByte()
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := readMsgPackMapHeader(br, tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := make(map[string]string)
+	for range n {
+		key, err := readMsgPackString(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := readMsgPackString(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		data[key] = value
+		if keys != nil {
+			keys.Add(1)
+		}
+	}
+
+	// The deadlines, if any key has a TTL
+	tag, err = br.ReadByte()
+	if err == io.EOF {
+		return data, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if n, err = readMsgPackMapHeader(br, tag); err != nil {
+		return nil, nil, err
+	}
+	unix := make(map[string]int64, n)
+	for range n {
+		key, err := readMsgPackString(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		if tag, err = br.ReadByte(); err != nil {
+			return nil, nil, unexpected(err)
+		}
+		if tag != 0xd3 {
+			return nil, nil, fmt.Errorf("expected a MessagePack int 64, got type 0x%02x", tag)
+		}
+		ns, err := readUint(br, 8)
+		if err != nil {
+			return nil, nil, err
+		}
+		unix[key] = int64(ns)
+	}
+	return data, unixDeadlines(unix), nil
+}
+
+// readMsgPackMapHeader reads the number of entries of the map that tag starts.
+func readMsgPackMapHeader(br *bufio.Reader, tag byte) (uint64, error) {
+	switch {
+	case tag&0xf0 == 0x80:
+		return uint64(tag & 0x0f), nil
+	case tag == 0xde:
+		return readUint(br, 2)
+	case tag == 0xdf:
+		return readUint(br, 4)
+	default:
+		return 0, errors.New("expected a MessagePack map")
+	}
+}
+
+// readMsgPackString reads a str or bin value.
+func readMsgPackString(br *bufio.Reader) (string, error) {
+	tag, err := br.ReadByte()
+	if err != nil {
+		return "", unexpected(err)
+	}
+	var n uint64
+	switch {
+	case tag&0xe0 == 0xa0:
+		n = uint64(tag & 0x1f)
+	case tag == 0xd9 || tag == 0xc4:
+		n, err = readUint(br, 1)
+	case tag == 0xda || tag == 0xc5:
+		n, err = readUint(br, 2)
+	case tag == 0xdb || tag == 0xc6:
+		n, err = readUint(br, 4)
+	default:
+		return "", fmt.Errorf("expected a MessagePack string, got type 0x%02x", tag)
+	}
+	if err != nil {
+		return "", err
+	}
+	return readString(br, n)
+}
+
+// readUint reads a big-endian unsigned integer of size bytes.
+func readUint(r io.Reader, size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[8-size:]); err != nil {
+		return 0, unexpected(err)
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// readString reads n bytes as a string. The bytes are read as they arrive
+// rather than allocated up front, so a corrupt length cannot claim more
+// memory than the input holds.
+func readString(r io.Reader, n uint64) (string, error) {
+	if n > math.MaxInt64 {
+		return "", errors.New("string length out of range")
+	}
+	b, err := io.ReadAll(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return "", err
+	}
+	if uint64(len(b)) != n {
+		return "", io.ErrUnexpectedEOF
+	}
+	return string(b), nil
+}
+
+// unexpected turns io.EOF in the middle of an encoding into
+// io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
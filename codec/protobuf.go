@@ -0,0 +1,212 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Protobuf writes the pairs in the protocol buffers wire format of
+//
+//	message Snapshot {
+//	  map<string, string> pairs = 1;
+//	  map<string, int64> expires = 2; // Unix nanoseconds
+//	}
+//
+// so they can be read with code generated from that message in any language.
+type Protobuf struct{}
+
+// Field tags of Snapshot and of its map entries, all length-delimited but
+// the deadline, a varint
+const (
+	pbPairs    = 1<<3 | 2
+	pbExpires  = 2<<3 | 2
+	pbKey      = 1<<3 | 2
+	pbValue    = 2<<3 | 2
+	pbDeadline = 2<<3 | 0
+)
+
+func (Protobuf) Name() string        { return "protobuf" }
+func (Protobuf) Extension() string   { return "pb" }
+func (Protobuf) ContentType() string { return "application/x-protobuf" }
+
+func (Protobuf) Encode(w io.Writer, data map[string]string, expiry map[string]time.Time) error {
+	bw := bufio.NewWriter(w)
+	var buf [binary.MaxVarintLen64]byte
+	uvarint := func(v uint64) {
+		bw.Write(buf[:binary.PutUvarint(buf[:], v)])
+	}
+	for key, value := range data {
+		entry := 1 + uvarintLen(len(key)) + len(key) + 1 + uvarintLen(len(value)) + len(value)
+		uvarint(pbPairs)
+		uvarint(uint64(entry))
+		uvarint(pbKey)
+		uvarint(uint64(len(key)))
+		bw.WriteString(key)
+		uvarint(pbValue)
+		uvarint(uint64(len(value)))
+		bw.WriteString(value)
+	}
+	for key, at := range expiring(data, expiry) {
+		ns := uint64(at.UnixNano())
+		entry := 1 + uvarintLen(len(key)) + len(key) + 1 + uvarintLen64(ns)
+		uvarint(pbExpires)
+		uvarint(uint64(entry))
+		uvarint(pbKey)
+		uvarint(uint64(len(key)))
+		bw.WriteString(key)
+		uvarint(pbDeadline)
+		uvarint(ns)
+	}
+	return bw.Flush()
+}
+
+func uvarintLen(n int) int {
+	return uvarintLen64(uint64(n))
+}
+
+func uvarintLen64(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+// Decode reads to the end of r, since a protocol buffers message does not
+// mark where it ends. Fields other than pairs and expires are skipped.
+func (Protobuf) Decode(r io.Reader, keys *atomic.Int64) (map[string]string, map[string]time.Time, error) {
+	br := bufio.NewReader(r)
+	data := make(map[string]string)
+	unix := make(map[string]int64)
+	for {
+		tag, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return data, unixDeadlines(unix), nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if tag != pbPairs && tag != pbExpires {
+			if err := skipField(br, tag); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, nil, unexpected(err)
+		}
+		entry := bufio.NewReader(io.LimitReader(br, int64(n)))
+		if tag == pbExpires {
+			key, ns, err := readDeadlineEntry(entry)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid expires entry: %w", err)
+			}
+			unix[key] = ns
+			continue
+		}
+		key, value, err := readEntry(entry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid map entry: %w", err)
+		}
+		data[key] = value
+		if keys != nil {
+			keys.Add(1)
+		}
+	}
+}
+
+// readEntry reads the key and value of a map entry; either may be absent,
+// as protocol buffers leave out empty strings.
+func readEntry(br *bufio.Reader) (key, value string, err error) {
+	for {
+		tag, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return key, value, nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+		switch tag {
+		case pbKey, pbValue:
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return "", "", unexpected(err)
+			}
+			s, err := readString(br, n)
+			if err != nil {
+				return "", "", err
+			}
+			if tag == pbKey {
+				key = s
+			} else {
+				value = s
+			}
+		default:
+			if err := skipField(br, tag); err != nil {
+				return "", "", err
+			}
+		}
+	}
+}
+
+// readDeadlineEntry reads the key and Unix nanoseconds of an expires entry.
+func readDeadlineEntry(br *bufio.Reader) (key string, ns int64, err error) {
+	for {
+		tag, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return key, ns, nil
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		switch tag {
+		case pbKey:
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return "", 0, unexpected(err)
+			}
+			if key, err = readString(br, n); err != nil {
+				return "", 0, err
+			}
+		case pbDeadline:
+			v, err := binary.ReadUvarint(br)
+			if err != nil {
+				return "", 0, unexpected(err)
+			}
+			ns = int64(v)
+		default:
+			if err := skipField(br, tag); err != nil {
+				return "", 0, err
+			}
+		}
+	}
+}
+
+// skipField reads past the value of a field of an unknown tag.
+func skipField(br *bufio.Reader, tag uint64) error {
+	var n int64
+	switch tag & 7 {
+	case 0: // varint
+		_, err := binary.ReadUvarint(br)
+		return unexpected(err)
+	case 1: // 64-bit
+		n = 8
+	case 2: // length-delimited
+		length, err := binary.ReadUvarint(br)
+		if err != nil {
+			return unexpected(err)
+		}
+		n = int64(length)
+	case 5: // 32-bit
+		n = 4
+	default:
+		return errors.New("unsupported protocol buffers wire type")
+	}
+	if _, err := io.CopyN(io.Discard, br, n); err != nil {
+		return unexpected(err)
+	}
+	return nil
+}
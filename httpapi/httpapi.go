@@ -0,0 +1,233 @@
+// Package httpapi holds the response helpers shared by the broker and store
+// servers. Every error response has the same JSON shape:
+//
+//	{"error": {"code": "key_not_found", "message": "Key 'k1' not found", "details": ...}}
+//
+// A request that accepts application/problem+json gets the error as an RFC
+// 7807 problem instead:
+//
+//	{"type": "urn:kv:problem:key-not-found", "title": "Key not found", "status": 404,
+//	 "detail": "Key 'k1' not found", "code": "key_not_found"}
+//
+// The code, and the type named after it, are stable and machine-readable;
+// the message or detail is for people and may change. A failure that is no
+// more than its status has a generic code such as "not_found" and type
+// "about:blank".
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProblemContentType is the media type of problems.
+const ProblemContentType = "application/problem+json"
+
+// Error codes beyond the generic ones derived from the status code. Each
+// names a problem type of its own.
+const (
+	CodeKeyNotFound   = "key_not_found"
+	CodeStoreNotFound = "store_not_found"
+	CodeStoreExists   = "store_exists"
+	CodeNoStores      = "no_stores"
+	CodeStoreFailed   = "store_failed"
+	CodeQuotaExceeded = "quota_exceeded"
+	// CodeStoreUnavailable is returned when the stores are there but none
+	// can take the request now, e.g. because they are busy; it is worth
+	// retrying after the response's Retry-After.
+	CodeStoreUnavailable = "store_unavailable"
+	// CodePreconditionFailed is returned when a conditional write's If-Match
+	// or If-None-Match header does not hold.
+	CodePreconditionFailed = "precondition_failed"
+	// CodeValidationFailed is returned for a write the broker's validation
+	// rules refuse; the details name the rule, the key and the reason.
+	CodeValidationFailed = "validation_failed"
+)
+
+// problemTitles are the titles of the typed problems, by code.
+var problemTitles = map[string]string{
+	CodeKeyNotFound:        "Key not found",
+	CodeStoreNotFound:      "Store not found",
+	CodeStoreExists:        "Store already exists",
+	CodeNoStores:           "No stores available",
+	CodeStoreFailed:        "Store failed",
+	CodeQuotaExceeded:      "Quota exceeded",
+	CodeStoreUnavailable:   "Store unavailable",
+	CodePreconditionFailed: "Precondition failed",
+	CodeValidationFailed:   "Validation failed",
+}
+
+// ProblemType returns the problem type URI for an error code, e.g.
+// "urn:kv:problem:key-not-found", or "about:blank" for a generic code.
+func ProblemType(code string) string {
+	if _, typed := problemTitles[code]; !typed {
+		return "about:blank"
+	}
+	return "urn:kv:problem:" + strings.ReplaceAll(code, "_", "-")
+}
+
+// Problem is an RFC 7807 problem detail, the body of error responses to
+// requests that accept ProblemContentType. Code and Details are extension
+// members.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Code is the error code the type is named after.
+	Code    string      `json:"code"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// ErrorBody is the error envelope, the body of other error responses.
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes a failed request.
+type ErrorDetail struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// NewProblem returns the problem for a failure with the given status and
+// code. details may be nil.
+func NewProblem(status int, code, detail string, details interface{}) Problem {
+	title, typed := problemTitles[code]
+	if !typed {
+		title = http.StatusText(status)
+	}
+	return Problem{Type: ProblemType(code), Title: title, Status: status, Detail: detail, Code: code, Details: details}
+}
+
+// StatusCode returns the generic error code for an HTTP status, e.g.
+// "not_found" for 404 and "method_not_allowed" for 405.
+func StatusCode(status int) string {
+	switch status {
+	case http.StatusInternalServerError:
+		return "internal"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	case http.StatusGatewayTimeout:
+		return "timeout"
+	}
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	text = strings.ToLower(strings.ReplaceAll(text, "-", ""))
+	return strings.ReplaceAll(text, " ", "_")
+}
+
+// Error replies with the generic code for status. It takes the same
+// arguments as http.Error.
+func Error(w http.ResponseWriter, message string, status int) {
+	WriteError(w, status, StatusCode(status), message, nil)
+}
+
+// WriteError replies with the error envelope, or the problem if the request
+// accepts one, for status and code. details may be nil.
+func WriteError(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	h := w.Header()
+	// Drop headers meant for a successful response, as http.Error does
+	h.Del("Content-Length")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if !servesProblems(w) {
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ErrorBody{Error: ErrorDetail{Code: code, Message: message, Details: details}})
+		return
+	}
+	h.Set("Content-Type", ProblemContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(NewProblem(status, code, message, details))
+}
+
+// problemWriter marks the response to a request that accepts problems.
+type problemWriter struct {
+	http.ResponseWriter
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush.
+func (p problemWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// negotiateErrors has errors written to w as problems if r accepts them.
+// Every route the Router registers goes through it, outside its middleware.
+func negotiateErrors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if acceptsProblems(r) {
+			w = problemWriter{w}
+		}
+		next(w, r)
+	}
+}
+
+func acceptsProblems(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), ProblemContentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// servesProblems reports whether w, or a writer it wraps, is a
+// problemWriter.
+func servesProblems(w http.ResponseWriter) bool {
+	for {
+		switch rw := w.(type) {
+		case problemWriter:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// DecodeProblem reads the error from a failed response's body, whether a
+// problem or the error envelope. It returns false if the body is neither,
+// e.g. plain text.
+func DecodeProblem(body []byte) (Problem, bool) {
+	var p struct {
+		Problem
+		Legacy *struct {
+			Code    string      `json:"code"`
+			Message string      `json:"message"`
+			Details interface{} `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return Problem{}, false
+	}
+	if legacy := p.Legacy; legacy != nil && legacy.Code != "" {
+		return Problem{Type: ProblemType(legacy.Code), Code: legacy.Code, Detail: legacy.Message, Details: legacy.Details}, true
+	}
+	if p.Type == "" && p.Code == "" {
+		return Problem{}, false
+	}
+	return p.Problem, true
+}
+
+// DryRun reports whether the request asks, with ?dry_run=true, to be told
+// what it would do instead of doing it.
+func DryRun(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("dry_run")
+	if v == "" {
+		return false, nil
+	}
+	dry, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid dry_run %q: want true or false", v)
+	}
+	return dry, nil
+}
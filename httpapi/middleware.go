@@ -0,0 +1,296 @@
+package httpapi
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"io"
+	"kv/logging"
+	"kv/metrics"
+	"kv/tracing"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware wraps the handler of a route, e.g. to log, authenticate or
+// limit requests. route is the route's unversioned pattern, e.g. "/get", for
+// labelling logs and metrics.
+type Middleware func(route string, next http.HandlerFunc) http.HandlerFunc
+
+// Chain returns a middleware that applies mws in order, the first outermost.
+func Chain(mws ...Middleware) Middleware {
+	return func(route string, next http.HandlerFunc) http.HandlerFunc {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](route, next)
+		}
+		return next
+	}
+}
+
+// Router registers routes on a ServeMux under Version, each wrapped in the
+// router's middleware chain. Their errors are problems for requests that
+// accept them.
+type Router struct {
+	mux        *http.ServeMux
+	middleware []Middleware
+}
+
+// NewRouter returns a router adding routes to mux through mws.
+func NewRouter(mux *http.ServeMux, mws ...Middleware) *Router {
+	return &Router{mux: mux, middleware: mws}
+}
+
+// Use adds middleware inside the existing chain. It applies to routes
+// registered afterwards.
+func (r *Router) Use(mws ...Middleware) {
+	r.middleware = append(r.middleware, mws...)
+}
+
+// Handle registers handler for pattern under Version. mws wrap this route
+// only, inside the router's chain.
+func (r *Router) Handle(pattern string, handler http.HandlerFunc, mws ...Middleware) {
+	chain := append(append([]Middleware(nil), r.middleware...), mws...)
+	r.mux.HandleFunc(Version+pattern, negotiateErrors(Chain(chain...)(pattern, handler)))
+}
+
+// Mux returns the ServeMux routes are added to, for handlers registered
+// outside the versioned API such as /metrics.
+func (r *Router) Mux() *http.ServeMux {
+	return r.mux
+}
+
+// Logging logs one line per request with logging.AccessLog.
+func Logging(logger *slog.Logger) Middleware {
+	return func(route string, next http.HandlerFunc) http.HandlerFunc {
+		return logging.AccessLog(logger, next)
+	}
+}
+
+// Tracing starts a span named after the route for every request.
+func Tracing() Middleware {
+	return tracing.Middleware
+}
+
+// Metrics counts and times requests by route.
+func Metrics(m *metrics.HTTPMetrics) Middleware {
+	return m.Instrument
+}
+
+// BearerAuth requires "Authorization: Bearer <token>" matching token(). It
+// lets every request through while token() is empty, so a token can be set
+// or cleared at runtime.
+func BearerAuth(token func() string) Middleware {
+	return func(route string, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			want := token()
+			if want != "" {
+				given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(want)) != 1 {
+					Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+			}
+			next(w, r)
+		}
+	}
+}
+
+// RateLimit allows perSecond requests on average, with bursts of up to burst,
+// across every route it wraps. Requests over the limit get 429 with a
+// Retry-After header.
+func RateLimit(perSecond float64, burst int) Middleware {
+	if burst < 1 {
+		burst = 1
+	}
+	limiter := &tokenBucket{rate: perSecond, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+	return func(route string, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if wait, ok := limiter.take(); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// tokenBucket is the limiter behind RateLimit.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token if one is available, or returns how long until one is.
+func (b *tokenBucket) take() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if b.rate <= 0 {
+		return time.Second, false
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), false
+}
+
+// ConcurrencyLimiter bounds how many requests are served at once across the
+// routes it wraps, so a flood of requests is turned away rather than
+// served by ever more goroutines holding ever more memory.
+type ConcurrencyLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+	// Shed, if set, is called for every request turned away.
+	Shed func(route string)
+}
+
+// NewConcurrencyLimiter allows limit requests at once. A request over the
+// limit waits up to wait for another to finish, then gets 503 with a
+// Retry-After header.
+func NewConcurrencyLimiter(limit int, wait time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{slots: make(chan struct{}, max(limit, 1)), wait: wait}
+}
+
+// Limit is the limiter's middleware.
+func (l *ConcurrencyLimiter) Limit(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire(r.Context()) {
+			if l.Shed != nil {
+				l.Shed(route)
+			}
+			w.Header().Set("Retry-After", "1")
+			Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-l.slots }()
+		next(w, r)
+	}
+}
+
+// acquire takes a slot, waiting up to l.wait for one.
+func (l *ConcurrencyLimiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// InFlight returns how many requests hold a slot.
+func (l *ConcurrencyLimiter) InFlight() int {
+	return len(l.slots)
+}
+
+// Gzip compresses responses for clients that accept gzip.
+func Gzip() Middleware {
+	return func(route string, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsGzip(r) {
+				next(w, r)
+				return
+			}
+			gz := &gzipWriter{ResponseWriter: w}
+			defer gz.close()
+			next(gz, r)
+		}
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.EqualFold(name, "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter compresses what a handler writes. The gzip stream is started
+// on the first write, so responses without a body are left alone.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	if code != http.StatusNoContent && code != http.StatusNotModified && g.Header().Get("Content-Encoding") == "" {
+		g.Header().Del("Content-Length")
+		g.Header().Set("Content-Encoding", "gzip")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	var w io.Writer = g.ResponseWriter
+	if g.gz != nil {
+		w = g.gz
+	}
+	return w.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Flush sends what has been compressed so far, for streaming responses.
+func (g *gzipWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+// LongRunning lifts the server's write timeout for a route whose response
+// streams or takes long to produce, such as a watch or a handoff. The read
+// timeout still applies to the request.
+func LongRunning() Middleware {
+	return func(route string, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.NewResponseController(w).SetWriteDeadline(time.Time{})
+			next(w, r)
+		}
+	}
+}
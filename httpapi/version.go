@@ -0,0 +1,32 @@
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Version is the path prefix of the current API version. Routes are served
+// under it, e.g. /v1/get; a breaking change would ship under /v2 while /v1
+// keeps working.
+const Version = "/v1"
+
+// Legacy returns a handler for paths from before the API was versioned. It
+// serves a request for /get as if it were for Version+"/get", marking the
+// response deprecated and pointing at the versioned path. Register it on
+// mux as the "/" pattern, so it sees only requests no route matches.
+func Legacy(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == Version || strings.HasPrefix(r.URL.Path, Version+"/") {
+			Error(w, "No such route: "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = Version + r.URL.Path
+		r2.URL.RawPath = ""
+		r2.RequestURI = r2.URL.RequestURI()
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+r2.URL.Path+`>; rel="successor-version"`)
+		mux.ServeHTTP(w, r2)
+	})
+}
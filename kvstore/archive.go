@@ -0,0 +1,269 @@
+package kvstore
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kv/codec"
+	"kv/httpapi"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot formats and compressions of a SnapshotArchive.
+const (
+	FormatJSON      = "json"  // one JSON object holding every pair, as the store's own snapshot
+	FormatJSONLines = "jsonl" // a {"key": ..., "value": ..., "expires": ...} object per line
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// archiveTimeFormat names archived snapshots so they sort by time.
+const archiveTimeFormat = "20060102T150405.000Z"
+
+// SnapshotArchive has every periodic snapshot also written to Destination
+// as a file of its own, named after the store and the time, so an older
+// snapshot can be restored with /load. The store's own snapshot, which it
+// loads on startup, is written as before.
+type SnapshotArchive struct {
+	// Format is FormatJSON (the default) or FormatJSONLines.
+	Format string `json:"format,omitempty"`
+	// Compression is CompressionNone (the default) or CompressionGzip.
+	Compression string `json:"compression,omitempty"`
+	// Destination is the directory archived snapshots are written to,
+	// relative to the data directory unless absolute.
+	Destination string `json:"destination"`
+	// Retain is how many archived snapshots of the store are kept, the
+	// newest; 0 keeps them all.
+	Retain int `json:"retain,omitempty"`
+}
+
+// Validate reports every problem with the archive settings at once.
+func (a SnapshotArchive) Validate() error {
+	var errs []error
+	if a.Destination == "" {
+		errs = append(errs, errors.New("destination is required"))
+	}
+	if a.Format != "" && a.Format != FormatJSON && a.Format != FormatJSONLines {
+		errs = append(errs, fmt.Errorf("format %q is neither %q nor %q", a.Format, FormatJSON, FormatJSONLines))
+	}
+	if a.Compression != "" && a.Compression != CompressionNone && a.Compression != CompressionGzip {
+		errs = append(errs, fmt.Errorf("compression %q is neither %q nor %q", a.Compression, CompressionNone, CompressionGzip))
+	}
+	if a.Retain < 0 {
+		errs = append(errs, errors.New("retain must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// extension returns the file extension of the archived snapshots.
+func (a SnapshotArchive) extension() string {
+	ext := ".snapshot." + FormatJSON
+	if a.Format == FormatJSONLines {
+		ext = ".snapshot." + FormatJSONLines
+	}
+	if a.Compression == CompressionGzip {
+		ext += ".gz"
+	}
+	return ext
+}
+
+// SetSnapshotArchive has every periodic snapshot also archived as a, which
+// must be valid; nil stops archiving.
+func (s *KVStore) SetSnapshotArchive(a *SnapshotArchive) {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	s.archive = a
+}
+
+// archiveSnapshot writes the data to a new file under the archive's
+// destination and removes the archived snapshots beyond those retained.
+func (s *KVStore) archiveSnapshot(a SnapshotArchive) (err error) {
+	defer func() {
+		s.snapMu.Lock()
+		s.lastArchiveErr = err
+		s.snapMu.Unlock()
+	}()
+	dir := s.DataPath(a.Destination)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	s.mu.Lock()
+	frozen := s.data
+	data := frozen.freeze()
+	expiry := maps.Clone(s.expiry)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		frozen.thaw()
+		s.mu.Unlock()
+	}()
+
+	name := filepath.Join(dir, s.Name+"-"+time.Now().UTC().Format(archiveTimeFormat)+a.extension())
+	// Written under another name first, so a partial file is never taken
+	// for an archived snapshot
+	tmp := name + ".tmp"
+	if err := s.writeArchive(tmp, a, data, expiry); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to name archived snapshot: %w", err)
+	}
+	s.snapMu.Lock()
+	s.lastArchive = name
+	s.snapMu.Unlock()
+	s.logger.Info("snapshot archived", "file", name)
+	return s.pruneArchive(dir, a)
+}
+
+func (s *KVStore) writeArchive(name string, a SnapshotArchive, data map[string]string, expiry map[string]time.Time) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create archived snapshot: %w", err)
+	}
+	defer file.Close()
+
+	out := s.background.DiskWriter(context.Background(), "snapshot", file)
+	var zw *gzip.Writer
+	if a.Compression == CompressionGzip {
+		zw = gzip.NewWriter(out)
+		out = zw
+	}
+	if a.Format == FormatJSONLines {
+		enc := json.NewEncoder(out)
+		for key, value := range data {
+			line := pairLine{Key: key, Value: value}
+			if at, ok := expiry[key]; ok {
+				line.Expires = &at
+			}
+			if err := enc.Encode(line); err != nil {
+				return fmt.Errorf("failed to encode archived snapshot: %w", err)
+			}
+		}
+	} else if err := (codec.JSON{}).Encode(out, data, expiry); err != nil {
+		return fmt.Errorf("failed to encode archived snapshot: %w", err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to compress archived snapshot: %w", err)
+		}
+	}
+	return file.Close()
+}
+
+// pruneArchive removes the store's oldest archived snapshots in dir beyond
+// the number retained.
+func (s *KVStore) pruneArchive(dir string, a SnapshotArchive) error {
+	if a.Retain == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list archived snapshots: %w", err)
+	}
+	var archived []string
+	for _, entry := range entries {
+		// Another store's name may start with this one's, but is not
+		// followed by the time
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(name, s.Name+"-")
+		if !ok || len(stamp) < len(archiveTimeFormat) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		if _, err := time.Parse(archiveTimeFormat, stamp[:len(archiveTimeFormat)]); err == nil {
+			archived = append(archived, name)
+		}
+	}
+	sort.Strings(archived)
+	for _, name := range archived[:max(len(archived)-a.Retain, 0)] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to remove archived snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// pairLine is a line of a snapshot in FormatJSONLines.
+type pairLine struct {
+	Key     string     `json:"key"`
+	Value   string     `json:"value"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// decodeSnapshot decodes a snapshot file named filename, gunzipping it if
+// the name ends in ".gz". An archived snapshot in FormatJSONLines is read by
+// line, any other in the codec its name ends with. The deadlines of the
+// keys with a TTL are returned with the pairs.
+func decodeSnapshot(filename string, r io.Reader, keys *atomic.Int64) (map[string]string, map[string]time.Time, error) {
+	base := strings.TrimSuffix(filename, ".gz")
+	if base != filename {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	if !strings.HasSuffix(base, "."+FormatJSONLines) {
+		return codec.ForFile(base).Decode(r, keys)
+	}
+	dec := json.NewDecoder(r)
+	data := make(map[string]string)
+	var expiry map[string]time.Time
+	for dec.More() {
+		var line pairLine
+		if err := dec.Decode(&line); err != nil {
+			return nil, nil, err
+		}
+		data[line.Key] = line.Value
+		if line.Expires != nil {
+			if expiry == nil {
+				expiry = make(map[string]time.Time)
+			}
+			expiry[line.Key] = *line.Expires
+		}
+		if keys != nil {
+			keys.Add(1)
+		}
+	}
+	return data, expiry, nil
+}
+
+// SnapshotArchiveHandler: GET, POST /snapshot-archive { "format": "...", "compression": "...", "destination": "...", "retain": n }
+// Reports or sets where periodic snapshots are archived; POST null stops archiving. Comes from the broker.
+func (h *KVStoreHandler) SnapshotArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var archive *SnapshotArchive
+		if err := json.NewDecoder(r.Body).Decode(&archive); err != nil {
+			httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if archive != nil {
+			if err := archive.Validate(); err != nil {
+				httpapi.Error(w, "Invalid snapshot archive: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		h.kvstore.SetSnapshotArchive(archive)
+	default:
+		httpapi.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.kvstore.SnapshotStatus().Archive)
+}
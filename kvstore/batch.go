@@ -0,0 +1,174 @@
+package kvstore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KeyValue is a single key-value pair returned by Scan.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ScanResult is a page of pairs returned by Scan.
+type ScanResult struct {
+	Items []KeyValue `json:"items"`
+	// More is set when further keys match after the last item.
+	More bool `json:"more"`
+}
+
+// SetMany inserts or updates all pairs atomically with respect to readers.
+func (s *KVStore) SetMany(pairs map[string]string) error {
+	for key := range pairs {
+		if key == "" {
+			return errors.New("key cannot be empty")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, value := range pairs {
+		s.data.put(key, value)
+		s.resetExpiryLocked(key, now)
+		s.publish(OpSet, key, value)
+	}
+	return nil
+}
+
+// SetManyNewer is SetMany for pairs moved from another store, with the
+// entity tags they had there. A key this store holds with a later revision
+// was written here since the pair was read, and is kept; the keys kept are
+// returned. A pair without a tag is written whatever the store holds.
+func (s *KVStore) SetManyNewer(pairs, etags map[string]string) ([]string, error) {
+	for key := range pairs {
+		if key == "" {
+			return nil, errors.New("key cannot be empty")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []string
+	now := time.Now()
+	for key, value := range pairs {
+		if etag, ok := etags[key]; ok {
+			// Entity tags are fixed-width hexadecimal revisions
+			if _, exists := s.data.get(key); exists && !s.expiredLocked(key, now) && s.etagLocked(key) > etag {
+				kept = append(kept, key)
+				continue
+			}
+		}
+		s.data.put(key, value)
+		s.resetExpiryLocked(key, now)
+		s.publish(OpSet, key, value)
+	}
+	sort.Strings(kept)
+	return kept, nil
+}
+
+// DeleteUnchanged deletes each key whose value is still the one in pairs and
+// returns how many were deleted. Keys changed since the caller read them are
+// kept.
+func (s *KVStore) DeleteUnchanged(pairs map[string]string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := 0
+	for key, value := range pairs {
+		if current, ok := s.data.get(key); ok && current == value {
+			s.data.remove(key)
+			delete(s.expiry, key)
+			s.publish(OpDelete, key, "")
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// DeletePrefix deletes every key starting with prefix and returns how many
+// were deleted, not counting keys that had expired.
+func (s *KVStore) DeletePrefix(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.data.all() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	deleted := 0
+	now := time.Now()
+	for _, key := range keys {
+		if !s.expiredLocked(key, now) {
+			value, _ := s.data.get(key)
+			s.trashLocked(key, value, now)
+			deleted++
+		}
+		s.data.remove(key)
+		delete(s.expiry, key)
+		s.publish(OpDelete, key, "")
+	}
+	return deleted
+}
+
+// GetMany returns the values of those keys that exist and have not expired.
+func (s *KVStore) GetMany(keys []string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	values := make(map[string]string, len(keys))
+	now := time.Now()
+	for _, key := range keys {
+		if value, ok := s.data.get(key); ok && !s.expiredLocked(key, now) {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// GetManyTagged is GetMany returning the keys' entity tags too.
+func (s *KVStore) GetManyTagged(keys []string) (values, etags map[string]string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	values = make(map[string]string, len(keys))
+	etags = make(map[string]string, len(keys))
+	now := time.Now()
+	for _, key := range keys {
+		if value, ok := s.data.get(key); ok && !s.expiredLocked(key, now) {
+			values[key] = value
+			etags[key] = s.etagLocked(key)
+		}
+	}
+	return values, etags
+}
+
+// Scan returns up to limit pairs whose keys start with prefix and sort after
+// the key after, in key order. A limit of zero or less returns every match.
+func (s *KVStore) Scan(prefix, after string, limit int) ScanResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0)
+	now := time.Now()
+	for key := range s.data.all() {
+		if strings.HasPrefix(key, prefix) && key > after && !s.expiredLocked(key, now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := ScanResult{Items: make([]KeyValue, 0, len(keys))}
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		result.More = true
+	}
+	for _, key := range keys {
+		value, _ := s.data.get(key)
+		result.Items = append(result.Items, KeyValue{Key: key, Value: value})
+	}
+	return result
+}
@@ -0,0 +1,187 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"kv/httpapi"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// bloomMinCapacity is the smallest number of keys a filter is sized for.
+	bloomMinCapacity = 1024
+	// bloomFalsePositiveRate is the rate filters are sized for at capacity.
+	bloomFalsePositiveRate = 0.01
+)
+
+// BloomFilter answers whether a key may be in a set: never no for a key
+// that was added, and yes for one that was not at about the rate it was
+// sized for. Keys cannot be removed; the store rebuilds its filter instead.
+type BloomFilter struct {
+	Bits   []byte `json:"bits"`
+	Hashes int    `json:"hashes"`
+	// Version is set by the store and changes whenever its filter does.
+	Version uint64 `json:"version"`
+}
+
+// NewBloomFilter returns an empty filter sized for capacity keys.
+func NewBloomFilter(capacity int) *BloomFilter {
+	capacity = max(capacity, bloomMinCapacity)
+	bits := math.Ceil(-float64(capacity) * math.Log(bloomFalsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(bits / float64(capacity) * math.Ln2))
+	return &BloomFilter{Bits: make([]byte, (int(bits)+7)/8), Hashes: max(hashes, 1)}
+}
+
+// bloomHashes returns the two hashes the filter's probe positions are derived from.
+func bloomHashes(key string) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:]) | 1
+}
+
+// Add records key in the filter.
+func (f *BloomFilter) Add(key string) {
+	m := uint64(len(f.Bits) * 8)
+	h1, h2 := bloomHashes(key)
+	for i := 0; i < f.Hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		f.Bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// MayContain reports false if key was definitely not added.
+func (f *BloomFilter) MayContain(key string) bool {
+	if len(f.Bits) == 0 {
+		return true
+	}
+	m := uint64(len(f.Bits) * 8)
+	h1, h2 := bloomHashes(key)
+	for i := 0; i < f.Hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if f.Bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone returns a copy of the filter.
+func (f *BloomFilter) Clone() *BloomFilter {
+	clone := *f
+	clone.Bits = append([]byte(nil), f.Bits...)
+	return &clone
+}
+
+// bloomState is the store's filter of its keys. Deleted keys stay in the
+// filter until it is rebuilt, once they outnumber the keys left or the store
+// outgrows the capacity the filter was sized for.
+type bloomState struct {
+	filter   *BloomFilter
+	capacity int
+	deleted  int
+}
+
+// updateBloom keeps the filter in step with a mutation. s.mu must be held.
+func (s *KVStore) updateBloom(op, key string) {
+	switch op {
+	case OpSet:
+		if s.data.len() <= s.bloom.capacity {
+			s.bloom.filter.Add(key)
+			s.bloom.filter.Version++
+			return
+		}
+	case OpDelete, OpExpire:
+		s.bloom.deleted++
+		if s.bloom.deleted <= max(s.data.len(), bloomMinCapacity) {
+			return
+		}
+	}
+	s.rebuildBloom()
+}
+
+// rebuildBloom builds the filter anew from the keys held, sized for twice as
+// many. s.mu must be held.
+func (s *KVStore) rebuildBloom() {
+	// Versions start from the clock, so a restarted store does not repeat
+	// the versions of its previous run
+	version := uint64(time.Now().UnixNano())
+	if s.bloom.filter != nil {
+		version = s.bloom.filter.Version
+	}
+	s.bloom = bloomOf(s.data)
+	s.bloom.filter.Version = version + 1
+}
+
+// bloomOf builds a filter of the keys of data, sized for twice as many. Its
+// version is left for the caller to set.
+func bloomOf(data *dataMap) bloomState {
+	capacity := max(2*data.len(), bloomMinCapacity)
+	filter := NewBloomFilter(capacity)
+	for key := range data.all() {
+		filter.Add(key)
+	}
+	return bloomState{filter: filter, capacity: capacity}
+}
+
+// Bloom returns a copy of the filter of the store's keys, or nil if its
+// version is still version.
+func (s *KVStore) Bloom(version uint64) *BloomFilter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.bloom.filter.Version == version {
+		return nil
+	}
+	return s.bloom.filter.Clone()
+}
+
+// MayHave reports false if the store definitely does not hold key.
+func (s *KVStore) MayHave(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bloom.filter.MayContain(key)
+}
+
+// BloomHandler: GET /bloom?version=<n>
+// Returns the filter of the store's keys, or 304 if its version is still n.
+func (h *KVStoreHandler) BloomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var version uint64
+	if v := r.URL.Query().Get("version"); v != "" {
+		parsed, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			httpapi.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		version = parsed
+	}
+	filter := h.kvstore.Bloom(version)
+	if filter == nil {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	jsonResponse(w, filter)
+}
+
+// MaybeHasHandler: GET /maybe-has?key=<key>
+// Answers from the filter whether the store may hold the key, without reading it.
+func (h *KVStoreHandler) MaybeHasHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		httpapi.Error(w, "Key is required", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"maybe": h.kvstore.MayHave(key)})
+}
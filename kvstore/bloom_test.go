@@ -0,0 +1,126 @@
+package kvstore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilterHasNoFalseNegatives(t *testing.T) {
+	const n = 10000
+	f := NewBloomFilter(n)
+	for i := 0; i < n; i++ {
+		f.Add(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < n; i++ {
+		if key := fmt.Sprintf("key%d", i); !f.MayContain(key) {
+			t.Fatalf("MayContain(%q) = false for a key added", key)
+		}
+	}
+
+	// Sized for n keys at 1%; allow some slack for the hash
+	positives := 0
+	for i := 0; i < n; i++ {
+		if f.MayContain(fmt.Sprintf("other%d", i)) {
+			positives++
+		}
+	}
+	if rate := float64(positives) / n; rate > 3*bloomFalsePositiveRate {
+		t.Errorf("false positive rate %.3f at capacity, sized for %.2f", rate, bloomFalsePositiveRate)
+	}
+}
+
+func TestBloomFilterEmpty(t *testing.T) {
+	if f := NewBloomFilter(0); f.MayContain("k") {
+		t.Error("an empty filter may contain k")
+	}
+	// A filter without bits, such as one decoded from nothing, rules out nothing
+	if f := (&BloomFilter{}); !f.MayContain("k") {
+		t.Error("a filter without bits rules out k")
+	}
+}
+
+func TestBloomFilterClone(t *testing.T) {
+	f := NewBloomFilter(0)
+	f.Add("a")
+	clone := f.Clone()
+	clone.Add("b")
+	if !clone.MayContain("a") || !clone.MayContain("b") {
+		t.Error("clone lost a key")
+	}
+	if f.MayContain("b") {
+		t.Error("adding to the clone changed the original")
+	}
+}
+
+func TestStoreBloomAddsWrites(t *testing.T) {
+	s := NewKVStore("bloom", "0")
+	version := s.Bloom(0).Version
+	if s.MayHave("k") {
+		t.Error("empty store may have k")
+	}
+
+	s.Set("k", "v")
+	if !s.MayHave("k") {
+		t.Error("MayHave(k) = false after setting k")
+	}
+	f := s.Bloom(version)
+	if f == nil || f.Version == version {
+		t.Fatal("filter version unchanged by a write")
+	}
+	if s.Bloom(f.Version) != nil {
+		t.Error("Bloom returned a filter whose version the caller has")
+	}
+
+	// Deleted keys stay in the filter until it is rebuilt
+	s.Delete("k")
+	if !s.MayHave("k") {
+		t.Error("a deleted key was dropped from the filter before a rebuild")
+	}
+}
+
+func TestStoreBloomRebuilds(t *testing.T) {
+	s := NewKVStore("bloom", "0")
+	capacity := s.bloom.capacity
+	keys := 3 * capacity
+	for i := 0; i < keys; i++ {
+		s.Set(fmt.Sprintf("key%d", i), "v")
+	}
+	if s.bloom.capacity < keys {
+		t.Fatalf("filter sized for %d keys while the store holds %d", s.bloom.capacity, keys)
+	}
+	for i := 0; i < keys; i++ {
+		if key := fmt.Sprintf("key%d", i); !s.MayHave(key) {
+			t.Fatalf("MayHave(%q) = false after outgrowing the filter", key)
+		}
+	}
+
+	// Deleting more keys than are left rebuilds the filter without them
+	version := s.Bloom(0).Version
+	kept, rebuiltAt := 10, 0
+	for i := kept; i < keys; i++ {
+		s.Delete(fmt.Sprintf("key%d", i))
+		if s.bloom.deleted == 0 {
+			rebuiltAt = i
+		}
+	}
+	if rebuiltAt == 0 {
+		t.Fatalf("filter not rebuilt after %d of %d keys were deleted", keys-kept, keys)
+	}
+	if v := s.Bloom(0).Version; v <= version {
+		t.Errorf("version went from %d to %d over a rebuild", version, v)
+	}
+	for i := 0; i < kept; i++ {
+		if key := fmt.Sprintf("key%d", i); !s.MayHave(key) {
+			t.Errorf("MayHave(%q) = false for a key kept over a rebuild", key)
+		}
+	}
+	positives := 0
+	for i := kept; i <= rebuiltAt; i++ {
+		if s.MayHave(fmt.Sprintf("key%d", i)) {
+			positives++
+		}
+	}
+	if dropped := rebuiltAt + 1 - kept; positives > dropped/20 {
+		t.Errorf("%d of the %d keys deleted before the rebuild still in the filter", positives, dropped)
+	}
+}
@@ -0,0 +1,263 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kv/httpapi"
+	"kv/metrics"
+	"kv/singleflight"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// In cache mode a store fronts an origin: a service the application runs
+// that owns the data. A key missing from the store is read through from the
+// origin and kept with the store's default TTL; writes and deletes go to
+// the origin before the store. The origin answers, for a key k:
+//
+//	GET    <origin>?key=k  the value as the body, or 404
+//	PUT    <origin>?key=k  stores the body as the value
+//	DELETE <origin>?key=k  deletes the key (404 is fine)
+
+// DefaultOriginTimeout bounds each request to a cache's origin.
+const DefaultOriginTimeout = 5 * time.Second
+
+// NoReadThroughHeader on a /get asks a store in cache mode not to read a
+// missing key through from its origin. The broker sets it when it looks for
+// a key on every store, so only the store it picks reads it through.
+const NoReadThroughHeader = "X-KV-No-Read-Through"
+
+// ErrOrigin is returned when a cache's origin fails or cannot be reached.
+var ErrOrigin = errors.New("origin request failed")
+
+// originRead is the result of reading a key from the origin.
+type originRead struct {
+	value string
+	found bool
+}
+
+// cacheOrigin is the origin of a store in cache mode.
+type cacheOrigin struct {
+	url      *url.URL
+	client   *http.Client
+	timeout  time.Duration
+	flights  singleflight.Group[originRead] // reads in flight, one per key
+	requests *metrics.CounterVec
+}
+
+// EnableCache puts the store in cache mode in front of the origin at
+// originURL, each request to which may take up to timeout. Call it before
+// the store serves requests.
+func (s *KVStore) EnableCache(originURL string, timeout time.Duration) error {
+	u, err := url.Parse(originURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("origin %q is not an http(s) URL", originURL)
+	}
+	if timeout <= 0 {
+		timeout = DefaultOriginTimeout
+	}
+	s.cache = &cacheOrigin{
+		url:      u,
+		client:   &http.Client{Timeout: timeout},
+		timeout:  timeout,
+		requests: s.metrics.NewCounterVec("kvstore_cache_requests_total", "Reads in cache mode by result: hit, fill (read through from the origin), shared (waited for another read of the key), miss (not at the origin either) or error.", "result"),
+	}
+	s.logger.Info("cache mode enabled", "origin", u.Redacted())
+	return nil
+}
+
+// Cache reports whether the store is in cache mode.
+func (s *KVStore) Cache() bool {
+	return s.cache != nil
+}
+
+// ReadThrough is Get, except that in cache mode a key the store does not
+// hold is read from the origin and kept. Concurrent reads of the same
+// missing key share a single request to the origin.
+func (s *KVStore) ReadThrough(ctx context.Context, key string) (string, error) {
+	value, err := s.Get(key)
+	if err == nil || s.cache == nil {
+		if s.cache != nil {
+			s.cache.requests.Inc("hit")
+		}
+		return value, err
+	}
+
+	// The read is shared, so one caller giving up must not fail the others
+	ctx = context.WithoutCancel(ctx)
+	fetched := false
+	read, err, _ := s.cache.flights.Do(key, func() (originRead, error) {
+		fetched = true
+		return s.fill(ctx, key)
+	})
+	switch {
+	case err != nil:
+		s.cache.requests.Inc("error")
+		return "", err
+	case !fetched:
+		s.cache.requests.Inc("shared")
+	case read.found:
+		s.cache.requests.Inc("fill")
+	default:
+		s.cache.requests.Inc("miss")
+	}
+	if !read.found {
+		return "", ErrKeyNotFound
+	}
+	return read.value, nil
+}
+
+// fill reads key from the origin and keeps it with the default TTL, unless
+// it was written while the origin was asked.
+func (s *KVStore) fill(ctx context.Context, key string) (originRead, error) {
+	resp, err := s.originRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return originRead{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return originRead{}, nil
+	default:
+		return originRead{}, fmt.Errorf("%w: origin returned status %d", ErrOrigin, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return originRead{}, fmt.Errorf("%w: %w", ErrOrigin, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if current, ok := s.data.get(key); ok && !s.expiredLocked(key, now) {
+		return originRead{value: current, found: true}, nil
+	}
+	value := string(body)
+	s.data.put(key, value)
+	s.resetExpiryLocked(key, now)
+	s.publish(OpSet, key, value)
+	return originRead{value: value, found: true}, nil
+}
+
+// writeThrough writes key to the origin, or deletes it if value is nil. It
+// does nothing unless the store is in cache mode.
+func (s *KVStore) writeThrough(ctx context.Context, key string, value *string) error {
+	if s.cache == nil {
+		return nil
+	}
+	method, body := http.MethodDelete, []byte(nil)
+	if value != nil {
+		method, body = http.MethodPut, []byte(*value)
+	}
+	resp, err := s.originRequest(ctx, method, key, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && !(method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		return fmt.Errorf("%w: origin returned status %d", ErrOrigin, resp.StatusCode)
+	}
+	return nil
+}
+
+// SetThrough is SetIf, writing the key to the origin first in cache mode.
+func (s *KVStore) SetThrough(ctx context.Context, key, value string, p Precondition) (string, error) {
+	if s.cache != nil && !p.IsZero() {
+		// Check before writing to the origin; SetIf checks again
+		s.mu.RLock()
+		current, exists := s.data.get(key)
+		exists = exists && !s.expiredLocked(key, time.Now())
+		etag := s.etagLocked(key)
+		s.mu.RUnlock()
+		if !p.Allows(current, etag, exists) {
+			return "", ErrPreconditionFailed
+		}
+	}
+	if err := s.writeThrough(ctx, key, &value); err != nil {
+		return "", err
+	}
+	return s.SetIf(key, value, p)
+}
+
+// SetManyThrough is SetMany, writing the pairs to the origin first in
+// cache mode.
+func (s *KVStore) SetManyThrough(ctx context.Context, pairs map[string]string) error {
+	if s.cache != nil {
+		for key, value := range pairs {
+			if err := s.writeThrough(ctx, key, &value); err != nil {
+				return err
+			}
+		}
+	}
+	return s.SetMany(pairs)
+}
+
+// DeleteThrough is Delete, or DeleteIf for a conditional delete, deleting
+// the key at the origin first in cache mode. The key is then reported
+// deleted even if the store did not hold it, unless the delete was
+// conditional.
+func (s *KVStore) DeleteThrough(ctx context.Context, key string, p Precondition) error {
+	if s.cache != nil && !p.IsZero() {
+		// Check before deleting at the origin; DeleteIf checks again
+		s.mu.RLock()
+		current, exists := s.data.get(key)
+		exists = exists && !s.expiredLocked(key, time.Now())
+		etag := s.etagLocked(key)
+		s.mu.RUnlock()
+		if !exists || !p.Allows(current, etag, exists) {
+			return ErrPreconditionFailed
+		}
+	}
+	if err := s.writeThrough(ctx, key, nil); err != nil {
+		return err
+	}
+	if !p.IsZero() {
+		return s.DeleteIf(key, p)
+	}
+	if err := s.Delete(key); err != nil && s.cache == nil {
+		return err
+	}
+	return nil
+}
+
+// originRequest sends a request for key to the origin.
+func (s *KVStore) originRequest(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cache.timeout)
+	u := *s.cache.url
+	query := u.Query()
+	query.Set("key", key)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := s.cache.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("%w: %w", ErrOrigin, err)
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a request's context once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// originError writes the response to a request the origin failed.
+func originError(w http.ResponseWriter, err error) {
+	httpapi.WriteError(w, http.StatusBadGateway, httpapi.CodeStoreFailed, err.Error(), nil)
+}
@@ -0,0 +1,118 @@
+package kvstore
+
+import "time"
+
+// DefaultChangeLogSize is the number of recent mutations each store retains.
+const DefaultChangeLogSize = 10000
+
+// Change operations.
+const (
+	OpSet    = "set"
+	OpDelete = "delete"
+	// OpReset means the whole dataset was replaced (e.g. a snapshot was loaded);
+	// consumers should resynchronize from a full export.
+	OpReset = "reset"
+)
+
+// Change is a single mutation recorded in a store's change feed.
+type Change struct {
+	Seq   uint64    `json:"seq"`
+	Op    string    `json:"op"`
+	Key   string    `json:"key,omitempty"`
+	Value string    `json:"value,omitempty"`
+	Time  time.Time `json:"time"`
+	// Expires is when the key set expires; nil if it has no TTL. A change
+	// of TTL alone is recorded as a set of the key's current value.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Rev is the revision of the key set, which read replicas take too, so
+	// its entity tag is the same on them.
+	Rev uint64 `json:"rev,omitempty"`
+}
+
+// ChangeFeed is a page of changes returned by Changes.
+type ChangeFeed struct {
+	Changes []Change `json:"changes"`
+	// Next is the sequence number to pass as since on the following call.
+	Next uint64 `json:"next"`
+	// Truncated is set when changes after since were already evicted from the
+	// bounded log, so the consumer has missed mutations and should resync.
+	Truncated bool `json:"truncated"`
+}
+
+// changeLog is a bounded ring of the most recent mutations.
+type changeLog struct {
+	entries []Change
+	start   int // index of the oldest entry
+	size    int
+	lastSeq uint64
+}
+
+func newChangeLog(capacity int) *changeLog {
+	return &changeLog{entries: make([]Change, capacity)}
+}
+
+// record appends a mutation and returns it with its sequence number.
+func (l *changeLog) record(op, key, value string, expires *time.Time, rev uint64) Change {
+	change := Change{Op: op, Key: key, Value: value, Time: time.Now(), Expires: expires, Rev: rev}
+	if l == nil || len(l.entries) == 0 {
+		return change
+	}
+	l.lastSeq++
+	change.Seq = l.lastSeq
+	if l.size < len(l.entries) {
+		l.entries[(l.start+l.size)%len(l.entries)] = change
+		l.size++
+		return change
+	}
+	l.entries[l.start] = change
+	l.start = (l.start + 1) % len(l.entries)
+	return change
+}
+
+func (l *changeLog) since(since uint64, limit int) ChangeFeed {
+	feed := ChangeFeed{Changes: []Change{}, Next: since}
+	if l == nil {
+		return feed
+	}
+	if since > l.lastSeq {
+		since = l.lastSeq // consumer is ahead, e.g. after a store restart
+		feed.Next = since
+	}
+	if l.size > 0 && since+1 < l.entries[l.start].Seq {
+		feed.Truncated = true
+	}
+	for i := 0; i < l.size; i++ {
+		change := l.entries[(l.start+i)%len(l.entries)]
+		if change.Seq <= since {
+			continue
+		}
+		if limit > 0 && len(feed.Changes) >= limit {
+			break
+		}
+		feed.Changes = append(feed.Changes, change)
+		feed.Next = change.Seq
+	}
+	return feed
+}
+
+// appliedBefore returns the time before which every change was made, for
+// a consumer that has applied the changes up to since. ok is false if the
+// changes after since were already evicted.
+func (l *changeLog) appliedBefore(since uint64, now time.Time) (before time.Time, ok bool) {
+	if l == nil || since >= l.lastSeq {
+		return now, true
+	}
+	if l.size == 0 || since+1 < l.entries[l.start].Seq {
+		return time.Time{}, false
+	}
+	next := l.entries[(l.start+int(since+1-l.entries[l.start].Seq))%len(l.entries)]
+	return next.Time, true
+}
+
+// Changes returns up to limit mutations with a sequence number greater than
+// since (limit <= 0 means no limit).
+func (s *KVStore) Changes(since uint64, limit int) ChangeFeed {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.changes.since(since, limit)
+}
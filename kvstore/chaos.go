@@ -0,0 +1,107 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"kv/httpapi"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults are the failures injected into a store's requests.
+type Faults struct {
+	// LatencyMs delays every request by this many milliseconds.
+	LatencyMs int `json:"latency_ms"`
+	// DropRate is the fraction of requests (0 to 1) whose connection is
+	// dropped without a response.
+	DropRate float64 `json:"drop_rate"`
+}
+
+// faultInjector applies Faults to requests and crashes the store on demand.
+type faultInjector struct {
+	mu     sync.RWMutex
+	faults Faults
+	crash  func()
+}
+
+// EnableFaultInjection turns on the /chaos admin endpoints, which inject
+// latency and dropped requests and crash the store by calling crash. It must
+// be called before the routes are registered and is meant for testing only.
+func (h *KVStoreHandler) EnableFaultInjection(crash func()) {
+	h.faults = &faultInjector{crash: crash}
+}
+
+// SetFaults replaces the faults being injected. It has no effect unless
+// fault injection is enabled.
+func (h *KVStoreHandler) SetFaults(f Faults) {
+	if h.faults == nil {
+		return
+	}
+	h.faults.mu.Lock()
+	defer h.faults.mu.Unlock()
+	h.faults.faults = f
+}
+
+// inject is a middleware making every route but /chaos suffer the
+// configured faults.
+func (fi *faultInjector) inject(route string, next http.HandlerFunc) http.HandlerFunc {
+	if strings.HasPrefix(route, "/chaos") {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		fi.mu.RLock()
+		f := fi.faults
+		fi.mu.RUnlock()
+
+		if f.LatencyMs > 0 {
+			select {
+			case <-time.After(time.Duration(f.LatencyMs) * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f.DropRate > 0 && rand.Float64() < f.DropRate {
+			// Abort the response; the server closes the connection
+			panic(http.ErrAbortHandler)
+		}
+		next(w, r)
+	}
+}
+
+// ChaosHandler: GET /chaos returns the injected faults; POST /chaos
+// {"latency_ms": 200, "drop_rate": 0.1} replaces them.
+func (h *KVStoreHandler) ChaosHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var f Faults
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil || f.LatencyMs < 0 || f.DropRate < 0 || f.DropRate > 1 {
+			httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		h.SetFaults(f)
+		h.logger.Warn("fault injection changed", "latency_ms", f.LatencyMs, "drop_rate", f.DropRate)
+	default:
+		httpapi.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.faults.mu.RLock()
+	defer h.faults.mu.RUnlock()
+	jsonResponse(w, h.faults.faults)
+}
+
+// ChaosCrashHandler: POST /chaos/crash
+// Responds, then crashes the store.
+func (h *KVStoreHandler) ChaosCrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.logger.Warn("crashing on request")
+	jsonResponse(w, map[string]string{"status": "crashing"})
+	http.NewResponseController(w).Flush()
+	go h.faults.crash()
+}
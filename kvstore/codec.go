@@ -0,0 +1,66 @@
+package kvstore
+
+import (
+	"kv/codec"
+	"os"
+	"strings"
+	"time"
+)
+
+// Snapshot files are named <base>.snapshot.<ext>, where ext is that of the
+// codec they are written in. Their metadata, tombstone and counter files are
+// JSON whatever the codec, and named after the base alone.
+
+// SetCodec sets the codec the store writes its snapshots and peer backups in
+// and asks its peers for backups in. Snapshots and backups written in
+// another codec are still read. Call it before the store is used.
+func (s *KVStore) SetCodec(c codec.Codec) {
+	s.codec = c
+}
+
+// Codec returns the codec the store writes its snapshots in.
+func (s *KVStore) Codec() codec.Codec {
+	return s.codec
+}
+
+// snapshotFile is the file named base written in c.
+func snapshotFile(base string, c codec.Codec) string {
+	return base + ".snapshot." + c.Extension()
+}
+
+// snapshotBase is the snapshot file at path without ".snapshot.<ext>".
+func snapshotBase(path string) string {
+	if i := strings.LastIndex(path, ".snapshot."); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
+// removeOtherCodecs removes the files named base written in codecs other
+// than keep, left from before the store's codec was changed. fileMu must be
+// held.
+func removeOtherCodecs(base string, keep codec.Codec) {
+	for _, ext := range codec.Extensions() {
+		if ext != keep.Extension() {
+			os.Remove(base + ".snapshot." + ext)
+		}
+	}
+}
+
+// StartupSnapshotPath is the snapshot the store starts from: SnapshotPath,
+// or if there is none, the newest snapshot of the store written in another
+// codec, so a store whose codec was changed keeps its data.
+func (s *KVStore) StartupSnapshotPath() string {
+	path := s.SnapshotPath()
+	if fileExists(path) {
+		return path
+	}
+	newest, newestTime := path, time.Time{}
+	for _, ext := range codec.Extensions() {
+		other := s.DataPath(s.Name + ".snapshot." + ext)
+		if info, err := os.Stat(other); err == nil && info.ModTime().After(newestTime) {
+			newest, newestTime = other, info.ModTime()
+		}
+	}
+	return newest
+}
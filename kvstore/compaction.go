@@ -0,0 +1,194 @@
+package kvstore
+
+import (
+	"context"
+	"kv/httpapi"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+const (
+	// DefaultCompactionInterval is how often a store checks whether its
+	// map is worth rebuilding.
+	DefaultCompactionInterval = time.Minute
+	// DefaultCompactionThreshold is the share of its retained capacity a
+	// map may fall to before it is rebuilt.
+	DefaultCompactionThreshold = 0.5
+	// compactionMinCapacity is the retained capacity below which a map is
+	// never rebuilt automatically; the memory is not worth the pause.
+	compactionMinCapacity = 4096
+)
+
+// Go maps never shrink: after deleting most of its keys a map keeps the
+// buckets it grew for the most it ever held. The store tracks that high
+// water mark as the map's retained capacity and compacts the map, copying
+// the live keys into a new one sized for them, when too little of it is in
+// use. Holding s.mu for the copy pauses writes for as long as it takes.
+
+// compactionState tracks the data map's retained capacity and the
+// compactions done. It is guarded by s.mu.
+type compactionState struct {
+	capacity  int // most keys the data map held since it was made
+	threshold float64
+	count     int
+	last      CompactionResult
+}
+
+// CompactionResult describes a compaction.
+type CompactionResult struct {
+	Time           time.Time `json:"time"`
+	Keys           int       `json:"keys"`
+	CapacityBefore int       `json:"capacity_before"`
+	PauseSeconds   float64   `json:"pause_seconds"`
+}
+
+// MemoryStats compares the keys a store holds with the capacity its map
+// retains, and reports the Go heap.
+type MemoryStats struct {
+	LiveKeys     int `json:"live_keys"`
+	ExpiringKeys int `json:"expiring_keys"`
+	// RetainedCapacity is the most keys the map held since it was made or
+	// last compacted; it keeps the memory for that many.
+	RetainedCapacity int     `json:"retained_capacity"`
+	LiveRatio        float64 `json:"live_ratio"`
+	// Threshold is the live ratio below which the map is compacted; zero
+	// if the store does not compact on its own.
+	Threshold      float64           `json:"threshold"`
+	Compactions    int               `json:"compactions"`
+	LastCompaction *CompactionResult `json:"last_compaction,omitempty"`
+
+	HeapAllocBytes    uint64 `json:"heap_alloc_bytes"`
+	HeapInuseBytes    uint64 `json:"heap_inuse_bytes"`
+	HeapIdleBytes     uint64 `json:"heap_idle_bytes"`
+	HeapReleasedBytes uint64 `json:"heap_released_bytes"`
+	SysBytes          uint64 `json:"sys_bytes"`
+	NumGC             uint32 `json:"num_gc"`
+}
+
+// updateCapacity keeps the retained capacity in step with a mutation. s.mu
+// must be held.
+func (s *KVStore) updateCapacity(op string) {
+	switch op {
+	case OpSet:
+		s.compaction.capacity = max(s.compaction.capacity, s.data.len())
+	case OpReset:
+		// A map replaced wholesale was made for the keys it holds
+		s.compaction.capacity = s.data.len()
+	}
+}
+
+// liveRatio is the share of the retained capacity in use. s.mu must be held.
+func (s *KVStore) liveRatio() float64 {
+	if s.compaction.capacity == 0 {
+		return 1
+	}
+	return float64(s.data.len()) / float64(s.compaction.capacity)
+}
+
+// Compact copies the live keys and TTLs into maps sized for them, so the
+// memory retained for keys deleted since can be freed.
+func (s *KVStore) Compact() CompactionResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+func (s *KVStore) compactLocked() CompactionResult {
+	start := time.Now()
+	result := CompactionResult{Time: start, Keys: s.data.len(), CapacityBefore: s.compaction.capacity}
+	// clone makes a new map sized for the keys; maps.Clone would keep the old map's size
+	data := s.data.clone()
+	expiry := make(map[string]time.Time, len(s.expiry))
+	for key, deadline := range s.expiry {
+		expiry[key] = deadline
+	}
+	s.data, s.expiry = newDataMap(data), expiry
+	s.compaction.capacity = len(data)
+	s.compaction.count++
+	result.PauseSeconds = time.Since(start).Seconds()
+	s.compaction.last = result
+	s.compactions.Inc()
+	s.logger.Info("map compacted", "keys", result.Keys, "capacity_before", result.CapacityBefore, "pause", time.Since(start))
+	return result
+}
+
+// compactIfSparse compacts the map if its live ratio fell below threshold.
+func (s *KVStore) compactIfSparse(threshold float64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.compaction.capacity < compactionMinCapacity || s.liveRatio() >= threshold {
+		return false
+	}
+	s.compactLocked()
+	return true
+}
+
+// StartCompaction starts a goroutine that compacts the map every interval
+// if less than threshold of its retained capacity is in use, replacing the
+// one already running.
+func (s *KVStore) StartCompaction(interval time.Duration, threshold float64) {
+	s.mu.Lock()
+	s.compaction.threshold = threshold
+	s.mu.Unlock()
+	s.tasks.Start("compaction", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			s.compactIfSparse(threshold)
+		}
+	})
+}
+
+// MemoryStats reports the store's live keys against its retained capacity.
+func (s *KVStore) MemoryStats() MemoryStats {
+	s.mu.RLock()
+	stats := MemoryStats{
+		LiveKeys:         s.data.len(),
+		ExpiringKeys:     len(s.expiry),
+		RetainedCapacity: max(s.compaction.capacity, s.data.len()),
+		LiveRatio:        s.liveRatio(),
+		Threshold:        s.compaction.threshold,
+		Compactions:      s.compaction.count,
+	}
+	if s.compaction.count > 0 {
+		last := s.compaction.last
+		stats.LastCompaction = &last
+	}
+	s.mu.RUnlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats.HeapAllocBytes = mem.HeapAlloc
+	stats.HeapInuseBytes = mem.HeapInuse
+	stats.HeapIdleBytes = mem.HeapIdle
+	stats.HeapReleasedBytes = mem.HeapReleased
+	stats.SysBytes = mem.Sys
+	stats.NumGC = mem.NumGC
+	return stats
+}
+
+// MemoryHandler: GET /memory
+// Reports live keys against the capacity the store's map retains, its compactions and the Go heap.
+func (h *KVStoreHandler) MemoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.kvstore.MemoryStats())
+}
+
+// CompactHandler: POST /memory/compact
+// Compacts the store's map now, whatever its live ratio.
+func (h *KVStoreHandler) CompactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.kvstore.Compact())
+}
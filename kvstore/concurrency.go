@@ -0,0 +1,42 @@
+package kvstore
+
+import (
+	"kv/httpapi"
+	"net/http"
+	"time"
+)
+
+// LimitConcurrency bounds how many requests the store serves at once, so a
+// flood of requests degrades into 503s with Retry-After instead of
+// unbounded goroutines and memory. A request over the limit waits up to
+// wait for another to finish first. Probes, the load report and /watch
+// streams are not limited. Call it before the handler serves its first request.
+func (h *KVStoreHandler) LimitConcurrency(limit int, wait time.Duration) {
+	limiter := httpapi.NewConcurrencyLimiter(limit, wait)
+	shed := h.kvstore.metrics.NewCounterVec("kvstore_requests_shed_total", "Requests turned away with 503 because the store was serving its limit of concurrent requests, by route.", "route")
+	limiter.Shed = func(route string) { shed.Inc(route) }
+	h.kvstore.metrics.NewGaugeFunc("kvstore_requests_in_flight", "Requests being served that count against the concurrency limit.", func() float64 {
+		return float64(limiter.InFlight())
+	})
+	h.limiter = limiter
+}
+
+// limitConcurrency is the store's concurrency limit as middleware.
+func (h *KVStoreHandler) limitConcurrency(route string, next http.HandlerFunc) http.HandlerFunc {
+	if unlimitedRoutes[route] {
+		return next
+	}
+	return h.limiter.Limit(route, next)
+}
+
+// unlimitedRoutes are served whatever the concurrency limit: probes and the
+// load report the broker places keys by must answer under load, and a
+// /watch stream would hold its slot for as long as it is open.
+var unlimitedRoutes = map[string]bool{
+	"/healthz":     true,
+	"/readyz":      true,
+	"/version":     true,
+	"/load-status": true,
+	"/load-report": true,
+	"/watch":       true,
+}
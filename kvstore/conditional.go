@@ -0,0 +1,156 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPreconditionFailed is returned by SetIf and DeleteIf when the key's
+// current value does not satisfy the request's If-Match or If-None-Match
+// header.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ETag returns the entity tag of a revision of a key.
+func ETag(rev uint64) string {
+	return fmt.Sprintf(`"%016x"`, rev)
+}
+
+// lastRevision numbers the writes made by every store in the process, each
+// write of a key taking a revision of its own, so writing back an earlier
+// value does not bring back its tag. It starts from the time the process
+// started, so revisions do not repeat across restarts.
+var lastRevision atomic.Uint64
+
+func init() {
+	lastRevision.Store(uint64(time.Now().UnixNano()))
+}
+
+func nextRevision() uint64 {
+	return lastRevision.Add(1)
+}
+
+// etagLocked returns the entity tag of key as the store holds it. The keys
+// not written since the data was loaded share the revision taken as it was.
+// s.mu must be held.
+func (s *KVStore) etagLocked(key string) string {
+	if rev, ok := s.revs[key]; ok {
+		return ETag(rev)
+	}
+	return ETag(s.loadedRev)
+}
+
+// GetTagged is Get returning the key's entity tag with its value.
+func (s *KVStore) GetTagged(key string) (value, etag string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.data.get(key)
+	if !ok || s.expiredLocked(key, time.Now()) {
+		return "", "", ErrKeyNotFound
+	}
+	return value, s.etagLocked(key), nil
+}
+
+// Precondition holds the If-Match and If-None-Match headers of a write.
+type Precondition struct {
+	IfMatch     string
+	IfNoneMatch string
+	// IfValue, if set, is the value the key must hold. It is the broker's
+	// if_value and is not sent to stores, which are sent the tag of the
+	// value it was checked against instead.
+	IfValue *string
+}
+
+// PreconditionFrom reads the conditional headers of a request.
+func PreconditionFrom(h http.Header) Precondition {
+	return Precondition{IfMatch: h.Get("If-Match"), IfNoneMatch: h.Get("If-None-Match")}
+}
+
+// IsZero reports whether the write is unconditional.
+func (p Precondition) IsZero() bool {
+	return p.IfMatch == "" && p.IfNoneMatch == "" && p.IfValue == nil
+}
+
+// Header sets the conditional headers on h.
+func (p Precondition) Header(h http.Header) {
+	if p.IfMatch != "" {
+		h.Set("If-Match", p.IfMatch)
+	}
+	if p.IfNoneMatch != "" {
+		h.Set("If-None-Match", p.IfNoneMatch)
+	}
+}
+
+// Allows reports whether a write may go ahead given the key's current value
+// and entity tag, or that it has none.
+func (p Precondition) Allows(value, etag string, exists bool) bool {
+	if p.IfMatch != "" && !(exists && MatchesETag(p.IfMatch, etag)) {
+		return false
+	}
+	if p.IfNoneMatch != "" && exists && MatchesETag(p.IfNoneMatch, etag) {
+		return false
+	}
+	if p.IfValue != nil && !(exists && value == *p.IfValue) {
+		return false
+	}
+	return true
+}
+
+// MatchesETag reports whether a list of entity tags from an If-Match or
+// If-None-Match header, or "*", includes etag. Weak tags compare equal to
+// the strong tag they mark.
+func MatchesETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteIf is Delete for a conditional delete: the key is deleted only if
+// its current value satisfies p, checked and deleted under one lock.
+func (s *KVStore) DeleteIf(key string, p Precondition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	current, exists := s.data.get(key)
+	if !exists || s.expiredLocked(key, now) {
+		return ErrKeyNotFound
+	}
+	if !p.Allows(current, s.etagLocked(key), true) {
+		return ErrPreconditionFailed
+	}
+	s.data.remove(key)
+	delete(s.expiry, key)
+	s.trashLocked(key, current, now)
+	s.publish(OpDelete, key, "")
+	return nil
+}
+
+// SetIf is Set for a conditional write: the key is set only if its current
+// value satisfies p, checked and written under one lock. It returns the
+// entity tag of the value written.
+func (s *KVStore) SetIf(key, value string, p Precondition) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key == "" {
+		return "", errors.New("key cannot be empty")
+	}
+	now := time.Now()
+	current, exists := s.data.get(key)
+	if exists && s.expiredLocked(key, now) {
+		exists = false
+	}
+	if !p.Allows(current, s.etagLocked(key), exists) {
+		return "", ErrPreconditionFailed
+	}
+	s.data.put(key, value)
+	s.resetExpiryLocked(key, now)
+	s.publish(OpSet, key, value)
+	return s.etagLocked(key), nil
+}
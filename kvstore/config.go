@@ -0,0 +1,320 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/codec"
+	"kv/qos"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EngineMemory is the in-memory storage engine, currently the only one.
+const EngineMemory = "memory"
+
+// Duration is a time.Duration written in config files as a string such as
+// "15s" or "1m30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"15s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// StoreConfig is the configuration of a store server, read from a JSON file
+// by LoadStoreConfig:
+//
+//	{
+//	  "name": "store1",
+//	  "listen": ":8081",
+//	  "advertise": "10.0.0.5:8081",
+//	  "broker": "http://broker1:8080/v1/register,http://broker2:8080/v1/register",
+//	  "register_timeout": "1m",
+//	  "heartbeat_interval": "10s",
+//	  "data_dir": "/var/lib/kv",
+//	  "snapshot_interval": "15s",
+//	  "warmup_timeout": "30s",
+//	  "compaction_interval": "1m",
+//	  "compaction_threshold": 0.5,
+//	  "engine": "memory",
+//	  "codec": "json",
+//	  "admin_token": "secret",
+//	  "indexes": [{"name": "email", "field": "email"}],
+//	  "background_limit": {"bytes_per_second": 10485760, "ops_per_second": 5000},
+//	  "server_timeouts": {"read_header": "10s", "read": "1m", "write": "2m", "idle": "2m"},
+//	  "peer_timeout": "2m",
+//	  "tombstone_horizon": "24h"
+//	}
+type StoreConfig struct {
+	// Name identifies the store to the broker and names its snapshot files.
+	Name string `json:"name"`
+	// Listen is the address the server listens on, e.g. ":8081". With port 0
+	// the kernel picks a free port, and the store registers that one.
+	Listen string `json:"listen"`
+	// Advertise is the host:port the broker and peers reach the store at.
+	// It defaults to localhost and the port of Listen.
+	Advertise string `json:"advertise,omitempty"`
+	// Broker is the broker's registration URL, or a comma-separated list of
+	// them; the store registers with the first that accepts it.
+	Broker string `json:"broker"`
+	// RegisterTimeout is how long the store keeps retrying registration at
+	// startup before giving up.
+	RegisterTimeout Duration `json:"register_timeout,omitempty"`
+	// HeartbeatInterval is how often the store re-registers while running.
+	HeartbeatInterval Duration `json:"heartbeat_interval,omitempty"`
+	// DataDir holds the store's snapshot and peer backup files.
+	DataDir string `json:"data_dir,omitempty"`
+	// SnapshotInterval is how often the store saves a snapshot and backs up its peer.
+	SnapshotInterval Duration `json:"snapshot_interval,omitempty"`
+	// WarmUpTimeout bounds how long a starting store waits for the backup
+	// of its data held by its peer before serving; zero skips warm-up.
+	WarmUpTimeout Duration `json:"warmup_timeout,omitempty"`
+	// CompactionInterval is how often the store checks whether its map
+	// should be compacted; zero turns automatic compaction off.
+	CompactionInterval Duration `json:"compaction_interval,omitempty"`
+	// CompactionThreshold is the share of the keys its map retains memory
+	// for that must still be live; below it the map is compacted.
+	CompactionThreshold float64 `json:"compaction_threshold,omitempty"`
+	// Engine is the storage engine; only "memory" is supported.
+	Engine string `json:"engine,omitempty"`
+	// Codec is the format snapshots and peer backups are written in:
+	// "json" (the default), "gob", "msgpack" or "protobuf".
+	Codec string `json:"codec,omitempty"`
+	// AdminToken authenticates the broker's admin calls such as /shutdown.
+	AdminToken string `json:"admin_token,omitempty"`
+	// ReplicaOf, if set, is the host:port of the store this one serves as a
+	// read replica of. A replica holds a copy of its primary's data and
+	// refuses writes.
+	ReplicaOf string `json:"replica_of,omitempty"`
+	// DefaultTTL, if set, is the TTL given to every key written to the
+	// store, unless /expire or /persist set another. A default TTL set
+	// through the broker replaces it.
+	DefaultTTL Duration `json:"default_ttl,omitempty"`
+	// Cache, if set, puts the store in cache mode in front of an origin.
+	Cache *CacheConfig `json:"cache,omitempty"`
+	// Indexes are the secondary indexes the store keeps from startup.
+	Indexes []IndexSpec `json:"indexes,omitempty"`
+	// BackgroundLimit paces snapshots, the backups the store serves and
+	// handoffs, so they leave room for client traffic. The broker's
+	// background_limit, if set, replaces it.
+	BackgroundLimit qos.Limit `json:"background_limit,omitempty"`
+	// ServerTimeouts bound how long clients may take over their requests.
+	ServerTimeouts ServerTimeouts `json:"server_timeouts,omitempty"`
+	// PeerTimeout bounds each call the store makes to another store.
+	PeerTimeout Duration `json:"peer_timeout,omitempty"`
+	// TombstoneHorizon is how long the store keeps the tombstones of keys
+	// deleted or expired at least; they are purged after it once its
+	// backup holders and replicas have acknowledged them.
+	TombstoneHorizon Duration `json:"tombstone_horizon,omitempty"`
+	// TrashRetention, if set, turns on soft delete: deleted keys are kept
+	// in memory for this long and can be restored with /undelete.
+	TrashRetention Duration `json:"trash_retention,omitempty"`
+	// MaxConcurrentRequests, if set, is how many requests the store serves
+	// at once; more get 503 with Retry-After. Probes and /watch streams
+	// are not counted.
+	MaxConcurrentRequests int `json:"max_concurrent_requests,omitempty"`
+	// ConcurrencyWait is how long a request over MaxConcurrentRequests
+	// waits for another to finish before it is turned away.
+	ConcurrencyWait Duration `json:"concurrency_wait,omitempty"`
+}
+
+// CacheConfig configures cache mode: keys missing from the store are read
+// through from the origin, and writes go to the origin first. Keys read
+// through expire after the store's default TTL.
+type CacheConfig struct {
+	// Origin is the URL of the origin's key endpoint.
+	Origin string `json:"origin"`
+	// Timeout bounds each request to the origin; it defaults to 5s.
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// DefaultStoreConfig returns the configuration used for settings that are
+// neither in the config file nor given as flags.
+func DefaultStoreConfig() StoreConfig {
+	return StoreConfig{
+		DataDir:             ".",
+		RegisterTimeout:     Duration(time.Minute),
+		HeartbeatInterval:   Duration(DefaultHeartbeatInterval),
+		SnapshotInterval:    Duration(15 * time.Second),
+		WarmUpTimeout:       Duration(DefaultWarmUpTimeout),
+		CompactionInterval:  Duration(DefaultCompactionInterval),
+		CompactionThreshold: DefaultCompactionThreshold,
+		Engine:              EngineMemory,
+		Codec:               codec.Default,
+		ServerTimeouts:      DefaultServerTimeouts(),
+		PeerTimeout:         Duration(DefaultPeerTimeout),
+		TombstoneHorizon:    Duration(DefaultTombstoneHorizon),
+	}
+}
+
+// LoadStoreConfig reads a JSON config file over the defaults. Unknown
+// fields are rejected so typos do not go unnoticed.
+func LoadStoreConfig(path string) (StoreConfig, error) {
+	cfg := DefaultStoreConfig()
+	file, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// BrokerURLs returns the broker registration URLs listed in Broker.
+func (c StoreConfig) BrokerURLs() []string {
+	var urls []string
+	for _, u := range strings.Split(c.Broker, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// AdvertiseAddress returns Advertise, or localhost with the port of Listen.
+// A port of 0 in Advertise also stands for the port of Listen, for a store
+// told the port the kernel picked by setting Listen to the address it
+// listens on.
+func (c StoreConfig) AdvertiseAddress() string {
+	_, port, err := net.SplitHostPort(c.Listen)
+	if c.Advertise != "" {
+		if host, advertised, splitErr := net.SplitHostPort(c.Advertise); splitErr == nil && advertised == "0" && err == nil {
+			return net.JoinHostPort(host, port)
+		}
+		return c.Advertise
+	}
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+// Validate reports every problem with the configuration at once.
+func (c StoreConfig) Validate() error {
+	var errs []error
+	if c.Name == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen %q is not a host:port address", c.Listen))
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		errs = append(errs, fmt.Errorf("listen %q has an invalid port", c.Listen))
+	}
+	if c.Advertise != "" {
+		if host, _, err := net.SplitHostPort(c.Advertise); err != nil || host == "" {
+			errs = append(errs, fmt.Errorf("advertise %q is not a host:port address", c.Advertise))
+		}
+	}
+	brokers := c.BrokerURLs()
+	if len(brokers) == 0 {
+		errs = append(errs, errors.New("broker URL is required"))
+	}
+	for _, b := range brokers {
+		if u, err := url.Parse(b); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("broker %q is not an http(s) URL", b))
+		}
+	}
+	if c.RegisterTimeout <= 0 {
+		errs = append(errs, errors.New("register_timeout must be positive"))
+	}
+	if c.HeartbeatInterval <= 0 {
+		errs = append(errs, errors.New("heartbeat_interval must be positive"))
+	}
+	if c.DataDir != "" {
+		if info, err := os.Stat(c.DataDir); err != nil {
+			errs = append(errs, fmt.Errorf("data_dir: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("data_dir %q is not a directory", c.DataDir))
+		}
+	}
+	if c.SnapshotInterval <= 0 {
+		errs = append(errs, errors.New("snapshot_interval must be positive"))
+	}
+	if _, err := codec.Lookup(c.Codec); err != nil {
+		errs = append(errs, fmt.Errorf("codec: %w", err))
+	}
+	seen := make(map[string]bool)
+	for i, idx := range c.Indexes {
+		if idx.Name == "" {
+			errs = append(errs, fmt.Errorf("indexes[%d]: name is required", i))
+		} else if seen[idx.Name] {
+			errs = append(errs, fmt.Errorf("indexes[%d]: duplicate name %q", i, idx.Name))
+		}
+		seen[idx.Name] = true
+	}
+	if err := c.BackgroundLimit.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("background_limit: %w", err))
+	}
+	if err := c.ServerTimeouts.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("server_timeouts: %w", err))
+	}
+	if c.PeerTimeout <= 0 {
+		errs = append(errs, errors.New("peer_timeout must be positive"))
+	}
+	if c.TombstoneHorizon <= 0 {
+		errs = append(errs, errors.New("tombstone_horizon must be positive"))
+	}
+	if c.CompactionInterval < 0 {
+		errs = append(errs, errors.New("compaction_interval must not be negative"))
+	}
+	if c.CompactionThreshold <= 0 || c.CompactionThreshold >= 1 {
+		errs = append(errs, fmt.Errorf("compaction_threshold %g must be between 0 and 1", c.CompactionThreshold))
+	}
+	if c.DefaultTTL < 0 {
+		errs = append(errs, errors.New("default_ttl must not be negative"))
+	}
+	if c.TrashRetention < 0 {
+		errs = append(errs, errors.New("trash_retention must not be negative"))
+	}
+	if c.MaxConcurrentRequests < 0 {
+		errs = append(errs, errors.New("max_concurrent_requests must not be negative"))
+	}
+	if c.ConcurrencyWait < 0 {
+		errs = append(errs, errors.New("concurrency_wait must not be negative"))
+	}
+	if c.WarmUpTimeout < 0 {
+		errs = append(errs, errors.New("warmup_timeout must not be negative"))
+	}
+	if c.ReplicaOf != "" {
+		if host, _, err := net.SplitHostPort(c.ReplicaOf); err != nil || host == "" {
+			errs = append(errs, fmt.Errorf("replica_of %q is not a host:port address", c.ReplicaOf))
+		}
+	}
+	if c.Cache != nil {
+		if u, err := url.Parse(c.Cache.Origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("cache.origin %q is not an http(s) URL", c.Cache.Origin))
+		}
+		if c.Cache.Timeout < 0 {
+			errs = append(errs, errors.New("cache.timeout must not be negative"))
+		}
+		if c.ReplicaOf != "" {
+			errs = append(errs, errors.New("cache and replica_of cannot both be set"))
+		}
+	}
+	if c.Engine != EngineMemory {
+		errs = append(errs, fmt.Errorf("engine %q is not supported (want %q)", c.Engine, EngineMemory))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,205 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/httpapi"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ErrNotCounter is returned by Incr when the key holds a value that is not
+// a decimal integer, or the increment would overflow it.
+var ErrNotCounter = errors.New("value is not an integer counter")
+
+// Incr adds delta to the integer held by key and returns the result. A key
+// that does not exist counts as 0; a key with a TTL keeps it.
+func (s *KVStore) Incr(key string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key == "" {
+		return 0, errors.New("key cannot be empty")
+	}
+	var current int64
+	now := time.Now()
+	if value, exists := s.data.get(key); exists && !s.expiredLocked(key, now) {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s", ErrNotCounter, key)
+		}
+		current = parsed
+	} else {
+		s.resetExpiryLocked(key, now)
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, fmt.Errorf("%w: %s would overflow", ErrNotCounter, key)
+	}
+	current += delta
+	value := strconv.FormatInt(current, 10)
+	s.data.put(key, value)
+	s.publish(OpSet, key, value)
+	return current, nil
+}
+
+// Counter floors: besides its full backups, a store keeps the latest value
+// of every counter the broker incremented on a store it backs up, in
+// peerof<name>.<peer>.counters.json. Taking over the peer's keys never sets
+// a counter below its floor, so counters do not go back on failover even if
+// the last full backup is older than the last increment.
+
+// countersPath is the counter floor file kept next to the backup file at path.
+func countersPath(path string) string {
+	return snapshotBase(path) + ".counters.json"
+}
+
+// readCounterFloors reads the counter floors kept next to the backup file at
+// path. fileMu must be held.
+func readCounterFloors(path string) (map[string]int64, error) {
+	floors := make(map[string]int64)
+	data, err := os.ReadFile(countersPath(path))
+	if os.IsNotExist(err) {
+		return floors, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &floors); err != nil {
+		return nil, fmt.Errorf("failed to decode counter floors: %w", err)
+	}
+	return floors, nil
+}
+
+// writeCounterFloors replaces the counter floors kept next to the backup file
+// at path, removing the file if there are none. fileMu must be held.
+func writeCounterFloors(path string, floors map[string]int64) error {
+	if len(floors) == 0 {
+		if err := os.Remove(countersPath(path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(floors)
+	if err != nil {
+		return err
+	}
+	tmp := countersPath(path) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, countersPath(path))
+}
+
+// RaiseCounterFloor records that the counter key on the named peer has
+// reached value.
+func (s *KVStore) RaiseCounterFloor(peer, key string, value int64) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	path := s.PeerBackupPath(peer)
+	floors, err := readCounterFloors(path)
+	if err != nil {
+		return err
+	}
+	if floor, exists := floors[key]; exists && floor >= value {
+		return nil
+	}
+	floors[key] = value
+	return writeCounterFloors(path, floors)
+}
+
+// applyCounterFloors raises the counters in data to the floors kept next to
+// the backup file at path. With prune, floors data now reaches are dropped,
+// as data is about to be written as that backup. fileMu must be held.
+func applyCounterFloors(path string, data map[string]string, prune bool) (int, error) {
+	floors, err := readCounterFloors(path)
+	if err != nil || len(floors) == 0 {
+		return 0, err
+	}
+	raised := 0
+	for key, floor := range floors {
+		value, exists := data[key]
+		current, err := strconv.ParseInt(value, 10, 64)
+		switch {
+		case exists && (err != nil || current >= floor):
+			// Caught up with the increment, or no longer a counter
+			if prune {
+				delete(floors, key)
+			}
+		case prune:
+			// The backup predates the increment; keep the floor
+		default:
+			data[key] = strconv.FormatInt(floor, 10)
+			raised++
+		}
+	}
+	if prune {
+		return 0, writeCounterFloors(path, floors)
+	}
+	return raised, nil
+}
+
+// IncrRequest is the body of POST /incr.
+type IncrRequest struct {
+	Key   string `json:"key"`
+	Delta *int64 `json:"delta,omitempty"` // 1 if omitted
+}
+
+// IncrResponse is the result of an increment.
+type IncrResponse struct {
+	Key   string `json:"key"`
+	Value int64  `json:"value"`
+}
+
+// IncrHandler: POST /incr {"key": "hits", "delta": 1}
+// Adds delta to the integer held by the key and responds with the result; 409 if it is not an integer.
+func (h *KVStoreHandler) IncrHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req IncrRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	delta := int64(1)
+	if req.Delta != nil {
+		delta = *req.Delta
+	}
+	value, err := h.kvstore.Incr(req.Key, delta)
+	if err != nil {
+		httpapi.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	h.kvstore.noteAccess(req.Key)
+	jsonResponse(w, IncrResponse{Key: req.Key, Value: value})
+}
+
+// CounterFloorRequest is the body of POST /counter-floor.
+type CounterFloorRequest struct {
+	Peer  string `json:"peer"`
+	Key   string `json:"key"`
+	Value int64  `json:"value"`
+}
+
+// CounterFloorHandler: POST /counter-floor {"peer": "store2", "key": "hits", "value": 42}
+// Sent by the broker after incrementing a counter on a store this one backs up.
+func (h *KVStoreHandler) CounterFloorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req CounterFloorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Peer == "" || req.Key == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := h.kvstore.RaiseCounterFloor(req.Peer, req.Key, req.Value); err != nil {
+		httpapi.Error(w, "Failed to record counter: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]string{"message": "Counter recorded"})
+}
@@ -0,0 +1,142 @@
+package kvstore
+
+import "iter"
+
+// dataMap holds a store's keys and values. A snapshot freezes it to read
+// its base map without holding s.mu; writes made meanwhile go to an overlay
+// instead, and are folded into the base once the snapshot is done. Copying
+// nothing up front, a snapshot pauses writers for no longer than it takes
+// to fold in the writes made while it ran.
+//
+// Its methods require s.mu, held exclusively by those that write.
+type dataMap struct {
+	base map[string]string
+	// set and deleted hold the writes made while the base is frozen; a key
+	// is in at most one of them
+	set     map[string]string
+	deleted map[string]struct{}
+	length  int
+	bytes   int64 // of the keys and values held
+	frozen  int   // readers of the base not holding s.mu
+}
+
+func newDataMap(base map[string]string) *dataMap {
+	d := &dataMap{base: base, length: len(base)}
+	for key, value := range base {
+		d.bytes += int64(len(key) + len(value))
+	}
+	return d
+}
+
+func (d *dataMap) get(key string) (string, bool) {
+	if d.frozen > 0 {
+		if value, ok := d.set[key]; ok {
+			return value, true
+		}
+		if _, ok := d.deleted[key]; ok {
+			return "", false
+		}
+	}
+	value, ok := d.base[key]
+	return value, ok
+}
+
+func (d *dataMap) put(key, value string) {
+	if old, ok := d.get(key); ok {
+		d.bytes += int64(len(value) - len(old))
+	} else {
+		d.length++
+		d.bytes += int64(len(key) + len(value))
+	}
+	if d.frozen == 0 {
+		d.base[key] = value
+		return
+	}
+	d.set[key] = value
+	delete(d.deleted, key)
+}
+
+func (d *dataMap) remove(key string) {
+	old, ok := d.get(key)
+	if !ok {
+		return
+	}
+	d.length--
+	d.bytes -= int64(len(key) + len(old))
+	if d.frozen == 0 {
+		delete(d.base, key)
+		return
+	}
+	delete(d.set, key)
+	d.deleted[key] = struct{}{}
+}
+
+func (d *dataMap) len() int {
+	return d.length
+}
+
+// size returns the bytes of the keys and values held.
+func (d *dataMap) size() int64 {
+	return d.bytes
+}
+
+// all iterates over the pairs held, in no particular order.
+func (d *dataMap) all() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for key, value := range d.set {
+			if !yield(key, value) {
+				return
+			}
+		}
+		for key, value := range d.base {
+			if d.frozen > 0 {
+				if _, ok := d.set[key]; ok {
+					continue
+				}
+				if _, ok := d.deleted[key]; ok {
+					continue
+				}
+			}
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// clone copies the pairs held into a map of their own.
+func (d *dataMap) clone() map[string]string {
+	data := make(map[string]string, d.length)
+	for key, value := range d.all() {
+		data[key] = value
+	}
+	return data
+}
+
+// freeze returns the pairs held, which stay as they are until thaw is
+// called, so they can be read without s.mu. The first freeze returns the
+// base itself; a nested one returns a copy, since the base lacks the writes
+// made since the first. s.mu must be held exclusively.
+func (d *dataMap) freeze() map[string]string {
+	d.frozen++
+	if d.frozen > 1 {
+		return d.clone()
+	}
+	d.set, d.deleted = make(map[string]string), make(map[string]struct{})
+	return d.base
+}
+
+// thaw ends a freeze, folding the writes made since into the base once no
+// reader is left. s.mu must be held exclusively.
+func (d *dataMap) thaw() {
+	if d.frozen--; d.frozen > 0 {
+		return
+	}
+	for key := range d.deleted {
+		delete(d.base, key)
+	}
+	for key, value := range d.set {
+		d.base[key] = value
+	}
+	d.set, d.deleted = nil, nil
+}
@@ -0,0 +1,195 @@
+package kvstore
+
+import (
+	"errors"
+	"io"
+	"kv/codec"
+	"maps"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pairsSize is the bytes of the keys and values of pairs.
+func pairsSize(pairs map[string]string) int64 {
+	var n int64
+	for key, value := range pairs {
+		n += int64(len(key) + len(value))
+	}
+	return n
+}
+
+// checkHolds checks that d holds exactly want, through every way of reading it.
+func checkHolds(t *testing.T, d *dataMap, want map[string]string) {
+	t.Helper()
+	if got := d.clone(); !maps.Equal(got, want) {
+		t.Errorf("holds %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got, ok := d.get(key); !ok || got != value {
+			t.Errorf("get(%q) = %q, %v; want %q", key, got, ok, value)
+		}
+	}
+	if d.len() != len(want) {
+		t.Errorf("len() = %d, want %d", d.len(), len(want))
+	}
+	if d.size() != pairsSize(want) {
+		t.Errorf("size() = %d, want %d", d.size(), pairsSize(want))
+	}
+}
+
+func TestDataMapWritesDuringFreeze(t *testing.T) {
+	d := newDataMap(map[string]string{"a": "1", "b": "2", "c": "3"})
+	frozen := d.freeze()
+
+	d.put("a", "10")
+	d.put("d", "4")
+	d.remove("b")
+	d.remove("c")
+	d.put("c", "30") // deleted and written again
+	d.remove("missing")
+
+	// The snapshot reads the base as it was frozen
+	if want := map[string]string{"a": "1", "b": "2", "c": "3"}; !maps.Equal(frozen, want) {
+		t.Errorf("frozen base changed to %v, want %v", frozen, want)
+	}
+	if want := map[string]string{"a": "10", "c": "30", "d": "4"}; !maps.Equal(d.set, want) {
+		t.Errorf("overlay set = %v, want %v", d.set, want)
+	}
+	if _, ok := d.deleted["b"]; !ok || len(d.deleted) != 1 {
+		t.Errorf("overlay deleted = %v, want b only", d.deleted)
+	}
+	if _, ok := d.get("b"); ok {
+		t.Error("b readable after being deleted during the freeze")
+	}
+	checkHolds(t, d, map[string]string{"a": "10", "c": "30", "d": "4"})
+
+	d.thaw()
+	want := map[string]string{"a": "10", "c": "30", "d": "4"}
+	if !maps.Equal(d.base, want) {
+		t.Errorf("base after thaw = %v, want %v", d.base, want)
+	}
+	if d.set != nil || d.deleted != nil {
+		t.Errorf("overlay kept after thaw: set %v, deleted %v", d.set, d.deleted)
+	}
+	checkHolds(t, d, want)
+
+	// Writes go straight to the base again
+	d.put("e", "5")
+	if d.base["e"] != "5" {
+		t.Error("write after thaw did not reach the base")
+	}
+}
+
+func TestDataMapNestedFreeze(t *testing.T) {
+	d := newDataMap(map[string]string{"a": "1"})
+	first := d.freeze()
+	d.put("b", "2")
+	second := d.freeze()
+	d.remove("a")
+	d.put("c", "3")
+
+	// Each freeze reads the pairs held when it was taken
+	if want := map[string]string{"a": "1"}; !maps.Equal(first, want) {
+		t.Errorf("first freeze reads %v, want %v", first, want)
+	}
+	if want := map[string]string{"a": "1", "b": "2"}; !maps.Equal(second, want) {
+		t.Errorf("nested freeze reads %v, want %v", second, want)
+	}
+	want := map[string]string{"b": "2", "c": "3"}
+	checkHolds(t, d, want)
+
+	d.thaw()
+	// The first freeze still reads the base: the writes stay in the overlay
+	if !maps.Equal(first, map[string]string{"a": "1"}) {
+		t.Errorf("first freeze changed to %v before the last thaw", first)
+	}
+	checkHolds(t, d, want)
+
+	d.thaw()
+	if !maps.Equal(d.base, want) {
+		t.Errorf("base after the last thaw = %v, want %v", d.base, want)
+	}
+	checkHolds(t, d, want)
+}
+
+// blockingCodec writes snapshots as JSON, but only once release is closed.
+// It closes encoding once the first snapshot is frozen and being written.
+type blockingCodec struct {
+	codec.JSON
+	encoding, release chan struct{}
+	once              *sync.Once
+}
+
+func (c blockingCodec) Encode(w io.Writer, data map[string]string, expiry map[string]time.Time) error {
+	c.once.Do(func() { close(c.encoding) })
+	<-c.release
+	return c.JSON.Encode(w, data, expiry)
+}
+
+func TestStoreWritesWhileSnapshotFrozen(t *testing.T) {
+	dir := t.TempDir()
+	s := NewKVStore("frozen", "0")
+	s.SetDataDir(dir)
+	blocking := blockingCodec{encoding: make(chan struct{}), release: make(chan struct{}), once: new(sync.Once)}
+	s.SetCodec(blocking)
+	s.Set("a", "1")
+	s.Set("b", "2")
+
+	saved := make(chan error, 1)
+	go func() { saved <- s.SaveToDisk() }()
+	<-blocking.encoding
+
+	// Writes finish while the snapshot is being written out
+	wrote := make(chan struct{})
+	go func() {
+		defer close(wrote)
+		s.Set("a", "10")
+		s.Set("c", "3")
+		s.Delete("b")
+	}()
+	select {
+	case <-wrote:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked by the snapshot being written")
+	}
+	if value, err := s.Get("a"); err != nil || value != "10" {
+		t.Errorf("Get a during the snapshot = %q, %v; want 10", value, err)
+	}
+	if _, err := s.Get("b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get b after deleting it during the snapshot: %v, want ErrKeyNotFound", err)
+	}
+
+	close(blocking.release)
+	if err := <-saved; err != nil {
+		t.Fatal(err)
+	}
+	// The snapshot taken holds the data as it was frozen
+	if got, want := loadSnapshot(t, dir, s), map[string]string{"a": "1", "b": "2"}; !maps.Equal(got, want) {
+		t.Errorf("snapshot holds %v, want %v", got, want)
+	}
+
+	want := map[string]string{"a": "10", "c": "3"}
+	if got := s.GetAllData(); !maps.Equal(got, want) {
+		t.Errorf("data after the snapshot = %v, want %v", got, want)
+	}
+	// and the next one the writes made meanwhile
+	if err := s.SaveToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadSnapshot(t, dir, s); !maps.Equal(got, want) {
+		t.Errorf("next snapshot holds %v, want %v", got, want)
+	}
+}
+
+// loadSnapshot loads the snapshot s saved in dir into a store of its own
+// and returns its data.
+func loadSnapshot(t *testing.T, dir string, s *KVStore) map[string]string {
+	t.Helper()
+	loaded := NewKVStore("loaded", "0")
+	loaded.SetDataDir(dir)
+	if err := loaded.LoadFromDisk(s.SnapshotPath()); err != nil {
+		t.Fatal(err)
+	}
+	return loaded.GetAllData()
+}
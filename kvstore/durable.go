@@ -0,0 +1,43 @@
+package kvstore
+
+import "sync"
+
+// durableSave is the fsynced save that callers of SaveDurably join. A save
+// takes the callers arriving until it freezes the data; those arriving later
+// start another, so every caller's earlier writes are in the save it waits
+// for.
+type durableSave struct {
+	mu   sync.Mutex
+	next *saveCall // nil until a caller arrives after the last save froze its data
+}
+
+// saveCall is a save shared by the callers that joined it.
+type saveCall struct {
+	done chan struct{}
+	err  error
+}
+
+// SaveDurably saves a snapshot holding every write made before the call and
+// returns once it is fsynced. Unlike SaveToDisk it is not paced, and
+// concurrent callers share a save rather than taking one each.
+func (s *KVStore) SaveDurably() error {
+	d := &s.durable
+	d.mu.Lock()
+	call, leader := d.next, false
+	if call == nil {
+		call, leader = &saveCall{done: make(chan struct{})}, true
+		d.next = call
+	}
+	d.mu.Unlock()
+
+	if leader {
+		call.err = s.saveToDisk(saveOptions{freezing: func() {
+			d.mu.Lock()
+			d.next = nil
+			d.mu.Unlock()
+		}})
+		close(call.done)
+	}
+	<-call.done
+	return call.err
+}
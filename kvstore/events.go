@@ -0,0 +1,166 @@
+package kvstore
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OpExpire is the operation of an event for a key removed because its TTL
+// passed. The change feed reports these as OpDelete.
+const OpExpire = "expire"
+
+// DefaultEventBuffer is the number of events a subscriber may fall behind by
+// before further events are dropped for it.
+const DefaultEventBuffer = 1024
+
+// Event is a mutation published on a store's event bus. Seq matches the
+// change feed's sequence number for the same mutation.
+type Event struct {
+	Seq   uint64    `json:"seq"`
+	Op    string    `json:"op"`
+	Key   string    `json:"key,omitempty"`
+	Value string    `json:"value,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// EventBus delivers a store's mutations to in-process subscribers, such as
+// the /watch endpoint. Publishing never blocks: a subscriber that falls more
+// than its buffer behind misses events, which its Dropped count reports.
+type EventBus struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewEventBus returns an empty event bus.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives the events published after it was made, in order.
+type Subscription struct {
+	// C carries the events. It is closed when the subscription or the bus is closed.
+	C <-chan Event
+
+	ch      chan Event
+	bus     *EventBus
+	prefix  string
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Subscribe returns a subscription to events for keys starting with prefix
+// (every event if prefix is empty), buffering up to buffer events.
+// OpReset events have no key and are delivered to every subscriber.
+func (b *EventBus) Subscribe(prefix string, buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = DefaultEventBuffer
+	}
+	ch := make(chan Event, buffer)
+	sub := &Subscription{C: ch, ch: ch, bus: b, prefix: prefix}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return sub
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// Publish delivers e to every matching subscriber without waiting for any.
+func (b *EventBus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return
+	}
+	for sub := range b.subs {
+		if e.Op != OpReset && !strings.HasPrefix(e.Key, sub.prefix) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribers returns the number of open subscriptions.
+func (b *EventBus) Subscribers() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
+
+// Close closes every subscription; later events are discarded.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for sub := range b.subs {
+		sub.once.Do(func() { close(sub.ch) })
+	}
+	b.subs = nil
+}
+
+// Dropped returns the number of events the subscriber missed because its
+// buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close stops the subscription and closes C.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	delete(s.bus.subs, s)
+	s.once.Do(func() { close(s.ch) })
+}
+
+// Events returns the store's event bus.
+func (s *KVStore) Events() *EventBus {
+	return s.events
+}
+
+// publish brings the Bloom filter and indexes up to date with a mutation,
+// records it in the change feed and publishes it on the event bus. s.mu must
+// be held, so events are published in change feed order.
+func (s *KVStore) publish(op, key, value string) {
+	s.updateBloom(op, key)
+	s.updateIndexes(op, key, value)
+	s.updateCapacity(op)
+	s.record(op, key, value)
+}
+
+// record is publish for a mutation whose Bloom filter and indexes are
+// already up to date. s.mu must be held.
+func (s *KVStore) record(op, key, value string) {
+	logOp := op
+	if op == OpExpire {
+		logOp = OpDelete
+	}
+	var expires *time.Time
+	if deadline, ok := s.expiry[key]; ok && logOp == OpSet {
+		expires = &deadline
+	}
+	// Each write of a key takes a revision of its own
+	var rev uint64
+	if logOp == OpSet {
+		rev = nextRevision()
+		s.revs[key] = rev
+	} else {
+		delete(s.revs, key)
+	}
+	change := s.changes.record(logOp, key, value, expires, rev)
+	s.noteTombstoneLocked(logOp, key, change.Time)
+	s.eventsTotal.Inc(op)
+	s.events.Publish(Event{Seq: change.Seq, Op: op, Key: key, Value: value, Time: change.Time})
+}
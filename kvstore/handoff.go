@@ -0,0 +1,271 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/httpapi"
+	"maps"
+	"net/http"
+	"sort"
+)
+
+// handoffBatchSize is the number of pairs sent to the handoff target per request.
+const handoffBatchSize = 1000
+
+// handoffCatchUpPasses bounds the passes that send the writes made while a
+// handoff was running.
+const handoffCatchUpPasses = 5
+
+// HandoffResult reports a handoff of the store's keys to another store.
+type HandoffResult struct {
+	Target string `json:"target"`
+	// Keys is the number of keys the target holds for this store afterwards.
+	Keys int `json:"keys"`
+	// Verified is the number of them read back from the target with the
+	// value sent; the handoff fails if it is short of Keys.
+	Verified int `json:"verified"`
+	// Passes is the number of passes made: the full copy and the catch-ups.
+	Passes int `json:"passes"`
+}
+
+// HandOff pushes every key the store holds to the store at target (host:port)
+// and reads each back to confirm it arrived. Writes made meanwhile, found in
+// the change log, are sent in further passes until there are none. Keys are
+// sent with their entity tags, so a key written on the target since it was
+// read here is kept there, and is no longer this store's to confirm. The
+// store keeps its keys; the caller removes it afterwards.
+//
+// Its progress is reported by Migration, through which it can be paused,
+// resumed or aborted between batches.
+func (s *KVStore) HandOff(ctx context.Context, target string) (result HandoffResult, err error) {
+	result = HandoffResult{Target: target}
+	if target == "" || target == s.IPAddress {
+		return result, errors.New("handoff target must be another store")
+	}
+	m := NewMigration("handoff", s.Name, target)
+	s.mu.Lock()
+	if s.migration != nil && s.migration.Status().FinishedAt == nil {
+		s.mu.Unlock()
+		return result, errors.New("a handoff is already running")
+	}
+	s.migration = m
+	s.mu.Unlock()
+	defer func() { m.Finish(err) }()
+
+	// sent is what the target holds for this store
+	sent := make(map[string]string)
+	s.mu.RLock()
+	seq := s.changes.lastSeq
+	pending, etags := s.cloneTaggedLocked()
+	s.mu.RUnlock()
+	var deleted map[string]string
+
+	for {
+		result.Passes++
+		m.AddKeys(len(pending))
+		kept, err := s.handoffPass(ctx, m, target, pending, etags, deleted)
+		if err != nil {
+			return result, err
+		}
+		for key := range deleted {
+			delete(sent, key)
+		}
+		maps.Copy(sent, pending)
+		for _, key := range kept {
+			delete(sent, key)
+		}
+
+		s.mu.RLock()
+		feed := s.changes.since(seq, 0)
+		s.mu.RUnlock()
+		if len(feed.Changes) == 0 && !feed.Truncated {
+			break
+		}
+		if result.Passes > handoffCatchUpPasses {
+			return result, fmt.Errorf("store is still being written to after %d passes", result.Passes)
+		}
+		seq = feed.Next
+		pending, etags, deleted = make(map[string]string), make(map[string]string), make(map[string]string)
+		if feed.Truncated {
+			// Too many writes to follow; send everything again
+			s.mu.RLock()
+			pending, etags = s.cloneTaggedLocked()
+			s.mu.RUnlock()
+			for key, value := range sent {
+				if _, ok := pending[key]; !ok {
+					deleted[key] = value
+				}
+			}
+			continue
+		}
+		for _, change := range feed.Changes {
+			switch change.Op {
+			case OpSet:
+				pending[change.Key] = change.Value
+				if change.Rev != 0 {
+					etags[change.Key] = ETag(change.Rev)
+				}
+				delete(deleted, change.Key)
+			case OpDelete:
+				if value, ok := sent[change.Key]; ok {
+					deleted[change.Key] = value
+				}
+				delete(pending, change.Key)
+			}
+		}
+	}
+
+	result.Keys = len(sent)
+	verified, err := s.verifyHandoff(ctx, target, sent)
+	result.Verified = verified
+	if err != nil {
+		return result, err
+	}
+	if verified < len(sent) {
+		return result, fmt.Errorf("target holds %d of %d keys handed off", verified, len(sent))
+	}
+	s.logger.Info("keys handed off", "target", target, "keys", result.Keys, "passes", result.Passes)
+	return result, nil
+}
+
+// handoffPass sends pairs to target in batches, with the entity tags in
+// etags, and deletes there the keys in deleted that still have the value
+// sent earlier. It returns the keys the target kept, having written them
+// since they were read.
+func (s *KVStore) handoffPass(ctx context.Context, m *Migration, target string, pairs, etags, deleted map[string]string) ([]string, error) {
+	var kept []string
+	for _, batch := range batches(pairs) {
+		if err := m.Wait(ctx); err != nil {
+			return kept, err
+		}
+		if err := s.background.WaitPairs(ctx, "handoff", batch); err != nil {
+			return kept, err
+		}
+		batchTags := make(map[string]string, len(batch))
+		for key := range batch {
+			if etag, ok := etags[key]; ok {
+				batchTags[key] = etag
+			}
+		}
+		var written struct {
+			Kept []string `json:"kept"`
+		}
+		if err := s.storePost(ctx, target, "/mset?moved=1", map[string]interface{}{"pairs": batch, "etags": batchTags}, &written); err != nil {
+			return kept, fmt.Errorf("error sending keys to %s: %w", target, err)
+		}
+		kept = append(kept, written.Kept...)
+		m.Moved(batch)
+	}
+	for _, batch := range batches(deleted) {
+		if err := s.storePost(ctx, target, "/mdelete", map[string]interface{}{"pairs": batch}, nil); err != nil {
+			return kept, fmt.Errorf("error deleting keys on %s: %w", target, err)
+		}
+	}
+	return kept, nil
+}
+
+// cloneTaggedLocked copies the pairs held, and their entity tags, into maps
+// of their own. s.mu must be held.
+func (s *KVStore) cloneTaggedLocked() (data, etags map[string]string) {
+	data = s.data.clone()
+	etags = make(map[string]string, len(data))
+	for key := range data {
+		etags[key] = s.etagLocked(key)
+	}
+	return data, etags
+}
+
+// verifyHandoff reads the keys sent back from target and counts those that
+// have the value sent.
+func (s *KVStore) verifyHandoff(ctx context.Context, target string, sent map[string]string) (int, error) {
+	verified := 0
+	for _, batch := range batches(sent) {
+		keys := make([]string, 0, len(batch))
+		for key := range batch {
+			keys = append(keys, key)
+		}
+		var got struct {
+			Values map[string]string `json:"values"`
+		}
+		if err := s.storePost(ctx, target, "/mget", map[string]interface{}{"keys": keys}, &got); err != nil {
+			return verified, fmt.Errorf("error reading keys back from %s: %w", target, err)
+		}
+		for key, value := range batch {
+			if got.Values[key] == value {
+				verified++
+			}
+		}
+	}
+	return verified, nil
+}
+
+// batches splits pairs into batches of at most handoffBatchSize, in key order.
+func batches(pairs map[string]string) []map[string]string {
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var result []map[string]string
+	for start := 0; start < len(keys); start += handoffBatchSize {
+		batch := make(map[string]string)
+		for _, key := range keys[start:min(start+handoffBatchSize, len(keys))] {
+			batch[key] = pairs[key]
+		}
+		result = append(result, batch)
+	}
+	return result
+}
+
+// storePost sends body as JSON to another store and decodes the response into
+// out, if not nil.
+func (s *KVStore) storePost(ctx context.Context, addr, path string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+httpapi.Version+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.transport.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("store returned status %d for %s", resp.StatusCode, path)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// HandoffHandler: POST /handoff {"target": "host:port"}
+// Sent by the broker before it removes the store: pushes every key to the target and confirms each arrived.
+func (h *KVStoreHandler) HandoffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Target == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.kvstore.HandOff(r.Context(), req.Target)
+	if err != nil {
+		h.logger.Error("handoff failed", "target", req.Target, "err", err)
+		httpapi.WriteError(w, http.StatusBadGateway, httpapi.CodeStoreFailed, "Handoff failed: "+err.Error(), result)
+		return
+	}
+	jsonResponse(w, result)
+}
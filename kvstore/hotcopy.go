@@ -0,0 +1,110 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"kv/httpapi"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Hot copies: the broker copies a key read so often that it loads the store
+// holding it to other stores, and spreads the key's reads over them. A copy
+// is not one of the store's keys: it is not listed, scanned, counted in its
+// stats, snapshotted or backed up, and it is only read through /hot-copies.
+// Copies expire unless the broker renews them, and the broker stops reading
+// a key's copies as soon as it writes the key, so it never reads a copy
+// older than the write.
+
+// hotCopies are the copies a store holds of other stores' hot keys.
+type hotCopies struct {
+	mu      sync.Mutex
+	entries map[string]hotCopy
+}
+
+type hotCopy struct {
+	value   string
+	expires time.Time
+}
+
+// PutHotCopies keeps copies of pairs for ttl, replacing earlier copies of
+// the same keys, and drops the copies of drop.
+func (s *KVStore) PutHotCopies(pairs map[string]string, drop []string, ttl time.Duration) {
+	c := &s.copies
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for _, key := range drop {
+		delete(c.entries, key)
+	}
+	if len(pairs) > 0 && c.entries == nil {
+		c.entries = make(map[string]hotCopy, len(pairs))
+	}
+	for key, value := range pairs {
+		c.entries[key] = hotCopy{value: value, expires: now.Add(ttl)}
+	}
+}
+
+// HotCopy returns the copy of key, if the store holds one that has not
+// expired.
+func (s *KVStore) HotCopy(key string) (string, bool) {
+	c := &s.copies
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !time.Now().Before(e.expires) {
+		return "", false
+	}
+	return e.value, true
+}
+
+// HotCopyCount returns the number of copies the store holds, expired or not.
+func (s *KVStore) HotCopyCount() int {
+	c := &s.copies
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// HotCopiesRequest is the body of a store's POST /hot-copies.
+type HotCopiesRequest struct {
+	Copies map[string]string `json:"copies,omitempty"`
+	Drop   []string          `json:"drop,omitempty"`
+	// TTL is how long the copies are kept unless renewed.
+	TTL Duration `json:"ttl"`
+}
+
+// HotCopiesHandler: GET /hot-copies?key=<k>, POST /hot-copies { "copies": {...}, "drop": [...], "ttl": "30s" }
+// Reads the copy of another store's hot key, or keeps and drops copies.
+func (h *KVStoreHandler) HotCopiesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		key := r.URL.Query().Get("key")
+		value, ok := h.kvstore.HotCopy(key)
+		if !ok {
+			httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeKeyNotFound, "No copy of the key", nil)
+			return
+		}
+		h.kvstore.noteAccess(key)
+		jsonResponse(w, map[string]string{"key": key, "value": value})
+	case http.MethodPost:
+		var req HotCopiesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.TTL <= 0 && len(req.Copies) > 0 {
+			httpapi.Error(w, "ttl must be positive", http.StatusBadRequest)
+			return
+		}
+		h.kvstore.PutHotCopies(req.Copies, req.Drop, time.Duration(req.TTL))
+		jsonResponse(w, map[string]int{"copies": h.kvstore.HotCopyCount()})
+	default:
+		httpapi.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+	}
+}
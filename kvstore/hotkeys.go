@@ -0,0 +1,204 @@
+package kvstore
+
+import (
+	"fmt"
+	"hash/maphash"
+	"kv/httpapi"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hot keys: a store counts the reads and writes of each key in a count-min
+// sketch, which takes fixed memory however many keys there are and may only
+// overcount, and keeps the keys counted most often alongside it. Counts are
+// halved every hotKeysHalfLife, so they follow the recent traffic rather
+// than everything since the store started. Reads of keys the store does not
+// hold are not counted, so stores asked for every key do not all report it.
+
+const (
+	// hotKeysDepth and hotKeysWidth size the sketch: each access is counted
+	// in one cell of each row, and a key's count is the least of its cells.
+	hotKeysDepth = 4
+	hotKeysWidth = 2048
+	// MaxHotKeys is how many of the most counted keys are kept, and so the
+	// most /hotkeys reports.
+	MaxHotKeys = 100
+	// hotKeysHalfLife is how often the counts are halved.
+	hotKeysHalfLife = time.Minute
+	// DefaultHotKeysLimit is how many keys /hotkeys reports unless asked.
+	DefaultHotKeysLimit = 10
+)
+
+// hotKeys is the store's access sketch and its most counted keys.
+type hotKeys struct {
+	mu        sync.Mutex
+	seed      maphash.Seed
+	cells     [hotKeysDepth][hotKeysWidth]uint32
+	top       map[string]uint64
+	total     uint64
+	nextDecay time.Time
+}
+
+// observe counts an access to each of keys.
+func (h *hotKeys) observe(now time.Time, keys ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.catchUp(now)
+	for _, key := range keys {
+		h.total++
+		h.track(key, h.add(key))
+	}
+}
+
+// catchUp halves the counts once for every half-life passed by now. h.mu
+// must be held.
+func (h *hotKeys) catchUp(now time.Time) {
+	if h.top == nil {
+		h.seed = maphash.MakeSeed()
+		h.top = make(map[string]uint64, MaxHotKeys)
+		h.nextDecay = now.Add(hotKeysHalfLife)
+	}
+	for !now.Before(h.nextDecay) {
+		h.decay()
+		h.nextDecay = h.nextDecay.Add(hotKeysHalfLife)
+		if h.total == 0 {
+			// Nothing left to halve; skip the idle half-lives at once
+			h.nextDecay = now.Add(hotKeysHalfLife)
+		}
+	}
+}
+
+// add counts key in the sketch and returns its estimated count.
+func (h *hotKeys) add(key string) uint64 {
+	sum := maphash.String(h.seed, key)
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	count := uint32(0)
+	for row := range h.cells {
+		cell := &h.cells[row][(h1+uint32(row)*h2)%hotKeysWidth]
+		if *cell < ^uint32(0) {
+			*cell++
+		}
+		if row == 0 || *cell < count {
+			count = *cell
+		}
+	}
+	return uint64(count)
+}
+
+// track keeps key among the most counted if its count is high enough,
+// dropping the least counted key to make room.
+func (h *hotKeys) track(key string, count uint64) {
+	if _, ok := h.top[key]; ok || len(h.top) < MaxHotKeys {
+		h.top[key] = count
+		return
+	}
+	least, leastCount := "", uint64(0)
+	for k, c := range h.top {
+		if least == "" || c < leastCount {
+			least, leastCount = k, c
+		}
+	}
+	if count > leastCount {
+		delete(h.top, least)
+		h.top[key] = count
+	}
+}
+
+// decay halves every count, dropping the tracked keys it brings to zero.
+func (h *hotKeys) decay() {
+	for row := range h.cells {
+		for i := range h.cells[row] {
+			h.cells[row][i] /= 2
+		}
+	}
+	for key, count := range h.top {
+		if count /= 2; count == 0 {
+			delete(h.top, key)
+		} else {
+			h.top[key] = count
+		}
+	}
+	h.total /= 2
+}
+
+// HotKey is a key and its approximate recent access count.
+type HotKey struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	// Share is the key's part of the store's accesses.
+	Share float64 `json:"share"`
+}
+
+// HotKeysReport is the response of a store's GET /hotkeys.
+type HotKeysReport struct {
+	// Total is the store's recent accesses, halved with the counts.
+	Total    uint64   `json:"total"`
+	HalfLife Duration `json:"half_life"`
+	Keys     []HotKey `json:"keys"`
+}
+
+// HotKeys reports the limit keys accessed most often recently, most
+// accessed first.
+func (s *KVStore) HotKeys(limit int) HotKeysReport {
+	h := &s.hot
+	h.mu.Lock()
+	h.catchUp(time.Now())
+	report := HotKeysReport{Total: h.total, HalfLife: Duration(hotKeysHalfLife), Keys: make([]HotKey, 0, len(h.top))}
+	for key, count := range h.top {
+		report.Keys = append(report.Keys, HotKey{Key: key, Count: count})
+	}
+	h.mu.Unlock()
+
+	sort.Slice(report.Keys, func(i, j int) bool {
+		a, b := report.Keys[i], report.Keys[j]
+		return a.Count > b.Count || a.Count == b.Count && a.Key < b.Key
+	})
+	if limit > 0 && len(report.Keys) > limit {
+		report.Keys = report.Keys[:limit]
+	}
+	for i := range report.Keys {
+		if report.Total > 0 {
+			report.Keys[i].Share = min(float64(report.Keys[i].Count)/float64(report.Total), 1)
+		}
+	}
+	return report
+}
+
+// noteAccess counts reads or writes of keys made by clients.
+func (s *KVStore) noteAccess(keys ...string) {
+	if len(keys) > 0 {
+		s.hot.observe(time.Now(), keys...)
+	}
+}
+
+// HotKeysHandler: GET /hotkeys?limit=<n>
+// Reports the keys read and written most often recently, with approximate
+// counts; limit defaults to 10 and is at most 100.
+func (h *KVStoreHandler) HotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, err := HotKeysLimit(r)
+	if err != nil {
+		httpapi.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jsonResponse(w, h.kvstore.HotKeys(limit))
+}
+
+// HotKeysLimit reads the limit parameter of a /hotkeys request.
+func HotKeysLimit(r *http.Request) (int, error) {
+	limit := DefaultHotKeysLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > MaxHotKeys {
+			return 0, fmt.Errorf("limit must be a number from 1 to %d", MaxHotKeys)
+		}
+		limit = n
+	}
+	return limit, nil
+}
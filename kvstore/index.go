@@ -0,0 +1,262 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/httpapi"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrIndexNotFound is returned when querying or dropping an index the store does not have.
+	ErrIndexNotFound = errors.New("index not found")
+	// ErrIndexExists is returned when creating an index under a name taken by a different one.
+	ErrIndexExists = errors.New("an index with this name but another field exists")
+)
+
+// IndexSpec describes a secondary index. With no Field the index is on the
+// whole value; otherwise the value is read as a JSON object and indexed on
+// Field, a dot-separated path such as "user.email". Values that are not JSON
+// objects or lack the field are left out of the index.
+type IndexSpec struct {
+	Name  string `json:"name"`
+	Field string `json:"field,omitempty"`
+}
+
+// IndexInfo describes an index and the number of keys it covers.
+type IndexInfo struct {
+	IndexSpec
+	Keys int `json:"keys"`
+}
+
+// secondaryIndex maps indexed values to the keys holding them.
+type secondaryIndex struct {
+	spec    IndexSpec
+	entries map[string]map[string]struct{} // indexed value -> keys
+	byKey   map[string]string              // key -> indexed value
+}
+
+func newSecondaryIndex(spec IndexSpec) *secondaryIndex {
+	return &secondaryIndex{
+		spec:    spec,
+		entries: make(map[string]map[string]struct{}),
+		byKey:   make(map[string]string),
+	}
+}
+
+// extract returns what value is indexed under, and false if it is not indexed.
+func (idx *secondaryIndex) extract(value string) (string, bool) {
+	if idx.spec.Field == "" {
+		return value, true
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(value), &doc); err != nil {
+		return "", false
+	}
+	for _, part := range strings.Split(idx.spec.Field, ".") {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if doc, ok = obj[part]; !ok {
+			return "", false
+		}
+	}
+	switch v := doc.(type) {
+	case string:
+		return v, true
+	case nil, map[string]interface{}, []interface{}:
+		return "", false
+	default:
+		// Numbers and booleans are indexed as written in JSON
+		raw, _ := json.Marshal(v)
+		return string(raw), true
+	}
+}
+
+func (idx *secondaryIndex) set(key, value string) {
+	idx.remove(key)
+	indexed, ok := idx.extract(value)
+	if !ok {
+		return
+	}
+	keys := idx.entries[indexed]
+	if keys == nil {
+		keys = make(map[string]struct{})
+		idx.entries[indexed] = keys
+	}
+	keys[key] = struct{}{}
+	idx.byKey[key] = indexed
+}
+
+func (idx *secondaryIndex) remove(key string) {
+	indexed, ok := idx.byKey[key]
+	if !ok {
+		return
+	}
+	delete(idx.byKey, key)
+	delete(idx.entries[indexed], key)
+	if len(idx.entries[indexed]) == 0 {
+		delete(idx.entries, indexed)
+	}
+}
+
+// updateIndexes keeps the indexes in step with a mutation. s.mu must be held.
+func (s *KVStore) updateIndexes(op, key, value string) {
+	for name, idx := range s.indexes {
+		switch op {
+		case OpSet:
+			idx.set(key, value)
+		case OpDelete, OpExpire:
+			idx.remove(key)
+		case OpReset:
+			s.indexes[name] = s.buildIndex(idx.spec)
+		}
+	}
+}
+
+// buildIndex indexes the keys held. s.mu must be held.
+func (s *KVStore) buildIndex(spec IndexSpec) *secondaryIndex {
+	return indexData(spec, s.data)
+}
+
+// indexData builds an index of data.
+func indexData(spec IndexSpec, data *dataMap) *secondaryIndex {
+	idx := newSecondaryIndex(spec)
+	for key, value := range data.all() {
+		idx.set(key, value)
+	}
+	return idx
+}
+
+// CreateIndex adds a secondary index and builds it from the keys held.
+// Creating an index that already exists with the same field does nothing.
+func (s *KVStore) CreateIndex(spec IndexSpec) error {
+	if spec.Name == "" {
+		return errors.New("index name cannot be empty")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idx, exists := s.indexes[spec.Name]; exists {
+		if idx.spec != spec {
+			return fmt.Errorf("%w: %s is on %q", ErrIndexExists, spec.Name, idx.spec.Field)
+		}
+		return nil
+	}
+	s.indexes[spec.Name] = s.buildIndex(spec)
+	s.logger.Info("index created", "index", spec.Name, "field", spec.Field, "keys", len(s.indexes[spec.Name].byKey))
+	return nil
+}
+
+// DropIndex removes a secondary index.
+func (s *KVStore) DropIndex(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.indexes[name]; !exists {
+		return ErrIndexNotFound
+	}
+	delete(s.indexes, name)
+	s.logger.Info("index dropped", "index", name)
+	return nil
+}
+
+// Indexes lists the store's secondary indexes by name.
+func (s *KVStore) Indexes() []IndexInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	infos := make([]IndexInfo, 0, len(s.indexes))
+	for _, idx := range s.indexes {
+		infos = append(infos, IndexInfo{IndexSpec: idx.spec, Keys: len(idx.byKey)})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Query returns, in key order, up to limit pairs after the key after whose
+// value the named index holds under value (limit <= 0 means no limit).
+func (s *KVStore) Query(index, value, after string, limit int) (ScanResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	idx, exists := s.indexes[index]
+	if !exists {
+		return ScanResult{}, ErrIndexNotFound
+	}
+	now := time.Now()
+	keys := make([]string, 0, len(idx.entries[value]))
+	for key := range idx.entries[value] {
+		if key > after && !s.expiredLocked(key, now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := ScanResult{Items: []KeyValue{}}
+	for _, key := range keys {
+		if limit > 0 && len(result.Items) >= limit {
+			result.More = true
+			break
+		}
+		value, _ := s.data.get(key)
+		result.Items = append(result.Items, KeyValue{Key: key, Value: value})
+	}
+	return result, nil
+}
+
+// IndexesHandler: GET /indexes, POST /indexes {"name": "email", "field": "email"}, DELETE /indexes?name=email
+// Lists, creates or drops the store's secondary indexes.
+func (h *KVStoreHandler) IndexesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, h.kvstore.Indexes())
+	case http.MethodPost:
+		var spec IndexSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil || spec.Name == "" {
+			httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := h.kvstore.CreateIndex(spec); err != nil {
+			httpapi.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		jsonResponse(w, spec)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if err := h.kvstore.DropIndex(name); err != nil {
+			httpapi.Error(w, "Index not found: "+name, http.StatusNotFound)
+			return
+		}
+		jsonResponse(w, map[string]string{"message": "Index dropped: " + name})
+	default:
+		httpapi.Error(w, "Only GET, POST and DELETE are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// QueryHandler: GET /query?index=email&value=<v>&after=<key>&limit=<n>
+// Returns the pairs whose value the index holds under v, in key order.
+func (h *KVStoreHandler) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	limit := 0
+	if limitStr := query.Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed < 0 {
+			httpapi.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	result, err := h.kvstore.Query(query.Get("index"), query.Get("value"), query.Get("after"), limit)
+	if err != nil {
+		httpapi.Error(w, "Index not found: "+query.Get("index"), http.StatusNotFound)
+		return
+	}
+	jsonResponse(w, result)
+}
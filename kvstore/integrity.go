@@ -0,0 +1,321 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/httpapi"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Integrity self-check: a starting store checks what it has on disk before
+// serving it. Its snapshot is checked against the checksum and key count
+// written alongside, and every peer backup it holds against its checksum.
+// A corrupt snapshot is set aside and the store starts empty, reporting
+// itself corrupt so the broker routes nothing to it and has it recover its
+// data from the peer holding its backup. A corrupt peer backup is set aside
+// too, and taken again by the next backup. Stores keep no write-ahead log,
+// so there is nothing else to check.
+
+// ErrSnapshotCorrupt is returned when a snapshot cannot be decoded or does
+// not match the checksum or key count written with it.
+var ErrSnapshotCorrupt = errors.New("snapshot is corrupt")
+
+// ErrNotCorrupt is returned when asked to recover a store whose data is
+// intact, unless forced.
+var ErrNotCorrupt = errors.New("store data is not corrupt")
+
+// ErrRecovering is returned when asked to recover a store that already is.
+var ErrRecovering = errors.New("store is already recovering")
+
+// Integrity statuses.
+const (
+	IntegrityOK = "ok"
+	// IntegrityDegraded is a store whose own data is intact but which set
+	// aside a corrupt peer backup.
+	IntegrityDegraded   = "degraded"
+	IntegrityCorrupt    = "corrupt"
+	IntegrityRecovering = "recovering"
+	IntegrityRecovered  = "recovered"
+)
+
+// Integrity is the outcome of a store's startup self-check, and of its
+// recovery if its snapshot was corrupt.
+type Integrity struct {
+	Status  string    `json:"status"`
+	Checked time.Time `json:"checked"`
+	// Snapshot is "verified", "unverified" for one written before
+	// checksums, "none" or "corrupt".
+	Snapshot  string     `json:"snapshot"`
+	Problems  []string   `json:"problems,omitempty"`
+	Recovered *time.Time `json:"recovered,omitempty"`
+}
+
+// integrityState is the store's current Integrity.
+type integrityState struct {
+	mu     sync.Mutex
+	report Integrity
+}
+
+// Integrity returns the outcome of the store's self-check; a store that ran
+// none reports IntegrityOK.
+func (s *KVStore) Integrity() Integrity {
+	s.integrity.mu.Lock()
+	defer s.integrity.mu.Unlock()
+	report := s.integrity.report
+	if report.Status == "" {
+		report.Status = IntegrityOK
+	}
+	report.Problems = append([]string(nil), report.Problems...)
+	return report
+}
+
+// Corrupt reports whether the store started from corrupt data and has not
+// recovered yet.
+func (s *KVStore) Corrupt() bool {
+	status := s.Integrity().Status
+	return status == IntegrityCorrupt || status == IntegrityRecovering
+}
+
+// snapshotMeta is the checksum and key count written with a snapshot.
+type snapshotMeta struct {
+	// File is the name of the snapshot file, without its directory.
+	File     string    `json:"file"`
+	Saved    time.Time `json:"saved"`
+	Keys     int       `json:"keys"`
+	Checksum string    `json:"checksum"`
+	// JournalSeq is the last line of the journal the snapshot holds.
+	JournalSeq uint64 `json:"journal_seq,omitempty"`
+}
+
+// snapshotMetaPath is the metadata file of the snapshot at path.
+func snapshotMetaPath(path string) string {
+	return snapshotBase(path) + ".snapshot.meta.json"
+}
+
+// readSnapshotMeta returns the metadata written with the snapshot at path,
+// or nil if there is none, as for a snapshot from before checksums.
+func readSnapshotMeta(path string) *snapshotMeta {
+	data, err := os.ReadFile(snapshotMetaPath(path))
+	if err != nil {
+		return nil
+	}
+	var meta snapshotMeta
+	if err := json.Unmarshal(data, &meta); err != nil || meta.File != filepath.Base(path) {
+		return nil
+	}
+	return &meta
+}
+
+// writeSnapshotMeta writes the metadata of the snapshot at path, through a
+// temporary file. fileMu must be held.
+func writeSnapshotMeta(path string, meta snapshotMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileSynced(snapshotMetaPath(path), data)
+}
+
+// setAside renames a corrupt file, so it is neither loaded again nor
+// overwritten, and returns its new name.
+func setAside(path string) string {
+	aside := path + ".corrupt"
+	if err := os.Rename(path, aside); err != nil {
+		return path
+	}
+	return aside
+}
+
+// LoadChecked loads the snapshot at path, as the store starts, checking it
+// against its checksum, then checks the peer backups held. A corrupt
+// snapshot is set aside and the store starts empty, reporting itself corrupt
+// until Recover. The error is for failing to read what is there.
+func (s *KVStore) LoadChecked(path string) (Integrity, error) {
+	report := Integrity{Status: IntegrityOK, Snapshot: "none"}
+	if fileExists(path) {
+		report.Snapshot = "unverified"
+		if readSnapshotMeta(path) != nil {
+			report.Snapshot = "verified"
+		}
+	}
+	err := s.LoadFromDisk(path)
+	if errors.Is(err, ErrSnapshotCorrupt) {
+		s.fileMu.Lock()
+		aside := setAside(path)
+		os.Remove(snapshotMetaPath(path))
+		s.fileMu.Unlock()
+		s.logger.Error("snapshot is corrupt, starting empty until recovered from a peer", "file", path, "set_aside", aside, "err", err)
+		report.Status, report.Snapshot = IntegrityCorrupt, "corrupt"
+		report.Problems = append(report.Problems, fmt.Sprintf("snapshot %s: %v", filepath.Base(path), err))
+	} else if err != nil {
+		return report, err
+	}
+
+	for _, problem := range s.checkPeerBackups() {
+		report.Problems = append(report.Problems, problem)
+		if report.Status == IntegrityOK {
+			report.Status = IntegrityDegraded
+		}
+	}
+	report.Checked = time.Now()
+	s.integrity.mu.Lock()
+	s.integrity.report = report
+	s.integrity.mu.Unlock()
+	return report, nil
+}
+
+// checkPeerBackups reads every peer backup held, setting aside those that
+// do not match their checksum, and returns what was wrong with them.
+func (s *KVStore) checkPeerBackups() []string {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	backups, err := s.readPeerBackups()
+	if err != nil {
+		return []string{fmt.Sprintf("peer backups: %v", err)}
+	}
+	var problems []string
+	for _, backup := range backups {
+		_, err := readPeerBackupData(backup)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		aside := setAside(backup.path)
+		os.Rename(metaPath(backup.path), metaPath(backup.path)+".corrupt")
+		s.logger.Error("peer backup is corrupt, set aside until taken again", "peer", backup.meta.Peer, "file", backup.path, "set_aside", aside, "err", err)
+		problems = append(problems, fmt.Sprintf("backup of %s: %v", backup.meta.Peer, err))
+	}
+	return problems
+}
+
+// startRecovery marks the store recovering and returns its status before.
+// It returns ErrNotCorrupt for a store whose data is intact, unless force is
+// set.
+func (s *KVStore) startRecovery(force bool) (string, error) {
+	s.integrity.mu.Lock()
+	defer s.integrity.mu.Unlock()
+	was := s.integrity.report.Status
+	if was == "" {
+		was = IntegrityOK
+	}
+	switch {
+	case was == IntegrityRecovering:
+		return was, ErrRecovering
+	case was != IntegrityCorrupt && !force:
+		return was, ErrNotCorrupt
+	}
+	s.integrity.report.Status = IntegrityRecovering
+	return was, nil
+}
+
+// recover replaces the data of a store that started from a corrupt snapshot
+// with the backup its peer holds at holder (host:port). With no holder, or
+// none holding a backup, the store keeps serving the empty data it started
+// with. With force, the data of a store whose data was intact is replaced by
+// the backup however old it is, as for a store that lost its disk, and it is
+// ErrNoPeerBackup if there is none. was is the status before startRecovery;
+// LoadStatus reports the progress.
+func (s *KVStore) recover(ctx context.Context, holder string, force bool, was string) error {
+	loaded := false
+	var err error
+	if holder != "" {
+		loaded, err = s.pullBackup(ctx, holder, force)
+	}
+
+	s.integrity.mu.Lock()
+	defer s.integrity.mu.Unlock()
+	report := &s.integrity.report
+	if err == nil && !loaded && was != IntegrityCorrupt {
+		err = ErrNoPeerBackup
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to recover from %q: %w", holder, err)
+		report.Status = was
+		report.Problems = append(report.Problems, err.Error())
+		return err
+	}
+	now := time.Now()
+	report.Status, report.Recovered = IntegrityRecovered, &now
+	if !loaded {
+		report.Problems = append(report.Problems, "no peer held a backup to recover from; the store started empty")
+	}
+	return nil
+}
+
+// RecoverRequest is the body of a store's POST /recover.
+type RecoverRequest struct {
+	// Holder is the address of the store holding the backup of this
+	// store's data; empty if there is none.
+	Holder string `json:"holder"`
+	// Force recovers a store whose data is intact, replacing it.
+	Force bool `json:"force,omitempty"`
+}
+
+// RecoveryStatus is the response of a store's GET /recover: its integrity
+// and the progress of loading the backup it recovers from.
+type RecoveryStatus struct {
+	Integrity Integrity  `json:"integrity"`
+	Load      LoadStatus `json:"load"`
+}
+
+// OnRecovery sets fn to be called with true as the store starts recovering
+// from its peer, and with false once it may serve again: it recovered, or a
+// forced recovery of intact data failed. It is used, e.g., to tell the
+// broker to route nothing to the store meanwhile.
+func (h *KVStoreHandler) OnRecovery(fn func(recovering bool)) {
+	h.recovery = fn
+}
+
+// RecoverHandler: GET /recover, POST /recover { "holder": "host:port", "force": false }
+// Sent by the broker to a store reporting a corrupt snapshot, or to any store with force: loads the backup of its
+// data from the holder in the background; 409 if its data is intact or it is already recovering. GET reports the
+// progress.
+func (h *KVStoreHandler) RecoverHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, RecoveryStatus{Integrity: h.kvstore.Integrity(), Load: h.kvstore.LoadStatus()})
+		return
+	case http.MethodPost:
+	default:
+		httpapi.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RecoverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	was, err := h.kvstore.startRecovery(req.Force)
+	if err != nil {
+		httpapi.Error(w, "Store is "+was+": "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	// Route nothing here, and refuse to be backed up, until the backup is
+	// loaded
+	h.SetWarming(true)
+	if h.recovery != nil {
+		h.recovery(true)
+	}
+	h.kvstore.tasks.Go(func(ctx context.Context) {
+		if err := h.kvstore.recover(ctx, req.Holder, req.Force, was); err != nil {
+			h.logger.Error("failed to recover from peer", "holder", req.Holder, "err", err)
+			if h.kvstore.Corrupt() {
+				return // still routed nothing; the broker asks again
+			}
+		} else {
+			h.logger.Info("recovered from peer", "holder", req.Holder)
+		}
+		h.SetWarming(false)
+		if h.recovery != nil {
+			h.recovery(false)
+		}
+	})
+	w.WriteHeader(http.StatusAccepted)
+	jsonResponse(w, map[string]string{"status": IntegrityRecovering})
+}
@@ -0,0 +1,286 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kv/httpapi"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// journal is the file the store appends the keys of durably acknowledged
+// writes to, so a durable write costs one line and an fsync rather than a
+// snapshot of the whole store. Each snapshot drops the lines it holds.
+type journal struct {
+	mu   sync.Mutex
+	file *os.File // opened by the first append
+	size int64    // of the file, as appended to
+	seq  uint64   // of the last line appended
+}
+
+// journalEntry is a line of the journal: a key as it was when the line was
+// appended.
+type journalEntry struct {
+	Seq     uint64     `json:"seq"`
+	Key     string     `json:"key"`
+	Value   *string    `json:"value,omitempty"` // nil if the key was deleted
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// journalMark is where a snapshot froze the data: the lines before it are
+// in the snapshot.
+type journalMark struct {
+	size int64
+	seq  uint64
+}
+
+// journalPath is the store's journal file.
+func (s *KVStore) journalPath() string {
+	return s.DataPath(s.Name + ".journal.jsonl")
+}
+
+// Journal appends the keys as they are now to the store's journal and
+// returns once it is fsynced, so their values survive a crash before the
+// next snapshot. A key that is deleted is journaled as deleted.
+func (s *KVStore) Journal(keys ...string) error {
+	j := &s.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		file, err := os.OpenFile(s.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open journal: %w", err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to open journal: %w", err)
+		}
+		j.file, j.size = file, info.Size()
+	}
+
+	// Read under j.mu, so no snapshot freezes the data between reading a
+	// key and appending it
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	s.mu.RLock()
+	for _, key := range keys {
+		j.seq++
+		entry := journalEntry{Seq: j.seq, Key: key}
+		if value, ok := s.data.get(key); ok {
+			entry.Value = &value
+			if at, ok := s.expiry[key]; ok {
+				entry.Expires = &at
+			}
+		}
+		enc.Encode(entry)
+	}
+	s.mu.RUnlock()
+
+	n, err := j.file.Write(buf.Bytes())
+	j.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to append to journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	return nil
+}
+
+// mark returns where the journal is as a snapshot freezes the data. j.mu
+// must be held.
+func (j *journal) mark() journalMark {
+	return journalMark{size: j.size, seq: j.seq}
+}
+
+// trimJournal drops the lines before mark, which a snapshot now on disk
+// holds, keeping those appended while it was saved. fileMu must be held.
+func (s *KVStore) trimJournal(mark journalMark) error {
+	j := &s.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	path := s.journalPath()
+	if mark.size == 0 {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(mark.size, io.SeekStart); err != nil {
+		return err
+	}
+	tail, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSynced(path, tail); err != nil {
+		return fmt.Errorf("failed to trim journal: %w", err)
+	}
+	// Appends go on in the new file
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	return nil
+}
+
+// replayJournal applies the journal's lines after seq to data and expiry,
+// the store's own snapshot as loaded, and returns how many it applied. The
+// journal goes on numbering its lines from the last one it holds.
+func (s *KVStore) replayJournal(seq uint64, data map[string]string, expiry map[string]time.Time) (int, error) {
+	file, err := os.Open(s.journalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read journal: %w", err)
+	}
+	var applied int
+	var read int64 // up to the end of the last whole line
+	last := seq
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		// A line cut short by a crash, even by its newline alone, was
+		// never acknowledged
+		var entry journalEntry
+		end := read + int64(len(scanner.Bytes())) + 1
+		if end > info.Size() || json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			break
+		}
+		read = end
+		last = max(last, entry.Seq)
+		if entry.Seq <= seq {
+			continue
+		}
+		delete(expiry, entry.Key)
+		if entry.Value == nil {
+			delete(data, entry.Key)
+		} else {
+			data[entry.Key] = *entry.Value
+			if entry.Expires != nil {
+				expiry[entry.Key] = *entry.Expires
+			}
+		}
+		applied++
+	}
+	if err := scanner.Err(); err != nil {
+		return applied, fmt.Errorf("failed to read journal: %w", err)
+	}
+	if read < info.Size() {
+		// Cut off, so lines appended later are not run into it
+		s.logger.Warn("journal ends in a partial line, dropping it", "file", file.Name())
+		if err := os.Truncate(file.Name(), read); err != nil {
+			return applied, fmt.Errorf("failed to truncate journal: %w", err)
+		}
+	}
+	// The next snapshot holds what was replayed, and drops it
+	s.journal.mu.Lock()
+	s.journal.seq = max(s.journal.seq, last)
+	if s.journal.file == nil {
+		s.journal.size = read
+	}
+	s.journal.mu.Unlock()
+	return applied, nil
+}
+
+// loadJournal starts a store that has no snapshot from its journal. fileMu
+// must be held.
+func (s *KVStore) loadJournal() error {
+	data, expiry := make(map[string]string), make(map[string]time.Time)
+	applied, err := s.replayJournal(0, data, expiry)
+	if err != nil || applied == 0 {
+		return err
+	}
+	prepared := s.prepareData(data, expiry)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaceData(prepared)
+	s.logger.Info("data loaded from journal", "file", s.journalPath(), "keys", len(data))
+	return nil
+}
+
+// writeFileSynced replaces the file at path with data through a temporary
+// file, fsyncing it and its directory, so a crash leaves either the old file
+// or the new one.
+func writeFileSynced(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory, so the files just renamed into it stay
+// renamed after a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// JournalRequest names the keys a store journals.
+type JournalRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// JournalHandler: POST /journal {"keys": ["key1", ...]}
+// Appends the keys as they are now to the store's journal and fsyncs it; the broker sends it for
+// writes made with ack=durable.
+func (h *KVStoreHandler) JournalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req JournalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Keys) == 0 {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := h.kvstore.Journal(req.Keys...); err != nil {
+		h.logger.Error("failed to journal keys", "keys", len(req.Keys), "err", err)
+		httpapi.Error(w, "Failed to journal keys", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]int{"journaled": len(req.Keys)})
+}
@@ -1,72 +1,207 @@
 package kvstore
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
+	"kv/codec"
+	"kv/lifecycle"
+	"kv/metrics"
+	"kv/qos"
+	"kv/transport"
+	"log/slog"
+	"maps"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // KVStore represents the in-memory key-value store.
 type KVStore struct {
 	mu        sync.RWMutex
-	data      map[string]string
+	data      *dataMap
+	expiry    map[string]time.Time // deadlines of keys with a TTL
+	revs      map[string]uint64    // revisions of the keys written since the data was loaded
+	loadedRev uint64               // revision of the other keys, taken as the data was loaded
 	Name      string
 	IPAddress string
-	PeerIP    string
-}
+	PeerIP    string    // address of the ring successor
+	peers     []PeerRef // stores backed up, the successor first; guarded by mu
 
-// LoadAndMergeFromDisk loads data from a file and merges it with the existing in-memory key-value store.
-func (s *KVStore) LoadAndMergeFromDisk() error {
-	// Open the snapshot file
-	filename := "peerof" + s.Name + ".snapshot.json"
-	file, err := os.Open(filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("Snapshot file does not exist. No data to merge.")
-			return nil
-		}
-		return fmt.Errorf("failed to open snapshot file: %w", err)
-	}
-	defer file.Close()
+	changes     *changeLog                 // guarded by mu
+	tombstones  tombstoneState             // guarded by mu
+	trash       trashState                 // deleted keys kept for undelete; guarded by mu
+	bloom       bloomState                 // filter of the keys held; guarded by mu
+	indexes     map[string]*secondaryIndex // guarded by mu
+	defaultTTL  time.Duration              // given to keys written; guarded by mu
+	compaction  compactionState            // guarded by mu
+	events      *EventBus                  // mutations are published under mu
+	eventsTotal *metrics.CounterVec
+	compactions *metrics.CounterVec
 
-	// Deserialize the JSON data into a temporary map
-	var data map[string]string
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&data)
-	if err != nil {
-		return fmt.Errorf("failed to decode JSON data: %w", err)
-	}
+	dataDir          string      // where snapshot files are kept; the working directory if empty
+	codec            codec.Codec // format of snapshots and peer backups
+	logger           *slog.Logger
+	transport        transport.Transport // reaches the peer for backups
+	metrics          *metrics.Registry
+	snapshotDuration *metrics.HistogramVec
+	tombstonesPurged *metrics.CounterVec
+	startedAt        time.Time
+	lastPeerBackup   time.Time        // guarded by mu
+	snapshotTime     time.Time        // when the loaded snapshot was saved; guarded by mu
+	replica          *replication     // set if the store is a read replica
+	background       *qos.Limiter     // paces snapshots, backups served and handoffs
+	load             loadProgress     // progress of the current or last snapshot load
+	cache            *cacheOrigin     // set if the store is in cache mode
+	migration        *Migration       // the current or last handoff; guarded by mu
+	tasks            *lifecycle.Group // snapshots, expiry, compaction and replication loops
+	ops              rateMeter        // reads and writes, for the load report
+	hot              hotKeys          // accesses by key, for /hotkeys
+	copies           hotCopies        // copies of other stores' hot keys, for the broker to spread reads
+	integrity        integrityState   // outcome of the startup self-check
 
-	// Merge the temporary map with the in-memory store
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	for key, value := range data {
-		s.data[key] = value
-	}
+	// fileMu serializes reading and writing the snapshot and peer backup
+	// files, so a load never sees a half-written file. mu is not held for
+	// file I/O.
+	fileMu sync.Mutex
 
-	fmt.Println("Data successfully loaded and merged from disk:", filename)
-	return nil
+	// dirLock holds the store's lock in its data directory; nil until Lock
+	dirLock *os.File
+
+	// durable lets concurrent callers of SaveDurably share a save
+	durable durableSave
+
+	// journal holds the durably acknowledged writes since the last snapshot
+	journal journal
+
+	// uncleanShutdown is set when the store's previous run did not shut down
+	// cleanly, as found by MarkRunning
+	uncleanShutdown atomic.Bool
+
+	// periodic snapshot state
+	snapMu           sync.Mutex
+	snapshotInterval time.Duration // zero when disabled
+	lastSnapshot     time.Time
+	lastSnapshotErr  error
+	archive          *SnapshotArchive // nil unless periodic snapshots are archived
+	lastArchive      string           // the file last archived to
+	lastArchiveErr   error
+	lastSuccess      time.Time
+	lastFailure      time.Time
 }
 
 // NewKVStore initializes and returns a new KVStore instance.
 func NewKVStore(name string, port string) *KVStore {
-	return &KVStore{
-		data:      make(map[string]string),
+	s := &KVStore{
+		data:      newDataMap(make(map[string]string)),
+		expiry:    make(map[string]time.Time),
+		revs:      make(map[string]uint64),
+		loadedRev: nextRevision(),
 		Name:      name,
 		IPAddress: fmt.Sprintf("localhost:%s", port), // Set correct address format
 		PeerIP:    "",
+		changes:   newChangeLog(DefaultChangeLogSize),
+		indexes:   make(map[string]*secondaryIndex),
+		events:    NewEventBus(),
+		logger:    slog.Default().With("component", "kvstore", "store", name),
+		transport: &http.Client{Timeout: DefaultPeerTimeout},
+		metrics:   metrics.NewRegistry(),
+		startedAt: time.Now(),
+		tasks:     lifecycle.New(),
+		codec:     codec.JSON{},
+	}
+	s.background = qos.NewLimiter(qos.Limit{}, s.metrics, "kvstore")
+	s.rebuildBloom()
+	s.registerMetrics()
+	return s
+}
+
+// SetDataDir sets the directory holding the store's snapshot and peer
+// backup files. Call it before the store is used.
+func (s *KVStore) SetDataDir(dir string) {
+	s.dataDir = dir
+}
+
+// DataPath resolves a snapshot file name against the data directory.
+// Absolute paths are returned unchanged.
+func (s *KVStore) DataPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
 	}
+	return filepath.Join(s.dataDir, name)
+}
+
+// SnapshotPath is the file the store's snapshots are saved to, named after
+// its codec.
+func (s *KVStore) SnapshotPath() string {
+	return snapshotFile(s.DataPath(s.Name), s.codec)
+}
+
+// SetTransport replaces the transport used to reach the peer, e.g. with an
+// in-memory one in tests. Call it before the store is used.
+func (s *KVStore) SetTransport(t transport.Transport) {
+	s.transport = t
+}
+
+// registerMetrics sets up the store's own gauges and histograms.
+func (s *KVStore) registerMetrics() {
+	s.metrics.NewGaugeFunc("kvstore_keys", "Number of keys held in memory.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(s.data.len())
+	})
+	s.metrics.NewGaugeFunc("kvstore_replication_lag_seconds", "Seconds since the last successful peer backup (or since startup if none succeeded yet).", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if s.lastPeerBackup.IsZero() {
+			return time.Since(s.startedAt).Seconds()
+		}
+		return time.Since(s.lastPeerBackup).Seconds()
+	})
+	s.metrics.NewGaugeFunc("kvstore_background_goroutines", "Background loops running: snapshots, expiry, compaction and replication.", func() float64 {
+		return float64(s.tasks.Len())
+	})
+	s.eventsTotal = s.metrics.NewCounterVec("kvstore_events_total", "Mutations published on the event bus, by operation.", "op")
+	s.metrics.NewGaugeFunc("kvstore_event_subscribers", "Open event bus subscriptions, e.g. /watch streams.", func() float64 {
+		return float64(s.events.Subscribers())
+	})
+	s.metrics.NewGaugeFunc("kvstore_map_retained_capacity", "Most keys the store's map held since it was made or compacted; Go maps keep the memory for them.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(s.compaction.capacity)
+	})
+	s.compactions = s.metrics.NewCounterVec("kvstore_compactions_total", "Times the store's map was rebuilt to free the memory of deleted keys.")
+	s.metrics.NewGaugeFunc("kvstore_tombstones", "Tombstones held of keys deleted or expired.", func() float64 {
+		held, _ := s.tombstoneCounts()
+		return float64(held)
+	})
+	s.metrics.NewGaugeFunc("kvstore_tombstones_awaiting_ack", "Tombstones past the horizon still held until every backup holder and replica has acknowledged them.", func() float64 {
+		_, awaiting := s.tombstoneCounts()
+		return float64(awaiting)
+	})
+	s.tombstonesPurged = s.metrics.NewCounterVec("kvstore_tombstones_purged_total", "Tombstones purged once past the horizon and acknowledged.")
+	s.snapshotDuration = s.metrics.NewHistogramVec("kvstore_snapshot_duration_seconds", "Time taken to write a snapshot to disk.", nil, "result")
 }
 
-// SetPeerIP sets the peer IP address for the KVStore.
+// Metrics returns the registry holding this store's metrics.
+func (s *KVStore) Metrics() *metrics.Registry {
+	return s.metrics
+}
+
+// SetPeerIP sets the peer IP address for the KVStore, making it the only
+// store backed up.
 func (s *KVStore) SetPeerIP(PeerIP string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.PeerIP = PeerIP
+	var peers []PeerRef
+	if PeerIP != "" {
+		peers = []PeerRef{{Address: PeerIP}}
+	}
+	s.SetPeers(peers)
 }
 
 // GetPeerIP returns the peer IP address for the KVStore.
@@ -83,41 +218,74 @@ func (s *KVStore) Set(key, value string) error {
 	if key == "" {
 		return errors.New("key cannot be empty")
 	}
-	s.data[key] = value
+	s.data.put(key, value)
+	s.resetExpiryLocked(key, time.Now())
+	s.publish(OpSet, key, value)
 	return nil
 }
 
 // Get retrieves the value associated with the given key.
-// Returns an error if the key does not exist.
+// Returns ErrKeyNotFound if the key does not exist.
 func (s *KVStore) Get(key string) (string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	val, ok := s.data[key]
-	if !ok {
-		return "", errors.New("key not found")
+	val, ok := s.data.get(key)
+	if !ok || s.expiredLocked(key, time.Now()) {
+		return "", ErrKeyNotFound
 	}
 	return val, nil
 }
 
 // Delete removes the key-value pair associated with the given key.
-// Returns an error if the key does not exist.
+// Returns ErrKeyNotFound if the key does not exist.
 func (s *KVStore) Delete(key string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	_, ok := s.data[key]
-	if !ok {
-		return errors.New("key not found")
+	now := time.Now()
+	value, ok := s.data.get(key)
+	if !ok || s.expiredLocked(key, now) {
+		return ErrKeyNotFound
 	}
-	delete(s.data, key)
+	s.data.remove(key)
+	delete(s.expiry, key)
+	s.trashLocked(key, value, now)
+	s.publish(OpDelete, key, "")
 
 	return nil
 }
 
-// PrintData prints the current in-memory data map.
-func (s *KVStore) PrintData() {
+// Stats summarizes the size of a store's data.
+type Stats struct {
+	Keys  int `json:"keys"`
+	Bytes int `json:"bytes"` // sum of key and value lengths
+}
+
+// Stats returns the number of keys held and their total size in bytes.
+func (s *KVStore) Stats() Stats {
+	return s.PrefixStats("")
+}
+
+// Len returns the number of keys held, including expired keys not yet removed.
+func (s *KVStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.data.len()
+}
+
+// PrefixStats is Stats for the keys starting with prefix.
+func (s *KVStore) PrefixStats(prefix string) Stats {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	fmt.Println(s.data)
+	stats := Stats{}
+	now := time.Now()
+	for key, value := range s.data.all() {
+		if !strings.HasPrefix(key, prefix) || s.expiredLocked(key, now) {
+			continue
+		}
+		stats.Keys++
+		stats.Bytes += len(key) + len(value)
+	}
+	return stats
 }
 
 // GetAllData returns a copy of the entire data map.
@@ -127,117 +295,328 @@ func (s *KVStore) GetAllData() map[string]string {
 
 	// Create a copy of the data map to avoid race conditions
 	dataCopy := make(map[string]string)
-	for key, value := range s.data {
-		dataCopy[key] = value
+	now := time.Now()
+	for key, value := range s.data.all() {
+		if !s.expiredLocked(key, now) {
+			dataCopy[key] = value
+		}
 	}
 	return dataCopy
 }
 
-// SaveToDisk saves the in-memory data to a file in JSON format.
+// SaveToDisk saves the in-memory data to a file in the store's codec, paced to the
+// store's background limit.
 func (s *KVStore) SaveToDisk() error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	return s.saveToDisk(saveOptions{paced: true})
+}
+
+// saveOptions are how a snapshot is saved.
+type saveOptions struct {
+	paced bool // paced to the background limit
+	// freezing, if set, is called with s.mu held just before the data is
+	// frozen: every write made before it is in the snapshot.
+	freezing func()
+}
 
-	// Open or create the file for writing
-	filename := s.Name + ".snapshot.json"
-	file, err := os.Create(filename)
+// saveToDisk is SaveToDisk, unpaced unless opts.paced is set.
+func (s *KVStore) saveToDisk(opts saveOptions) (err error) {
+	if s.snapshotDuration != nil {
+		start := time.Now()
+		defer func() {
+			result := "success"
+			if err != nil {
+				result = "error"
+			}
+			s.snapshotDuration.ObserveSince(start, result)
+		}()
+	}
+
+	defer func() {
+		s.snapMu.Lock()
+		s.lastSnapshot, s.lastSnapshotErr = time.Now(), err
+		if err != nil {
+			s.lastFailure = s.lastSnapshot
+		} else {
+			s.lastSuccess = s.lastSnapshot
+		}
+		s.snapMu.Unlock()
+	}()
+
+	// Freeze the data rather than copy it, so writers are neither blocked
+	// while it is written out nor while a copy is taken; their writes are
+	// folded in afterwards. It is frozen under fileMu, so saves land on disk
+	// in the order taken.
+	// The journal is marked with the freeze: its lines before the mark are
+	// in the snapshot.
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	s.journal.mu.Lock()
+	s.mu.Lock()
+	if opts.freezing != nil {
+		opts.freezing()
+	}
+	frozen := s.data
+	data := frozen.freeze()
+	expiry := maps.Clone(s.expiry)
+	mark := s.journal.mark()
+	s.mu.Unlock()
+	s.journal.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		frozen.thaw()
+		s.mu.Unlock()
+	}()
+
+	// Written and fsynced under another name first, so a save that fails
+	// partway, or a crash, leaves the snapshot it replaces as it was
+	filename := s.SnapshotPath()
+	tmp := filename + ".tmp"
+	file, err := os.Create(tmp)
 	if err != nil {
 		return fmt.Errorf("failed to create snapshot file: %w", err)
 	}
+	defer os.Remove(tmp)
 	defer file.Close()
 
-	// Serialize the map to JSON
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(s.data)
-	if err != nil {
-		return fmt.Errorf("failed to encode data to JSON: %w", err)
+	hash := sha256.New()
+	var out io.Writer = file
+	if opts.paced {
+		out = s.background.DiskWriter(context.Background(), "snapshot", file)
+	}
+	if err := s.codec.Encode(io.MultiWriter(out, hash), data, expiry); err != nil {
+		return fmt.Errorf("failed to encode data as %s: %w", s.codec.Name(), err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync snapshot file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot file: %w", err)
+	}
+
+	// The old metadata is removed before the rename, so a crash between
+	// the two leaves a snapshot that loads unverified rather than one
+	// checked against the checksum of the snapshot it replaced.
+	if err := os.Remove(snapshotMetaPath(filename)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove snapshot metadata: %w", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("failed to name snapshot file: %w", err)
+	}
+	if err := syncDir(filepath.Dir(filename)); err != nil {
+		return fmt.Errorf("failed to sync data directory: %w", err)
+	}
+	meta := snapshotMeta{File: filepath.Base(filename), Saved: time.Now(), Keys: len(data), Checksum: checksum(hash.Sum(nil)), JournalSeq: mark.seq}
+	if err := writeSnapshotMeta(filename, meta); err != nil {
+		return fmt.Errorf("failed to write snapshot metadata: %w", err)
+	}
+	removeOtherCodecs(s.DataPath(s.Name), s.codec)
+	if err := s.trimJournal(mark); err != nil {
+		// Its lines are in the snapshot, whose metadata skips them
+		s.logger.Warn("failed to trim journal", "err", err)
 	}
 
-	fmt.Println("Data successfully saved to disk:", filename)
+	s.logger.Debug("data saved to disk", "file", filename)
 	return nil
 }
 
 // LoadFromDisk loads data from a file into the in-memory key-value store.
-func (s *KVStore) LoadFromDisk(filename string) error {
+// The file is decoded and indexed into a new map while the store keeps
+// serving its current data; s.mu is held only to swap the maps. Its
+// progress is reported by LoadStatus. The store's own snapshot is followed
+// by the writes journaled since it was saved.
+func (s *KVStore) LoadFromDisk(filename string) (err error) {
 	// Open the snapshot file
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	own := snapshotBase(filename) == s.DataPath(s.Name)
 	file, err := os.Open(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Println("Snapshot file does not exist. Starting with an empty store.")
+			s.logger.Info("snapshot file does not exist, starting with an empty store", "file", filename)
+			if own {
+				return s.loadJournal()
+			}
 			return nil
 		}
 		return fmt.Errorf("failed to open snapshot file: %w", err)
 	}
 	defer file.Close()
 
-	// Deserialize the JSON data into the map
-	var data map[string]string
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&data)
-	if err != nil {
-		return fmt.Errorf("failed to decode JSON data: %w", err)
+	var size int64
+	var saved time.Time
+	if info, err := file.Stat(); err == nil {
+		size, saved = info.Size(), info.ModTime()
 	}
+	s.load.begin(filename, size)
+	defer func() { s.load.finish(err) }()
 
-	// Update the in-memory store
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.data = data
-
-	fmt.Println("Data successfully loaded from disk:", filename)
-	return nil
-}
-
-func (s *KVStore) RequestPeerBackup(peerURL string) {
-	resp, err := http.Get(peerURL + "/peer-backup")
-	if err != nil {
-		fmt.Println("Error sending request to peer-backup:", err)
-		return
+	// Decode the data into a new map in the codec the file is named for; an
+	// archived snapshot may be in another format or compressed. A snapshot
+	// saved with metadata is checked against it.
+	meta := readSnapshotMeta(filename)
+	hash := sha256.New()
+	var in io.Reader = countingReader{r: file, n: &s.load.bytes}
+	if meta != nil {
+		in = io.TeeReader(in, hash)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Error response from peer-backup:", resp.Status)
-		return
+	data, expiry, err := decodeSnapshot(filename, in, &s.load.keys)
+	if err != nil {
+		if meta != nil {
+			return fmt.Errorf("%w: failed to decode: %v", ErrSnapshotCorrupt, err)
+		}
+		return fmt.Errorf("failed to decode snapshot: %w", err)
 	}
-
-	var data map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		fmt.Println("Error decoding response data:", err)
-		return
+	if meta != nil {
+		// The decoder may leave the end of the file unread
+		io.Copy(hash, in)
+		if sum := checksum(hash.Sum(nil)); sum != meta.Checksum {
+			return fmt.Errorf("%w: checksum %s, saved as %s", ErrSnapshotCorrupt, sum, meta.Checksum)
+		}
+		if len(data) != meta.Keys {
+			return fmt.Errorf("%w: %d keys, saved with %d", ErrSnapshotCorrupt, len(data), meta.Keys)
+		}
 	}
-	peerBackupFileName := "peerof" + s.Name + ".snapshot.json"
-	file, err := os.Create(peerBackupFileName)
-	if err != nil {
-		fmt.Println("Error creating snapshot file:", err)
-		return
+	if own {
+		var seq uint64
+		if meta != nil {
+			seq = meta.JournalSeq
+		}
+		if expiry == nil {
+			expiry = make(map[string]time.Time)
+		}
+		applied, err := s.replayJournal(seq, data, expiry)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			s.logger.Info("journaled writes replayed", "file", s.journalPath(), "writes", applied)
+		}
 	}
-	defer file.Close()
+	s.load.setPhase(LoadIndexing)
+	prepared := s.prepareData(data, expiry)
 
-	if err := json.NewEncoder(file).Encode(data); err != nil {
-		fmt.Println("Error encoding data to snapshot file:", err)
-		return
-	}
+	// Update the in-memory store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaceData(prepared)
+	s.snapshotTime = saved
 
-	fmt.Println("Data successfully saved to peer.snapshot.json")
+	s.logger.Info("data loaded from disk", "file", filename, "keys", len(data))
+	return nil
 }
 
 // StartPeriodicSnapshots starts a goroutine that saves the data to disk periodically.
+// A loop that is already running is replaced, so calling it again changes the
+// interval; calling it with the current interval leaves the loop as it is.
 func (s *KVStore) StartPeriodicSnapshots(interval time.Duration) {
-	go func() {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	if s.snapshotInterval == interval && s.tasks.Running("snapshots") {
+		return
+	}
+	s.snapshotInterval = interval
+	s.tasks.Start("snapshots", func(ctx context.Context) {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
-		filename := s.Name + ".snapshot.json"
-		for range ticker.C {
-			peer_ip := s.GetPeerIP()
-			if peer_ip != "" {
-				s.RequestPeerBackup(fmt.Sprintf("http://%s", peer_ip))
+		filename := s.SnapshotPath()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
 			}
+			s.BackUpPeers()
 			err := s.SaveToDisk()
 			if err != nil {
-				fmt.Println("Error during periodic snapshot:", err)
-			} else {
-				fmt.Println("Periodic snapshot saved to disk:", filename)
+				s.logger.Error("error during periodic snapshot", "err", err)
+				continue
+			}
+			s.logger.Info("periodic snapshot saved to disk", "file", filename)
+			s.snapMu.Lock()
+			archive := s.archive
+			s.snapMu.Unlock()
+			if archive != nil {
+				if err := s.archiveSnapshot(*archive); err != nil {
+					s.logger.Error("error archiving snapshot", "err", err)
+				}
 			}
 		}
-	}()
+	})
+}
+
+// StopPeriodicSnapshots stops the periodic snapshot loop. It reports whether one was running.
+// A snapshot being saved is finished first.
+func (s *KVStore) StopPeriodicSnapshots() bool {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	s.snapshotInterval = 0
+	return s.tasks.Stop("snapshots")
+}
+
+// Close stops the store's background loops and waits for them, ends event
+// subscriptions and saves a final snapshot, so a store that is shutting
+// down loses none of its writes. The running marker is then removed and the
+// data directory unlocked.
+func (s *KVStore) Close() error {
+	// Nothing is paced any more: the store is going away and must not
+	// outlast its shutdown timeout waiting for a snapshot to finish
+	s.background.SetLimit(qos.Limit{})
+	s.tasks.Close()
+	s.events.Close()
+	if err := s.saveToDisk(saveOptions{}); err != nil {
+		return err
+	}
+	s.logger.Info("final snapshot saved to disk", "file", s.SnapshotPath())
+	err := s.markStopped()
+	s.unlock()
+	return err
+}
+
+// SnapshotStatus describes a store's periodic snapshot configuration.
+type SnapshotStatus struct {
+	Enabled         bool       `json:"enabled"`
+	IntervalSeconds float64    `json:"interval_seconds,omitempty"`
+	Codec           string     `json:"codec,omitempty"` // the format snapshots are written in
+	LastSnapshot    *time.Time `json:"last_snapshot,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	// LastSuccess and LastFailure are the times of the last snapshot saved
+	// and the last one that failed.
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	// Archive is where periodic snapshots are also archived, if anywhere;
+	// LastArchive is the file last written there.
+	Archive          *SnapshotArchive `json:"archive,omitempty"`
+	LastArchive      string           `json:"last_archive,omitempty"`
+	LastArchiveError string           `json:"last_archive_error,omitempty"`
+}
+
+// SnapshotStatus reports whether periodic snapshots are running and how the last snapshot went.
+func (s *KVStore) SnapshotStatus() SnapshotStatus {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	status := SnapshotStatus{
+		Enabled:         s.snapshotInterval > 0,
+		IntervalSeconds: s.snapshotInterval.Seconds(),
+		Codec:           s.codec.Name(),
+	}
+	if !s.lastSnapshot.IsZero() {
+		last := s.lastSnapshot
+		status.LastSnapshot = &last
+	}
+	if s.lastSnapshotErr != nil {
+		status.LastError = s.lastSnapshotErr.Error()
+	}
+	if !s.lastSuccess.IsZero() {
+		success := s.lastSuccess
+		status.LastSuccess = &success
+	}
+	if !s.lastFailure.IsZero() {
+		failure := s.lastFailure
+		status.LastFailure = &failure
+	}
+	status.Archive, status.LastArchive = s.archive, s.lastArchive
+	if s.lastArchiveErr != nil {
+		status.LastArchiveError = s.lastArchiveErr.Error()
+	}
+	return status
 }
@@ -0,0 +1,766 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"kv/codec"
+	"kv/httpapi"
+	"kv/logging"
+	"kv/metrics"
+	"kv/version"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func LoadKVStoresConfig(filePath string) ([]KVStoreConfig, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config struct {
+		KVStores []KVStoreConfig `json:"kvstores"`
+	}
+
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return nil, err
+	}
+
+	return config.KVStores, nil
+}
+
+type KVStoreConfig struct {
+	Name      string `json:"name"`
+	IPAddress string `json:"ip_address"`
+}
+
+// KVStoreHandler wraps a store to expose it via HTTP.
+type KVStoreHandler struct {
+	kvstore     *KVStore
+	httpMetrics *metrics.HTTPMetrics
+	logger      *slog.Logger
+
+	// readiness state reported by /readyz
+	registered     atomic.Bool
+	snapshotLoaded atomic.Bool
+	draining       atomic.Bool
+	warming        atomic.Bool
+	restoring      atomic.Bool
+
+	recovery func(recovering bool) // set by OnRecovery
+
+	faults   *faultInjector              // nil unless fault injection is enabled
+	limiter  *httpapi.ConcurrencyLimiter // nil unless LimitConcurrency was called
+	shutdown *shutdownControl            // nil unless the /shutdown endpoint is enabled
+
+	mux    *http.ServeMux
+	router *httpapi.Router
+	hooks  []func(*httpapi.Router) // added by AddRoutes
+	routes sync.Once
+}
+
+func (h *KVStoreHandler) SetHandler(w http.ResponseWriter, r *http.Request) {
+	var requestData map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	key, keyExists := requestData["key"]
+	value, valueExists := requestData["value"]
+	if !keyExists || !valueExists {
+		httpapi.Error(w, "Missing key or value in request body", http.StatusBadRequest)
+		return
+	}
+
+	etag, err := h.kvstore.SetThrough(r.Context(), key, value, PreconditionFrom(r.Header))
+	if errors.Is(err, ErrPreconditionFailed) {
+		httpapi.WriteError(w, http.StatusPreconditionFailed, httpapi.CodePreconditionFailed, "Precondition failed for key: "+key, nil)
+		return
+	} else if errors.Is(err, ErrOrigin) {
+		originError(w, err)
+		return
+	} else if err != nil {
+		httpapi.Error(w, "Failed to set key-value pair", http.StatusInternalServerError)
+		return
+	}
+	h.kvstore.noteAccess(key)
+
+	response := map[string]string{"key": key, "value": value}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ExpireHandler: POST /expire { "key": "...", "seconds": <n> }
+func (h *KVStoreHandler) ExpireHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Key     string `json:"key"`
+		Seconds int    `json:"seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Seconds <= 0 {
+		httpapi.Error(w, "seconds must be positive", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.kvstore.Expire(req.Key, time.Duration(req.Seconds)*time.Second); err != nil {
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeKeyNotFound, "Key not found", nil)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{"key": req.Key, "ttl": req.Seconds})
+}
+
+// TTLHandler: GET /ttl?key=<key>
+// Reports the seconds left before the key expires, or -1 if it has no TTL.
+func (h *KVStoreHandler) TTLHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		httpapi.Error(w, "Missing key parameter", http.StatusBadRequest)
+		return
+	}
+
+	ttl, ok, err := h.kvstore.TTL(key)
+	if err != nil {
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeKeyNotFound, "Key not found", nil)
+		return
+	}
+	seconds := -1
+	if ok {
+		seconds = int(math.Ceil(ttl.Seconds()))
+	}
+	jsonResponse(w, map[string]interface{}{"key": key, "ttl": seconds})
+}
+
+// PersistHandler: POST /persist { "key": "..." }
+func (h *KVStoreHandler) PersistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	had, err := h.kvstore.Persist(req.Key)
+	if err != nil {
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeKeyNotFound, "Key not found", nil)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{"key": req.Key, "persisted": had})
+}
+
+// MGetHandler: POST /mget { "keys": ["<key>", ...] }
+// Responds with the values of the keys this store holds, and their entity tags; missing keys are left out.
+func (h *KVStoreHandler) MGetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	values, etags := h.kvstore.GetManyTagged(req.Keys)
+	h.kvstore.noteAccess(slices.Collect(maps.Keys(values))...)
+	jsonResponse(w, map[string]interface{}{"values": values, "etags": etags})
+}
+
+// MSetHandler: POST /mset[?moved=1] { "pairs": { "<key>": "<value>", ... }, "etags": { "<key>": "<etag>", ... } }
+// moved marks keys moved from another store, which a store in cache mode does not write through to its origin again.
+// etags, sent with moved keys, are the tags the keys had on that store: a key written here since is kept, and listed in "kept".
+func (h *KVStoreHandler) MSetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Pairs map[string]string `json:"pairs"`
+		ETags map[string]string `json:"etags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	moved := r.URL.Query().Get("moved") == "1"
+	var kept []string
+	setMany := func() error { return h.kvstore.SetManyThrough(r.Context(), req.Pairs) }
+	if moved {
+		setMany = func() (err error) {
+			kept, err = h.kvstore.SetManyNewer(req.Pairs, req.ETags)
+			return err
+		}
+	}
+	if err := setMany(); errors.Is(err, ErrOrigin) {
+		originError(w, err)
+		return
+	} else if err != nil {
+		httpapi.Error(w, "Failed to set key-value pairs: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !moved {
+		h.kvstore.noteAccess(slices.Collect(maps.Keys(req.Pairs))...)
+	}
+	response := map[string]interface{}{"count": len(req.Pairs) - len(kept)}
+	if len(kept) > 0 {
+		response["kept"] = kept
+	}
+	jsonResponse(w, response)
+}
+
+// MDeleteHandler: POST /mdelete { "pairs": { "<key>": "<value>", ... } }
+// Deletes each key that still has the given value, so a key written since is kept. Responds with the count deleted.
+func (h *KVStoreHandler) MDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Pairs map[string]string `json:"pairs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	jsonResponse(w, map[string]int{"count": h.kvstore.DeleteUnchanged(req.Pairs)})
+}
+
+// DeletePrefixHandler: POST /delete-prefix?dry_run=<bool> { "prefix": "..." }
+// Deletes every key starting with prefix and reports how many; a dry run only counts them.
+func (h *KVStoreHandler) DeletePrefixHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Prefix string `json:"prefix"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	dryRun, err := httpapi.DryRun(r)
+	if err != nil {
+		httpapi.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dryRun {
+		jsonResponse(w, map[string]int{"count": h.kvstore.PrefixStats(req.Prefix).Keys})
+		return
+	}
+	jsonResponse(w, map[string]int{"count": h.kvstore.DeletePrefix(req.Prefix)})
+}
+
+// ScanHandler: GET /scan?prefix=<p>&after=<key>&limit=<n>
+func (h *KVStoreHandler) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 0
+	if limitStr := query.Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed < 0 {
+			httpapi.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	jsonResponse(w, h.kvstore.Scan(query.Get("prefix"), query.Get("after"), limit))
+}
+
+func (h *KVStoreHandler) GetHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		httpapi.Error(w, "Missing key parameter", http.StatusBadRequest)
+		return
+	}
+
+	value, etag, err := h.kvstore.GetTagged(key)
+	if err != nil && r.Header.Get(NoReadThroughHeader) == "" {
+		// Read through the origin in cache mode, which keeps what it reads
+		if value, err = h.kvstore.ReadThrough(r.Context(), key); err == nil {
+			if current, tag, err := h.kvstore.GetTagged(key); err == nil && current == value {
+				etag = tag
+			}
+		}
+	}
+	if errors.Is(err, ErrOrigin) {
+		originError(w, err)
+		return
+	} else if err != nil {
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeKeyNotFound, "Key not found", nil)
+		return
+	}
+	h.kvstore.noteAccess(key)
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && MatchesETag(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	response := map[string]string{"key": key, "value": value}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// NewKVStoreHandler wraps a store to expose it via HTTP.
+func NewKVStoreHandler(b *KVStore) *KVStoreHandler {
+	h := &KVStoreHandler{
+		kvstore:     b,
+		httpMetrics: metrics.NewHTTPMetrics(b.Metrics(), "kvstore"),
+		logger:      slog.Default().With("component", "kvstore_server", "store", b.Name),
+		mux:         http.NewServeMux(),
+	}
+	h.router = httpapi.NewRouter(h.mux, httpapi.Logging(h.logger), httpapi.Tracing(), httpapi.Metrics(h.httpMetrics))
+	return h
+}
+
+// SetSnapshotLoaded records whether the store's snapshot has been restored, for /readyz.
+func (h *KVStoreHandler) SetSnapshotLoaded(loaded bool) {
+	h.snapshotLoaded.Store(loaded)
+}
+
+// SetRegistered records whether the store is registered with the broker, for /readyz.
+func (h *KVStoreHandler) SetRegistered(registered bool) {
+	h.registered.Store(registered)
+}
+
+func jsonResponse(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// SaveToDiskHandler: POST /save[?sync=true]
+// Saves a snapshot. With sync=true it is not paced, and holds every write
+// acknowledged before the request; concurrent requests share a save.
+func (h *KVStoreHandler) SaveToDiskHandler(w http.ResponseWriter, r *http.Request) {
+	save := h.kvstore.SaveToDisk
+	if r.URL.Query().Get("sync") == "true" {
+		save = h.kvstore.SaveDurably
+	}
+	if err := save(); err != nil {
+		httpapi.Error(w, "Failed to save data to disk", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{"status": "Data successfully saved to disk"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// LoadFromDiskHandler: POST /load?dry_run=<bool> { "filename": "..." }
+// Replaces the store's data with a snapshot file; a dry run reports the keys it would add, change and remove.
+func (h *KVStoreHandler) LoadFromDiskHandler(w http.ResponseWriter, r *http.Request) {
+	var requestData map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	filename, filenameExists := requestData["filename"]
+	if !filenameExists {
+		httpapi.Error(w, "Missing filename in request body", http.StatusBadRequest)
+		return
+	}
+
+	dryRun, err := httpapi.DryRun(r)
+	if err != nil {
+		httpapi.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		plan, err := h.kvstore.PlanLoad(h.kvstore.DataPath(filename))
+		if err != nil {
+			httpapi.Error(w, "Failed to read snapshot file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, plan)
+		return
+	}
+
+	if err := h.kvstore.LoadFromDisk(h.kvstore.DataPath(filename)); err != nil {
+		httpapi.Error(w, "Failed to load data from disk", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{"status": "Data successfully loaded from disk"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *KVStoreHandler) GetAllDataHandler(w http.ResponseWriter, r *http.Request) {
+	data := h.kvstore.GetAllData()
+	w.Header().Set(StoreNameHeader, h.kvstore.Name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(h.kvstore.background.Writer(r.Context(), "peer_backup", w)).Encode(data)
+}
+
+// StatsHandler: GET /stats?prefix=<p>
+// Counts the keys, optionally only those starting with prefix, and their size.
+func (h *KVStoreHandler) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, h.kvstore.PrefixStats(r.URL.Query().Get("prefix")))
+}
+
+// ChangesHandler: GET /changes?since=<seq>&limit=<n>&replica=<name>
+// A read replica names itself, acknowledging the tombstones of the changes up to since.
+func (h *KVStoreHandler) ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		parsed, err := strconv.ParseUint(sinceStr, 10, 64)
+		if err != nil {
+			httpapi.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed < 0 {
+			httpapi.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	jsonResponse(w, h.kvstore.Changes(since, limit))
+	if replica := r.URL.Query().Get("replica"); replica != "" {
+		h.kvstore.ackReplica(replica, since)
+	}
+}
+
+func (h *KVStoreHandler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	var requestData map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	key, keyExists := requestData["key"]
+	if !keyExists {
+		httpapi.Error(w, "Missing key parameter", http.StatusBadRequest)
+		return
+	}
+	err := h.kvstore.DeleteThrough(r.Context(), key, PreconditionFrom(r.Header))
+	if errors.Is(err, ErrOrigin) {
+		originError(w, err)
+		return
+	} else if errors.Is(err, ErrPreconditionFailed) {
+		httpapi.WriteError(w, http.StatusPreconditionFailed, httpapi.CodePreconditionFailed, "Precondition failed for key: "+key, nil)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context(), h.logger).Debug("delete failed", "key_hash", logging.KeyHash(key), "err", err)
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeKeyNotFound, "Key not found", nil)
+		return
+	}
+	h.kvstore.noteAccess(key)
+	response := map[string]string{"status": "Key-Value pair successfully deleted"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Use adds middleware, e.g. httpapi.BearerAuth or httpapi.RateLimit, around
+// every route, inside access logging, tracing and metrics. Call it before
+// the handler serves its first request.
+func (h *KVStoreHandler) Use(mws ...httpapi.Middleware) {
+	h.router.Use(mws...)
+}
+
+// AddRoutes registers a hook that adds routes of its own, through the same
+// middleware, when the handler sets up its routes. Call it before the
+// handler serves its first request.
+func (h *KVStoreHandler) AddRoutes(hook func(*httpapi.Router)) {
+	h.hooks = append(h.hooks, hook)
+}
+
+// ServeHTTP serves the store's API from the handler's own ServeMux, so
+// several stores can run in one process. Routes are registered on the first
+// request, after EnableFaultInjection and EnableShutdown have been called.
+func (h *KVStoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.routes.Do(h.registerRoutes)
+	h.mux.ServeHTTP(w, r)
+}
+
+// registerRoutes sets up the store's HTTP routes on its mux.
+func (h *KVStoreHandler) registerRoutes() {
+	if h.limiter != nil {
+		h.router.Use(h.limitConcurrency)
+	}
+	if h.faults != nil {
+		h.router.Use(h.faults.inject)
+	}
+	h.router.Use(h.replicaGuard, h.loadingGuard, h.countOps)
+
+	//key value store routes
+	h.router.Handle("/get", h.GetHandler)
+	h.router.Handle("/set", h.SetHandler)
+	h.router.Handle("/name", h.GetNameHandler)
+	h.router.Handle("/getall", h.GetAllDataHandler, httpapi.LongRunning())
+	h.router.Handle("/mset", h.MSetHandler)
+	h.router.Handle("/mget", h.MGetHandler)
+	h.router.Handle("/mdelete", h.MDeleteHandler)
+	h.router.Handle("/delete-prefix", h.DeletePrefixHandler)
+	h.router.Handle("/scan", h.ScanHandler)
+	h.router.Handle("/bloom", h.BloomHandler)
+	h.router.Handle("/maybe-has", h.MaybeHasHandler)
+	h.router.Handle("/indexes", h.IndexesHandler)
+	h.router.Handle("/query", h.QueryHandler)
+	h.router.Handle("/incr", h.IncrHandler)
+	h.router.Handle("/stats", h.StatsHandler)
+	h.router.Handle("/load-report", h.LoadReportHandler)
+	h.router.Handle("/hotkeys", h.HotKeysHandler)
+	h.router.Handle("/hot-copies", h.HotCopiesHandler) //comes from broker, to spread the reads of another store's hot keys
+	h.router.Handle("/memory", h.MemoryHandler)
+	h.router.Handle("/memory/compact", h.CompactHandler)
+	h.router.Handle("/changes", h.ChangesHandler)
+	h.router.Handle("/watch", h.WatchHandler, httpapi.LongRunning())
+	h.router.Handle("/delete", h.DeleteHandler)
+	h.router.Handle("/trash", h.TrashHandler)
+	h.router.Handle("/undelete", h.UndeleteHandler)
+	h.router.Handle("/expire", h.ExpireHandler)
+	h.router.Handle("/ttl", h.TTLHandler)
+	h.router.Handle("/persist", h.PersistHandler)
+	h.router.Handle("/default-ttl", h.DefaultTTLHandler)
+	h.router.Handle("/drain", h.DrainHandler)                            //comes from broker, before it moves your keys away and removes you
+	h.router.Handle("/handoff", h.HandoffHandler, httpapi.LongRunning()) //comes from broker, before it removes you: push your keys to your successor
+	h.router.Handle("/migration", h.MigrationHandler)
+	h.router.Handle("/migration/{action}", h.MigrationControlHandler)
+	if h.shutdown != nil {
+		h.router.Handle("/shutdown", h.ShutdownHandler) //comes from broker, after it has removed you
+	}
+
+	//peering routes
+	h.router.Handle("/notify", h.PeerNotificationHandler)                       //comes from broker, when it tells you who your peer is
+	h.router.Handle("/peer-dead", h.PeerDeadHandler)                            //comes from broker, when your peer is dead. then you load peers data from disk
+	h.router.Handle("/peer-backup", h.PeerBackupHandler, httpapi.LongRunning()) //comes from peer, when this comes you send all your data in response field
+	h.router.Handle("/peer-backups", h.PeerBackupsHandler, httpapi.LongRunning())
+	h.router.Handle("/backup-peers", h.BackUpPeersHandler)             //comes from broker, when a peer's data changed a lot and should be backed up now
+	h.router.Handle("/prune-peer-backups", h.PrunePeerBackupsHandler)  //comes from broker, to remove backups of stores you no longer back up
+	h.router.Handle("/replica", h.ReplicaHandler)                      //comes from broker, to check how far a read replica is behind
+	h.router.Handle("/backup", h.BackupHandler, httpapi.LongRunning()) //comes from peer, when it starts and warms up from the backup of its data
+	h.router.Handle("/recover", h.RecoverHandler)                      //comes from broker, when you started from a corrupt snapshot: load your backup from your peer
+	h.router.Handle("/counter-floor", h.CounterFloorHandler)           //comes from broker, after it incremented a counter on a store you back up
+	h.router.Handle("/tombstones", h.TombstonesHandler)                //comes from peer with its backup, or from broker after it deleted keys on a store you back up
+
+	//snapshot routes
+	h.router.Handle("/save", h.SaveToDiskHandler, httpapi.LongRunning())
+	h.router.Handle("/journal", h.JournalHandler)
+	h.router.Handle("/load", h.LoadFromDiskHandler, httpapi.LongRunning())
+	h.router.Handle("/start-snapshots", h.StartPeriodicSnapshotsHandler)
+	h.router.Handle("/stop-snapshots", h.StopPeriodicSnapshotsHandler)
+	h.router.Handle("/snapshot-status", h.SnapshotStatusHandler)
+	h.router.Handle("/snapshot-archive", h.SnapshotArchiveHandler) //comes from broker, when a snapshot profile is attached
+	h.router.Handle("/load-status", h.LoadStatusHandler)
+	h.router.Handle("/background-limit", h.BackgroundLimitHandler) //comes from broker, to pace snapshots, backups and handoffs
+
+	//observability routes
+	h.mux.Handle("/metrics", h.kvstore.Metrics())
+	h.router.Handle("/healthz", h.HealthHandler)
+	h.router.Handle("/readyz", h.ReadyHandler)
+	h.router.Handle("/version", version.Handler)
+
+	//fault injection routes, for testing only
+	if h.faults != nil {
+		h.router.Handle("/chaos", h.ChaosHandler)
+		h.router.Handle("/chaos/crash", h.ChaosCrashHandler)
+	}
+
+	//routes added by extensions
+	for _, hook := range h.hooks {
+		hook(h.router)
+	}
+
+	// Unversioned paths from before /v1, for existing clients
+	h.mux.Handle("/", httpapi.Legacy(h.mux))
+}
+
+// HealthHandler reports liveness: the process is up and serving HTTP.
+func (h *KVStoreHandler) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	health := map[string]interface{}{"status": "ok", "keys": h.kvstore.Len()}
+	if h.kvstore.Cache() {
+		health["cache"] = true
+	}
+	if h.kvstore.UncleanShutdown() {
+		health["unclean_shutdown"] = true
+	}
+	if integrity := h.kvstore.Integrity().Status; integrity != IntegrityOK {
+		health["integrity"] = integrity
+	}
+	jsonResponse(w, health)
+}
+
+// ReadyHandler reports readiness: the store has loaded its snapshot, found
+// its data intact or recovered it, is registered with the broker, has warmed
+// up from its peer and is not draining. The outcome of the integrity
+// self-check is reported with the checks.
+func (h *KVStoreHandler) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	integrity := h.kvstore.Integrity()
+	checks := map[string]bool{
+		"snapshot_loaded": h.snapshotLoaded.Load(),
+		"intact":          !h.kvstore.Corrupt(),
+		"registered":      h.registered.Load(),
+		"warm":            !h.warming.Load(),
+		"not_draining":    !h.draining.Load(),
+	}
+	ready := true
+	for _, ok := range checks {
+		ready = ready && ok
+	}
+
+	status := "ready"
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		status = "not ready"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks, "integrity": integrity})
+}
+
+// DrainHandler: POST /drain, DELETE /drain
+// POST comes from the broker before it moves this store's keys elsewhere and removes it; from then on /readyz fails.
+// DELETE comes from the broker when the move failed or was aborted and the store stays in the cluster.
+func (h *KVStoreHandler) DrainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.draining.Store(true)
+		h.logger.Info("store is draining")
+		jsonResponse(w, map[string]string{"status": "draining"})
+	case http.MethodDelete:
+		h.draining.Store(false)
+		h.logger.Info("store is no longer draining")
+		jsonResponse(w, map[string]string{"status": "serving"})
+	default:
+		httpapi.Error(w, "Only POST and DELETE are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *KVStoreHandler) PeerBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if h.warming.Load() {
+		// Keep the peer's backup of our data until we have warmed up from it
+		httpapi.Error(w, "Store is warming up", http.StatusServiceUnavailable)
+		return
+	}
+	// Taken before the data is read, so no key deleted after it is missed
+	// by the tombstones the peer fetches next
+	taken := time.Now()
+	data := h.kvstore.GetAllData()
+	w.Header().Set(StoreNameHeader, h.kvstore.Name)
+	w.Header().Set(BackupTimeHeader, taken.Format(time.RFC3339Nano))
+	// In the codec the peer accepts, or JSON for one that predates codecs
+	c := codec.ForContentType(r.Header.Get("Accept"))
+	w.Header().Set("Content-Type", c.ContentType())
+	if err := c.Encode(w, data, nil); err != nil {
+		h.logger.Warn("failed to send peer backup", "err", err)
+	}
+}
+
+func (h *KVStoreHandler) GetNameHandler(w http.ResponseWriter, r *http.Request) {
+	response := map[string]string{"name": h.kvstore.Name}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// PeerNotificationHandler: POST /notify {"peer_ip": "host:port", "peers": [{"name": "s2", "address": "host:port"}]}
+// Sent by the broker when the ring changes: the stores this store backs up, its successor first. "peers" is
+// only sent when there is more than one; otherwise "peer_ip" is the successor.
+func (h *KVStoreHandler) PeerNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PeerIP string    `json:"peer_ip"`
+		Peers  []PeerRef `json:"peers"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.PeerIP == "" && len(req.Peers) == 0 {
+		httpapi.Error(w, "Missing peer_ip in request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Peers) > 0 {
+		h.kvstore.SetPeers(req.Peers)
+	} else {
+		h.kvstore.SetPeerIP(req.PeerIP)
+	}
+
+	// Optionally, respond with acknowledgment
+	response := map[string]string{"message": "Peer notified successfully"}
+	jsonResponse(w, response)
+}
+
+func (h *KVStoreHandler) StartPeriodicSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	intervalStr := r.URL.Query().Get("interval")
+	if intervalStr == "" {
+		httpapi.Error(w, "Missing interval parameter", http.StatusBadRequest)
+		return
+	}
+
+	interval, err := strconv.Atoi(intervalStr)
+	if err != nil || interval <= 0 {
+		httpapi.Error(w, "Invalid interval parameter", http.StatusBadRequest)
+		return
+	}
+
+	h.kvstore.StartPeriodicSnapshots(time.Duration(interval) * time.Second)
+
+	response := map[string]string{"status": "Periodic snapshots started"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// StopPeriodicSnapshotsHandler: POST /stop-snapshots
+func (h *KVStoreHandler) StopPeriodicSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := "Periodic snapshots stopped"
+	if !h.kvstore.StopPeriodicSnapshots() {
+		status = "Periodic snapshots were not running"
+	}
+	jsonResponse(w, map[string]string{"status": status})
+}
+
+// SnapshotStatusHandler: GET /snapshot-status
+func (h *KVStoreHandler) SnapshotStatusHandler(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, h.kvstore.SnapshotStatus())
+}
+
+func (h *KVStoreHandler) StartPeriodicSnapshots() {
+	h.kvstore.StartPeriodicSnapshots(time.Duration(15) * time.Second)
+}
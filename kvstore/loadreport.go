@@ -0,0 +1,120 @@
+package kvstore
+
+import (
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// opsWindow is how many seconds the operations rate of a load report is
+// averaged over.
+const opsWindow = 10
+
+// LoadReport tells the broker how busy a store is. The broker pulls it with
+// every health check and weighs placement by it.
+type LoadReport struct {
+	Keys int `json:"keys"`
+	// DataBytes is the size of the keys and values held.
+	DataBytes int64 `json:"data_bytes"`
+	// MemoryBytes is the heap memory the store's process has in use.
+	MemoryBytes uint64 `json:"memory_bytes"`
+	// OpsPerSecond is the rate of reads and writes over the last 10 seconds.
+	OpsPerSecond float64 `json:"ops_per_second"`
+	// SnapshotAgeSeconds is the time since the last snapshot was saved, or
+	// the loaded one was taken; -1 if there is neither.
+	SnapshotAgeSeconds float64 `json:"snapshot_age_seconds"`
+}
+
+// LoadReport reports the store's keys, data size, memory, operations rate and
+// snapshot age.
+func (s *KVStore) LoadReport() LoadReport {
+	now := time.Now()
+	report := LoadReport{OpsPerSecond: s.ops.rate(now), SnapshotAgeSeconds: -1}
+	s.mu.RLock()
+	report.Keys, report.DataBytes = s.data.len(), s.data.size()
+	snapshot := s.snapshotTime
+	s.mu.RUnlock()
+
+	s.snapMu.Lock()
+	if s.lastSuccess.After(snapshot) {
+		snapshot = s.lastSuccess
+	}
+	s.snapMu.Unlock()
+	if !snapshot.IsZero() {
+		report.SnapshotAgeSeconds = now.Sub(snapshot).Seconds()
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	report.MemoryBytes = mem.HeapInuse
+	return report
+}
+
+// rateMeter counts events per second over the last opsWindow seconds.
+type rateMeter struct {
+	mu     sync.Mutex
+	counts [opsWindow]int64
+	secs   [opsWindow]int64 // the second each count is for
+}
+
+// add counts an event at now.
+func (m *rateMeter) add(now time.Time) {
+	sec := now.Unix()
+	i := sec % opsWindow
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.secs[i] != sec {
+		m.secs[i], m.counts[i] = sec, 0
+	}
+	m.counts[i]++
+}
+
+// rate returns the events per second over the opsWindow whole seconds
+// before now.
+func (m *rateMeter) rate(now time.Time) float64 {
+	sec := now.Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	for i, s := range m.secs {
+		if s < sec && s >= sec-opsWindow {
+			total += m.counts[i]
+		}
+	}
+	return float64(total) / opsWindow
+}
+
+// opsRoutes are the reads and writes counted in a load report.
+var opsRoutes = map[string]bool{
+	"/get":        true,
+	"/set":        true,
+	"/mget":       true,
+	"/mset":       true,
+	"/mdelete":    true,
+	"/delete":     true,
+	"/scan":       true,
+	"/query":      true,
+	"/incr":       true,
+	"/expire":     true,
+	"/ttl":        true,
+	"/persist":    true,
+	"/hot-copies": true,
+}
+
+// countOps counts the requests to opsRoutes for the load report.
+func (h *KVStoreHandler) countOps(route string, next http.HandlerFunc) http.HandlerFunc {
+	if !opsRoutes[route] {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.kvstore.ops.add(time.Now())
+		next(w, r)
+	}
+}
+
+// LoadReportHandler: GET /load-report
+// Reports the store's keys, data size, memory, operations rate and snapshot age, for the broker's placement.
+func (h *KVStoreHandler) LoadReportHandler(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, h.kvstore.LoadReport())
+}
@@ -0,0 +1,68 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errLocked is returned by lockFile when another process holds the lock.
+var errLocked = errors.New("file is locked")
+
+// DataDirLockedError is returned by Lock when another process holds the
+// store's lock in its data directory.
+type DataDirLockedError struct {
+	Path string
+	PID  int // of the process holding the lock; 0 if it is not known
+}
+
+func (e *DataDirLockedError) Error() string {
+	owner := "another process"
+	if e.PID != 0 {
+		owner = "process " + strconv.Itoa(e.PID)
+	}
+	return fmt.Sprintf("%s is held by %s: a store of the same name is already running on this data directory", e.Path, owner)
+}
+
+// lockPath is the file the store locks in its data directory.
+func (s *KVStore) lockPath() string {
+	return s.DataPath(s.Name + ".lock")
+}
+
+// Lock takes the store's lock in its data directory, so a second process
+// started with the same name and data directory fails here instead of
+// overwriting the first one's snapshots and peer backups. The lock is held
+// until Close or the process exits; the file holding it is left in place.
+// Call it before the store reads or writes its files.
+func (s *KVStore) Lock() error {
+	file, err := os.OpenFile(s.lockPath(), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := lockFile(file); err != nil {
+		defer file.Close()
+		if errors.Is(err, errLocked) {
+			data, _ := io.ReadAll(file)
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+			return &DataDirLockedError{Path: file.Name(), PID: pid}
+		}
+		return fmt.Errorf("failed to lock %s: %w", file.Name(), err)
+	}
+	// Name the owner, for the error the next process to try gets
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	s.dirLock = file
+	return nil
+}
+
+// unlock releases the lock taken by Lock, if any.
+func (s *KVStore) unlock() {
+	if s.dirLock != nil {
+		s.dirLock.Close()
+		s.dirLock = nil
+	}
+}
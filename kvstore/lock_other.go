@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package kvstore
+
+import "os"
+
+// lockFile does nothing: data directories are only locked where flock is
+// available.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,264 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"kv/httpapi"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Migration states.
+const (
+	MigrationRunning = "running"
+	MigrationPaused  = "paused"
+	MigrationAborted = "aborted"
+	MigrationDone    = "done"
+	MigrationFailed  = "failed"
+)
+
+// ErrMigrationAborted is returned by a migration that was aborted.
+var ErrMigrationAborted = errors.New("migration aborted")
+
+// ErrMigrationFinished is returned when pausing, resuming or aborting a
+// migration that is no longer running.
+var ErrMigrationFinished = errors.New("migration has finished")
+
+// MigrationStatus reports the progress of keys being moved off a store,
+// by a handoff or a drain.
+type MigrationStatus struct {
+	Kind   string `json:"kind"` // handoff, drain, split or merge
+	Store  string `json:"store"`
+	Target string `json:"target,omitempty"`
+	State  string `json:"state"`
+	// KeysTotal grows when keys written during a handoff are sent too.
+	KeysTotal  int        `json:"keys_total"`
+	KeysMoved  int        `json:"keys_moved"`
+	BytesMoved int64      `json:"bytes_moved"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// KeysPerSecond and BytesPerSecond are averaged over the time the
+	// migration was running, not paused.
+	KeysPerSecond  float64 `json:"keys_per_second"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// ETASeconds estimates the time left at the current rate; -1 if unknown.
+	ETASeconds int    `json:"eta_seconds"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Migration tracks keys being moved in batches, and lets the move be paused,
+// resumed and aborted between batches.
+type Migration struct {
+	mu       sync.Mutex
+	status   MigrationStatus
+	paused   time.Duration // time spent paused, up to pausedAt
+	pausedAt time.Time     // set while paused
+	resumed  chan struct{} // closed when a pause ends
+	aborted  bool
+}
+
+// NewMigration starts tracking a migration of kind moving the keys of store
+// to target.
+func NewMigration(kind, store, target string) *Migration {
+	return &Migration{status: MigrationStatus{
+		Kind:      kind,
+		Store:     store,
+		Target:    target,
+		State:     MigrationRunning,
+		StartedAt: time.Now(),
+	}}
+}
+
+// AddKeys adds n keys to those to be moved.
+func (m *Migration) AddKeys(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.KeysTotal += n
+}
+
+// Moved records that a batch of pairs has been moved.
+func (m *Migration) Moved(pairs map[string]string) {
+	bytes := 0
+	for key, value := range pairs {
+		bytes += len(key) + len(value)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.KeysMoved += len(pairs)
+	m.status.BytesMoved += int64(bytes)
+}
+
+// Wait is called before each batch. It blocks while the migration is
+// paused, and returns ErrMigrationAborted once it has been aborted.
+func (m *Migration) Wait(ctx context.Context) error {
+	for {
+		m.mu.Lock()
+		aborted, resumed := m.aborted, m.resumed
+		m.mu.Unlock()
+		if aborted {
+			return ErrMigrationAborted
+		}
+		if resumed == nil {
+			return nil
+		}
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Pause holds the migration back before its next batch.
+func (m *Migration) Pause() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status.State != MigrationRunning && m.status.State != MigrationPaused {
+		return ErrMigrationFinished
+	}
+	if m.resumed == nil {
+		m.resumed = make(chan struct{})
+		m.pausedAt = time.Now()
+		m.status.State = MigrationPaused
+	}
+	return nil
+}
+
+// Resume lets a paused migration go on.
+func (m *Migration) Resume() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status.State != MigrationRunning && m.status.State != MigrationPaused {
+		return ErrMigrationFinished
+	}
+	m.resume()
+	m.status.State = MigrationRunning
+	return nil
+}
+
+// resume ends a pause. m.mu must be held.
+func (m *Migration) resume() {
+	if m.resumed == nil {
+		return
+	}
+	m.paused += time.Since(m.pausedAt)
+	close(m.resumed)
+	m.resumed, m.pausedAt = nil, time.Time{}
+}
+
+// Abort stops the migration before its next batch. The keys already moved
+// stay where they are.
+func (m *Migration) Abort() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status.State != MigrationRunning && m.status.State != MigrationPaused {
+		return ErrMigrationFinished
+	}
+	m.aborted = true
+	m.resume()
+	return nil
+}
+
+// Finish records the outcome of the migration.
+func (m *Migration) Finish(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resume()
+	now := time.Now()
+	m.status.FinishedAt = &now
+	switch {
+	case errors.Is(err, ErrMigrationAborted):
+		m.status.State = MigrationAborted
+	case err != nil:
+		m.status.State = MigrationFailed
+		m.status.Error = err.Error()
+	default:
+		m.status.State = MigrationDone
+	}
+}
+
+// Status reports the migration's progress.
+func (m *Migration) Status() MigrationStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := m.status
+	end := time.Now()
+	if status.FinishedAt != nil {
+		end = *status.FinishedAt
+	}
+	if !m.pausedAt.IsZero() {
+		end = m.pausedAt
+	}
+	if running := end.Sub(status.StartedAt) - m.paused; running > 0 && status.KeysMoved > 0 {
+		status.KeysPerSecond = float64(status.KeysMoved) / running.Seconds()
+		status.BytesPerSecond = float64(status.BytesMoved) / running.Seconds()
+	}
+	switch {
+	case status.FinishedAt != nil:
+		status.ETASeconds = 0
+	case status.KeysPerSecond > 0:
+		status.ETASeconds = int(float64(max(status.KeysTotal-status.KeysMoved, 0)) / status.KeysPerSecond)
+	default:
+		status.ETASeconds = -1
+	}
+	return status
+}
+
+// Control applies a pause, resume or abort action to the migration.
+func (m *Migration) Control(action string) error {
+	switch action {
+	case "pause":
+		return m.Pause()
+	case "resume":
+		return m.Resume()
+	case "abort":
+		return m.Abort()
+	}
+	return errors.New("unknown action: " + action)
+}
+
+// Migration returns the store's current or last handoff, or nil if it has
+// not handed off its keys.
+func (s *KVStore) Migration() *Migration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.migration
+}
+
+// MigrationHandler: GET /migration
+// Reports the progress of the store's current or last handoff.
+func (h *KVStoreHandler) MigrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m := h.kvstore.Migration()
+	if m == nil {
+		httpapi.Error(w, "No handoff has run on this store", http.StatusNotFound)
+		return
+	}
+	jsonResponse(w, m.Status())
+}
+
+// MigrationControlHandler: POST /migration/{action}
+// Pauses, resumes or aborts the store's running handoff; action is pause, resume or abort.
+func (h *KVStoreHandler) MigrationControlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m := h.kvstore.Migration()
+	if m == nil {
+		httpapi.Error(w, "No handoff has run on this store", http.StatusNotFound)
+		return
+	}
+	if err := m.Control(r.PathValue("action")); errors.Is(err, ErrMigrationFinished) {
+		httpapi.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		httpapi.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jsonResponse(w, m.Status())
+}
@@ -0,0 +1,533 @@
+package kvstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kv/codec"
+	"kv/httpapi"
+	"kv/tracing"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Peer backups: a store keeps the data of each store it backs up (its ring
+// successor, and more with a replication factor above 2) in
+// peerof<name>.<peer>.snapshot.<ext>, next to its own <name>.snapshot.<ext>,
+// where ext is that of its codec, and describes it in
+// peerof<name>.<peer>.meta.json. The metadata is written
+// after the data, so a backup without it is incomplete or from an older
+// version, which kept a single peerof<name>.snapshot.json.
+
+// StoreNameHeader carries the name of the store answering a peer backup request.
+const StoreNameHeader = "X-Store-Name"
+
+// BackupChecksumHeader carries the checksum of a streamed peer backup, in
+// the form of PeerBackupMeta.Checksum.
+const BackupChecksumHeader = "X-Backup-Checksum"
+
+var (
+	// ErrNoPeerBackup is returned when a store holds no backup of the store
+	// asked for.
+	ErrNoPeerBackup = errors.New("no backup of that store is held here")
+	// ErrPeerBackupCorrupt is returned when the backup does not match its checksum.
+	ErrPeerBackupCorrupt = errors.New("peer backup does not match its checksum")
+)
+
+// PeerRef names a store that another backs up.
+type PeerRef struct {
+	Name    string `json:"name"`
+	Address string `json:"address"` // host:port
+}
+
+// PeerBackupMeta describes the peer backup a store holds.
+type PeerBackupMeta struct {
+	Holder  string    `json:"holder"`  // name of the store holding the backup
+	Peer    string    `json:"peer"`    // name of the store backed up; empty if it did not say
+	Address string    `json:"address"` // its host:port
+	Taken   time.Time `json:"taken"`
+	Keys    int       `json:"keys"`
+	// Checksum is "sha256:" and the hex SHA-256 of the backup file.
+	Checksum string `json:"checksum"`
+	// Codec is the name of the codec the backup file is written in; empty
+	// means JSON.
+	Codec string `json:"codec,omitempty"`
+}
+
+// peerBackup is a peer backup file and its metadata.
+type peerBackup struct {
+	path string
+	meta PeerBackupMeta
+}
+
+// PeerBackupPath is the file the store writes its backup of the named peer
+// to, or the single backup file of older versions if peer is empty.
+func (s *KVStore) PeerBackupPath(peer string) string {
+	if peer == "" {
+		return s.DataPath("peerof" + s.Name + ".snapshot.json")
+	}
+	return snapshotFile(s.DataPath("peerof"+s.Name+"."+peer), s.codec)
+}
+
+// metaPath is the metadata file of the backup file at path.
+func metaPath(path string) string {
+	return snapshotBase(path) + ".meta.json"
+}
+
+// checksum formats a SHA-256 sum as PeerBackupMeta.Checksum.
+func checksum(sum []byte) string {
+	return "sha256:" + hex.EncodeToString(sum)
+}
+
+// SetPeers sets the stores this store backs up, its ring successor first.
+func (s *KVStore) SetPeers(peers []PeerRef) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers = slices.Clone(peers)
+	s.PeerIP = ""
+	if len(peers) > 0 {
+		s.PeerIP = peers[0].Address
+	}
+}
+
+// Peers returns the stores this store backs up, its ring successor first.
+func (s *KVStore) Peers() []PeerRef {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.peers)
+}
+
+// BackUpPeers copies the data of every store this store backs up.
+func (s *KVStore) BackUpPeers() error {
+	var errs []error
+	for _, peer := range s.Peers() {
+		errs = append(errs, s.RequestPeerBackup("http://"+peer.Address))
+	}
+	return errors.Join(errs...)
+}
+
+// PeerBackups returns the metadata of every peer backup held, newest first.
+func (s *KVStore) PeerBackups() ([]PeerBackupMeta, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	backups, err := s.readPeerBackups()
+	metas := make([]PeerBackupMeta, len(backups))
+	for i, backup := range backups {
+		metas[i] = backup.meta
+	}
+	return metas, err
+}
+
+// readPeerBackups reads the metadata of every peer backup held, newest
+// first. fileMu must be held.
+func (s *KVStore) readPeerBackups() ([]peerBackup, error) {
+	pattern := s.DataPath("peerof" + s.Name + "*.meta.json")
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var backups []peerBackup
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var meta PeerBackupMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("failed to decode peer backup metadata %s: %w", path, err)
+		}
+		// The pattern also matches the backups of stores whose name starts with ours
+		if meta.Holder != s.Name {
+			continue
+		}
+		backupCodec, err := codec.Lookup(meta.Codec)
+		if err != nil {
+			return nil, fmt.Errorf("peer backup %s: %w", path, err)
+		}
+		backups = append(backups, peerBackup{
+			path: snapshotFile(strings.TrimSuffix(path, ".meta.json"), backupCodec),
+			meta: meta,
+		})
+	}
+	slices.SortFunc(backups, func(a, b peerBackup) int { return b.meta.Taken.Compare(a.meta.Taken) })
+	return backups, nil
+}
+
+// findPeerBackup returns the newest backup of the store with the given name
+// and address; either may be empty. It returns ErrNoPeerBackup if there is
+// none. fileMu must be held.
+func (s *KVStore) findPeerBackup(name, addr string) (peerBackup, error) {
+	backups, err := s.readPeerBackups()
+	if err != nil {
+		return peerBackup{}, err
+	}
+	for _, backup := range backups {
+		if (name == "" || backup.meta.Peer == "" || backup.meta.Peer == name) && (addr == "" || backup.meta.Address == addr) {
+			return backup, nil
+		}
+	}
+	return peerBackup{}, ErrNoPeerBackup
+}
+
+// writePeerBackup replaces the backup file at path and its metadata. fileMu
+// must be held.
+func (s *KVStore) writePeerBackup(path string, data map[string]string, meta PeerBackupMeta) error {
+	// Without metadata the old backup no longer counts once the data file
+	// is touched
+	if err := os.Remove(metaPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create peer backup file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	out := s.background.DiskWriter(context.Background(), "peer_backup", file)
+	if err := s.codec.Encode(io.MultiWriter(out, hash), data, nil); err != nil {
+		return fmt.Errorf("failed to encode peer backup: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	removeOtherCodecs(snapshotBase(path), s.codec)
+
+	meta.Keys, meta.Checksum, meta.Codec = len(data), checksum(hash.Sum(nil)), s.codec.Name()
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath(path), encoded, 0o644)
+}
+
+// RemovePeerBackups deletes every peer backup file the store holds.
+func (s *KVStore) RemovePeerBackups() {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	backups, _ := s.readPeerBackups()
+	for _, backup := range backups {
+		os.Remove(backup.path)
+		os.Remove(metaPath(backup.path))
+		os.Remove(countersPath(backup.path))
+		os.Remove(tombstonesPath(backup.path))
+	}
+	os.Remove(s.PeerBackupPath(""))
+}
+
+// PrunePeerBackups deletes the backups held of stores this store no longer
+// backs up that were taken more than maxAge ago, and returns the names of
+// the stores they were of. Such backups are left behind when the ring
+// changes; they are kept for a while in case their store is failed over.
+func (s *KVStore) PrunePeerBackups(maxAge time.Duration) ([]string, error) {
+	// The broker names the peers only when there is more than one
+	names, addrs := make(map[string]bool), make(map[string]bool)
+	for _, peer := range s.Peers() {
+		names[peer.Name] = true
+		addrs[peer.Address] = true
+	}
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	backups, err := s.readPeerBackups()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	for _, backup := range backups {
+		if names[backup.meta.Peer] || addrs[backup.meta.Address] || time.Since(backup.meta.Taken) <= maxAge {
+			continue
+		}
+		// The metadata goes first, so a backup left half removed no longer counts
+		if err := os.Remove(metaPath(backup.path)); err != nil {
+			return pruned, err
+		}
+		os.Remove(backup.path)
+		os.Remove(countersPath(backup.path))
+		os.Remove(tombstonesPath(backup.path))
+		pruned = append(pruned, backup.meta.Peer)
+	}
+	if len(pruned) > 0 {
+		s.logger.Info("stale peer backups removed", "peers", pruned)
+	}
+	return pruned, nil
+}
+
+// RequestPeerBackup copies the data of the store at peerURL into the
+// store's backup file of it. Failures are also logged.
+func (s *KVStore) RequestPeerBackup(peerURL string) error {
+	ctx, span := tracing.Start(context.Background(), "peer-backup", "store", s.Name, "peer", peerURL)
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peerURL+httpapi.Version+"/peer-backup", nil)
+	if err != nil {
+		span.RecordError(err)
+		s.logger.Error("error creating peer-backup request", "peer", peerURL, "err", err)
+		return err
+	}
+	tracing.Inject(ctx, req.Header)
+	req.Header.Set("Accept", s.codec.ContentType())
+	resp, err := s.transport.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		s.logger.Error("error sending peer-backup request", "peer", peerURL, "err", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		s.logger.Warn("peer-backup rejected", "peer", peerURL, "status", resp.StatusCode)
+		return fmt.Errorf("peer %s rejected the backup with status %d", peerURL, resp.StatusCode)
+	}
+
+	// A peer that predates codecs answers in JSON whatever we accept
+	data, _, err := codec.ForContentType(resp.Header.Get("Content-Type")).Decode(resp.Body, nil)
+	if err != nil {
+		s.logger.Error("error decoding peer-backup response", "peer", peerURL, "err", err)
+		return err
+	}
+	meta := PeerBackupMeta{
+		Holder:  s.Name,
+		Peer:    resp.Header.Get(StoreNameHeader),
+		Address: strings.TrimPrefix(peerURL, "http://"),
+		Taken:   time.Now(),
+	}
+	// The time the peer read its data, if it says, as its tombstones are
+	// dated by its clock
+	if taken, err := time.Parse(time.RFC3339Nano, resp.Header.Get(BackupTimeHeader)); err == nil {
+		meta.Taken = taken
+	}
+	tombstones, err := s.fetchPeerTombstones(ctx, meta.Address)
+	if err != nil {
+		s.logger.Warn("error fetching peer tombstones", "peer", peerURL, "err", err)
+	}
+	path := s.PeerBackupPath(meta.Peer)
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if _, err := applyCounterFloors(path, data, true); err != nil {
+		s.logger.Warn("error pruning counter floors", "file", path, "err", err)
+	}
+	if err := pruneTombstones(path, meta.Taken, tombstones); err != nil {
+		s.logger.Warn("error pruning tombstones", "file", path, "err", err)
+	}
+	if err := s.writePeerBackup(path, data, meta); err != nil {
+		s.logger.Error("error saving peer backup", "file", path, "err", err)
+		return err
+	}
+
+	s.mu.Lock()
+	s.lastPeerBackup = meta.Taken
+	s.mu.Unlock()
+
+	s.logger.Debug("peer backup saved", "file", path, "peer", meta.Peer, "keys", len(data))
+	return nil
+}
+
+// MergePeerBackup merges the newest backup held of the store with the given
+// name and address into the store's data, taking over the keys of a peer
+// that died. If both are empty it is the backup of the store's successor. A
+// single backup without metadata, from an older version, is merged as it is.
+// Keys the peer removed after the backup was taken are left out. It returns
+// the backup's metadata.
+func (s *KVStore) MergePeerBackup(name, addr string) (PeerBackupMeta, error) {
+	if name == "" && addr == "" {
+		if peers := s.Peers(); len(peers) > 0 {
+			addr = peers[0].Address
+		}
+	}
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	backup, err := s.findPeerBackup(name, addr)
+	floorsOnly := false
+	switch {
+	case errors.Is(err, ErrNoPeerBackup) && fileExists(s.PeerBackupPath("")):
+		backup = peerBackup{path: s.PeerBackupPath("")}
+		s.logger.Warn("peer backup has no metadata, merging it unchecked", "file", backup.path)
+	case errors.Is(err, ErrNoPeerBackup) && name != "" && fileExists(countersPath(s.PeerBackupPath(name))):
+		// The peer died before its first backup, but after counters on it
+		// were incremented
+		backup = peerBackup{path: s.PeerBackupPath(name), meta: PeerBackupMeta{Holder: s.Name, Peer: name, Address: addr}}
+		floorsOnly = true
+	case err != nil:
+		return PeerBackupMeta{}, err
+	}
+	meta := backup.meta
+
+	data := make(map[string]string)
+	if !floorsOnly {
+		if data, err = readPeerBackupData(backup); err != nil {
+			return meta, err
+		}
+	}
+	raised, err := applyCounterFloors(backup.path, data, false)
+	if err != nil {
+		s.logger.Warn("error reading counter floors", "file", backup.path, "err", err)
+	}
+	dropped, deadlines, err := applyTombstones(backup.path, meta.Taken, data)
+	if err != nil {
+		s.logger.Warn("error reading tombstones", "file", backup.path, "err", err)
+	}
+	meta.Keys = len(data)
+
+	// Merge the backup with the in-memory store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, value := range data {
+		s.data.put(key, value)
+		s.resetExpiryLocked(key, now)
+		if deadline, ok := deadlines[key]; ok {
+			s.expiry[key] = deadline
+		}
+		s.publish(OpSet, key, value)
+	}
+
+	s.logger.Info("data loaded and merged from disk", "file", backup.path, "peer", meta.Peer, "keys", len(data), "counters_raised", raised, "tombstoned", dropped)
+	return meta, nil
+}
+
+// readPeerBackupData reads a backup file, checking it against its metadata's
+// checksum if it has one. fileMu must be held.
+func readPeerBackupData(backup peerBackup) (map[string]string, error) {
+	file, err := os.Open(backup.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open peer backup file: %w", err)
+	}
+	defer file.Close()
+
+	// A backup without metadata is from before codecs, and in JSON
+	backupCodec, err := codec.Lookup(backup.meta.Codec)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	data, _, err := backupCodec.Decode(io.TeeReader(file, hash), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode peer backup: %w", err)
+	}
+	if backup.meta.Checksum != "" {
+		// The decoder may leave the end of the file unread, such as the
+		// newline the JSON encoder ends it with
+		io.Copy(hash, file)
+		if checksum(hash.Sum(nil)) != backup.meta.Checksum {
+			return nil, ErrPeerBackupCorrupt
+		}
+	}
+	return data, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// PeerDeadRequest names the store whose backup a store takes over. Both
+// fields are optional.
+type PeerDeadRequest struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// PeerDeadHandler: POST /peer-dead {"name": "store2", "address": "host:port"}
+// Sent by the broker when a store this one backs up died: merges the newest backup held of it; 404 if there
+// is none.
+func (h *KVStoreHandler) PeerDeadHandler(w http.ResponseWriter, r *http.Request) {
+	var req PeerDeadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := h.kvstore.MergePeerBackup(req.Name, req.Address)
+	if errors.Is(err, ErrNoPeerBackup) {
+		httpapi.Error(w, "No backup of that store is held here", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error("failed to load peer backup", "peer", req.Name, "err", err)
+		httpapi.Error(w, "Failed to load data from peer backup", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, map[string]interface{}{
+		"status": "Data successfully loaded from peer backup",
+		"backup": meta,
+	})
+}
+
+// PeerBackupsHandler: GET /peer-backups
+// Lists the metadata of the peer backups this store holds, newest first.
+func (h *KVStoreHandler) PeerBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	backups, err := h.kvstore.PeerBackups()
+	if err != nil {
+		httpapi.Error(w, "Failed to read peer backups", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, backups)
+}
+
+// PrunePeerBackupsRequest is the body of POST /prune-peer-backups.
+type PrunePeerBackupsRequest struct {
+	MaxAge Duration `json:"max_age"`
+}
+
+// PrunePeerBackupsHandler: POST /prune-peer-backups {"max_age": "24h"}
+// Deletes the backups of stores this one no longer backs up that are older than max_age; comes from the broker.
+func (h *KVStoreHandler) PrunePeerBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req PrunePeerBackupsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MaxAge < 0 {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	pruned, err := h.kvstore.PrunePeerBackups(time.Duration(req.MaxAge))
+	if err != nil {
+		h.logger.Error("failed to prune peer backups", "err", err)
+		httpapi.Error(w, "Failed to prune peer backups", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string][]string{"pruned": pruned})
+}
+
+// BackUpPeersHandler: POST /backup-peers [{"peer": "host:port"}]
+// Backs up every store this one backs up now rather than on the next snapshot tick; 502 if any backup failed.
+// With a peer, backs up only that store: one shutting down asks for a last backup of its data.
+func (h *KVStoreHandler) BackUpPeersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req BackUpPeersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Peer != "" {
+		if err := h.kvstore.RequestPeerBackup("http://" + req.Peer); err != nil {
+			httpapi.Error(w, "Failed to back up peer: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		jsonResponse(w, map[string]int{"peers": 1})
+		return
+	}
+	if err := h.kvstore.BackUpPeers(); err != nil {
+		httpapi.Error(w, "Failed to back up peers: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	jsonResponse(w, map[string]int{"peers": len(h.kvstore.Peers())})
+}
@@ -0,0 +1,129 @@
+package kvstore
+
+import (
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// These tests are meant for "go test -race": they run every kind of write
+// alongside snapshots, compactions and loads, then check that the store
+// still agrees with itself and with what it saved.
+
+func TestConcurrentWritesSnapshotsAndLoads(t *testing.T) {
+	dir := t.TempDir()
+	s := NewKVStore("race", "0")
+	s.SetDataDir(dir)
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprintf("k%d", i), "seed")
+	}
+	if err := s.SaveToDisk(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	loop := func(f func(rng *rand.Rand)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(rand.Uint64(), 0))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					f(rng)
+				}
+			}
+		}()
+	}
+	key := func(rng *rand.Rand) string { return fmt.Sprintf("k%d", rng.IntN(200)) }
+
+	for range 4 {
+		loop(func(rng *rand.Rand) { s.Set(key(rng), strconv.Itoa(rng.IntN(1000))) })
+	}
+	loop(func(rng *rand.Rand) { s.Delete(key(rng)) })
+	loop(func(rng *rand.Rand) {
+		ttl := time.Hour
+		if rng.IntN(2) == 0 {
+			ttl = time.Millisecond
+		}
+		s.Expire(key(rng), ttl)
+		s.DeleteExpired()
+	})
+	loop(func(rng *rand.Rand) { s.Journal(key(rng), key(rng)) })
+	loop(func(rng *rand.Rand) {
+		s.Get(key(rng))
+		s.GetAllData()
+	})
+	loop(func(*rand.Rand) {
+		if err := s.SaveToDisk(); err != nil {
+			t.Errorf("SaveToDisk: %v", err)
+		}
+	})
+	loop(func(*rand.Rand) { s.Compact() })
+	loop(func(*rand.Rand) {
+		if err := s.LoadFromDisk(s.SnapshotPath()); err != nil {
+			t.Errorf("LoadFromDisk: %v", err)
+		}
+	})
+
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	time.Sleep(5 * time.Millisecond) // past the shortest TTL set
+	s.DeleteExpired()
+	data := s.GetAllData()
+	if s.Len() != len(data) {
+		t.Errorf("Len() = %d, but %d pairs held", s.Len(), len(data))
+	}
+	if err := s.SaveToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewKVStore("loaded", "0")
+	loaded.SetDataDir(dir)
+	if err := loaded.LoadFromDisk(s.SnapshotPath()); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.GetAllData(); !maps.Equal(got, data) {
+		t.Errorf("snapshot holds %d pairs that differ from the %d in memory", len(got), len(data))
+	}
+}
+
+func TestConcurrentConditionalWrites(t *testing.T) {
+	s := NewKVStore("race", "0")
+	s.Set("n", "0")
+
+	// Each writer increments n only if no one wrote it since it was read
+	var wg sync.WaitGroup
+	var applied atomic.Int64
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				value, etag, err := s.GetTagged("n")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := strconv.Atoi(value)
+				if _, err := s.SetIf("n", strconv.Itoa(n+1), Precondition{IfMatch: etag}); err == nil {
+					applied.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _ := s.Get("n"); value != strconv.FormatInt(applied.Load(), 10) {
+		t.Errorf("n = %s after %d conditional increments succeeded", value, applied.Load())
+	}
+}
@@ -0,0 +1,325 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/lifecycle"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeatInterval is how often a running store re-registers.
+const DefaultHeartbeatInterval = 10 * time.Second
+
+// Bounds of the backoff between rounds of registration attempts.
+const (
+	registerInitialBackoff = 200 * time.Millisecond
+	registerMaxBackoff     = 5 * time.Second
+)
+
+// ErrRemoved is returned when a broker refuses a heartbeat because the store
+// was removed from the cluster.
+var ErrRemoved = errors.New("store was removed from the cluster")
+
+// registrationClient bounds each call to a broker, so an unresponsive one
+// does not hold up trying the next.
+var registrationClient = &http.Client{Timeout: 5 * time.Second}
+
+// RegisterWithBroker sends a registration request to the Broker.
+func RegisterWithBroker(brokerURL, name, ip string) error {
+	return RegisterWithBrokerToken(brokerURL, name, ip, "")
+}
+
+// RegisterWithBrokerToken is RegisterWithBroker presenting token, the
+// broker's admin token, which it requires to register once one is set.
+func RegisterWithBrokerToken(brokerURL, name, ip, token string) error {
+	_, err := register(brokerURL, name, ip, registerOptions{token: token})
+	return err
+}
+
+// registerOptions are the optional fields of a registration.
+type registerOptions struct {
+	replicaOf string // address of the primary, for a read replica
+	heartbeat bool
+	warming   bool   // the store is still loading its data from its peer
+	unclean   bool   // the store's previous run did not shut down cleanly
+	corrupt   bool   // the store started from a corrupt snapshot and has not recovered
+	token     string // the admin token, presented to the broker if set
+}
+
+// register posts the store's name and address to a broker's /register URL.
+// It returns the address of the store holding the backup of this store's
+// data, if the broker named one.
+func register(brokerURL, name, ip string, opts registerOptions) (string, error) {
+	data := map[string]interface{}{
+		"name":       name,
+		"ip_address": ip,
+	}
+	if opts.replicaOf != "" {
+		data["replica_of"] = opts.replicaOf
+	}
+	if opts.heartbeat {
+		data["heartbeat"] = true
+	}
+	if opts.warming {
+		data["warming"] = true
+	}
+	if opts.unclean {
+		data["unclean_shutdown"] = true
+	}
+	if opts.corrupt {
+		data["corrupt"] = true
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := brokerPost(brokerURL, opts.token, jsonData)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return "", ErrRemoved
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to register with broker, status code: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Backup string `json:"backup"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return result.Backup, nil
+}
+
+// DeregisterFromBroker removes the store from the broker that brokerURL (the
+// broker's /register URL, as passed to RegisterWithBroker) points at, so it
+// stops routing requests to the store.
+func DeregisterFromBroker(brokerURL, name string) error {
+	return deregister(brokerURL, name, "")
+}
+
+// deregister is DeregisterFromBroker presenting token, if set.
+func deregister(brokerURL, name, token string) error {
+	removeURL := strings.TrimSuffix(brokerURL, "/register") + "/stores/remove"
+	jsonData, err := json.Marshal(map[string]string{"name": name})
+	if err != nil {
+		return err
+	}
+
+	resp, err := brokerPost(removeURL, token, jsonData)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to deregister from broker, status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// brokerPost posts body to a broker, with token as a bearer token if set: a
+// broker shared by tenants requires the admin token from stores.
+func brokerPost(url, token string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return registrationClient.Do(req)
+}
+
+// Registration keeps a store registered with one of several brokers. The
+// broker that last accepted the store is tried first.
+type Registration struct {
+	brokers   []string
+	name      string
+	addr      string
+	replicaOf string
+	token     string
+	logger    *slog.Logger
+	tasks     *lifecycle.Group // the heartbeat loop
+
+	mu         sync.Mutex
+	current    int // index into brokers of the broker that last accepted
+	warming    bool
+	unclean    bool
+	corrupt    bool
+	registered bool
+	backup     string // holder of the backup of the store's data, as last reported
+}
+
+// NewRegistration prepares the registration of store name at addr with the
+// given broker /register URLs.
+func NewRegistration(brokers []string, name, addr string) *Registration {
+	return &Registration{
+		brokers: brokers,
+		name:    name,
+		addr:    addr,
+		logger:  slog.Default().With("component", "registration", "store", name),
+		tasks:   lifecycle.New(),
+	}
+}
+
+// SetReplicaOf registers the store as a read replica of the store at
+// primary (host:port). Call it before Register.
+func (r *Registration) SetReplicaOf(primary string) {
+	r.replicaOf = primary
+}
+
+// SetToken sets the admin token the store presents to the broker, which a
+// broker shared by tenants requires. Call it before Register.
+func (r *Registration) SetToken(token string) {
+	r.token = token
+}
+
+// SetUncleanShutdown tells the broker, with each registration, that the
+// store's previous run did not shut down cleanly. Set it before Register.
+func (r *Registration) SetUncleanShutdown(unclean bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unclean = unclean
+}
+
+// SetCorrupt tells the broker, with each registration, that the store
+// started from a corrupt snapshot and has not recovered its data yet; the
+// broker routes nothing to it and has it recover from its peer. Set it
+// before Register, and clear it before clearing SetWarming.
+func (r *Registration) SetCorrupt(corrupt bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.corrupt = corrupt
+}
+
+// SetWarming records whether the store is still loading its data from its
+// peer; the broker neither reads from a warming store nor gives it new keys.
+// Set it before Register. Clearing it afterwards tells the broker at once.
+func (r *Registration) SetWarming(warming bool) error {
+	r.mu.Lock()
+	was, registered := r.warming, r.registered
+	r.warming = warming
+	r.mu.Unlock()
+	if was && !warming && registered {
+		return r.try(true)
+	}
+	return nil
+}
+
+// Backup returns the address of the store holding the backup of this
+// store's data, as reported by the broker at the last registration, or ""
+// if there is none.
+func (r *Registration) Backup() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.backup
+}
+
+// Broker returns the /register URL of the broker that last accepted the store.
+func (r *Registration) Broker() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.brokers[r.current]
+}
+
+// Register registers the store, trying each broker in turn and backing off
+// between rounds, until one accepts or ctx is done.
+func (r *Registration) Register(ctx context.Context) error {
+	backoff := registerInitialBackoff
+	for {
+		err := r.try(false)
+		if err == nil {
+			return nil
+		}
+		r.logger.Warn("registration failed, retrying", "err", err, "backoff", backoff)
+
+		// Wait between half and all of the backoff, so restarted stores do
+		// not all retry together
+		wait := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("giving up on registration: %w", err)
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, registerMaxBackoff)
+	}
+}
+
+// try makes one attempt on every broker, starting with the current one.
+func (r *Registration) try(heartbeat bool) error {
+	r.mu.Lock()
+	start := r.current
+	opts := registerOptions{replicaOf: r.replicaOf, heartbeat: heartbeat, warming: r.warming, unclean: r.unclean, corrupt: r.corrupt, token: r.token}
+	r.mu.Unlock()
+
+	var errs []error
+	for i := range r.brokers {
+		n := (start + i) % len(r.brokers)
+		backup, err := register(r.brokers[n], r.name, r.addr, opts)
+		if err == nil {
+			r.mu.Lock()
+			if r.current != n {
+				r.logger.Info("switched to broker", "broker", r.brokers[n])
+			}
+			r.current, r.registered, r.backup = n, true, backup
+			r.mu.Unlock()
+			return nil
+		}
+		if errors.Is(err, ErrRemoved) {
+			return err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", r.brokers[n], err))
+	}
+	return errors.Join(errs...)
+}
+
+// StartHeartbeats re-registers the store at the given interval, so a broker
+// that restarted or dropped the store learns of it again. Heartbeats stop
+// when the store has been removed from the cluster, or on Stop.
+func (r *Registration) StartHeartbeats(interval time.Duration) {
+	r.tasks.Start("heartbeats", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := r.try(true)
+			if errors.Is(err, ErrRemoved) {
+				r.logger.Warn("store was removed from the cluster, stopping heartbeats")
+				return
+			}
+			if err != nil {
+				r.logger.Warn("heartbeat failed", "err", err)
+			}
+		}
+	})
+}
+
+// Stop stops the heartbeats, waiting for one in flight, so none arrives
+// after the store deregisters. They cannot be started again.
+func (r *Registration) Stop() {
+	r.tasks.Close()
+}
+
+// Deregister stops the heartbeats and removes the store from the broker that
+// last accepted it.
+func (r *Registration) Deregister() error {
+	r.Stop()
+	return deregister(r.Broker(), r.name, r.token)
+}
@@ -0,0 +1,290 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/httpapi"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultReplicaPollInterval is how often a read replica asks its primary
+// for new changes.
+const DefaultReplicaPollInterval = 200 * time.Millisecond
+
+// replicaPageSize is the number of changes a replica fetches per request.
+const replicaPageSize = 1000
+
+// MaxStalenessHeader on a read from a replica bounds how far behind its
+// primary the replica may be, as a duration such as "5s". A replica further
+// behind answers 503, and the read should go to the primary.
+const MaxStalenessHeader = "X-Max-Staleness"
+
+// errResync means a replica can no longer follow its primary's change feed,
+// e.g. because the primary restarted or changes were evicted, and must copy
+// the primary's data again.
+var errResync = errors.New("replica must resync from primary")
+
+// ReplicaStatus describes how far a read replica is behind its primary.
+type ReplicaStatus struct {
+	// Primary is the address of the store being followed.
+	Primary string `json:"primary"`
+	// Seq is the last change of the primary's feed that was applied.
+	Seq uint64 `json:"seq"`
+	// CaughtUp is when the replica last held every change its primary had.
+	CaughtUp *time.Time `json:"caught_up,omitempty"`
+	// StalenessSeconds is the time since CaughtUp: reads from the replica
+	// may miss writes made on the primary within it. It is -1 until the
+	// replica first catches up.
+	StalenessSeconds float64 `json:"staleness_seconds"`
+	LastError        string  `json:"last_error,omitempty"`
+}
+
+// replication is the state of a store that follows a primary.
+type replication struct {
+	primary string
+
+	mu       sync.Mutex
+	seq      uint64
+	synced   bool // a full copy of the primary has been taken
+	caughtUp time.Time
+	lastErr  error
+}
+
+// FollowPrimary makes the store a read replica of the store at primary
+// (host:port). It copies the primary's data, then applies the primary's
+// change feed, polled every interval, until the store is closed. The store
+// should not be written to otherwise. Call it before the store serves
+// requests.
+func (s *KVStore) FollowPrimary(primary string, interval time.Duration) {
+	r := &replication{primary: primary}
+	s.replica = r
+	s.tasks.Start("replication", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			err := s.pollPrimary(ctx, r)
+			r.mu.Lock()
+			if err != nil && r.lastErr == nil {
+				s.logger.Warn("failed to replicate from primary", "primary", primary, "err", err)
+			}
+			if err != nil {
+				// The primary may have restarted, starting a new change
+				// feed, so copy it again once it is back
+				r.synced = false
+			}
+			r.lastErr = err
+			r.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// IsReplica reports whether the store follows a primary.
+func (s *KVStore) IsReplica() bool {
+	return s.replica != nil
+}
+
+// ReplicaStatus reports how far the store is behind its primary, and false
+// if it is not a replica.
+func (s *KVStore) ReplicaStatus() (ReplicaStatus, bool) {
+	r := s.replica
+	if r == nil {
+		return ReplicaStatus{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := ReplicaStatus{Primary: r.primary, Seq: r.seq, StalenessSeconds: -1}
+	if !r.caughtUp.IsZero() {
+		caughtUp := r.caughtUp
+		status.CaughtUp = &caughtUp
+		status.StalenessSeconds = time.Since(caughtUp).Seconds()
+	}
+	if r.lastErr != nil {
+		status.LastError = r.lastErr.Error()
+	}
+	return status, true
+}
+
+// pollPrimary brings the replica up to date with its primary, copying all
+// of the primary's data first if it cannot follow the change feed.
+func (s *KVStore) pollPrimary(ctx context.Context, r *replication) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r.mu.Lock()
+	synced, seq := r.synced, r.seq
+	r.mu.Unlock()
+	if !synced {
+		var err error
+		if seq, err = s.copyPrimary(ctx, r.primary); err != nil {
+			return err
+		}
+	}
+
+	for {
+		// Changes made before the request are all in its response
+		asked := time.Now()
+		var feed ChangeFeed
+		if err := s.primaryRequest(ctx, r.primary, fmt.Sprintf("/changes?since=%d&limit=%d&replica=%s", seq, replicaPageSize, url.QueryEscape(s.Name)), &feed); err != nil {
+			return err
+		}
+		err := errResync
+		if !feed.Truncated && feed.Next >= seq {
+			seq, err = s.applyChanges(feed.Changes, seq)
+		}
+
+		r.mu.Lock()
+		r.seq, r.synced = seq, err == nil
+		if err == nil && len(feed.Changes) < replicaPageSize {
+			r.caughtUp = asked
+		}
+		r.mu.Unlock()
+		if err != nil || len(feed.Changes) < replicaPageSize {
+			return err
+		}
+	}
+}
+
+// copyPrimary replaces the store's data with the primary's and returns the
+// primary's change sequence number from before the copy. Replaying the
+// changes after it over the copy is safe: they are applied in order, so
+// those already in the copy are simply repeated.
+func (s *KVStore) copyPrimary(ctx context.Context, primary string) (uint64, error) {
+	var feed ChangeFeed
+	if err := s.primaryRequest(ctx, primary, fmt.Sprintf("/changes?since=%d&limit=1", uint64(math.MaxUint64)), &feed); err != nil {
+		return 0, err
+	}
+	var data map[string]string
+	if err := s.primaryRequest(ctx, primary, "/getall", &data); err != nil {
+		return 0, err
+	}
+
+	if data == nil {
+		data = make(map[string]string)
+	}
+	// The primary's tombstones hold its keys' TTL deadlines
+	var tombstones TombstonesResponse
+	if err := s.primaryRequest(ctx, primary, "/tombstones", &tombstones); err != nil {
+		return 0, err
+	}
+	prepared := s.prepareData(data, tombstones.Tombstones)
+	s.mu.Lock()
+	s.replaceData(prepared)
+	s.mu.Unlock()
+	s.logger.Info("copied data from primary", "primary", primary, "keys", len(data), "seq", feed.Next)
+	return feed.Next, nil
+}
+
+// applyChanges applies a page of the primary's change feed and returns the
+// sequence number of the last change applied.
+func (s *KVStore) applyChanges(changes []Change, seq uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, change := range changes {
+		switch change.Op {
+		case OpSet:
+			s.data.put(change.Key, change.Value)
+			delete(s.expiry, change.Key)
+			if change.Expires != nil {
+				s.expiry[change.Key] = *change.Expires
+			}
+			s.publish(OpSet, change.Key, change.Value)
+			if change.Rev != 0 {
+				s.revs[change.Key] = change.Rev
+			}
+		case OpDelete:
+			if _, ok := s.data.get(change.Key); ok {
+				s.data.remove(change.Key)
+				delete(s.expiry, change.Key)
+				s.publish(OpDelete, change.Key, "")
+			}
+		default:
+			// The primary's data was replaced wholesale
+			return seq, errResync
+		}
+		seq = change.Seq
+	}
+	return seq, nil
+}
+
+// primaryRequest GETs path from the primary and decodes the JSON response into out.
+func (s *KVStore) primaryRequest(ctx context.Context, primary, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+primary+httpapi.Version+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.transport.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary returned status %d for %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// replicaWrites are the routes a replica refuses, since its data comes from
+// its primary.
+var replicaWrites = map[string]bool{
+	"/set":      true,
+	"/mset":     true,
+	"/delete":   true,
+	"/expire":   true,
+	"/persist":  true,
+	"/undelete": true,
+}
+
+// replicaGuard refuses writes on a replica, and reads that allow less
+// staleness than the replica has.
+func (h *KVStoreHandler) replicaGuard(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, ok := h.kvstore.ReplicaStatus()
+		if !ok {
+			next(w, r)
+			return
+		}
+		if replicaWrites[route] {
+			httpapi.Error(w, "Store is a read replica of "+status.Primary+"; write to the primary", http.StatusForbidden)
+			return
+		}
+		if bound := r.Header.Get(MaxStalenessHeader); bound != "" {
+			maxStaleness, err := time.ParseDuration(bound)
+			if err != nil {
+				httpapi.Error(w, "Invalid "+MaxStalenessHeader+" header", http.StatusBadRequest)
+				return
+			}
+			if status.StalenessSeconds < 0 || status.StalenessSeconds > maxStaleness.Seconds() {
+				httpapi.Error(w, "Replica is too far behind its primary", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// ReplicaHandler: GET /replica
+// Reports the replica's primary and staleness; 404 if the store is not a replica.
+func (h *KVStoreHandler) ReplicaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, ok := h.kvstore.ReplicaStatus()
+	if !ok {
+		httpapi.Error(w, "Store is not a read replica", http.StatusNotFound)
+		return
+	}
+	jsonResponse(w, status)
+}
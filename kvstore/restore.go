@@ -0,0 +1,262 @@
+package kvstore
+
+import (
+	"fmt"
+	"io"
+	"kv/httpapi"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phases of a snapshot load, as reported by LoadStatus.
+const (
+	LoadIdle     = "idle"     // no snapshot loaded since the store started
+	LoadReading  = "reading"  // decoding the snapshot file
+	LoadIndexing = "indexing" // building the Bloom filter and indexes of the data read
+	LoadDone     = "done"
+	LoadFailed   = "failed"
+)
+
+// LoadStatus describes the store's current or last snapshot load.
+type LoadStatus struct {
+	Phase      string `json:"phase"`
+	File       string `json:"file,omitempty"`
+	BytesRead  int64  `json:"bytes_read"`
+	TotalBytes int64  `json:"total_bytes"`
+	Keys       int64  `json:"keys"`
+	// Progress is the share of the file read, from 0 to 1.
+	Progress float64    `json:"progress"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// loadProgress tracks a snapshot load. It has its own lock, so the status
+// can be read while the load holds fileMu or s.mu.
+type loadProgress struct {
+	mu     sync.Mutex
+	status LoadStatus
+	bytes  atomic.Int64
+	keys   atomic.Int64
+}
+
+func (p *loadProgress) begin(file string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.status = LoadStatus{Phase: LoadReading, File: file, TotalBytes: size, Started: &now}
+	p.bytes.Store(0)
+	p.keys.Store(0)
+}
+
+func (p *loadProgress) setPhase(phase string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Phase = phase
+}
+
+func (p *loadProgress) finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.status.Phase, p.status.Finished = LoadDone, &now
+	if err != nil {
+		p.status.Phase, p.status.Error = LoadFailed, err.Error()
+	}
+}
+
+func (p *loadProgress) get() LoadStatus {
+	p.mu.Lock()
+	status := p.status
+	p.mu.Unlock()
+	if status.Phase == "" {
+		status.Phase = LoadIdle
+	}
+	status.BytesRead, status.Keys = p.bytes.Load(), p.keys.Load()
+	if status.TotalBytes > 0 {
+		status.Progress = min(float64(status.BytesRead)/float64(status.TotalBytes), 1)
+	}
+	return status
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// LoadStatus reports the progress of the current or last snapshot load.
+func (s *KVStore) LoadStatus() LoadStatus {
+	return s.load.get()
+}
+
+// Loading reports whether a snapshot load is under way.
+func (s *KVStore) Loading() bool {
+	phase := s.load.get().Phase
+	return phase == LoadReading || phase == LoadIndexing
+}
+
+// LoadPlan is what loading a snapshot file would change, as reported by a
+// dry run of /load. If the file does not exist the store is left as it is.
+type LoadPlan struct {
+	DryRun bool   `json:"dry_run"`
+	File   string `json:"file"`
+	Exists bool   `json:"exists"`
+	// Keys is the number of keys in the file, which replace the store's
+	// CurrentKeys; Added, Changed, Removed and Unchanged break the change
+	// down by key.
+	Keys        int `json:"keys"`
+	CurrentKeys int `json:"current_keys"`
+	Added       int `json:"added"`
+	Changed     int `json:"changed"`
+	Removed     int `json:"removed"`
+	Unchanged   int `json:"unchanged"`
+}
+
+// PlanLoad reads the snapshot file and compares it with the store's data,
+// reporting what LoadFromDisk would change without changing it.
+func (s *KVStore) PlanLoad(filename string) (LoadPlan, error) {
+	plan := LoadPlan{DryRun: true, File: filename}
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.mu.RLock()
+			plan.CurrentKeys = s.data.len()
+			s.mu.RUnlock()
+			plan.Unchanged = plan.CurrentKeys
+			return plan, nil
+		}
+		return plan, fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer file.Close()
+	data, _, err := decodeSnapshot(filename, file, nil)
+	if err != nil {
+		return plan, fmt.Errorf("failed to decode JSON data: %w", err)
+	}
+
+	plan.Exists, plan.Keys = true, len(data)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	plan.CurrentKeys = s.data.len()
+	for key, value := range data {
+		switch current, ok := s.data.get(key); {
+		case !ok:
+			plan.Added++
+		case current != value:
+			plan.Changed++
+		default:
+			plan.Unchanged++
+		}
+	}
+	plan.Removed = plan.CurrentKeys - plan.Changed - plan.Unchanged
+	return plan, nil
+}
+
+// preparedData is a map about to replace the store's data, with its Bloom
+// filter and indexes built ahead of the swap.
+type preparedData struct {
+	data    *dataMap
+	expiry  map[string]time.Time
+	bloom   bloomState
+	indexes map[string]*secondaryIndex
+}
+
+// prepareData builds the Bloom filter and indexes of data without holding
+// s.mu, so the store keeps serving its current data meanwhile. Keys with a
+// deadline in expiry keep it; the others get the default TTL, if any.
+func (s *KVStore) prepareData(data map[string]string, expiry map[string]time.Time) *preparedData {
+	s.mu.RLock()
+	specs := make([]IndexSpec, 0, len(s.indexes))
+	for _, idx := range s.indexes {
+		specs = append(specs, idx.spec)
+	}
+	ttl := s.defaultTTL
+	s.mu.RUnlock()
+
+	p := &preparedData{data: newDataMap(data), expiry: make(map[string]time.Time)}
+	deadline := time.Now().Add(ttl)
+	for key := range data {
+		if at, ok := expiry[key]; ok {
+			p.expiry[key] = at
+		} else if ttl > 0 {
+			// Keys loaded without one are written anew, so they get the default TTL
+			p.expiry[key] = deadline
+		}
+	}
+	p.bloom = bloomOf(p.data)
+	p.indexes = make(map[string]*secondaryIndex, len(specs))
+	for _, spec := range specs {
+		p.indexes[spec.Name] = indexData(spec, p.data)
+	}
+	return p
+}
+
+// replaceData swaps in prepared data, with the TTLs the keys were prepared
+// with. Only indexes created or changed since it was prepared are built
+// while s.mu is held. s.mu must be held.
+func (s *KVStore) replaceData(p *preparedData) {
+	p.bloom.filter.Version = s.bloom.filter.Version + 1
+	s.data, s.expiry, s.bloom = p.data, p.expiry, p.bloom
+	s.revs, s.loadedRev = make(map[string]uint64), nextRevision()
+	for name, idx := range s.indexes {
+		if built, ok := p.indexes[name]; ok && built.spec == idx.spec {
+			s.indexes[name] = built
+		} else {
+			s.indexes[name] = s.buildIndex(idx.spec)
+		}
+	}
+	s.compaction.capacity = p.data.len()
+	s.record(OpReset, "", "")
+}
+
+// LoadStatusHandler: GET /load-status
+// Reports the progress of the current or last snapshot load: phase, bytes read of the file's size and keys decoded.
+func (h *KVStoreHandler) LoadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.kvstore.LoadStatus())
+}
+
+// SetRestoring records whether the store is restoring its snapshot at
+// startup. Until it is done, only health, version and load status are
+// served, so neither clients nor the peer backing the store up mistake it
+// for empty. Loads through /load later keep serving the current data until
+// the new data is swapped in.
+func (h *KVStoreHandler) SetRestoring(restoring bool) {
+	h.restoring.Store(restoring)
+}
+
+// loadingGuard answers 503 to all but loadingRoutes while the store
+// restores its snapshot at startup.
+func (h *KVStoreHandler) loadingGuard(route string, next http.HandlerFunc) http.HandlerFunc {
+	if loadingRoutes[route] {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.restoring.Load() {
+			w.Header().Set("Retry-After", "1")
+			httpapi.Error(w, "Store is restoring its snapshot", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// loadingRoutes are served while the store loads its snapshot at startup.
+var loadingRoutes = map[string]bool{
+	"/healthz":     true,
+	"/readyz":      true,
+	"/version":     true,
+	"/load-status": true,
+}
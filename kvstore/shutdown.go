@@ -0,0 +1,145 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"kv/httpapi"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shutdownControl lets an authenticated caller stop the store's server.
+type shutdownControl struct {
+	token string
+	once  sync.Once
+	stop  func()
+}
+
+// EnableShutdown turns on the /shutdown endpoint, which the broker calls when
+// it removes the store. Requests must carry "Authorization: Bearer <token>";
+// with an empty token every request is refused. stop is called once, after
+// the response is sent, and should stop the server gracefully and save a
+// final snapshot. It must be called before the routes are registered.
+func (h *KVStoreHandler) EnableShutdown(token string, stop func()) {
+	h.shutdown = &shutdownControl{token: token, stop: stop}
+}
+
+// authorized reports whether r carries the bearer token.
+func (c *shutdownControl) authorized(r *http.Request) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && c.token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(c.token)) == 1
+}
+
+// ShutdownHandler: POST /shutdown
+// Stops serving new requests, lets in-flight ones finish, saves a final
+// snapshot and exits. Requires the admin token.
+func (h *KVStoreHandler) ShutdownHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.shutdown.token == "" {
+		httpapi.Error(w, "Shutdown is disabled: no admin token configured", http.StatusForbidden)
+		return
+	}
+	if !h.shutdown.authorized(r) {
+		h.logger.Warn("rejected unauthenticated shutdown request", "remote", r.RemoteAddr)
+		httpapi.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	h.draining.Store(true)
+	h.logger.Info("shutting down on request", "remote", r.RemoteAddr)
+	jsonResponse(w, map[string]string{"status": "shutting down"})
+	http.NewResponseController(w).Flush()
+	// The server waits for this request during a graceful stop, so stop it
+	// from another goroutine
+	go h.shutdown.once.Do(h.shutdown.stop)
+}
+
+// runningMarker is the file that is present in the data directory while
+// the store runs. Finding it at startup means the previous run crashed or
+// was killed, and lost the writes made since its last snapshot.
+func (s *KVStore) runningMarker() string {
+	return s.DataPath(s.Name + ".running")
+}
+
+// runningMarkerInfo is the content of the running marker, for diagnosis.
+type runningMarkerInfo struct {
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+}
+
+// MarkRunning writes the running marker, removed by Close once the final
+// snapshot is saved, and reports whether the previous run left its marker
+// behind: whether it did not shut down cleanly.
+func (s *KVStore) MarkRunning() (bool, error) {
+	path := s.runningMarker()
+	if data, err := os.ReadFile(path); err == nil {
+		var prev runningMarkerInfo
+		json.Unmarshal(data, &prev)
+		s.uncleanShutdown.Store(true)
+		s.logger.Warn("previous run did not shut down cleanly, writes since its last snapshot may be lost", "pid", prev.PID, "started", prev.Started)
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	data, err := json.Marshal(runningMarkerInfo{PID: os.Getpid(), Started: time.Now()})
+	if err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return false, err
+	}
+	return s.uncleanShutdown.Load(), nil
+}
+
+// markStopped removes the running marker after a clean shutdown.
+func (s *KVStore) markStopped() error {
+	if err := os.Remove(s.runningMarker()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// UncleanShutdown reports whether the store's previous run did not shut down
+// cleanly.
+func (s *KVStore) UncleanShutdown() bool {
+	return s.uncleanShutdown.Load()
+}
+
+// BackUpPeersRequest is the optional body of POST /backup-peers.
+type BackUpPeersRequest struct {
+	// Peer, if set, is the address (host:port) of the one store to back
+	// up, such as a store about to shut down.
+	Peer string `json:"peer,omitempty"`
+}
+
+// RequestFinalBackup asks the store holding the backup of this store's data,
+// at holder (host:port), to back it up now, so the backup is current when
+// this store stops. It is called while the store still serves /peer-backup.
+func (s *KVStore) RequestFinalBackup(ctx context.Context, holder string) error {
+	body, err := json.Marshal(BackUpPeersRequest{Peer: s.IPAddress})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+holder+httpapi.Version+"/backup-peers", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.transport.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backup-peers returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
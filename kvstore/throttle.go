@@ -0,0 +1,46 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"kv/httpapi"
+	"kv/qos"
+	"net/http"
+)
+
+// SetBackgroundLimit paces the store's background work from now on:
+// periodic and manual snapshots, serving its data to the peer backing it up,
+// writing the backups it holds and handing its keys off. Reads and writes by
+// clients are never paced.
+func (s *KVStore) SetBackgroundLimit(limit qos.Limit) {
+	s.background.SetLimit(limit)
+	s.logger.Info("background limit set", "bytes_per_second", limit.BytesPerSecond, "ops_per_second", limit.OpsPerSecond,
+		"disk_bytes_per_second", limit.DiskBytesPerSecond, "off_peak", limit.OffPeak)
+}
+
+// BackgroundLimit returns the pace of the store's background work.
+func (s *KVStore) BackgroundLimit() qos.Limit {
+	return s.background.Limit()
+}
+
+// BackgroundLimitHandler: GET /background-limit, POST /background-limit {"bytes_per_second": 1048576, "ops_per_second": 5000}
+// Reports or sets the pace of the store's background work; zero fields are not limited.
+func (h *KVStoreHandler) BackgroundLimitHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var limit qos.Limit
+		if err := json.NewDecoder(r.Body).Decode(&limit); err != nil {
+			httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := limit.Validate(); err != nil {
+			httpapi.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.kvstore.SetBackgroundLimit(limit)
+	default:
+		httpapi.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, h.kvstore.BackgroundLimit())
+}
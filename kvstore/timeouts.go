@@ -0,0 +1,59 @@
+package kvstore
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// DefaultPeerTimeout bounds each call a store makes to another store: a
+// peer backup, a batch of a handoff or a replica's poll of its primary.
+const DefaultPeerTimeout = 2 * time.Minute
+
+// ServerTimeouts bound how long a client may take over each part of a
+// request, so a slow or stalled client cannot hold a connection, and the
+// goroutine serving it, forever. Zero turns a timeout off.
+type ServerTimeouts struct {
+	// ReadHeader bounds reading the request line and headers.
+	ReadHeader Duration `json:"read_header,omitempty"`
+	// Read bounds reading the whole request, body included.
+	Read Duration `json:"read,omitempty"`
+	// Write bounds producing and writing the response. Routes that stream
+	// or run long, such as /watch and /handoff, are exempt.
+	Write Duration `json:"write,omitempty"`
+	// Idle bounds how long a keep-alive connection waits for its next request.
+	Idle Duration `json:"idle,omitempty"`
+}
+
+// DefaultServerTimeouts returns the timeouts used for those neither in the
+// config file nor given as flags.
+func DefaultServerTimeouts() ServerTimeouts {
+	return ServerTimeouts{
+		ReadHeader: Duration(10 * time.Second),
+		Read:       Duration(time.Minute),
+		Write:      Duration(2 * time.Minute),
+		Idle:       Duration(2 * time.Minute),
+	}
+}
+
+// Validate reports a negative timeout.
+func (t ServerTimeouts) Validate() error {
+	if t.ReadHeader < 0 || t.Read < 0 || t.Write < 0 || t.Idle < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	return nil
+}
+
+// Apply sets the timeouts on srv.
+func (t ServerTimeouts) Apply(srv *http.Server) {
+	srv.ReadHeaderTimeout = time.Duration(t.ReadHeader)
+	srv.ReadTimeout = time.Duration(t.Read)
+	srv.WriteTimeout = time.Duration(t.Write)
+	srv.IdleTimeout = time.Duration(t.Idle)
+}
+
+// SetPeerTimeout bounds each call the store makes to another store. Call it
+// before the store serves requests.
+func (s *KVStore) SetPeerTimeout(d time.Duration) {
+	s.SetTransport(&http.Client{Timeout: d})
+}
@@ -0,0 +1,358 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv/httpapi"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Tombstones: a store remembers when it deleted each key, or the key
+// expired, until the key is written again or the tombstone is purged.
+// The stores backing it up copy its tombstones with every backup, and the
+// broker tells them of the keys it deletes as it deletes them; they keep
+// them in peerof<name>.<peer>.tombstones.json. Merging a backup leaves out
+// the keys removed since it was taken, so a store taking over a dead peer's
+// keys does not bring back those the peer deleted after its last backup. A
+// tombstone dated in the future is the TTL deadline of a key: the key is
+// merged with the time it has left, and left out once that has passed.
+//
+// A tombstone is purged once it is older than the store's horizon and every
+// store copying the store's data has acknowledged it: the stores backing it
+// up by fetching the tombstones, its read replicas by reading the change
+// feed past the deletion. One not heard from for a horizon no longer holds
+// tombstones back; it copies the store's data afresh when it returns.
+
+// DefaultTombstoneHorizon is how long a tombstone is kept at least. A backup
+// older than that may bring back keys deleted since; backups are taken far
+// more often.
+const DefaultTombstoneHorizon = 24 * time.Hour
+
+// tombstoneState is the store's tombstones and what its backup holders and
+// replicas have acknowledged of them.
+type tombstoneState struct {
+	at      map[string]time.Time // when each key was removed
+	horizon time.Duration        // zero means DefaultTombstoneHorizon
+	// consumers are the backup holders and replicas by name
+	consumers map[string]tombstoneConsumer
+}
+
+// tombstoneConsumer is a store copying this store's data.
+type tombstoneConsumer struct {
+	acked time.Time // it has every tombstone dated before
+	seen  time.Time
+}
+
+func (t *tombstoneState) horizonOrDefault() time.Duration {
+	if t.horizon <= 0 {
+		return DefaultTombstoneHorizon
+	}
+	return t.horizon
+}
+
+// tombstonesPath is the tombstone file kept next to the backup file at path.
+func tombstonesPath(path string) string {
+	return snapshotBase(path) + ".tombstones.json"
+}
+
+// readTombstones reads the tombstones kept next to the backup file at path.
+// fileMu must be held.
+func readTombstones(path string) (map[string]time.Time, error) {
+	tombstones := make(map[string]time.Time)
+	data, err := os.ReadFile(tombstonesPath(path))
+	if os.IsNotExist(err) {
+		return tombstones, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &tombstones); err != nil {
+		return nil, fmt.Errorf("failed to decode tombstones: %w", err)
+	}
+	return tombstones, nil
+}
+
+// writeTombstones replaces the tombstones kept next to the backup file at
+// path, removing the file if there are none. fileMu must be held.
+func writeTombstones(path string, tombstones map[string]time.Time) error {
+	if len(tombstones) == 0 {
+		if err := os.Remove(tombstonesPath(path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(tombstones)
+	if err != nil {
+		return err
+	}
+	tmp := tombstonesPath(path) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, tombstonesPath(path))
+}
+
+// noteTombstoneLocked brings the store's tombstones up to date with a
+// mutation of key at the given time. s.mu must be held.
+func (s *KVStore) noteTombstoneLocked(op, key string, at time.Time) {
+	switch op {
+	case OpDelete:
+		if s.tombstones.at == nil {
+			s.tombstones.at = make(map[string]time.Time)
+		}
+		s.tombstones.at[key] = at
+	case OpSet:
+		delete(s.tombstones.at, key)
+	}
+}
+
+// SetTombstoneHorizon sets how long tombstones are kept at least; zero
+// restores DefaultTombstoneHorizon.
+func (s *KVStore) SetTombstoneHorizon(horizon time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tombstones.horizon = horizon
+}
+
+// ackTombstones records that the named backup holder or replica has every
+// tombstone dated before acked.
+func (s *KVStore) ackTombstones(consumer string, acked time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tombstones.consumers == nil {
+		s.tombstones.consumers = make(map[string]tombstoneConsumer)
+	}
+	c := s.tombstones.consumers[consumer]
+	if acked.After(c.acked) {
+		c.acked = acked
+	}
+	c.seen = time.Now()
+	s.tombstones.consumers[consumer] = c
+}
+
+// ackReplica records that the named replica has applied the store's changes
+// up to since, and with them the tombstones dated before the next.
+func (s *KVStore) ackReplica(replica string, since uint64) {
+	s.mu.RLock()
+	before, ok := s.changes.appliedBefore(since, time.Now())
+	s.mu.RUnlock()
+	if ok {
+		s.ackTombstones(replica, before)
+	}
+}
+
+// PurgeTombstones drops the tombstones older than the horizon that every
+// backup holder and replica heard from within it has acknowledged, and
+// returns how many were dropped.
+func (s *KVStore) PurgeTombstones() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	horizon := s.tombstones.horizonOrDefault()
+	acked := now
+	for name, c := range s.tombstones.consumers {
+		if now.Sub(c.seen) > horizon {
+			delete(s.tombstones.consumers, name)
+			s.logger.Info("tombstones no longer held for silent consumer", "consumer", name, "last_seen", c.seen)
+			continue
+		}
+		if c.acked.Before(acked) {
+			acked = c.acked
+		}
+	}
+	purged := 0
+	for key, at := range s.tombstones.at {
+		if now.Sub(at) > horizon && at.Before(acked) {
+			delete(s.tombstones.at, key)
+			purged++
+		}
+	}
+	s.tombstonesPurged.Add(float64(purged))
+	return purged
+}
+
+// tombstoneCounts returns the number of tombstones held, and how many of
+// them are past the horizon but not yet acknowledged by every consumer.
+func (s *KVStore) tombstoneCounts() (held, awaiting int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	horizon := s.tombstones.horizonOrDefault()
+	for _, at := range s.tombstones.at {
+		if now.Sub(at) > horizon {
+			awaiting++
+		}
+	}
+	return len(s.tombstones.at), awaiting
+}
+
+// Tombstones returns when each key the store removed was removed, and when
+// each key with a TTL will be.
+func (s *KVStore) Tombstones() map[string]time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tombstones := make(map[string]time.Time, len(s.tombstones.at)+len(s.expiry))
+	for key, at := range s.tombstones.at {
+		tombstones[key] = at
+	}
+	for key, deadline := range s.expiry {
+		tombstones[key] = deadline
+	}
+	return tombstones
+}
+
+// RecordPeerTombstones records that keys were deleted from the named peer,
+// each at the time given.
+func (s *KVStore) RecordPeerTombstones(peer string, deleted map[string]time.Time) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	path := s.PeerBackupPath(peer)
+	tombstones, err := readTombstones(path)
+	if err != nil {
+		return err
+	}
+	for key, at := range deleted {
+		if prev, exists := tombstones[key]; !exists || at.After(prev) {
+			tombstones[key] = at
+		}
+	}
+	return writeTombstones(path, tombstones)
+}
+
+// fetchPeerTombstones asks the peer at addr (host:port) for its tombstones.
+func (s *KVStore) fetchPeerTombstones(ctx context.Context, addr string) (map[string]time.Time, error) {
+	var resp TombstonesResponse
+	if err := s.primaryRequest(ctx, addr, "/tombstones?holder="+url.QueryEscape(s.Name), &resp); err != nil {
+		return nil, err
+	}
+	return resp.Tombstones, nil
+}
+
+// pruneTombstones updates the tombstones kept next to the backup file at
+// path for a backup of the peer's data as of taken: those the backup
+// already reflects are dropped, and the TTL deadlines are replaced by the
+// peer's, whose tombstones are added. fileMu must be held.
+func pruneTombstones(path string, taken time.Time, peer map[string]time.Time) error {
+	tombstones, err := readTombstones(path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for key, at := range tombstones {
+		if at.Before(taken) || at.After(now) {
+			delete(tombstones, key)
+		}
+	}
+	for key, at := range peer {
+		if !at.Before(taken) {
+			tombstones[key] = at
+		}
+	}
+	return writeTombstones(path, tombstones)
+}
+
+// applyTombstones leaves out of data, a backup taken at taken, the keys
+// removed since, and returns the deadlines of the keys in it that have a
+// TTL. fileMu must be held.
+func applyTombstones(path string, taken time.Time, data map[string]string) (dropped int, deadlines map[string]time.Time, err error) {
+	tombstones, err := readTombstones(path)
+	if err != nil || len(tombstones) == 0 {
+		return 0, nil, err
+	}
+	dropped, deadlines = applyTombstoneTimes(tombstones, taken, data)
+	return dropped, deadlines, nil
+}
+
+// applyTombstoneTimes is applyTombstones with the tombstones at hand.
+func applyTombstoneTimes(tombstones map[string]time.Time, taken time.Time, data map[string]string) (dropped int, deadlines map[string]time.Time) {
+	now := time.Now()
+	deadlines = make(map[string]time.Time)
+	for key, at := range tombstones {
+		if _, exists := data[key]; !exists {
+			continue
+		}
+		switch {
+		case at.After(now):
+			deadlines[key] = at
+		case !at.Before(taken):
+			delete(data, key)
+			dropped++
+		}
+	}
+	return dropped, deadlines
+}
+
+// peerBackupTombstones returns the tombstones and TTL deadlines kept with
+// the newest backup held of the store at addr.
+func (s *KVStore) peerBackupTombstones(addr string) (map[string]time.Time, error) {
+	if addr == "" {
+		return nil, ErrNoPeerBackup
+	}
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	backup, err := s.findPeerBackup("", addr)
+	if err != nil {
+		return nil, err
+	}
+	return readTombstones(backup.path)
+}
+
+// TombstonesResponse is the response of GET /tombstones.
+type TombstonesResponse struct {
+	// Tombstones holds when each key was deleted or expired, or will
+	// expire.
+	Tombstones map[string]time.Time `json:"tombstones"`
+}
+
+// TombstonesRequest is the body of POST /tombstones.
+type TombstonesRequest struct {
+	Peer string   `json:"peer"`
+	Keys []string `json:"keys"`
+	// Deleted holds keys deleted earlier, with when, e.g. while this store
+	// was down. Keys are recorded as deleted now.
+	Deleted map[string]time.Time `json:"deleted,omitempty"`
+}
+
+// TombstonesHandler: GET /tombstones?holder=<name>, POST /tombstones {"peer": "store2", "keys": ["a", "b"]}
+// GET comes from a peer backing this store up, with its backup, and acknowledges the tombstones sent; POST from the
+// broker, after it deleted keys on a store this one backs up, or once this one is back for keys deleted while it was
+// down.
+func (h *KVStoreHandler) TombstonesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		asked := time.Now()
+		jsonResponse(w, TombstonesResponse{Tombstones: h.kvstore.Tombstones()})
+		if holder := r.URL.Query().Get("holder"); holder != "" {
+			h.kvstore.ackTombstones(holder, asked)
+		}
+	case http.MethodPost:
+		var req TombstonesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Peer == "" {
+			httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		deleted := make(map[string]time.Time, len(req.Keys)+len(req.Deleted))
+		for key, at := range req.Deleted {
+			if at.After(now) {
+				at = now
+			}
+			deleted[key] = at
+		}
+		for _, key := range req.Keys {
+			deleted[key] = now
+		}
+		if err := h.kvstore.RecordPeerTombstones(req.Peer, deleted); err != nil {
+			h.logger.Error("failed to record tombstones", "peer", req.Peer, "err", err)
+			httpapi.Error(w, "Failed to record tombstones", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, map[string]int{"keys": len(deleted)})
+	default:
+		httpapi.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,218 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"kv/httpapi"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Trash: with a trash retention set, a store keeps the keys deleted through
+// /delete and /delete-prefix, with their values, for that long, so they can
+// be restored with /undelete. Keys moved off the store, expired or
+// overwritten are not kept, and a store in cache mode keeps none since its
+// origin holds the data. The trash is held in memory only: it is neither in
+// snapshots nor in peer backups, so a restart or a failover empties it.
+
+// trashState is the store's deleted keys awaiting restore or purge.
+type trashState struct {
+	retention time.Duration // zero when soft delete is off
+	entries   map[string]trashEntry
+}
+
+type trashEntry struct {
+	value   string
+	deleted time.Time
+}
+
+// TrashedKey is a deleted key held in a store's trash.
+type TrashedKey struct {
+	Key     string    `json:"key"`
+	Bytes   int       `json:"bytes"` // of the value
+	Deleted time.Time `json:"deleted"`
+	Expires time.Time `json:"expires"` // when it is purged
+}
+
+// SetTrashRetention turns soft delete on, keeping deleted keys restorable for
+// retention, or off with zero, which empties the trash. Keys already in the
+// trash are purged by the new retention.
+func (s *KVStore) SetTrashRetention(retention time.Duration) {
+	s.mu.Lock()
+	s.trash.retention = max(retention, 0)
+	if s.trash.retention == 0 {
+		s.trash.entries = nil
+	}
+	s.mu.Unlock()
+	if retention > 0 {
+		s.logger.Info("soft delete enabled", "retention", retention)
+	}
+}
+
+// TrashRetention returns how long deleted keys are kept, or zero if they
+// are not.
+func (s *KVStore) TrashRetention() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.trash.retention
+}
+
+// trashLocked keeps key, just deleted with value, in the trash if soft
+// delete is on. s.mu must be held.
+func (s *KVStore) trashLocked(key, value string, now time.Time) {
+	if s.trash.retention <= 0 || s.cache != nil {
+		return
+	}
+	if s.trash.entries == nil {
+		s.trash.entries = make(map[string]trashEntry)
+	}
+	s.trash.entries[key] = trashEntry{value: value, deleted: now}
+}
+
+// Trash returns the keys starting with prefix held in the trash, in key
+// order.
+func (s *KVStore) Trash(prefix string) []TrashedKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	keys := make([]TrashedKey, 0)
+	for key, e := range s.trash.entries {
+		expires := e.deleted.Add(s.trash.retention)
+		if !strings.HasPrefix(key, prefix) || !now.Before(expires) {
+			continue
+		}
+		keys = append(keys, TrashedKey{Key: key, Bytes: len(e.value), Deleted: e.deleted, Expires: expires})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	return keys
+}
+
+// Undelete restores keys from the trash and returns the pairs restored. A
+// key no longer in the trash, or written again since it was deleted, is
+// skipped; one written again stays in the trash until purged.
+func (s *KVStore) Undelete(keys []string) (restored map[string]string, skipped []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	restored = make(map[string]string)
+	for _, key := range keys {
+		e, ok := s.undeletableLocked(key, now)
+		if !ok {
+			skipped = append(skipped, key)
+			continue
+		}
+		delete(s.trash.entries, key)
+		s.data.put(key, e.value)
+		s.resetExpiryLocked(key, now)
+		s.publish(OpSet, key, e.value)
+		restored[key] = e.value
+	}
+	return restored, skipped
+}
+
+// Restorable returns the pairs Undelete would restore for keys, without
+// restoring them, and the keys it would skip.
+func (s *KVStore) Restorable(keys []string) (values map[string]string, skipped []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	values = make(map[string]string)
+	for _, key := range keys {
+		e, ok := s.undeletableLocked(key, now)
+		if !ok {
+			skipped = append(skipped, key)
+			continue
+		}
+		values[key] = e.value
+	}
+	return values, skipped
+}
+
+// undeletableLocked returns the trash entry of key if it can be restored:
+// it is still in the trash and has not been written again. s.mu must be
+// held.
+func (s *KVStore) undeletableLocked(key string, now time.Time) (trashEntry, bool) {
+	e, ok := s.trash.entries[key]
+	if !ok || !now.Before(e.deleted.Add(s.trash.retention)) {
+		return trashEntry{}, false
+	}
+	if _, exists := s.data.get(key); exists && !s.expiredLocked(key, now) {
+		return trashEntry{}, false
+	}
+	return e, true
+}
+
+// PurgeTrash drops the keys kept in the trash for longer than the retention
+// and returns how many were dropped.
+func (s *KVStore) PurgeTrash() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	purged := 0
+	for key, e := range s.trash.entries {
+		if !now.Before(e.deleted.Add(s.trash.retention)) {
+			delete(s.trash.entries, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// TrashResponse is the response of a store's GET /trash.
+type TrashResponse struct {
+	Retention Duration     `json:"retention"`
+	Keys      []TrashedKey `json:"keys"`
+}
+
+// UndeleteRequest is the body of a store's POST /undelete.
+type UndeleteRequest struct {
+	Keys []string `json:"keys"`
+	// DryRun returns the pairs that would be restored without restoring
+	// them.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// UndeleteResponse is the response of a store's POST /undelete.
+type UndeleteResponse struct {
+	Restored map[string]string `json:"restored"`
+	Skipped  []string          `json:"skipped,omitempty"`
+}
+
+// TrashHandler: GET /trash?prefix=<p>
+// Lists the deleted keys held in the trash, with when each is purged.
+func (h *KVStoreHandler) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, TrashResponse{
+		Retention: Duration(h.kvstore.TrashRetention()),
+		Keys:      h.kvstore.Trash(r.URL.Query().Get("prefix")),
+	})
+}
+
+// UndeleteHandler: POST /undelete { "keys": ["...", ...], "dry_run": false }
+// Restores keys from the trash, skipping those no longer in it or written
+// again since. A dry run returns what would be restored.
+func (h *KVStoreHandler) UndeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpapi.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req UndeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.DryRun {
+		values, skipped := h.kvstore.Restorable(req.Keys)
+		jsonResponse(w, UndeleteResponse{Restored: values, Skipped: skipped})
+		return
+	}
+	restored, skipped := h.kvstore.Undelete(req.Keys)
+	if len(restored) > 0 {
+		h.logger.Info("keys restored from trash", "keys", len(restored))
+	}
+	jsonResponse(w, UndeleteResponse{Restored: restored, Skipped: skipped})
+}
@@ -0,0 +1,175 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kv/httpapi"
+	"net/http"
+	"time"
+)
+
+// ErrKeyNotFound is returned by reads, deletes and TTL operations on a key
+// that does not exist.
+var ErrKeyNotFound = errors.New("key not found")
+
+// expiredLocked reports whether key has a deadline that has passed. Expired
+// keys are invisible to reads until the expiry sweeper removes them.
+// s.mu must be held.
+func (s *KVStore) expiredLocked(key string, now time.Time) bool {
+	deadline, ok := s.expiry[key]
+	return ok && !now.Before(deadline)
+}
+
+// Expire sets key to be deleted after ttl, overriding the store's default
+// TTL. Setting the key again gives it the default TTL, or none if the store
+// has none; deleting it clears its TTL. The change feed records it as a set
+// of the key's value with its new deadline, so replicas take it too.
+func (s *KVStore) Expire(key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	value, ok := s.data.get(key)
+	if !ok || s.expiredLocked(key, now) {
+		return ErrKeyNotFound
+	}
+	if s.expiry == nil {
+		s.expiry = make(map[string]time.Time)
+	}
+	s.expiry[key] = now.Add(ttl)
+	s.record(OpSet, key, value)
+	return nil
+}
+
+// TTL returns the time left before key expires. ok is false if the key has no TTL.
+func (s *KVStore) TTL(key string) (ttl time.Duration, ok bool, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	if _, exists := s.data.get(key); !exists || s.expiredLocked(key, now) {
+		return 0, false, ErrKeyNotFound
+	}
+	deadline, ok := s.expiry[key]
+	if !ok {
+		return 0, false, nil
+	}
+	return deadline.Sub(now), true, nil
+}
+
+// Persist removes key's TTL. It reports whether the key had one.
+func (s *KVStore) Persist(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.data.get(key)
+	if !ok || s.expiredLocked(key, time.Now()) {
+		return false, ErrKeyNotFound
+	}
+	_, had := s.expiry[key]
+	if had {
+		delete(s.expiry, key)
+		s.record(OpSet, key, value)
+	}
+	return had, nil
+}
+
+// DeleteExpired removes every key whose TTL has passed and returns how many were removed.
+func (s *KVStore) DeleteExpired() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	removed := 0
+	for key, deadline := range s.expiry {
+		if now.Before(deadline) {
+			continue
+		}
+		delete(s.expiry, key)
+		if _, ok := s.data.get(key); ok {
+			s.data.remove(key)
+			s.publish(OpExpire, key, "")
+			removed++
+		}
+	}
+	return removed
+}
+
+// StartExpiry starts a goroutine that deletes expired keys and purges
+// tombstones and the trash at the given interval, replacing the one already
+// running.
+func (s *KVStore) StartExpiry(interval time.Duration) {
+	s.tasks.Start("expiry", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if removed := s.DeleteExpired(); removed > 0 {
+				s.logger.Debug("expired keys removed", "keys", removed)
+			}
+			if purged := s.PurgeTombstones(); purged > 0 {
+				s.logger.Debug("tombstones purged", "tombstones", purged)
+			}
+			if purged := s.PurgeTrash(); purged > 0 {
+				s.logger.Debug("trash purged", "keys", purged)
+			}
+		}
+	})
+}
+
+// SetDefaultTTL gives every key written from now on a TTL of ttl, which
+// Expire and Persist can override key by key; zero lets keys live until
+// deleted. Keys already held keep their TTL, or lack of one.
+func (s *KVStore) SetDefaultTTL(ttl time.Duration) {
+	s.mu.Lock()
+	s.defaultTTL = ttl
+	s.mu.Unlock()
+	s.logger.Info("default TTL set", "ttl", ttl)
+}
+
+// DefaultTTL returns the TTL keys written to the store are given, or zero.
+func (s *KVStore) DefaultTTL() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.defaultTTL
+}
+
+// resetExpiryLocked gives key, just written, the store's default TTL or
+// else none. s.mu must be held.
+func (s *KVStore) resetExpiryLocked(key string, now time.Time) {
+	if s.defaultTTL <= 0 {
+		delete(s.expiry, key)
+		return
+	}
+	s.expiry[key] = now.Add(s.defaultTTL)
+}
+
+// DefaultTTLRequest sets a store's default TTL in whole seconds; zero
+// removes it.
+type DefaultTTLRequest struct {
+	Seconds int `json:"seconds"`
+}
+
+// DefaultTTLHandler: GET /default-ttl, POST /default-ttl {"seconds": 86400}
+// Reports or sets the TTL keys written to the store are given unless set otherwise; 0 means none.
+func (h *KVStoreHandler) DefaultTTLHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req DefaultTTLRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Seconds < 0 {
+			httpapi.Error(w, "seconds must not be negative", http.StatusBadRequest)
+			return
+		}
+		h.kvstore.SetDefaultTTL(time.Duration(req.Seconds) * time.Second)
+	default:
+		httpapi.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, DefaultTTLRequest{Seconds: int(h.kvstore.DefaultTTL() / time.Second)})
+}
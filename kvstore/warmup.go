@@ -0,0 +1,196 @@
+package kvstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"kv/codec"
+	"kv/httpapi"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultWarmUpTimeout bounds how long a starting store waits for the
+// backup of its data before serving what it has.
+const DefaultWarmUpTimeout = 30 * time.Second
+
+// BackupTimeHeader carries the time a peer backup was taken, in RFC 3339
+// format with nanoseconds.
+const BackupTimeHeader = "X-Backup-Time"
+
+// lockedFile is a file read under fileMu, which Close releases.
+type lockedFile struct {
+	*os.File
+	mu *sync.Mutex
+}
+
+func (f lockedFile) Close() error {
+	defer f.mu.Unlock()
+	return f.File.Close()
+}
+
+// openPeerBackup opens the newest backup held of the store at addr and
+// returns its metadata. The file cannot be rewritten until it is closed.
+func (s *KVStore) openPeerBackup(addr string) (lockedFile, PeerBackupMeta, error) {
+	if addr == "" {
+		return lockedFile{}, PeerBackupMeta{}, ErrNoPeerBackup
+	}
+	s.fileMu.Lock()
+	backup, err := s.findPeerBackup("", addr)
+	if err != nil {
+		s.fileMu.Unlock()
+		return lockedFile{}, backup.meta, err
+	}
+	file, err := os.Open(backup.path)
+	if err != nil {
+		s.fileMu.Unlock()
+		if os.IsNotExist(err) {
+			return lockedFile{}, backup.meta, ErrNoPeerBackup
+		}
+		return lockedFile{}, backup.meta, err
+	}
+	return lockedFile{file, &s.fileMu}, backup.meta, nil
+}
+
+// WarmUp loads the store's data from the backup its peer holds at holder
+// (host:port), if that backup is newer than the snapshot the store started
+// from. It reports whether the backup was loaded. The backup is decoded as it
+// streams in and replaces the store's data once complete; LoadStatus reports
+// its progress.
+func (s *KVStore) WarmUp(ctx context.Context, holder string) (bool, error) {
+	return s.pullBackup(ctx, holder, false)
+}
+
+// pullBackup is WarmUp, loading the backup however old it is if always is
+// set.
+func (s *KVStore) pullBackup(ctx context.Context, holder string, always bool) (loaded bool, err error) {
+	path := "/backup?of=" + url.QueryEscape(s.IPAddress)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+holder+httpapi.Version+path, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", s.codec.ContentType())
+	resp, err := s.transport.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		s.logger.Info("peer holds no backup of this store, serving local data", "holder", holder)
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("backup holder returned status %d", resp.StatusCode)
+	}
+
+	taken, err := time.Parse(time.RFC3339Nano, resp.Header.Get(BackupTimeHeader))
+	if err != nil {
+		return false, fmt.Errorf("backup holder sent no valid %s header", BackupTimeHeader)
+	}
+	s.mu.RLock()
+	restored := s.snapshotTime
+	s.mu.RUnlock()
+	if !always && !taken.After(restored) {
+		s.logger.Info("local snapshot is newer than the peer's backup, serving local data", "holder", holder, "backup_time", taken, "snapshot_time", restored)
+		return false, nil
+	}
+
+	s.load.begin("backup from "+holder, max(resp.ContentLength, 0))
+	defer func() { s.load.finish(err) }()
+	hash := sha256.New()
+	body := io.TeeReader(countingReader{r: resp.Body, n: &s.load.bytes}, hash)
+	// The holder sends the file as it wrote it, whatever codec we asked for
+	data, _, err := codec.ForContentType(resp.Header.Get("Content-Type")).Decode(body, &s.load.keys)
+	if err != nil {
+		return false, fmt.Errorf("error reading backup: %w", err)
+	}
+	if sum := resp.Header.Get(BackupChecksumHeader); sum != "" {
+		io.Copy(hash, body)
+		if checksum(hash.Sum(nil)) != sum {
+			return false, ErrPeerBackupCorrupt
+		}
+	}
+	// The keys' TTLs, and the keys deleted since the backup was taken, are
+	// kept next to it
+	var dropped int
+	var deadlines map[string]time.Time
+	var tombstones TombstonesResponse
+	if err := s.primaryRequest(ctx, holder, path+"&tombstones=true", &tombstones); err != nil {
+		s.logger.Warn("error fetching the backup's tombstones, keys keep no TTL", "holder", holder, "err", err)
+	} else {
+		dropped, deadlines = applyTombstoneTimes(tombstones.Tombstones, taken, data)
+	}
+	s.load.setPhase(LoadIndexing)
+	prepared := s.prepareData(data, deadlines)
+	s.mu.Lock()
+	s.replaceData(prepared)
+	s.mu.Unlock()
+	s.logger.Info("warmed up from peer backup", "holder", holder, "keys", len(data), "backup_time", taken, "tombstoned", dropped)
+	return true, nil
+}
+
+// SetWarming records whether the store is still loading its data from its
+// peer. A warming store is not ready and refuses to be backed up, so its
+// peer keeps the backup it is warming up from.
+func (h *KVStoreHandler) SetWarming(warming bool) {
+	h.warming.Store(warming)
+}
+
+// BackupHandler: GET /backup?of=<host:port>[&tombstones=true]
+// Streams the backup this store holds of the store at the given address in the codec it was written in,
+// with its time and checksum in headers; 404 if it holds none. With tombstones, returns instead the
+// tombstones and TTL deadlines kept with the backup.
+func (h *KVStoreHandler) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("tombstones") == "true" {
+		tombstones, err := h.kvstore.peerBackupTombstones(r.URL.Query().Get("of"))
+		if errors.Is(err, ErrNoPeerBackup) {
+			httpapi.Error(w, "No backup of that store is held here", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			httpapi.Error(w, "Failed to read the backup's tombstones", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, TombstonesResponse{Tombstones: tombstones})
+		return
+	}
+	file, meta, err := h.kvstore.openPeerBackup(r.URL.Query().Get("of"))
+	if errors.Is(err, ErrNoPeerBackup) {
+		httpapi.Error(w, "No backup of that store is held here", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpapi.Error(w, "Failed to open peer backup", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	backupCodec, err := codec.Lookup(meta.Codec)
+	if err != nil {
+		httpapi.Error(w, "Peer backup is in an unknown codec", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", backupCodec.ContentType())
+	w.Header().Set(BackupTimeHeader, meta.Taken.Format(time.RFC3339Nano))
+	w.Header().Set(BackupChecksumHeader, meta.Checksum)
+	if info, err := file.Stat(); err == nil {
+		// Lets the puller report its progress
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	if meta.Peer != "" {
+		w.Header().Set(StoreNameHeader, meta.Peer)
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		h.logger.Warn("failed to stream peer backup", "err", err)
+	}
+}
@@ -0,0 +1,50 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"kv/httpapi"
+	"net/http"
+)
+
+// WatchHandler: GET /watch?prefix=<p>
+// Streams the store's mutations as they happen, one JSON event per line. The
+// stream ends if the watcher falls too far behind to be sent every event;
+// reconnect and catch up from /changes using the last seq seen.
+func (h *KVStoreHandler) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpapi.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sub := h.kvstore.Events().Subscribe(r.URL.Query().Get("prefix"), DefaultEventBuffer)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				return // the store is shutting down
+			}
+			if sub.Dropped() > 0 {
+				h.logger.Warn("watcher fell behind, ending stream", "dropped", sub.Dropped())
+				return
+			}
+			if err := enc.Encode(event); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
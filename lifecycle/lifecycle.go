@@ -0,0 +1,121 @@
+// Package lifecycle owns the background goroutines of a server, such as
+// periodic snapshots and health checks, so they start and stop with it: a
+// loop started again replaces the one running rather than stacking up, and
+// Close stops every goroutine and waits for it to return.
+package lifecycle
+
+import (
+	"context"
+	"sync"
+)
+
+// task is a goroutine started under a name.
+type task struct {
+	cancel context.CancelFunc
+}
+
+// Group runs background goroutines under one context.
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	tasks   map[string]*task
+	running int
+	closed  bool
+}
+
+// New returns a group ready to run goroutines.
+func New() *Group {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Group{ctx: ctx, cancel: cancel, tasks: make(map[string]*task)}
+}
+
+// Go runs fn in a goroutine. Its context is cancelled when the group is
+// closed, and fn should then return. It reports false, without running fn,
+// if the group is already closed.
+func (g *Group) Go(fn func(ctx context.Context)) bool {
+	return g.start("", fn)
+}
+
+// Start is Go for a goroutine that runs under name, such as a periodic
+// loop. The goroutine already running under name is stopped, and Stop stops
+// this one.
+func (g *Group) Start(name string, fn func(ctx context.Context)) bool {
+	return g.start(name, fn)
+}
+
+func (g *Group) start(name string, fn func(ctx context.Context)) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	ctx, cancel := context.WithCancel(g.ctx)
+	t := &task{cancel: cancel}
+	if name != "" {
+		if old := g.tasks[name]; old != nil {
+			old.cancel()
+		}
+		g.tasks[name] = t
+	}
+	g.running++
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer cancel()
+		fn(ctx)
+		g.mu.Lock()
+		g.running--
+		if name != "" && g.tasks[name] == t {
+			delete(g.tasks, name)
+		}
+		g.mu.Unlock()
+	}()
+	return true
+}
+
+// Stop cancels the context of the goroutine running under name, without
+// waiting for it to return. It reports whether one was running.
+func (g *Group) Stop(name string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	t := g.tasks[name]
+	if t == nil {
+		return false
+	}
+	t.cancel()
+	delete(g.tasks, name)
+	return true
+}
+
+// Running reports whether a goroutine is running under name.
+func (g *Group) Running(name string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.tasks[name] != nil
+}
+
+// Len returns how many goroutines are running, stopped ones that have not
+// returned yet included.
+func (g *Group) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.running
+}
+
+// Done is closed when the group is closed.
+func (g *Group) Done() <-chan struct{} {
+	return g.ctx.Done()
+}
+
+// Close cancels every goroutine's context and waits for them all to
+// return. Nothing can be started afterwards. It is safe to call twice.
+func (g *Group) Close() {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	g.cancel()
+	g.wg.Wait()
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPMetrics records request counts and latencies for HTTP routes.
+type HTTPMetrics struct {
+	requests *CounterVec
+	latency  *HistogramVec
+}
+
+// NewHTTPMetrics registers the per-route request metrics under the given prefix (e.g. "broker").
+func NewHTTPMetrics(r *Registry, prefix string) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: r.NewCounterVec(prefix+"_http_requests_total", "Total HTTP requests by route, method and status code.", "route", "method", "code"),
+		latency:  r.NewHistogramVec(prefix+"_http_request_duration_seconds", "HTTP request latency by route.", nil, "route"),
+	}
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Instrument wraps next so that every request to route is counted and timed.
+func (m *HTTPMetrics) Instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		m.requests.Inc(route, r.Method, strconv.Itoa(rec.status))
+		m.latency.ObserveSince(start, route)
+	}
+}
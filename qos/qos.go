@@ -0,0 +1,240 @@
+// Package qos throttles background work, such as snapshots, peer backups
+// and moving keys between stores, so it does not compete with user traffic.
+package qos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kv/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit caps the rate of background work. A zero field is not limited.
+type Limit struct {
+	// BytesPerSecond caps the data written or sent.
+	BytesPerSecond int64 `json:"bytes_per_second,omitempty"`
+	// OpsPerSecond caps the keys handled.
+	OpsPerSecond int64 `json:"ops_per_second,omitempty"`
+	// DiskBytesPerSecond caps the data written to disk, such as snapshots
+	// and peer backup files, on top of BytesPerSecond.
+	DiskBytesPerSecond int64 `json:"disk_bytes_per_second,omitempty"`
+	// OffPeak is a daily window, in local time such as "01:00-05:00", in
+	// which background work is not limited, so heavy work run then
+	// finishes sooner. It may span midnight.
+	OffPeak string `json:"off_peak,omitempty"`
+}
+
+// Validate reports a negative rate or a malformed off-peak window.
+func (l Limit) Validate() error {
+	var errs []error
+	if l.BytesPerSecond < 0 || l.OpsPerSecond < 0 || l.DiskBytesPerSecond < 0 {
+		errs = append(errs, errors.New("background rates cannot be negative"))
+	}
+	if l.OffPeak != "" {
+		if _, _, err := parseWindow(l.OffPeak); err != nil {
+			errs = append(errs, fmt.Errorf("off_peak: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseWindow parses a daily window such as "01:00-05:00" into its start
+// and end as offsets from midnight.
+func parseWindow(s string) (start, end time.Duration, err error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not a window such as \"01:00-05:00\"", s)
+	}
+	if start, err = parseClock(from); err == nil {
+		end, err = parseClock(to)
+	}
+	if err == nil && start == end {
+		err = fmt.Errorf("%q is empty", s)
+	}
+	return start, end, err
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day such as \"01:00\"", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// inWindow reports whether now falls in the daily window s, which must be
+// valid; an empty window contains no time.
+func inWindow(s string, now time.Time) bool {
+	start, end, err := parseWindow(s)
+	if s == "" || err != nil {
+		return false
+	}
+	y, m, d := now.Date()
+	offset := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+	if start < end {
+		return offset >= start && offset < end
+	}
+	return offset >= start || offset < end
+}
+
+// bucket is a token bucket holding up to one second of its rate. Taking
+// more than it holds is allowed; the taker then waits until the debt is
+// paid back, so work larger than the burst still goes through at the rate.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes n tokens at rate and returns how long to wait before going on.
+func (b *bucket) take(n, rate int64, now time.Time) time.Duration {
+	if rate <= 0 || n <= 0 {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	}
+	b.tokens = min(b.tokens, float64(rate))
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// Limiter paces background work to a Limit. Its zero value, and a nil
+// *Limiter, do not limit.
+type Limiter struct {
+	mu        sync.Mutex
+	limit     Limit
+	bytes     bucket
+	ops       bucket
+	disk      bucket
+	throttled *metrics.CounterVec
+}
+
+// NewLimiter returns a limiter pacing work to limit. If reg is not nil, the
+// time work was held back is counted in prefix_background_throttled_seconds_total.
+func NewLimiter(limit Limit, reg *metrics.Registry, prefix string) *Limiter {
+	l := &Limiter{limit: limit}
+	if reg != nil {
+		l.throttled = reg.NewCounterVec(prefix+"_background_throttled_seconds_total", "Time background work was held back to stay within its rate, by operation.", "op")
+	}
+	return l
+}
+
+// SetLimit changes the limit for work from now on.
+func (l *Limiter) SetLimit(limit Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+}
+
+// Limit returns the current limit.
+func (l *Limiter) Limit() Limit {
+	if l == nil {
+		return Limit{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Wait blocks until ops keys and bytes bytes of the operation op may go
+// ahead, or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, op string, ops, bytes int) error {
+	return l.wait(ctx, op, ops, bytes, 0)
+}
+
+// wait is Wait for work that also writes disk bytes to disk.
+func (l *Limiter) wait(ctx context.Context, op string, ops, bytes, disk int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if inWindow(l.limit.OffPeak, now) {
+		l.mu.Unlock()
+		return nil
+	}
+	delay := max(l.ops.take(int64(ops), l.limit.OpsPerSecond, now), l.bytes.take(int64(bytes), l.limit.BytesPerSecond, now),
+		l.disk.take(int64(disk), l.limit.DiskBytesPerSecond, now))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	if l.throttled != nil {
+		l.throttled.Add(delay.Seconds(), op)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitPairs is Wait for writing pairs: one op per key, and the bytes of
+// their keys and values.
+func (l *Limiter) WaitPairs(ctx context.Context, op string, pairs map[string]string) error {
+	bytes := 0
+	for key, value := range pairs {
+		bytes += len(key) + len(value)
+	}
+	return l.Wait(ctx, op, len(pairs), bytes)
+}
+
+// Writer returns w paced to the limiter's byte rate for the operation op.
+func (l *Limiter) Writer(ctx context.Context, op string, w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &writer{ctx: ctx, op: op, w: w, l: l}
+}
+
+// DiskWriter is Writer for a file, paced to the disk byte rate as well.
+func (l *Limiter) DiskWriter(ctx context.Context, op string, w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &writer{ctx: ctx, op: op, w: w, l: l, disk: true}
+}
+
+// writeChunk is the most written to the underlying writer at once, so a
+// large write is paced smoothly rather than sent in one burst after a wait.
+const writeChunk = 32 << 10
+
+type writer struct {
+	ctx  context.Context
+	op   string
+	w    io.Writer
+	l    *Limiter
+	disk bool // also paced to the disk byte rate
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), writeChunk)]
+		disk := 0
+		if w.disk {
+			disk = len(chunk)
+		}
+		if err := w.l.wait(w.ctx, w.op, 0, len(chunk), disk); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
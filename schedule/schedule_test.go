@@ -0,0 +1,120 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// at parses a time such as "2026-10-16 10:30" in UTC.
+func at(t *testing.T, s string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestNext(t *testing.T) {
+	// 2026-10-16 is a Friday
+	tests := []struct {
+		name  string
+		spec  string
+		after string
+		want  string
+	}{
+		{"every minute", "* * * * *", "2026-10-16 10:30", "2026-10-16 10:31"},
+		{"later today", "0 2 * * *", "2026-10-16 01:59", "2026-10-16 02:00"},
+		{"tomorrow", "0 2 * * *", "2026-10-16 10:30", "2026-10-17 02:00"},
+		{"strictly after", "0 2 * * *", "2026-10-16 02:00", "2026-10-17 02:00"},
+
+		{"hour range", "0 9-17 * * *", "2026-10-16 12:00", "2026-10-16 13:00"},
+		{"past the hour range", "0 9-17 * * *", "2026-10-16 17:00", "2026-10-17 09:00"},
+		{"minute range", "10-12 * * * *", "2026-10-16 10:12", "2026-10-16 11:10"},
+
+		{"step", "*/15 * * * *", "2026-10-16 10:31", "2026-10-16 10:45"},
+		{"step into the next hour", "*/15 * * * *", "2026-10-16 10:50", "2026-10-16 11:00"},
+		{"range with a step", "0 8-18/4 * * *", "2026-10-16 12:00", "2026-10-16 16:00"},
+		{"past a range with a step", "0 8-18/4 * * *", "2026-10-16 16:00", "2026-10-17 08:00"},
+		{"value with a step", "5/20 * * * *", "2026-10-16 10:45", "2026-10-16 11:05"},
+
+		{"list", "0,30 * * * *", "2026-10-16 10:00", "2026-10-16 10:30"},
+		{"list of values, ranges and steps", "0 1,5-6,22/2 * * *", "2026-10-16 06:00", "2026-10-16 22:00"},
+
+		{"day of week", "0 0 * * 1", "2026-10-16 10:00", "2026-10-19 00:00"},
+		{"7 is Sunday", "0 0 * * 7", "2026-10-16 10:00", "2026-10-18 00:00"},
+		{"0 is Sunday", "0 0 * * 0", "2026-10-16 10:00", "2026-10-18 00:00"},
+		{"day of month", "0 0 1 * *", "2026-10-16 10:00", "2026-11-01 00:00"},
+		{"day of week or month: the weekday first", "0 0 20 * 1", "2026-10-16 10:00", "2026-10-19 00:00"},
+		{"day of week or month: the day first", "0 0 20 * 1", "2026-10-19 00:00", "2026-10-20 00:00"},
+		{"day of week or month: neither restricted alone", "0 0 16 * 1", "2026-10-16 00:00", "2026-10-19 00:00"},
+
+		{"next month", "30 12 5 * *", "2026-10-16 10:00", "2026-11-05 12:30"},
+		{"skips months too short", "0 0 31 * *", "2026-10-31 00:00", "2026-12-31 00:00"},
+		{"month range", "0 0 1 2-3 *", "2026-03-01 00:00", "2027-02-01 00:00"},
+		{"next year", "0 0 1 1 *", "2026-10-16 10:00", "2027-01-01 00:00"},
+		{"last minute of the year", "59 23 31 12 *", "2026-12-31 23:59", "2027-12-31 23:59"},
+		{"into the new year", "* * * * *", "2026-12-31 23:59", "2027-01-01 00:00"},
+		{"leap day", "0 0 29 2 *", "2026-10-16 10:00", "2028-02-29 00:00"},
+
+		{"@hourly", "@hourly", "2026-10-16 10:30", "2026-10-16 11:00"},
+		{"@daily", "@daily", "2026-10-16 10:30", "2026-10-17 00:00"},
+		{"@weekly", "@weekly", "2026-10-16 10:30", "2026-10-18 00:00"},
+		{"@monthly", "@monthly", "2026-10-16 10:30", "2026-11-01 00:00"},
+		{"@yearly", "@yearly", "2026-10-16 10:30", "2027-01-01 00:00"},
+		{"@every", "@every 90m", "2026-10-16 10:30", "2026-10-16 12:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.spec, err)
+			}
+			if got, want := s.Next(at(t, tt.after)), at(t, tt.want); !got.Equal(want) {
+				t.Errorf("Parse(%q).Next(%s) = %s, want %s", tt.spec, tt.after, got.Format(time.DateTime), want.Format(time.DateTime))
+			}
+		})
+	}
+}
+
+func TestNextSkipsSeconds(t *testing.T) {
+	s, err := Parse("*/5 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := at(t, "2026-10-16 10:04").Add(59*time.Second + time.Millisecond)
+	if got, want := s.Next(after), at(t, "2026-10-16 10:05"); !got.Equal(want) {
+		t.Errorf("Next(%s) = %s, want %s", after, got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"-1 * * * *",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"a * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1,,2 * * * *",
+		"0 0 30 2 *",
+		"@often",
+		"@every",
+		"@every soon",
+		"@every 500ms",
+	} {
+		if s, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) = %v, want an error", spec, s)
+		}
+	}
+}
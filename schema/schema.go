@@ -0,0 +1,351 @@
+// Package schema checks JSON documents against a JSON Schema. It supports
+// the keywords most used to describe a value's shape: type, enum, const,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// minLength, maxLength, pattern, minimum, maximum, exclusiveMinimum and
+// exclusiveMaximum. A schema using any other validation keyword, such as
+// $ref or oneOf, is refused rather than partly applied.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// annotations are keywords that describe a schema without constraining
+// documents, and are ignored.
+var annotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true,
+	"description": true, "default": true, "examples": true,
+}
+
+// Schema is a parsed JSON Schema.
+type Schema struct {
+	always *bool // set for the schemas true and false
+
+	types            []string
+	enum             []interface{}
+	constant         interface{}
+	hasConst         bool
+	properties       map[string]*Schema
+	required         []string
+	additional       *Schema // nil allows any additional property
+	items            *Schema
+	minItems         *float64
+	maxItems         *float64
+	minLength        *float64
+	maxLength        *float64
+	pattern          *regexp.Regexp
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+}
+
+// Parse parses a JSON Schema.
+func Parse(data []byte) (*Schema, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %w", err)
+	}
+	return parse(v, "")
+}
+
+func parse(v interface{}, path string) (*Schema, error) {
+	if b, ok := v.(bool); ok {
+		return &Schema{always: &b}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema%s must be an object or a boolean", at(path))
+	}
+	s := &Schema{}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value := m[k]
+		var err error
+		switch k {
+		case "type":
+			s.types, err = parseTypes(value)
+		case "enum":
+			list, ok := value.([]interface{})
+			if !ok {
+				err = errors.New("must be an array")
+			}
+			s.enum = list
+		case "const":
+			s.constant, s.hasConst = value, true
+		case "properties":
+			props, ok := value.(map[string]interface{})
+			if !ok {
+				err = errors.New("must be an object")
+				break
+			}
+			s.properties = make(map[string]*Schema, len(props))
+			for name, sub := range props {
+				if s.properties[name], err = parse(sub, path+"/properties/"+name); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			s.required, err = parseStrings(value)
+		case "additionalProperties":
+			s.additional, err = parse(value, path+"/additionalProperties")
+			if err != nil {
+				return nil, err
+			}
+		case "items":
+			if s.items, err = parse(value, path+"/items"); err != nil {
+				return nil, err
+			}
+		case "minItems":
+			s.minItems, err = parseCount(value)
+		case "maxItems":
+			s.maxItems, err = parseCount(value)
+		case "minLength":
+			s.minLength, err = parseCount(value)
+		case "maxLength":
+			s.maxLength, err = parseCount(value)
+		case "pattern":
+			p, ok := value.(string)
+			if !ok {
+				err = errors.New("must be a string")
+				break
+			}
+			s.pattern, err = regexp.Compile(p)
+		case "minimum":
+			s.minimum, err = parseNumber(value)
+		case "maximum":
+			s.maximum, err = parseNumber(value)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = parseNumber(value)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = parseNumber(value)
+		default:
+			if !annotations[k] {
+				err = errors.New("is not supported")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("schema%s: %q %w", at(path), k, err)
+		}
+	}
+	return s, nil
+}
+
+// typeNames are the values of the type keyword.
+var typeNames = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+func parseTypes(v interface{}) ([]string, error) {
+	if name, ok := v.(string); ok {
+		v = []interface{}{name}
+	}
+	names, err := parseStrings(v)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !typeNames[name] {
+			return nil, fmt.Errorf("names unknown type %q", name)
+		}
+	}
+	return names, nil
+}
+
+func parseStrings(v interface{}) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("must be an array of strings")
+	}
+	strs := make([]string, len(list))
+	for i, item := range list {
+		if strs[i], ok = item.(string); !ok {
+			return nil, errors.New("must be an array of strings")
+		}
+	}
+	return strs, nil
+}
+
+func parseNumber(v interface{}) (*float64, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return nil, errors.New("must be a number")
+	}
+	return &f, nil
+}
+
+func parseCount(v interface{}) (*float64, error) {
+	f, err := parseNumber(v)
+	if err != nil || *f < 0 || *f != math.Trunc(*f) {
+		return nil, errors.New("must be a non-negative integer")
+	}
+	return f, nil
+}
+
+// Validate reports whether document is JSON satisfying the schema. The error
+// names the first place it does not, as a JSON pointer.
+func (s *Schema) Validate(document []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(document))
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("value is not valid JSON: %w", err)
+	}
+	if dec.More() {
+		return errors.New("value is not valid JSON: more than one value")
+	}
+	return s.check(v, "")
+}
+
+func (s *Schema) check(v interface{}, path string) error {
+	if s.always != nil {
+		if !*s.always {
+			return fmt.Errorf("value%s is not allowed", at(path))
+		}
+		return nil
+	}
+	if len(s.types) > 0 && !matchesType(v, s.types) {
+		return fmt.Errorf("value%s is %s, not %s", at(path), typeOf(v), strings.Join(s.types, " or "))
+	}
+	if s.enum != nil && !contains(s.enum, v) {
+		return fmt.Errorf("value%s is not one of the allowed values", at(path))
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, v) {
+		return fmt.Errorf("value%s is not the required value", at(path))
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return s.checkObject(v, path)
+	case []interface{}:
+		if s.minItems != nil && float64(len(v)) < *s.minItems {
+			return fmt.Errorf("value%s has fewer than %g items", at(path), *s.minItems)
+		}
+		if s.maxItems != nil && float64(len(v)) > *s.maxItems {
+			return fmt.Errorf("value%s has more than %g items", at(path), *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range v {
+				if err := s.items.check(item, fmt.Sprintf("%s/%d", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := float64(utf8.RuneCountInString(v))
+		if s.minLength != nil && n < *s.minLength {
+			return fmt.Errorf("value%s is shorter than %g characters", at(path), *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return fmt.Errorf("value%s is longer than %g characters", at(path), *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("value%s does not match %q", at(path), s.pattern)
+		}
+	case float64:
+		switch {
+		case s.minimum != nil && v < *s.minimum:
+			return fmt.Errorf("value%s is less than %g", at(path), *s.minimum)
+		case s.maximum != nil && v > *s.maximum:
+			return fmt.Errorf("value%s is greater than %g", at(path), *s.maximum)
+		case s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum:
+			return fmt.Errorf("value%s is not greater than %g", at(path), *s.exclusiveMinimum)
+		case s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum:
+			return fmt.Errorf("value%s is not less than %g", at(path), *s.exclusiveMaximum)
+		}
+	}
+	return nil
+}
+
+func (s *Schema) checkObject(v map[string]interface{}, path string) error {
+	for _, name := range s.required {
+		if _, ok := v[name]; !ok {
+			return fmt.Errorf("value%s is missing required property %q", at(path), name)
+		}
+	}
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub, ok := s.properties[name]
+		if !ok {
+			sub = s.additional
+		}
+		if sub == nil {
+			continue
+		}
+		if err := sub.check(v[name], path+"/"+escape(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchesType(v interface{}, types []string) bool {
+	actual := typeOf(v)
+	for _, t := range types {
+		if t == actual || t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf returns the JSON Schema type of a decoded value; whole numbers are
+// integers.
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+func contains(list []interface{}, v interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// at formats a JSON pointer for an error message; the document itself has
+// none.
+func at(path string) string {
+	if path == "" {
+		return ""
+	}
+	return " at " + path
+}
+
+// escape escapes a property name for a JSON pointer.
+func escape(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,69 @@
+// Package singleflight collapses concurrent calls for the same key into one,
+// so a burst of requests for a key that is not at hand costs a single fetch.
+package singleflight
+
+import "sync"
+
+// call is a fetch in flight, or just done.
+type call[V any] struct {
+	done    chan struct{}
+	value   V
+	err     error
+	waiters int // calls that shared the result, besides the first
+}
+
+// Group runs at most one fetch per key at a time. Its zero value is ready
+// to use.
+type Group[V any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[V]
+}
+
+// Do runs fetch and returns its result, unless a fetch for key is already
+// in flight; then it waits for that one and returns its result instead.
+// shared reports whether the result went to more than one caller.
+func (g *Group[V]) Do(key string, fetch func() (V, error)) (value V, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call[V])
+	}
+	if c, ok := g.calls[key]; ok {
+		c.waiters++
+		g.mu.Unlock()
+		<-c.done
+		return c.value, c.err, true
+	}
+	c := &call[V]{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		shared = c.waiters > 0
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.value, c.err = fetch()
+	return c.value, c.err, false
+}
+
+// Forget makes later calls for the keys run a fetch of their own rather
+// than wait for one already in flight, e.g. because the keys have changed
+// since it started. Calls already waiting still share its result.
+func (g *Group[V]) Forget(keys ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range keys {
+		delete(g.calls, key)
+	}
+}
+
+// InFlight returns how many keys are being fetched.
+func (g *Group[V]) InFlight() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.calls)
+}
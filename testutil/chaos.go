@@ -0,0 +1,102 @@
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ChaosOptions configures RunChaos.
+type ChaosOptions struct {
+	// Writers is the number of goroutines writing keys concurrently.
+	Writers int
+	// Duration is how long writes are issued for.
+	Duration time.Duration
+	// KillAfter is when, after writes start, a random store is crashed.
+	KillAfter time.Duration
+	// BackupInterval is how often the stores snapshot and back up their peers.
+	BackupInterval time.Duration
+}
+
+// ChaosReport is the outcome of RunChaos.
+type ChaosReport struct {
+	// Killed is the name of the crashed store.
+	Killed string
+	// Acknowledged is the number of writes the broker reported as successful.
+	Acknowledged int
+	// Failed is the number of writes that returned an error.
+	Failed int
+	// Lost lists acknowledged keys that could not be read back, or were
+	// read back with the wrong value, after failover.
+	Lost []string
+}
+
+// RunChaos writes unique keys through the broker while crashing one store
+// part-way through, then reads every acknowledged key back. A sound cluster
+// reports no Lost keys; keys written to the crashed store after its last
+// peer backup show up there.
+func RunChaos(ctx context.Context, c *Cluster, opts ChaosOptions) (ChaosReport, error) {
+	var report ChaosReport
+	if len(c.Stores) < 2 {
+		return report, fmt.Errorf("chaos needs at least two stores, have %d", len(c.Stores))
+	}
+	if opts.Writers < 1 {
+		opts.Writers = 1
+	}
+	for _, s := range c.Stores {
+		s.KV.StartPeriodicSnapshots(opts.BackupInterval)
+	}
+
+	cl := c.Client()
+	var (
+		mu    sync.Mutex
+		acked = make(map[string]string)
+		wg    sync.WaitGroup
+	)
+	deadline := time.Now().Add(opts.Duration)
+	for w := 0; w < opts.Writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; time.Now().Before(deadline) && ctx.Err() == nil; i++ {
+				key := fmt.Sprintf("chaos-%d-%d", w, i)
+				value := fmt.Sprint(i)
+				err := cl.Set(ctx, key, value)
+				mu.Lock()
+				if err == nil {
+					acked[key] = value
+				} else {
+					report.Failed++
+				}
+				mu.Unlock()
+			}
+		}(w)
+	}
+
+	select {
+	case <-time.After(opts.KillAfter):
+	case <-ctx.Done():
+	}
+	victim := c.Stores[rand.N(len(c.Stores))]
+	report.Killed = victim.Name
+	if err := c.StopStore(victim.Name); err != nil {
+		return report, err
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	report.Acknowledged = len(acked)
+	for key, value := range acked {
+		got, err := cl.Get(ctx, key)
+		if err != nil || got != value {
+			report.Lost = append(report.Lost, key)
+		}
+	}
+	sort.Strings(report.Lost)
+	return report, nil
+}
@@ -0,0 +1,35 @@
+package testutil
+
+import (
+	"context"
+	"kv/client"
+	"testing"
+	"time"
+)
+
+func TestChaosLosesNoReplicatedWrite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("crashes a store mid-run")
+	}
+	c := New(t, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// A write acknowledged as replicated is on the crashed store's backup
+	// holder, so failover brings every one of them back
+	report, err := RunChaos(client.WithAck(ctx, client.AckReplicated), c, ChaosOptions{
+		Writers:        4,
+		Duration:       time.Second,
+		KillAfter:      300 * time.Millisecond,
+		BackupInterval: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("RunChaos: %v", err)
+	}
+	if report.Acknowledged == 0 {
+		t.Fatalf("no write was acknowledged (%d failed)", report.Failed)
+	}
+	if len(report.Lost) > 0 {
+		t.Errorf("%d of %d acknowledged writes lost after crashing %s: %v", len(report.Lost), report.Acknowledged, report.Killed, report.Lost)
+	}
+}
@@ -0,0 +1,239 @@
+// Package testutil starts throwaway clusters for end-to-end tests: a broker
+// and a number of stores, each on its own ServeMux and a random local port,
+// registered with each other exactly as the kv binary does it.
+package testutil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"kv/broker"
+	"kv/client"
+	"kv/kvstore"
+	"net"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Store is one running store of a Cluster.
+type Store struct {
+	Name string
+	// Addr is the host:port the store is registered under.
+	Addr    string
+	KV      *kvstore.KVStore
+	Handler *kvstore.KVStoreHandler
+
+	server  *httptest.Server
+	stopped bool
+}
+
+// Cluster is a broker and its stores running in this process.
+type Cluster struct {
+	Broker *broker.Broker
+	// BrokerURL is the base URL of the broker, e.g. "http://127.0.0.1:43121".
+	BrokerURL string
+	Stores    []*Store
+
+	mu         sync.Mutex
+	server     *httptest.Server
+	adminToken string
+	dir        string // holds the stores' files
+}
+
+// Start starts a broker and n stores and registers the stores. Snapshot,
+// journal and peer backup files are written to a temporary directory, which
+// Close removes.
+func Start(n int) (*Cluster, error) {
+	dir, err := os.MkdirTemp("", "kv-cluster-")
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{Broker: broker.NewBroker(), adminToken: newToken(), dir: dir}
+	c.Broker.SetAdminToken(c.adminToken)
+	c.server = httptest.NewServer(broker.NewBrokerHandler(c.Broker))
+	c.BrokerURL = c.server.URL
+
+	for i := 0; i < n; i++ {
+		if _, err := c.AddStore(); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// New is Start for tests: it fails t if the cluster cannot be started and
+// closes the cluster when the test finishes.
+func New(t testing.TB, n int) *Cluster {
+	t.Helper()
+	c, err := Start(n)
+	if err != nil {
+		t.Fatalf("starting cluster: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// AddStore starts another store and registers it with the broker.
+func (c *Cluster) AddStore() (*Store, error) {
+	// The handler is set once the store, which is named after the port, exists
+	server := httptest.NewUnstartedServer(nil)
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	c.mu.Lock()
+	name := fmt.Sprintf("store%d-%s", len(c.Stores)+1, port)
+	c.mu.Unlock()
+
+	store, err := c.startStore(name, server)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.Stores = append(c.Stores, store)
+	c.mu.Unlock()
+	return store, nil
+}
+
+// RestartStore starts the named stopped store again, empty, on a new port
+// and registers it with the broker under the same name, as a store
+// listening on port 0 does when it restarts.
+func (c *Cluster) RestartStore(name string) (*Store, error) {
+	old := c.Store(name)
+	if old == nil {
+		return nil, fmt.Errorf("store %q not found", name)
+	}
+	c.mu.Lock()
+	stopped := old.stopped
+	c.mu.Unlock()
+	if !stopped {
+		return nil, fmt.Errorf("store %q is still running", name)
+	}
+
+	server := httptest.NewUnstartedServer(nil)
+	store, err := c.startStore(name, server)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	for i, s := range c.Stores {
+		if s == old {
+			c.Stores[i] = store
+		}
+	}
+	c.mu.Unlock()
+	return store, nil
+}
+
+// startStore serves a store named name on server and registers it.
+func (c *Cluster) startStore(name string, server *httptest.Server) (*Store, error) {
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	kv := kvstore.NewKVStore(name, port)
+	kv.SetDataDir(c.dir)
+	handler := kvstore.NewKVStoreHandler(kv)
+	handler.EnableFaultInjection(func() { c.StopStore(name) })
+	// The broker shuts stores down when they are removed
+	handler.EnableShutdown(c.adminToken, func() {
+		c.StopStore(name)
+		kv.Close()
+	})
+	server.Config.Handler = handler
+	handler.SetSnapshotLoaded(true)
+	server.Start()
+
+	store := &Store{Name: name, Addr: kv.IPAddress, KV: kv, Handler: handler, server: server}
+	if err := kvstore.RegisterWithBrokerToken(c.BrokerURL+"/v1/register", name, store.Addr, c.adminToken); err != nil {
+		server.Close()
+		return nil, fmt.Errorf("registering %s: %w", name, err)
+	}
+	handler.SetRegistered(true)
+	return store, nil
+}
+
+// Client returns a client for the cluster's broker.
+func (c *Cluster) Client() *client.Client {
+	return client.New(c.BrokerURL)
+}
+
+// Store returns the named store, or nil.
+func (c *Cluster) Store(name string) *Store {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.Stores {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// BackUpPeers makes every running store copy the data of the stores it backs up, as
+// the periodic snapshot loop does, so a failed store's keys can be recovered.
+func (c *Cluster) BackUpPeers() {
+	c.mu.Lock()
+	var running []*kvstore.KVStore
+	for _, s := range c.Stores {
+		if !s.stopped {
+			running = append(running, s.KV)
+		}
+	}
+	c.mu.Unlock()
+	for _, kv := range running {
+		kv.BackUpPeers()
+	}
+}
+
+// SetFaults injects latency and dropped requests into the store.
+func (s *Store) SetFaults(f kvstore.Faults) {
+	s.Handler.SetFaults(f)
+}
+
+// StopStore shuts the named store's server down abruptly, as if it had
+// crashed. The broker is not told; it notices on its next call to the store.
+func (c *Cluster) StopStore(name string) error {
+	s := c.Store(name)
+	if s == nil {
+		return fmt.Errorf("store %q not found", name)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !s.stopped {
+		s.server.CloseClientConnections()
+		s.server.Close()
+		s.stopped = true
+	}
+	return nil
+}
+
+// Close stops every server and removes the cluster's files.
+func (c *Cluster) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.Stores {
+		s.KV.StopPeriodicSnapshots()
+		s.KV.Events().Close() // ends /watch streams, which Close would wait for
+		if !s.stopped {
+			s.server.Close()
+			s.stopped = true
+		}
+	}
+	c.server.Close()
+	c.Broker.Close()
+	os.RemoveAll(c.dir)
+}
+
+// newToken returns a random admin token for a cluster.
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
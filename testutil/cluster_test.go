@@ -0,0 +1,123 @@
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"kv/kvstore"
+	"testing"
+	"time"
+)
+
+func TestClusterServesWritesAcrossStores(t *testing.T) {
+	c := New(t, 3)
+	cl := c.Client()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for i := 0; i < 30; i++ {
+		if err := cl.Set(ctx, fmt.Sprintf("k%d", i), fmt.Sprint(i)); err != nil {
+			t.Fatalf("Set k%d: %v", i, err)
+		}
+	}
+	holding := 0
+	for _, s := range c.Stores {
+		if s.KV.Len() > 0 {
+			holding++
+		}
+	}
+	if holding < 2 {
+		t.Errorf("30 keys went to %d of 3 stores, want them spread", holding)
+	}
+	for i := 0; i < 30; i++ {
+		got, err := cl.Get(ctx, fmt.Sprintf("k%d", i))
+		if err != nil || got != fmt.Sprint(i) {
+			t.Errorf("Get k%d = %q, %v; want %q", i, got, err, fmt.Sprint(i))
+		}
+	}
+}
+
+func TestClusterRecoversStoppedStoreFromBackup(t *testing.T) {
+	c := New(t, 3)
+	cl := c.Client()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for i := 0; i < 30; i++ {
+		if err := cl.Set(ctx, fmt.Sprintf("k%d", i), fmt.Sprint(i)); err != nil {
+			t.Fatalf("Set k%d: %v", i, err)
+		}
+	}
+	c.BackUpPeers()
+
+	victim := c.Stores[0]
+	if victim.KV.Len() == 0 {
+		victim = c.Stores[1]
+	}
+	if err := c.StopStore(victim.Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StopStore(victim.Name); err != nil {
+		t.Fatalf("stopping a stopped store: %v", err)
+	}
+
+	for i := 0; i < 30; i++ {
+		got, err := cl.Get(ctx, fmt.Sprintf("k%d", i))
+		if err != nil || got != fmt.Sprint(i) {
+			t.Errorf("Get k%d after stopping %s = %q, %v; want %q", i, victim.Name, got, err, fmt.Sprint(i))
+		}
+	}
+	if c.Store("missing") != nil {
+		t.Error(`Store("missing") != nil`)
+	}
+	if err := c.StopStore("missing"); err == nil {
+		t.Error(`StopStore("missing") succeeded`)
+	}
+}
+
+func TestClusterTakesStoreRestartedOnNewPort(t *testing.T) {
+	c := New(t, 2)
+	cl := c.Client()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := c.Stores[0].Name
+	if _, err := c.RestartStore(name); err == nil {
+		t.Fatal("restarted a running store")
+	}
+	if err := c.StopStore(name); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := c.RestartStore(name)
+	if err != nil {
+		t.Fatalf("registering %s again at a new port: %v", name, err)
+	}
+	if restarted.Addr == c.Stores[1].Addr {
+		t.Fatalf("%s restarted at another store's address %s", name, restarted.Addr)
+	}
+	store, err := c.Broker.GetStore(name)
+	if err != nil || store.Address() != restarted.Addr {
+		t.Fatalf("broker has %s at %v, %v; want %s", name, store, err, restarted.Addr)
+	}
+	if _, peer, err := c.Broker.GetStorePeerIP(c.Stores[1].Name); err != nil || peer != name {
+		t.Errorf("peer of %s = %s, %v; want %s", c.Stores[1].Name, peer, err, name)
+	}
+	if addr, _, _ := c.Broker.GetStorePeerIP(c.Stores[1].Name); addr != restarted.Addr {
+		t.Errorf("peer ring has %s at %s, want %s", name, addr, restarted.Addr)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := cl.Set(ctx, fmt.Sprintf("k%d", i), fmt.Sprint(i)); err != nil {
+			t.Fatalf("Set k%d: %v", i, err)
+		}
+	}
+	if restarted.KV.Len() == 0 {
+		t.Errorf("no writes reached %s at its new address", name)
+	}
+
+	// A live store keeps its name
+	other := c.Stores[1]
+	err = kvstore.RegisterWithBrokerToken(c.BrokerURL+"/v1/register", other.Name, restarted.Addr, c.adminToken)
+	if err == nil {
+		t.Errorf("%s registered at %s while it still answers at %s", other.Name, restarted.Addr, other.Addr)
+	}
+}
@@ -0,0 +1,139 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context header used for propagation.
+const TraceparentHeader = "traceparent"
+
+// Span is a single timed operation within a trace. Finished spans are
+// exported as structured log records at debug level.
+type Span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Name     string
+	Start    time.Time
+
+	mu    sync.Mutex
+	attrs []any
+	err   error
+	ended bool
+}
+
+type spanKey struct{}
+
+// Start begins a new span. It becomes a child of the span carried by ctx, or
+// the root of a new trace if ctx carries none.
+func Start(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	span := &Span{
+		SpanID: newID(8),
+		Name:   name,
+		Start:  time.Now(),
+		attrs:  attrs,
+	}
+	if parent := FromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.TraceID = newID(16)
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext returns the span carried by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SetAttributes attaches key/value pairs to the span.
+func (s *Span) SetAttributes(attrs ...any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// RecordError marks the span as failed.
+func (s *Span) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End finishes the span and exports it. Calling End more than once has no effect.
+func (s *Span) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+
+	args := []any{
+		"trace_id", s.TraceID,
+		"span_id", s.SpanID,
+		"span", s.Name,
+		"duration", time.Since(s.Start),
+	}
+	if s.ParentID != "" {
+		args = append(args, "parent_id", s.ParentID)
+	}
+	if s.err != nil {
+		args = append(args, "err", s.err)
+	}
+	args = append(args, s.attrs...)
+	slog.Debug("span finished", args...)
+}
+
+// Inject writes the span carried by ctx into h as a traceparent header.
+func Inject(ctx context.Context, h http.Header) {
+	if span := FromContext(ctx); span != nil {
+		h.Set(TraceparentHeader, fmt.Sprintf("00-%s-%s-01", span.TraceID, span.SpanID))
+	}
+}
+
+// Extract returns a context carrying the remote parent described by the
+// traceparent header in h. Malformed or missing headers leave ctx unchanged.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	parts := strings.Split(h.Get(TraceparentHeader), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	if !isHex(parts[1]) || !isHex(parts[2]) {
+		return ctx
+	}
+	remote := &Span{TraceID: parts[1], SpanID: parts[2], ended: true}
+	return context.WithValue(ctx, spanKey{}, remote)
+}
+
+// Middleware starts a server span for every request, continuing any trace
+// propagated by the caller.
+func Middleware(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := Extract(r.Context(), r.Header)
+		ctx, span := Start(ctx, name, "method", r.Method)
+		defer span.End()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
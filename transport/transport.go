@@ -0,0 +1,124 @@
+// Package transport abstracts the HTTP calls the broker and stores make to
+// each other, so they can be routed in memory instead of over the network.
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Transport sends a request and returns its response. *http.Client satisfies it.
+type Transport interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Memory is a Transport that hands requests directly to in-process handlers
+// registered by address (host:port), without opening sockets. Requests to
+// an address with no handler fail as if the connection had been refused, so
+// unregistering a handler simulates a crashed server.
+type Memory struct {
+	mu       sync.RWMutex
+	handlers map[string]http.Handler
+}
+
+// NewMemory returns a Memory transport with no handlers.
+func NewMemory() *Memory {
+	return &Memory{handlers: make(map[string]http.Handler)}
+}
+
+// Register routes requests for addr to h, replacing any earlier handler.
+func (m *Memory) Register(addr string, h http.Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[addr] = h
+}
+
+// Unregister removes the handler for addr; later requests to it fail.
+func (m *Memory) Unregister(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.handlers, addr)
+}
+
+// Do serves req with the handler registered for its host. A handler that
+// aborts with http.ErrAbortHandler fails the request like a dropped connection.
+func (m *Memory) Do(req *http.Request) (resp *http.Response, err error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	h, ok := m.handlers[req.URL.Host]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", req.URL.Host)
+	}
+
+	// Present the request as a server would see it
+	in := req.Clone(req.Context())
+	in.RequestURI = req.URL.RequestURI()
+	in.RemoteAddr = "memory"
+	if in.Body == nil {
+		in.Body = http.NoBody
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			resp, err = nil, fmt.Errorf("read %s: connection reset by peer", req.URL.Host)
+		}
+	}()
+
+	rec := &recorder{header: make(http.Header)}
+	h.ServeHTTP(rec, in)
+	return rec.response(req), nil
+}
+
+// recorder collects a handler's response in memory. It stands in for
+// httptest.ResponseRecorder, which would link the testing package into the
+// binary.
+type recorder struct {
+	header http.Header
+	body   bytes.Buffer
+	status int
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+// Flush lets streaming handlers run; the body is handed over once they return.
+func (r *recorder) Flush() {
+	r.WriteHeader(http.StatusOK)
+}
+
+// response returns what the handler wrote as the response to req.
+func (r *recorder) response(req *http.Request) *http.Response {
+	r.WriteHeader(http.StatusOK)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.status, http.StatusText(r.status)),
+		StatusCode:    r.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        r.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(r.body.Bytes())),
+		ContentLength: int64(r.body.Len()),
+		Request:       req,
+	}
+}